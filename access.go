@@ -0,0 +1,134 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// parsePrefixes parses CIDRs, accepting bare IPs as single-address ranges.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP or CIDR %q", s)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientAllowed reports whether the request's client may trigger a send.
+// A deny_from match always refuses; with allow_from set, the client must
+// also match one of its ranges.
+func (w *WakeOnLAN) clientAllowed(r *http.Request) bool {
+	if len(w.allowFrom) == 0 && len(w.denyFrom) == 0 {
+		return true
+	}
+	addr, ok := clientAddr(r)
+	if !ok {
+		return false
+	}
+	for _, p := range w.denyFrom {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(w.allowFrom) == 0 {
+		return true
+	}
+	for _, p := range w.allowFrom {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the client IP as determined by Caddy, falling back
+// to the connection's remote address. Every feature telling clients apart
+// goes through it: Caddy takes the IP from the client_ip_headers, such as
+// X-Forwarded-For, only for connections from the server's trusted_proxies,
+// so a client can't pick its own IP by sending the header.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	ip, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if ip == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip = host
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// clientIP is clientAddr as a string for logs and records, empty if the
+// client's IP can't be told.
+func clientIP(r *http.Request) string {
+	if addr, ok := clientAddr(r); ok {
+		return addr.String()
+	}
+	return ""
+}
+
+// parseOUIs parses MAC prefixes in the same formats as MACs (00:11:22,
+// 00-11-22 or 001122) into their three bytes.
+func parseOUIs(list []string) ([][3]byte, error) {
+	ouis := make([][3]byte, 0, len(list))
+	for _, s := range list {
+		cleaned := strings.ReplaceAll(strings.ReplaceAll(s, ":", ""), "-", "")
+		b, err := hex.DecodeString(cleaned)
+		if err != nil || len(b) != 3 {
+			return nil, fmt.Errorf("invalid OUI %q: want three bytes like 00:11:22", s)
+		}
+		ouis = append(ouis, [3]byte{b[0], b[1], b[2]})
+	}
+	return ouis, nil
+}
+
+// errOUINotAllowed refuses a MAC outside allow_oui.
+var errOUINotAllowed = errors.New("MAC not allowed by allow_oui")
+
+// checkOUI returns errOUINotAllowed unless hw starts with an allowed OUI.
+func checkOUI(ouis [][3]byte, hw net.HardwareAddr) error {
+	if !ouiAllowed(ouis, hw) {
+		return fmt.Errorf("%w: %s", errOUINotAllowed, hw)
+	}
+	return nil
+}
+
+// ouiAllowed reports whether hw starts with one of the allowed OUIs. An
+// empty list allows every MAC.
+func ouiAllowed(ouis [][3]byte, hw net.HardwareAddr) bool {
+	if len(ouis) == 0 {
+		return true
+	}
+	if len(hw) < 3 {
+		return false
+	}
+	for _, oui := range ouis {
+		if hw[0] == oui[0] && hw[1] == oui[1] && hw[2] == oui[2] {
+			return true
+		}
+	}
+	return false
+}
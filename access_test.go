@@ -0,0 +1,245 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestParseOUIs(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    [3]byte
+		wantErr bool
+	}{
+		{input: "00:11:22", want: [3]byte{0x00, 0x11, 0x22}},
+		{input: "AA-BB-CC", want: [3]byte{0xaa, 0xbb, 0xcc}},
+		{input: "10ffe0", want: [3]byte{0x10, 0xff, 0xe0}},
+		{input: "00:11", wantErr: true},
+		{input: "00:11:22:33", wantErr: true},
+		{input: "zz:11:22", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			ouis, err := parseOUIs([]string{tt.input})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && ouis[0] != tt.want {
+				t.Errorf("parsed % x, want % x", ouis[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckOUI(t *testing.T) {
+	ouis, err := parseOUIs([]string{"00:11:22", "10:ff:e0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mac  string
+		ouis [][3]byte
+		want bool
+	}{
+		{mac: "00:11:22:33:44:55", ouis: ouis, want: true},
+		{mac: "10:ff:e0:cf:e6:0e", ouis: ouis, want: true},
+		{mac: "00:11:23:33:44:55", ouis: ouis, want: false},
+		{mac: "aa:bb:cc:dd:ee:ff", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mac, func(t *testing.T) {
+			hw, err := net.ParseMAC(tt.mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := checkOUI(tt.ouis, hw) == nil; got != tt.want {
+				t.Errorf("allowed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowOUIConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: "allow_oui 00:11:22 10-ff-e0", want: []string{"00:11:22", "10-ff-e0"}},
+		{input: "allow_oui", wantErr: true},
+		{input: "allow_oui 00:11", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan {\n\tfrom_body\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && strings.Join(w.AllowOUI, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("allow_oui = %v, want %v", w.AllowOUI, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPAllowOUIBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		macs       []string
+		wantStatus int
+		// results per entry, in order
+		want []string
+	}{
+		{name: "allowed", macs: []string{"00:11:22:33:44:55"}, wantStatus: http.StatusOK, want: []string{"sent"}},
+		{name: "refused", macs: []string{"aa:bb:cc:33:44:55"}, wantStatus: http.StatusForbidden, want: []string{"forbidden"}},
+		{name: "mixed", macs: []string{"00:11:22:33:44:55", "aa:bb:cc:33:44:55"}, wantStatus: http.StatusMultiStatus, want: []string{"sent", "forbidden"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{FromBody: true, AllowOUI: []string{"00:11:22"}})
+			var entries []string
+			for _, mac := range tt.macs {
+				entries = append(entries, fmt.Sprintf(`{"mac":%q,"ip":"127.0.0.1","port":%d}`, mac, host.port()))
+			}
+			r := newTestRequest("POST", "http://example.com/", strings.NewReader("["+strings.Join(entries, ",")+"]"))
+			r.Header.Set("Content-Type", "application/json")
+
+			rec, _, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			var results []bulkResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+				t.Fatalf("decoding %q: %v", rec.Body, err)
+			}
+			sent := 0
+			for i, res := range results {
+				if i >= len(tt.want) || res.Result != tt.want[i] {
+					t.Errorf("entry %d: result %q, want %q", i, res.Result, tt.want[i])
+				}
+				if res.Sent {
+					sent++
+				}
+			}
+			if sent > 0 {
+				host.expect(t, sent)
+			}
+			host.expectNone(t)
+		})
+	}
+}
+
+func TestServeHTTPAllowOUIAuto(t *testing.T) {
+	tests := []struct {
+		name     string
+		neighbor string
+		wantSent bool
+	}{
+		{name: "allowed", neighbor: "00:11:22:33:44:55", wantSent: true},
+		{name: "refused", neighbor: "aa:bb:cc:33:44:55", wantSent: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{MAC: autoMAC, IP: "127.0.0.1", Port: host.port(), AllowOUI: []string{"00:11:22"}, StatusHeader: "X-Wake-Result"})
+			c, n, _ := newFakeNeighborCache()
+			n.set("127.0.0.1", tt.neighbor)
+			w.macCache = c
+
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := rec.Header().Get("X-Wake-Result")
+			if tt.wantSent {
+				host.expect(t, 1)
+			} else if !strings.HasPrefix(result, string(resultMACResolveFailed)) {
+				t.Errorf("result %q, want %s", result, resultMACResolveFailed)
+			}
+			host.expectNone(t)
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		// client IP Caddy determined, if any
+		clientIP string
+		// X-Forwarded-For sent by the client
+		forwarded string
+		want      string
+	}{
+		{name: "remote address", remoteAddr: "192.0.2.7:51234", want: "192.0.2.7"},
+		{name: "from a trusted proxy", remoteAddr: "10.0.0.1:51234", clientIP: "192.0.2.7", want: "192.0.2.7"},
+		{name: "header not trusted", remoteAddr: "192.0.2.7:51234", forwarded: "10.1.2.3", want: "192.0.2.7"},
+		{name: "IPv4-mapped", remoteAddr: "[::ffff:192.0.2.7]:51234", want: "192.0.2.7"},
+		{name: "zone", remoteAddr: "[fe80::1%eth0]:51234", want: "fe80::1"},
+		{name: "no port", remoteAddr: "192.0.2.7", want: "192.0.2.7"},
+		{name: "unknown", remoteAddr: "@", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.clientIP != "" {
+				caddyhttp.SetVar(r.Context(), caddyhttp.ClientIPVarKey, tt.clientIP)
+			}
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPAllowFromClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		clientIP   string
+		forwarded  string
+		wantStatus int
+	}{
+		{name: "allowed", remoteAddr: "10.0.0.5:51234", wantStatus: http.StatusNoContent},
+		{name: "denied", remoteAddr: "192.0.2.7:51234", wantStatus: http.StatusForbidden},
+		{name: "allowed through a trusted proxy", remoteAddr: "192.0.2.1:51234", clientIP: "10.0.0.5", wantStatus: http.StatusNoContent},
+		{name: "denied through a trusted proxy", remoteAddr: "10.0.0.1:51234", clientIP: "192.0.2.7", wantStatus: http.StatusForbidden},
+		{name: "spoofed header", remoteAddr: "192.0.2.7:51234", forwarded: "10.0.0.5", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), AllowFrom: []string{"10.0.0.0/8"}, Required: true})
+			r := newTestRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.clientIP != "" {
+				caddyhttp.SetVar(r.Context(), caddyhttp.ClientIPVarKey, tt.clientIP)
+			}
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			rec, _, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if tt.wantStatus == http.StatusNoContent {
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultAckTimeout is how long a wake waits for the agent's ack after
+// its last packet.
+const defaultAckTimeout = 2 * time.Second
+
+// ackMagic opens the trailer ack appends to each packet and the agent's
+// reply.
+const ackMagic = "WOLACK"
+
+// resultAckReceived reports a packet the agent on the target's segment
+// acknowledged, with no wait configured or nothing to confirm the host
+// up by.
+const resultAckReceived wakeResult = "ack_received"
+
+// Ack asks an agent on the target's network segment to acknowledge each
+// wake's packets, telling "the packet reached the target's segment" apart
+// from "the host booted". The packets get a trailer after the magic
+// packet, which NICs ignore:
+//
+//	"WOLACK" <reply port, 2 bytes big-endian> <nonce, 8 bytes>
+//
+// and the agent answers with one UDP datagram of "WOLACK" <nonce> to the
+// packet's source address at the reply port.
+type Ack struct {
+	// UDP port acks are received on, on all addresses, e.g. one a
+	// firewall lets in. Default: a free port per wake.
+	Port int `json:"port,omitempty"`
+	// How long to wait for the ack after the last packet. Default: 2s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// validateAck checks ack and the settings it depends on.
+func (w *WakeOnLAN) validateAck() error {
+	a := w.Ack
+	if a == nil {
+		return nil
+	}
+	switch {
+	case a.Port < 0 || a.Port > 65535:
+		return fmt.Errorf("invalid ack port %d", a.Port)
+	case a.Timeout < 0:
+		return fmt.Errorf("invalid ack timeout %s", time.Duration(a.Timeout))
+	case w.relayed() || w.Publish != nil || w.GRPC != nil:
+		return errors.New("ack cannot be combined with relay, publish or grpc, which build the packets elsewhere")
+	case slices.Contains(w.transports, transportRawEthernet):
+		return errors.New("ack cannot be combined with the raw_ethernet transport, whose frames have no address to reply to")
+	case len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil:
+		return errors.New("ack cannot be combined with escalate, send_until_up or broadcast_fallback")
+	}
+	return nil
+}
+
+// ackWait is one wake waiting for its ack.
+type ackWait struct {
+	reply []byte
+	heard chan struct{}
+	done  bool
+}
+
+// ackListener is the socket acks arrive on and the wakes waiting for one.
+// On the configured port it is shared by every wake while any waits.
+type ackListener struct {
+	conn  net.PacketConn
+	waits map[*ackWait]struct{}
+}
+
+var ackListeners = struct {
+	sync.Mutex
+	m map[int]*ackListener
+}{m: make(map[int]*ackListener)}
+
+// listen starts waiting for the ack of a wake, returning the trailer its
+// packets carry. heard is closed once the ack arrives; release stops
+// waiting, closing the socket after the last wake.
+func (a *Ack) listen() (trailer []byte, heard <-chan struct{}, release func(), err error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, nil, err
+	}
+	wait := &ackWait{reply: append([]byte(ackMagic), nonce...), heard: make(chan struct{})}
+
+	ackListeners.Lock()
+	defer ackListeners.Unlock()
+	l := ackListeners.m[a.Port]
+	if l == nil || a.Port == 0 {
+		conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(a.Port))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("ack: %w", err)
+		}
+		l = &ackListener{conn: conn, waits: make(map[*ackWait]struct{})}
+		if a.Port != 0 {
+			ackListeners.m[a.Port] = l
+		}
+		go l.serve()
+	}
+	l.waits[wait] = struct{}{}
+
+	port := l.conn.LocalAddr().(*net.UDPAddr).Port
+	trailer = binary.BigEndian.AppendUint16([]byte(ackMagic), uint16(port))
+	trailer = append(trailer, nonce...)
+	return trailer, wait.heard, func() {
+		ackListeners.Lock()
+		defer ackListeners.Unlock()
+		delete(l.waits, wait)
+		if len(l.waits) == 0 {
+			l.conn.Close()
+			if ackListeners.m[a.Port] == l {
+				delete(ackListeners.m, a.Port)
+			}
+		}
+	}, nil
+}
+
+// serve reads datagrams until the socket is closed, ending the wait of the
+// wake whose nonce each one carries.
+func (l *ackListener) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ackListeners.Lock()
+		for wait := range l.waits {
+			if !wait.done && bytes.HasPrefix(buf[:n], wait.reply) {
+				wait.done = true
+				close(wait.heard)
+			}
+		}
+		ackListeners.Unlock()
+	}
+}
+
+// awaitAck reports whether heard is closed within the ack timeout.
+func (a *Ack) awaitAck(ctx context.Context, heard <-chan struct{}) bool {
+	timeout := time.Duration(a.Timeout)
+	if timeout == 0 {
+		timeout = defaultAckTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-heard:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// parseAck parses ack: an optional port, then a block with port and
+// timeout.
+func parseAck(d *caddyfile.Dispenser) (*Ack, error) {
+	a := new(Ack)
+	if d.NextArg() {
+		port, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return nil, d.Errf("invalid ack port '%s'", d.Val())
+		}
+		a.Port = port
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "port":
+			port, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			a.Port = port
+		case "timeout":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			a.Timeout = dur
+		default:
+			return nil, d.Errf("unrecognized ack subdirective '%s'", d.Val())
+		}
+	}
+	return a, nil
+}
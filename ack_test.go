@@ -0,0 +1,168 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestAckConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Ack
+		wantErr bool
+	}{
+		{input: "ack"},
+		{input: "ack 40009", want: Ack{Port: 40009}},
+		{input: "ack {\n\t\tport 40009\n\t\ttimeout 500ms\n\t}", want: Ack{Port: 40009, Timeout: caddy.Duration(500 * time.Millisecond)}},
+		{input: "ack http", wantErr: true},
+		{input: "ack 1 2", wantErr: true},
+		{input: "ack 70000", wantErr: true},
+		{input: "ack {\n\t\ttimeout -1s\n\t}", wantErr: true},
+		{input: "ack {\n\t\tsecret x\n\t}", wantErr: true},
+		{input: "ack\n\trelay 192.0.2.9:9", wantErr: true},
+		{input: "ack\n\tcheck 192.0.2.1:22\n\tsend_until_up", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.Ack != tt.want {
+				t.Errorf("ack %+v, want %+v", *w.Ack, tt.want)
+			}
+		})
+	}
+}
+
+// ackAgent is a companion agent on the target's segment, receiving its
+// packets and, while acking, acknowledging them.
+type ackAgent struct {
+	*fakeHost
+	acking bool
+}
+
+// newAckAgent listens like a fake host, acknowledging every packet if
+// acking is true.
+func newAckAgent(t *testing.T, acking bool) *ackAgent {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &ackAgent{acking: acking, fakeHost: &fakeHost{conn: conn, packets: make(chan []byte, 64)}}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				close(a.packets)
+				return
+			}
+			packet := bytes.Clone(buf[:n])
+			a.packets <- packet
+			trailer := packet[len(buildMagicPacket(make(net.HardwareAddr, 6))):]
+			if !a.acking || !bytes.HasPrefix(trailer, []byte(ackMagic)) || len(trailer) != len(ackMagic)+10 {
+				continue
+			}
+			port := binary.BigEndian.Uint16(trailer[len(ackMagic):])
+			reply := append([]byte(ackMagic), trailer[len(ackMagic)+2:]...)
+			conn.WriteToUDP(reply, &net.UDPAddr{IP: from.IP, Port: int(port)})
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return a
+}
+
+func TestServeHTTPAck(t *testing.T) {
+	tests := []struct {
+		name       string
+		acking     bool
+		wantResult wakeResult
+		wantWarned bool
+	}{
+		{name: "acknowledged", acking: true, wantResult: resultAckReceived},
+		{name: "silent", wantResult: resultSent, wantWarned: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newAckAgent(t, tt.acking)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:          testMAC,
+				IP:           "127.0.0.1",
+				Port:         agent.port(),
+				Ack:          &Ack{Timeout: caddy.Duration(300 * time.Millisecond)},
+				StatusHeader: "X-Wake-Result",
+			})
+			logs := observeLogs(w)
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result %q, want %q", got, want)
+			}
+			packet := agent.expect(t, 1)[0]
+			hw, _ := parseMAC(testMAC)
+			magic := buildMagicPacket(hw)
+			if !bytes.HasPrefix(packet, magic) || !bytes.HasPrefix(packet[len(magic):], []byte(ackMagic)) {
+				t.Errorf("packet %x doesn't carry the ack trailer after the magic packet", packet)
+			}
+			if warned := logs.FilterMessageSnippet("no ack from the agent").Len() > 0; warned != tt.wantWarned {
+				t.Errorf("warned %v, want %v", warned, tt.wantWarned)
+			}
+		})
+	}
+}
+
+func TestAckListenerSharedPort(t *testing.T) {
+	// Wakes on a configured port share its socket until the last is done
+	a := &Ack{Port: freeUDPPort(t), Timeout: caddy.Duration(200 * time.Millisecond)}
+	trailer1, heard1, release1, err := a.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer2, heard2, release2, err := a.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, trailer := range [][]byte{trailer1, trailer2} {
+		if port := binary.BigEndian.Uint16(trailer[len(ackMagic):]); int(port) != a.Port {
+			t.Errorf("trailer asks for a reply on port %d, want %d", port, a.Port)
+		}
+	}
+	if bytes.Equal(trailer1[len(ackMagic)+2:], trailer2[len(ackMagic)+2:]) {
+		t.Error("two wakes got the same nonce")
+	}
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(append([]byte(ackMagic), trailer2[len(ackMagic)+2:]...))
+	if !a.awaitAck(context.Background(), heard2) {
+		t.Error("ack for the second wake not heard")
+	}
+	if a.awaitAck(context.Background(), heard1) {
+		t.Error("first wake heard the second's ack")
+	}
+
+	release1()
+	release2()
+	ackListeners.Lock()
+	_, open := ackListeners.m[a.Port]
+	ackListeners.Unlock()
+	if open {
+		t.Error("socket kept open after the last wake")
+	}
+}
@@ -0,0 +1,347 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// registry tracks the provisioned handlers and apps for the admin API.
+var registry = struct {
+	mu       sync.Mutex
+	handlers map[*WakeOnLAN]struct{}
+	apps     map[*App]struct{}
+
+	lastError *healthError
+}{
+	handlers: make(map[*WakeOnLAN]struct{}),
+	apps:     make(map[*App]struct{}),
+}
+
+// healthError is the most recent failure across all targets.
+type healthError struct {
+	Target string    `json:"target"`
+	Result string    `json:"result"`
+	Error  string    `json:"error"`
+	Time   time.Time `json:"time"`
+}
+
+func registerHandler(w *WakeOnLAN) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.handlers[w] = struct{}{}
+}
+
+func unregisterHandler(w *WakeOnLAN) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.handlers, w)
+}
+
+func registerApp(a *App) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.apps[a] = struct{}{}
+}
+
+func unregisterApp(a *App) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.apps, a)
+}
+
+// recordError remembers a failure for the health endpoint.
+func recordError(target string, result wakeResult, err error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.lastError = &healthError{Target: target, Result: string(result), Error: err.Error(), Time: time.Now()}
+}
+
+// adminAPI serves the module's endpoints under /wake_on_lan/ on Caddy's
+// admin API.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.wake_on_lan",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/wake_on_lan/health", Handler: caddy.AdminHandlerFunc(a.handleHealth)},
+		{Pattern: "/wake_on_lan/config", Handler: caddy.AdminHandlerFunc(a.handleConfig)},
+		{Pattern: "/wake_on_lan/loopback_test", Handler: caddy.AdminHandlerFunc(a.handleLoopbackTest)},
+		{Pattern: "/wake_on_lan/bundle", Handler: caddy.AdminHandlerFunc(a.handleBundle)},
+		{Pattern: "/wake_on_lan/summary", Handler: caddy.AdminHandlerFunc(a.handleSummary)},
+		{Pattern: "/wake_on_lan/fuse", Handler: caddy.AdminHandlerFunc(a.handleFuse)},
+		{Pattern: targetsAPIPath, Handler: caddy.AdminHandlerFunc(a.handleTargets)},
+		{Pattern: targetsAPIPath + "/", Handler: caddy.AdminHandlerFunc(a.handleTargets)},
+		// Every other path under /wake_on_lan/, of which only @<target> is
+		// served
+		{Pattern: "/wake_on_lan/", Handler: caddy.AdminHandlerFunc(a.handleTrigger)},
+	}
+}
+
+// health is the body of GET /wake_on_lan/health.
+type health struct {
+	// "ok", or "degraded" when a socket failed to open or the inventory
+	// watcher stopped
+	Status        string       `json:"status"`
+	Handlers      int          `json:"handlers"`
+	Targets       int          `json:"targets"`
+	UptimeSeconds int64        `json:"uptime_seconds"`
+	Problems      []string     `json:"problems,omitempty"`
+	LastError     *healthError `json:"last_error,omitempty"`
+}
+
+func (adminAPI) handleHealth(rw http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	registry.mu.Lock()
+	h := health{Status: "ok", Handlers: len(registry.handlers), LastError: registry.lastError}
+	var oldest time.Time
+	for w := range registry.handlers {
+		h.Targets += len(w.allTargets())
+		if oldest.IsZero() || w.provisionedAt.Before(oldest) {
+			oldest = w.provisionedAt
+		}
+		if w.broadcastErr != nil {
+			h.Problems = append(h.Problems, "broadcast socket: "+w.broadcastErr.Error())
+		}
+	}
+	for a := range registry.apps {
+		if source := a.inventorySource(); source != "" && !a.watching() {
+			h.Problems = append(h.Problems, "inventory watcher not running for "+source)
+		}
+		a.mu.RLock()
+		if a.storageErr != nil {
+			h.Problems = append(h.Problems, a.storageErr.Error())
+		}
+		a.mu.RUnlock()
+	}
+	registry.mu.Unlock()
+
+	if !oldest.IsZero() {
+		h.UptimeSeconds = int64(time.Since(oldest).Seconds())
+	}
+	if len(h.Problems) > 0 {
+		h.Status = "degraded"
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(h)
+}
+
+// handlerConfig is one handler in the body of GET /wake_on_lan/config.
+type handlerConfig struct {
+	// The handler's settings after provisioning, with the app's defaults
+	// and its profile merged in and secrets redacted
+	Config map[string]any `json:"config"`
+	// Every target with the handler's settings applied, as woken
+	Targets []Target `json:"targets"`
+}
+
+// redacted replaces values that may hold secrets.
+const redacted = "REDACTED"
+
+func (adminAPI) handleConfig(rw http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	configs, err := handlerConfigs(true)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(configs)
+}
+
+// handlerConfigs describes every running handler, oldest first, with
+// secrets redacted if redact is true.
+func handlerConfigs(redact bool) ([]handlerConfig, error) {
+	registry.mu.Lock()
+	handlers := make([]*WakeOnLAN, 0, len(registry.handlers))
+	for w := range registry.handlers {
+		handlers = append(handlers, w)
+	}
+	registry.mu.Unlock()
+	sort.Slice(handlers, func(i, j int) bool {
+		return handlers[i].provisionedAt.Before(handlers[j].provisionedAt)
+	})
+
+	configs := make([]handlerConfig, 0, len(handlers))
+	for _, w := range handlers {
+		c, err := effectiveConfig(w, redact)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+// effectiveConfig describes the provisioned handler w, with secrets
+// redacted if redact is true.
+func effectiveConfig(w *WakeOnLAN, redact bool) (handlerConfig, error) {
+	raw, err := json.Marshal(w)
+	if err != nil {
+		return handlerConfig{}, err
+	}
+	var config map[string]any
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return handlerConfig{}, err
+	}
+	targets := w.allTargets()
+	if targets == nil {
+		targets = []Target{}
+	}
+	if !redact {
+		return handlerConfig{Config: config, Targets: targets}, nil
+	}
+	// Webhook URLs commonly carry a token in the path or query
+	if notify, ok := config["notify"].(string); ok {
+		config["notify"] = redactURL(notify)
+	}
+	// Queue URLs commonly carry a password or token; only the URLs are
+	// kept, down to their scheme and host
+	if publish, ok := config["publish"].(map[string]any); ok {
+		if args, ok := publish["args"].([]any); ok {
+			for i, arg := range args {
+				if s, ok := arg.(string); ok {
+					args[i] = redactURL(s)
+				}
+			}
+		}
+	}
+	// The template may spell out a token for the notify endpoint
+	if _, ok := config["notify_template"]; ok {
+		config["notify_template"] = redacted
+	}
+	// Command arguments often pass credentials; the program is kept
+	for _, key := range []string{"on_wake_exec", "confirm_exec"} {
+		if args, ok := config[key].([]any); ok {
+			for i := 1; i < len(args); i++ {
+				args[i] = redacted
+			}
+		}
+	}
+	// The sleep payload is often a shared secret
+	if _, ok := config["sleep_payload"]; ok {
+		config["sleep_payload"] = redacted
+	}
+	// The gRPC bearer token
+	if grpc, ok := config["grpc"].(map[string]any); ok {
+		if _, ok := grpc["token"]; ok {
+			grpc["token"] = redacted
+		}
+	}
+	// SNMP credentials
+	if snmp, ok := config["snmp"].(map[string]any); ok {
+		for _, key := range []string{"community", "auth_passphrase", "priv_passphrase"} {
+			if _, ok := snmp[key]; ok {
+				snmp[key] = redacted
+			}
+		}
+	}
+	// Readiness check headers, typically carrying a token
+	if waitHTTP, ok := config["wait_http"].(map[string]any); ok {
+		if header, ok := waitHTTP["header"].(map[string]any); ok {
+			for name := range header {
+				header[name] = []string{redacted}
+			}
+		}
+	}
+	// Target secrets, of the positional target and the others
+	redactTargetConfig(config)
+	var configured []any
+	if targets, ok := config["targets"].([]any); ok {
+		configured = append(configured, targets...)
+	}
+	for _, key := range []string{"host_map", "sni_map"} {
+		if hosts, ok := config[key].(map[string]any); ok {
+			for _, t := range hosts {
+				configured = append(configured, t)
+			}
+		}
+	}
+	for _, t := range configured {
+		if t, ok := t.(map[string]any); ok {
+			redactTargetConfig(t)
+		}
+	}
+	for i := range targets {
+		targets[i] = redactTarget(targets[i])
+	}
+	return handlerConfig{Config: config, Targets: targets}, nil
+}
+
+// redactTargetConfig redacts the SecureOn password and BMC credentials of
+// the target config t.
+func redactTargetConfig(t map[string]any) {
+	if _, ok := t["secureon"]; ok {
+		t["secureon"] = redacted
+	}
+	if bmc, ok := t["bmc"].(map[string]any); ok {
+		for _, key := range []string{"username", "password"} {
+			if _, ok := bmc[key]; ok {
+				bmc[key] = redacted
+			}
+		}
+	}
+}
+
+// redactTarget returns t with its SecureOn password and BMC credentials
+// redacted, leaving the BMC t shares with the handler alone.
+func redactTarget(t Target) Target {
+	if t.SecureOn != "" {
+		t.SecureOn = redacted
+	}
+	if t.BMC != nil && (t.BMC.Username != "" || t.BMC.Password != "") {
+		bmc := *t.BMC
+		if bmc.Username != "" {
+			bmc.Username = redacted
+		}
+		if bmc.Password != "" {
+			bmc.Password = redacted
+		}
+		t.BMC = &bmc
+	}
+	return t
+}
+
+// redactURL keeps only the scheme and host of s.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	if u.User == nil && (u.Path == "" || u.Path == "/") && u.RawQuery == "" && u.Fragment == "" {
+		return s
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
+
+// Interface guards
+var _ caddy.AdminRouter = (*adminAPI)(nil)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
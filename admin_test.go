@@ -0,0 +1,148 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestEffectiveConfigRedacts(t *testing.T) {
+	const secret = "hunter2"
+	bmc := func() *BMC { return &BMC{Endpoint: "https://10.0.9.5", Username: secret, Password: secret} }
+	w := &WakeOnLAN{
+		MAC:            testMAC,
+		IP:             "192.0.2.1",
+		SecureOn:       "01:02:03:04:05:06",
+		Targets:        []Target{{Name: "db", MAC: testMAC, IP: "192.0.2.2", BMC: bmc()}},
+		HostMap:        map[string]Target{"db.example.com": {MAC: testMAC, IP: "192.0.2.3", BMC: bmc()}},
+		SNIMap:         map[string]Target{"db.example.com": {MAC: testMAC, IP: "192.0.2.4", BMC: bmc()}},
+		GRPC:           &GRPC{Endpoint: "wol.example.com:443", Token: secret},
+		Publish:        &Publish{Backend: "redis", Args: []string{"redis://:" + secret + "@queue.lan:6379", "wake_requests"}},
+		Notify:         "https://hooks.example.com/" + secret,
+		NotifyTemplate: `{"token":"` + secret + `"}`,
+		OnWakeExec:     []string{"/usr/local/bin/mount-nas", "--password", secret},
+		ConfirmExec:    []string{"/usr/local/bin/app-ready", "--token=" + secret},
+	}
+	c, err := effectiveConfig(w, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{secret, w.SecureOn} {
+		if strings.Contains(string(out), s) {
+			t.Errorf("config holds secret %q: %s", s, out)
+		}
+	}
+	if got := c.Config["on_wake_exec"].([]any)[0]; got != w.OnWakeExec[0] {
+		t.Errorf("on_wake_exec program = %v, want it kept", got)
+	}
+	if got := w.Targets[0].BMC.Password; got != secret {
+		t.Errorf("redacting changed the handler's BMC password to %q", got)
+	}
+
+	c, err = effectiveConfig(w, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := json.Marshal(c); !strings.Contains(string(out), secret) {
+		t.Errorf("config without redaction lacks the secrets: %s", out)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "https://hooks.example.com", want: "https://hooks.example.com"},
+		{in: "https://hooks.example.com/", want: "https://hooks.example.com/"},
+		{in: "https://hooks.example.com/T000/secret", want: "https://hooks.example.com/" + redacted},
+		{in: "https://hooks.example.com/?token=secret", want: "https://hooks.example.com/" + redacted},
+		{in: "redis://:secret@cache:6379", want: "redis://cache:6379/" + redacted},
+		{in: "wol:queue", want: redacted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := redactURL(tt.in); got != tt.want {
+				t.Errorf("redactURL(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleConfig(t *testing.T) {
+	const secret = "T000/hunter2"
+	ctx := loadApp(t, `{
+		"defaults": {"repeat": 3},
+		"profiles": {"desktop": {"broadcast": "192.0.2.255", "interval": "2s"}}
+	}`)
+	provisionIn(t, ctx, &WakeOnLAN{
+		Name:    "config-test",
+		MAC:     testMAC,
+		IP:      "192.0.2.1",
+		Profile: "desktop",
+		Notify:  "https://hooks.example.com/" + secret,
+	})
+
+	tests := []struct {
+		method     string
+		wantStatus int
+	}{
+		{method: http.MethodGet, wantStatus: http.StatusOK},
+		{method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			err := adminAPI{}.handleConfig(rec, httptest.NewRequest(tt.method, "/wake_on_lan/config", nil))
+			if tt.wantStatus != http.StatusOK {
+				var apiErr caddy.APIError
+				if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.wantStatus {
+					t.Errorf("error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(rec.Body.String(), secret) {
+				t.Errorf("config holds the notify token: %s", rec.Body)
+			}
+			var configs []handlerConfig
+			if err := json.Unmarshal(rec.Body.Bytes(), &configs); err != nil {
+				t.Fatalf("decoding %q: %v", rec.Body, err)
+			}
+			var c *handlerConfig
+			for i := range configs {
+				if configs[i].Config["name"] == "config-test" {
+					c = &configs[i]
+				}
+			}
+			if c == nil {
+				t.Fatalf("handler missing from %s", rec.Body)
+			}
+			// From the profile
+			if got := c.Config["broadcast"]; got != "192.0.2.255" {
+				t.Errorf("broadcast = %v, want the profile's", got)
+			}
+			if got := c.Config["notify"]; got != "https://hooks.example.com/"+redacted {
+				t.Errorf("notify = %v, want it redacted", got)
+			}
+			if len(c.Targets) != 1 {
+				t.Fatalf("targets %v, want one", c.Targets)
+			}
+			// From the app's defaults and the profile
+			if target := c.Targets[0]; target.Repeat != 3 || time.Duration(target.Interval) != 2*time.Second {
+				t.Errorf("target repeat %d, interval %s; want 3, 2s", target.Repeat, time.Duration(target.Interval))
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminTriggerPrefix opens the admin endpoint waking a target by its
+// label, as in POST /wake_on_lan/@nas. The @ keeps labels apart from the
+// other endpoints' names.
+const adminTriggerPrefix = "/wake_on_lan/@"
+
+// adminTriggerSet is the targets a handler is waking through the admin
+// API, by key, so a caller triggering as often as its clients look the
+// host up starts one wake at a time.
+type adminTriggerSet struct {
+	mu      sync.Mutex
+	running map[string]struct{}
+}
+
+// start reports whether no wake of key was running, marking one as such.
+func (s *adminTriggerSet) start(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.running[key]; ok {
+		return false
+	}
+	s.running[key] = struct{}{}
+	return true
+}
+
+// done marks the wake of key as no longer running.
+func (s *adminTriggerSet) done(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, key)
+}
+
+// validateAdminTrigger checks that admin_trigger has targets to wake.
+func (w *WakeOnLAN) validateAdminTrigger() error {
+	switch {
+	case !w.AdminTrigger:
+		return nil
+	case w.Action == actionSleep:
+		return errors.New("admin_trigger requires action wake")
+	case w.MAC == "" && len(w.Targets) == 0 && len(w.Inventory) == 0:
+		return errors.New("admin_trigger requires targets configured by mac, target or inventory")
+	}
+	return nil
+}
+
+// adminTriggerTarget returns the oldest handler with admin_trigger waking a
+// target labelled label, and that target.
+func adminTriggerTarget(label string) (*WakeOnLAN, Target, bool) {
+	registry.mu.Lock()
+	handlers := make([]*WakeOnLAN, 0, len(registry.handlers))
+	for w := range registry.handlers {
+		if w.AdminTrigger {
+			handlers = append(handlers, w)
+		}
+	}
+	registry.mu.Unlock()
+	sort.Slice(handlers, func(i, j int) bool {
+		return handlers[i].provisionedAt.Before(handlers[j].provisionedAt)
+	})
+	for _, w := range handlers {
+		for _, t := range w.targets() {
+			if t.label() == label {
+				return w, t, true
+			}
+		}
+	}
+	return nil, Target{}, false
+}
+
+// adminTriggerResponse is the body of POST /wake_on_lan/@<target>.
+type adminTriggerResponse struct {
+	Target string `json:"target"`
+	// "started", or "in_progress" if a wake triggered earlier is still
+	// running
+	Status string `json:"status"`
+}
+
+func (adminAPI) handleTrigger(rw http.ResponseWriter, r *http.Request) error {
+	label, ok := strings.CutPrefix(r.URL.Path, adminTriggerPrefix)
+	if !ok || label == "" || strings.Contains(label, "/") {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("not found")}
+	}
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w, t, ok := adminTriggerTarget(label)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no handler with admin_trigger wakes target %q", label),
+		}
+	}
+	if m := w.MaintenanceWindow; m != nil {
+		if until, on := m.activeAt(time.Now()); on {
+			rw.Header().Set("Retry-After", strconv.Itoa(int((max(time.Until(until), 0)+time.Second-1)/time.Second)))
+			return caddy.APIError{
+				HTTPStatus: http.StatusServiceUnavailable,
+				Err:        fmt.Errorf("wakes suspended for maintenance until %s", until.In(m.loc).Format(time.RFC3339)),
+			}
+		}
+	}
+
+	resp := adminTriggerResponse{Target: t.label(), Status: "in_progress"}
+	if w.adminTriggers.start(t.key()) {
+		resp.Status = "started"
+		logger := w.requestLogger(r)
+		src := w.newAuditSource(r)
+		// Bounded by the module context, like a wake after the response
+		go func() {
+			defer w.adminTriggers.done(t.key())
+			result, err := w.wake(w.ctx, t, logger)
+			w.record(logger, t, result, err)
+			w.audit(src, t, result, err)
+		}()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(rw).Encode(resp)
+}
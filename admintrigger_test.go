@@ -0,0 +1,142 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestAdminTriggerConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "mac", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tadmin_trigger\n}"},
+		{name: "targets", input: "wake_on_lan {\n\tadmin_trigger\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tname nas\n\t}\n}"},
+		{name: "argument", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tadmin_trigger nas\n}", wantErr: true},
+		{name: "sleep", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tadmin_trigger\n\taction sleep\n\tsleep_endpoint 192.0.2.1:9\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.AdminTrigger {
+				t.Error("admin_trigger not set")
+			}
+		})
+	}
+}
+
+// postTrigger requests the admin endpoint waking label with method,
+// returning the status it answers with and its body.
+func postTrigger(t *testing.T, method, label string) (int, adminTriggerResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	err := adminAPI{}.handleTrigger(rec, httptest.NewRequest(method, adminTriggerPrefix+label, nil))
+	var apiErr caddy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatus, adminTriggerResponse{}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp adminTriggerResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return rec.Code, resp
+}
+
+func TestHandleTrigger(t *testing.T) {
+	host := newFakeHost(t)
+	provisionTest(t, &WakeOnLAN{
+		AdminTrigger: true,
+		Targets:      []Target{{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port()}},
+	})
+	provisionTest(t, &WakeOnLAN{
+		Targets: []Target{{Name: "desktop", MAC: "00:11:22:aa:bb:cc", IP: "127.0.0.1", Port: host.port()}},
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		label      string
+		wantStatus int
+	}{
+		{name: "no label", method: http.MethodPost, wantStatus: http.StatusNotFound},
+		{name: "unknown", method: http.MethodPost, label: "printer", wantStatus: http.StatusNotFound},
+		{name: "without admin_trigger", method: http.MethodPost, label: "desktop", wantStatus: http.StatusNotFound},
+		{name: "nested", method: http.MethodPost, label: "nas/wake", wantStatus: http.StatusNotFound},
+		{name: "get", method: http.MethodGet, label: "nas", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := postTrigger(t, tt.method, tt.label); got != tt.wantStatus {
+				t.Errorf("status = %d, want %d", got, tt.wantStatus)
+			}
+		})
+	}
+	host.expectNone(t)
+
+	status, resp := postTrigger(t, http.MethodPost, "nas")
+	if status != http.StatusAccepted || resp != (adminTriggerResponse{Target: "nas", Status: "started"}) {
+		t.Errorf("trigger = %d %+v, want the wake started", status, resp)
+	}
+	host.expect(t, 1)
+}
+
+func TestHandleTriggerInProgress(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		AdminTrigger: true,
+		MAC:          testMAC,
+		IP:           "127.0.0.1",
+		Port:         host.port(),
+		Check:        fmt.Sprintf("127.0.0.1:%d", closedPort(t)),
+		Wait:         caddy.Duration(time.Minute),
+	})
+	if _, resp := postTrigger(t, http.MethodPost, testMAC); resp.Status != "started" {
+		t.Fatalf("first trigger %q, want started", resp.Status)
+	}
+	host.expect(t, 1)
+	// Still waiting for the host to come up
+	if _, resp := postTrigger(t, http.MethodPost, testMAC); resp.Status != "in_progress" {
+		t.Errorf("second trigger %q, want in_progress", resp.Status)
+	}
+	host.expectNone(t)
+
+	// Once the wake ends, the next trigger starts another
+	w.adminTriggers.done(w.targets()[0].key())
+	if _, resp := postTrigger(t, http.MethodPost, testMAC); resp.Status != "started" {
+		t.Errorf("trigger after the wake %q, want started", resp.Status)
+	}
+}
+
+func TestHandleTriggerMaintenance(t *testing.T) {
+	host := newFakeHost(t)
+	now := time.Now().UTC()
+	provisionTest(t, &WakeOnLAN{
+		AdminTrigger: true,
+		Targets:      []Target{{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port()}},
+		MaintenanceWindow: &MaintenanceWindow{
+			Timezone: "UTC",
+			Between:  []MaintenancePeriod{{Start: now.Add(-time.Hour).Format(maintenanceDateTime), End: now.Add(time.Hour).Format(maintenanceDateTime)}},
+		},
+	})
+	if got, _ := postTrigger(t, http.MethodPost, "nas"); got != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	host.expectNone(t)
+}
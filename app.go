@@ -0,0 +1,424 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// defaultInventoryPoll is how often the inventory file is checked for
+// changes.
+const defaultInventoryPoll = 5 * time.Second
+
+// App holds configuration shared by all wake_on_lan handlers: the named
+// targets of an inventory file, kept up to date while Caddy runs, the
+// defaults and profiles handlers inherit, and wakes on a schedule.
+type App struct {
+	// Path of a YAML or JSON file of named targets. Handlers refer to
+	// them by name; the file is reloaded when it changes.
+	Inventory string `json:"inventory,omitempty"`
+	// Key in Caddy's configured storage of an inventory in the same
+	// format, shared by every instance using that storage, e.g. in a
+	// cluster. It takes precedence over Inventory, which is used instead
+	// while the storage can't be read.
+	InventoryStorageKey string `json:"inventory_storage_key,omitempty"`
+	// How often the inventory file, or storage key, is checked for
+	// changes. Default: 5s.
+	InventoryPoll caddy.Duration `json:"inventory_poll,omitempty"`
+	// Settings every handler inherits unless it sets them itself.
+	Defaults *Defaults `json:"defaults,omitempty"`
+	// Named presets of settings, selected by handlers with profile.
+	Profiles map[string]*Profile `json:"profiles,omitempty"`
+	// Wakes fired at set times, independent of requests.
+	Schedules []Schedule `json:"schedules,omitempty"`
+	// Lets handlers run commands with on_wake_exec. Off by default, so
+	// that running programs is a decision made in the global options.
+	AllowExec bool `json:"allow_exec,omitempty"`
+	// Maximum number of wakes running at once across all handlers, each
+	// holding a goroutine and sockets while it sends and waits. Default:
+	// no limit.
+	MaxConcurrentWakes int `json:"max_concurrent_wakes,omitempty"`
+	// What a wake does when the limit is reached: "queue" (the default)
+	// for up to QueueTimeout, or "reject". Refused wakes report "busy"
+	// and fail the request with 503.
+	WhenFull string `json:"when_full,omitempty"`
+	// How long a queued wake waits for a slot. Default: 10s.
+	QueueTimeout caddy.Duration `json:"queue_timeout,omitempty"`
+	// How far back GET /wake_on_lan/summary counts each target's wakes.
+	// Default: 15m.
+	SummaryWindow caddy.Duration `json:"summary_window,omitempty"`
+	// Most wakes, and wake latencies, kept per target for the summary;
+	// older ones are dropped even within the window. Default: 100.
+	SummarySize int `json:"summary_size,omitempty"`
+
+	mu      sync.RWMutex
+	targets map[string]Target
+	modTime time.Time
+	size    int64
+
+	storage        certmagic.Storage
+	storageModTime time.Time
+	storageSize    int64
+	// Why the storage couldn't be read last time, nil if it could.
+	storageErr error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	logger *zap.Logger
+
+	cron           *cron.Cron
+	scheduleCancel context.CancelFunc
+	slots          *wakeSlots
+}
+
+// CaddyModule returns the Caddy module information.
+func (*App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "wake_on_lan",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision loads the inventory and checks the schedules. An invalid
+// inventory fails the config.
+func (a *App) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger()
+	if a.InventoryPoll < 0 {
+		return errors.New("wake_on_lan: invalid inventory_poll")
+	}
+	if a.Defaults != nil {
+		if err := a.Defaults.validate(); err != nil {
+			return fmt.Errorf("wake_on_lan: defaults: %w", err)
+		}
+	}
+	for name, profile := range a.Profiles {
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("wake_on_lan: profile %s: %w", name, err)
+		}
+	}
+	if err := validateConcurrency(a.MaxConcurrentWakes, a.WhenFull, time.Duration(a.QueueTimeout)); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := validateSummary(time.Duration(a.SummaryWindow), a.SummarySize); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	a.slots = newWakeSlots(a.MaxConcurrentWakes, a.WhenFull, time.Duration(a.QueueTimeout))
+	for i := range a.Schedules {
+		if err := a.Schedules[i].validate(); err != nil {
+			return fmt.Errorf("wake_on_lan: schedule %q: %w", a.Schedules[i].Cron, err)
+		}
+	}
+	initMetrics(ctx.GetMetricsRegistry())
+	if a.InventoryStorageKey != "" {
+		a.storage = ctx.Storage()
+		unavailable, err := a.loadStorageInventory(ctx)
+		switch {
+		case unavailable && a.Inventory != "":
+			a.logger.Warn("inventory storage unavailable; using the inventory file", zap.Error(err))
+			if err := a.loadInventory(); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+	} else if a.Inventory != "" {
+		if err := a.loadInventory(); err != nil {
+			return err
+		}
+	}
+	for _, s := range a.Schedules {
+		for _, name := range s.Inventory {
+			if _, ok := a.target(name); !ok {
+				return fmt.Errorf("wake_on_lan: schedule %q: target %q not in inventory", s.Cron, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Start starts the schedules and watches the inventory file for changes.
+func (a *App) Start() error {
+	registerApp(a)
+	configureSummaries(time.Duration(a.SummaryWindow), a.SummarySize)
+	a.startSchedules()
+	if a.Inventory == "" && a.InventoryStorageKey == "" {
+		return nil
+	}
+	poll := time.Duration(a.InventoryPoll)
+	if poll == 0 {
+		poll = defaultInventoryPoll
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel, a.done = cancel, make(chan struct{})
+	go a.watchInventory(ctx, poll)
+	return nil
+}
+
+// Stop stops the schedules and watching the inventory file.
+func (a *App) Stop() error {
+	unregisterApp(a)
+	a.stopSchedules()
+	if a.cancel != nil {
+		a.cancel()
+		<-a.done
+	}
+	return nil
+}
+
+// watching reports whether the inventory watcher is running.
+func (a *App) watching() bool {
+	if a.done == nil {
+		return false
+	}
+	select {
+	case <-a.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// target returns the inventory target with the given name.
+func (a *App) target(name string) (Target, bool) {
+	if t, ok, overridden := runtimeTarget(name); overridden {
+		return t, ok
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	t, ok := a.targets[name]
+	return t, ok
+}
+
+// parseAppOption parses the wake_on_lan global option:
+//
+//	wake_on_lan {
+//		allow_exec
+//		max_concurrent_wakes <n>
+//		when_full queue|reject
+//		queue_timeout <duration>
+//		summary_window <duration>
+//		summary_size <n>
+//		inventory [<path>] {
+//			storage <key>
+//			poll <interval>
+//		}
+//		defaults {
+//			port <port>
+//			repeat <count>
+//			interval <duration>
+//		}
+//		profile <name> {
+//			broadcast [<address>]
+//			protocol udp|tcp
+//			port <port>
+//			repeat <count>
+//			interval <duration>
+//		}
+//		schedule <cron> {
+//			target <mac> [<ip> [<port>]]
+//			inventory <name...>
+//			broadcast <address>
+//		}
+//	}
+func parseAppOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := new(App)
+	d.Next() // consume option name
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	var last string
+	for d.NextBlock(0) {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "allow_exec":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			app.AllowExec = true
+		case "max_concurrent_wakes":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			app.MaxConcurrentWakes = n
+		case "when_full":
+			mode, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			app.WhenFull = mode
+		case "queue_timeout":
+			timeout, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			app.QueueTimeout = timeout
+		case "summary_window":
+			window, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			app.SummaryWindow = window
+		case "summary_size":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			app.SummarySize = n
+		case "inventory":
+			if err := parseInventoryBlock(d, app); err != nil {
+				return nil, err
+			}
+		case "defaults":
+			defaults, err := parseDefaults(d)
+			if err != nil {
+				return nil, err
+			}
+			app.Defaults = defaults
+		case "schedule":
+			s, err := parseSchedule(d)
+			if err != nil {
+				return nil, err
+			}
+			app.Schedules = append(app.Schedules, s)
+		case "profile":
+			name, profile, err := parseProfile(d)
+			if err != nil {
+				return nil, err
+			}
+			if err := addProfile(d, app, name, profile); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, d.Errf("unrecognized subdirective '%s'", d.Val())
+		}
+	}
+	return appOption(app), nil
+}
+
+// parseInventoryOption parses the wake_on_lan_inventory global option, a
+// shorthand for the inventory of the wake_on_lan one:
+//
+//	wake_on_lan_inventory [<path>] {
+//		storage <key>
+//		poll <interval>
+//	}
+func parseInventoryOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := new(App)
+	d.Next() // consume option name
+	if err := parseInventoryBlock(d, app); err != nil {
+		return nil, err
+	}
+	return appOption(app), nil
+}
+
+// parseDefaultsOption parses the wake_on_lan_defaults global option, a
+// shorthand for the defaults of the wake_on_lan one:
+//
+//	wake_on_lan_defaults {
+//		port <port>
+//		repeat <count>
+//		interval <duration>
+//	}
+func parseDefaultsOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	d.Next() // consume option name
+	defaults, err := parseDefaults(d)
+	if err != nil {
+		return nil, err
+	}
+	return appOption(&App{Defaults: defaults}), nil
+}
+
+// parseInventoryBlock parses the arguments and block of an inventory option
+// into app.
+func parseInventoryBlock(d *caddyfile.Dispenser, app *App) error {
+	if d.NextArg() {
+		app.Inventory = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "poll":
+			poll, err := parseDurationArg(d)
+			if err != nil {
+				return err
+			}
+			app.InventoryPoll = poll
+		case "storage":
+			key, err := parseStringArg(d)
+			if err != nil {
+				return err
+			}
+			app.InventoryStorageKey = key
+		default:
+			return d.Errf("unrecognized subdirective '%s'", d.Val())
+		}
+	}
+	if app.Inventory == "" && app.InventoryStorageKey == "" {
+		return d.Err("inventory requires a path or a storage key")
+	}
+	return nil
+}
+
+// appOption wraps app as the wake_on_lan app of the Caddyfile's config.
+// Each global option returning it replaces the app entirely, which is why
+// the shorthands can't be combined (see checkAppOptions).
+func appOption(app *App) httpcaddyfile.App {
+	return httpcaddyfile.App{
+		Name:  "wake_on_lan",
+		Value: caddyconfig.JSON(app, nil),
+	}
+}
+
+// appOptions are the global options that configure the wake_on_lan app.
+var appOptions = []string{"wake_on_lan", "wake_on_lan_inventory", "wake_on_lan_defaults", "wake_on_lan_profile"}
+
+// checkAppOptions rejects Caddyfiles setting more than one of the global
+// options for the app, since only one of them would take effect.
+func checkAppOptions(h httpcaddyfile.Helper) error {
+	var set []string
+	for _, name := range appOptions {
+		if h.Option(name) != nil {
+			set = append(set, name)
+		}
+	}
+	if len(set) > 1 {
+		return fmt.Errorf("wake_on_lan: global options %s cannot be combined; use the wake_on_lan global option's inventory, defaults and profile instead", strings.Join(set, " and "))
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.App         = (*App)(nil)
+	_ caddy.Provisioner = (*App)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(new(App))
+	httpcaddyfile.RegisterGlobalOption("wake_on_lan", parseAppOption)
+	httpcaddyfile.RegisterGlobalOption("wake_on_lan_inventory", parseInventoryOption)
+	httpcaddyfile.RegisterGlobalOption("wake_on_lan_defaults", parseDefaultsOption)
+	httpcaddyfile.RegisterGlobalOption("wake_on_lan_profile", parseProfileOption)
+}
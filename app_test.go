@@ -0,0 +1,24 @@
+package caddy_wakeonlan
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// loadApp runs Caddy with only the wake_on_lan app, configured as the
+// JSON app, and returns the context handlers provisioned with it see the
+// app in.
+func loadApp(t *testing.T, app string) caddy.Context {
+	t.Helper()
+	config := `{"admin": {"disabled": true}, "apps": {"wake_on_lan": ` + app + `}}`
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatalf("loading app: %v", err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+	ctx := caddy.ActiveContext()
+	if _, err := ctx.App("wake_on_lan"); err != nil {
+		t.Fatalf("no wake_on_lan app: %v", err)
+	}
+	return ctx
+}
@@ -0,0 +1,235 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Rotation defaults for the audit log.
+const (
+	defaultAuditRollSizeMB = 10
+	defaultAuditRollKeep   = 10
+)
+
+// AuditLog configures an append-only file of JSON lines, one per wake or
+// sleep attempt, kept apart from Caddy's logs.
+type AuditLog struct {
+	// File to append to. Handlers naming the same file share it, with the
+	// rotation settings of the first one loaded.
+	Path string `json:"path"`
+	// Size in megabytes at which the file is rotated. Default: 10.
+	RollSizeMB int `json:"roll_size_mb,omitempty"`
+	// How many rotated files to keep. Default: 10.
+	RollKeep int `json:"roll_keep,omitempty"`
+}
+
+// validate checks the audit log settings.
+func (a *AuditLog) validate() error {
+	if a.Path == "" {
+		return errors.New("audit_log requires a path")
+	}
+	if a.RollSizeMB < 0 {
+		return fmt.Errorf("invalid audit_log roll_size %dMB", a.RollSizeMB)
+	}
+	if a.RollKeep < 0 {
+		return fmt.Errorf("invalid audit_log roll_keep %d", a.RollKeep)
+	}
+	return nil
+}
+
+// auditWriters shares one writer per audit log file across handlers and
+// config reloads.
+var auditWriters = caddy.NewUsagePool()
+
+// auditWriter serializes writes to one audit log file.
+type auditWriter struct {
+	mu  sync.Mutex
+	out *lumberjack.Logger
+}
+
+func (a *auditWriter) Destruct() error {
+	return a.out.Close()
+}
+
+// write appends line with a single unbuffered write, so a record is never
+// held back in memory or interleaved with another.
+func (a *auditWriter) write(line []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := a.out.Write(line)
+	return err
+}
+
+// openAuditWriter returns the shared writer for the configured file. The
+// file is opened once up front so an unwritable path fails the config.
+func openAuditWriter(cfg *AuditLog) (*auditWriter, error) {
+	path, err := filepath.Abs(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	val, _, err := auditWriters.LoadOrNew(path, func() (caddy.Destructor, error) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+
+		size, keep := cfg.RollSizeMB, cfg.RollKeep
+		if size == 0 {
+			size = defaultAuditRollSizeMB
+		}
+		if keep == 0 {
+			keep = defaultAuditRollKeep
+		}
+		return &auditWriter{out: &lumberjack.Logger{Filename: path, MaxSize: size, MaxBackups: keep}}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*auditWriter), nil
+}
+
+// releaseAuditWriter drops the handler's use of the shared writer, closing
+// the file when no handler uses it anymore.
+func releaseAuditWriter(cfg *AuditLog) {
+	if path, err := filepath.Abs(cfg.Path); err == nil {
+		_, _ = auditWriters.Delete(path)
+	}
+}
+
+// parseAuditLog parses the audit_log subdirective.
+func parseAuditLog(d *caddyfile.Dispenser) (*AuditLog, error) {
+	audit := new(AuditLog)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	audit.Path = d.Val()
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "roll_size":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid roll_size %q: %v", d.Val(), err)
+			}
+			// Rotation works in whole megabytes; round up
+			audit.RollSizeMB = int((size + 1<<20 - 1) >> 20)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "roll_keep":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			audit.RollKeep = n
+		default:
+			return nil, d.Errf("unrecognized audit_log subdirective '%s'", d.Val())
+		}
+	}
+	return audit, nil
+}
+
+// auditSource is who triggered a wake, taken from the request.
+type auditSource struct {
+	WakeID   string
+	ClientIP string
+	User     string
+}
+
+// newAuditSource describes the client of r. User is the ID set by Caddy's
+// authentication handler, if one ran.
+func (w *WakeOnLAN) newAuditSource(r *http.Request) auditSource {
+	src := auditSource{WakeID: w.wakeID(r), ClientIP: clientIP(r)}
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		src.User, _ = repl.GetString("http.auth.user.id")
+	}
+	return src
+}
+
+// auditRecord is one line of the audit log, with enough of the target to
+// replay the wake.
+type auditRecord struct {
+	Time     time.Time   `json:"ts"`
+	WakeID   string      `json:"wake_id,omitempty"`
+	ClientIP string      `json:"client_ip,omitempty"`
+	User     string      `json:"user,omitempty"`
+	Action   string      `json:"action"`
+	Target   string      `json:"target"`
+	MAC      string      `json:"mac,omitempty"`
+	IP       string      `json:"ip,omitempty"`
+	Port     int         `json:"port,omitempty"`
+	Meta     *TargetMeta `json:"meta,omitempty"`
+	Result   string      `json:"result"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// audit appends the outcome of waking t to the audit log, if configured.
+// Write errors are logged; they never fail the wake.
+func (w *WakeOnLAN) audit(src auditSource, t Target, result wakeResult, err error) {
+	if w.auditWriter == nil {
+		return
+	}
+	mac := t.MAC
+	if hw, err := t.hardwareAddr(); err == nil {
+		mac = hw.String()
+	}
+	w.writeAudit(auditRecord{
+		Action: actionWake,
+		Target: t.label(),
+		MAC:    mac,
+		IP:     t.IP,
+		Port:   portOrDefault(t.Port),
+		Meta:   t.Meta,
+	}, src, result, err)
+}
+
+// auditSleep appends the outcome of a sleep command to the audit log.
+func (w *WakeOnLAN) auditSleep(src auditSource, result wakeResult, err error) {
+	if w.auditWriter == nil {
+		return
+	}
+	w.writeAudit(auditRecord{Action: actionSleep, Target: w.sleepLabel(), IP: w.SleepEndpoint}, src, result, err)
+}
+
+func (w *WakeOnLAN) writeAudit(rec auditRecord, src auditSource, result wakeResult, err error) {
+	rec.Time = time.Now().UTC()
+	rec.WakeID, rec.ClientIP, rec.User = src.WakeID, src.ClientIP, src.User
+	rec.Result = string(result)
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	line, jsonErr := json.Marshal(rec)
+	if jsonErr != nil {
+		w.logger.Warn("encoding audit record", zap.Error(jsonErr))
+		return
+	}
+	if err := w.auditWriter.write(append(line, '\n')); err != nil {
+		w.logger.Warn("writing audit log", zap.String("path", w.AuditLog.Path), zap.Error(err))
+	}
+}
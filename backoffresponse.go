@@ -0,0 +1,270 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Defaults of backoff_response.
+const (
+	defaultBackoffInitial = time.Second
+	defaultBackoffMax     = 30 * time.Second
+	defaultBackoffFactor  = 2
+	defaultBackoffTTL     = 5 * time.Minute
+)
+
+// errNotReady is returned for a request answered with a 503 while its
+// targets boot.
+var errNotReady = errors.New("target not up yet; retry later")
+
+// BackoffResponse answers requests with a 503 Service Unavailable while
+// the targets boot instead of holding them for a wait: each request probes
+// the targets, sending the packets to those still down, and until every
+// target is up gets a Retry-After growing with each retry of the same
+// client, so the client polls politely until the host answers.
+type BackoffResponse struct {
+	// Retry-After of a client's first request. Default: 1s.
+	Initial caddy.Duration `json:"initial,omitempty"`
+	// Longest Retry-After. Default: 30s.
+	Max caddy.Duration `json:"max,omitempty"`
+	// What each retry multiplies the Retry-After by. Default: 2.
+	Factor float64 `json:"factor,omitempty"`
+	// How long a client's place in the schedule is kept after its last
+	// request; a client retrying later starts over. Default: 5m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+// validateBackoffResponse checks backoff_response and what it relies on.
+func (w *WakeOnLAN) validateBackoffResponse() error {
+	b := w.BackoffResponse
+	if b == nil {
+		return nil
+	}
+	switch {
+	case b.Initial < 0 || b.Max < 0 || b.TTL < 0:
+		return errors.New("backoff_response initial, max and ttl must not be negative")
+	case b.Factor != 0 && b.Factor < 1:
+		return fmt.Errorf("invalid backoff_response factor %g: must be at least 1", b.Factor)
+	case b.Max != 0 && b.Max < b.Initial:
+		return fmt.Errorf("backoff_response max %s is below initial %s", time.Duration(b.Max), time.Duration(b.Initial))
+	case w.Wait > 0 || w.WaitingPage != nil || w.EarlyResponse != nil:
+		return errors.New("backoff_response replaces wait; it cannot be combined with wait, waiting_page or early_response")
+	case len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil || w.ConfirmListen != nil:
+		return errors.New("backoff_response cannot be combined with escalate, send_until_up, broadcast_fallback or confirm_listen")
+	case w.AfterResponse || w.FromBody || w.WakeOnFailure || w.OnTimeout != "" || w.ResponseDelay != nil:
+		return errors.New("backoff_response cannot be combined with after_response, from_body, wake_on_failure, on_timeout or response_delay")
+	}
+	if w.WaitHTTP == nil && !w.waitsARP() {
+		for _, t := range w.allTargets() {
+			if t.Check == "" {
+				return errors.New("backoff_response requires a check address, wait_arp, confirm_arp_learned or wait_http")
+			}
+		}
+	}
+	return nil
+}
+
+// backoffClients tracks where each client is in the backoff schedule, by
+// client and targets.
+type backoffClients struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	retries   map[string]*backoffClient
+	lastSweep time.Time
+}
+
+// backoffClient is one client's retries of a wake.
+type backoffClient struct {
+	retries int
+	seen    time.Time
+}
+
+func newBackoffClients(ttl time.Duration) *backoffClients {
+	if ttl == 0 {
+		ttl = defaultBackoffTTL
+	}
+	return &backoffClients{ttl: ttl, retries: make(map[string]*backoffClient)}
+}
+
+// next returns how many times the client with key retried before this
+// request, counting this one for the next.
+func (c *backoffClients) next(key string, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) >= c.ttl/4 {
+		for k, e := range c.retries {
+			if now.Sub(e.seen) >= c.ttl {
+				delete(c.retries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	e, ok := c.retries[key]
+	if !ok || now.Sub(e.seen) >= c.ttl {
+		e = new(backoffClient)
+		c.retries[key] = e
+	} else {
+		e.retries++
+	}
+	e.seen = now
+	return e.retries
+}
+
+// done forgets the client with key once its targets are up.
+func (c *backoffClients) done(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.retries, key)
+}
+
+// delay returns the Retry-After after retries earlier retries: initial,
+// multiplied by the factor on each retry, up to max.
+func (b *BackoffResponse) delay(retries int) time.Duration {
+	initial, limit, factor := time.Duration(b.Initial), time.Duration(b.Max), b.Factor
+	if initial == 0 {
+		initial = defaultBackoffInitial
+	}
+	if limit == 0 {
+		limit = max(defaultBackoffMax, initial)
+	}
+	if factor == 0 {
+		factor = defaultBackoffFactor
+	}
+	d := float64(initial) * math.Pow(factor, float64(retries))
+	if d >= float64(limit) {
+		return limit
+	}
+	return time.Duration(d)
+}
+
+// backoffKey returns the key of r's client for waking targets: its
+// idempotency key if it sent one, otherwise its IP, followed by the
+// targets.
+func (w *WakeOnLAN) backoffKey(r *http.Request, targets []Target) string {
+	client := clientIP(r)
+	if w.IdempotencyKey != "" {
+		if key := r.Header.Get(w.IdempotencyKey); key != "" && len(key) <= maxIdempotencyKey {
+			client = "key:" + key
+		}
+	}
+	labels := make([]string, len(targets))
+	for i, t := range targets {
+		labels[i] = t.label()
+	}
+	return client + "\x00" + strings.Join(labels, "\x00")
+}
+
+// serveBackoff wakes the targets without waiting for them and calls the
+// next handler if all of them are up; otherwise it answers with a 503 and
+// a Retry-After further along the client's backoff schedule.
+func (w *WakeOnLAN) serveBackoff(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler, targets []Target, logger *zap.Logger) error {
+	results, failure, err := w.wakeTargets(rw, r, targets, logger)
+	if w.failsRequest(err) {
+		return w.failWake(rw, r, failure, err)
+	}
+	key := w.backoffKey(r, targets)
+	if allUp(results) {
+		w.backoff.done(key)
+		return next.ServeHTTP(rw, r)
+	}
+
+	var labels []string
+	for i, t := range targets {
+		if !results[i].up() {
+			labels = append(labels, t.label())
+		}
+	}
+	retries := w.backoff.next(key, time.Now())
+	retry := w.BackoffResponse.delay(retries)
+	seconds := strconv.Itoa(max(int((retry+time.Second-1)/time.Second), 1))
+	logger.Debug("targets not up yet; answering with a backoff", zap.Strings("targets", labels),
+		zap.Int("retries", retries), zap.String("retry_after", seconds))
+
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Retry-After", seconds)
+	if w.JSONErrors {
+		return w.fail(rw, http.StatusServiceUnavailable, "not_ready", errNotReady)
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = fmt.Fprintf(rw, "Waking up %s; retry in %s seconds.\n", strings.Join(labels, ", "), seconds)
+	return err
+}
+
+// parseBackoffResponse parses backoff_response: an optional initial and
+// max, then a block with initial, max, factor and ttl.
+func parseBackoffResponse(d *caddyfile.Dispenser) (*BackoffResponse, error) {
+	b := new(BackoffResponse)
+	args := d.RemainingArgs()
+	if len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	for i, arg := range args {
+		dur, err := caddy.ParseDuration(arg)
+		if err != nil {
+			return nil, d.Errf("invalid backoff_response duration %q: %v", arg, err)
+		}
+		if i == 0 {
+			b.Initial = caddy.Duration(dur)
+		} else {
+			b.Max = caddy.Duration(dur)
+		}
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "initial":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.Initial = dur
+		case "max":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.Max = dur
+		case "ttl":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.TTL = dur
+		case "factor":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			f, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return nil, d.Errf("invalid backoff_response factor '%s'", d.Val())
+			}
+			b.Factor = f
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unrecognized backoff_response subdirective '%s'", d.Val())
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,174 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestBackoffResponseConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    BackoffResponse
+		wantErr bool
+	}{
+		{input: "check 192.0.2.1:22\n\tbackoff_response"},
+		{input: "check 192.0.2.1:22\n\tbackoff_response 2s", want: BackoffResponse{Initial: caddy.Duration(2 * time.Second)}},
+		{input: "check 192.0.2.1:22\n\tbackoff_response 2s 1m", want: BackoffResponse{Initial: caddy.Duration(2 * time.Second), Max: caddy.Duration(time.Minute)}},
+		{
+			input: "check 192.0.2.1:22\n\tbackoff_response {\n\t\tinitial 500ms\n\t\tmax 10s\n\t\tfactor 1.5\n\t\tttl 1m\n\t}",
+			want:  BackoffResponse{Initial: caddy.Duration(500 * time.Millisecond), Max: caddy.Duration(10 * time.Second), Factor: 1.5, TTL: caddy.Duration(time.Minute)},
+		},
+		{input: "wait_http http://192.0.2.1/\n\tbackoff_response"},
+		{input: "backoff_response", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tbackoff_response 1s 2s 3s", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tbackoff_response soon", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tbackoff_response -1s", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tbackoff_response 10s 5s", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tbackoff_response {\n\t\tfactor 0.5\n\t}", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tbackoff_response {\n\t\tfactor fast\n\t}", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tbackoff_response {\n\t\tretries 3\n\t}", wantErr: true},
+		{input: "check 192.0.2.1:22\n\twait 1m\n\tbackoff_response", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tafter_response\n\tbackoff_response", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.BackoffResponse != tt.want {
+				t.Errorf("backoff_response %+v, want %+v", *w.BackoffResponse, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       BackoffResponse
+		retries int
+		want    time.Duration
+	}{
+		{name: "first", retries: 0, want: time.Second},
+		{name: "doubled", retries: 3, want: 8 * time.Second},
+		{name: "capped", retries: 10, want: defaultBackoffMax},
+		{name: "factor", b: BackoffResponse{Factor: 1.5}, retries: 2, want: 2250 * time.Millisecond},
+		{name: "max", b: BackoffResponse{Max: caddy.Duration(5 * time.Second)}, retries: 3, want: 5 * time.Second},
+		// Without a max, an initial above the default is its own cap
+		{name: "initial above the default max", b: BackoffResponse{Initial: caddy.Duration(time.Minute)}, retries: 2, want: time.Minute},
+		{name: "factor 1", b: BackoffResponse{Initial: caddy.Duration(3 * time.Second), Factor: 1}, retries: 5, want: 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.b.delay(tt.retries); got != tt.want {
+				t.Errorf("delay(%d) = %s, want %s", tt.retries, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffClients(t *testing.T) {
+	c := newBackoffClients(time.Minute)
+	now := time.Now()
+	for i := range 3 {
+		if got := c.next("a", now.Add(time.Duration(i)*time.Second)); got != i {
+			t.Errorf("request %d: %d retries, want %d", i+1, got, i)
+		}
+	}
+	if got := c.next("b", now); got != 0 {
+		t.Errorf("other client: %d retries, want 0", got)
+	}
+
+	// A client back after the TTL starts over
+	if got := c.next("a", now.Add(2*time.Minute)); got != 0 {
+		t.Errorf("after the TTL: %d retries, want 0", got)
+	}
+	if _, kept := c.retries["b"]; kept {
+		t.Error("expired client kept")
+	}
+
+	c.next("a", now.Add(2*time.Minute))
+	c.done("a")
+	if got := c.next("a", now.Add(2*time.Minute)); got != 0 {
+		t.Errorf("after done: %d retries, want 0", got)
+	}
+}
+
+func TestServeHTTPBackoffResponse(t *testing.T) {
+	host := newFakeHost(t)
+	checkPort := closedPort(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:             testMAC,
+		IP:              "127.0.0.1",
+		Port:            host.port(),
+		Check:           fmt.Sprintf("127.0.0.1:%d", checkPort),
+		CheckTimeout:    caddy.Duration(100 * time.Millisecond),
+		BackoffResponse: &BackoffResponse{Initial: caddy.Duration(2 * time.Second), Max: caddy.Duration(5 * time.Second)},
+	})
+
+	// Down: a 503 with a growing Retry-After, packets sent each time
+	for i, want := range []string{"2", "4", "5"} {
+		rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		if got := statusOf(rec, err); got != http.StatusServiceUnavailable || called {
+			t.Fatalf("request %d: status %d, next called %v; want %d and not called", i+1, got, called, http.StatusServiceUnavailable)
+		}
+		if got := rec.Header().Get("Retry-After"); got != want {
+			t.Errorf("request %d: Retry-After %q, want %q", i+1, got, want)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("request %d: Cache-Control %q, want no-store", i+1, got)
+		}
+		host.expect(t, 1)
+	}
+
+	// Another client starts at the beginning
+	r := newTestRequest("GET", "http://example.com/", nil)
+	r.RemoteAddr = "192.0.2.7:1234"
+	rec, _, err := serveTest(w, r)
+	if got := rec.Header().Get("Retry-After"); statusOf(rec, err) != http.StatusServiceUnavailable || got != "2" {
+		t.Errorf("other client: status %d, Retry-After %q; want %d and 2", statusOf(rec, err), got, http.StatusServiceUnavailable)
+	}
+	host.expect(t, 1)
+
+	// Once up, requests pass and the schedule is forgotten
+	listenAfter(t, checkPort, 0)
+	rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if got := statusOf(rec, err); got != http.StatusNoContent || !called {
+		t.Errorf("once up: status %d, next called %v; want %d and called", got, called, http.StatusNoContent)
+	}
+	host.expectNone(t)
+	if n := len(w.backoff.retries); n != 1 {
+		t.Errorf("%d clients tracked, want only the other one", n)
+	}
+}
+
+func TestServeHTTPBackoffResponseIdempotencyKey(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:             testMAC,
+		IP:              "127.0.0.1",
+		Port:            host.port(),
+		Check:           fmt.Sprintf("127.0.0.1:%d", closedPort(t)),
+		CheckTimeout:    caddy.Duration(100 * time.Millisecond),
+		IdempotencyKey:  "Idempotency-Key",
+		BackoffResponse: &BackoffResponse{},
+	})
+	// The same key keeps its place from different addresses
+	for i, want := range []string{"1", "2"} {
+		r := newTestRequest("GET", "http://example.com/", nil)
+		r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i+1)
+		r.Header.Set("Idempotency-Key", "abc")
+		rec, _, _ := serveTest(w, r)
+		if got := rec.Header().Get("Retry-After"); got != want {
+			t.Errorf("request %d: Retry-After %q, want %q", i+1, got, want)
+		}
+	}
+}
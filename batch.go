@@ -0,0 +1,69 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// wakeBatcher collects requests for the same target arriving within a
+// window of the first and wakes it once for all of them when the window
+// ends. Unlike the wakeCoordinator, which shares a wake already in flight,
+// it delays the first request so that near-simultaneous ones share its
+// send.
+type wakeBatcher struct {
+	mu      sync.Mutex
+	pending map[string]*wakeBatch
+}
+
+// wakeBatch is the wake shared by the requests of one window.
+type wakeBatch struct {
+	done     chan struct{}
+	requests int
+	result   wakeResult
+	err      error
+}
+
+// run adds the request to the pending batch for key, starting one that is
+// flushed after window if there is none, and returns the batch's result.
+// fn runs once per batch, detached from the request context of the request
+// that started it.
+func (b *wakeBatcher) run(ctx context.Context, key string, window time.Duration, logger *zap.Logger, fn func(ctx context.Context) (wakeResult, error)) (wakeResult, error) {
+	b.mu.Lock()
+	if b.pending == nil {
+		b.pending = make(map[string]*wakeBatch)
+	}
+	if batch := b.pending[key]; batch != nil {
+		batch.requests++
+		b.mu.Unlock()
+		logger.Debug("batched with pending wake")
+		return batch.wait(ctx)
+	}
+	batch := &wakeBatch{done: make(chan struct{}), requests: 1}
+	b.pending[key] = batch
+	b.mu.Unlock()
+
+	detached := context.WithoutCancel(ctx)
+	time.AfterFunc(window, func() {
+		b.mu.Lock()
+		delete(b.pending, key)
+		requests := batch.requests
+		b.mu.Unlock()
+		logger.Debug("flushing batched wake", zap.Int("requests", requests))
+		defer close(batch.done)
+		batch.result, batch.err = fn(detached)
+	})
+	return batch.wait(ctx)
+}
+
+// wait blocks until the batch's wake completes or ctx is cancelled.
+func (batch *wakeBatch) wait(ctx context.Context) (wakeResult, error) {
+	select {
+	case <-batch.done:
+		return batch.result, batch.err
+	case <-ctx.Done():
+		return resultError, ctx.Err()
+	}
+}
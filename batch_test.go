@@ -0,0 +1,151 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestBatchWindowConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "batch_window 50ms", want: 50 * time.Millisecond},
+		{input: "batch_window 0s"},
+		{input: "batch_window -1s", wantErr: true},
+		{input: "batch_window", wantErr: true},
+		{input: "batch_window soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && time.Duration(w.BatchWindow) != tt.want {
+				t.Errorf("batch_window = %s, want %s", time.Duration(w.BatchWindow), tt.want)
+			}
+		})
+	}
+}
+
+func TestWakeBatcher(t *testing.T) {
+	const window = 100 * time.Millisecond
+	tests := []struct {
+		name string
+		// key and delay from the start of each request
+		keys   []string
+		delays []time.Duration
+		// wakes run, one per batch
+		wantRuns int
+	}{
+		{name: "burst", keys: []string{"a", "a", "a", "a"}, delays: []time.Duration{0, 10 * time.Millisecond, 30 * time.Millisecond, 60 * time.Millisecond}, wantRuns: 1},
+		{name: "after the window", keys: []string{"a", "a"}, delays: []time.Duration{0, 2 * window}, wantRuns: 2},
+		{name: "distinct targets", keys: []string{"a", "b", "a", "b"}, delays: []time.Duration{0, 0, 10 * time.Millisecond, 10 * time.Millisecond}, wantRuns: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b wakeBatcher
+			var runs atomic.Int32
+			fn := func(context.Context) (wakeResult, error) {
+				runs.Add(1)
+				return resultSent, nil
+			}
+			var wg sync.WaitGroup
+			for i, key := range tt.keys {
+				wg.Add(1)
+				time.AfterFunc(tt.delays[i], func() {
+					defer wg.Done()
+					if result, err := b.run(t.Context(), key, window, zap.NewNop(), fn); result != resultSent || err != nil {
+						t.Errorf("request %d: %s, %v", i+1, result, err)
+					}
+				})
+			}
+			wg.Wait()
+			if got := int(runs.Load()); got != tt.wantRuns {
+				t.Errorf("ran %d wakes, want %d", got, tt.wantRuns)
+			}
+		})
+	}
+
+	t.Run("cancelled request", func(t *testing.T) {
+		// The request that opened the batch leaving doesn't stop the wake
+		// for the others
+		var b wakeBatcher
+		ran := make(chan bool, 1)
+		fn := func(ctx context.Context) (wakeResult, error) {
+			ran <- ctx.Err() == nil
+			return resultSent, nil
+		}
+		ctx, cancel := context.WithCancel(t.Context())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		if _, err := b.run(ctx, "a", window, zap.NewNop(), fn); !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled request: %v, want %v", err, context.Canceled)
+		}
+		if result, err := b.run(t.Context(), "a", window, zap.NewNop(), fn); result != resultSent || err != nil {
+			t.Errorf("batched request: %s, %v", result, err)
+		}
+		if live := <-ran; !live {
+			t.Error("wake ran with a cancelled context")
+		}
+		select {
+		case <-ran:
+			t.Error("wake ran twice")
+		default:
+		}
+	})
+}
+
+func TestServeHTTPBatchWindow(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:          testMAC,
+		IP:           "127.0.0.1",
+		Port:         host.port(),
+		BatchWindow:  caddy.Duration(200 * time.Millisecond),
+		StatusHeader: "X-Wake-Result",
+	})
+	logs := observeLogs(w)
+
+	const requests = 10
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != http.StatusNoContent {
+				t.Errorf("request %d: status %d, want %d (%v)", i+1, got, http.StatusNoContent, err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(resultSent)+"; target="+testMAC; got != want {
+				t.Errorf("request %d: result = %q, want %q", i+1, got, want)
+			}
+		}()
+	}
+	wg.Wait()
+	host.expect(t, 1)
+	host.expectNone(t)
+
+	flushed := logs.FilterMessage("flushing batched wake").All()
+	if len(flushed) != 1 {
+		t.Fatalf("flushed %d batches, want 1", len(flushed))
+	}
+	if got := flushed[0].ContextMap()["requests"]; got != int64(requests) {
+		t.Errorf("batch covered %v requests, want %d", got, requests)
+	}
+}
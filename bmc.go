@@ -0,0 +1,404 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Kinds of BMC.
+const (
+	// A Redfish service, over HTTPS.
+	bmcRedfish = "redfish"
+	// IPMI over LAN, through ipmitool.
+	bmcIPMI = "ipmi"
+)
+
+// Defaults of a BMC power-on.
+const (
+	defaultBMCTimeout   = 30 * time.Second
+	defaultBMCResetType = "On"
+)
+
+// redfishSystemsPath is the collection of the systems a Redfish service
+// manages.
+const redfishSystemsPath = "/redfish/v1/Systems"
+
+// maxRedfishBody bounds the responses read from a Redfish service.
+const maxRedfishBody = 1 << 20
+
+// BMC powers a server on through its baseboard management controller
+// instead of sending it magic packets: with a Redfish ComputerSystem.Reset
+// of type On, or an IPMI chassis power on through ipmitool. A server
+// already powered on is left alone. The target's MAC still names it.
+type BMC struct {
+	// redfish (the default) or ipmi.
+	Type string `json:"type,omitempty"`
+	// Redfish: the service's base URL, e.g. https://10.0.9.5. IPMI: the
+	// BMC's host, or host:port.
+	Endpoint string `json:"endpoint"`
+	// Redfish: path of the system to power on, e.g.
+	// /redfish/v1/Systems/1. Default: the only member of
+	// /redfish/v1/Systems.
+	System string `json:"system,omitempty"`
+	// Redfish: ResetType of the reset, e.g. On or ForceOn. Default: On.
+	ResetType string `json:"reset_type,omitempty"`
+	// Credentials, with Caddy's global placeholders such as {env.*} or
+	// {file.*}, which keep them out of the config. Redfish sends them with
+	// HTTP basic auth; ipmitool gets the password from its environment,
+	// not its command line.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Redfish: PEM file of the CAs the service's certificate is verified
+	// with, instead of the system's.
+	CA string `json:"ca,omitempty"`
+	// Redfish: if true, the service's certificate isn't verified, for the
+	// self-signed ones BMCs ship with.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// How long a power-on may take. Default: 30s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// validate checks the BMC settings fit its type.
+func (b *BMC) validate() error {
+	if b == nil {
+		return nil
+	}
+	if b.Timeout < 0 {
+		return fmt.Errorf("invalid bmc timeout %s", time.Duration(b.Timeout))
+	}
+	switch b.Type {
+	case "", bmcRedfish:
+		u, err := url.Parse(b.Endpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("bmc endpoint %q must be an absolute https or http URL", b.Endpoint)
+		}
+		if b.System != "" && !strings.HasPrefix(b.System, "/") {
+			return fmt.Errorf("bmc system %q must be a path", b.System)
+		}
+		if b.CA != "" && b.InsecureSkipVerify {
+			return errors.New("bmc ca and insecure_skip_verify cannot be combined")
+		}
+		_, err = b.tlsConfig()
+		return err
+	case bmcIPMI:
+		if b.Endpoint == "" || strings.Contains(b.Endpoint, "/") {
+			return fmt.Errorf("bmc endpoint %q must be a host or host:port for ipmi", b.Endpoint)
+		}
+		if b.System != "" || b.ResetType != "" || b.CA != "" || b.InsecureSkipVerify {
+			return errors.New("bmc system, reset_type, ca and insecure_skip_verify only apply to redfish")
+		}
+		if b.Username == "" {
+			return errors.New("bmc type ipmi requires a username")
+		}
+		if _, err := exec.LookPath("ipmitool"); err != nil {
+			return fmt.Errorf("bmc type ipmi requires ipmitool: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown bmc type %q: want redfish or ipmi", b.Type)
+}
+
+// validateBMC checks the handler's settings that can't be combined with
+// targets powered on through a BMC.
+func (w *WakeOnLAN) validateBMC() error {
+	for _, t := range w.allTargets() {
+		if t.BMC == nil {
+			continue
+		}
+		switch {
+		case w.Publish != nil || w.GRPC != nil || w.relayed() || w.HelperSocket != "":
+			return fmt.Errorf("target %s: bmc cannot be combined with publish, grpc, relay or helper_socket", t.label())
+		case len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil || w.Ack != nil:
+			return fmt.Errorf("target %s: bmc cannot be combined with escalate, send_until_up, broadcast_fallback or ack, which send packets", t.label())
+		}
+	}
+	return nil
+}
+
+// powerOn powers the target on through its BMC, in place of sending its
+// packets.
+func (b *BMC) powerOn(ctx context.Context, logger *zap.Logger) error {
+	timeout := time.Duration(b.Timeout)
+	if timeout == 0 {
+		timeout = defaultBMCTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	repl := caddy.NewReplacer()
+	username := repl.ReplaceKnown(b.Username, "")
+	password := strings.TrimSpace(repl.ReplaceKnown(b.Password, ""))
+	recordDelivery(ctx, delivery{dest: b.Endpoint, transport: "bmc"})
+	if b.Type == bmcIPMI {
+		return b.powerOnIPMI(ctx, username, password, logger)
+	}
+	return b.powerOnRedfish(ctx, username, password, logger)
+}
+
+// tlsConfig returns the TLS settings of the Redfish service's connections.
+func (b *BMC) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: b.InsecureSkipVerify}
+	if b.CA != "" {
+		pem, err := os.ReadFile(b.CA)
+		if err != nil {
+			return nil, fmt.Errorf("bmc ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("bmc ca: no certificate in %s", b.CA)
+		}
+	}
+	return cfg, nil
+}
+
+// redfishSystem is the part of a Redfish ComputerSystem read before
+// powering it on.
+type redfishSystem struct {
+	PowerState string `json:"PowerState"`
+	Actions    struct {
+		Reset struct {
+			Target string `json:"target"`
+		} `json:"#ComputerSystem.Reset"`
+	} `json:"Actions"`
+}
+
+// redfishCollection is a Redfish collection such as /redfish/v1/Systems.
+type redfishCollection struct {
+	Members []struct {
+		ID string `json:"@odata.id"`
+	} `json:"Members"`
+}
+
+// redfishError is the body of a failed Redfish request.
+type redfishError struct {
+	Error struct {
+		Message string `json:"message"`
+		Info    []struct {
+			Message string `json:"Message"`
+		} `json:"@Message.ExtendedInfo"`
+	} `json:"error"`
+}
+
+// powerOnRedfish resets the system to On, unless its power state is On
+// already.
+func (b *BMC) powerOnRedfish(ctx context.Context, username, password string, logger *zap.Logger) error {
+	cfg, err := b.tlsConfig()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	defer client.CloseIdleConnections()
+	call := func(method, path string, body, into any) error {
+		return redfishCall(ctx, client, b.Endpoint, username, password, method, path, body, into)
+	}
+
+	system := b.System
+	if system == "" {
+		var systems redfishCollection
+		if err := call(http.MethodGet, redfishSystemsPath, nil, &systems); err != nil {
+			return err
+		}
+		if len(systems.Members) != 1 {
+			return fmt.Errorf("redfish: %d systems at %s; set the bmc system to power on", len(systems.Members), redfishSystemsPath)
+		}
+		system = systems.Members[0].ID
+	}
+	var state redfishSystem
+	if err := call(http.MethodGet, system, nil, &state); err != nil {
+		return err
+	}
+	if state.PowerState == "On" {
+		logger.Debug("system already powered on; not resetting", zap.String("bmc", b.Endpoint), zap.String("system", system))
+		return nil
+	}
+	action := state.Actions.Reset.Target
+	if action == "" {
+		action = strings.TrimSuffix(system, "/") + "/Actions/ComputerSystem.Reset"
+	}
+	resetType := b.ResetType
+	if resetType == "" {
+		resetType = defaultBMCResetType
+	}
+	if err := call(http.MethodPost, action, map[string]string{"ResetType": resetType}, nil); err != nil {
+		return err
+	}
+	logger.Debug("system powered on through redfish", zap.String("bmc", b.Endpoint), zap.String("system", system),
+		zap.String("power_state", state.PowerState), zap.String("reset_type", resetType))
+	return nil
+}
+
+// redfishCall makes one request of the Redfish service at base, decoding
+// the response into into, if set, and failing with the service's message
+// for any status but 2xx.
+func redfishCall(ctx context.Context, client *http.Client, base, username, password, method, path string, body, into any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(base, "/")+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("redfish: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("redfish %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRedfishBody))
+	if err != nil {
+		return fmt.Errorf("redfish %s %s: %w", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e redfishError
+		msg := resp.Status
+		if json.Unmarshal(data, &e) == nil {
+			switch {
+			case len(e.Error.Info) > 0 && e.Error.Info[0].Message != "":
+				msg += ": " + e.Error.Info[0].Message
+			case e.Error.Message != "":
+				msg += ": " + e.Error.Message
+			}
+		}
+		return fmt.Errorf("redfish %s %s: %s", method, path, msg)
+	}
+	if into != nil {
+		if err := json.Unmarshal(data, into); err != nil {
+			return fmt.Errorf("redfish %s %s: invalid response: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// powerOnIPMI runs ipmitool's chassis power on, which BMCs accept for a
+// server already on too.
+func (b *BMC) powerOnIPMI(ctx context.Context, username, password string, logger *zap.Logger) error {
+	host, port := b.Endpoint, ""
+	if h, p, err := net.SplitHostPort(b.Endpoint); err == nil {
+		host, port = h, p
+	}
+	args := []string{"-I", "lanplus", "-H", host, "-U", username, "-E"}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "chassis", "power", "on")
+	cmd := exec.CommandContext(ctx, "ipmitool", args...)
+	// -E has ipmitool read it here, where other users can't see it
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+password)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("ipmitool chassis power on: %w: %s", err, msg)
+		}
+		return fmt.Errorf("ipmitool chassis power on: %w", err)
+	}
+	logger.Debug("system powered on through ipmi", zap.String("bmc", b.Endpoint), zap.String("output", strings.TrimSpace(string(out))))
+	return nil
+}
+
+// parseBMC parses a target's bmc: an optional endpoint, then a block with
+// type, endpoint, system, reset_type, username, password, ca,
+// insecure_skip_verify and timeout.
+func parseBMC(d *caddyfile.Dispenser) (*BMC, error) {
+	b := new(BMC)
+	if d.NextArg() {
+		b.Endpoint = d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "type":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.Type = v
+		case "endpoint":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.Endpoint = v
+		case "system":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.System = v
+		case "reset_type":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.ResetType = v
+		case "username":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.Username = v
+		case "password":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.Password = v
+		case "ca":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.CA = v
+		case "insecure_skip_verify":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			b.InsecureSkipVerify = true
+		case "timeout":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			b.Timeout = dur
+		default:
+			return nil, d.Errf("unrecognized bmc subdirective '%s'", d.Val())
+		}
+	}
+	if b.Endpoint == "" {
+		return nil, d.Err("bmc requires an endpoint")
+	}
+	return b, nil
+}
@@ -0,0 +1,217 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestBMCConfig(t *testing.T) {
+	target := func(bmc string) string {
+		return "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tbmc " + bmc + "\n\t}\n}"
+	}
+	tests := []struct {
+		name    string
+		input   string
+		want    BMC
+		wantErr bool
+	}{
+		{name: "endpoint", input: target("https://192.0.2.5"), want: BMC{Endpoint: "https://192.0.2.5"}},
+		{
+			name:  "block",
+			input: target("{\n\t\t\tendpoint https://192.0.2.5\n\t\t\tsystem /redfish/v1/Systems/1\n\t\t\treset_type ForceOn\n\t\t\tusername admin\n\t\t\tpassword {env.BMC_PASSWORD}\n\t\t\tinsecure_skip_verify\n\t\t\ttimeout 1m\n\t\t}"),
+			want: BMC{
+				Endpoint:           "https://192.0.2.5",
+				System:             "/redfish/v1/Systems/1",
+				ResetType:          "ForceOn",
+				Username:           "admin",
+				Password:           "{env.BMC_PASSWORD}",
+				InsecureSkipVerify: true,
+				Timeout:            caddy.Duration(time.Minute),
+			},
+		},
+		{name: "no endpoint", input: target("{\n\t\t\tusername admin\n\t\t}"), wantErr: true},
+		{name: "two endpoints", input: target("https://192.0.2.5 https://192.0.2.6"), wantErr: true},
+		{name: "not a URL", input: target("192.0.2.5"), wantErr: true},
+		{name: "other scheme", input: target("ftp://192.0.2.5"), wantErr: true},
+		{name: "relative system", input: target("https://192.0.2.5 {\n\t\t\tsystem Systems/1\n\t\t}"), wantErr: true},
+		{name: "ca and insecure_skip_verify", input: target("https://192.0.2.5 {\n\t\t\tca ca.pem\n\t\t\tinsecure_skip_verify\n\t\t}"), wantErr: true},
+		{name: "missing ca", input: target("https://192.0.2.5 {\n\t\t\tca /nonexistent/ca.pem\n\t\t}"), wantErr: true},
+		{name: "negative timeout", input: target("https://192.0.2.5 {\n\t\t\ttimeout -1s\n\t\t}"), wantErr: true},
+		{name: "unknown type", input: target("192.0.2.5 {\n\t\t\ttype amt\n\t\t}"), wantErr: true},
+		{name: "ipmi URL", input: target("https://192.0.2.5 {\n\t\t\ttype ipmi\n\t\t\tusername admin\n\t\t}"), wantErr: true},
+		{name: "ipmi without username", input: target("192.0.2.5 {\n\t\t\ttype ipmi\n\t\t}"), wantErr: true},
+		{name: "ipmi with system", input: target("192.0.2.5 {\n\t\t\ttype ipmi\n\t\t\tusername admin\n\t\t\tsystem /redfish/v1/Systems/1\n\t\t}"), wantErr: true},
+		{name: "unknown subdirective", input: target("https://192.0.2.5 {\n\t\t\tport 623\n\t\t}"), wantErr: true},
+		{
+			name:    "with relay",
+			input:   "wake_on_lan {\n\trelay 192.0.2.10:9\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tbmc https://192.0.2.5\n\t}\n}",
+			wantErr: true,
+		},
+		{
+			name:    "with send_until_up",
+			input:   "wake_on_lan {\n\twait 1m\n\tsend_until_up\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tcheck 192.0.2.1:22\n\t\tbmc https://192.0.2.5\n\t}\n}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.Targets[0].BMC != tt.want {
+				t.Errorf("bmc %+v, want %+v", *w.Targets[0].BMC, tt.want)
+			}
+		})
+	}
+}
+
+// stubRedfish is a Redfish service managing systems by path, each with its
+// power state, recording the resets it is asked for.
+type stubRedfish struct {
+	*httptest.Server
+	// The status failing the reset with, if set
+	resetStatus int
+
+	mu     sync.Mutex
+	states map[string]string
+	resets []string
+	auth   []string
+}
+
+func newStubRedfish(t *testing.T, states map[string]string) *stubRedfish {
+	t.Helper()
+	s := &stubRedfish{states: states}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubRedfish) serve(rw http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, password, _ := r.BasicAuth()
+	s.auth = append(s.auth, user+":"+password)
+	rw.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == redfishSystemsPath:
+		var c redfishCollection
+		for path := range s.states {
+			c.Members = append(c.Members, struct {
+				ID string `json:"@odata.id"`
+			}{ID: path})
+		}
+		json.NewEncoder(rw).Encode(c)
+	case r.Method == http.MethodGet && s.states[r.URL.Path] != "":
+		var sys redfishSystem
+		sys.PowerState = s.states[r.URL.Path]
+		sys.Actions.Reset.Target = r.URL.Path + "/Actions/Reset"
+		json.NewEncoder(rw).Encode(sys)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/Actions/Reset"):
+		if s.resetStatus != 0 {
+			rw.WriteHeader(s.resetStatus)
+			rw.Write([]byte(`{"error":{"message":"General error","@Message.ExtendedInfo":[{"Message":"The system is locked."}]}}`))
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		s.resets = append(s.resets, strings.TrimSuffix(r.URL.Path, "/Actions/Reset")+" "+body["ResetType"])
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(rw, `{"error":{"message":"not found"}}`, http.StatusNotFound)
+	}
+}
+
+func (s *stubRedfish) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.resets...)
+}
+
+func TestPowerOnRedfish(t *testing.T) {
+	tests := []struct {
+		name        string
+		states      map[string]string
+		bmc         BMC
+		resetStatus int
+		wantResets  []string
+		wantErr     string
+	}{
+		{name: "off", states: map[string]string{"/redfish/v1/Systems/1": "Off"}, wantResets: []string{"/redfish/v1/Systems/1 On"}},
+		{name: "already on", states: map[string]string{"/redfish/v1/Systems/1": "On"}},
+		{
+			name:       "system and reset_type",
+			states:     map[string]string{"/redfish/v1/Systems/1": "Off", "/redfish/v1/Systems/2": "Off"},
+			bmc:        BMC{System: "/redfish/v1/Systems/2", ResetType: "ForceOn"},
+			wantResets: []string{"/redfish/v1/Systems/2 ForceOn"},
+		},
+		{name: "several systems", states: map[string]string{"/redfish/v1/Systems/1": "Off", "/redfish/v1/Systems/2": "Off"}, wantErr: "2 systems"},
+		{name: "unknown system", states: map[string]string{"/redfish/v1/Systems/1": "Off"}, bmc: BMC{System: "/redfish/v1/Systems/9"}, wantErr: "404"},
+		{name: "reset refused", states: map[string]string{"/redfish/v1/Systems/1": "Off"}, resetStatus: http.StatusConflict, wantErr: "The system is locked."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WOL_TEST_BMC_PASSWORD", "s3cret")
+			stub := newStubRedfish(t, tt.states)
+			stub.resetStatus = tt.resetStatus
+			b := tt.bmc
+			b.Endpoint, b.Username, b.Password = stub.URL, "admin", "{env.WOL_TEST_BMC_PASSWORD}"
+			err := b.powerOn(t.Context(), zap.NewNop())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("powerOn = %v, want an error with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stub.requested(); strings.Join(got, ",") != strings.Join(tt.wantResets, ",") {
+				t.Errorf("resets %q, want %q", got, tt.wantResets)
+			}
+			for _, auth := range stub.auth {
+				if auth != "admin:s3cret" {
+					t.Errorf("authenticated as %q, want admin with the password from the environment", auth)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTPBMC(t *testing.T) {
+	host := newFakeHost(t)
+	stub := newStubRedfish(t, map[string]string{"/redfish/v1/Systems/1": "Off"})
+	w := provisionTest(t, &WakeOnLAN{
+		Targets: []Target{
+			{Name: "server", MAC: testMAC, IP: "127.0.0.1", Port: host.port(), BMC: &BMC{Endpoint: stub.URL}},
+			{Name: "desktop", MAC: "00:11:22:aa:bb:cc", IP: "127.0.0.1", Port: host.port()},
+		},
+		StatusHeader: "X-Wake-Result",
+	})
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Values("X-Wake-Result"); strings.Join(got, ",") != "sent; target=server,sent; target=desktop" {
+		t.Errorf("results %q, want both sent", got)
+	}
+	if got := stub.requested(); len(got) != 1 {
+		t.Errorf("resets %q, want the server powered on", got)
+	}
+	// Only the target without a BMC is sent a packet
+	if p := host.expect(t, 1)[0]; !strings.Contains(string(p), "\x00\x11\x22\xaa\xbb\xcc") {
+		t.Errorf("packet % x, want the desktop's", p)
+	}
+	host.expectNone(t)
+}
@@ -0,0 +1,241 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultRearmInterval is how often once_per_boot probes targets.
+const defaultRearmInterval = 30 * time.Second
+
+// bootWakingTimeout is how long a target sent to without confirmation
+// stays waking before it counts as down again.
+const bootWakingTimeout = 5 * time.Minute
+
+// OncePerBoot makes the handler wake each target once, then leave it alone
+// while it stays up: a probe running in the background re-arms the target
+// once it finds it down again.
+type OncePerBoot struct {
+	// Address (host:port) probed over TCP. Default: each target's check
+	// address.
+	Probe string `json:"probe,omitempty"`
+	// How often targets that were woken are probed. Default: 30s.
+	RearmInterval caddy.Duration `json:"rearm_interval,omitempty"`
+}
+
+// validateOncePerBoot checks once_per_boot and that every target can be
+// probed.
+func (w *WakeOnLAN) validateOncePerBoot() error {
+	o := w.OncePerBoot
+	if o == nil {
+		return nil
+	}
+	if o.RearmInterval < 0 {
+		return fmt.Errorf("invalid once_per_boot rearm_interval %s", time.Duration(o.RearmInterval))
+	}
+	if err := validateProbeAddress(o.Probe); err != nil {
+		return fmt.Errorf("once_per_boot probe: %w", err)
+	}
+	if o.Probe == "" {
+		for _, t := range w.allTargets() {
+			if t.Check == "" {
+				return errors.New("once_per_boot requires a probe or check address")
+			}
+		}
+	}
+	return nil
+}
+
+// The states of a target under once_per_boot. Down targets aren't
+// tracked.
+type bootState int
+
+const (
+	bootDown bootState = iota
+	// Sent to, not yet seen up.
+	bootWaking
+	// Seen up; requests don't send until a probe finds it down.
+	bootUp
+)
+
+func (s bootState) String() string {
+	switch s {
+	case bootWaking:
+		return "waking"
+	case bootUp:
+		return "up"
+	}
+	return "down"
+}
+
+type bootTarget struct {
+	state bootState
+	probe string
+	since time.Time
+}
+
+// bootTracker holds the once_per_boot state of each target, by key, and
+// moves it through down → waking → up → down from wake outcomes and
+// background probes.
+type bootTracker struct {
+	interval     time.Duration
+	probeTimeout time.Duration
+	logger       *zap.Logger
+	probe        func(ctx context.Context, addr string, timeout time.Duration) bool
+	now          func() time.Time
+
+	mu      sync.Mutex
+	targets map[string]*bootTarget
+}
+
+func newBootTracker(cfg *OncePerBoot, probeTimeout time.Duration, logger *zap.Logger) *bootTracker {
+	interval := time.Duration(cfg.RearmInterval)
+	if interval == 0 {
+		interval = defaultRearmInterval
+	}
+	return &bootTracker{
+		interval:     interval,
+		probeTimeout: probeTimeout,
+		logger:       logger,
+		probe:        probeTCP,
+		now:          time.Now,
+		targets:      make(map[string]*bootTarget),
+	}
+}
+
+// state returns the state of the target with key.
+func (b *bootTracker) state(key string) bootState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, ok := b.targets[key]; ok {
+		return t.state
+	}
+	return bootDown
+}
+
+// record moves the target with key on from the outcome of waking it: up
+// if it was seen up, waking if it was only sent to, and down otherwise.
+func (b *bootTracker) record(key, probe string, result wakeResult) {
+	if probe == "" {
+		// Targets added after the config loaded may have nothing to probe
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch result {
+	case resultAlreadyUp, resultWoken:
+		b.set(key, probe, bootUp)
+	case resultSent, resultAckReceived, resultTXConfirmed:
+		if t, ok := b.targets[key]; !ok || t.state != bootUp {
+			b.set(key, probe, bootWaking)
+		}
+	default:
+		delete(b.targets, key)
+	}
+}
+
+func (b *bootTracker) set(key, probe string, state bootState) {
+	t, ok := b.targets[key]
+	if !ok {
+		t = &bootTarget{}
+		b.targets[key] = t
+	}
+	if !ok || t.state != state {
+		t.state, t.since = state, b.now()
+		b.logger.Debug("once_per_boot state changed", zap.String("key", key), zap.Stringer("state", state))
+	}
+	t.probe = probe
+}
+
+// check probes every tracked target once: waking targets that answer are
+// up, up targets that don't are down and re-armed, and waking targets
+// that never answered are given up on.
+func (b *bootTracker) check(ctx context.Context) {
+	b.mu.Lock()
+	probes := make(map[string]string, len(b.targets))
+	for key, t := range b.targets {
+		probes[key] = t.probe
+	}
+	b.mu.Unlock()
+
+	for key, addr := range probes {
+		up := b.probe(ctx, addr, b.probeTimeout)
+		if ctx.Err() != nil {
+			return
+		}
+		b.mu.Lock()
+		t, ok := b.targets[key]
+		switch {
+		case !ok:
+		case up && t.state == bootWaking:
+			b.set(key, addr, bootUp)
+		case !up && t.state == bootUp:
+			delete(b.targets, key)
+			b.logger.Info("target went down; re-armed for the next wake", zap.String("key", key), zap.String("probe", addr))
+		case !up && b.now().Sub(t.since) > bootWakingTimeout:
+			delete(b.targets, key)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// run checks the targets every interval until ctx is done.
+func (b *bootTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.check(ctx)
+		}
+	}
+}
+
+// bootProbe returns the address once_per_boot probes t at.
+func (w *WakeOnLAN) bootProbe(t Target) string {
+	if w.OncePerBoot.Probe != "" {
+		return w.OncePerBoot.Probe
+	}
+	return t.Check
+}
+
+// parseOncePerBoot parses the once_per_boot subdirective.
+func parseOncePerBoot(d *caddyfile.Dispenser) (*OncePerBoot, error) {
+	o := new(OncePerBoot)
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "probe":
+			addr, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			o.Probe = addr
+		case "rearm_interval":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			o.RearmInterval = dur
+		default:
+			return nil, d.Errf("unrecognized once_per_boot subdirective '%s'", d.Val())
+		}
+	}
+	return o, nil
+}
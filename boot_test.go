@@ -0,0 +1,197 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestOncePerBootConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    OncePerBoot
+		wantErr bool
+	}{
+		{
+			name:  "full",
+			input: "once_per_boot {\n\t\tprobe 192.0.2.1:22\n\t\trearm_interval 1m\n\t}",
+			want:  OncePerBoot{Probe: "192.0.2.1:22", RearmInterval: caddy.Duration(time.Minute)},
+		},
+		{name: "check address", input: "check 192.0.2.1:22\n\tonce_per_boot"},
+		{name: "without probe or check", input: "once_per_boot", wantErr: true},
+		{name: "argument", input: "check 192.0.2.1:22\n\tonce_per_boot 1m", wantErr: true},
+		{name: "unknown subdirective", input: "check 192.0.2.1:22\n\tonce_per_boot {\n\t\tcooldown 1m\n\t}", wantErr: true},
+		{name: "negative rearm_interval", input: "check 192.0.2.1:22\n\tonce_per_boot {\n\t\trearm_interval -1s\n\t}", wantErr: true},
+		{name: "probe without port", input: "once_per_boot {\n\t\tprobe 192.0.2.1\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.OncePerBoot != tt.want {
+				t.Errorf("once_per_boot = %+v, want %+v", *w.OncePerBoot, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootTracker(t *testing.T) {
+	// Each step records a wake result, or else runs the background probe
+	// with the host up or not, after advancing the clock
+	type step struct {
+		advance time.Duration
+		record  wakeResult
+		up      bool
+		want    bootState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "woken",
+			steps: []step{
+				{record: resultWoken, want: bootUp},
+				{up: true, want: bootUp},
+				{up: false, want: bootDown},
+			},
+		},
+		{
+			name: "already up",
+			steps: []step{
+				{record: resultAlreadyUp, want: bootUp},
+				{up: false, want: bootDown},
+			},
+		},
+		{
+			name: "sent, then seen up",
+			steps: []step{
+				{record: resultSent, want: bootWaking},
+				{up: false, want: bootWaking},
+				{advance: time.Minute, up: true, want: bootUp},
+				{record: resultSent, want: bootUp},
+				{up: false, want: bootDown},
+			},
+		},
+		{
+			name: "sent, never up",
+			steps: []step{
+				{record: resultSent, want: bootWaking},
+				{advance: bootWakingTimeout - time.Second, up: false, want: bootWaking},
+				{advance: 2 * time.Second, up: false, want: bootDown},
+			},
+		},
+		{
+			name: "failed",
+			steps: []step{
+				{record: resultSent, want: bootWaking},
+				{record: resultSendFailed, want: bootDown},
+				{record: resultWoken, want: bootUp},
+				{record: resultWakeTimeout, want: bootDown},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var up bool
+			now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			b := newBootTracker(&OncePerBoot{}, time.Second, zap.NewNop())
+			b.probe = func(context.Context, string, time.Duration) bool { return up }
+			b.now = func() time.Time { return now }
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				if s.record != "" {
+					b.record("nas", "192.0.2.1:22", s.record)
+				} else {
+					up = s.up
+					b.check(t.Context())
+				}
+				if got := b.state("nas"); got != s.want {
+					t.Fatalf("step %d: state = %s, want %s", i+1, got, s.want)
+				}
+			}
+		})
+	}
+
+	t.Run("nothing to probe", func(t *testing.T) {
+		b := newBootTracker(&OncePerBoot{}, time.Second, zap.NewNop())
+		b.record("nas", "", resultWoken)
+		if got := b.state("nas"); got != bootDown {
+			t.Errorf("state = %s, want %s", got, bootDown)
+		}
+	})
+}
+
+func TestServeHTTPOncePerBoot(t *testing.T) {
+	host := newFakeHost(t)
+	checkPort := closedPort(t)
+	check := fmt.Sprintf("127.0.0.1:%d", checkPort)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:          testMAC,
+		IP:           "127.0.0.1",
+		Port:         host.port(),
+		Check:        check,
+		OncePerBoot:  &OncePerBoot{RearmInterval: caddy.Duration(time.Hour)},
+		StatusHeader: "X-Wake-Result",
+	})
+	var listener net.Listener
+
+	// Each step brings the host up or down, then serves a request or runs
+	// the background probe
+	steps := []struct {
+		up, down    bool
+		probe       bool
+		wantResult  wakeResult
+		wantPackets int
+		wantState   bootState
+	}{
+		{wantResult: resultSent, wantPackets: 1, wantState: bootWaking},
+		{up: true, probe: true, wantState: bootUp},
+		// Neither sent nor probed: the host stays up as far as the handler
+		// knows, until the background probe finds it down
+		{down: true, wantResult: resultAlreadyUp, wantState: bootUp},
+		{probe: true, wantState: bootDown},
+		{wantResult: resultSent, wantPackets: 1, wantState: bootWaking},
+	}
+	key := w.allTargets()[0].key()
+	for i, s := range steps {
+		switch {
+		case s.up:
+			var err error
+			if listener, err = net.Listen("tcp4", check); err != nil {
+				t.Fatal(err)
+			}
+		case s.down:
+			listener.Close()
+		}
+		if s.probe {
+			w.boot.check(t.Context())
+		} else {
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatalf("step %d: %v", i+1, err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(s.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("step %d: result = %q, want %q", i+1, got, want)
+			}
+			if s.wantPackets > 0 {
+				host.expect(t, s.wantPackets)
+			}
+			host.expectNone(t)
+		}
+		if got := w.boot.state(key); got != s.wantState {
+			t.Errorf("step %d: state = %s, want %s", i+1, got, s.wantState)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errBroadcastUnsupported is returned where SO_BROADCAST can't be set
+// explicitly; sends then fall back to dialing per packet.
+var errBroadcastUnsupported = errors.New("setting SO_BROADCAST is not supported on this platform")
+
+// errSendBufferUnsupported is returned where SO_SNDBUF can't be set.
+var errSendBufferUnsupported = errors.New("setting SO_SNDBUF is not supported on this platform")
+
+// Range of send_buffer sizes, in bytes.
+const (
+	minSendBuffer = 4096
+	maxSendBuffer = 16 << 20
+)
+
+// sharesBroadcastConn reports whether broadcasts go out on one socket
+// opened when the config loads. A helper sends them on its own sockets,
+// and in a VRF each packet is sent on a socket bound to it.
+func (w *WakeOnLAN) sharesBroadcastConn() bool {
+	return (w.Broadcast != "" || w.escalatesToBroadcast() || w.BroadcastFallback != nil) && w.HelperSocket == "" && w.VRF == ""
+}
+
+// validateSendBuffer checks send_buffer's size and that there is a shared
+// socket for it to size.
+func (w *WakeOnLAN) validateSendBuffer() error {
+	switch {
+	case w.SendBuffer == 0:
+		return nil
+	case w.SendBuffer < minSendBuffer || w.SendBuffer > maxSendBuffer:
+		return fmt.Errorf("invalid send_buffer %d: must be %d to %d bytes", w.SendBuffer, minSendBuffer, maxSendBuffer)
+	case !w.sharesBroadcastConn():
+		return errors.New("send_buffer sizes the socket broadcasts share; requires broadcast, escalate to broadcast or broadcast_fallback, without helper_socket or vrf")
+	}
+	return nil
+}
+
+// setSendBuffer sets conn's send buffer to n bytes and returns the size
+// the system settled on, which it may round or clamp.
+func setSendBuffer(conn *net.UDPConn, n int) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		if sockErr = setSockSendBuffer(fd, n); sockErr == nil {
+			size, sockErr = sockSendBuffer(fd)
+		}
+	}); err != nil {
+		return 0, err
+	}
+	return size, sockErr
+}
+
+// sizeSendBuffer applies send_buffer to the shared broadcast socket and
+// logs the size the system settled on. One that can't be set only logs a
+// warning: the default buffer still sends.
+func (w *WakeOnLAN) sizeSendBuffer() {
+	if w.SendBuffer == 0 {
+		return
+	}
+	size, err := setSendBuffer(w.broadcastConn, w.SendBuffer)
+	if err != nil {
+		w.logger.Warn("setting the broadcast socket's send buffer; keeping the system's", zap.Int("send_buffer", w.SendBuffer), zap.Error(err))
+		return
+	}
+	if size < w.SendBuffer {
+		w.logger.Warn("broadcast socket's send buffer clamped by the system; on Linux, raise net.core.wmem_max",
+			zap.Int("send_buffer", w.SendBuffer), zap.Int("effective", size))
+		return
+	}
+	w.logger.Info("broadcast socket's send buffer set", zap.Int("send_buffer", w.SendBuffer), zap.Int("effective", size))
+}
+
+// openBroadcastConn opens an unconnected IPv4 UDP socket with SO_BROADCAST
+// set, to be reused for every broadcast packet. With ports, the socket is
+// bound to a port from that range.
+func openBroadcastConn(ports *sourcePorts) (*net.UDPConn, error) {
+	return listenBroadcast(ports, "broadcast")
+}
+
+// listenBroadcast opens an unconnected IPv4 UDP socket with SO_BROADCAST
+// set, bound to the port pinned for key when ports is set.
+func listenBroadcast(ports *sourcePorts, key string) (*net.UDPConn, error) {
+	listen := func(port int) (*net.UDPConn, error) {
+		return ports.listenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: port})
+	}
+	var conn *net.UDPConn
+	var err error
+	if ports != nil {
+		conn, err = ports.bind(key, listen)
+	} else {
+		conn, err = listen(0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = setBroadcast(fd)
+	}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if sockErr != nil {
+		conn.Close()
+		return nil, sockErr
+	}
+	return conn, nil
+}
+
+// sendBroadcast sends payload to the broadcast address, on the shared
+// socket if there is one or on a fresh one otherwise, such as for a ttl
+// the shared socket mustn't keep.
+func sendBroadcast(ctx context.Context, conn *net.UDPConn, broadcast string, port int, payload []byte, ttl int, opts sendOptions) error {
+	ip := net.ParseIP(broadcast)
+	if ip == nil {
+		return fmt.Errorf("invalid broadcast address %q", broadcast)
+	}
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	if conn == nil || ttl != 0 {
+		return writeBroadcast(ctx, opts.SourcePorts, "broadcast", addr, payload, ttl)
+	}
+	start := time.Now()
+	n, err := conn.WriteToUDP(payload, addr)
+	observePhase(ctx, phaseWrite, start)
+	if err != nil {
+		return err
+	}
+	return checkWritten(n, len(payload))
+}
+
+// writeBroadcast sends payload to the broadcast address addr from a
+// one-off unconnected socket with SO_BROADCAST set, as connecting a UDP
+// socket to a broadcast address fails on some platforms. Where the option
+// can't be set explicitly, it falls back to a dialed socket.
+func writeBroadcast(ctx context.Context, ports *sourcePorts, key string, addr *net.UDPAddr, payload []byte, ttl int) error {
+	start := time.Now()
+	conn, err := listenBroadcast(ports, key)
+	if errors.Is(err, errBroadcastUnsupported) {
+		return writeConnected(ctx, ports, key, addr, payload, ttl)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := setTTL(conn, addr.IP, ttl); err != nil {
+		return err
+	}
+	observePhase(ctx, phaseDial, start)
+
+	start = time.Now()
+	n, err := conn.WriteToUDP(payload, addr)
+	observePhase(ctx, phaseWrite, start)
+	if err != nil {
+		return err
+	}
+	return checkWritten(n, len(payload))
+}
+
+// isBroadcastAddr reports whether ip is the limited broadcast address or
+// the directed broadcast address of a local network.
+func isBroadcastAddr(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return true
+	}
+	nets, err := interfaceNetworks()
+	if err != nil {
+		return false
+	}
+	for _, n := range nets {
+		// /31 and /32 networks have no broadcast address
+		if ones, bits := n.Mask.Size(); bits-ones > 1 && broadcastAddr(n).Equal(ip4) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBroadcast checks that addr is an IPv4 address usable as a
+// broadcast destination.
+func validateBroadcast(addr string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("broadcast address %q must be an IPv4 address", addr)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package caddy_wakeonlan
+
+// setBroadcast is not implemented on this platform.
+func setBroadcast(fd uintptr) error {
+	return errBroadcastUnsupported
+}
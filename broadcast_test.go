@@ -0,0 +1,259 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestValidateBroadcast(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: "192.168.1.255"},
+		{addr: "255.255.255.255"},
+		{addr: "ff02::1", wantErr: true},
+		{addr: "lan.broadcast", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if err := validateBroadcast(tt.addr); (err != nil) != tt.wantErr {
+				t.Errorf("validateBroadcast(%q) = %v, want error %v", tt.addr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsBroadcastAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "255.255.255.255", want: true},
+		{ip: "127.0.0.1", want: false},
+		{ip: "ff02::1", want: false},
+	}
+	if ip := localBroadcast(t); ip != nil {
+		tests = append(tests, struct {
+			ip   string
+			want bool
+		}{ip: ip.String(), want: true})
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isBroadcastAddr(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("isBroadcastAddr(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroadcastConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "set", input: "broadcast 192.168.1.255", want: "192.168.1.255"},
+		{name: "missing address", input: "broadcast", wantErr: true},
+		{name: "IPv6", input: "broadcast ff02::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.Broadcast != tt.want {
+				t.Errorf("broadcast = %q, want %q", w.Broadcast, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPBroadcastConn(t *testing.T) {
+	// A loopback address stands in for the broadcast address, so the
+	// packets can be caught
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, Broadcast: "127.0.0.1", Port: host.port()})
+	conn := w.broadcastConn
+	if conn == nil {
+		t.Fatal("no broadcast socket opened at provision")
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		p := host.expect(t, 1)[0]
+		hw, _ := parseMAC(testMAC)
+		if string(p[:102]) != string(buildMagicPacket(hw)) {
+			t.Errorf("request %d: not the magic packet", i+1)
+		}
+	}
+	if w.broadcastConn != conn {
+		t.Error("the broadcast socket was replaced between requests")
+	}
+}
+
+func TestOpenBroadcastConn(t *testing.T) {
+	host := newFakeHost(t)
+	conn, err := openBroadcastConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := sendBroadcast(t.Context(), conn, "127.0.0.1", host.port(), []byte("wake"), 0, sendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := host.expect(t, 1)[0]; string(got) != "wake" {
+		t.Errorf("got %q, want %q", got, "wake")
+	}
+	// A TTL of its own goes out on a fresh socket
+	if err := sendBroadcast(t.Context(), conn, "127.0.0.1", host.port(), []byte("ttl"), 2, sendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	host.expect(t, 1)
+	if err := sendBroadcast(t.Context(), conn, "lan", host.port(), []byte("wake"), 0, sendOptions{}); err == nil {
+		t.Error("sent to an invalid broadcast address")
+	}
+}
+
+// localBroadcast returns the broadcast address of a local network, or
+// nil if the host has none.
+func localBroadcast(t *testing.T) net.IP {
+	t.Helper()
+	nets, err := interfaceNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nets {
+		if ones, bits := n.Mask.Size(); bits-ones > 1 {
+			return broadcastAddr(n)
+		}
+	}
+	return nil
+}
+
+func TestWriteUDPBroadcast(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   net.IP
+	}{
+		{name: "limited", ip: net.IPv4bcast},
+		{name: "directed", ip: localBroadcast(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.ip == nil {
+				t.Skip("no local network with a broadcast address")
+			}
+			// Broadcasts are looped back to sockets on the wildcard address
+			host := newFakeHostOn(t, net.IPv4zero)
+			err := writeUDPFrom(t.Context(), nil, "broadcast", &net.UDPAddr{IP: tt.ip, Port: host.port()}, []byte("wake"), 0)
+			if err != nil {
+				t.Fatalf("writing to %s: %v", tt.ip, err)
+			}
+			if got := host.expect(t, 1)[0]; string(got) != "wake" {
+				t.Errorf("got %q, want %q", got, "wake")
+			}
+		})
+	}
+}
+
+func TestServeHTTPBroadcastTarget(t *testing.T) {
+	host := newFakeHostOn(t, net.IPv4zero)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "255.255.255.255", Port: host.port(), StatusHeader: "X-Wake-Result"})
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Get("X-Wake-Result"); !strings.HasPrefix(got, string(resultSent)) {
+		t.Errorf("result %q, want %s", got, resultSent)
+	}
+	host.expect(t, 1)
+}
+
+func TestSendBufferConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{input: "broadcast 192.168.1.255\n\tsend_buffer 1048576", want: 1 << 20},
+		{input: "broadcast 192.168.1.255\n\tsend_buffer 4096", want: minSendBuffer},
+		{input: "broadcast 192.168.1.255\n\tsend_buffer 16777216", want: maxSendBuffer},
+		{input: "broadcast 192.168.1.255\n\tsend_buffer 4095", wantErr: true},
+		{input: "broadcast 192.168.1.255\n\tsend_buffer 16777217", wantErr: true},
+		{input: "broadcast 192.168.1.255\n\tsend_buffer", wantErr: true},
+		{input: "broadcast 192.168.1.255\n\tsend_buffer 1MiB", wantErr: true},
+		{input: "broadcast 192.168.1.255\n\tsend_buffer 4096 8192", wantErr: true},
+		// No shared socket to size
+		{input: "send_buffer 1048576", wantErr: true},
+		{input: "broadcast 192.168.1.255\n\thelper_socket /run/wol.sock\n\tsend_buffer 1048576", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.SendBuffer != tt.want {
+				t.Errorf("send_buffer = %d, want %d", w.SendBuffer, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetSendBuffer(t *testing.T) {
+	conn, err := openBroadcastConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	size, err := setSendBuffer(conn, 64<<10)
+	if errors.Is(err, errSendBufferUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Linux doubles it, others may round it
+	if size < 32<<10 {
+		t.Errorf("send buffer of %d bytes, want about %d", size, 64<<10)
+	}
+}
+
+func TestSizeSendBuffer(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, Broadcast: "127.0.0.1", Port: host.port(), SendBuffer: 64 << 10})
+	if w.broadcastConn == nil {
+		t.Fatal("no broadcast socket opened at provision")
+	}
+	// Sized again, as at provision, to see what is logged
+	logs := observeLogs(w)
+	w.sizeSendBuffer()
+	if logs.FilterMessageSnippet("send buffer").Len() != 1 {
+		t.Errorf("logged %v, want the size settled on", logs.All())
+	}
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	host.expect(t, 1)
+
+	// Without send_buffer the system's size is left alone
+	w.SendBuffer = 0
+	logged := logs.Len()
+	w.sizeSendBuffer()
+	if logs.Len() != logged {
+		t.Errorf("logged %v without send_buffer, want nothing", logs.All()[logged:])
+	}
+}
@@ -0,0 +1,10 @@
+//go:build unix
+
+package caddy_wakeonlan
+
+import "golang.org/x/sys/unix"
+
+// setBroadcast enables SO_BROADCAST on the socket.
+func setBroadcast(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+}
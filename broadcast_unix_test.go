@@ -0,0 +1,34 @@
+//go:build unix
+
+package caddy_wakeonlan
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenBroadcastConnSetsOption(t *testing.T) {
+	conn, err := openBroadcastConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var on int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		on, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	if on == 0 {
+		t.Error("SO_BROADCAST not set on the broadcast socket")
+	}
+}
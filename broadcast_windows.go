@@ -0,0 +1,10 @@
+//go:build windows
+
+package caddy_wakeonlan
+
+import "golang.org/x/sys/windows"
+
+// setBroadcast enables SO_BROADCAST on the socket.
+func setBroadcast(fd uintptr) error {
+	return windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_BROADCAST, 1)
+}
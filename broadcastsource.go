@@ -0,0 +1,181 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+)
+
+// Policies for picking the interfaces 255.255.255.255 goes out on.
+const (
+	sourceLargestSubnet = "largest_subnet"
+	sourceDefaultRoute  = "default_route"
+	sourceAll           = "all"
+)
+
+// defaultRouteProbe is the address routed to, without sending anything,
+// to find the source address of the default route.
+const defaultRouteProbe = "192.0.2.1:9"
+
+// localNetwork is an IPv4 network of an up, broadcast-capable interface,
+// with IP the interface's own address in it.
+type localNetwork struct {
+	iface   string
+	network *net.IPNet
+}
+
+// validateBroadcastSource checks broadcast_source and the settings it
+// depends on.
+func (w *WakeOnLAN) validateBroadcastSource() error {
+	switch w.BroadcastSource {
+	case "":
+		return nil
+	case sourceLargestSubnet, sourceDefaultRoute, sourceAll:
+	default:
+		return fmt.Errorf("invalid broadcast_source %q (must be largest_subnet, default_route or all)", w.BroadcastSource)
+	}
+	switch {
+	case w.Broadcast == "" && !w.escalatesToBroadcast() && w.BroadcastFallback == nil:
+		return errors.New("broadcast_source requires broadcast, a broadcast escalate step or broadcast_fallback")
+	case w.relayed() || w.HelperSocket != "" || w.SourcePortRange != "":
+		return errors.New("broadcast_source cannot be combined with relay, helper_socket or source_port_range")
+	}
+	return nil
+}
+
+// localNetworks lists the IPv4 networks of every up, broadcast-capable,
+// non-loopback interface.
+func localNetworks() ([]localNetwork, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var nets []localNetwork
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			n, ok := a.(*net.IPNet)
+			if !ok || n.IP.To4() == nil {
+				continue
+			}
+			nets = append(nets, localNetwork{iface: iface.Name, network: &net.IPNet{IP: n.IP.To4(), Mask: n.Mask}})
+		}
+	}
+	return nets, nil
+}
+
+// defaultRouteIP returns the local address the system sends from to reach
+// hosts off every local network. Connecting a UDP socket only looks the
+// route up; nothing is sent.
+func defaultRouteIP() (net.IP, error) {
+	conn, err := net.Dial("udp4", defaultRouteProbe)
+	if err != nil {
+		return nil, fmt.Errorf("finding the default route: %w", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// selectBroadcastSources returns the interfaces of nets that policy picks,
+// given the default route's source address (nil if there is none):
+// largest_subnet the one with the shortest prefix, the first of them on a
+// tie; default_route the one holding defaultIP; all every one, once.
+func selectBroadcastSources(policy string, nets []localNetwork, defaultIP net.IP) ([]string, error) {
+	if len(nets) == 0 {
+		return nil, errors.New("no broadcast-capable IPv4 interface")
+	}
+	switch policy {
+	case sourceLargestSubnet:
+		best := nets[0]
+		for _, n := range nets[1:] {
+			ones, _ := n.network.Mask.Size()
+			bestOnes, _ := best.network.Mask.Size()
+			if ones < bestOnes {
+				best = n
+			}
+		}
+		return []string{best.iface}, nil
+	case sourceDefaultRoute:
+		for _, n := range nets {
+			if n.network.IP.Equal(defaultIP) {
+				return []string{n.iface}, nil
+			}
+		}
+		return nil, fmt.Errorf("no broadcast-capable interface holds the default route source %s", defaultIP)
+	case sourceAll:
+		var ifaces []string
+		for _, n := range nets {
+			if !slices.Contains(ifaces, n.iface) {
+				ifaces = append(ifaces, n.iface)
+			}
+		}
+		return ifaces, nil
+	}
+	return nil, fmt.Errorf("unknown broadcast_source %q", policy)
+}
+
+// broadcastSources returns the interfaces policy picks among the current
+// ones. They are looked up on every send, so addresses that come and go
+// with DHCP are followed.
+func broadcastSources(policy string) ([]string, error) {
+	nets, err := localNetworks()
+	if err != nil {
+		return nil, err
+	}
+	var defaultIP net.IP
+	if policy == sourceDefaultRoute {
+		if defaultIP, err = defaultRouteIP(); err != nil {
+			return nil, err
+		}
+	}
+	return selectBroadcastSources(policy, nets, defaultIP)
+}
+
+// broadcastFromSources sends payload to 255.255.255.255 through each
+// interface policy picks. It succeeds if any of them sent.
+func broadcastFromSources(ctx context.Context, policy string, port int, payload []byte, ttl int, opts sendOptions) error {
+	ifaces, err := broadcastSources(policy)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, ifname := range ifaces {
+		recordDelivery(ctx, delivery{dest: hostPort(net.IPv4bcast.String(), port), transport: protocolUDP, iface: ifname, bytes: len(payload)})
+		if err := broadcastOnInterface(ctx, ifname, net.IPv4bcast.String(), port, payload, ttl, opts); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ifname, err))
+		}
+	}
+	if len(errs) < len(ifaces) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// sendTargetBroadcast sends payload for t to the broadcast address: through
+// t's interface if it is bound to one, through the broadcast_source
+// interfaces for 255.255.255.255, and on the shared socket otherwise.
+// Directed broadcasts already leave through the interface on their network.
+func sendTargetBroadcast(ctx context.Context, t Target, broadcast string, port int, payload []byte, opts sendOptions) error {
+	switch {
+	case t.Interface != "":
+		recordDelivery(ctx, delivery{dest: hostPort(broadcast, port), transport: protocolUDP, iface: t.Interface, bytes: len(payload)})
+		return broadcastOnInterface(ctx, t.Interface, broadcast, port, payload, t.TTL, opts)
+	case opts.BroadcastSource != "" && net.ParseIP(broadcast).Equal(net.IPv4bcast):
+		return broadcastFromSources(ctx, opts.BroadcastSource, port, payload, t.TTL, opts)
+	}
+	recordDelivery(ctx, delivery{dest: hostPort(broadcast, port), transport: protocolUDP, bytes: len(payload)})
+	if ip := net.ParseIP(broadcast); ip != nil {
+		if sent, err := sharedBroadcastOn(ctx, opts, "", &net.UDPAddr{IP: ip, Port: port}, payload, t.TTL); sent {
+			return err
+		}
+	}
+	return sendBroadcast(ctx, opts.BroadcastConn, broadcast, port, payload, t.TTL, opts)
+}
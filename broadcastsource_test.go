@@ -0,0 +1,125 @@
+package caddy_wakeonlan
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBroadcastSourceConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "broadcast 255.255.255.255\n\tbroadcast_source largest_subnet", want: sourceLargestSubnet},
+		{input: "broadcast 255.255.255.255\n\tbroadcast_source default_route", want: sourceDefaultRoute},
+		{input: "broadcast 255.255.255.255\n\tbroadcast_source all", want: sourceAll},
+		{input: "check 192.0.2.1:22\n\tbroadcast_fallback\n\tbroadcast_source all", want: sourceAll},
+		{input: "broadcast 255.255.255.255\n\tbroadcast_source smallest_subnet", wantErr: true},
+		{input: "broadcast 255.255.255.255\n\tbroadcast_source", wantErr: true},
+		{input: "broadcast 255.255.255.255\n\tbroadcast_source all default_route", wantErr: true},
+		{input: "broadcast_source all", wantErr: true},
+		{input: "broadcast 255.255.255.255\n\trelay 192.0.2.10:9\n\tbroadcast_source all", wantErr: true},
+		{input: "broadcast 255.255.255.255\n\tsource_port_range 40000-40010\n\tbroadcast_source all", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.BroadcastSource != tt.want {
+				t.Errorf("broadcast_source = %q, want %q", w.BroadcastSource, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectBroadcastSources(t *testing.T) {
+	network := func(iface, cidr string) localNetwork {
+		ip, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return localNetwork{iface: iface, network: &net.IPNet{IP: ip.To4(), Mask: n.Mask}}
+	}
+	multiHomed := []localNetwork{
+		network("eth0", "192.168.1.10/24"),
+		network("eth1", "10.0.0.5/16"),
+		network("eth1", "10.1.0.5/24"),
+		network("wlan0", "172.16.0.3/16"),
+	}
+	tests := []struct {
+		name      string
+		policy    string
+		nets      []localNetwork
+		defaultIP string
+		want      []string
+		wantErr   bool
+	}{
+		{name: "largest subnet", policy: sourceLargestSubnet, nets: multiHomed, want: []string{"eth1"}},
+		{name: "largest subnet tie", policy: sourceLargestSubnet, nets: []localNetwork{network("eth0", "192.168.1.10/24"), network("eth1", "192.168.2.10/24")}, want: []string{"eth0"}},
+		{name: "default route", policy: sourceDefaultRoute, nets: multiHomed, defaultIP: "172.16.0.3", want: []string{"wlan0"}},
+		{name: "default route elsewhere", policy: sourceDefaultRoute, nets: multiHomed, defaultIP: "198.51.100.7", wantErr: true},
+		{name: "no default route", policy: sourceDefaultRoute, nets: multiHomed, wantErr: true},
+		{name: "all", policy: sourceAll, nets: multiHomed, want: []string{"eth0", "eth1", "wlan0"}},
+		{name: "single interface", policy: sourceAll, nets: multiHomed[:1], want: []string{"eth0"}},
+		{name: "no interfaces", policy: sourceAll, wantErr: true},
+		{name: "unknown policy", policy: "random", nets: multiHomed, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectBroadcastSources(tt.policy, tt.nets, net.ParseIP(tt.defaultIP))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selectBroadcastSources = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPBroadcastSource(t *testing.T) {
+	nets, err := localNetworks()
+	if err != nil || len(nets) == 0 {
+		t.Skip("no broadcast-capable IPv4 interface")
+	}
+	for _, policy := range []string{sourceLargestSubnet, sourceDefaultRoute, sourceAll} {
+		t.Run(policy, func(t *testing.T) {
+			ifaces, err := broadcastSources(policy)
+			if err != nil {
+				t.Skipf("nothing for %s to pick: %v", policy, err)
+			}
+			// Broadcasts are looped back to sockets on the wildcard
+			// address, a copy for each interface they leave through
+			host := newFakeHostOn(t, net.IPv4zero)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:             testMAC,
+				IP:              "127.0.0.1",
+				Port:            host.port(),
+				Broadcast:       "255.255.255.255",
+				BroadcastSource: policy,
+				StatusHeader:    "X-Wake-Result",
+			})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rec.Header().Get("X-Wake-Result"); !strings.HasPrefix(got, string(resultSent)) {
+				if strings.HasPrefix(got, string(resultSendFailed)) {
+					t.Skipf("can't broadcast through %v here: %s", ifaces, got)
+				}
+				t.Errorf("result %q, want %s", got, resultSent)
+			}
+			// The unicast packet, and the broadcasts
+			host.expect(t, 1+len(ifaces))
+			host.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// budgetVar is the request variable holding the wake budget, shared by
+// every handler invocation during one client request.
+const budgetVar = "wake_on_lan.wake_budget"
+
+// resultBudgetExhausted reports a wake skipped because the request used
+// up its wake_budget.
+const resultBudgetExhausted wakeResult = "budget_exhausted"
+
+// errBudgetExhausted is returned for a wake skipped because the request
+// used up its wake_budget.
+var errBudgetExhausted = errors.New("wake budget for the request exhausted")
+
+// wakeBudget counts the wakes a client request may still start.
+type wakeBudget struct {
+	mu   sync.Mutex
+	left int
+}
+
+// take uses up one wake, reporting false if none is left.
+func (b *wakeBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.left <= 0 {
+		return false
+	}
+	b.left--
+	return true
+}
+
+// exhausted reports whether no wake is left.
+func (b *wakeBudget) exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.left <= 0
+}
+
+// requestBudget returns the wake budget of r, starting it at wake_budget
+// on the first invocation during the request. Later invocations, from
+// this handler or another, share it, so error handlers and retries that
+// run the handler again don't start the wakes afresh. It is nil without
+// a wake_budget.
+func (w *WakeOnLAN) requestBudget(r *http.Request) *wakeBudget {
+	if w.WakeBudget == 0 {
+		return nil
+	}
+	if b, ok := caddyhttp.GetVar(r.Context(), budgetVar).(*wakeBudget); ok {
+		return b
+	}
+	b := &wakeBudget{left: w.WakeBudget}
+	caddyhttp.SetVar(r.Context(), budgetVar, b)
+	return b
+}
+
+// takeBudget uses up one wake of the budget of the request ctx belongs to,
+// if it has one.
+func takeBudget(ctx context.Context) bool {
+	b, ok := caddyhttp.GetVar(ctx, budgetVar).(*wakeBudget)
+	return !ok || b.take()
+}
@@ -0,0 +1,153 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWakeBudgetConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{input: "wake_budget 2", want: 2},
+		{input: "wake_budget 0"},
+		{input: "wake_budget -1", wantErr: true},
+		{input: "wake_budget", wantErr: true},
+		{input: "wake_budget many", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.WakeBudget != tt.want {
+				t.Errorf("wake_budget = %d, want %d", w.WakeBudget, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPWakeBudget(t *testing.T) {
+	// Every invocation runs within the same client request, as from a
+	// handle_errors route or a retrying handler
+	const otherMAC = "00:11:22:aa:bb:cc"
+	tests := []struct {
+		name        string
+		budget      int
+		invocations int
+		// a second handler, with its own budget, runs after each
+		// invocation of the first
+		second      bool
+		up          bool
+		wantPackets int
+	}{
+		{name: "one wake", budget: 1, invocations: 3, wantPackets: 1},
+		{name: "two wakes", budget: 2, invocations: 3, wantPackets: 2},
+		{name: "no budget", invocations: 3, wantPackets: 3},
+		{name: "shared by another handler", budget: 3, invocations: 2, second: true, wantPackets: 3},
+		// The second handler finds the budget used up and lets the request
+		// through without waking
+		{name: "used up by another handler", budget: 1, invocations: 2, second: true, wantPackets: 1},
+		{name: "already up", budget: 1, invocations: 3, up: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			checkPort := closedPort(t)
+			if tt.up {
+				l, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", checkPort))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer l.Close()
+			}
+			handlers := []*WakeOnLAN{provisionTest(t, &WakeOnLAN{
+				MAC:        testMAC,
+				IP:         "127.0.0.1",
+				Port:       host.port(),
+				Check:      fmt.Sprintf("127.0.0.1:%d", checkPort),
+				WakeBudget: tt.budget,
+			})}
+			if tt.second {
+				handlers = append(handlers, provisionTest(t, &WakeOnLAN{
+					MAC:        otherMAC,
+					IP:         "127.0.0.1",
+					Port:       host.port(),
+					WakeBudget: 1,
+				}))
+			}
+
+			r := newTestRequest("GET", "http://example.com/", nil)
+			for i := 0; i < tt.invocations; i++ {
+				for j, w := range handlers {
+					rec := httptest.NewRecorder()
+					err := w.ServeHTTP(rec, r, new(nextHandler))
+					if got := statusOf(rec, err); got != http.StatusNoContent {
+						t.Errorf("invocation %d of handler %d: status %d, want %d (%v)", i+1, j+1, got, http.StatusNoContent, err)
+					}
+				}
+			}
+			if tt.wantPackets > 0 {
+				host.expect(t, tt.wantPackets)
+			}
+			host.expectNone(t)
+		})
+	}
+}
+
+func TestServeHTTPWakeBudgetTargets(t *testing.T) {
+	// Each target takes one; those past the budget report it
+	tests := []struct {
+		name       string
+		required   bool
+		wantStatus int
+	}{
+		{name: "logged", wantStatus: http.StatusNoContent},
+		{name: "required", required: true, wantStatus: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				Targets: []Target{
+					{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port()},
+					{Name: "desktop", MAC: "00:11:22:aa:bb:cc", IP: "127.0.0.1", Port: host.port()},
+				},
+				WakeBudget:   1,
+				Required:     tt.required,
+				StatusHeader: "X-Wake-Result",
+			})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			results := map[string]bool{}
+			for _, v := range rec.Header().Values("X-Wake-Result") {
+				results[v] = true
+			}
+			sent, exhausted := 0, 0
+			for _, name := range []string{"nas", "desktop"} {
+				switch {
+				case results[string(resultSent)+"; target="+name]:
+					sent++
+				case results[string(resultBudgetExhausted)+"; target="+name]:
+					exhausted++
+				}
+			}
+			if sent != 1 || exhausted != 1 {
+				t.Errorf("results %v, want one sent and one budget_exhausted", rec.Header().Values("X-Wake-Result"))
+			}
+			host.expect(t, 1)
+			host.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// resultForbidden reports a bulk entry refused by allow_oui.
+const resultForbidden wakeResult = "forbidden"
+
+// Limits of the from_body bulk endpoint.
+const (
+	defaultMaxBodyTargets = 32
+	defaultMaxBodyBytes   = 4 << 10
+	maxMaxBodyBytes       = 1 << 20
+	defaultBulkConcurrent = 4
+)
+
+// maxAdminBodyBytes bounds the bodies posted to the admin endpoints.
+const maxAdminBodyBytes = 64 << 10
+
+// defaultBodyContentType is the media type bulk requests must be sent as.
+const defaultBodyContentType = "application/json"
+
+// anyContentType, as body_content_type, accepts bodies of any type.
+const anyContentType = "*"
+
+// bulkRequestTarget is one entry of a bulk wake request: either the name of
+// a configured target or an explicit MAC with optional IP and port.
+type bulkRequestTarget struct {
+	Name string `json:"name,omitempty"`
+	MAC  string `json:"mac,omitempty"`
+	IP   string `json:"ip,omitempty"`
+	Port int    `json:"port,omitempty"`
+}
+
+// bulkResult reports the outcome for one entry of a bulk wake request.
+type bulkResult struct {
+	Target string `json:"target"`
+	Sent   bool   `json:"sent"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// With json_response, whether the target was confirmed up and how
+	// long its wake took
+	Confirmed      *bool  `json:"confirmed,omitempty"`
+	WakeDurationMS *int64 `json:"wake_duration_ms,omitempty"`
+}
+
+// serveBulk wakes the targets listed in the request body and answers with
+// a result per entry, in request order: 200 if all succeeded, 207 if some
+// failed.
+func (w *WakeOnLAN) serveBulk(rw http.ResponseWriter, r *http.Request, logger *zap.Logger) error {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("wake_on_lan: bulk wake requires POST"))
+	}
+	if err := w.checkBodyContentType(r); err != nil {
+		return caddyhttp.Error(http.StatusUnsupportedMediaType, err)
+	}
+	maxBytes := int64(w.MaxBodyBytes)
+	if maxBytes == 0 {
+		maxBytes = defaultMaxBodyBytes
+	}
+	if r.ContentLength > maxBytes {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("wake_on_lan: bulk request of %d bytes over the limit of %d", r.ContentLength, maxBytes))
+	}
+	var entries []bulkRequestTarget
+	body := http.MaxBytesReader(rw, r.Body, maxBytes)
+	if err := json.NewDecoder(body).Decode(&entries); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+		}
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: invalid bulk request: %w", err))
+	}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+	}
+	maxTargets := w.MaxBodyTargets
+	if maxTargets == 0 {
+		maxTargets = defaultMaxBodyTargets
+	}
+	if len(entries) == 0 || len(entries) > maxTargets {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: bulk request must list 1 to %d targets", maxTargets))
+	}
+
+	results := make([]bulkResult, len(entries))
+	concurrent := w.BulkConcurrency
+	if concurrent == 0 {
+		concurrent = defaultBulkConcurrent
+	}
+	src := w.newAuditSource(r)
+	ctx, cancel := w.wakeContext(r)
+	defer cancel()
+	sem := make(chan struct{}, concurrent)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		t, err := w.bulkTarget(entry)
+		if err != nil {
+			result := resultError
+			if errors.Is(err, errOUINotAllowed) {
+				result = resultForbidden
+			} else if errors.Is(err, errMACIPMismatch) {
+				result = resultMACIPMismatch
+			}
+			results[i] = bulkResult{Target: entry.label(), Result: string(result), Error: err.Error()}
+			w.audit(src, Target{MAC: entry.MAC, IP: entry.IP, Port: entry.Port, Name: entry.label()}, result, err)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, t Target) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			result, err := w.wake(ctx, t, logger)
+			w.record(logger, t, result, err)
+			w.audit(src, t, result, err)
+			results[i] = bulkResult{Target: t.label(), Sent: !result.failed(), Result: string(result)}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+			if w.JSONResponse {
+				confirmed, ms := result.up(), time.Since(start).Milliseconds()
+				results[i].Confirmed, results[i].WakeDurationMS = &confirmed, &ms
+			}
+		}(i, t)
+	}
+	wg.Wait()
+	noteOutcomes(r.Context(), bulkOutcomes(results))
+	if w.AccessLogFields {
+		// The first entry that failed, or else the first, as for the
+		// result variables
+		first := results[0]
+		for _, res := range results {
+			if !res.Sent {
+				first = res
+				break
+			}
+		}
+		setLogFields(r, first.Target, wakeResult(first.Result), first.Error)
+	}
+
+	// 403 if every entry was refused, 207 if any other failed
+	status := http.StatusOK
+	forbidden := 0
+	for _, res := range results {
+		if res.Result == string(resultForbidden) {
+			forbidden++
+		}
+		if !res.Sent {
+			status = http.StatusMultiStatus
+		}
+	}
+	if forbidden == len(results) {
+		status = http.StatusForbidden
+	}
+	out, err := json.Marshal(results)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, err = rw.Write(out)
+	return err
+}
+
+// checkBodyContentType checks that r's body is of the media type bulk
+// requests must be sent as, ignoring its parameters.
+func (w *WakeOnLAN) checkBodyContentType(r *http.Request) error {
+	want := w.BodyContentType
+	if want == "" {
+		want = defaultBodyContentType
+	}
+	if want == anyContentType {
+		return nil
+	}
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return fmt.Errorf("wake_on_lan: bulk request requires Content-Type %s", want)
+	}
+	got, _, err := mime.ParseMediaType(header)
+	if err != nil || !strings.EqualFold(got, want) {
+		return fmt.Errorf("wake_on_lan: bulk request of Content-Type %q; want %s", header, want)
+	}
+	return nil
+}
+
+// bulkTarget resolves a bulk request entry to a target: a configured one
+// by name, or one built from the entry's MAC and address.
+func (w *WakeOnLAN) bulkTarget(entry bulkRequestTarget) (Target, error) {
+	if entry.Name != "" {
+		for _, t := range w.allTargets() {
+			if t.Name == entry.Name {
+				return t, nil
+			}
+		}
+		return Target{}, fmt.Errorf("unknown target %q", entry.Name)
+	}
+	// Patterns multiply the packets sent; only the config may use them
+	if isMACPattern(entry.MAC) {
+		return Target{}, errors.New("MAC patterns are not accepted from requests")
+	}
+	if err := (Target{MAC: entry.MAC, IP: entry.IP, Port: entry.Port, fromRequest: true}).Validate(w.requiresIP()); err != nil {
+		return Target{}, err
+	}
+	if hw, err := parseMAC(entry.MAC); err == nil {
+		if err := checkOUI(w.allowOUI, hw); err != nil {
+			return Target{}, err
+		}
+		if w.VerifyMACIP != nil {
+			if err := w.verifyMACIP(hw, entry.IP); err != nil {
+				return Target{}, err
+			}
+		}
+	}
+	t := w.withDefaults(Target{MAC: entry.MAC, IP: entry.IP, Port: entry.Port, fromRequest: true})
+	// The handler's check address belongs to its configured targets
+	t.Check = ""
+	if w.Dynamic {
+		if err := w.checkRequestTarget(t); err != nil {
+			return Target{}, err
+		}
+	}
+	return t, nil
+}
+
+func (e bulkRequestTarget) label() string {
+	if e.Name != "" {
+		return sanitizeLabel(e.Name)
+	}
+	return sanitizeLabel(e.MAC)
+}
@@ -0,0 +1,236 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestBodyLimitsConfig(t *testing.T) {
+	tests := []struct {
+		input           string
+		wantBytes       int
+		wantContentType string
+		wantErr         bool
+	}{
+		{input: "from_body\n\tmax_body_bytes 1024", wantBytes: 1024},
+		{input: "from_body\n\tmax_body_bytes 1048576", wantBytes: maxMaxBodyBytes},
+		{input: "from_body\n\tbody_content_type application/vnd.wol+json", wantContentType: "application/vnd.wol+json"},
+		{input: "from_body\n\tbody_content_type *", wantContentType: anyContentType},
+		{input: "from_body\n\tmax_body_bytes 1048577", wantErr: true},
+		{input: "from_body\n\tmax_body_bytes -1", wantErr: true},
+		{input: "from_body\n\tmax_body_bytes", wantErr: true},
+		{input: "from_body\n\tmax_body_bytes 4KiB", wantErr: true},
+		{input: "from_body\n\tbody_content_type", wantErr: true},
+		{input: "from_body\n\tbody_content_type application/json text/plain", wantErr: true},
+		{input: "from_body\n\tbody_content_type application/", wantErr: true},
+		{input: "max_body_bytes 1024", wantErr: true},
+		{input: "body_content_type application/json", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (w.MaxBodyBytes != tt.wantBytes || w.BodyContentType != tt.wantContentType) {
+				t.Errorf("max_body_bytes %d, body_content_type %q; want %d, %q", w.MaxBodyBytes, w.BodyContentType, tt.wantBytes, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestCheckBodyContentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		header  string
+		wantErr bool
+	}{
+		{name: "json", header: "application/json"},
+		{name: "parameters", header: "application/json; charset=utf-8"},
+		{name: "case", header: "Application/JSON"},
+		{name: "missing", wantErr: true},
+		{name: "other", header: "text/plain", wantErr: true},
+		{name: "garbled", header: "application/json; =", wantErr: true},
+		{name: "configured", want: "application/vnd.wol+json", header: "application/vnd.wol+json"},
+		{name: "default refused once configured", want: "application/vnd.wol+json", header: "application/json", wantErr: true},
+		{name: "any", want: anyContentType, header: "text/plain"},
+		{name: "any, missing", want: anyContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest("POST", "http://example.com/", nil)
+			if tt.header != "" {
+				r.Header.Set("Content-Type", tt.header)
+			}
+			w := &WakeOnLAN{BodyContentType: tt.want}
+			if err := w.checkBodyContentType(r); (err != nil) != tt.wantErr {
+				t.Errorf("checkBodyContentType = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeHTTPBodyLimits(t *testing.T) {
+	host := newFakeHost(t)
+	entry := fmt.Sprintf(`{"mac":%q,"ip":"127.0.0.1","port":%d}`, testMAC, host.port())
+	// A body of one entry padded with whitespace to n bytes
+	body := func(n int) string {
+		return "[" + entry + strings.Repeat(" ", n-len(entry)-2) + "]"
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		// send without a Content-Length, as a chunked body is
+		chunked    bool
+		wantStatus int
+	}{
+		{name: "within the limit", contentType: "application/json", body: body(defaultMaxBodyBytes), wantStatus: http.StatusOK},
+		{name: "over the limit", contentType: "application/json", body: body(defaultMaxBodyBytes + 1), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "over the limit, chunked", contentType: "application/json", body: body(defaultMaxBodyBytes + 1), chunked: true, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "no Content-Type", body: "[" + entry + "]", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: "[" + entry + "]", wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, &WakeOnLAN{FromBody: true})
+			r := newTestRequest("POST", "http://example.com/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			rec, _, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if tt.wantStatus == http.StatusOK {
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+		})
+	}
+
+	t.Run("raised limit", func(t *testing.T) {
+		w := provisionTest(t, &WakeOnLAN{FromBody: true, MaxBodyBytes: 2 * defaultMaxBodyBytes})
+		r := newTestRequest("POST", "http://example.com/", strings.NewReader(body(defaultMaxBodyBytes+1)))
+		r.Header.Set("Content-Type", "application/json")
+		rec, _, err := serveTest(w, r)
+		if got := statusOf(rec, err); got != http.StatusOK {
+			t.Fatalf("status = %d, want %d (%v)", got, http.StatusOK, err)
+		}
+		host.expect(t, 1)
+	})
+}
+
+func TestServeHTTPBulkClientDisconnect(t *testing.T) {
+	tests := []struct {
+		name        string
+		cancel      bool
+		wantPackets int
+	}{
+		{name: "carries on", wantPackets: 6},
+		{name: "cancel_on_client_disconnect", cancel: true, wantPackets: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			// Three packets to each of two targets, the client leaving
+			// after the first ones
+			w := provisionTest(t, &WakeOnLAN{
+				FromBody:                 true,
+				Repeat:                   3,
+				Interval:                 caddy.Duration(300 * time.Millisecond),
+				CancelOnClientDisconnect: tt.cancel,
+			})
+			body := fmt.Sprintf(`[{"mac":"00:11:22:33:44:55","ip":"127.0.0.1","port":%d},{"mac":"00:11:22:33:44:66","ip":"127.0.0.1","port":%d}]`, host.port(), host.port())
+			r := newTestRequest("POST", "http://example.com/", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			time.AfterFunc(100*time.Millisecond, cancel)
+			if _, _, err := serveTest(w, r.WithContext(ctx)); err != nil {
+				t.Fatal(err)
+			}
+			host.expect(t, tt.wantPackets)
+			host.expectNone(t)
+		})
+	}
+}
+
+func TestBulkTargetNoLookup(t *testing.T) {
+	dns := newFakeDNS(t, func(string, dnsmessage.Type, int) ([]net.IP, dnsmessage.RCode) {
+		return nil, dnsmessage.RCodeNameError
+	})
+	w := provisionTest(t, &WakeOnLAN{FromBody: true})
+	tests := []struct {
+		ip      string
+		wantErr bool
+	}{
+		{ip: "nas.test."},
+		{ip: "nas_1.lab.test"},
+		{ip: "192.0.2.1"},
+		{ip: "nas test", wantErr: true},
+		{ip: "-nas.test", wantErr: true},
+		{ip: "nas..test", wantErr: true},
+		{ip: "nas.test/x", wantErr: true},
+		{ip: strings.Repeat("a", 64) + ".test", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			_, err := w.bulkTarget(bulkRequestTarget{MAC: testMAC, IP: tt.ip})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("bulkTarget error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+	// Names are left to the send, which resolves them under its context
+	if n := dns.queries("nas.test.", dnsmessage.TypeA); n != 0 {
+		t.Errorf("looked nas.test. up %d times while checking the entry", n)
+	}
+}
+
+func TestServeHTTPBulkHostnames(t *testing.T) {
+	// A full body of names that don't resolve: each is looked up once, by
+	// its send, and none while the body is checked
+	dns := newFakeDNS(t, func(string, dnsmessage.Type, int) ([]net.IP, dnsmessage.RCode) {
+		return nil, dnsmessage.RCodeNameError
+	})
+	w := provisionTest(t, &WakeOnLAN{FromBody: true})
+	entries := make([]string, defaultMaxBodyTargets)
+	for i := range entries {
+		entries[i] = fmt.Sprintf(`{"mac":"00:11:22:33:44:%02x","ip":"host%d.test."}`, i, i)
+	}
+	r := newTestRequest("POST", "http://example.com/", strings.NewReader("["+strings.Join(entries, ",")+"]"))
+	r.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	rec, _, err := serveTest(w, r)
+	if got := statusOf(rec, err); got != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want %d (%v)", got, http.StatusMultiStatus, err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("request took %s", took)
+	}
+	for i := range entries {
+		name := fmt.Sprintf("host%d.test.", i)
+		if n := dns.queries(name, dnsmessage.TypeA); n != 1 {
+			t.Errorf("%s looked up %d times, want once", name, n)
+		}
+	}
+	if !strings.Contains(rec.Body.String(), `"result":"send_failed"`) {
+		t.Errorf("body %s, want send_failed results", rec.Body)
+	}
+}
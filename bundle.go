@@ -0,0 +1,237 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// bundleVersion is the layout version of bundles written and accepted.
+const bundleVersion = 1
+
+// Values of the mode query parameter of POST /wake_on_lan/bundle.
+const (
+	importMerge   = "merge"
+	importReplace = "replace"
+)
+
+// importMu serializes imports, each a read, merge and rewrite of the
+// inventory file.
+var importMu sync.Mutex
+
+// bundle is the body of GET and POST /wake_on_lan/bundle: the inventory's
+// named targets, and the running handlers for reference.
+type bundle struct {
+	Version   int               `json:"version"`
+	Inventory map[string]Target `json:"inventory"`
+	// Only exported: handlers are configured through Caddy's own config
+	// API, not imported
+	Handlers []handlerConfig `json:"handlers,omitempty"`
+}
+
+// importResult is the response of POST /wake_on_lan/bundle.
+type importResult struct {
+	Mode    string `json:"mode"`
+	Targets int    `json:"targets"`
+	// Inventory files rewritten
+	Files []string `json:"files"`
+}
+
+// handleBundle exports the targets as a bundle on GET, with secrets only
+// if ?secrets=true, and imports one on POST, merged into each inventory
+// file or, with ?mode=replace, in place of its targets.
+func (adminAPI) handleBundle(rw http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		secrets, err := boolParam(r, "secrets")
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		b, err := exportBundle(!secrets)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(rw).Encode(b)
+	case http.MethodPost:
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = importMerge
+		}
+		if mode != importMerge && mode != importReplace {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid mode %q (want merge or replace)", mode)}
+		}
+		var b bundle
+		if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxAdminBodyBytes)).Decode(&b); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding bundle: %w", err)}
+		}
+		if err := b.validate(); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		result, err := importBundle(b, mode)
+		if err != nil {
+			return err
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(rw).Encode(result)
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method not allowed"),
+	}
+}
+
+// boolParam parses the query parameter name, false if absent.
+func boolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return b, nil
+}
+
+// exportBundle collects the named targets, as changed through the admin
+// API, and the running handlers, with secrets redacted if redact is true.
+func exportBundle(redact bool) (bundle, error) {
+	b := bundle{Version: bundleVersion, Inventory: namedTargets()}
+	if redact {
+		for name, t := range b.Inventory {
+			b.Inventory[name] = redactTarget(t)
+		}
+	}
+	handlers, err := handlerConfigs(redact)
+	if err != nil {
+		return bundle{}, err
+	}
+	b.Handlers = handlers
+	return b, nil
+}
+
+// validate checks the bundle's version and every target, before anything
+// is applied.
+func (b bundle) validate() error {
+	if b.Version != bundleVersion {
+		return fmt.Errorf("unsupported bundle version %d (want %d)", b.Version, bundleVersion)
+	}
+	for name, t := range b.Inventory {
+		if name == "" {
+			return errors.New("inventory target with an empty name")
+		}
+		if t.SecureOn == redacted {
+			return fmt.Errorf("target %s: secureon password was redacted; export with secrets=true", name)
+		}
+		if t.BMC != nil && (t.BMC.Username == redacted || t.BMC.Password == redacted) {
+			return fmt.Errorf("target %s: bmc credentials were redacted; export with secrets=true", name)
+		}
+		if err := t.Validate(false); err != nil {
+			return fmt.Errorf("target %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// importBundle applies the bundle's inventory to every running app with an
+// inventory file or storage key: the file, or the key if there is one, is
+// rewritten, then reloaded like any change.
+func importBundle(b bundle, mode string) (importResult, error) {
+	importMu.Lock()
+	defer importMu.Unlock()
+	apps := inventoryApps()
+	if len(apps) == 0 {
+		return importResult{}, caddy.APIError{HTTPStatus: http.StatusConflict, Err: errors.New("no inventory file or storage key configured to import into")}
+	}
+	result := importResult{Mode: mode, Files: []string{}}
+	for _, a := range apps {
+		targets := make(map[string]Target)
+		if mode == importMerge {
+			a.mu.RLock()
+			maps.Copy(targets, a.targets)
+			a.mu.RUnlock()
+		}
+		maps.Copy(targets, b.Inventory)
+		data, err := json.MarshalIndent(inventoryFile{Targets: targets}, "", "  ")
+		if err != nil {
+			return result, caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+		}
+		// The file must load once written, or the watcher would keep the
+		// old targets while the file says otherwise
+		if _, err := parseInventory(data); err != nil {
+			return result, caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("inventory %s: %w", a.Inventory, err)}
+		}
+		if a.InventoryStorageKey != "" {
+			// Shared with the other instances, which pick it up on their
+			// next poll
+			if err := a.storeInventory(context.Background(), data); err != nil {
+				return result, caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+			}
+			result.Targets = len(targets)
+			result.Files = append(result.Files, "storage:"+a.InventoryStorageKey)
+			a.logger.Info("inventory imported", zap.String("storage_key", a.InventoryStorageKey), zap.String("mode", mode), zap.Int("targets", len(targets)))
+			continue
+		}
+		if err := writeFileAtomic(a.Inventory, data); err != nil {
+			return result, caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: fmt.Errorf("writing inventory: %w", err)}
+		}
+		if err := a.loadInventory(); err != nil {
+			return result, caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+		}
+		result.Targets = len(targets)
+		result.Files = append(result.Files, a.Inventory)
+		a.logger.Info("inventory imported", zap.String("path", a.Inventory), zap.String("mode", mode), zap.Int("targets", len(targets)))
+	}
+	return result, nil
+}
+
+// inventoryApps returns the running apps with an inventory file or storage
+// key.
+func inventoryApps() []*App {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	var apps []*App
+	for a := range registry.apps {
+		if a.Inventory != "" || a.InventoryStorageKey != "" {
+			apps = append(apps, a)
+		}
+	}
+	return apps
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory, so a reader never sees it half written.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
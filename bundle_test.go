@@ -0,0 +1,310 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestBundleValidate(t *testing.T) {
+	target := func(edit func(*Target)) map[string]Target {
+		tt := Target{MAC: testMAC, IP: "192.0.2.1"}
+		if edit != nil {
+			edit(&tt)
+		}
+		return map[string]Target{"nas": tt}
+	}
+	tests := []struct {
+		name    string
+		b       bundle
+		wantErr bool
+	}{
+		{name: "valid", b: bundle{Version: bundleVersion, Inventory: target(nil)}},
+		{name: "unknown version", b: bundle{Version: bundleVersion + 1, Inventory: target(nil)}, wantErr: true},
+		{
+			name:    "empty name",
+			b:       bundle{Version: bundleVersion, Inventory: map[string]Target{"": {MAC: testMAC, IP: "192.0.2.1"}}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid target",
+			b:       bundle{Version: bundleVersion, Inventory: target(func(t *Target) { t.MAC = "nope" })},
+			wantErr: true,
+		},
+		{
+			name:    "redacted secureon",
+			b:       bundle{Version: bundleVersion, Inventory: target(func(t *Target) { t.SecureOn = redacted })},
+			wantErr: true,
+		},
+		{
+			name: "bmc",
+			b: bundle{Version: bundleVersion, Inventory: target(func(t *Target) {
+				t.BMC = &BMC{Endpoint: "https://10.0.9.5", Username: "admin", Password: "secret"}
+			})},
+		},
+		{
+			name: "redacted bmc password",
+			b: bundle{Version: bundleVersion, Inventory: target(func(t *Target) {
+				t.BMC = &BMC{Endpoint: "https://10.0.9.5", Username: "admin", Password: redacted}
+			})},
+			wantErr: true,
+		},
+		{
+			name: "redacted bmc username",
+			b: bundle{Version: bundleVersion, Inventory: target(func(t *Target) {
+				t.BMC = &BMC{Endpoint: "https://10.0.9.5", Username: redacted, Password: "secret"}
+			})},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.b.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedactTarget(t *testing.T) {
+	bmc := &BMC{Endpoint: "https://10.0.9.5", Username: "admin", Password: "secret"}
+	got := redactTarget(Target{MAC: testMAC, SecureOn: "01:02:03:04:05:06", BMC: bmc})
+	if got.SecureOn != redacted || got.BMC.Username != redacted || got.BMC.Password != redacted {
+		t.Errorf("redactTarget left secrets: %+v, %+v", got, *got.BMC)
+	}
+	if bmc.Password != "secret" {
+		t.Error("redactTarget changed the target's BMC")
+	}
+	if got := redactTarget(Target{MAC: testMAC}); got.SecureOn != "" || got.BMC != nil {
+		t.Errorf("redactTarget added secrets to a target without them: %+v", got)
+	}
+}
+
+// loadInventoryApp runs the app with an inventory file holding targets,
+// returning the file's path.
+func loadInventoryApp(t *testing.T, targets map[string]Target) string {
+	t.Helper()
+	data, err := json.Marshal(inventoryFile{Targets: targets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	inventory, _ := json.Marshal(path)
+	loadApp(t, `{"inventory": `+string(inventory)+`}`)
+	return path
+}
+
+func TestHandleBundleExport(t *testing.T) {
+	const password = "01:02:03:04:05:06"
+	loadInventoryApp(t, map[string]Target{
+		"nas":     {MAC: testMAC, IP: "192.0.2.1", SecureOn: password},
+		"desktop": {MAC: "00:11:22:aa:bb:cc", IP: "192.0.2.2"},
+	})
+	tests := []struct {
+		name         string
+		method       string
+		query        string
+		wantStatus   int
+		wantSecureOn string
+	}{
+		{name: "redacted", method: http.MethodGet, wantStatus: http.StatusOK, wantSecureOn: redacted},
+		{name: "without secrets", method: http.MethodGet, query: "?secrets=false", wantStatus: http.StatusOK, wantSecureOn: redacted},
+		{name: "with secrets", method: http.MethodGet, query: "?secrets=true", wantStatus: http.StatusOK, wantSecureOn: password},
+		{name: "invalid secrets", method: http.MethodGet, query: "?secrets=maybe", wantStatus: http.StatusBadRequest},
+		{name: "method", method: http.MethodPut, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			err := adminAPI{}.handleBundle(rec, httptest.NewRequest(tt.method, "/wake_on_lan/bundle"+tt.query, nil))
+			if tt.wantStatus != http.StatusOK {
+				var apiErr caddy.APIError
+				if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.wantStatus {
+					t.Errorf("error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b bundle
+			if err := json.Unmarshal(rec.Body.Bytes(), &b); err != nil {
+				t.Fatalf("decoding %q: %v", rec.Body, err)
+			}
+			if b.Version != bundleVersion || len(b.Inventory) != 2 {
+				t.Fatalf("bundle %s, want version %d with both targets", rec.Body, bundleVersion)
+			}
+			if got := b.Inventory["nas"].SecureOn; got != tt.wantSecureOn {
+				t.Errorf("secureon = %q, want %q", got, tt.wantSecureOn)
+			}
+			if got := b.Inventory["desktop"].SecureOn; got != "" {
+				t.Errorf("secureon of a target without one = %q", got)
+			}
+		})
+	}
+}
+
+func TestHandleBundleImport(t *testing.T) {
+	original := map[string]Target{
+		"nas":     {MAC: testMAC, IP: "192.0.2.1"},
+		"desktop": {MAC: "00:11:22:aa:bb:cc", IP: "192.0.2.2"},
+	}
+	tests := []struct {
+		name       string
+		query      string
+		body       string
+		wantStatus int
+		// targets in the inventory afterwards
+		wantTargets []string
+	}{
+		{
+			name:        "merge",
+			body:        `{"version": 1, "inventory": {"printer": {"mac": "00:11:22:dd:ee:ff", "ip": "192.0.2.3"}}}`,
+			wantStatus:  http.StatusOK,
+			wantTargets: []string{"desktop", "nas", "printer"},
+		},
+		{
+			name:        "merge over a target",
+			query:       "?mode=merge",
+			body:        `{"version": 1, "inventory": {"nas": {"mac": "00:11:22:dd:ee:ff", "ip": "192.0.2.3"}}}`,
+			wantStatus:  http.StatusOK,
+			wantTargets: []string{"desktop", "nas"},
+		},
+		{
+			name:        "replace",
+			query:       "?mode=replace",
+			body:        `{"version": 1, "inventory": {"printer": {"mac": "00:11:22:dd:ee:ff", "ip": "192.0.2.3"}}}`,
+			wantStatus:  http.StatusOK,
+			wantTargets: []string{"printer"},
+		},
+		{
+			name:        "invalid mode",
+			query:       "?mode=append",
+			body:        `{"version": 1, "inventory": {}}`,
+			wantStatus:  http.StatusBadRequest,
+			wantTargets: []string{"desktop", "nas"},
+		},
+		{
+			name:        "not JSON",
+			body:        `targets: {}`,
+			wantStatus:  http.StatusBadRequest,
+			wantTargets: []string{"desktop", "nas"},
+		},
+		{
+			name:        "unknown version",
+			query:       "?mode=replace",
+			body:        `{"version": 2, "inventory": {"printer": {"mac": "00:11:22:dd:ee:ff", "ip": "192.0.2.3"}}}`,
+			wantStatus:  http.StatusBadRequest,
+			wantTargets: []string{"desktop", "nas"},
+		},
+		// Nothing is applied unless the whole bundle is valid
+		{
+			name:        "one invalid target",
+			query:       "?mode=replace",
+			body:        `{"version": 1, "inventory": {"printer": {"mac": "00:11:22:dd:ee:ff", "ip": "192.0.2.3"}, "broken": {"mac": "nope"}}}`,
+			wantStatus:  http.StatusBadRequest,
+			wantTargets: []string{"desktop", "nas"},
+		},
+		{
+			name:        "redacted",
+			body:        `{"version": 1, "inventory": {"printer": {"mac": "00:11:22:dd:ee:ff", "ip": "192.0.2.3", "secureon": "` + redacted + `"}}}`,
+			wantStatus:  http.StatusBadRequest,
+			wantTargets: []string{"desktop", "nas"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := loadInventoryApp(t, original)
+			rec := httptest.NewRecorder()
+			err := adminAPI{}.handleBundle(rec, httptest.NewRequest(http.MethodPost, "/wake_on_lan/bundle"+tt.query, strings.NewReader(tt.body)))
+			if tt.wantStatus != http.StatusOK {
+				var apiErr caddy.APIError
+				if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.wantStatus {
+					t.Errorf("error = %v, want status %d", err, tt.wantStatus)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				var result importResult
+				if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+					t.Fatalf("decoding %q: %v", rec.Body, err)
+				}
+				if result.Targets != len(tt.wantTargets) || !slices.Equal(result.Files, []string{path}) {
+					t.Errorf("result %+v, want %d targets written to %s", result, len(tt.wantTargets), path)
+				}
+			}
+			if got := slices.Sorted(maps.Keys(namedTargets())); !slices.Equal(got, tt.wantTargets) {
+				t.Errorf("targets %v, want %v", got, tt.wantTargets)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written, err := parseInventory(data)
+			if err != nil {
+				t.Fatalf("inventory file no longer loads: %v", err)
+			}
+			if got := slices.Sorted(maps.Keys(written)); !slices.Equal(got, tt.wantTargets) {
+				t.Errorf("inventory file holds %v, want %v", got, tt.wantTargets)
+			}
+		})
+	}
+}
+
+func TestHandleBundleNoInventory(t *testing.T) {
+	loadApp(t, `{}`)
+	body := `{"version": 1, "inventory": {"nas": {"mac": "` + testMAC + `", "ip": "192.0.2.1"}}}`
+	err := adminAPI{}.handleBundle(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/wake_on_lan/bundle", strings.NewReader(body)))
+	var apiErr caddy.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusConflict {
+		t.Errorf("error = %v, want status %d", err, http.StatusConflict)
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	original := map[string]Target{
+		"nas":     {MAC: testMAC, IP: "192.0.2.1", SecureOn: "01:02:03:04:05:06", Port: 7},
+		"desktop": {MAC: "00:11:22:aa:bb:cc", IP: "192.0.2.2", Repeat: 3},
+	}
+	loadInventoryApp(t, original)
+	// As loaded, with the names filled in
+	want := namedTargets()
+	for _, tt := range []struct {
+		name    string
+		secrets bool
+		wantErr bool
+	}{
+		{name: "with secrets", secrets: true},
+		// The redacted password can't be imported back
+		{name: "redacted", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			exported := httptest.NewRecorder()
+			query := "?secrets=" + strconv.FormatBool(tt.secrets)
+			if err := (adminAPI{}).handleBundle(exported, httptest.NewRequest(http.MethodGet, "/wake_on_lan/bundle"+query, nil)); err != nil {
+				t.Fatal(err)
+			}
+			err := adminAPI{}.handleBundle(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/wake_on_lan/bundle?mode=replace", exported.Body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("import error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := namedTargets(); !reflect.DeepEqual(got, want) {
+				t.Errorf("targets after the round trip %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// defaultCheckPortSource is the port check_port_from_request takes when
+// given none: the one the client connected to.
+const defaultCheckPortSource = "{http.request.local.port}"
+
+// validateCheckPortFromRequest checks that every target has a check
+// address whose port check_port_from_request can replace.
+func (w *WakeOnLAN) validateCheckPortFromRequest() error {
+	if w.CheckPortFromRequest == "" {
+		return nil
+	}
+	if w.FromBody {
+		return errors.New("check_port_from_request cannot be combined with from_body, whose entries have no check address")
+	}
+	for _, t := range w.allTargets() {
+		if t.Check == "" {
+			return fmt.Errorf("target %s: check_port_from_request requires a check address to take the host from", t.label())
+		}
+	}
+	return nil
+}
+
+// withRequestCheckPort returns targets probed at the port
+// check_port_from_request takes from r instead of their check address's,
+// failing if it isn't a port.
+func (w *WakeOnLAN) withRequestCheckPort(r *http.Request, targets []Target) ([]Target, error) {
+	if w.CheckPortFromRequest == "" {
+		return targets, nil
+	}
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	value := repl.ReplaceAll(w.CheckPortFromRequest, "")
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("wake_on_lan: check_port_from_request: %q from %s is not a port", value, w.CheckPortFromRequest)
+	}
+	for i, t := range targets {
+		host, _, err := net.SplitHostPort(t.Check)
+		if err != nil {
+			// No check address, as for a from_query target without one
+			continue
+		}
+		targets[i].Check = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return targets, nil
+}
@@ -0,0 +1,121 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestCheckPortFromRequestConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", input: "check 192.0.2.1:22\n\tcheck_port_from_request", want: defaultCheckPortSource},
+		{name: "placeholder", input: "check 192.0.2.1:22\n\tcheck_port_from_request {http.request.header.X-Port}", want: "{http.request.header.X-Port}"},
+		{name: "two placeholders", input: "check 192.0.2.1:22\n\tcheck_port_from_request {a} {b}", wantErr: true},
+		{name: "no check", input: "check_port_from_request", wantErr: true},
+		{name: "from_body", input: "check 192.0.2.1:22\n\tcheck_port_from_request\n\tfrom_body", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.CheckPortFromRequest != tt.want {
+				t.Errorf("check_port_from_request %q, want %q", w.CheckPortFromRequest, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRequestCheckPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    string
+		want    string
+		wantErr bool
+	}{
+		{name: "port", port: "8443", want: "192.0.2.1:8443"},
+		{name: "empty", port: "", wantErr: true},
+		{name: "not a number", port: "https", wantErr: true},
+		{name: "out of range", port: "65536", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &WakeOnLAN{CheckPortFromRequest: defaultCheckPortSource}
+			r := newTestRequest("GET", "http://example.com/", nil)
+			r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).Set("http.request.local.port", tt.port)
+			targets := []Target{{MAC: testMAC, Check: "192.0.2.1:22"}, {MAC: "00:11:22:aa:bb:cc"}}
+			got, err := w.withRequestCheckPort(r, targets)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got[0].Check != tt.want {
+				t.Errorf("check %q, want %q", got[0].Check, tt.want)
+			}
+			if got[1].Check != "" {
+				t.Errorf("target without a check address probed at %q", got[1].Check)
+			}
+		})
+	}
+}
+
+func TestServeHTTPCheckPortFromRequest(t *testing.T) {
+	host := newFakeHost(t)
+	up := newTCPHost(t)
+	_, upPort, _ := net.SplitHostPort(up.addr())
+	check := fmt.Sprintf("127.0.0.1:%d", closedPort(t))
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:                  testMAC,
+		IP:                   "127.0.0.1",
+		Port:                 host.port(),
+		Check:                check,
+		Wait:                 caddy.Duration(time.Second),
+		CheckPortFromRequest: "{http.request.header.X-Port}",
+		StatusHeader:         "X-Wake-Result",
+	})
+	tests := []struct {
+		name       string
+		port       string
+		wantStatus int
+		wantResult wakeResult
+	}{
+		// The service the request names is up, though the configured one isn't
+		{name: "up", port: upPort, wantStatus: http.StatusNoContent, wantResult: resultAlreadyUp},
+		{name: "not a port", port: "ssh", wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest("GET", "http://example.com/", nil)
+			// As Caddy's HTTP replacer would fill it in
+			r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).Set("http.request.header.X-Port", tt.port)
+			rec, _, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if tt.wantResult != "" {
+				if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+					t.Errorf("result = %q, want %q", got, want)
+				}
+			}
+			host.expectNone(t)
+		})
+	}
+	if got := w.targets()[0].Check; got != check {
+		t.Errorf("configured check changed to %q, want %q", got, check)
+	}
+}
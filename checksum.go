@@ -0,0 +1,94 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Checksums a packet built from a template or an encoding can end with.
+const (
+	checksumNone = "none"
+	// The low byte of the sum of the bytes.
+	checksumSum8 = "sum8"
+	// The bytes XORed together, one byte.
+	checksumXOR = "xor"
+	// CRC-16/CCITT-FALSE (polynomial 0x1021, initial value 0xFFFF),
+	// two bytes big-endian.
+	checksumCRC16 = "crc16"
+)
+
+// checksumSteps maps each checksum to the step appending it to a packet.
+var checksumSteps = map[string]func([]byte) []byte{
+	checksumNone:  func(packet []byte) []byte { return packet },
+	checksumSum8:  appendSum8,
+	checksumXOR:   appendXOR,
+	checksumCRC16: appendCRC16,
+}
+
+// checksumSize returns how many bytes the checksum name appends.
+func checksumSize(name string) int {
+	switch name {
+	case checksumSum8, checksumXOR:
+		return 1
+	case checksumCRC16:
+		return 2
+	}
+	return 0
+}
+
+// validateChecksumName checks the checksum name is known.
+func validateChecksumName(name string) error {
+	if _, ok := checksumSteps[name]; !ok && name != "" {
+		return fmt.Errorf("invalid checksum %q: want none, sum8, crc16 or xor", name)
+	}
+	return nil
+}
+
+// validateChecksum checks t, with the handler's defaults applied, has a
+// custom packet for its checksum to end.
+func (t Target) validateChecksum() error {
+	if t.Checksum != "" && t.Checksum != checksumNone && t.PacketTemplate == "" && t.Encoding == "" {
+		return errors.New("checksum requires packet_template or encoding")
+	}
+	return nil
+}
+
+// appendChecksum appends the checksum name over packet to it.
+func appendChecksum(packet []byte, name string) []byte {
+	if step, ok := checksumSteps[name]; ok {
+		return step(packet)
+	}
+	return packet
+}
+
+func appendSum8(packet []byte) []byte {
+	var sum byte
+	for _, b := range packet {
+		sum += b
+	}
+	return append(packet, sum)
+}
+
+func appendXOR(packet []byte) []byte {
+	var x byte
+	for _, b := range packet {
+		x ^= b
+	}
+	return append(packet, x)
+}
+
+func appendCRC16(packet []byte) []byte {
+	crc := uint16(0xFFFF)
+	for _, b := range packet {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return binary.BigEndian.AppendUint16(packet, crc)
+}
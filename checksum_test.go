@@ -0,0 +1,95 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestAppendChecksum(t *testing.T) {
+	// The standard check input of "123456789"
+	check := []byte("123456789")
+	tests := []struct {
+		name string
+		want []byte
+	}{
+		{name: "", want: check},
+		{name: checksumNone, want: check},
+		{name: checksumSum8, want: append([]byte("123456789"), 0xDD)},
+		{name: checksumXOR, want: append([]byte("123456789"), 0x31)},
+		{name: checksumCRC16, want: append([]byte("123456789"), 0x29, 0xB1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := appendChecksum(bytes.Clone(check), tt.name)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("packet % x, want % x", got, tt.want)
+			}
+			if n := len(got) - len(check); n != checksumSize(tt.name) {
+				t.Errorf("appended %d bytes, checksumSize says %d", n, checksumSize(tt.name))
+			}
+		})
+	}
+}
+
+func TestChecksumConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "template", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tpacket_template \"ff*6 {mac_bytes}*16\"\n\tchecksum crc16\n}"},
+		{name: "encoding", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding standard\n\tchecksum xor\n}"},
+		{name: "none", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tchecksum none\n}"},
+		{name: "target", input: "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tencoding short\n\t\tchecksum sum8\n\t}\n}"},
+		{name: "target inherits", input: "wake_on_lan {\n\tencoding standard\n\tchecksum sum8\n\ttarget " + testMAC + " 192.0.2.1\n}"},
+		{name: "unknown", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding standard\n\tchecksum md5\n}", wantErr: true},
+		{name: "no argument", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tchecksum\n}", wantErr: true},
+		{name: "standard packet", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tchecksum sum8\n}", wantErr: true},
+		{name: "unknown on target", input: "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tencoding short\n\t\tchecksum adler\n\t}\n}", wantErr: true},
+		{name: "standard packet on target", input: "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tchecksum crc16\n\t}\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeHTTPChecksum(t *testing.T) {
+	hw, _ := net.ParseMAC(testMAC)
+	standard := buildMagicPacket(hw)
+	tests := []struct {
+		name string
+		w    WakeOnLAN
+		want []byte
+	}{
+		{name: "template", w: WakeOnLAN{PacketTemplate: "ff*6 {mac_bytes}*16", Checksum: checksumCRC16}, want: appendChecksum(bytes.Clone(standard), checksumCRC16)},
+		{name: "encoding", w: WakeOnLAN{Encoding: encodingStandard, Checksum: checksumXOR}, want: appendChecksum(bytes.Clone(standard), checksumXOR)},
+		// The checksum comes before the padding
+		{name: "padded", w: WakeOnLAN{Encoding: encodingStandard, Checksum: checksumSum8, PadTo: 110}, want: append(appendChecksum(bytes.Clone(standard), checksumSum8), make([]byte, 7)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := tt.w
+			w.MAC, w.IP, w.Port = testMAC, "127.0.0.1", host.port()
+			provisionTest(t, &w)
+			if got := packetSize(w.targets()[0], w.sendOptions()); got != len(tt.want) {
+				t.Errorf("packetSize = %d, want %d", got, len(tt.want))
+			}
+			if _, _, err := serveTest(&w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			if p := host.expect(t, 1)[0]; !bytes.Equal(p, tt.want) {
+				t.Errorf("packet % x, want % x", p, tt.want)
+			}
+		})
+	}
+}
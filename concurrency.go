@@ -0,0 +1,97 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// What a wake does when max_concurrent_wakes are already running.
+const (
+	whenFullQueue  = "queue"
+	whenFullReject = "reject"
+)
+
+// defaultQueueTimeout bounds how long a queued wake waits for a slot.
+const defaultQueueTimeout = 10 * time.Second
+
+// errTooManyWakes is returned for a wake refused because the limit of
+// concurrent wakes was reached.
+var errTooManyWakes = errors.New("too many wakes in progress")
+
+// wakeSlots bounds the number of wakes running at once across handlers.
+type wakeSlots struct {
+	sem     chan struct{}
+	reject  bool
+	timeout time.Duration
+}
+
+// newWakeSlots returns slots for n concurrent wakes, or nil for no limit.
+func newWakeSlots(n int, whenFull string, timeout time.Duration) *wakeSlots {
+	if n == 0 {
+		return nil
+	}
+	if timeout == 0 {
+		timeout = defaultQueueTimeout
+	}
+	return &wakeSlots{sem: make(chan struct{}, n), reject: whenFull == whenFullReject, timeout: timeout}
+}
+
+// validateConcurrency checks the concurrency limit settings.
+func validateConcurrency(n int, whenFull string, timeout time.Duration) error {
+	if n < 0 {
+		return fmt.Errorf("invalid max_concurrent_wakes %d", n)
+	}
+	switch whenFull {
+	case "", whenFullQueue, whenFullReject:
+	default:
+		return fmt.Errorf("unknown when_full %q", whenFull)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("invalid queue_timeout %s", timeout)
+	}
+	if n == 0 && (whenFull != "" || timeout != 0) {
+		return errors.New("when_full and queue_timeout require max_concurrent_wakes")
+	}
+	if whenFull == whenFullReject && timeout != 0 {
+		return errors.New("queue_timeout requires when_full queue")
+	}
+	return nil
+}
+
+// acquireWake takes one of the app's wake slots for a handler; handlers
+// without the app, or an app without a limit, never wait.
+func (a *App) acquireWake(ctx context.Context) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+	return a.slots.acquire(ctx)
+}
+
+// acquire takes a slot, waiting for one up to the queue timeout unless
+// full slots reject at once. The returned func gives the slot back.
+func (s *wakeSlots) acquire(ctx context.Context) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	release := func() { <-s.sem }
+	select {
+	case s.sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if s.reject {
+		return nil, errTooManyWakes
+	}
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case s.sem <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, errTooManyWakes
+	}
+}
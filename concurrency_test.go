@@ -0,0 +1,168 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestValidateConcurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		whenFull string
+		timeout  time.Duration
+		wantErr  bool
+	}{
+		{name: "no limit"},
+		{name: "queue", n: 4, whenFull: whenFullQueue, timeout: time.Second},
+		{name: "reject", n: 4, whenFull: whenFullReject},
+		{name: "negative", n: -1, wantErr: true},
+		{name: "unknown when_full", n: 4, whenFull: "drop", wantErr: true},
+		{name: "negative timeout", n: 4, timeout: -time.Second, wantErr: true},
+		{name: "when_full without limit", whenFull: whenFullReject, wantErr: true},
+		{name: "timeout with reject", n: 4, whenFull: whenFullReject, timeout: time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateConcurrency(tt.n, tt.whenFull, tt.timeout); (err != nil) != tt.wantErr {
+				t.Errorf("validateConcurrency = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConcurrencyOption(t *testing.T) {
+	v, err := parseAppOption(caddyfile.NewTestDispenser("wake_on_lan {\n\tmax_concurrent_wakes 8\n\twhen_full queue\n\tqueue_timeout 3s\n}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var app App
+	if err := json.Unmarshal(v.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatal(err)
+	}
+	if app.MaxConcurrentWakes != 8 || app.WhenFull != whenFullQueue || time.Duration(app.QueueTimeout) != 3*time.Second {
+		t.Errorf("max_concurrent_wakes %d, when_full %q, queue_timeout %s; want 8 queued for 3s", app.MaxConcurrentWakes, app.WhenFull, time.Duration(app.QueueTimeout))
+	}
+}
+
+func TestWakeSlots(t *testing.T) {
+	tests := []struct {
+		name     string
+		whenFull string
+		timeout  time.Duration
+		// give a slot back this long after the limit is reached, if set
+		releaseAfter time.Duration
+		cancel       bool
+		wantErr      error
+		wantWait     time.Duration
+	}{
+		{name: "reject", whenFull: whenFullReject, wantErr: errTooManyWakes},
+		{name: "queue times out", timeout: 100 * time.Millisecond, wantErr: errTooManyWakes, wantWait: 100 * time.Millisecond},
+		{name: "queue gets a slot", timeout: time.Second, releaseAfter: 50 * time.Millisecond, wantWait: 50 * time.Millisecond},
+		{name: "cancelled", timeout: time.Second, cancel: true, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const n = 3
+			s := newWakeSlots(n, tt.whenFull, tt.timeout)
+			releases := make([]func(), n)
+			for i := range n {
+				release, err := s.acquire(t.Context())
+				if err != nil {
+					t.Fatalf("slot %d: %v", i, err)
+				}
+				releases[i] = release
+			}
+			if tt.releaseAfter > 0 {
+				time.AfterFunc(tt.releaseAfter, releases[0])
+			}
+			ctx, cancel := context.WithCancel(t.Context())
+			if tt.cancel {
+				cancel()
+			}
+			defer cancel()
+
+			start := time.Now()
+			release, err := s.acquire(ctx)
+			took := time.Since(start)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("acquire = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				release()
+			}
+			if took < tt.wantWait || took > tt.wantWait+500*time.Millisecond {
+				t.Errorf("acquire took %s, want about %s", took, tt.wantWait)
+			}
+		})
+	}
+
+	// No limit never waits
+	var unlimited *wakeSlots
+	if release, err := unlimited.acquire(t.Context()); err != nil {
+		t.Errorf("acquiring without a limit: %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestServeHTTPMaxConcurrentWakes(t *testing.T) {
+	tests := []struct {
+		name       string
+		app        string
+		wantStatus int
+		wantResult wakeResult
+	}{
+		{name: "reject", app: `{"max_concurrent_wakes": 1, "when_full": "reject"}`, wantStatus: http.StatusServiceUnavailable, wantResult: resultBusy},
+		{name: "queue times out", app: `{"max_concurrent_wakes": 1, "queue_timeout": "100ms"}`, wantStatus: http.StatusServiceUnavailable, wantResult: resultBusy},
+		{name: "queue", app: `{"max_concurrent_wakes": 1, "queue_timeout": "5s"}`, wantStatus: http.StatusNoContent, wantResult: resultSent},
+		{name: "room", app: `{"max_concurrent_wakes": 2, "when_full": "reject"}`, wantStatus: http.StatusNoContent, wantResult: resultSent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := loadApp(t, tt.app)
+			// The first handler holds its slot while it waits in vain
+			slow := provisionIn(t, ctx, &WakeOnLAN{
+				MAC:   testMAC,
+				IP:    "127.0.0.1",
+				Port:  newFakeHost(t).port(),
+				Check: fmt.Sprintf("127.0.0.1:%d", closedPort(t)),
+				Wait:  caddy.Duration(600 * time.Millisecond),
+			})
+			host := newFakeHost(t)
+			w := provisionIn(t, ctx, &WakeOnLAN{MAC: "00:11:22:33:44:66", IP: "127.0.0.1", Port: host.port(), StatusHeader: "X-Wake-Result"})
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serveTest(slow, newTestRequest("GET", "http://example.com/", nil))
+			}()
+			defer wg.Wait()
+			time.Sleep(100 * time.Millisecond)
+
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if got := rec.Header().Get("X-Wake-Result"); !strings.HasPrefix(got, string(tt.wantResult)+";") {
+				t.Errorf("result %q, want %s", got, tt.wantResult)
+			}
+			if tt.wantResult == resultSent {
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// confirmCache remembers when each target was last confirmed up, by a
+// probe finding it already up or a wake seeing it come up, so requests
+// within confirm_cache_ttl answer already_up without probing again.
+type confirmCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu sync.Mutex
+	up map[string]time.Time
+}
+
+func newConfirmCache(ttl time.Duration) *confirmCache {
+	return &confirmCache{ttl: ttl, now: time.Now, up: make(map[string]time.Time)}
+}
+
+// fresh reports whether the target with key was confirmed up within the
+// TTL, dropping its entry once it is older.
+func (c *confirmCache) fresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	at, ok := c.up[key]
+	if !ok {
+		return false
+	}
+	if c.now().Sub(at) >= c.ttl {
+		delete(c.up, key)
+		return false
+	}
+	return true
+}
+
+// record confirms the target with key up now if its wake ended with
+// already_up or woken.
+func (c *confirmCache) record(key string, result wakeResult) {
+	if result != resultAlreadyUp && result != resultWoken {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.up[key] = c.now()
+}
+
+// validateConfirmCache checks confirm_cache_ttl and that there is a
+// confirmation to cache.
+func (w *WakeOnLAN) validateConfirmCache() error {
+	switch {
+	case w.ConfirmCacheTTL == 0:
+		return nil
+	case w.ConfirmCacheTTL < 0:
+		return fmt.Errorf("invalid confirm_cache_ttl %s", time.Duration(w.ConfirmCacheTTL))
+	case w.WaitHTTP != nil || len(w.ConfirmExec) > 0 || w.waitsARP():
+		return nil
+	}
+	for _, t := range w.allTargets() {
+		if t.Check == "" {
+			return errors.New("confirm_cache_ttl requires a check address, wait_arp, confirm_arp_learned, wait_http or confirm_exec to confirm targets up by")
+		}
+	}
+	return nil
+}
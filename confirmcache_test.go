@@ -0,0 +1,111 @@
+package caddy_wakeonlan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestConfirmCacheConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "check 192.0.2.1:22\n\tconfirm_cache_ttl 30s", want: 30 * time.Second},
+		{input: "wait 1m\n\twait_http http://192.0.2.1/\n\tconfirm_cache_ttl 30s", want: 30 * time.Second},
+		{input: "confirm_cache_ttl 30s", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tconfirm_cache_ttl -1s", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tconfirm_cache_ttl", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tconfirm_cache_ttl soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && time.Duration(w.ConfirmCacheTTL) != tt.want {
+				t.Errorf("confirm_cache_ttl %s, want %s", time.Duration(w.ConfirmCacheTTL), tt.want)
+			}
+		})
+	}
+}
+
+func TestConfirmCache(t *testing.T) {
+	now := time.Now()
+	c := newConfirmCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	if c.fresh("nas") {
+		t.Error("target never confirmed is fresh")
+	}
+	// Only a target seen up is confirmed
+	for _, result := range []wakeResult{resultSent, resultWakeTimeout, resultSendFailed} {
+		c.record("nas", result)
+		if c.fresh("nas") {
+			t.Errorf("target confirmed by %s", result)
+		}
+	}
+	c.record("nas", resultWoken)
+	c.record("desktop", resultAlreadyUp)
+	now = now.Add(59 * time.Second)
+	if !c.fresh("nas") || !c.fresh("desktop") {
+		t.Error("targets confirmed within the TTL aren't fresh")
+	}
+	now = now.Add(time.Second)
+	if c.fresh("nas") {
+		t.Error("target confirmed a TTL ago is fresh")
+	}
+	if _, kept := c.up["nas"]; kept {
+		t.Error("expired entry kept")
+	}
+}
+
+func TestServeHTTPConfirmCache(t *testing.T) {
+	host := newFakeHost(t)
+	up := newTCPHost(t)
+	const ttl = 300 * time.Millisecond
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:             testMAC,
+		IP:              "127.0.0.1",
+		Port:            host.port(),
+		Check:           up.addr(),
+		CheckTimeout:    caddy.Duration(100 * time.Millisecond),
+		ConfirmCacheTTL: caddy.Duration(ttl),
+		StatusHeader:    "X-Wake-Result",
+	})
+	wake := func() string {
+		t.Helper()
+		rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Header().Get("X-Wake-Result")
+	}
+	alreadyUp := string(resultAlreadyUp) + "; target=" + testMAC
+
+	if got := wake(); got != alreadyUp {
+		t.Fatalf("first request: %q, want %q", got, alreadyUp)
+	}
+	probes := up.conns.Load()
+	// The host goes down, but the confirmation still answers
+	up.ln.Close()
+	if got := wake(); got != alreadyUp {
+		t.Errorf("within the TTL: %q, want %q", got, alreadyUp)
+	}
+	if n := up.conns.Load(); n != probes {
+		t.Errorf("probed %d more times within the TTL, want none", n-probes)
+	}
+	host.expectNone(t)
+
+	time.Sleep(ttl)
+	if got, want := wake(), string(resultSent)+"; target="+testMAC; got != want {
+		t.Errorf("past the TTL: %q, want %q", got, want)
+	}
+	host.expect(t, 1)
+}
@@ -0,0 +1,82 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultConfirmExecTimeout bounds one run of the confirm_exec command.
+const defaultConfirmExecTimeout = 5 * time.Second
+
+// validateConfirmExec checks confirm_exec and the settings it depends on.
+func (w *WakeOnLAN) validateConfirmExec() error {
+	switch {
+	case len(w.ConfirmExec) == 0 && w.ConfirmExecTimeout != 0:
+		return errors.New("confirm_exec_timeout requires confirm_exec")
+	case len(w.ConfirmExec) == 0:
+		return nil
+	case w.ConfirmExecTimeout < 0:
+		return fmt.Errorf("invalid confirm_exec_timeout %s", time.Duration(w.ConfirmExecTimeout))
+	case w.Wait <= 0:
+		return errors.New("confirm_exec requires wait")
+	case len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil || w.WaitingPage != nil:
+		return errors.New("confirm_exec cannot be combined with escalate, send_until_up, broadcast_fallback or waiting_page")
+	}
+	return nil
+}
+
+// runConfirmExec runs the confirm_exec command once for t, with the target in
+// WAKE_* environment variables, and reports whether it exited with 0.
+// Its output is logged.
+func (w *WakeOnLAN) runConfirmExec(ctx context.Context, t Target) bool {
+	timeout := time.Duration(w.ConfirmExecTimeout)
+	if timeout == 0 {
+		timeout = defaultConfirmExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, w.confirmExecPath, w.ConfirmExec[1:]...)
+	cmd.Env = execEnv(t)
+	// Don't wait on output pipes held open by the command's children
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	fields := []zap.Field{
+		zap.String("target", t.label()),
+		zap.String("command", w.ConfirmExec[0]),
+		zap.ByteString("output", truncateOutput(out)),
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		w.logger.Warn("confirm_exec command timed out", append(fields, zap.Duration("timeout", timeout))...)
+		return false
+	case errors.As(err, &exitErr):
+		w.logger.Debug("confirm_exec command reports the target not up", append(fields, zap.Int("exit_code", exitErr.ExitCode()))...)
+		return false
+	case err != nil:
+		if ctx.Err() == nil {
+			w.logger.Warn("confirm_exec command failed", append(fields, zap.Error(err))...)
+		}
+		return false
+	}
+	w.logger.Debug("confirm_exec command confirms the target up", fields...)
+	return true
+}
+
+// waitConfirmExec runs the confirm_exec command for t until it confirms
+// the target up or ctx is done.
+func (w *WakeOnLAN) waitConfirmExec(ctx context.Context, t Target) bool {
+	for {
+		if w.runConfirmExec(ctx, t) {
+			return true
+		}
+		if sleepCtx(ctx, waitPollInterval) != nil {
+			return false
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package caddy_wakeonlan
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestConfirmExecConfig(t *testing.T) {
+	tests := []struct {
+		input       string
+		want        []string
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{input: "wait 1m\n\tconfirm_exec /usr/local/bin/nas-ready --pool tank", want: []string{"/usr/local/bin/nas-ready", "--pool", "tank"}},
+		{input: "wait 1m\n\tconfirm_exec nas-ready\n\tconfirm_exec_timeout 2s", want: []string{"nas-ready"}, wantTimeout: 2 * time.Second},
+		{input: "wait 1m\n\tconfirm_exec", wantErr: true},
+		{input: "confirm_exec nas-ready", wantErr: true},
+		{input: "wait 1m\n\tconfirm_exec_timeout 2s", wantErr: true},
+		{input: "wait 1m\n\tconfirm_exec nas-ready\n\tconfirm_exec_timeout -1s", wantErr: true},
+		{input: "wait 1m\n\tconfirm_exec nas-ready\n\tsend_until_up", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if strings.Join(w.ConfirmExec, " ") != strings.Join(tt.want, " ") || time.Duration(w.ConfirmExecTimeout) != tt.wantTimeout {
+				t.Errorf("confirm_exec %q, timeout %s; want %q, %s", w.ConfirmExec, time.Duration(w.ConfirmExecTimeout), tt.want, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestRunConfirmExec(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name        string
+		script      string
+		timeout     time.Duration
+		want        bool
+		wantMessage string
+	}{
+		{
+			name:        "up",
+			script:      `test "$WAKE_TARGET $WAKE_MAC $WAKE_IP $WAKE_PORT $WAKE_CHECK" = "nas 00:11:22:33:44:55 192.0.2.1 9 192.0.2.1:22"`,
+			want:        true,
+			wantMessage: "confirm_exec command confirms the target up",
+		},
+		{name: "not up", script: "echo pool degraded; exit 1", wantMessage: "confirm_exec command reports the target not up"},
+		{name: "timed out", script: "sleep 5", timeout: 100 * time.Millisecond, wantMessage: "confirm_exec command timed out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := loadApp(t, `{"allow_exec": true}`)
+			w := provisionIn(t, ctx, &WakeOnLAN{
+				MAC:                testMAC,
+				IP:                 "192.0.2.1",
+				Check:              "192.0.2.1:22",
+				Wait:               caddy.Duration(time.Minute),
+				ConfirmExec:        []string{"sh", "-c", tt.script},
+				ConfirmExecTimeout: caddy.Duration(tt.timeout),
+			})
+			logs := observeLogs(w)
+			target := Target{Name: "nas", MAC: strings.ToUpper(testMAC), IP: "192.0.2.1", Port: 9, Check: "192.0.2.1:22"}
+			if got := w.runConfirmExec(t.Context(), target); got != tt.want {
+				t.Errorf("runConfirmExec = %v, want %v", got, tt.want)
+			}
+			if logs.FilterMessage(tt.wantMessage).Len() != 1 {
+				t.Errorf("no %q log entry in %v", tt.wantMessage, logs.All())
+			}
+		})
+	}
+}
+
+func TestServeHTTPConfirmExec(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name string
+		// when the command starts passing, negative for never
+		upAfter    time.Duration
+		wantResult wakeResult
+		wantSent   bool
+	}{
+		{name: "already up", upAfter: 0, wantResult: resultAlreadyUp},
+		{name: "comes up", upAfter: 300 * time.Millisecond, wantResult: resultWoken, wantSent: true},
+		{name: "never up", upAfter: -1, wantResult: resultWakeTimeout, wantSent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			ready := filepath.Join(t.TempDir(), "ready")
+			markReady := func() {
+				if err := os.WriteFile(ready, nil, 0o644); err != nil {
+					t.Error(err)
+				}
+			}
+			switch {
+			case tt.upAfter == 0:
+				markReady()
+			case tt.upAfter > 0:
+				timer := time.AfterFunc(tt.upAfter, markReady)
+				t.Cleanup(func() { timer.Stop() })
+			}
+			ctx := loadApp(t, `{"allow_exec": true}`)
+			w := provisionIn(t, ctx, &WakeOnLAN{
+				MAC:          testMAC,
+				IP:           "127.0.0.1",
+				Port:         host.port(),
+				Wait:         caddy.Duration(time.Second),
+				ConfirmExec:  []string{"sh", "-c", `test -e "$0"`, ready},
+				StatusHeader: "X-Wake-Result",
+			})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			if tt.wantSent {
+				host.expect(t, 1)
+			} else {
+				host.expectNone(t)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// ConfirmListen confirms a wake by a datagram the target sends once it is
+// up, e.g. from a boot script, instead of the Caddy host probing it: for
+// hosts behind firewalls that let nothing in, or that come up on an
+// address the Caddy host can't reach.
+type ConfirmListen struct {
+	// UDP port to listen on, on all addresses.
+	Port int `json:"port"`
+	// IP the datagram must come from. Default: any.
+	From string `json:"from,omitempty"`
+	// Text the datagram must contain, with the placeholders {wake.target},
+	// {wake.mac} and {wake.ip} for the target woken, so one port can
+	// confirm several targets.
+	Contains string `json:"contains,omitempty"`
+	// Bytes the datagram must contain, in hex, instead of Contains.
+	ContainsHex string `json:"contains_hex,omitempty"`
+}
+
+// validateConfirmListen checks confirm_listen and the settings it depends
+// on.
+func (w *WakeOnLAN) validateConfirmListen() error {
+	c := w.ConfirmListen
+	if c == nil {
+		return nil
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("invalid confirm_listen port %d", c.Port)
+	}
+	if c.From != "" {
+		if _, err := netip.ParseAddr(c.From); err != nil {
+			return fmt.Errorf("invalid confirm_listen from %q: want an IP", c.From)
+		}
+	}
+	if c.Contains != "" && c.ContainsHex != "" {
+		return errors.New("confirm_listen contains and contains_hex cannot be combined")
+	}
+	if _, err := hex.DecodeString(c.ContainsHex); err != nil {
+		return fmt.Errorf("invalid confirm_listen contains_hex: %w", err)
+	}
+	switch {
+	case w.Wait <= 0:
+		return errors.New("confirm_listen requires wait")
+	case len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil || w.WaitingPage != nil:
+		return errors.New("confirm_listen cannot be combined with escalate, send_until_up, broadcast_fallback or waiting_page")
+	}
+	return nil
+}
+
+// confirmation is one wake waiting for its datagram.
+type confirmation struct {
+	from     netip.Addr
+	contains []byte
+	heard    chan struct{}
+	done     bool
+}
+
+// matches reports whether a datagram with payload from ip confirms c.
+func (c *confirmation) matches(ip netip.Addr, payload []byte) bool {
+	if c.from.IsValid() && c.from != ip {
+		return false
+	}
+	return bytes.Contains(payload, c.contains)
+}
+
+// confirmListener is the socket on one port and the wakes it confirms,
+// shared by every handler and target listening there while any waits.
+type confirmListener struct {
+	conn  net.PacketConn
+	waits map[*confirmation]struct{}
+}
+
+var confirmListeners = struct {
+	sync.Mutex
+	m map[int]*confirmListener
+}{m: make(map[int]*confirmListener)}
+
+// listen starts waiting for t's datagram, opening the port unless other
+// wakes already listen there. heard is closed once a matching datagram
+// arrives; release stops waiting, closing the port after the last wake.
+func (c *ConfirmListen) listen(t Target) (heard <-chan struct{}, release func(), err error) {
+	conf := &confirmation{heard: make(chan struct{})}
+	if c.From != "" {
+		conf.from = netip.MustParseAddr(c.From).Unmap().WithZone("")
+	}
+	if c.ContainsHex != "" {
+		conf.contains, _ = hex.DecodeString(c.ContainsHex)
+	} else {
+		repl := caddy.NewReplacer()
+		repl.Set("wake.target", t.label())
+		repl.Set("wake.mac", t.MAC)
+		repl.Set("wake.ip", t.IP)
+		conf.contains = []byte(repl.ReplaceKnown(c.Contains, ""))
+	}
+
+	confirmListeners.Lock()
+	defer confirmListeners.Unlock()
+	l := confirmListeners.m[c.Port]
+	if l == nil {
+		conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(c.Port))
+		if err != nil {
+			return nil, nil, fmt.Errorf("confirm_listen: %w", err)
+		}
+		l = &confirmListener{conn: conn, waits: make(map[*confirmation]struct{})}
+		confirmListeners.m[c.Port] = l
+		go l.serve()
+	}
+	l.waits[conf] = struct{}{}
+	return conf.heard, func() {
+		confirmListeners.Lock()
+		defer confirmListeners.Unlock()
+		delete(l.waits, conf)
+		if len(l.waits) == 0 {
+			l.conn.Close()
+			delete(confirmListeners.m, c.Port)
+		}
+	}, nil
+}
+
+// serve reads datagrams until the socket is closed, confirming every wake
+// each one matches.
+func (l *confirmListener) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ip := udpAddr.AddrPort().Addr().Unmap().WithZone("")
+		confirmListeners.Lock()
+		for conf := range l.waits {
+			if !conf.done && conf.matches(ip, buf[:n]) {
+				conf.done = true
+				close(conf.heard)
+			}
+		}
+		confirmListeners.Unlock()
+	}
+}
+
+// parseConfirmListen parses confirm_listen: an optional port, then a block
+// with port, from and contains [hex] <data>.
+func parseConfirmListen(d *caddyfile.Dispenser) (*ConfirmListen, error) {
+	c := new(ConfirmListen)
+	if d.NextArg() {
+		port, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return nil, d.Errf("invalid confirm_listen port '%s'", d.Val())
+		}
+		c.Port = port
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "port":
+			port, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			c.Port = port
+		case "from":
+			from, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			c.From = from
+		case "contains":
+			args := d.RemainingArgs()
+			switch {
+			case len(args) == 1:
+				c.Contains, c.ContainsHex = args[0], ""
+			case len(args) == 2 && args[0] == "hex":
+				c.Contains, c.ContainsHex = "", args[1]
+			default:
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unrecognized confirm_listen subdirective '%s'", d.Val())
+		}
+	}
+	if c.Port == 0 {
+		return nil, d.Err("confirm_listen requires a port")
+	}
+	return c, nil
+}
@@ -0,0 +1,160 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestConfirmListenConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ConfirmListen
+		wantErr bool
+	}{
+		{input: "wait 30s\n\tconfirm_listen 40000", want: ConfirmListen{Port: 40000}},
+		{
+			input: "wait 30s\n\tconfirm_listen {\n\t\tport 40000\n\t\tfrom 192.0.2.1\n\t\tcontains \"{wake.target} up\"\n\t}",
+			want:  ConfirmListen{Port: 40000, From: "192.0.2.1", Contains: "{wake.target} up"},
+		},
+		{
+			input: "wait 30s\n\tconfirm_listen 40000 {\n\t\tcontains hex 0a0b0c\n\t}",
+			want:  ConfirmListen{Port: 40000, ContainsHex: "0a0b0c"},
+		},
+		// The last contains wins
+		{
+			input: "wait 30s\n\tconfirm_listen 40000 {\n\t\tcontains hex 0a0b0c\n\t\tcontains booted\n\t}",
+			want:  ConfirmListen{Port: 40000, Contains: "booted"},
+		},
+		{input: "wait 30s\n\tconfirm_listen", wantErr: true},
+		{input: "wait 30s\n\tconfirm_listen nine", wantErr: true},
+		{input: "wait 30s\n\tconfirm_listen 40000 40001", wantErr: true},
+		{input: "wait 30s\n\tconfirm_listen 70000", wantErr: true},
+		{input: "wait 30s\n\tconfirm_listen 40000 {\n\t\tfrom nas.lan\n\t}", wantErr: true},
+		{input: "wait 30s\n\tconfirm_listen 40000 {\n\t\tcontains hex 0g\n\t}", wantErr: true},
+		{input: "wait 30s\n\tconfirm_listen 40000 {\n\t\tcontains up and running\n\t}", wantErr: true},
+		{input: "wait 30s\n\tconfirm_listen 40000 {\n\t\tcontains\n\t}", wantErr: true},
+		{input: "wait 30s\n\tconfirm_listen 40000 {\n\t\tlisten 40001\n\t}", wantErr: true},
+		{input: "confirm_listen 40000", wantErr: true},
+		{input: "check 192.0.2.1:22\n\twait 30s\n\tsend_until_up\n\tconfirm_listen 40000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.ConfirmListen != tt.want {
+				t.Errorf("confirm_listen = %+v, want %+v", *w.ConfirmListen, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfirmationMatches(t *testing.T) {
+	from := netip.MustParseAddr("192.0.2.1")
+	tests := []struct {
+		name    string
+		c       confirmation
+		ip      string
+		payload string
+		want    bool
+	}{
+		{name: "anything", c: confirmation{}, ip: "198.51.100.7", payload: "hello", want: true},
+		{name: "from", c: confirmation{from: from}, ip: "192.0.2.1", payload: "hello", want: true},
+		{name: "other sender", c: confirmation{from: from}, ip: "192.0.2.2", payload: "hello"},
+		{name: "contains", c: confirmation{contains: []byte("nas up")}, ip: "192.0.2.1", payload: "boot: nas up (3s)", want: true},
+		{name: "missing", c: confirmation{contains: []byte("nas up")}, ip: "192.0.2.1", payload: "desktop up"},
+		{name: "both", c: confirmation{from: from, contains: []byte("up")}, ip: "192.0.2.1", payload: "up", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.matches(netip.MustParseAddr(tt.ip), []byte(tt.payload)); got != tt.want {
+				t.Errorf("matches(%s, %q) = %v, want %v", tt.ip, tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+// announce sends payload to the local port every 100ms until the test
+// ends, standing in for a host announcing it booted.
+func announce(t *testing.T, port int, payload string) {
+	t.Helper()
+	conn, err := net.Dial("udp4", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		conn.Close()
+	})
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				conn.Write([]byte(payload))
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func TestServeHTTPConfirmListen(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen ConfirmListen
+		// sent to the port, none if empty
+		payload    string
+		wantResult wakeResult
+	}{
+		{name: "any datagram", payload: "hello", wantResult: resultWoken},
+		{name: "contains", listen: ConfirmListen{Contains: "{wake.target} up"}, payload: "boot: nas up", wantResult: resultWoken},
+		{name: "contains hex", listen: ConfirmListen{ContainsHex: "6e6173"}, payload: "nas", wantResult: resultWoken},
+		{name: "from", listen: ConfirmListen{From: "127.0.0.1"}, payload: "hello", wantResult: resultWoken},
+		{name: "other target", listen: ConfirmListen{Contains: "{wake.target} up"}, payload: "boot: desktop up", wantResult: resultWakeTimeout},
+		{name: "other sender", listen: ConfirmListen{From: "192.0.2.1"}, payload: "hello", wantResult: resultWakeTimeout},
+		{name: "silent", wantResult: resultWakeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			listen := tt.listen
+			listen.Port = freeUDPPort(t)
+			w := provisionTest(t, &WakeOnLAN{
+				Targets:       []Target{{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port()}},
+				Wait:          caddy.Duration(time.Second),
+				ConfirmListen: &listen,
+				StatusHeader:  "X-Wake-Result",
+			})
+			if tt.payload != "" {
+				announce(t, listen.Port, tt.payload)
+			}
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target=nas"; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			host.expect(t, 1)
+			// The port is closed once nothing waits on it
+			confirmListeners.Lock()
+			_, open := confirmListeners.m[listen.Port]
+			confirmListeners.Unlock()
+			if open {
+				t.Errorf("port %d still open after the wait", listen.Port)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// wakeCoordinator lets requests for the same target share a single wake.
+// While a wake is in flight, further requests attach to it and receive its
+// result. Within the grace period after a packet was sent, new requests
+// only extend the wait instead of sending again.
+type wakeCoordinator struct {
+	mu      sync.Mutex
+	flights map[string]*wakeFlight
+	sends   uint64 // sequence number of the last send
+}
+
+// wakeFlight is one shared wake (or wait) operation.
+type wakeFlight struct {
+	done   chan struct{}
+	sentAt time.Time // when the packet the flight relies on was sent
+	seq    uint64    // sequence number of that send
+	result wakeResult
+	err    error
+}
+
+// run executes fn as a shared flight for key. fn is told whether it should
+// send a packet or only wait for one sent earlier. It runs detached from the
+// request context so that one client going away does not cancel the wake
+// for everybody attached to it. Each request logs, at debug level, the
+// sequence number of the send it relies on, so that those sharing one can
+// be told apart.
+func (c *wakeCoordinator) run(ctx context.Context, key string, grace time.Duration, logger *zap.Logger, fn func(ctx context.Context, send bool) (wakeResult, error)) (wakeResult, error) {
+	c.mu.Lock()
+	if c.flights == nil {
+		c.flights = make(map[string]*wakeFlight)
+	}
+	send, sentAt := true, time.Now()
+	var seq uint64
+	if prev := c.flights[key]; prev != nil {
+		select {
+		case <-prev.done:
+			if !prev.result.failed() && time.Since(prev.sentAt) < grace {
+				send, sentAt, seq = false, prev.sentAt, prev.seq
+			}
+		default:
+			c.mu.Unlock()
+			logger.Debug("attached to wake in flight", zap.Uint64("send_seq", prev.seq))
+			return prev.wait(ctx)
+		}
+	}
+	if send {
+		c.sends++
+		seq = c.sends
+	}
+	f := &wakeFlight{done: make(chan struct{}), sentAt: sentAt, seq: seq}
+	c.flights[key] = f
+	c.mu.Unlock()
+	if send {
+		logger.Debug("starting wake", zap.Uint64("send_seq", seq))
+	} else {
+		logger.Debug("relying on recent send", zap.Uint64("send_seq", seq))
+	}
+
+	go func() {
+		defer close(f.done)
+		f.result, f.err = fn(context.WithoutCancel(ctx), send)
+	}()
+	return f.wait(ctx)
+}
+
+// wait blocks until the flight completes or ctx is cancelled.
+func (f *wakeFlight) wait(ctx context.Context) (wakeResult, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return resultError, ctx.Err()
+	}
+}
@@ -0,0 +1,245 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWakeCoordinatorSharesFlight(t *testing.T) {
+	var c wakeCoordinator
+	var sends, waits atomic.Int32
+	release := make(chan struct{})
+	fn := func(_ context.Context, send bool) (wakeResult, error) {
+		if send {
+			sends.Add(1)
+		} else {
+			waits.Add(1)
+		}
+		<-release
+		return resultWoken, nil
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	results := make([]wakeResult, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = c.run(t.Context(), "nas", time.Minute, zap.NewNop(), fn)
+		}()
+	}
+	// Let every request attach before the flight ends
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := sends.Load(); got != 1 {
+		t.Errorf("sent %d times for %d simultaneous requests, want 1", got, n)
+	}
+	if got := waits.Load(); got != 0 {
+		t.Errorf("started %d separate waits, want 0", got)
+	}
+	for i, r := range results {
+		if r != resultWoken {
+			t.Errorf("request %d got %s, want %s", i, r, resultWoken)
+		}
+	}
+}
+
+func TestWakeCoordinatorGrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		grace    time.Duration
+		first    wakeResult
+		wantSend bool
+	}{
+		{name: "within grace", grace: time.Minute, first: resultWakeTimeout, wantSend: false},
+		{name: "after grace", grace: time.Nanosecond, first: resultWakeTimeout, wantSend: true},
+		{name: "first failed", grace: time.Minute, first: resultSendFailed, wantSend: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c wakeCoordinator
+			c.run(t.Context(), "nas", tt.grace, zap.NewNop(), func(context.Context, bool) (wakeResult, error) {
+				return tt.first, nil
+			})
+			time.Sleep(time.Millisecond)
+			var sent bool
+			c.run(t.Context(), "nas", tt.grace, zap.NewNop(), func(_ context.Context, send bool) (wakeResult, error) {
+				sent = send
+				return resultWoken, nil
+			})
+			if sent != tt.wantSend {
+				t.Errorf("second wake sent = %v, want %v", sent, tt.wantSend)
+			}
+		})
+	}
+}
+
+func TestWakeCoordinatorDetached(t *testing.T) {
+	var c wakeCoordinator
+	release := make(chan struct{})
+	flightErr := make(chan error, 1)
+	ctx, cancel := context.WithCancel(t.Context())
+	returned := make(chan wakeResult)
+	go func() {
+		r, _ := c.run(ctx, "nas", time.Minute, zap.NewNop(), func(ctx context.Context, _ bool) (wakeResult, error) {
+			<-release
+			flightErr <- ctx.Err()
+			return resultWoken, nil
+		})
+		returned <- r
+	}()
+
+	// The client that started the wake going away returns for it alone
+	cancel()
+	if r := <-returned; r != resultError {
+		t.Errorf("cancelled request got %s, want %s", r, resultError)
+	}
+	close(release)
+	if err := <-flightErr; err != nil {
+		t.Errorf("the wake was cancelled with its client: %v", err)
+	}
+}
+
+func TestGracePeriodConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    caddy.Duration
+		wantErr bool
+	}{
+		{input: "grace_period 2m", want: caddy.Duration(2 * time.Minute)},
+		{input: "grace_period soon", wantErr: true},
+		{input: "grace_period", wantErr: true},
+		{input: "grace_period -1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.GracePeriod != tt.want {
+				t.Errorf("grace_period = %s, want %s", time.Duration(w.GracePeriod), time.Duration(tt.want))
+			}
+		})
+	}
+}
+
+func TestServeHTTPGracePeriodSingleSend(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:         testMAC,
+		IP:          "127.0.0.1",
+		Port:        host.port(),
+		Check:       "127.0.0.1:" + strconv.Itoa(closedPort(t)),
+		Wait:        caddy.Duration(300 * time.Millisecond),
+		GracePeriod: caddy.Duration(time.Minute),
+	})
+
+	const n = 10
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != http.StatusNoContent || !called {
+				t.Errorf("status %d, next called %v", got, called)
+			}
+		}()
+	}
+	wg.Wait()
+	host.expect(t, 1)
+	host.expectNone(t)
+}
+
+func TestWakeCoordinatorSendSeq(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core)
+	var c wakeCoordinator
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go c.run(t.Context(), "nas", time.Minute, logger, func(context.Context, bool) (wakeResult, error) {
+		close(started)
+		<-release
+		return resultWoken, nil
+	})
+	<-started
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.run(t.Context(), "nas", time.Minute, logger, nil)
+		}()
+	}
+	// Let both requests attach before the flight ends
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	noop := func(context.Context, bool) (wakeResult, error) { return resultWoken, nil }
+	c.run(t.Context(), "nas", time.Minute, logger, noop)
+	c.run(t.Context(), "db", time.Minute, logger, noop)
+	c.run(t.Context(), "nas", time.Nanosecond, logger, noop)
+
+	tests := []struct {
+		message string
+		want    []uint64
+	}{
+		{message: "starting wake", want: []uint64{1, 2, 3}},
+		{message: "attached to wake in flight", want: []uint64{1, 1}},
+		{message: "relying on recent send", want: []uint64{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			var got []uint64
+			for _, e := range logs.FilterMessage(tt.message).All() {
+				if e.Level != zapcore.DebugLevel {
+					t.Errorf("logged at %s, want debug", e.Level)
+				}
+				got = append(got, e.ContextMap()["send_seq"].(uint64))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("send_seq %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPSendSeq(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port(), GracePeriod: caddy.Duration(time.Minute)})
+	logs := observeLogs(w)
+	for range 2 {
+		if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host.expect(t, 1)
+	host.expectNone(t)
+
+	started := logs.FilterMessage("starting wake").FilterField(zap.String("target", "nas")).All()
+	relied := logs.FilterMessage("relying on recent send").FilterField(zap.String("target", "nas")).All()
+	if len(started) != 1 || len(relied) != 1 {
+		t.Fatalf("logged %d sends and %d requests relying on one, want 1 and 1", len(started), len(relied))
+	}
+	if seq := started[0].ContextMap()["send_seq"]; relied[0].ContextMap()["send_seq"] != seq {
+		t.Errorf("second request relied on send %v, want %v", relied[0].ContextMap()["send_seq"], seq)
+	}
+}
@@ -0,0 +1,100 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// headerWakeDebug is the response header debug_header adds.
+const headerWakeDebug = "X-Wake-Debug"
+
+// transportHelper names deliveries through helper_socket in the debug
+// header.
+const transportHelper = "helper"
+
+// delivery is one packet handed off: where to, how and its size, once
+// hostnames, broadcast sources and interfaces are resolved.
+type delivery struct {
+	dest      string
+	transport string
+	iface     string
+	bytes     int
+}
+
+// deliveryLog collects a wake's deliveries, each once however many times it
+// was repeated.
+type deliveryLog struct {
+	mu         sync.Mutex
+	deliveries []delivery
+}
+
+type deliveryLogKey struct{}
+
+// withDeliveryLog returns ctx recording the deliveries of the sends made
+// with it into the returned log.
+func withDeliveryLog(ctx context.Context) (context.Context, *deliveryLog) {
+	l := new(deliveryLog)
+	return context.WithValue(ctx, deliveryLogKey{}, l), l
+}
+
+// recordDelivery adds d to the delivery log of ctx, if it has one.
+func recordDelivery(ctx context.Context, d delivery) {
+	l, ok := ctx.Value(deliveryLogKey{}).(*deliveryLog)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !slices.Contains(l.deliveries, d) {
+		l.deliveries = append(l.deliveries, d)
+	}
+}
+
+// addDebugHeader adds a debug header value for each of t's deliveries,
+// or one with only the result if nothing was sent or the wake never
+// started (l is nil).
+func addDebugHeader(rw http.ResponseWriter, l *deliveryLog, t Target, result wakeResult) {
+	suffix := "result=" + string(result) + "; target=" + t.label()
+	if l == nil {
+		rw.Header().Add(headerWakeDebug, suffix)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.deliveries) == 0 {
+		rw.Header().Add(headerWakeDebug, suffix)
+		return
+	}
+	for _, d := range l.deliveries {
+		var b strings.Builder
+		fmt.Fprintf(&b, "dest=%s", d.dest)
+		if d.bytes > 0 {
+			fmt.Fprintf(&b, " bytes=%d", d.bytes)
+		}
+		fmt.Fprintf(&b, " transport=%s", d.transport)
+		if d.iface != "" {
+			fmt.Fprintf(&b, " iface=%s", d.iface)
+		}
+		rw.Header().Add(headerWakeDebug, b.String()+" "+suffix)
+	}
+}
+
+// recordHelperDelivery records the delivery h asks the helper for.
+func recordHelperDelivery(ctx context.Context, h helperHeader, hw net.HardwareAddr, bytes int) {
+	dest := hw.String()
+	if h.IP != "" {
+		dest = hostPort(h.IP, h.Port)
+	}
+	recordDelivery(ctx, delivery{dest: dest, transport: transportHelper + "/" + h.Transport, iface: h.Interface, bytes: bytes})
+}
+
+// hostPort formats ip and port as a destination.
+func hostPort(ip string, port int) string {
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
@@ -0,0 +1,173 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestDebugHeaderConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "debug_header"},
+		{input: "debug_header yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.DebugHeader {
+				t.Error("debug_header not set")
+			}
+		})
+	}
+}
+
+func TestAddDebugHeader(t *testing.T) {
+	target := Target{Name: "nas", MAC: testMAC}
+	tests := []struct {
+		name       string
+		deliveries []delivery
+		noLog      bool
+		want       []string
+	}{
+		{name: "never started", noLog: true, want: []string{"result=busy; target=nas"}},
+		{name: "nothing sent", want: []string{"result=busy; target=nas"}},
+		{
+			name:       "udp",
+			deliveries: []delivery{{dest: "192.0.2.1:9", transport: protocolUDP, iface: "eth0", bytes: 102}},
+			want:       []string{"dest=192.0.2.1:9 bytes=102 transport=udp iface=eth0 result=busy; target=nas"},
+		},
+		{
+			name:       "relay",
+			deliveries: []delivery{{dest: "192.0.2.10:9", transport: "relay"}},
+			want:       []string{"dest=192.0.2.10:9 transport=relay result=busy; target=nas"},
+		},
+		// Repeats of a delivery are described once
+		{
+			name: "repeated",
+			deliveries: []delivery{
+				{dest: "192.0.2.1:9", transport: protocolUDP, bytes: 102},
+				{dest: "192.0.2.255:9", transport: protocolUDP, bytes: 102},
+				{dest: "192.0.2.1:9", transport: protocolUDP, bytes: 102},
+			},
+			want: []string{
+				"dest=192.0.2.1:9 bytes=102 transport=udp result=busy; target=nas",
+				"dest=192.0.2.255:9 bytes=102 transport=udp result=busy; target=nas",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, l := withDeliveryLog(context.Background())
+			for _, d := range tt.deliveries {
+				recordDelivery(ctx, d)
+			}
+			if tt.noLog {
+				l = nil
+			}
+			rec := httptest.NewRecorder()
+			addDebugHeader(rec, l, target, resultBusy)
+			if got := rec.Header().Values(headerWakeDebug); !slices.Equal(got, tt.want) {
+				t.Errorf("%s = %q, want %q", headerWakeDebug, got, tt.want)
+			}
+		})
+	}
+	// Without a log in the context, nothing is recorded or fails
+	recordDelivery(context.Background(), delivery{dest: "192.0.2.1:9"})
+}
+
+func TestServeHTTPDebugHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		w    func(t *testing.T, port int) *WakeOnLAN
+		// the header's values, from the port packets were sent to
+		want func(port int) []string
+	}{
+		{
+			name: "off",
+			w: func(_ *testing.T, port int) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port}
+			},
+			want: func(int) []string { return nil },
+		},
+		{
+			name: "unicast",
+			w: func(_ *testing.T, port int) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port, Repeat: 3, DebugHeader: true}
+			},
+			want: func(port int) []string {
+				return []string{fmt.Sprintf("dest=127.0.0.1:%d bytes=102 transport=udp result=sent; target=%s", port, testMAC)}
+			},
+		},
+		{
+			name: "secureon",
+			w: func(_ *testing.T, port int) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port, SecureOn: "01:02:03:04:05:06", DebugHeader: true}
+			},
+			want: func(port int) []string {
+				return []string{fmt.Sprintf("dest=127.0.0.1:%d bytes=108 transport=udp result=sent; target=%s", port, testMAC)}
+			},
+		},
+		{
+			name: "send failed",
+			w: func(t *testing.T, _ int) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: closedPort(t), Protocol: protocolTCP, DebugHeader: true}
+			},
+			want: func(port int) []string {
+				// The attempted delivery, with the failure
+				return []string{fmt.Sprintf("dest=127.0.0.1:%d bytes=102 transport=tcp result=send_failed; target=%s", port, testMAC)}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := tt.w(t, host.port())
+			provisionTest(t, w)
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Values(headerWakeDebug), tt.want(w.Port); !slices.Equal(got, want) {
+				t.Errorf("%s = %q, want %q", headerWakeDebug, got, want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPDebugHeaderBroadcast(t *testing.T) {
+	broadcast := localBroadcast(t)
+	if broadcast == nil {
+		t.Skip("no local network with a broadcast address")
+	}
+	host := newFakeHostOn(t, net.IPv4zero)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:         testMAC,
+		IP:          "127.0.0.1",
+		Port:        host.port(),
+		Broadcast:   broadcast.String(),
+		DebugHeader: true,
+	})
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		fmt.Sprintf("dest=127.0.0.1:%d bytes=102 transport=udp result=sent; target=%s", host.port(), testMAC),
+		fmt.Sprintf("dest=%s:%d bytes=102 transport=udp result=sent; target=%s", broadcast, host.port(), testMAC),
+	}
+	if got := rec.Header().Values(headerWakeDebug); !slices.Equal(slices.Sorted(slices.Values(got)), slices.Sorted(slices.Values(want))) {
+		t.Errorf("%s = %q, want %q", headerWakeDebug, got, want)
+	}
+}
@@ -0,0 +1,62 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// requestSends records, for one request, which handler sent a magic packet
+// over each transport to each destination, so handlers further down the
+// chain that were configured to wake the same host don't send it again.
+type requestSends struct {
+	mu sync.Mutex
+	by map[string]*sendClaims
+}
+
+// sendClaims is one handler's share of a request's sends. Packets it sent
+// itself, repeats and retries, are never skipped.
+type sendClaims struct {
+	sends *requestSends
+}
+
+type sendClaimsKey struct{}
+
+// validateDedupeSends checks that dedupe_sends has packets to skip.
+func (w *WakeOnLAN) validateDedupeSends() error {
+	if w.DedupeSends && (w.relayed() || w.HelperSocket != "" || w.Publish != nil || w.GRPC != nil) {
+		return errors.New("dedupe_sends cannot be combined with relay, helper_socket, publish or grpc")
+	}
+	return nil
+}
+
+// withSendClaims returns r with claims of its own for the handler running,
+// on the record of sends a handler before it in the chain started, or a
+// new one.
+func withSendClaims(r *http.Request) *http.Request {
+	sends := &requestSends{by: make(map[string]*sendClaims)}
+	if c, ok := r.Context().Value(sendClaimsKey{}).(*sendClaims); ok {
+		sends = c.sends
+	}
+	return r.WithContext(context.WithValue(r.Context(), sendClaimsKey{}, &sendClaims{sends: sends}))
+}
+
+// claimSend reports whether the packet for mac may go to dest over
+// transport: unless another handler of the request already sent it there,
+// it is recorded as this one's and true is returned. It always is when
+// the handler sending doesn't have dedupe_sends.
+func claimSend(ctx context.Context, transport, mac, dest string) bool {
+	c, ok := ctx.Value(sendClaimsKey{}).(*sendClaims)
+	if !ok {
+		return true
+	}
+	key := transport + "\x00" + mac + "\x00" + dest
+	c.sends.mu.Lock()
+	defer c.sends.mu.Unlock()
+	if owner, ok := c.sends.by[key]; ok && owner != c {
+		return false
+	}
+	c.sends.by[key] = c
+	return true
+}
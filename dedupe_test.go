@@ -0,0 +1,114 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDedupeSendsConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "dedupe_sends"},
+		{input: "dedupe_sends yes", wantErr: true},
+		{input: "dedupe_sends\n\trelay 192.0.2.9:9", wantErr: true},
+		{input: "dedupe_sends\n\thelper_socket /run/wol.sock", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.DedupeSends {
+				t.Error("dedupe_sends not set")
+			}
+		})
+	}
+}
+
+func TestClaimSend(t *testing.T) {
+	// Without dedupe_sends, everything may be sent
+	if !claimSend(context.Background(), protocolUDP, testMAC, "192.0.2.1:9") {
+		t.Error("send refused without claims")
+	}
+
+	first := withSendClaims(httptest.NewRequest("GET", "/", nil))
+	second := withSendClaims(first)
+	fresh := withSendClaims(httptest.NewRequest("GET", "/", nil))
+	tests := []struct {
+		name      string
+		r         *http.Request
+		transport string
+		dest      string
+		want      bool
+	}{
+		{name: "first claims", r: first, transport: protocolUDP, dest: "192.0.2.1:9", want: true},
+		{name: "first again", r: first, transport: protocolUDP, dest: "192.0.2.1:9", want: true},
+		{name: "second, same send", r: second, transport: protocolUDP, dest: "192.0.2.1:9"},
+		{name: "second, other transport", r: second, transport: protocolTCP, dest: "192.0.2.1:9", want: true},
+		{name: "second, other port", r: second, transport: protocolUDP, dest: "192.0.2.1:7", want: true},
+		{name: "first, second's send", r: first, transport: protocolTCP, dest: "192.0.2.1:9"},
+		{name: "other request", r: fresh, transport: protocolUDP, dest: "192.0.2.1:9", want: true},
+	}
+	for _, tt := range tests {
+		if got := claimSend(tt.r.Context(), tt.transport, testMAC, tt.dest); got != tt.want {
+			t.Errorf("%s: claimSend = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// chainedHandler runs a wake_on_lan handler as the next handler of
+// another.
+type chainedHandler struct {
+	w *WakeOnLAN
+}
+
+func (h chainedHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) error {
+	return h.w.ServeHTTP(rw, r, new(nextHandler))
+}
+
+func TestServeHTTPDedupeSends(t *testing.T) {
+	tests := []struct {
+		name string
+		// whether the second handler has dedupe_sends
+		secondDedupes bool
+		// whether the second handler wakes another port
+		otherPort   bool
+		wantPackets int
+	}{
+		{name: "deduped", secondDedupes: true, wantPackets: 2},
+		{name: "second without dedupe_sends", wantPackets: 3},
+		{name: "other destination", secondDedupes: true, otherPort: true, wantPackets: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, other := newFakeHost(t), newFakeHost(t)
+			// The first handler's own repeats all go out
+			first := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Repeat: 2, DedupeSends: true})
+			port := host.port()
+			if tt.otherPort {
+				port = other.port()
+			}
+			second := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port, DedupeSends: tt.secondDedupes})
+			rec := httptest.NewRecorder()
+			if err := first.ServeHTTP(rec, newTestRequest("GET", "http://example.com/", nil), chainedHandler{second}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.otherPort {
+				host.expect(t, 2)
+				other.expect(t, 1)
+			} else {
+				host.expect(t, tt.wantPackets)
+			}
+			host.expectNone(t)
+			other.expectNone(t)
+		})
+	}
+}
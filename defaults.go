@@ -0,0 +1,96 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Defaults are handler settings configured once in the wake_on_lan app.
+// Each applies to every handler, and where they have their own, target,
+// that leaves it unset.
+type Defaults struct {
+	// UDP or TCP port targets without one are sent to, instead of 9.
+	Port int `json:"port,omitempty"`
+	// How many packets to send to each target.
+	Repeat int `json:"repeat,omitempty"`
+	// How long to wait between repeated packets.
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+// validate checks the defaults like the handler checks its own values.
+func (d *Defaults) validate() error {
+	if d.Port < 0 || d.Port > 65535 {
+		return fmt.Errorf("invalid port %d", d.Port)
+	}
+	return validateRetry(d.Repeat, d.Interval)
+}
+
+// applyDefaults fills in the handler's unset settings from d. Target ports
+// are filled in by withDefaults.
+func (w *WakeOnLAN) applyDefaults(d *Defaults) {
+	if w.Repeat == 0 {
+		w.Repeat = d.Repeat
+	}
+	if w.Interval == 0 {
+		w.Interval = d.Interval
+	}
+	if w.defaultPort == 0 {
+		w.defaultPort = d.Port
+	}
+}
+
+// parseDefaults parses a defaults block.
+func parseDefaults(d *caddyfile.Dispenser) (*Defaults, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	defaults := new(Defaults)
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		ok, err := defaults.parseSubdirective(d)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, d.Errf("unrecognized subdirective '%s'", d.Val())
+		}
+	}
+	if err := defaults.validate(); err != nil {
+		return nil, d.Err(err.Error())
+	}
+	return defaults, nil
+}
+
+// parseSubdirective parses the current subdirective into defaults if it is one of
+// the defaults, and reports whether it was.
+func (defaults *Defaults) parseSubdirective(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "port":
+		n, err := parseIntArg(d)
+		if err != nil {
+			return true, err
+		}
+		defaults.Port = n
+	case "repeat":
+		n, err := parseIntArg(d)
+		if err != nil {
+			return true, err
+		}
+		defaults.Repeat = n
+	case "interval":
+		dur, err := parseDurationArg(d)
+		if err != nil {
+			return true, err
+		}
+		defaults.Interval = dur
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,111 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestDefaultsOption(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		parse   func(*caddyfile.Dispenser, any) (any, error)
+		want    Defaults
+		wantErr bool
+	}{
+		{
+			name:  "shorthand",
+			input: "wake_on_lan_defaults {\n\tport 7\n\trepeat 3\n\tinterval 1s\n}",
+			parse: parseDefaultsOption,
+			want:  Defaults{Port: 7, Repeat: 3, Interval: caddy.Duration(time.Second)},
+		},
+		{
+			name:  "app option",
+			input: "wake_on_lan {\n\tdefaults {\n\t\tport 7\n\t}\n}",
+			parse: parseAppOption,
+			want:  Defaults{Port: 7},
+		},
+		{name: "bad port", input: "wake_on_lan_defaults {\n\tport 70000\n}", parse: parseDefaultsOption, wantErr: true},
+		{name: "bad repeat", input: "wake_on_lan_defaults {\n\trepeat -1\n}", parse: parseDefaultsOption, wantErr: true},
+		{name: "unknown", input: "wake_on_lan_defaults {\n\tbroadcast 192.0.2.255\n}", parse: parseDefaultsOption, wantErr: true},
+		{name: "argument", input: "wake_on_lan_defaults 7", parse: parseDefaultsOption, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tt.parse(caddyfile.NewTestDispenser(tt.input), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var app App
+			if err := json.Unmarshal(v.(httpcaddyfile.App).Value, &app); err != nil {
+				t.Fatal(err)
+			}
+			if app.Defaults == nil || *app.Defaults != tt.want {
+				t.Errorf("defaults = %+v, want %+v", app.Defaults, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultsInherited(t *testing.T) {
+	tests := []struct {
+		name         string
+		w            *WakeOnLAN
+		wantPort     int
+		wantRepeat   int
+		wantInterval time.Duration
+	}{
+		{
+			name:         "inherited",
+			w:            &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1"},
+			wantPort:     7,
+			wantRepeat:   3,
+			wantInterval: time.Second,
+		},
+		{
+			name:         "handler overrides",
+			w:            &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Port: 4000, Repeat: 2, Interval: caddy.Duration(time.Millisecond)},
+			wantPort:     4000,
+			wantRepeat:   2,
+			wantInterval: time.Millisecond,
+		},
+		{
+			name:         "target overrides",
+			w:            &WakeOnLAN{Targets: []Target{{MAC: testMAC, IP: "192.0.2.1", Port: 4000, Repeat: 5}}},
+			wantPort:     4000,
+			wantRepeat:   5,
+			wantInterval: time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := loadApp(t, `{"defaults": {"port": 7, "repeat": 3, "interval": "1s"}}`)
+			w := provisionIn(t, ctx, tt.w)
+			target := w.targets()[0]
+			if target.Port != tt.wantPort || target.Repeat != tt.wantRepeat || time.Duration(target.Interval) != tt.wantInterval {
+				t.Errorf("target port %d, repeat %d, interval %s; want %d, %d, %s",
+					target.Port, target.Repeat, time.Duration(target.Interval), tt.wantPort, tt.wantRepeat, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestServeHTTPDefaults(t *testing.T) {
+	host := newFakeHost(t)
+	ctx := loadApp(t, fmt.Sprintf(`{"defaults": {"port": %d, "repeat": 2}}`, host.port()))
+	w := provisionIn(t, ctx, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1"})
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	host.expect(t, 2)
+	host.expectNone(t)
+}
@@ -0,0 +1,157 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// resultDependencyDown reports a target not woken because a target it
+// depends on didn't come up.
+const resultDependencyDown wakeResult = "dependency_down"
+
+// errDependencyDown is wrapped by the error of a target whose dependency
+// didn't come up.
+var errDependencyDown = errors.New("dependency not up")
+
+// validateDependencies checks that every target's dependencies are other
+// targets of the handler that can confirm they came up, and that they
+// form no cycle.
+func (w *WakeOnLAN) validateDependencies() error {
+	all := w.allTargets()
+	byLabel := make(map[string]Target, len(all))
+	hasDeps := false
+	for _, t := range all {
+		byLabel[t.label()] = t
+		hasDeps = hasDeps || len(t.DependsOn) > 0
+	}
+	if !hasDeps {
+		return nil
+	}
+	if w.Wait <= 0 && len(w.Escalate) == 0 && w.SendUntilUp == nil && w.BroadcastFallback == nil {
+		return errors.New("depends_on requires wait, escalate, send_until_up or broadcast_fallback")
+	}
+	if w.AfterResponse || w.FromBody || w.WakeOnFailure || w.WaitingPage != nil {
+		return errors.New("depends_on cannot be combined with after_response, from_body, wake_on_failure or waiting_page")
+	}
+	for _, t := range all {
+		for _, name := range t.DependsOn {
+			dep, ok := byLabel[name]
+			switch {
+			case !ok:
+				return fmt.Errorf("target %s: depends_on %q: no such target", t.label(), name)
+			case name == t.label():
+				return fmt.Errorf("target %s: depends_on itself", t.label())
+			case dep.Check == "" && w.WaitHTTP == nil && len(w.ConfirmExec) == 0 && !w.waitsARP() && w.ConfirmListen == nil:
+				return fmt.Errorf("target %s: depends_on %s, which has no check address to confirm it came up", t.label(), name)
+			}
+		}
+	}
+
+	// Depth-first, a target met again while its dependencies are still
+	// being visited closes a cycle
+	const visiting, visited = 1, 2
+	state := make(map[string]int, len(all))
+	var visit func(label string, path []string) error
+	visit = func(label string, path []string) error {
+		switch state[label] {
+		case visiting:
+			cycle := append(path[slices.Index(path, label):], label)
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+		state[label] = visiting
+		for _, name := range byLabel[label].DependsOn {
+			if err := visit(name, append(path, label)); err != nil {
+				return err
+			}
+		}
+		state[label] = visited
+		return nil
+	}
+	for _, t := range all {
+		if err := visit(t.label(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withDependencies returns targets with the targets they depend on added,
+// transitively, and ordered so each comes after its dependencies.
+func (w *WakeOnLAN) withDependencies(targets []Target) []Target {
+	hasDeps := false
+	for _, t := range targets {
+		hasDeps = hasDeps || len(t.DependsOn) > 0
+	}
+	if !hasDeps {
+		return targets
+	}
+	byLabel := make(map[string]Target)
+	for _, t := range w.allTargets() {
+		byLabel[t.label()] = t
+	}
+	ordered := make([]Target, 0, len(targets))
+	seen := make(map[string]bool)
+	var visit func(t Target)
+	visit = func(t Target) {
+		if seen[t.label()] {
+			return
+		}
+		seen[t.label()] = true
+		for _, name := range t.DependsOn {
+			if dep, ok := byLabel[name]; ok {
+				visit(dep)
+			}
+		}
+		ordered = append(ordered, t)
+	}
+	for _, t := range targets {
+		visit(t)
+	}
+	return ordered
+}
+
+// dependencyIndexes returns, for each of targets, the indexes of the
+// targets among them it depends on. It is nil when none depends on
+// another.
+func dependencyIndexes(targets []Target) [][]int {
+	var deps [][]int
+	for i, t := range targets {
+		for _, name := range t.DependsOn {
+			for j, dep := range targets {
+				if j != i && dep.label() == name {
+					if deps == nil {
+						deps = make([][]int, len(targets))
+					}
+					deps[i] = append(deps[i], j)
+				}
+			}
+		}
+	}
+	return deps
+}
+
+// wakeAfterDependencies wakes targets[i] once the wakes of the targets it
+// depends on have finished, each of which closes its done channel, or
+// doesn't wake it if one of them didn't come up.
+func (w *WakeOnLAN) wakeAfterDependencies(ctx context.Context, targets []Target, i int, deps []int, done []chan struct{}, results []wakeResult, logger *zap.Logger) (wakeResult, error) {
+	for _, j := range deps {
+		select {
+		case <-done[j]:
+		case <-ctx.Done():
+			return resultError, ctx.Err()
+		}
+		if !results[j].up() {
+			logger.Debug("dependency did not come up; not waking",
+				zap.String("target", targets[i].label()), zap.String("dependency", targets[j].label()), zap.String("result", string(results[j])))
+			return resultDependencyDown, fmt.Errorf("%w: %s is %s", errDependencyDown, targets[j].label(), results[j])
+		}
+	}
+	return w.wake(ctx, targets[i], logger)
+}
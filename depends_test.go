@@ -0,0 +1,151 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestDependsOnConfig(t *testing.T) {
+	n := 0
+	target := func(name, extra string) string {
+		n++
+		return fmt.Sprintf("\ttarget 00:11:22:33:44:%02x 192.0.2.%d {", n, n) + "\n\t\tname " + name + "\n\t\tcheck 192.0.2.1:22\n" + extra + "\t}\n"
+	}
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "valid", input: "\twait 1m\n" + target("storage", "") + target("app", "\t\tdepends_on storage\n")},
+		{name: "chain", input: "\twait 1m\n" + target("a", "") + target("b", "\t\tdepends_on a\n") + target("c", "\t\tdepends_on a b\n")},
+		{name: "no names", input: "\twait 1m\n" + target("app", "\t\tdepends_on\n"), wantErr: "wrong argument count"},
+		{name: "without wait", input: target("storage", "") + target("app", "\t\tdepends_on storage\n"), wantErr: "requires wait"},
+		{name: "after_response", input: "\twait 1m\n\tafter_response\n" + target("storage", "") + target("app", "\t\tdepends_on storage\n"), wantErr: "cannot be combined"},
+		{name: "unknown", input: "\twait 1m\n" + target("app", "\t\tdepends_on storage\n"), wantErr: "no such target"},
+		{name: "itself", input: "\twait 1m\n" + target("app", "\t\tdepends_on app\n"), wantErr: "depends_on itself"},
+		{
+			name:    "dependency without check",
+			input:   "\twait 1m\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tname storage\n\t}\n" + target("app", "\t\tdepends_on storage\n"),
+			wantErr: "no check address",
+		},
+		{
+			name:    "cycle",
+			input:   "\twait 1m\n" + target("a", "\t\tdepends_on c\n") + target("b", "\t\tdepends_on a\n") + target("c", "\t\tdepends_on b\n"),
+			wantErr: "dependency cycle: a -> c -> b -> a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan {\n" + tt.input + "}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithDependencies(t *testing.T) {
+	w := &WakeOnLAN{Targets: []Target{
+		{Name: "db", MAC: "00:11:22:33:44:01"},
+		{Name: "storage", MAC: "00:11:22:33:44:02"},
+		{Name: "app", MAC: "00:11:22:33:44:03", DependsOn: []string{"db", "storage"}},
+		{Name: "web", MAC: "00:11:22:33:44:04", DependsOn: []string{"app"}},
+		{Name: "other", MAC: "00:11:22:33:44:05"},
+	}}
+	labels := func(targets []Target) string {
+		var s []string
+		for _, t := range targets {
+			s = append(s, t.label())
+		}
+		return strings.Join(s, ",")
+	}
+	tests := []struct {
+		pick []int
+		want string
+	}{
+		{pick: []int{4}, want: "other"},
+		{pick: []int{3}, want: "db,storage,app,web"},
+		{pick: []int{2, 4}, want: "db,storage,app,other"},
+		// A dependency picked after its dependent moves ahead of it
+		{pick: []int{2, 0}, want: "db,storage,app"},
+		{pick: []int{0, 1, 2, 3, 4}, want: "db,storage,app,web,other"},
+	}
+	for _, tt := range tests {
+		var picked []Target
+		for _, i := range tt.pick {
+			picked = append(picked, w.Targets[i])
+		}
+		if got := labels(w.withDependencies(picked)); got != tt.want {
+			t.Errorf("picking %s: got %s, want %s", labels(picked), got, tt.want)
+		}
+	}
+
+	ordered := w.withDependencies(w.Targets[2:4])
+	if got := fmt.Sprint(dependencyIndexes(ordered)); got != "[[] [] [0 1] [2]]" {
+		t.Errorf("dependency indexes %s", got)
+	}
+	if deps := dependencyIndexes(w.Targets[4:]); deps != nil {
+		t.Errorf("dependency indexes %v without dependencies, want nil", deps)
+	}
+}
+
+func TestServeHTTPDependsOn(t *testing.T) {
+	tests := []struct {
+		name string
+		// how long storage takes to come up; negative never does
+		storageUp   time.Duration
+		order       string
+		wantStatus  int
+		wantResults string
+	}{
+		{name: "up", storageUp: 0, wantStatus: http.StatusNoContent, wantResults: "already_up; target=storage,already_up; target=app"},
+		{name: "comes up", storageUp: 200 * time.Millisecond, order: orderParallel, wantStatus: http.StatusNoContent, wantResults: "woken; target=storage,already_up; target=app"},
+		{name: "down", storageUp: -1, wantStatus: http.StatusFailedDependency, wantResults: "wake_timeout; target=storage,dependency_down; target=app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageHost, appHost := newFakeHost(t), newFakeHost(t)
+			storagePort, app := closedPort(t), newTCPHost(t)
+			listenAfter(t, storagePort, tt.storageUp)
+			w := provisionTest(t, &WakeOnLAN{
+				Targets: []Target{
+					{Name: "app", MAC: "00:11:22:33:44:02", IP: "127.0.0.1", Port: appHost.port(), Check: app.addr(), DependsOn: []string{"storage"}},
+					{Name: "storage", MAC: "00:11:22:33:44:01", IP: "127.0.0.1", Port: storageHost.port(), Check: fmt.Sprintf("127.0.0.1:%d", storagePort)},
+				},
+				Wait:         caddy.Duration(time.Second),
+				CheckTimeout: caddy.Duration(100 * time.Millisecond),
+				Order:        tt.order,
+				Required:     true,
+				StatusHeader: "X-Wake-Result",
+			})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Errorf("status %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if got := strings.Join(rec.Header().Values("X-Wake-Result"), ","); got != tt.wantResults {
+				t.Errorf("results %q, want %q", got, tt.wantResults)
+			}
+			if tt.storageUp == 0 {
+				storageHost.expectNone(t)
+			} else {
+				storageHost.expect(t, 1)
+			}
+			// app is up, so is only ever checked and never sent to
+			appHost.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// destKind is the kind of address a UDP packet goes to, which decides the
+// socket it is sent on.
+type destKind int
+
+const (
+	// A single host, sent to on a connected socket.
+	destUnicast destKind = iota
+	// 255.255.255.255 or a local network's broadcast address, sent to on
+	// an unconnected socket with SO_BROADCAST.
+	destBroadcast
+	// A multicast group, sent to on an unconnected socket.
+	destMulticast
+)
+
+// classifyDest returns the kind of destination ip is.
+func classifyDest(ip net.IP) destKind {
+	switch {
+	case ip.IsMulticast():
+		return destMulticast
+	case isBroadcastAddr(ip):
+		return destBroadcast
+	}
+	return destUnicast
+}
+
+// writeMulticast writes payload to the multicast group addr from an
+// unconnected socket, bound to the port pinned for key when ports is set.
+// The system picks the outgoing interface, or addr's zone does for
+// link-local IPv6 groups.
+func writeMulticast(ctx context.Context, ports *sourcePorts, key string, addr *net.UDPAddr, payload []byte, ttl int) error {
+	start := time.Now()
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	listen := func(port int) (*net.UDPConn, error) {
+		return ports.listenUDP(network, &net.UDPAddr{Port: port})
+	}
+	var conn *net.UDPConn
+	var err error
+	if ports != nil {
+		conn, err = ports.bind(key, listen)
+	} else {
+		conn, err = listen(0)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := setTTL(conn, addr.IP, ttl); err != nil {
+		return err
+	}
+	observePhase(ctx, phaseDial, start)
+
+	start = time.Now()
+	n, err := conn.WriteToUDP(payload, addr)
+	observePhase(ctx, phaseWrite, start)
+	if err != nil {
+		return err
+	}
+	return checkWritten(n, len(payload))
+}
@@ -0,0 +1,103 @@
+package caddy_wakeonlan
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClassifyDest(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want destKind
+	}{
+		{ip: "127.0.0.1", want: destUnicast},
+		{ip: "192.0.2.10", want: destUnicast},
+		{ip: "::1", want: destUnicast},
+		{ip: "2001:db8::1", want: destUnicast},
+		{ip: "255.255.255.255", want: destBroadcast},
+		{ip: "239.255.0.9", want: destMulticast},
+		{ip: "224.0.0.1", want: destMulticast},
+		{ip: "ff02::1", want: destMulticast},
+		{ip: "::ffff:239.255.0.9", want: destMulticast},
+	}
+	if ip := localBroadcast(t); ip != nil {
+		tests = append(tests, struct {
+			ip   string
+			want destKind
+		}{ip: ip.String(), want: destBroadcast})
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := classifyDest(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("classifyDest(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+// listenMulticast joins group on the system's default multicast interface,
+// skipping the test where that isn't possible. Packets sent to the group
+// from this host are looped back to it.
+func listenMulticast(t *testing.T, group net.IP) *fakeHost {
+	t.Helper()
+	conn, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: group})
+	if err != nil {
+		t.Skipf("can't join %s: %v", group, err)
+	}
+	return newFakeHostConn(t, conn)
+}
+
+func TestWriteUDPFromDest(t *testing.T) {
+	group := net.IPv4(239, 255, 0, 9)
+	tests := []struct {
+		name string
+		// the receiving host, and the address it is sent to
+		listen func(t *testing.T) (*fakeHost, net.IP)
+	}{
+		{name: "unicast", listen: func(t *testing.T) (*fakeHost, net.IP) {
+			return newFakeHost(t), net.IPv4(127, 0, 0, 1)
+		}},
+		// Broadcasts are looped back to sockets on the wildcard address
+		{name: "broadcast", listen: func(t *testing.T) (*fakeHost, net.IP) {
+			return newFakeHostOn(t, net.IPv4zero), net.IPv4bcast
+		}},
+		{name: "multicast", listen: func(t *testing.T) (*fakeHost, net.IP) {
+			return listenMulticast(t, group), group
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, ip := tt.listen(t)
+			err := writeUDPFrom(t.Context(), nil, tt.name, &net.UDPAddr{IP: ip, Port: host.port()}, []byte("wake"), 0)
+			if err != nil && tt.name == "multicast" && strings.Contains(err.Error(), "unreachable") {
+				t.Skipf("no route for multicast: %v", err)
+			}
+			if err != nil {
+				t.Fatalf("writing to %s: %v", ip, err)
+			}
+			if got := host.expect(t, 1)[0]; string(got) != "wake" {
+				t.Errorf("got %q, want %q", got, "wake")
+			}
+		})
+	}
+}
+
+func TestServeHTTPMulticastTarget(t *testing.T) {
+	group := net.IPv4(239, 255, 0, 9)
+	host := listenMulticast(t, group)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: group.String(), Port: host.port(), StatusHeader: "X-Wake-Result"})
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Get("X-Wake-Result"); !strings.HasPrefix(got, string(resultSent)) {
+		if strings.HasPrefix(got, string(resultSendFailed)) {
+			t.Skipf("can't send to %s here: %s", group, got)
+		}
+		t.Errorf("result %q, want %s", got, resultSent)
+	}
+	if got := host.expect(t, 1)[0]; len(got) != magicPacketSize() {
+		t.Errorf("got %d bytes, want a %d-byte magic packet", len(got), magicPacketSize())
+	}
+}
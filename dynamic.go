@@ -0,0 +1,50 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// requestChecks are the safety checks a dynamic handler runs on each
+// target taken from a request, as the config has none to run them on.
+var requestChecks = []string{checkMACFamily, checkMACGroup, checkLoopback}
+
+// validateDynamic checks that a dynamic handler takes its targets from
+// requests, and only from them.
+func (w *WakeOnLAN) validateDynamic() error {
+	if !w.Dynamic {
+		return nil
+	}
+	switch {
+	case !w.FromBody && w.FromQuery == nil && w.TargetVar == "":
+		return errors.New("dynamic requires from_body, from_query or target_var")
+	case w.MAC != "" || w.IP != "" || w.SRV != "" || w.MDNS != "" || len(w.Targets) > 0 || len(w.HostMap) > 0 || len(w.SNIMap) > 0 || len(w.Inventory) > 0:
+		return errors.New("dynamic handlers take every target from the request; remove the positional target, targets, host_map, sni_map and inventory")
+	}
+	return nil
+}
+
+// checkRequestTarget runs the safety checks on t, taken from a request to
+// a dynamic handler: it fails for the first issue of a check at level
+// error, and logs those at level warn.
+func (w *WakeOnLAN) checkRequestTarget(t Target) error {
+	for _, check := range requestChecks {
+		level := w.strictness(check)
+		if level == strictOff {
+			continue
+		}
+		issue, ok := w.targetIssue(check, t)
+		if !ok {
+			continue
+		}
+		if level == strictError {
+			return errors.New(issue.problem)
+		}
+		if w.logThrottle.allow(t.label(), check, zapcore.WarnLevel) {
+			w.logger.Warn(issue.warning, append(issue.fields, zap.String("check", check))...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestDynamicConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "from_query", input: "wake_on_lan {\n\tdynamic\n\tfrom_query\n}"},
+		{name: "from_body", input: "wake_on_lan {\n\tdynamic\n\tfrom_body\n}"},
+		{name: "target_var", input: "wake_on_lan {\n\tdynamic\n\ttarget_var wol_target\n}"},
+		{name: "strictness error", input: "wake_on_lan {\n\tdynamic\n\tfrom_query\n\tstrictness error\n}"},
+		{name: "no request targets", input: "wake_on_lan {\n\tdynamic\n}", wantErr: true},
+		{name: "argument", input: "wake_on_lan {\n\tdynamic yes\n\tfrom_query\n}", wantErr: true},
+		{name: "positional target", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tdynamic\n\ttarget_var wol_target\n}", wantErr: true},
+		{name: "targets", input: "wake_on_lan {\n\tdynamic\n\tfrom_query\n\ttarget " + testMAC + " 192.0.2.1\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.Dynamic {
+				t.Error("dynamic not set")
+			}
+		})
+	}
+}
+
+func TestServeHTTPDynamic(t *testing.T) {
+	tests := []struct {
+		name         string
+		strictness   string
+		strictChecks map[string]string
+		mac          string
+		wantStatus   int
+		wantWarned   bool
+	}{
+		// The fake host is on loopback, which the loopback check flags
+		{name: "warn", mac: testMAC, wantStatus: http.StatusNoContent, wantWarned: true},
+		{name: "error", strictness: strictError, mac: testMAC, wantStatus: http.StatusBadRequest},
+		{name: "check off", strictness: strictError, strictChecks: map[string]string{checkLoopback: strictOff}, mac: testMAC, wantStatus: http.StatusNoContent},
+		{name: "mac_group error", strictChecks: map[string]string{checkLoopback: strictOff, checkMACGroup: strictError}, mac: "01:00:5e:00:00:01", wantStatus: http.StatusBadRequest},
+		{name: "off", strictness: strictOff, mac: "01:00:5e:00:00:01", wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{Dynamic: true, FromQuery: &QueryParams{}, Strictness: tt.strictness, StrictChecks: tt.strictChecks})
+			logs := observeLogs(w)
+			url := fmt.Sprintf("http://example.com/?mac=%s&ip=127.0.0.1&port=%d", tt.mac, host.port())
+			rec, _, err := serveTest(w, newTestRequest("GET", url, nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if tt.wantStatus == http.StatusNoContent {
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+			if warned := logs.FilterMessage("IP is on loopback; packets won't leave this host").Len() > 0; warned != tt.wantWarned {
+				t.Errorf("warned %v, want %v", warned, tt.wantWarned)
+			}
+		})
+	}
+}
+
+func TestServeHTTPDynamicBody(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{Dynamic: true, FromBody: true, StrictChecks: map[string]string{checkLoopback: strictOff, checkMACGroup: strictError}})
+	body := fmt.Sprintf(`[{"mac":%[1]q,"ip":"127.0.0.1","port":%[3]d},{"mac":%[2]q,"ip":"127.0.0.1","port":%[3]d}]`, testMAC, "ff:ff:ff:ff:ff:ff", host.port())
+	r := newTestRequest("POST", "http://example.com/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec, _, err := serveTest(w, r)
+	if got := statusOf(rec, err); got != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want %d (%v)", got, http.StatusMultiStatus, err)
+	}
+	var results []bulkResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	if len(results) != 2 || !results[0].Sent || results[1].Sent || !strings.Contains(results[1].Error, "broadcast address") {
+		t.Errorf("results %+v, want the first sent and the second refused as the broadcast address", results)
+	}
+	host.expect(t, 1)
+	host.expectNone(t)
+}
+
+func TestServeHTTPDynamicTargetVarUnset(t *testing.T) {
+	w := provisionTest(t, &WakeOnLAN{Dynamic: true, TargetVar: "wol_target"})
+	rec := httptest.NewRecorder()
+	next := new(nextHandler)
+	handler := varSetter{name: "wol_target", next: caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+		return w.ServeHTTP(rw, r, next)
+	})}
+	err := handler.ServeHTTP(rec, newTestRequest("GET", "http://example.com/", nil))
+	if got := statusOf(rec, err); got != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d (%v)", got, http.StatusBadRequest, err)
+	}
+}
@@ -0,0 +1,212 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// defaultBootEstimate is the boot time assumed for a target none of
+// whose wakes was measured yet.
+const defaultBootEstimate = 30 * time.Second
+
+// bootEstimateWeight is the weight of the latest measured boot time in a
+// target's estimate.
+const bootEstimateWeight = 0.3
+
+// errTooEarly is returned for a request answered with a 425 while its
+// targets boot.
+var errTooEarly = errors.New("target booting; retry later")
+
+// EarlyResponse answers requests with a 425 Too Early while the targets
+// boot instead of holding them for the wait: each request sends the
+// packets, unless a wake is already under way, and until every target is
+// up gets a Retry-After of the time its boot is estimated to still take.
+type EarlyResponse struct {
+	// Boot time assumed for a target until one of its wakes has been
+	// measured. Default: 30s.
+	Estimate caddy.Duration `json:"estimate,omitempty"`
+}
+
+// validateEarlyResponse checks early_response and what it relies on.
+func (w *WakeOnLAN) validateEarlyResponse() error {
+	e := w.EarlyResponse
+	if e == nil {
+		return nil
+	}
+	switch {
+	case e.Estimate < 0:
+		return fmt.Errorf("invalid early_response estimate %s", time.Duration(e.Estimate))
+	case w.Wait <= 0:
+		return errors.New("early_response requires wait, how long a wake is watched for the target to come up")
+	case w.WaitingPage != nil || len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil || w.ConfirmListen != nil:
+		return errors.New("early_response cannot be combined with waiting_page, escalate, send_until_up, broadcast_fallback or confirm_listen")
+	case w.AfterResponse || w.FromBody || w.FromQuery != nil || w.WakeOnFailure || w.OnTimeout != "" || w.ResponseDelay != nil:
+		return errors.New("early_response cannot be combined with after_response, from_body, from_query, wake_on_failure, on_timeout or response_delay")
+	}
+	if w.WaitHTTP == nil && len(w.ConfirmExec) == 0 {
+		for _, t := range w.allTargets() {
+			if t.Check == "" {
+				return errors.New("early_response requires a check address, wait_http or confirm_exec")
+			}
+		}
+	}
+	return nil
+}
+
+// bootEstimates tracks the targets being woken under early_response and
+// how long each took to boot before.
+type bootEstimates struct {
+	initial time.Duration
+
+	mu      sync.Mutex
+	booting map[string]time.Time
+	learned map[string]time.Duration
+}
+
+func newBootEstimates(initial time.Duration) *bootEstimates {
+	if initial == 0 {
+		initial = defaultBootEstimate
+	}
+	return &bootEstimates{
+		initial: initial,
+		booting: make(map[string]time.Time),
+		learned: make(map[string]time.Duration),
+	}
+}
+
+// start records that the target with key started booting at now,
+// reporting false if it already was.
+func (e *bootEstimates) start(key string, now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.booting[key]; ok {
+		return false
+	}
+	e.booting[key] = now
+	return true
+}
+
+// done ends the boot of the target with key, folding the time it took
+// into its estimate if it came up. It returns the new estimate, 0 if
+// there is none.
+func (e *bootEstimates) done(key string, up bool, now time.Time) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	since, ok := e.booting[key]
+	if !ok {
+		return 0
+	}
+	delete(e.booting, key)
+	if !up {
+		return 0
+	}
+	took := now.Sub(since)
+	if est, ok := e.learned[key]; ok {
+		took = time.Duration(bootEstimateWeight*float64(took) + (1-bootEstimateWeight)*float64(est))
+	}
+	e.learned[key] = took
+	return took
+}
+
+// remaining returns how long the target with key is estimated to still
+// take to boot, at least a second.
+func (e *bootEstimates) remaining(key string, now time.Time) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	est, ok := e.learned[key]
+	if !ok {
+		est = e.initial
+	}
+	if since, ok := e.booting[key]; ok {
+		est -= now.Sub(since)
+	}
+	return max(est, time.Second)
+}
+
+// serveEarly wakes the targets without waiting for them and calls the
+// next handler if all of them were already up; otherwise it answers with
+// a 425 and the Retry-After of the slowest, and watches the targets it
+// woke in the background to learn how long they take.
+func (w *WakeOnLAN) serveEarly(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler, targets []Target, logger *zap.Logger) error {
+	nowait := *w
+	nowait.Wait = 0
+	results, failure, err := nowait.wakeTargets(rw, r, targets, logger)
+	if w.failsRequest(err) {
+		return w.failWake(rw, r, failure, err)
+	}
+	if allUp(results) {
+		return next.ServeHTTP(rw, r)
+	}
+
+	now := time.Now()
+	var retry time.Duration
+	var labels []string
+	for i, t := range targets {
+		if results[i] == resultAlreadyUp {
+			continue
+		}
+		if (results[i] == resultSent || results[i] == resultAckReceived || results[i] == resultTXConfirmed) && w.early.start(t.key(), now) {
+			go w.watchBoot(t, logger)
+		}
+		retry = max(retry, w.early.remaining(t.key(), now))
+		labels = append(labels, t.label())
+	}
+	seconds := strconv.Itoa(int((retry + time.Second - 1) / time.Second))
+	logger.Debug("targets booting; answering too early", zap.Strings("targets", labels), zap.String("retry_after", seconds))
+
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Retry-After", seconds)
+	if w.JSONErrors {
+		return w.fail(rw, http.StatusTooEarly, "too_early", errTooEarly)
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusTooEarly)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = fmt.Fprintf(rw, "Waking up %s; retry in %s seconds.\n", strings.Join(labels, ", "), seconds)
+	return err
+}
+
+// watchBoot waits up to the wait for t to come up, recording how long it
+// took in its boot estimate.
+func (w *WakeOnLAN) watchBoot(t Target, logger *zap.Logger) {
+	ctx := context.Background()
+	if w.ctx.Context != nil {
+		ctx = w.ctx
+	}
+	up := w.waitUp(ctx, t, time.Duration(w.CheckTimeout), nil)
+	if est := w.early.done(t.key(), up, time.Now()); up {
+		logger.Debug("target came up", zap.String("target", t.label()), zap.Duration("boot_estimate", est))
+	} else {
+		logger.Debug("target still down after the wait", zap.String("target", t.label()), zap.Duration("wait", time.Duration(w.Wait)))
+	}
+}
+
+// parseEarlyResponse parses the early_response subdirective and its
+// optional boot estimate.
+func parseEarlyResponse(d *caddyfile.Dispenser) (*EarlyResponse, error) {
+	e := new(EarlyResponse)
+	if d.NextArg() {
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return nil, d.Errf("invalid early_response estimate %q: %v", d.Val(), err)
+		}
+		e.Estimate = caddy.Duration(dur)
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,175 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestEarlyResponseConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "check 192.0.2.1:22\n\twait 1m\n\tearly_response"},
+		{input: "check 192.0.2.1:22\n\twait 1m\n\tearly_response 45s", want: 45 * time.Second},
+		{input: "wait 1m\n\twait_http http://192.0.2.1/\n\tearly_response"},
+		{input: "check 192.0.2.1:22\n\twait 1m\n\tearly_response -1s", wantErr: true},
+		{input: "check 192.0.2.1:22\n\twait 1m\n\tearly_response soon", wantErr: true},
+		{input: "check 192.0.2.1:22\n\twait 1m\n\tearly_response 1s 2s", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tearly_response", wantErr: true},
+		{input: "wait 1m\n\tearly_response", wantErr: true},
+		{input: "check 192.0.2.1:22\n\twait 1m\n\ton_timeout next\n\tearly_response", wantErr: true},
+		{input: "check 192.0.2.1:22\n\twait 1m\n\tafter_response\n\tearly_response", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && time.Duration(w.EarlyResponse.Estimate) != tt.want {
+				t.Errorf("estimate %s, want %s", time.Duration(w.EarlyResponse.Estimate), tt.want)
+			}
+		})
+	}
+}
+
+func TestBootEstimates(t *testing.T) {
+	e := newBootEstimates(0)
+	now := time.Now()
+	if got := e.remaining("nas", now); got != defaultBootEstimate {
+		t.Errorf("unmeasured estimate %s, want %s", got, defaultBootEstimate)
+	}
+
+	if !e.start("nas", now) {
+		t.Fatal("first start reported as already booting")
+	}
+	if e.start("nas", now.Add(time.Second)) {
+		t.Error("second start not reported as already booting")
+	}
+	if got := e.remaining("nas", now.Add(10*time.Second)); got != 20*time.Second {
+		t.Errorf("remaining after 10s %s, want 20s", got)
+	}
+	// Past the estimate, still a second
+	if got := e.remaining("nas", now.Add(time.Minute)); got != time.Second {
+		t.Errorf("remaining past the estimate %s, want 1s", got)
+	}
+
+	if got := e.done("nas", true, now.Add(10*time.Second)); got != 10*time.Second {
+		t.Errorf("first measured estimate %s, want 10s", got)
+	}
+	if got := e.remaining("nas", now); got != 10*time.Second {
+		t.Errorf("estimate once measured %s, want 10s", got)
+	}
+
+	// Later boots move the estimate by their weight
+	e.start("nas", now)
+	if got := e.done("nas", true, now.Add(20*time.Second)); got != 13*time.Second {
+		t.Errorf("weighted estimate %s, want 13s", got)
+	}
+	// A boot that didn't come up teaches nothing
+	e.start("nas", now)
+	if got := e.done("nas", false, now.Add(time.Hour)); got != 0 {
+		t.Errorf("estimate %s from a failed boot, want none", got)
+	}
+	if got := e.remaining("nas", now); got != 13*time.Second {
+		t.Errorf("estimate after a failed boot %s, want 13s", got)
+	}
+	if got := e.done("other", true, now); got != 0 {
+		t.Errorf("estimate %s for a target never started, want none", got)
+	}
+}
+
+func TestServeHTTPEarlyResponse(t *testing.T) {
+	host := newFakeHost(t)
+	checkPort := closedPort(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:           testMAC,
+		IP:            "127.0.0.1",
+		Port:          host.port(),
+		Check:         fmt.Sprintf("127.0.0.1:%d", checkPort),
+		Wait:          caddy.Duration(5 * time.Second),
+		CheckTimeout:  caddy.Duration(100 * time.Millisecond),
+		EarlyResponse: &EarlyResponse{Estimate: caddy.Duration(10 * time.Second)},
+	})
+
+	// Down: a 425 while booting, for every request
+	for i, want := range []string{"10", "10"} {
+		rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		if got := statusOf(rec, err); got != http.StatusTooEarly || called {
+			t.Fatalf("request %d: status %d, next called %v; want %d and not called", i+1, got, called, http.StatusTooEarly)
+		}
+		if got := rec.Header().Get("Retry-After"); got != want {
+			t.Errorf("request %d: Retry-After %q, want %q", i+1, got, want)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("request %d: Cache-Control %q, want no-store", i+1, got)
+		}
+		host.expect(t, 1)
+	}
+
+	// The boot is measured once the host is up, and later requests pass
+	const bootTime = 500 * time.Millisecond
+	time.Sleep(bootTime)
+	listenAfter(t, checkPort, 0)
+	key := w.targets()[0].key()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w.early.mu.Lock()
+		est, ok := w.early.learned[key]
+		w.early.mu.Unlock()
+		if ok {
+			if est < bootTime || est > 2*time.Second {
+				t.Errorf("learned a boot time of %s, want about %s", est, bootTime)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("boot time not learned")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if got := statusOf(rec, err); got != http.StatusNoContent || !called {
+		t.Errorf("once up: status %d, next called %v; want %d and called", got, called, http.StatusNoContent)
+	}
+	host.expectNone(t)
+}
+
+func TestServeHTTPEarlyResponseJSON(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:           testMAC,
+		IP:            "127.0.0.1",
+		Port:          host.port(),
+		Check:         fmt.Sprintf("127.0.0.1:%d", closedPort(t)),
+		Wait:          caddy.Duration(time.Second),
+		CheckTimeout:  caddy.Duration(100 * time.Millisecond),
+		JSONErrors:    true,
+		EarlyResponse: &EarlyResponse{},
+	})
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if got := statusOf(rec, err); got != http.StatusTooEarly {
+		t.Fatalf("status %d, want %d", got, http.StatusTooEarly)
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "too_early" {
+		t.Errorf("body %q (%v), want error too_early", rec.Body, err)
+	}
+	if got := rec.Header().Get("Retry-After"); got != strconv.Itoa(int(defaultBootEstimate/time.Second)) {
+		t.Errorf("Retry-After %q, want the default estimate", got)
+	}
+	host.expect(t, 1)
+}
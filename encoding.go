@@ -0,0 +1,140 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Built-in encodings, and the prefix of those registered by plugins.
+const (
+	encodingStandard = "standard"
+	encodingShort    = "short"
+	encodingVendor   = "vendor:"
+)
+
+// Encoder builds the packet that wakes hw, for NICs expecting something
+// other than the standard magic packet. Plugins register one under a name
+// with RegisterEncoder, typically from an init function, and configs
+// select it as vendor:<name> in encoding. password is the target's
+// SecureOn password, nil if it has none; an encoder that can't carry one
+// returns an error. Encode must not keep or modify hw or password.
+type Encoder interface {
+	Encode(hw, password net.HardwareAddr) ([]byte, error)
+}
+
+var encoders = struct {
+	sync.RWMutex
+	m map[string]Encoder
+}{m: make(map[string]Encoder)}
+
+func init() {
+	encoders.m[encodingStandard] = standardEncoder{}
+	encoders.m[encodingShort] = shortEncoder{}
+}
+
+// RegisterEncoder makes e available as the encoding vendor:<name>. It
+// panics if the name is empty, contains a colon or is already registered,
+// like RegisterSender.
+func RegisterEncoder(name string, e Encoder) {
+	if name == "" || e == nil {
+		panic("wake_on_lan: encoder name and value required")
+	}
+	if strings.Contains(name, ":") {
+		panic(fmt.Sprintf("wake_on_lan: encoder name %q contains a colon", name))
+	}
+	encoders.Lock()
+	defer encoders.Unlock()
+	if _, ok := encoders.m[encodingVendor+name]; ok {
+		panic(fmt.Sprintf("wake_on_lan: encoder %q already registered", name))
+	}
+	encoders.m[encodingVendor+name] = e
+}
+
+// lookupEncoder returns the encoder of the encoding name, the standard one
+// if name is empty.
+func lookupEncoder(name string) (Encoder, error) {
+	if name == "" {
+		name = encodingStandard
+	}
+	if name == encodingVendor || (strings.Contains(name, ":") && !strings.HasPrefix(name, encodingVendor)) {
+		return nil, fmt.Errorf("invalid encoding %q (want standard, short or vendor:<name>)", name)
+	}
+	encoders.RLock()
+	defer encoders.RUnlock()
+	e, ok := encoders.m[name]
+	if !ok {
+		if strings.HasPrefix(name, encodingVendor) {
+			return nil, fmt.Errorf("unknown encoding %q: no encoder registered as %q", name, strings.TrimPrefix(name, encodingVendor))
+		}
+		return nil, fmt.Errorf("invalid encoding %q (want standard, short or vendor:<name>)", name)
+	}
+	return e, nil
+}
+
+// validateEncoding checks t's encoding exists, isn't combined with a
+// packet template and accepts t's SecureOn password, by encoding a packet
+// for a placeholder MAC.
+func (t Target) validateEncoding() error {
+	if t.Encoding == "" {
+		return nil
+	}
+	if t.PacketTemplate != "" {
+		return errors.New("encoding cannot be combined with packet_template")
+	}
+	_, err := encodePacket(t.Encoding, make(net.HardwareAddr, 6), t.SecureOn)
+	return err
+}
+
+// encodePacket builds the packet for hw with the encoding name, followed,
+// as the encoder sees fit, by the SecureOn password.
+func encodePacket(name string, hw net.HardwareAddr, secureOn string) ([]byte, error) {
+	e, err := lookupEncoder(name)
+	if err != nil {
+		return nil, err
+	}
+	var password net.HardwareAddr
+	if secureOn != "" {
+		if password, err = parseSecureOn(secureOn); err != nil {
+			return nil, fmt.Errorf("invalid secureon password: %w", err)
+		}
+	}
+	packet, err := e.Encode(hw, password)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s: %w", name, err)
+	}
+	return packet, nil
+}
+
+// standardEncoder builds the standard magic packet, 6 x 0xFF followed by
+// the MAC repeated 16 times, then the password if set.
+type standardEncoder struct{}
+
+func (standardEncoder) Encode(hw, password net.HardwareAddr) ([]byte, error) {
+	return append(buildMagicPacket(hw), password...), nil
+}
+
+// shortEncoder builds the short packet some embedded NICs expect: 6 x 0xFF,
+// the MAC repeated 4 times, then a checksum byte, the low byte of the sum
+// of the bytes before it.
+type shortEncoder struct{}
+
+func (shortEncoder) Encode(hw, password net.HardwareAddr) ([]byte, error) {
+	if password != nil {
+		return nil, errors.New("no room for a secureon password")
+	}
+	packet := make([]byte, 0, 6+4*6+1)
+	for i := 0; i < 6; i++ {
+		packet = append(packet, 0xFF)
+	}
+	for i := 0; i < 4; i++ {
+		packet = append(packet, hw...)
+	}
+	var sum byte
+	for _, b := range packet {
+		sum += b
+	}
+	return append(packet, sum), nil
+}
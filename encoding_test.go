@@ -0,0 +1,194 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// headerEncoder is an example of a vendor encoding: a fixed header, then
+// the MAC once.
+type headerEncoder struct {
+	header []byte
+}
+
+func (e headerEncoder) Encode(hw, password net.HardwareAddr) ([]byte, error) {
+	if password != nil {
+		return nil, errors.New("no room for a secureon password")
+	}
+	return append(bytes.Clone(e.header), hw...), nil
+}
+
+// registerTestEncoder registers e under a name unique to the test, as
+// encoders can't be unregistered, and returns its encoding.
+func registerTestEncoder(t *testing.T, e Encoder) string {
+	t.Helper()
+	name := "test-" + strings.NewReplacer("/", "-", " ", "-").Replace(t.Name())
+	RegisterEncoder(name, e)
+	return encodingVendor + name
+}
+
+func TestRegisterEncoder(t *testing.T) {
+	registerTestEncoder(t, headerEncoder{})
+	tests := []struct {
+		name    string
+		encoder Encoder
+	}{
+		{name: "", encoder: headerEncoder{}},
+		{name: "nil-encoder", encoder: nil},
+		{name: "with:colon", encoder: headerEncoder{}},
+		{name: "test-" + t.Name(), encoder: headerEncoder{}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.name), func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterEncoder(%q) did not panic", tt.name)
+				}
+			}()
+			RegisterEncoder(tt.name, tt.encoder)
+		})
+	}
+	if e, err := lookupEncoder(encodingStandard); err != nil || e != (standardEncoder{}) {
+		t.Errorf("standard encoder = %v, %v; want the built-in one", e, err)
+	}
+}
+
+func TestEncodePacket(t *testing.T) {
+	vendor := registerTestEncoder(t, headerEncoder{header: []byte("WAKE")})
+	hw, _ := parseMAC(testMAC)
+	password := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	ffs := bytes.Repeat([]byte{0xFF}, 6)
+	tests := []struct {
+		name     string
+		encoding string
+		secureOn string
+		want     []byte
+		wantErr  bool
+	}{
+		{name: "default", want: append(ffs, bytes.Repeat(hw, 16)...)},
+		{name: "standard", encoding: encodingStandard, want: append(ffs, bytes.Repeat(hw, 16)...)},
+		{
+			name:     "standard with secureon",
+			encoding: encodingStandard,
+			secureOn: "01:02:03:04:05:06",
+			want:     append(append(ffs, bytes.Repeat(hw, 16)...), password...),
+		},
+		// 6 x 0xFF, 4 x the MAC, then the low byte of the sum:
+		// 6*0xFF + 4*(0x11+0x22+0x33+0x44+0x55) = 2550 = 0x9F6
+		{name: "short", encoding: encodingShort, want: append(append(ffs, bytes.Repeat(hw, 4)...), 0xF6)},
+		{name: "short with secureon", encoding: encodingShort, secureOn: "01:02:03:04:05:06", wantErr: true},
+		{name: "vendor", encoding: vendor, want: append([]byte("WAKE"), hw...)},
+		{name: "vendor with secureon", encoding: vendor, secureOn: "01:02:03:04:05:06", wantErr: true},
+		{name: "invalid secureon", encoding: encodingStandard, secureOn: "nope", wantErr: true},
+		{name: "unregistered vendor", encoding: "vendor:missing", wantErr: true},
+		{name: "vendor without a name", encoding: encodingVendor, wantErr: true},
+		{name: "unknown", encoding: "long", wantErr: true},
+		{name: "other prefix", encoding: "plugin:standard", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodePacket(tt.encoding, hw, tt.secureOn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("packet\n%x\nwant\n%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodingConfig(t *testing.T) {
+	vendor := registerTestEncoder(t, headerEncoder{header: []byte("WAKE")})
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "standard", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding standard\n}", want: encodingStandard},
+		{name: "short", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding short\n}", want: encodingShort},
+		{name: "vendor", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding " + vendor + "\n}", want: vendor},
+		{name: "unknown", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding long\n}", wantErr: true},
+		{name: "unregistered", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding vendor:missing\n}", wantErr: true},
+		{name: "no argument", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding\n}", wantErr: true},
+		{name: "two arguments", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding short standard\n}", wantErr: true},
+		{
+			name:    "with packet_template",
+			input:   "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding short\n\tpacket_template \"{sync}{mac*16}\"\n}",
+			wantErr: true,
+		},
+		{
+			name:    "short with secureon",
+			input:   "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tencoding short\n\tsecureon 01:02:03:04:05:06\n}",
+			wantErr: true,
+		},
+		{
+			name:  "target",
+			input: "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tencoding short\n\t}\n}",
+		},
+		{
+			name:    "unknown for a target",
+			input:   "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tencoding long\n\t}\n}",
+			wantErr: true,
+		},
+		{
+			name:    "target with secureon",
+			input:   "wake_on_lan {\n\tencoding short\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tsecureon 01:02:03:04:05:06\n\t}\n}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.Encoding != tt.want {
+				t.Errorf("encoding = %q, want %q", w.Encoding, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPEncoding(t *testing.T) {
+	vendor := registerTestEncoder(t, headerEncoder{header: []byte("WAKE")})
+	hw, _ := parseMAC(testMAC)
+	standard := buildMagicPacket(hw)
+	short, _ := shortEncoder{}.Encode(hw, nil)
+	tests := []struct {
+		name string
+		// the handler's encoding, and the target's
+		encoding, targetEncoding string
+		want                     []byte
+	}{
+		{name: "default", want: standard},
+		{name: "short", encoding: encodingShort, want: short},
+		{name: "vendor", encoding: vendor, want: append([]byte("WAKE"), hw...)},
+		{name: "target", targetEncoding: encodingShort, want: short},
+		{name: "target over the handler", encoding: vendor, targetEncoding: encodingStandard, want: standard},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				Targets:  []Target{{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Encoding: tt.targetEncoding}},
+				Encoding: tt.encoding,
+			})
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			if got := host.expect(t, 1)[0]; !bytes.Equal(got, tt.want) {
+				t.Errorf("packet\n%x\nwant\n%x", got, tt.want)
+			}
+			host.expectNone(t)
+		})
+	}
+}
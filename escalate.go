@@ -0,0 +1,203 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Escalation strategies, from least to most aggressive.
+const (
+	// Send to the target's IP only.
+	strategyUnicast = "unicast"
+	// Send to the directed broadcast address of the target's subnet: the
+	// configured broadcast address, or else the one of the local interface
+	// whose network contains the target's IP.
+	strategyBroadcast = "broadcast"
+	// Send to the broadcast address of every local IPv4 interface and to
+	// 255.255.255.255.
+	strategyAllInterfaces = "all_interfaces"
+)
+
+// EscalationStep is one rung of the escalation ladder: send with Strategy,
+// then wait up to Wait for the check address to come up before moving on.
+type EscalationStep struct {
+	Strategy string         `json:"strategy"`
+	Wait     caddy.Duration `json:"wait"`
+}
+
+// validateEscalation checks the ladder's steps.
+func validateEscalation(steps []EscalationStep) error {
+	for i, step := range steps {
+		switch step.Strategy {
+		case strategyUnicast, strategyBroadcast, strategyAllInterfaces:
+		default:
+			return fmt.Errorf("escalate step %d: unknown strategy %q", i, step.Strategy)
+		}
+		if step.Wait <= 0 {
+			return fmt.Errorf("escalate step %d: wait must be positive", i)
+		}
+	}
+	return nil
+}
+
+// escalatesToBroadcast reports whether any step sends broadcasts, so the
+// shared broadcast socket is needed.
+func (w *WakeOnLAN) escalatesToBroadcast() bool {
+	for _, step := range w.Escalate {
+		if step.Strategy != strategyUnicast {
+			return true
+		}
+	}
+	return false
+}
+
+// escalate walks the ladder for t until its check address comes up. When
+// send is false (a packet went out recently), it only waits for as long as
+// the ladder would have.
+func (w *WakeOnLAN) escalate(ctx context.Context, t Target, send bool, logger *zap.Logger) (wakeResult, error) {
+	checkTimeout := time.Duration(w.CheckTimeout)
+	if !send {
+		var total time.Duration
+		for _, step := range w.Escalate {
+			total += time.Duration(step.Wait)
+		}
+		logger.Debug("packet sent recently; only waiting", zap.Duration("wait", total))
+		if waitTCP(ctx, t.Check, checkTimeout, total) {
+			return resultWoken, nil
+		}
+		return resultWakeTimeout, nil
+	}
+
+	var sent bool
+	var sentAt time.Time
+	var lastErr error
+	for i, step := range w.Escalate {
+		stepLogger := logger.With(zap.Int("step", i+1), zap.String("strategy", step.Strategy))
+		opts, err := w.escalationOptions(ctx, t, step.Strategy)
+		if err == nil {
+			err = sendRepeated(ctx, t, opts, stepLogger)
+		}
+		if err != nil {
+			// Try the next, more aggressive step right away
+			stepLogger.Debug("escalation step failed", zap.Error(err))
+			lastErr = err
+			if ctx.Err() != nil {
+				return resultError, ctx.Err()
+			}
+			continue
+		}
+		if !sent {
+			sent, sentAt = true, time.Now()
+		}
+		stepLogger.Debug("waiting for target", zap.String("check", t.Check), zap.Duration("wait", time.Duration(step.Wait)))
+		if waitTCP(ctx, t.Check, checkTimeout, time.Duration(step.Wait)) {
+			stepLogger.Info("target woken by escalation step")
+			observeWakeDuration(t, sentAt)
+			return resultWoken, nil
+		}
+	}
+	if !sent {
+		return failureResult(lastErr), lastErr
+	}
+	return resultWakeTimeout, nil
+}
+
+// escalationOptions returns the send options for one strategy.
+func (w *WakeOnLAN) escalationOptions(ctx context.Context, t Target, strategy string) (sendOptions, error) {
+	opts := w.sendOptions()
+	switch strategy {
+	case strategyUnicast:
+		if t.IP == "" {
+			return opts, errors.New("unicast requires a target IP")
+		}
+		opts.Broadcasts = nil
+	case strategyBroadcast:
+		opts.SkipUnicast = true
+		if w.Broadcast != "" {
+			break
+		}
+		if t.IP == "" {
+			return opts, errors.New("broadcast requires a broadcast address or a target IP")
+		}
+		addr, err := resolveUDPAddr(ctx, t.IP, portOrDefault(t.Port), opts.ResolveRetries, opts.ResolveBackoff, opts.Prefer)
+		if err != nil {
+			return opts, err
+		}
+		broadcast, err := directedBroadcast(addr.IP)
+		if err != nil {
+			return opts, err
+		}
+		opts.Broadcasts = []string{broadcast}
+	case strategyAllInterfaces:
+		opts.SkipUnicast = true
+		broadcasts, err := interfaceBroadcasts()
+		if err != nil {
+			return opts, err
+		}
+		opts.Broadcasts = append(broadcasts, net.IPv4bcast.String())
+	}
+	return opts, nil
+}
+
+// directedBroadcast returns the broadcast address of the local IPv4
+// network containing ip.
+func directedBroadcast(ip net.IP) (string, error) {
+	nets, err := interfaceNetworks()
+	if err != nil {
+		return "", err
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return broadcastAddr(n).String(), nil
+		}
+	}
+	return "", fmt.Errorf("no local network contains %s", ip)
+}
+
+// interfaceBroadcasts returns the broadcast address of every local IPv4
+// network.
+func interfaceBroadcasts() ([]string, error) {
+	nets, err := interfaceNetworks()
+	if err != nil {
+		return nil, err
+	}
+	broadcasts := make([]string, 0, len(nets))
+	for _, n := range nets {
+		broadcasts = append(broadcasts, broadcastAddr(n).String())
+	}
+	return broadcasts, nil
+}
+
+// interfaceNetworks lists the IPv4 networks of the interfaces that are up
+// and support broadcast.
+func interfaceNetworks() ([]*net.IPNet, error) {
+	locals, err := localNetworks()
+	if err != nil {
+		return nil, err
+	}
+	nets := make([]*net.IPNet, len(locals))
+	for i, n := range locals {
+		nets[i] = n.network
+	}
+	return nets, nil
+}
+
+// broadcastAddr returns the last address of the IPv4 network n.
+func broadcastAddr(n *net.IPNet) net.IP {
+	ip := n.IP.Mask(n.Mask).To4()
+	mask := n.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	b := make(net.IP, net.IPv4len)
+	for i := range b {
+		b[i] = ip[i] | ^mask[i]
+	}
+	return b
+}
@@ -0,0 +1,215 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestEscalateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []EscalationStep
+		wantErr bool
+	}{
+		{
+			name:  "ladder",
+			input: "check 192.0.2.1:22\n\tescalate {\n\t\tunicast 5s\n\t\tbroadcast 10s\n\t\tall_interfaces 20s\n\t}",
+			want: []EscalationStep{
+				{Strategy: strategyUnicast, Wait: caddy.Duration(5 * time.Second)},
+				{Strategy: strategyBroadcast, Wait: caddy.Duration(10 * time.Second)},
+				{Strategy: strategyAllInterfaces, Wait: caddy.Duration(20 * time.Second)},
+			},
+		},
+		{name: "argument", input: "check 192.0.2.1:22\n\tescalate unicast", wantErr: true},
+		{name: "missing wait", input: "check 192.0.2.1:22\n\tescalate {\n\t\tunicast\n\t}", wantErr: true},
+		{name: "unknown strategy", input: "check 192.0.2.1:22\n\tescalate {\n\t\tmulticast 5s\n\t}", wantErr: true},
+		{name: "zero wait", input: "check 192.0.2.1:22\n\tescalate {\n\t\tunicast 0s\n\t}", wantErr: true},
+		{name: "without check", input: "escalate {\n\t\tunicast 5s\n\t}", wantErr: true},
+		{name: "with wait", input: "check 192.0.2.1:22\n\twait 5s\n\tescalate {\n\t\tunicast 5s\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(w.Escalate, tt.want) {
+				t.Errorf("escalate = %v, want %v", w.Escalate, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscalationOptions(t *testing.T) {
+	tests := []struct {
+		name           string
+		broadcast      string
+		ip             string
+		strategy       string
+		wantUnicast    bool
+		wantBroadcasts []string
+		wantErr        bool
+	}{
+		{name: "unicast", broadcast: "192.0.2.255", ip: "192.0.2.1", strategy: strategyUnicast, wantUnicast: true},
+		{name: "unicast without IP", strategy: strategyUnicast, wantErr: true},
+		{name: "broadcast", broadcast: "192.0.2.255", ip: "192.0.2.1", strategy: strategyBroadcast, wantBroadcasts: []string{"192.0.2.255"}},
+		{name: "broadcast without address or IP", strategy: strategyBroadcast, wantErr: true},
+		{name: "broadcast off every local network", ip: "127.0.0.1", strategy: strategyBroadcast, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &WakeOnLAN{Broadcast: tt.broadcast}
+			opts, err := w.escalationOptions(t.Context(), Target{MAC: testMAC, IP: tt.ip}, tt.strategy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if opts.SkipUnicast == tt.wantUnicast {
+				t.Errorf("SkipUnicast = %v, want %v", opts.SkipUnicast, !tt.wantUnicast)
+			}
+			if !slices.Equal(opts.Broadcasts, tt.wantBroadcasts) {
+				t.Errorf("broadcasts = %v, want %v", opts.Broadcasts, tt.wantBroadcasts)
+			}
+		})
+	}
+
+	t.Run("all interfaces", func(t *testing.T) {
+		opts, err := new(WakeOnLAN).escalationOptions(t.Context(), Target{MAC: testMAC}, strategyAllInterfaces)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !opts.SkipUnicast {
+			t.Error("all_interfaces sends unicast")
+		}
+		if len(opts.Broadcasts) == 0 || opts.Broadcasts[len(opts.Broadcasts)-1] != "255.255.255.255" {
+			t.Errorf("broadcasts = %v, want them to end with 255.255.255.255", opts.Broadcasts)
+		}
+	})
+}
+
+func TestBroadcastAddr(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		{cidr: "192.168.1.10/24", want: "192.168.1.255"},
+		{cidr: "10.1.2.3/8", want: "10.255.255.255"},
+		{cidr: "172.16.5.4/22", want: "172.16.7.255"},
+		{cidr: "192.0.2.1/32", want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			ip, n, err := net.ParseCIDR(tt.cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.IP = ip
+			if got := broadcastAddr(n).String(); got != tt.want {
+				t.Errorf("broadcastAddr = %s, want %s", got, tt.want)
+			}
+			// As the interfaces report it, with a 16-byte mask
+			n.Mask = append(net.IPMask(bytes.Repeat([]byte{0xff}, 12)), n.Mask...)
+			if got := broadcastAddr(n).String(); got != tt.want {
+				t.Errorf("broadcastAddr with a 16-byte mask = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPEscalate(t *testing.T) {
+	// Unicast and broadcast both go to the fake host; all_interfaces goes
+	// to the real interfaces, which the host can't see, so it only ever
+	// times out here
+	tests := []struct {
+		name string
+		// packets after which the check address comes up, 0 for never
+		upAfter    int
+		wantResult wakeResult
+		wantStep   int
+	}{
+		{name: "unicast", upAfter: 1, wantResult: resultWoken, wantStep: 1},
+		{name: "broadcast", upAfter: 2, wantResult: resultWoken, wantStep: 2},
+		{name: "exhausted", wantResult: resultWakeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			checkPort := closedPort(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:       testMAC,
+				IP:        "127.0.0.1",
+				Port:      host.port(),
+				Broadcast: "127.0.0.1",
+				Check:     fmt.Sprintf("127.0.0.1:%d", checkPort),
+				Escalate: []EscalationStep{
+					{Strategy: strategyUnicast, Wait: caddy.Duration(time.Second)},
+					{Strategy: strategyBroadcast, Wait: caddy.Duration(time.Second)},
+					{Strategy: strategyAllInterfaces, Wait: caddy.Duration(time.Second)},
+				},
+				StatusHeader: "X-Wake-Result",
+			})
+			logs := observeLogs(w)
+
+			packets := make(chan int, 1)
+			go func() {
+				n := 0
+				for range host.packets {
+					n++
+					if n == tt.upAfter {
+						l, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", checkPort))
+						if err != nil {
+							t.Error(err)
+							continue
+						}
+						t.Cleanup(func() { l.Close() })
+					}
+					select {
+					case <-packets:
+					default:
+					}
+					packets <- n
+				}
+			}()
+
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			want := tt.upAfter
+			if want == 0 {
+				want = 2
+			}
+			if got := <-packets; got != want {
+				t.Errorf("got %d packets, want %d", got, want)
+			}
+
+			woken := logs.FilterMessage("target woken by escalation step").All()
+			switch {
+			case tt.wantStep == 0 && len(woken) > 0:
+				t.Errorf("logged a step waking the target: %v", woken[0].ContextMap())
+			case tt.wantStep > 0 && len(woken) != 1:
+				t.Errorf("logged %d steps waking the target, want 1", len(woken))
+			case tt.wantStep > 0:
+				fields := woken[0].ContextMap()
+				if fields["step"] != int64(tt.wantStep) || fields["strategy"] != w.Escalate[tt.wantStep-1].Strategy {
+					t.Errorf("woken by %v (%v), want step %d", fields["step"], fields["strategy"], tt.wantStep)
+				}
+			}
+		})
+	}
+}
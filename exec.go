@@ -0,0 +1,105 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultExecTimeout bounds an on_wake_exec command.
+const defaultExecTimeout = 30 * time.Second
+
+// maxExecOutput is how much of a command's output is logged.
+const maxExecOutput = 4 << 10
+
+// provisionExec checks that the app allows on_wake_exec and confirm_exec
+// and resolves their commands, so one that doesn't exist fails the config.
+func (w *WakeOnLAN) provisionExec() error {
+	for _, c := range []struct {
+		name    string
+		command []string
+		path    *string
+	}{{"on_wake_exec", w.OnWakeExec, &w.execPath}, {"confirm_exec", w.ConfirmExec, &w.confirmExecPath}} {
+		if len(c.command) == 0 {
+			continue
+		}
+		if w.app == nil || !w.app.AllowExec {
+			return fmt.Errorf("wake_on_lan: %s requires allow_exec in the wake_on_lan global option", c.name)
+		}
+		path, err := exec.LookPath(c.command[0])
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: %s: %w", c.name, err)
+		}
+		*c.path = path
+	}
+	return nil
+}
+
+// execEnv returns the environment commands run for t with: Caddy's, and
+// the target in WAKE_* variables.
+func execEnv(t Target) []string {
+	return append(os.Environ(),
+		"WAKE_TARGET="+t.label(),
+		"WAKE_MAC="+strings.ToLower(t.MAC),
+		"WAKE_IP="+t.IP,
+		"WAKE_PORT="+strconv.Itoa(portOrDefault(t.Port)),
+		"WAKE_CHECK="+t.Check,
+	)
+}
+
+// runWakeExec runs the on_wake_exec command for woken target t in the
+// background, with the target in WAKE_* environment variables. Its output
+// is logged; failures never affect the wake.
+func (w *WakeOnLAN) runWakeExec(logger *zap.Logger, t Target, result wakeResult) {
+	if w.execPath == "" {
+		return
+	}
+	timeout := time.Duration(w.OnWakeExecTimeout)
+	if timeout == 0 {
+		timeout = defaultExecTimeout
+	}
+	parent := w.ctx.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	env := append(execEnv(t), "WAKE_RESULT="+string(result))
+	go func() {
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, w.execPath, w.OnWakeExec[1:]...)
+		cmd.Env = env
+		// Don't wait on output pipes held open by the command's children
+		cmd.WaitDelay = time.Second
+		out, err := cmd.CombinedOutput()
+		fields := []zap.Field{
+			zap.String("target", t.label()),
+			zap.String("command", w.OnWakeExec[0]),
+			zap.ByteString("output", truncateOutput(out)),
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			logger.Warn("on_wake_exec command timed out", append(fields, zap.Duration("timeout", timeout))...)
+			return
+		}
+		if err != nil {
+			logger.Warn("on_wake_exec command failed", append(fields, zap.Error(err))...)
+			return
+		}
+		logger.Info("on_wake_exec command ran", fields...)
+	}()
+}
+
+// truncateOutput trims out and cuts it to the logged maximum.
+func truncateOutput(out []byte) []byte {
+	out = bytes.TrimSpace(out)
+	if len(out) <= maxExecOutput {
+		return out
+	}
+	return append(out[:maxExecOutput:maxExecOutput], "..."...)
+}
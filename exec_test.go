@@ -0,0 +1,197 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// requireShell skips the test where there is no sh to run commands with.
+func requireShell(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run commands with")
+	}
+}
+
+// waitForLog waits for a log entry with message, returning it.
+func waitForLog(t *testing.T, logs *observer.ObservedLogs, message string) observer.LoggedEntry {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if entries := logs.FilterMessage(message).All(); len(entries) > 0 {
+			return entries[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %q log entry in %v", message, logs.All())
+	return observer.LoggedEntry{}
+}
+
+func TestOnWakeExecConfig(t *testing.T) {
+	tests := []struct {
+		input       string
+		want        []string
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{input: "on_wake_exec /usr/local/bin/mount-nas --share backup", want: []string{"/usr/local/bin/mount-nas", "--share", "backup"}},
+		{input: "on_wake_exec mount-nas\n\ton_wake_exec_timeout 5s", want: []string{"mount-nas"}, wantTimeout: 5 * time.Second},
+		{input: "on_wake_exec", wantErr: true},
+		{input: "on_wake_exec mount-nas\n\ton_wake_exec_timeout -1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if strings.Join(w.OnWakeExec, " ") != strings.Join(tt.want, " ") || time.Duration(w.OnWakeExecTimeout) != tt.wantTimeout {
+				t.Errorf("on_wake_exec %q, timeout %s; want %q, %s", w.OnWakeExec, time.Duration(w.OnWakeExecTimeout), tt.want, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestProvisionExec(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name    string
+		app     string
+		command []string
+		wantErr string
+	}{
+		{name: "allowed", app: `{"allow_exec": true}`, command: []string{"sh", "-c", "true"}},
+		{name: "not allowed", app: `{}`, command: []string{"sh", "-c", "true"}, wantErr: "requires allow_exec"},
+		{name: "not found", app: `{"allow_exec": true}`, command: []string{"no-such-command-for-wake-on-lan"}, wantErr: "executable file not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := loadApp(t, tt.app)
+			w := &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", OnWakeExec: tt.command}
+			err := w.Provision(ctx)
+			if err == nil {
+				defer w.Cleanup()
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Provision: %v", err)
+				}
+				if want, _ := exec.LookPath("sh"); w.execPath != want {
+					t.Errorf("command resolved to %q, want %q", w.execPath, want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Provision = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), maxExecOutput+10)
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{name: "trimmed", in: []byte("  mounted\n"), want: "mounted"},
+		{name: "empty", in: nil, want: ""},
+		{name: "long", in: long, want: string(long[:maxExecOutput]) + "..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(truncateOutput(tt.in)); got != tt.want {
+				t.Errorf("truncateOutput = %.40q (%d bytes), want %.40q (%d bytes)", got, len(got), tt.want, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestServeHTTPOnWakeExec(t *testing.T) {
+	requireShell(t)
+	tests := []struct {
+		name        string
+		script      string
+		timeout     time.Duration
+		wantMessage string
+		wantOutput  string
+	}{
+		{
+			name:        "ran",
+			script:      `echo "$WAKE_TARGET $WAKE_MAC $WAKE_IP $WAKE_PORT $WAKE_RESULT"`,
+			wantMessage: "on_wake_exec command ran",
+			wantOutput:  "exec-test 00:11:22:33:44:55 127.0.0.1 {port} sent",
+		},
+		{
+			name:        "failed",
+			script:      "echo mount failed; exit 3",
+			wantMessage: "on_wake_exec command failed",
+			wantOutput:  "mount failed",
+		},
+		{
+			name:        "timed out",
+			script:      "sleep 5",
+			timeout:     100 * time.Millisecond,
+			wantMessage: "on_wake_exec command timed out",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			ctx := loadApp(t, `{"allow_exec": true}`)
+			w := provisionIn(t, ctx, &WakeOnLAN{
+				Name:              "exec-test",
+				MAC:               strings.ToUpper(testMAC),
+				IP:                "127.0.0.1",
+				Port:              host.port(),
+				OnWakeExec:        []string{"sh", "-c", tt.script},
+				OnWakeExecTimeout: caddy.Duration(tt.timeout),
+			})
+			logs := observeLogs(w)
+
+			start := time.Now()
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("request took %s, want it not to wait for the command", took)
+			}
+			host.expect(t, 1)
+
+			entry := waitForLog(t, logs, tt.wantMessage)
+			want := strings.ReplaceAll(tt.wantOutput, "{port}", fmt.Sprint(host.port()))
+			if got := entry.ContextMap()["output"]; got != want {
+				t.Errorf("output = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestOnWakeExecSkippedWhenUp(t *testing.T) {
+	requireShell(t)
+	up := newTCPHost(t)
+	ctx := loadApp(t, `{"allow_exec": true}`)
+	w := provisionIn(t, ctx, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Check: up.addr(), OnWakeExec: []string{"sh", "-c", "echo ran"}})
+	logs := observeLogs(w)
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := logs.FilterMessage("on_wake_exec command ran").Len(); n != 0 {
+		t.Errorf("command ran %d times for a target already up", n)
+	}
+}
@@ -0,0 +1,236 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Defaults for broadcast_fallback.
+const (
+	defaultFallbackAfter    = 3
+	defaultFallbackInterval = 5 * time.Second
+)
+
+// BroadcastFallback sends to a target's IP until it is confirmed up, and
+// once that has failed After times, broadcasts to its subnet once instead:
+// a host asleep long enough for the switch to forget its MAC only gets
+// broadcasts.
+type BroadcastFallback struct {
+	// Unicast sends without confirmation before the broadcast. Default: 3.
+	After int `json:"after,omitempty"`
+	// How long each send, the broadcast included, waits for the check
+	// address. Default: 5s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Where the broadcast address comes from: a network (192.168.1.0/24)
+	// to broadcast to, or a mask (/24 or 255.255.255.0) applied to the
+	// target's IP. Default: the network of the local interface containing
+	// the target's IP.
+	Subnet string `json:"subnet,omitempty"`
+}
+
+// validateBroadcastFallback checks broadcast_fallback and the settings it
+// can't be combined with.
+func (w *WakeOnLAN) validateBroadcastFallback() error {
+	f := w.BroadcastFallback
+	if f == nil {
+		return nil
+	}
+	if f.After < 0 || f.Interval < 0 {
+		return errors.New("broadcast_fallback after and interval must not be negative")
+	}
+	if f.Subnet != "" {
+		if _, err := fallbackBroadcast(f.Subnet, netip.IPv4Unspecified()); err != nil {
+			return fmt.Errorf("broadcast_fallback subnet: %w", err)
+		}
+	}
+	switch {
+	case w.Wait > 0 || len(w.Escalate) > 0 || w.SendUntilUp != nil || w.WaitingPage != nil:
+		return errors.New("broadcast_fallback replaces wait, escalate, send_until_up and waiting_page")
+	case w.Broadcast != "" || w.relayed():
+		return errors.New("broadcast_fallback cannot be combined with broadcast or relay")
+	}
+	for _, t := range w.allTargets() {
+		if t.Check == "" {
+			return errors.New("broadcast_fallback requires a check address")
+		}
+	}
+	return nil
+}
+
+// fallbackAfter and fallbackInterval return the settings with their
+// defaults filled in.
+func (f *BroadcastFallback) fallbackAfter() int {
+	if f.After == 0 {
+		return defaultFallbackAfter
+	}
+	return f.After
+}
+
+func (f *BroadcastFallback) fallbackInterval() time.Duration {
+	if f.Interval == 0 {
+		return defaultFallbackInterval
+	}
+	return time.Duration(f.Interval)
+}
+
+// isSubnetNetwork reports whether subnet names a network rather than a
+// mask to apply to the target's IP.
+func isSubnetNetwork(subnet string) bool {
+	return strings.Contains(subnet, "/") && !strings.HasPrefix(subnet, "/")
+}
+
+// fallbackBroadcast derives the broadcast address from subnet for a target
+// at ip, which a network ignores.
+func fallbackBroadcast(subnet string, ip netip.Addr) (string, error) {
+	if isSubnetNetwork(subnet) {
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil || network.IP.To4() == nil {
+			return "", fmt.Errorf("invalid IPv4 network %q", subnet)
+		}
+		return broadcastAddr(network).String(), nil
+	}
+	var mask net.IPMask
+	if strings.HasPrefix(subnet, "/") {
+		if _, n, err := net.ParseCIDR("0.0.0.0" + subnet); err == nil {
+			mask = n.Mask
+		}
+	} else if m := net.ParseIP(subnet).To4(); m != nil {
+		mask = net.IPMask(m)
+	}
+	if ones, bits := mask.Size(); bits == 0 || ones == 0 {
+		return "", fmt.Errorf("invalid mask %q", subnet)
+	}
+	if !ip.Is4() {
+		return "", fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+	return broadcastAddr(&net.IPNet{IP: ip.AsSlice(), Mask: mask}).String(), nil
+}
+
+// broadcastFallback sends unicast packets to t, waiting for its check
+// address after each, and broadcasts once when none was confirmed. When
+// send is false (a packet went out recently), it only waits for as long
+// as that would have taken.
+func (w *WakeOnLAN) broadcastFallback(ctx context.Context, t Target, send bool, logger *zap.Logger) (wakeResult, error) {
+	f := w.BroadcastFallback
+	after, interval := f.fallbackAfter(), f.fallbackInterval()
+	checkTimeout := time.Duration(w.CheckTimeout)
+	if !send {
+		total := time.Duration(after+1) * interval
+		logger.Debug("packet sent recently; only waiting", zap.Duration("wait", total))
+		if waitTCP(ctx, t.Check, checkTimeout, total) {
+			return resultWoken, nil
+		}
+		return resultWakeTimeout, nil
+	}
+
+	opts := w.sendOptions()
+	var sentAt time.Time
+	for i := 0; i < after; i++ {
+		if err := sendRepeated(ctx, t, opts, logger); err != nil {
+			if ctx.Err() != nil {
+				return resultError, ctx.Err()
+			}
+			logger.Debug("unicast send failed; falling back to broadcast", zap.Error(err))
+			break
+		}
+		if sentAt.IsZero() {
+			sentAt = time.Now()
+		}
+		if waitTCP(ctx, t.Check, checkTimeout, interval) {
+			observeWakeDuration(t, sentAt)
+			return resultWoken, nil
+		}
+	}
+
+	broadcast, err := w.fallbackAddress(ctx, t, opts)
+	if err == nil {
+		logger.Info("no confirmation after unicast sends; falling back to broadcast",
+			zap.Int("after", after), zap.String("broadcast", broadcast))
+		opts.SkipUnicast = true
+		opts.Broadcasts = []string{broadcast}
+		err = sendRepeated(ctx, t, opts, logger)
+	}
+	if err != nil {
+		if sentAt.IsZero() {
+			return failureResult(err), err
+		}
+		logger.Warn("broadcast fallback failed", zap.Error(err))
+		return resultWakeTimeout, nil
+	}
+	if sentAt.IsZero() {
+		sentAt = time.Now()
+	}
+	if waitTCP(ctx, t.Check, checkTimeout, interval) {
+		observeWakeDuration(t, sentAt)
+		return resultWoken, nil
+	}
+	return resultWakeTimeout, nil
+}
+
+// fallbackAddress returns the broadcast address for t: that of the
+// configured network, or derived from t's IP.
+func (w *WakeOnLAN) fallbackAddress(ctx context.Context, t Target, opts sendOptions) (string, error) {
+	subnet := w.BroadcastFallback.Subnet
+	if isSubnetNetwork(subnet) {
+		return fallbackBroadcast(subnet, netip.IPv4Unspecified())
+	}
+	if t.IP == "" {
+		return "", errors.New("broadcast fallback requires a subnet network or a target IP")
+	}
+	addr, err := resolveUDPAddr(ctx, t.IP, portOrDefault(t.Port), opts.ResolveRetries, opts.ResolveBackoff, opts.Prefer)
+	if err != nil {
+		return "", err
+	}
+	if subnet == "" {
+		return directedBroadcast(addr.IP)
+	}
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return fallbackBroadcast(subnet, ip.Unmap())
+}
+
+// parseBroadcastFallback parses the broadcast_fallback subdirective.
+func parseBroadcastFallback(d *caddyfile.Dispenser) (*BroadcastFallback, error) {
+	f := new(BroadcastFallback)
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "after":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			f.After = n
+		case "interval":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			f.Interval = dur
+		case "subnet":
+			subnet, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			f.Subnet = subnet
+		default:
+			return nil, d.Errf("unrecognized broadcast_fallback subdirective '%s'", d.Val())
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,177 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestBroadcastFallbackConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    BroadcastFallback
+		wantErr bool
+	}{
+		{
+			name:  "full",
+			input: "check 192.0.2.1:22\n\tbroadcast_fallback {\n\t\tafter 2\n\t\tinterval 3s\n\t\tsubnet /24\n\t}",
+			want:  BroadcastFallback{After: 2, Interval: caddy.Duration(3 * time.Second), Subnet: "/24"},
+		},
+		{name: "defaults", input: "check 192.0.2.1:22\n\tbroadcast_fallback"},
+		{name: "network", input: "check 192.0.2.1:22\n\tbroadcast_fallback {\n\t\tsubnet 192.0.2.0/24\n\t}", want: BroadcastFallback{Subnet: "192.0.2.0/24"}},
+		{name: "dotted mask", input: "check 192.0.2.1:22\n\tbroadcast_fallback {\n\t\tsubnet 255.255.255.0\n\t}", want: BroadcastFallback{Subnet: "255.255.255.0"}},
+		{name: "invalid mask", input: "check 192.0.2.1:22\n\tbroadcast_fallback {\n\t\tsubnet /33\n\t}", wantErr: true},
+		{name: "IPv6 network", input: "check 192.0.2.1:22\n\tbroadcast_fallback {\n\t\tsubnet 2001:db8::/64\n\t}", wantErr: true},
+		{name: "negative after", input: "check 192.0.2.1:22\n\tbroadcast_fallback {\n\t\tafter -1\n\t}", wantErr: true},
+		{name: "argument", input: "check 192.0.2.1:22\n\tbroadcast_fallback 3", wantErr: true},
+		{name: "unknown subdirective", input: "check 192.0.2.1:22\n\tbroadcast_fallback {\n\t\tmask /24\n\t}", wantErr: true},
+		{name: "without check", input: "broadcast_fallback", wantErr: true},
+		{name: "with broadcast", input: "check 192.0.2.1:22\n\tbroadcast 192.0.2.255\n\tbroadcast_fallback", wantErr: true},
+		{name: "with wait", input: "check 192.0.2.1:22\n\twait 5s\n\tbroadcast_fallback", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.BroadcastFallback != tt.want {
+				t.Errorf("broadcast_fallback = %+v, want %+v", *w.BroadcastFallback, tt.want)
+			}
+		})
+	}
+}
+
+func TestFallbackBroadcast(t *testing.T) {
+	tests := []struct {
+		subnet  string
+		ip      string
+		want    string
+		wantErr bool
+	}{
+		{subnet: "192.168.1.0/24", ip: "10.0.0.1", want: "192.168.1.255"},
+		{subnet: "/24", ip: "192.168.1.10", want: "192.168.1.255"},
+		{subnet: "/22", ip: "172.16.5.4", want: "172.16.7.255"},
+		{subnet: "255.255.0.0", ip: "10.1.2.3", want: "10.1.255.255"},
+		{subnet: "/0", ip: "192.168.1.10", wantErr: true},
+		{subnet: "255.0.255.0", ip: "192.168.1.10", wantErr: true},
+		{subnet: "/24", ip: "2001:db8::1", wantErr: true},
+		{subnet: "192.168.1.0/33", ip: "192.168.1.10", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subnet+" "+tt.ip, func(t *testing.T) {
+			got, err := fallbackBroadcast(tt.subnet, netip.MustParseAddr(tt.ip))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("broadcast = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPBroadcastFallback(t *testing.T) {
+	// The target's IP and its "subnet" are distinct loopback addresses, so
+	// the fake hosts tell unicast and broadcast apart
+	tests := []struct {
+		name string
+		// comes up after the nth unicast packet, or after the broadcast
+		upAfterUnicast   int
+		upAfterBroadcast bool
+		wantResult       wakeResult
+		wantUnicast      int
+		wantBroadcast    bool
+	}{
+		{name: "confirmed by unicast", upAfterUnicast: 1, wantResult: resultWoken, wantUnicast: 1},
+		{name: "confirmed after the fallback", upAfterBroadcast: true, wantResult: resultWoken, wantUnicast: 2, wantBroadcast: true},
+		{name: "never confirmed", wantResult: resultWakeTimeout, wantUnicast: 2, wantBroadcast: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unicast := newFakeHost(t)
+			broadcast, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: unicast.port()})
+			if err != nil {
+				t.Skipf("can't listen on 127.0.0.2: %v", err)
+			}
+			defer broadcast.Close()
+			checkPort := closedPort(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:   testMAC,
+				IP:    "127.0.0.1",
+				Port:  unicast.port(),
+				Check: fmt.Sprintf("127.0.0.1:%d", checkPort),
+				BroadcastFallback: &BroadcastFallback{
+					After:    2,
+					Interval: caddy.Duration(600 * time.Millisecond),
+					Subnet:   "127.0.0.2/32",
+				},
+				StatusHeader: "X-Wake-Result",
+			})
+			logs := observeLogs(w)
+
+			up := func() {
+				l, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", checkPort))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				t.Cleanup(func() { l.Close() })
+			}
+			unicastPackets := make(chan int, 8)
+			go func() {
+				n := 0
+				for range unicast.packets {
+					n++
+					if n == tt.upAfterUnicast {
+						up()
+					}
+					unicastPackets <- n
+				}
+			}()
+			broadcastPackets := make(chan struct{}, 8)
+			go func() {
+				buf := make([]byte, 2048)
+				for {
+					if _, _, err := broadcast.ReadFromUDP(buf); err != nil {
+						return
+					}
+					if tt.upAfterBroadcast {
+						up()
+					}
+					broadcastPackets <- struct{}{}
+				}
+			}()
+
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if got := len(unicastPackets); got != tt.wantUnicast {
+				t.Errorf("got %d unicast packets, want %d", got, tt.wantUnicast)
+			}
+			if got := len(broadcastPackets) == 1; got != tt.wantBroadcast || len(broadcastPackets) > 1 {
+				t.Errorf("got %d broadcast packets, want broadcast %v", len(broadcastPackets), tt.wantBroadcast)
+			}
+			fellBack := logs.FilterMessage("no confirmation after unicast sends; falling back to broadcast").All()
+			if got := len(fellBack) == 1; got != tt.wantBroadcast {
+				t.Fatalf("logged the fallback: %v, want %v", got, tt.wantBroadcast)
+			}
+			if tt.wantBroadcast && (fellBack[0].ContextMap()["broadcast"] != "127.0.0.2" || fellBack[0].ContextMap()["after"] != int64(2)) {
+				t.Errorf("fallback logged with %v", fellBack[0].ContextMap())
+			}
+		})
+	}
+}
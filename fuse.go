@@ -0,0 +1,167 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// resultFuseBlown reports a wake refused because the target was sent its
+// max_lifetime_packets already.
+const resultFuseBlown wakeResult = "fuse_blown"
+
+// errFuseBlown is returned for a packet refused by max_lifetime_packets.
+var errFuseBlown = errors.New("max_lifetime_packets reached; no more packets until a reload or a reset through the admin API")
+
+// packetFuse counts the packets each target was sent since the handler was
+// provisioned, refusing any over the limit.
+type packetFuse struct {
+	limit  int64
+	logger *zap.Logger
+
+	mu sync.Mutex
+	// Keyed by Target.key, so targets sharing a name or MAC are counted
+	// apart
+	counts map[string]*fuseCount
+}
+
+// fuseCount is the packet counter of one target.
+type fuseCount struct {
+	label string
+	n     atomic.Int64
+}
+
+func newPacketFuse(limit int, logger *zap.Logger) *packetFuse {
+	return &packetFuse{limit: int64(limit), logger: logger, counts: make(map[string]*fuseCount)}
+}
+
+// count returns the packet counter of t.
+func (f *packetFuse) count(t Target) *fuseCount {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := t.key()
+	c := f.counts[key]
+	if c == nil {
+		c = &fuseCount{label: t.label()}
+		f.counts[key] = c
+	}
+	return c
+}
+
+// take reserves a packet to t, returning errFuseBlown instead if the limit
+// was reached. The reservation is settled by settle once it is known
+// whether the packet went out.
+func (f *packetFuse) take(t Target) error {
+	c := f.count(t)
+	if c.n.Add(1) > f.limit {
+		// Kept at the limit, so a reset isn't needed twice
+		c.n.Add(-1)
+		return errFuseBlown
+	}
+	return nil
+}
+
+// settle charges the packet reserved by take if it was sent, and gives it
+// back otherwise. The packet that reaches the limit is logged.
+func (f *packetFuse) settle(t Target, sent bool) {
+	c := f.count(t)
+	if !sent {
+		c.n.Add(-1)
+		return
+	}
+	if n := c.n.Load(); n == f.limit {
+		f.logger.Error("max_lifetime_packets reached; no more packets will be sent to the target until a reload or a reset",
+			zap.String("target", c.label), zap.Int64("packets", n))
+	}
+}
+
+// reset clears the counts of the targets labelled label, or of every
+// target if label is empty, returning how many counts it cleared.
+func (f *packetFuse) reset(label string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if label == "" {
+		n := len(f.counts)
+		clear(f.counts)
+		return n
+	}
+	n := 0
+	for key, c := range f.counts {
+		if c.label == label {
+			delete(f.counts, key)
+			n++
+		}
+	}
+	return n
+}
+
+// fuseTarget is one target in the body of GET /wake_on_lan/fuse.
+type fuseTarget struct {
+	Target  string `json:"target"`
+	Packets int64  `json:"packets"`
+	Limit   int64  `json:"limit"`
+	Blown   bool   `json:"blown"`
+}
+
+// fuses returns the fuses of the running handlers.
+func fuses() []*packetFuse {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	var fs []*packetFuse
+	for w := range registry.handlers {
+		if w.fuse != nil {
+			fs = append(fs, w.fuse)
+		}
+	}
+	return fs
+}
+
+// handleFuse serves GET /wake_on_lan/fuse, listing the packets counted per
+// target, and POST to reset them, for one ?target= or all.
+func (adminAPI) handleFuse(rw http.ResponseWriter, r *http.Request) error {
+	label := r.URL.Query().Get("target")
+	switch r.Method {
+	case http.MethodGet:
+		targets := []fuseTarget{}
+		for _, f := range fuses() {
+			f.mu.Lock()
+			for _, c := range f.counts {
+				if label != "" && c.label != label {
+					continue
+				}
+				sent := c.n.Load()
+				targets = append(targets, fuseTarget{Target: c.label, Packets: sent, Limit: f.limit, Blown: sent >= f.limit})
+			}
+			f.mu.Unlock()
+		}
+		sort.Slice(targets, func(i, j int) bool {
+			if targets[i].Target != targets[j].Target {
+				return targets[i].Target < targets[j].Target
+			}
+			return targets[i].Packets > targets[j].Packets
+		})
+		rw.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(rw).Encode(targets)
+	case http.MethodPost:
+		var reset int
+		for _, f := range fuses() {
+			reset += f.reset(label)
+		}
+		if label != "" && reset == 0 {
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("no packets counted for target %q", label)}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(rw).Encode(map[string]int{"reset": reset})
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method not allowed"),
+	}
+}
@@ -0,0 +1,177 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestPacketFuse(t *testing.T) {
+	nas := Target{Name: "nas", MAC: testMAC, IP: "192.0.2.1"}
+	// Shares nas's label, but is another target
+	other := Target{Name: "nas", MAC: testMAC, IP: "192.0.2.2"}
+
+	f := newPacketFuse(2, zap.NewNop())
+	for i := 0; i < 2; i++ {
+		if err := f.take(nas); err != nil {
+			t.Fatalf("take %d: %v", i+1, err)
+		}
+		f.settle(nas, true)
+	}
+	if err := f.take(nas); err != errFuseBlown {
+		t.Fatalf("take over the limit = %v, want errFuseBlown", err)
+	}
+	if err := f.take(other); err != nil {
+		t.Fatalf("take for another target with the same label: %v", err)
+	}
+	f.settle(other, true)
+	if got := f.count(nas).n.Load(); got != 2 {
+		t.Errorf("count after a refused take = %d, want 2", got)
+	}
+	if n := f.reset("nas"); n != 2 {
+		t.Errorf("reset cleared %d counts, want 2", n)
+	}
+	if err := f.take(nas); err != nil {
+		t.Errorf("take after reset: %v", err)
+	}
+}
+
+func TestPacketFuseSettleUnsent(t *testing.T) {
+	nas := Target{Name: "nas", MAC: testMAC, IP: "192.0.2.1"}
+	f := newPacketFuse(1, zap.NewNop())
+	for i := 0; i < 3; i++ {
+		if err := f.take(nas); err != nil {
+			t.Fatalf("take %d after unsent packets: %v", i+1, err)
+		}
+		f.settle(nas, false)
+	}
+	if got := f.count(nas).n.Load(); got != 0 {
+		t.Errorf("count = %d, want 0", got)
+	}
+}
+
+func TestServeHTTPFuseBlown(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     func(host *fakeHost) int
+		protocol string
+		// Status of each of three required wakes
+		want []int
+	}{
+		{
+			name: "sent",
+			port: func(host *fakeHost) int { return host.port() },
+			want: []int{http.StatusNoContent, http.StatusNoContent, http.StatusServiceUnavailable},
+		},
+		{
+			// Failed sends aren't charged, so the fuse never blows
+			name:     "send failed",
+			port:     func(*fakeHost) int { return closedPort(t) },
+			protocol: protocolTCP,
+			want:     []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: tt.port(host), Protocol: tt.protocol, Required: true, MaxLifetimePackets: 2})
+			for i, want := range tt.want {
+				rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+				if got := statusOf(rec, err); got != want {
+					t.Errorf("wake %d: status %d, want %d", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxLifetimePacketsConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{input: "max_lifetime_packets 1000", want: 1000},
+		{input: "max_lifetime_packets -1", wantErr: true},
+		{input: "max_lifetime_packets", wantErr: true},
+		{input: "max_lifetime_packets many", wantErr: true},
+		{input: "max_lifetime_packets 1 2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.MaxLifetimePackets != tt.want {
+				t.Errorf("max_lifetime_packets = %d, want %d", w.MaxLifetimePackets, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleFuse(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{Name: "fuse-nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Required: true, MaxLifetimePackets: 1})
+	serve := func() int {
+		t.Helper()
+		rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		return statusOf(rec, err)
+	}
+	admin := func(method, query string) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		return rec, adminAPI{}.handleFuse(rec, httptest.NewRequest(method, "/wake_on_lan/fuse"+query, nil))
+	}
+	if got := serve(); got != http.StatusNoContent {
+		t.Fatalf("first wake: status %d, want %d", got, http.StatusNoContent)
+	}
+	host.expect(t, 1)
+	if got := serve(); got != http.StatusServiceUnavailable {
+		t.Fatalf("wake over the limit: status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	rec, err := admin(http.MethodGet, "?target=fuse-nas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets []fuseTarget
+	if err := json.Unmarshal(rec.Body.Bytes(), &targets); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	if want := (fuseTarget{Target: "fuse-nas", Packets: 1, Limit: 1, Blown: true}); len(targets) != 1 || targets[0] != want {
+		t.Errorf("fuse %+v, want %+v", targets, want)
+	}
+
+	if _, err := admin(http.MethodPost, "?target=printer"); !isAPIStatus(err, http.StatusNotFound) {
+		t.Errorf("reset of an unknown target: %v, want a 404", err)
+	}
+	if _, err := admin(http.MethodDelete, ""); !isAPIStatus(err, http.StatusMethodNotAllowed) {
+		t.Errorf("DELETE: %v, want a 405", err)
+	}
+	rec, err = admin(http.MethodPost, "?target=fuse-nas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"reset":1}` {
+		t.Errorf("reset answered %s, want one count reset", got)
+	}
+	if got := serve(); got != http.StatusNoContent {
+		t.Errorf("wake after the reset: status %d, want %d", got, http.StatusNoContent)
+	}
+	host.expect(t, 1)
+}
+
+// isAPIStatus reports whether err is an admin API error of status.
+func isAPIStatus(err error, status int) bool {
+	var apiErr caddy.APIError
+	return errors.As(err, &apiErr) && apiErr.HTTPStatus == status
+}
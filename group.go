@@ -0,0 +1,98 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// resultGroupFailed reports a group wake in which a member didn't come up.
+const resultGroupFailed wakeResult = "group_failed"
+
+// errGroupFailed is wrapped by the groupError of a failed group wake.
+var errGroupFailed = errors.New("not every group member came up")
+
+// groupMember is one member's outcome in a group wake.
+type groupMember struct {
+	Target string     `json:"target"`
+	Result wakeResult `json:"result"`
+}
+
+// groupError fails a group wake, listing every member's outcome.
+type groupError struct {
+	group   string
+	members []groupMember
+}
+
+func (e *groupError) Error() string {
+	var failed []string
+	for _, m := range e.members {
+		if !m.Result.up() {
+			failed = append(failed, m.Target+"="+string(m.Result))
+		}
+	}
+	return fmt.Sprintf("wake_on_lan: group %s: %d of %d members did not come up: %s",
+		e.group, len(failed), len(e.members), strings.Join(failed, ", "))
+}
+
+func (e *groupError) Unwrap() error { return errGroupFailed }
+
+// up reports whether r confirms the target is up.
+func (r wakeResult) up() bool {
+	return r == resultWoken || r == resultAlreadyUp
+}
+
+// validateGroup checks that every member of a group can confirm it came
+// up, as the group only succeeds once they all have.
+func (w *WakeOnLAN) validateGroup() error {
+	if w.Group == "" {
+		return nil
+	}
+	if w.Wait <= 0 && len(w.Escalate) == 0 && w.SendUntilUp == nil && w.BroadcastFallback == nil {
+		return errors.New("group requires wait, escalate, send_until_up or broadcast_fallback")
+	}
+	if w.AfterResponse || w.FromBody || w.WakeOnFailure || w.WaitingPage != nil {
+		return errors.New("group cannot be combined with after_response, from_body, wake_on_failure or waiting_page")
+	}
+	for _, t := range w.allTargets() {
+		if t.Check == "" && w.WaitHTTP == nil && len(w.ConfirmExec) == 0 && !w.waitsARP() {
+			return errors.New("group requires a check address on every target, wait_http, confirm_exec, wait_arp or confirm_arp_learned")
+		}
+	}
+	return nil
+}
+
+// checkGroup returns a groupError unless every target came up. Members
+// that did come up are left running; their results are logged alongside
+// the failures.
+func (w *WakeOnLAN) checkGroup(targets []Target, results []wakeResult, logger *zap.Logger) error {
+	members := make([]groupMember, len(targets))
+	ok := true
+	for i, t := range targets {
+		members[i] = groupMember{Target: t.label(), Result: results[i]}
+		ok = ok && results[i].up()
+	}
+	if ok {
+		return nil
+	}
+	fields := []zap.Field{zap.String("group", w.Group)}
+	for _, m := range members {
+		fields = append(fields, zap.String("member."+m.Target, string(m.Result)))
+	}
+	logger.Warn("group did not come up", fields...)
+	return &groupError{group: w.Group, members: members}
+}
+
+// mergeResults updates results, for all targets, with the later results
+// of the subset retried.
+func mergeResults(all []Target, results []wakeResult, retried []Target, retriedResults []wakeResult) {
+	for i, t := range retried {
+		for j := range all {
+			if all[j].key() == t.key() {
+				results[j] = retriedResults[i]
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestGroupConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "with wait", input: "check 192.0.2.1:22\n\twait 30s\n\tgroup cluster", want: "cluster"},
+		{name: "with send_until_up", input: "check 192.0.2.1:22\n\tsend_until_up\n\tgroup cluster", want: "cluster"},
+		{name: "with wait_http", input: "wait 30s\n\twait_http http://192.0.2.1/health\n\tgroup cluster", want: "cluster"},
+		{name: "missing name", input: "check 192.0.2.1:22\n\twait 30s\n\tgroup", wantErr: true},
+		{name: "two names", input: "check 192.0.2.1:22\n\twait 30s\n\tgroup a b", wantErr: true},
+		{name: "without wait", input: "check 192.0.2.1:22\n\tgroup cluster", wantErr: true},
+		{name: "without check", input: "wait 30s\n\tgroup cluster", wantErr: true},
+		{name: "with after_response", input: "check 192.0.2.1:22\n\twait 30s\n\tafter_response\n\tgroup cluster", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.Group != tt.want {
+				t.Errorf("group = %q, want %q", w.Group, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPGroup(t *testing.T) {
+	tests := []struct {
+		name string
+		// how long each member takes to come up, negative for never
+		upAfter    [2]time.Duration
+		onTimeout  string
+		retries    int
+		wantStatus int
+		wantNext   bool
+		// members' results when the group fails
+		wantMembers []groupMember
+	}{
+		{name: "all up", upAfter: [2]time.Duration{0, 0}, wantStatus: http.StatusNoContent, wantNext: true},
+		{
+			name:       "one never up",
+			upAfter:    [2]time.Duration{0, -1},
+			wantStatus: http.StatusGatewayTimeout,
+			wantMembers: []groupMember{
+				{Target: "node1", Result: resultAlreadyUp},
+				{Target: "node2", Result: resultWakeTimeout},
+			},
+		},
+		{
+			name:       "none up",
+			upAfter:    [2]time.Duration{-1, -1},
+			wantStatus: http.StatusGatewayTimeout,
+			wantMembers: []groupMember{
+				{Target: "node1", Result: resultWakeTimeout},
+				{Target: "node2", Result: resultWakeTimeout},
+			},
+		},
+		{name: "up on retry", upAfter: [2]time.Duration{0, 1500 * time.Millisecond}, onTimeout: onTimeoutRetry, retries: 1, wantStatus: http.StatusNoContent, wantNext: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			var targets []Target
+			for i, mac := range []string{testMAC, "00:11:22:aa:bb:cc"} {
+				checkPort := closedPort(t)
+				targets = append(targets, Target{
+					Name:  fmt.Sprintf("node%d", i+1),
+					MAC:   mac,
+					IP:    "127.0.0.1",
+					Port:  host.port(),
+					Check: fmt.Sprintf("127.0.0.1:%d", checkPort),
+				})
+				listenAfter(t, checkPort, tt.upAfter[i])
+			}
+			w := provisionTest(t, &WakeOnLAN{
+				Targets:          targets,
+				Wait:             caddy.Duration(time.Second),
+				OnTimeout:        tt.onTimeout,
+				OnTimeoutRetries: tt.retries,
+				Group:            "cluster",
+				JSONErrors:       true,
+			})
+			logs := observeLogs(w)
+
+			rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if called != tt.wantNext {
+				t.Errorf("next called = %v, want %v", called, tt.wantNext)
+			}
+			failed := logs.FilterMessage("group did not come up").All()
+			if tt.wantMembers == nil {
+				if len(failed) > 0 {
+					t.Errorf("logged a group failure: %v", failed[0].ContextMap())
+				}
+				return
+			}
+
+			var body errorBody
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding %q: %v", rec.Body, err)
+			}
+			if body.Error != string(resultGroupFailed) || !slices.Equal(body.Members, tt.wantMembers) {
+				t.Errorf("body %+v, want group_failed with members %v", body, tt.wantMembers)
+			}
+			if len(failed) != 1 {
+				t.Fatalf("logged %d group failures, want 1", len(failed))
+			}
+			fields := failed[0].ContextMap()
+			for _, m := range tt.wantMembers {
+				if got := fields["member."+m.Target]; got != string(m.Result) {
+					t.Errorf("logged %s as %v, want %s", m.Target, got, m.Result)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupError(t *testing.T) {
+	err := &groupError{group: "cluster", members: []groupMember{
+		{Target: "node1", Result: resultWoken},
+		{Target: "node2", Result: resultWakeTimeout},
+		{Target: "node3", Result: resultSendFailed},
+	}}
+	if want := "wake_on_lan: group cluster: 2 of 3 members did not come up: node2=wake_timeout, node3=send_failed"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	if !errors.Is(err, errGroupFailed) {
+		t.Error("groupError doesn't wrap errGroupFailed")
+	}
+}
@@ -0,0 +1,290 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// defaultGRPCMethod is the RPC called by default, Wake of the service in
+// proto/wake.proto.
+const defaultGRPCMethod = "/wakeonlan.v1.WakeService/Wake"
+
+// GRPC calls a management service's Wake RPC for each target instead of
+// sending packets, for proxies that can't reach the LAN themselves. The
+// request is the WakeRequest of proto/wake.proto; the response's content
+// is ignored, and an error status fails the wake.
+type GRPC struct {
+	// The service's address, host:port.
+	Endpoint string `json:"endpoint"`
+	// Full name of the method, "/<package>.<service>/<method>", taking a
+	// message with the fields of WakeRequest. Default:
+	// "/wakeonlan.v1.WakeService/Wake".
+	Method string `json:"method,omitempty"`
+	// If true, the connection isn't encrypted. By default it uses TLS,
+	// verified with the system's roots.
+	Plaintext bool `json:"plaintext,omitempty"`
+	// PEM file of the CAs the service's certificate is verified with,
+	// instead of the system's.
+	CA string `json:"ca,omitempty"`
+	// PEM files of the client certificate and its key, for services
+	// requiring mutual TLS.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	// Name the service's certificate is verified for. Default: the
+	// endpoint's host.
+	ServerName string `json:"server_name,omitempty"`
+	// Bearer token sent in the authorization metadata of each call, with
+	// Caddy's global placeholders such as {env.*}.
+	Token string `json:"token,omitempty"`
+}
+
+// validateGRPC checks grpc and the settings it can't be combined with.
+func (w *WakeOnLAN) validateGRPC() error {
+	g := w.GRPC
+	if g == nil {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(g.Endpoint); err != nil {
+		return fmt.Errorf("invalid grpc endpoint %q: want host:port", g.Endpoint)
+	}
+	switch {
+	case g.Method != "" && !validGRPCMethod(g.Method):
+		return fmt.Errorf("invalid grpc method %q: want /<package>.<service>/<method>", g.Method)
+	case (g.Cert == "") != (g.Key == ""):
+		return errors.New("grpc cert and key must be set together")
+	case g.Plaintext && (g.CA != "" || g.Cert != "" || g.ServerName != ""):
+		return errors.New("grpc plaintext cannot be combined with ca, cert, key or server_name")
+	case w.Publish != nil || w.relayed() || w.HelperSocket != "":
+		return errors.New("grpc cannot be combined with publish, relay or helper_socket")
+	case len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil:
+		return errors.New("grpc cannot be combined with escalate, send_until_up or broadcast_fallback")
+	}
+	_, err := g.transportCredentials()
+	return err
+}
+
+// validGRPCMethod reports whether m has the form /<service>/<method>.
+func validGRPCMethod(m string) bool {
+	if len(m) < 4 || m[0] != '/' {
+		return false
+	}
+	for i := 1; i < len(m)-1; i++ {
+		if m[i] == '/' {
+			return i > 1
+		}
+	}
+	return false
+}
+
+// transportCredentials returns the credentials g's connection uses.
+func (g *GRPC) transportCredentials() (credentials.TransportCredentials, error) {
+	if g.Plaintext {
+		return insecure.NewCredentials(), nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: g.ServerName}
+	if g.CA != "" {
+		pem, err := os.ReadFile(g.CA)
+		if err != nil {
+			return nil, fmt.Errorf("grpc ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("grpc ca: no certificate in %s", g.CA)
+		}
+	}
+	if g.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(g.Cert, g.Key)
+		if err != nil {
+			return nil, fmt.Errorf("grpc cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+// provisionGRPC sets up the connection to the service, shared by every
+// wake and opened on the first call.
+func (w *WakeOnLAN) provisionGRPC() error {
+	if w.GRPC == nil {
+		return nil
+	}
+	creds, err := w.GRPC.transportCredentials()
+	if err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	conn, err := grpc.NewClient(w.GRPC.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("wake_on_lan: grpc: %w", err)
+	}
+	w.grpcConn = conn
+	w.grpcToken = caddy.NewReplacer().ReplaceKnown(w.GRPC.Token, "")
+	return nil
+}
+
+// wakeGRPC calls the Wake RPC for t, in place of sending packets.
+func (w *WakeOnLAN) wakeGRPC(ctx context.Context, t Target, logger *zap.Logger) error {
+	method := w.GRPC.Method
+	if method == "" {
+		method = defaultGRPCMethod
+	}
+	timeout := time.Duration(w.SendTimeout)
+	if timeout == 0 {
+		timeout = defaultPublishTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if w.grpcToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+w.grpcToken)
+	}
+	req := grpcWakeRequest{
+		Target:    t.label(),
+		MAC:       t.MAC,
+		IP:        t.IP,
+		Port:      t.Port,
+		Interface: t.Interface,
+		SecureOn:  t.SecureOn,
+	}
+	var resp grpcWakeResponse
+	if err := w.grpcConn.Invoke(ctx, method, req, &resp, grpc.ForceCodec(grpcWakeCodec{})); err != nil {
+		if s, ok := status.FromError(err); ok {
+			return fmt.Errorf("grpc %s: %s: %s", method, s.Code(), s.Message())
+		}
+		return fmt.Errorf("grpc %s: %w", method, err)
+	}
+	logger.Debug("wake requested over grpc", zap.String("method", method))
+	return nil
+}
+
+// grpcWakeRequest is the WakeRequest message of proto/wake.proto.
+type grpcWakeRequest struct {
+	Target    string
+	MAC       string
+	IP        string
+	Port      int
+	Interface string
+	SecureOn  string
+}
+
+// grpcWakeResponse is the WakeResponse message, whose content is ignored.
+type grpcWakeResponse struct{}
+
+// grpcWakeCodec encodes grpcWakeRequest in the protobuf wire format, as
+// the "proto" content subtype every gRPC server accepts, without code
+// generated from proto/wake.proto.
+type grpcWakeCodec struct{}
+
+func (grpcWakeCodec) Marshal(v any) ([]byte, error) {
+	req, ok := v.(grpcWakeRequest)
+	if !ok {
+		return nil, fmt.Errorf("grpc: can't encode a %T", v)
+	}
+	var b []byte
+	for i, s := range []string{req.Target, req.MAC, req.IP} {
+		if s != "" {
+			b = protowire.AppendTag(b, protowire.Number(i+1), protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	}
+	if req.Port != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(req.Port))
+	}
+	for i, s := range []string{req.Interface, req.SecureOn} {
+		if s != "" {
+			b = protowire.AppendTag(b, protowire.Number(i+5), protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	}
+	return b, nil
+}
+
+func (grpcWakeCodec) Unmarshal(data []byte, v any) error {
+	if _, ok := v.(*grpcWakeResponse); !ok {
+		return fmt.Errorf("grpc: can't decode into a %T", v)
+	}
+	return nil
+}
+
+func (grpcWakeCodec) Name() string { return "proto" }
+
+// parseGRPC parses grpc: the endpoint, then a block with method,
+// plaintext, ca, cert, key, server_name and token.
+func parseGRPC(d *caddyfile.Dispenser) (*GRPC, error) {
+	g := new(GRPC)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	g.Endpoint = d.Val()
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "method":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			g.Method = v
+		case "plaintext":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			g.Plaintext = true
+		case "ca":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			g.CA = v
+		case "cert":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			g.Cert = v
+		case "key":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			g.Key = v
+		case "server_name":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			g.ServerName = v
+		case "token":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			g.Token = v
+		default:
+			return nil, d.Errf("unrecognized grpc subdirective '%s'", d.Val())
+		}
+	}
+	return g, nil
+}
@@ -0,0 +1,269 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// rawCodec passes messages through as the bytes on the wire, for a stub
+// server without generated code.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) { return *v.(*[]byte), nil }
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// grpcCall is a call the stub service received.
+type grpcCall struct {
+	method        string
+	authorization []string
+	req           grpcWakeRequest
+}
+
+// stubGRPC is a gRPC service answering every method, with err if set.
+type stubGRPC struct {
+	addr string
+	err  error
+
+	mu    sync.Mutex
+	calls []grpcCall
+}
+
+func newStubGRPC(t *testing.T, err error) *stubGRPC {
+	t.Helper()
+	ln, lerr := net.Listen("tcp", "127.0.0.1:0")
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+	s := &stubGRPC{addr: ln.Addr().String(), err: err}
+	srv := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(s.handle))
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return s
+}
+
+func (s *stubGRPC) handle(_ any, stream grpc.ServerStream) error {
+	var b []byte
+	if err := stream.RecvMsg(&b); err != nil {
+		return err
+	}
+	method, _ := grpc.MethodFromServerStream(stream)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	req, err := decodeWakeRequest(b)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	s.mu.Lock()
+	s.calls = append(s.calls, grpcCall{method: method, authorization: md.Get("authorization"), req: req})
+	s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	empty := []byte{}
+	return stream.SendMsg(&empty)
+}
+
+func (s *stubGRPC) received() []grpcCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]grpcCall(nil), s.calls...)
+}
+
+// decodeWakeRequest decodes a WakeRequest of proto/wake.proto.
+func decodeWakeRequest(b []byte) (grpcWakeRequest, error) {
+	var req grpcWakeRequest
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return req, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 || num != 4 {
+				return req, fmt.Errorf("unexpected varint field %d", num)
+			}
+			req.Port, b = int(v), b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeString(b)
+		if n < 0 {
+			return req, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			req.Target = v
+		case 2:
+			req.MAC = v
+		case 3:
+			req.IP = v
+		case 5:
+			req.Interface = v
+		case 6:
+			req.SecureOn = v
+		default:
+			return req, fmt.Errorf("unexpected field %d", num)
+		}
+	}
+	return req, nil
+}
+
+func TestGRPCConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    GRPC
+		wantErr bool
+	}{
+		{input: "grpc wol.example.com:443", want: GRPC{Endpoint: "wol.example.com:443"}},
+		{
+			input: "grpc 192.0.2.10:50051 {\n\t\tmethod /acme.Power/WakeHost\n\t\tplaintext\n\t\ttoken {env.WOL_TOKEN}\n\t}",
+			want:  GRPC{Endpoint: "192.0.2.10:50051", Method: "/acme.Power/WakeHost", Plaintext: true, Token: "{env.WOL_TOKEN}"},
+		},
+		{input: "grpc wol.example.com:443 {\n\t\tserver_name wol.internal\n\t}", want: GRPC{Endpoint: "wol.example.com:443", ServerName: "wol.internal"}},
+		{input: "grpc", wantErr: true},
+		{input: "grpc wol.example.com", wantErr: true},
+		{input: "grpc wol.example.com:443 extra", wantErr: true},
+		{input: "grpc wol.example.com:443 {\n\t\tmethod Wake\n\t}", wantErr: true},
+		{input: "grpc wol.example.com:443 {\n\t\tmethod //Wake\n\t}", wantErr: true},
+		{input: "grpc wol.example.com:443 {\n\t\tcert client.pem\n\t}", wantErr: true},
+		{input: "grpc wol.example.com:443 {\n\t\tplaintext\n\t\tserver_name wol.internal\n\t}", wantErr: true},
+		{input: "grpc wol.example.com:443 {\n\t\tca /nonexistent/ca.pem\n\t}", wantErr: true},
+		{input: "grpc wol.example.com:443 {\n\t\tretries 3\n\t}", wantErr: true},
+		{input: "grpc wol.example.com:443\n\trelay 192.0.2.10:9", wantErr: true},
+		{input: "grpc wol.example.com:443\n\tpublish http https://queue.example.com/wakes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.GRPC != tt.want {
+				t.Errorf("grpc = %+v, want %+v", *w.GRPC, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidGRPCMethod(t *testing.T) {
+	tests := []struct {
+		method string
+		want   bool
+	}{
+		{method: defaultGRPCMethod, want: true},
+		{method: "/Power/Wake", want: true},
+		{method: "Power/Wake"},
+		{method: "/Power/"},
+		{method: "//Wake"},
+		{method: "/PowerWake"},
+		{method: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			if got := validGRPCMethod(tt.method); got != tt.want {
+				t.Errorf("validGRPCMethod(%q) = %v, want %v", tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCWakeCodec(t *testing.T) {
+	tests := []grpcWakeRequest{
+		{Target: "nas", MAC: testMAC, IP: "192.0.2.1", Port: 9, Interface: "eth0", SecureOn: "01:02:03:04:05:06"},
+		{Target: testMAC, MAC: testMAC},
+		{},
+	}
+	for _, req := range tests {
+		b, err := grpcWakeCodec{}.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeWakeRequest(b)
+		if err != nil {
+			t.Fatalf("decoding % x: %v", b, err)
+		}
+		if got != req {
+			t.Errorf("decoded %+v, want %+v", got, req)
+		}
+	}
+	if _, err := (grpcWakeCodec{}).Marshal("wake"); err == nil {
+		t.Error("encoded a string")
+	}
+	if err := (grpcWakeCodec{}).Unmarshal(nil, new(string)); err == nil {
+		t.Error("decoded into a string")
+	}
+}
+
+func TestServeHTTPGRPC(t *testing.T) {
+	t.Setenv("WOL_TEST_GRPC_TOKEN", "s3cret")
+	tests := []struct {
+		name       string
+		method     string
+		err        error
+		wantMethod string
+		wantResult wakeResult
+	}{
+		{name: "woken", wantMethod: defaultGRPCMethod, wantResult: resultSent},
+		{name: "method", method: "/acme.Power/WakeHost", wantMethod: "/acme.Power/WakeHost", wantResult: resultSent},
+		{name: "error status", err: status.Error(codes.NotFound, "no such host"), wantMethod: defaultGRPCMethod, wantResult: resultSendFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			stub := newStubGRPC(t, tt.err)
+			w := provisionTest(t, &WakeOnLAN{
+				Targets: []Target{{
+					Name:      "nas",
+					MAC:       testMAC,
+					IP:        "127.0.0.1",
+					Port:      host.port(),
+					SecureOn:  "01:02:03:04:05:06",
+					Interface: "lo",
+				}},
+				GRPC:         &GRPC{Endpoint: stub.addr, Method: tt.method, Plaintext: true, Token: "{env.WOL_TEST_GRPC_TOKEN}"},
+				StatusHeader: "X-Wake-Result",
+			})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target=nas"; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			// Called in place of the packet
+			host.expectNone(t)
+
+			calls := stub.received()
+			if len(calls) != 1 {
+				t.Fatalf("%d calls, want 1", len(calls))
+			}
+			if calls[0].method != tt.wantMethod {
+				t.Errorf("called %s, want %s", calls[0].method, tt.wantMethod)
+			}
+			if len(calls[0].authorization) != 1 || calls[0].authorization[0] != "Bearer s3cret" {
+				t.Errorf("authorization %q, want the token from the environment", calls[0].authorization)
+			}
+			want := grpcWakeRequest{Target: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Interface: "lo", SecureOn: "01:02:03:04:05:06"}
+			if calls[0].req != want {
+				t.Errorf("request %+v, want %+v", calls[0].req, want)
+			}
+		})
+	}
+}
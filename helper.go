@@ -0,0 +1,92 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+// helperHeader describes one packet handed to a helper_socket helper. Each
+// datagram is the header as a JSON line, then the packet's bytes:
+//
+//	{"transport":"udp","ip":"192.168.1.255","port":9,"broadcast":true}\n<packet>
+type helperHeader struct {
+	// "udp", "tcp", "raw_ethernet" or the name of a plugin transport.
+	Transport string `json:"transport"`
+	// Destination IP (with its zone, if any) and port; unset for raw
+	// ethernet frames.
+	IP   string `json:"ip,omitempty"`
+	Port int    `json:"port,omitempty"`
+	// Set when IP is a broadcast address, which needs SO_BROADCAST.
+	Broadcast bool `json:"broadcast,omitempty"`
+	// Interface to send from: always set for raw ethernet frames, and for
+	// other packets when the target is bound to one.
+	Interface string `json:"interface,omitempty"`
+}
+
+// validateHelperSocket checks the settings helper_socket can't be combined
+// with.
+func (w *WakeOnLAN) validateHelperSocket() error {
+	if w.HelperSocket == "" {
+		return nil
+	}
+	if w.relayed() || w.SourcePortRange != "" {
+		return errors.New("helper_socket cannot be combined with relay or source_port_range")
+	}
+	return nil
+}
+
+// sendHelper hands packet, described by h, to the helper listening on the
+// Unix datagram socket at path. timeout bounds connecting and writing.
+func sendHelper(ctx context.Context, path string, h helperHeader, packet []byte, timeout time.Duration) error {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "unixgram", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	header, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	datagram := append(append(header, '\n'), packet...)
+	n, err := conn.Write(datagram)
+	if err != nil {
+		return err
+	}
+	return checkWritten(n, len(datagram))
+}
+
+// helperDestinations returns a header for each packet sendWOL would send
+// itself: one per transport to addr when unicast, and one per broadcast
+// address.
+func helperDestinations(t Target, addr *net.UDPAddr, port int, unicast bool, opts sendOptions) []helperHeader {
+	var headers []helperHeader
+	if unicast && !opts.SkipUnicast {
+		for _, transport := range opts.Transports {
+			switch {
+			case transport == transportRawEthernet:
+				headers = append(headers, helperHeader{Transport: transport, Interface: rawInterface(t, opts)})
+			case addr == nil:
+			default:
+				headers = append(headers, helperHeader{Transport: transport, IP: addr.AddrPort().Addr().Unmap().String(), Port: addr.Port, Broadcast: transport == protocolUDP && classifyDest(addr.IP) == destBroadcast, Interface: t.Interface})
+			}
+		}
+	}
+	for _, broadcast := range opts.Broadcasts {
+		headers = append(headers, helperBroadcast(broadcast, port, t.Interface))
+	}
+	return headers
+}
+
+// helperBroadcast returns the header of a UDP broadcast, through ifname if
+// set.
+func helperBroadcast(broadcast string, port int, ifname string) helperHeader {
+	return helperHeader{Transport: protocolUDP, IP: broadcast, Port: port, Broadcast: true, Interface: ifname}
+}
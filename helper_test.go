@@ -0,0 +1,97 @@
+package caddy_wakeonlan
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestHelperSocketConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "path", input: "helper_socket /run/wol-helper.sock", want: "/run/wol-helper.sock"},
+		{name: "with broadcast", input: "broadcast 192.0.2.255\n\thelper_socket /run/wol-helper.sock", want: "/run/wol-helper.sock"},
+		{name: "missing path", input: "helper_socket", wantErr: true},
+		{name: "two paths", input: "helper_socket /a.sock /b.sock", wantErr: true},
+		{name: "with relay", input: "relay 192.0.2.10:9\n\thelper_socket /run/wol-helper.sock", wantErr: true},
+		{name: "with source_port_range", input: "source_port_range 40000-40010\n\thelper_socket /run/wol-helper.sock", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.HelperSocket != tt.want {
+				t.Errorf("helper_socket = %q, want %q", w.HelperSocket, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelperDestinations(t *testing.T) {
+	unicast := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9}
+	tests := []struct {
+		name    string
+		target  Target
+		addr    *net.UDPAddr
+		unicast bool
+		opts    sendOptions
+		want    []helperHeader
+	}{
+		{
+			name:    "unicast",
+			addr:    unicast,
+			unicast: true,
+			opts:    sendOptions{Transports: []string{protocolUDP}},
+			want:    []helperHeader{{Transport: protocolUDP, IP: "192.0.2.1", Port: 9}},
+		},
+		{
+			name:    "every transport and broadcast",
+			target:  Target{Interface: "eth1"},
+			addr:    unicast,
+			unicast: true,
+			opts:    sendOptions{Transports: []string{protocolUDP, protocolTCP, transportRawEthernet}, RawInterface: "eth0", Broadcasts: []string{"192.0.2.255"}},
+			want: []helperHeader{
+				{Transport: protocolUDP, IP: "192.0.2.1", Port: 9, Interface: "eth1"},
+				{Transport: protocolTCP, IP: "192.0.2.1", Port: 9, Interface: "eth1"},
+				{Transport: transportRawEthernet, Interface: "eth1"},
+				{Transport: protocolUDP, IP: "192.0.2.255", Port: 9, Broadcast: true, Interface: "eth1"},
+			},
+		},
+		{
+			name:    "broadcast IP",
+			addr:    &net.UDPAddr{IP: net.IPv4bcast, Port: 7},
+			unicast: true,
+			opts:    sendOptions{Transports: []string{protocolUDP}},
+			want:    []helperHeader{{Transport: protocolUDP, IP: "255.255.255.255", Port: 7, Broadcast: true}},
+		},
+		{
+			name: "broadcast only",
+			addr: unicast,
+			opts: sendOptions{Transports: []string{protocolUDP}, Broadcasts: []string{"192.0.2.255"}},
+			want: []helperHeader{{Transport: protocolUDP, IP: "192.0.2.255", Port: 9, Broadcast: true}},
+		},
+		{
+			name:    "without an address",
+			unicast: true,
+			opts:    sendOptions{Transports: []string{protocolUDP}, Broadcasts: []string{"192.0.2.255"}},
+			want:    []helperHeader{{Transport: protocolUDP, IP: "192.0.2.255", Port: 9, Broadcast: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := helperDestinations(tt.target, tt.addr, 9, tt.unicast, tt.opts)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("destinations = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+//go:build unix
+
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// stubHelper is a helper_socket helper recording what it is handed.
+type stubHelper struct {
+	path      string
+	datagrams chan helperDatagram
+}
+
+type helperDatagram struct {
+	header helperHeader
+	packet []byte
+}
+
+// newStubHelper listens on a Unix datagram socket until the test ends.
+func newStubHelper(t *testing.T) *stubHelper {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "helper.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("no Unix datagram sockets: %v", err)
+	}
+	h := &stubHelper{path: path, datagrams: make(chan helperDatagram, 16)}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			line, packet, ok := bytes.Cut(buf[:n], []byte("\n"))
+			var d helperDatagram
+			if !ok || json.Unmarshal(line, &d.header) != nil {
+				t.Errorf("malformed datagram %q", buf[:n])
+				continue
+			}
+			d.packet = bytes.Clone(packet)
+			h.datagrams <- d
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return h
+}
+
+// expect returns the next n datagrams, failing the test if they don't
+// arrive, or if more follow. It may run on its own goroutine.
+func (h *stubHelper) expect(t *testing.T, n int) []helperDatagram {
+	t.Helper()
+	var got []helperDatagram
+	for len(got) < n {
+		select {
+		case d := <-h.datagrams:
+			got = append(got, d)
+		case <-time.After(2 * time.Second):
+			t.Errorf("got %d datagrams, want %d", len(got), n)
+			return got
+		}
+	}
+	select {
+	case d := <-h.datagrams:
+		t.Errorf("unexpected datagram %+v", d.header)
+	case <-time.After(100 * time.Millisecond):
+	}
+	return got
+}
+
+func TestServeHTTPHelperSocket(t *testing.T) {
+	tests := []struct {
+		name string
+		w    WakeOnLAN
+		want []helperHeader
+	}{
+		{
+			name: "unicast",
+			w:    WakeOnLAN{IP: "192.0.2.1"},
+			want: []helperHeader{{Transport: protocolUDP, IP: "192.0.2.1", Port: 9}},
+		},
+		{
+			name: "unicast and broadcast",
+			w:    WakeOnLAN{IP: "192.0.2.1", Port: 7, Broadcast: "192.0.2.255"},
+			want: []helperHeader{
+				{Transport: protocolUDP, IP: "192.0.2.1", Port: 7},
+				{Transport: protocolUDP, IP: "192.0.2.255", Port: 7, Broadcast: true},
+			},
+		},
+		{
+			name: "transports",
+			w:    WakeOnLAN{IP: "192.0.2.1", Transports: []string{protocolUDP, protocolTCP}},
+			want: []helperHeader{
+				{Transport: protocolUDP, IP: "192.0.2.1", Port: 9},
+				{Transport: protocolTCP, IP: "192.0.2.1", Port: 9},
+			},
+		},
+		{
+			name: "MAC pattern",
+			w:    WakeOnLAN{MAC: "00:11:22:33:44:**", Broadcast: "192.0.2.255"},
+			want: slices.Repeat([]helperHeader{{Transport: protocolUDP, IP: "192.0.2.255", Port: 9, Broadcast: true}}, 256),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			helper := newStubHelper(t)
+			w := tt.w
+			if w.MAC == "" {
+				w.MAC = testMAC
+			}
+			w.HelperSocket = helper.path
+			w.StatusHeader = "X-Wake-Result"
+			provisionTest(t, &w)
+
+			// A pattern's datagrams outnumber the stub's buffer
+			got := make(chan []helperDatagram, 1)
+			go func() { got <- helper.expect(t, len(tt.want)) }()
+			rec, _, err := serveTest(&w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := rec.Header().Get("X-Wake-Result"); !strings.HasPrefix(h, string(resultSent)+";") {
+				t.Errorf("result = %q, want %q", h, resultSent)
+			}
+			for i, d := range <-got {
+				if d.header != tt.want[i] {
+					t.Errorf("datagram %d: header %+v, want %+v", i, d.header, tt.want[i])
+				}
+				if len(d.packet) != 102 || !bytes.Equal(d.packet[:6], bytes.Repeat([]byte{0xff}, 6)) {
+					t.Errorf("datagram %d: packet %x isn't a magic packet", i, d.packet)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTPHelperSocketMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "helper.sock")
+	tests := []struct {
+		name       string
+		required   bool
+		wantStatus int
+	}{
+		{name: "logged", wantStatus: http.StatusNoContent},
+		{name: "required", required: true, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", HelperSocket: path, Required: tt.required, StatusHeader: "X-Wake-Result"})
+			logs := observeLogs(w)
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if !tt.required {
+				if got, want := rec.Header().Get("X-Wake-Result"), string(resultSendFailed)+"; target="+testMAC; got != want {
+					t.Errorf("result = %q, want %q", got, want)
+				}
+				if logs.FilterLevelExact(zapcore.WarnLevel).Len()+logs.FilterLevelExact(zapcore.ErrorLevel).Len() == 0 {
+					t.Error("failure to reach the helper not logged")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package caddy_wakeonlan
+
+import (
+	"net"
+	"strings"
+)
+
+// lookupHostMap returns the target mapped to the given request host.
+// Exact names take precedence over wildcards; a wildcard label ("*")
+// matches exactly one label of the host, like Caddy's host matcher.
+func lookupHostMap(hostMap map[string]Target, host string) (Target, bool) {
+	if len(hostMap) == 0 {
+		return Target{}, false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if t, ok := hostMap[host]; ok {
+		return t, true
+	}
+
+	// Prefer the most specific pattern (fewest "*" labels, then longest)
+	var (
+		best      Target
+		bestStars = -1
+		bestLen   int
+	)
+	for pattern, t := range hostMap {
+		stars := strings.Count(pattern, "*")
+		if !matchHostPattern(strings.ToLower(pattern), host) {
+			continue
+		}
+		if bestStars == -1 || stars < bestStars || (stars == bestStars && len(pattern) > bestLen) {
+			best, bestStars, bestLen = t, stars, len(pattern)
+		}
+	}
+	return best, bestStars != -1
+}
+
+// matchHostPattern reports whether host matches the pattern label by label.
+func matchHostPattern(pattern, host string) bool {
+	patternLabels := strings.Split(pattern, ".")
+	hostLabels := strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i, p := range patternLabels {
+		if p != "*" && p != hostLabels[i] {
+			return false
+		}
+	}
+	return true
+}
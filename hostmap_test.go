@@ -0,0 +1,153 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLookupHostMap(t *testing.T) {
+	hostMap := map[string]Target{
+		"nas.example.com":     {Name: "nas"},
+		"*.lab.example.com":   {Name: "lab"},
+		"db.lab.example.com":  {Name: "db"},
+		"*.*.example.com":     {Name: "any"},
+		"printer.example.com": {Name: "printer"},
+	}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "nas.example.com", want: "nas"},
+		{host: "NAS.Example.com.", want: "nas"},
+		{host: "nas.example.com:8443", want: "nas"},
+		{host: "pi.lab.example.com", want: "lab"},
+		{host: "db.lab.example.com", want: "db"},
+		{host: "pi.office.example.com", want: "any"},
+		{host: "a.pi.lab.example.com", want: ""},
+		{host: "example.com", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, ok := lookupHostMap(hostMap, tt.host)
+			if ok != (tt.want != "") || got.Name != tt.want {
+				t.Errorf("lookupHostMap(%q) = %q, %v, want %q", tt.host, got.Name, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileHostMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "exact and wildcard",
+			input: `wake_on_lan {
+				host_map {
+					NAS.example.com 10:ff:e0:cf:e6:0e 192.168.1.10
+					*.lab.example.com 10:ff:e0:cf:e6:0f 192.168.1.20 9 {
+						repeat 3
+					}
+				}
+			}`,
+			want: map[string]string{"nas.example.com": "192.168.1.10", "*.lab.example.com": "192.168.1.20"},
+		},
+		{
+			name:    "argument",
+			input:   "wake_on_lan {\n\thost_map nas.example.com\n}",
+			wantErr: true,
+		},
+		{
+			name:    "target without a MAC",
+			input:   "wake_on_lan {\n\thost_map {\n\t\tnas.example.com\n\t}\n}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(w.HostMap) != len(tt.want) {
+				t.Fatalf("host_map = %v, want %v", w.HostMap, tt.want)
+			}
+			for host, ip := range tt.want {
+				if got := w.HostMap[host].IP; got != ip {
+					t.Errorf("host %s mapped to %q, want %q", host, got, ip)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateHostMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		hostMap map[string]Target
+		wantErr bool
+	}{
+		{name: "valid", hostMap: map[string]Target{"nas.example.com": {MAC: testMAC, IP: "192.0.2.1"}}},
+		{name: "empty hostname", hostMap: map[string]Target{"": {MAC: testMAC, IP: "192.0.2.1"}}, wantErr: true},
+		{name: "invalid target", hostMap: map[string]Target{"nas.example.com": {MAC: "nope", IP: "192.0.2.1"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &WakeOnLAN{HostMap: tt.hostMap}
+			if err := w.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeHTTPHostMap(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		withTarget bool
+		// Which host gets the packet: "nas", "lab", "default" or none
+		want       string
+		wantStatus int
+	}{
+		{name: "exact", host: "nas.example.com", want: "nas", wantStatus: http.StatusNoContent},
+		{name: "wildcard", host: "pi.lab.example.com", want: "lab", wantStatus: http.StatusNoContent},
+		{name: "unmapped", host: "other.example.com", wantStatus: http.StatusNotFound},
+		{name: "unmapped with default", host: "other.example.com", withTarget: true, want: "default", wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := map[string]*fakeHost{"nas": newFakeHost(t), "lab": newFakeHost(t), "default": newFakeHost(t)}
+			w := &WakeOnLAN{HostMap: map[string]Target{
+				"nas.example.com":   {MAC: "00:11:22:33:44:01", IP: "127.0.0.1", Port: hosts["nas"].port()},
+				"*.lab.example.com": {MAC: "00:11:22:33:44:02", IP: "127.0.0.1", Port: hosts["lab"].port()},
+			}}
+			if tt.withTarget {
+				w.Targets = []Target{{MAC: testMAC, IP: "127.0.0.1", Port: hosts["default"].port()}}
+			}
+			w = provisionTest(t, w)
+
+			r := newTestRequest("GET", "http://"+tt.host+"/", nil)
+			rec, called, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status %d, want %d", got, tt.wantStatus)
+			}
+			if called != (tt.wantStatus == http.StatusNoContent) {
+				t.Errorf("next handler called = %v", called)
+			}
+			for name, h := range hosts {
+				if name == tt.want {
+					h.expect(t, 1)
+				} else {
+					h.expectNone(t)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// headerIdempotencyKey is the request header idempotency_key reads by
+// default.
+const headerIdempotencyKey = "Idempotency-Key"
+
+// defaultIdempotencyTTL is how long a key's outcome is kept by default.
+const defaultIdempotencyTTL = 10 * time.Minute
+
+// maxIdempotencyKey is the longest idempotency key accepted.
+const maxIdempotencyKey = 255
+
+// idempotencyCache remembers the outcome of each wake requested with an
+// idempotency key, so a client retrying the request gets that outcome back
+// instead of waking again.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*idempotentWake
+	lastSweep time.Time
+}
+
+// idempotentWake is the outcome of the wake for one key: what the request
+// that ran it added to the response and left in its variables, and how it
+// ended.
+type idempotentWake struct {
+	done    chan struct{}
+	expires time.Time
+	// The outcome isn't kept, as for a wake cut short when its client gave
+	// up; retries wake again.
+	dropped bool
+
+	header  http.Header
+	vars    map[string]any
+	failure wakeResult
+	err     error
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, entries: make(map[string]*idempotentWake)}
+}
+
+// begin returns the entry for key and whether the caller runs the wake,
+// having created it, or replays the entry's outcome once done is closed.
+func (c *idempotencyCache) begin(key string) (*idempotentWake, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) >= c.ttl/4 {
+		for k, e := range c.entries {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if e, ok := c.entries[key]; ok && (e.expires.IsZero() || now.Before(e.expires)) {
+		return e, false
+	}
+	e := &idempotentWake{done: make(chan struct{})}
+	c.entries[key] = e
+	return e, true
+}
+
+// finish stores e's outcome for the TTL, or forgets it if dropped, and
+// releases the requests waiting for it.
+func (c *idempotencyCache) finish(key string, e *idempotentWake) {
+	c.mu.Lock()
+	if e.dropped {
+		delete(c.entries, key)
+	} else {
+		e.expires = time.Now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// validateIdempotency checks idempotency_key and the settings it depends
+// on.
+func (w *WakeOnLAN) validateIdempotency() error {
+	if w.IdempotencyTTL < 0 {
+		return fmt.Errorf("invalid idempotency_ttl %s", time.Duration(w.IdempotencyTTL))
+	}
+	if w.IdempotencyKey == "" {
+		if w.IdempotencyTTL != 0 {
+			return errors.New("idempotency_ttl requires idempotency_key")
+		}
+		return nil
+	}
+	if w.AfterResponse || w.FromBody || w.WaitingPage != nil || w.WakeOnFailure {
+		return errors.New("idempotency_key cannot be combined with after_response, from_body, waiting_page or wake_on_failure")
+	}
+	return nil
+}
+
+// provisionIdempotency sets up the cache of outcomes by key.
+func (w *WakeOnLAN) provisionIdempotency() {
+	if w.IdempotencyKey == "" {
+		return
+	}
+	ttl := time.Duration(w.IdempotencyTTL)
+	if ttl == 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	w.idempotency = newIdempotencyCache(ttl)
+}
+
+// idempotencyKey returns the cache key of r's idempotency key for waking
+// targets, empty if r has none. The targets are part of it, so a key
+// reused to wake something else doesn't replay the wrong outcome.
+func (w *WakeOnLAN) idempotencyKey(r *http.Request, targets []Target) (string, error) {
+	if w.idempotency == nil {
+		return "", nil
+	}
+	key := r.Header.Get(w.IdempotencyKey)
+	if key == "" {
+		return "", nil
+	}
+	if len(key) > maxIdempotencyKey {
+		return "", caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: %s longer than %d bytes", w.IdempotencyKey, maxIdempotencyKey))
+	}
+	labels := make([]string, len(targets))
+	for i, t := range targets {
+		labels[i] = t.label()
+	}
+	return key + "\x00" + strings.Join(labels, "\x00"), nil
+}
+
+// wakeIdempotent wakes targets once per key: the first request with it
+// runs wakeUntilUp and stores the outcome, and repeats within the TTL,
+// including those arriving while it runs, get the same status headers,
+// variables and failure without anything being sent. results is nil for
+// a replay.
+func (w *WakeOnLAN) wakeIdempotent(rw http.ResponseWriter, r *http.Request, targets []Target, key string, logger *zap.Logger) ([]wakeResult, wakeResult, error) {
+	for {
+		e, first := w.idempotency.begin(key)
+		if first {
+			before := make(map[string]int)
+			for _, name := range w.replayedHeaders() {
+				before[name] = len(rw.Header().Values(name))
+			}
+			results, failure, err := w.wakeUntilUp(rw, r, targets, logger)
+			e.header = make(http.Header)
+			for _, name := range w.replayedHeaders() {
+				for _, v := range rw.Header().Values(name)[before[name]:] {
+					e.header.Add(name, v)
+				}
+			}
+			e.vars = make(map[string]any)
+			for _, name := range []string{varResult, varTarget, varError, varResults} {
+				e.vars[name] = caddyhttp.GetVar(r.Context(), name)
+			}
+			e.failure, e.err = failure, err
+			e.dropped = r.Context().Err() != nil && (err != nil || slices.Contains(results, resultClientDisconnected))
+			w.idempotency.finish(key, e)
+			return results, failure, err
+		}
+		select {
+		case <-e.done:
+		case <-r.Context().Done():
+			return nil, resultClientDisconnected, errClientDisconnected
+		}
+		if e.dropped {
+			continue
+		}
+		logger.Debug("idempotency key seen before; replaying its outcome",
+			zap.String("key", r.Header.Get(w.IdempotencyKey)), zap.String("result", string(e.failure)))
+		for name, values := range e.header {
+			for _, v := range values {
+				rw.Header().Add(name, v)
+			}
+		}
+		for name, v := range e.vars {
+			caddyhttp.SetVar(r.Context(), name, v)
+		}
+		return nil, e.failure, e.err
+	}
+}
+
+// replayedHeaders returns the response headers a wake adds, which a
+// replay adds again.
+func (w *WakeOnLAN) replayedHeaders() []string {
+	var names []string
+	if w.StatusHeader != "" {
+		names = append(names, w.StatusHeader)
+	}
+	if w.DebugHeader {
+		names = append(names, headerWakeDebug)
+	}
+	return names
+}
@@ -0,0 +1,218 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestIdempotencyConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantTTL time.Duration
+		wantErr bool
+	}{
+		{input: "idempotency_key", want: headerIdempotencyKey},
+		{input: "idempotency_key X-Request-Id\n\tidempotency_ttl 1h", want: "X-Request-Id", wantTTL: time.Hour},
+		{input: "idempotency_key one two", wantErr: true},
+		{input: "idempotency_ttl 1h", wantErr: true},
+		{input: "idempotency_key\n\tidempotency_ttl -1s", wantErr: true},
+		{input: "idempotency_key\n\tidempotency_ttl", wantErr: true},
+		{input: "idempotency_key\n\tafter_response", wantErr: true},
+		{input: "idempotency_key\n\tfrom_body", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (w.IdempotencyKey != tt.want || time.Duration(w.IdempotencyTTL) != tt.wantTTL) {
+				t.Errorf("idempotency_key %q, ttl %s; want %q, %s", w.IdempotencyKey, time.Duration(w.IdempotencyTTL), tt.want, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	c := newIdempotencyCache(200 * time.Millisecond)
+	e, first := c.begin("a")
+	if !first {
+		t.Fatal("a new key isn't run")
+	}
+	// Running: later requests wait for it
+	if got, again := c.begin("a"); again || got != e {
+		t.Error("a running key is run again")
+	}
+	c.finish("a", e)
+	select {
+	case <-e.done:
+	default:
+		t.Error("waiting requests not released")
+	}
+	if got, again := c.begin("a"); again || got != e {
+		t.Error("a finished key is run again within the TTL")
+	}
+	if _, first := c.begin("b"); !first {
+		t.Error("another key isn't run")
+	}
+
+	// Dropped outcomes are forgotten
+	d, _ := c.begin("dropped")
+	d.dropped = true
+	c.finish("dropped", d)
+	if _, first := c.begin("dropped"); !first {
+		t.Error("a dropped key isn't run again")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if _, first := c.begin("a"); !first {
+		t.Error("an expired key isn't run again")
+	}
+}
+
+func TestServeHTTPIdempotency(t *testing.T) {
+	tests := []struct {
+		name string
+		// the key of each request, sent that long after the last
+		keys        []string
+		gap         time.Duration
+		ttl         time.Duration
+		wantPackets int
+	}{
+		{name: "repeated", keys: []string{"k1", "k1", "k1"}, wantPackets: 1},
+		{name: "distinct", keys: []string{"k1", "k2"}, wantPackets: 2},
+		{name: "without a key", keys: []string{"", ""}, wantPackets: 2},
+		{name: "expired", keys: []string{"k1", "k1"}, gap: 400 * time.Millisecond, ttl: 300 * time.Millisecond, wantPackets: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:            testMAC,
+				IP:             "127.0.0.1",
+				Port:           host.port(),
+				Required:       true,
+				IdempotencyKey: headerIdempotencyKey,
+				IdempotencyTTL: caddy.Duration(tt.ttl),
+				StatusHeader:   "X-Wake-Result",
+			})
+			var first *httptest.ResponseRecorder
+			for i, key := range tt.keys {
+				time.Sleep(tt.gap)
+				r := newTestRequest("GET", "http://example.com/", nil)
+				if key != "" {
+					r.Header.Set(headerIdempotencyKey, key)
+				}
+				rec, called, err := serveTest(w, r)
+				if got := statusOf(rec, err); got != http.StatusNoContent || !called {
+					t.Fatalf("request %d: status %d, next called %v; want %d and called (%v)", i+1, got, called, http.StatusNoContent, err)
+				}
+				if first == nil {
+					first = rec
+				} else if got, want := rec.Header().Values("X-Wake-Result"), first.Header().Values("X-Wake-Result"); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("request %d: results %q, want %q as before", i+1, got, want)
+				}
+			}
+			host.expect(t, tt.wantPackets)
+			host.expectNone(t)
+		})
+	}
+}
+
+func TestServeHTTPIdempotencyFailure(t *testing.T) {
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:            testMAC,
+		IP:             "127.0.0.1",
+		Port:           closedPort(t),
+		Protocol:       protocolTCP,
+		Required:       true,
+		JSONErrors:     true,
+		IdempotencyKey: "X-Request-Id",
+		StatusHeader:   "X-Wake-Result",
+	})
+	logs := observeLogs(w)
+	var bodies, results []string
+	var statuses []int
+	for range 2 {
+		r := newTestRequest("GET", "http://example.com/", nil)
+		r.Header.Set("X-Request-Id", "retry-me")
+		rec, called, err := serveTest(w, r)
+		if called {
+			t.Error("next handler called after a failed required wake")
+		}
+		statuses = append(statuses, statusOf(rec, err))
+		bodies = append(bodies, rec.Body.String())
+		results = append(results, rec.Header().Get("X-Wake-Result"))
+	}
+	if statuses[0] != http.StatusBadGateway || statuses[1] != statuses[0] {
+		t.Errorf("statuses %v, want %d twice", statuses, http.StatusBadGateway)
+	}
+	if bodies[1] != bodies[0] || results[1] != results[0] {
+		t.Errorf("replay differs: bodies %q, results %q", bodies, results)
+	}
+	// Only the first request tried to send
+	if n := logs.FilterMessage("idempotency key seen before; replaying its outcome").Len(); n != 1 {
+		t.Errorf("replayed %d times, want 1", n)
+	}
+}
+
+func TestServeHTTPIdempotencyConcurrent(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:            testMAC,
+		IP:             "127.0.0.1",
+		Port:           host.port(),
+		Check:          fmt.Sprintf("127.0.0.1:%d", closedPort(t)),
+		Wait:           caddy.Duration(700 * time.Millisecond),
+		CheckTimeout:   caddy.Duration(100 * time.Millisecond),
+		IdempotencyKey: headerIdempotencyKey,
+		StatusHeader:   "X-Wake-Result",
+	})
+	// The retries arrive while the first request is still waiting
+	results := make([]string, 3)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+			r := newTestRequest("GET", "http://example.com/", nil)
+			r.Header.Set(headerIdempotencyKey, "k1")
+			rec, _, err := serveTest(w, r)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = rec.Header().Get("X-Wake-Result")
+		}()
+	}
+	wg.Wait()
+	want := string(resultWakeTimeout) + "; target=" + testMAC
+	if strings.Join(results, ",") != strings.Join([]string{want, want, want}, ",") {
+		t.Errorf("results %q, want %q each", results, want)
+	}
+	host.expect(t, 1)
+	host.expectNone(t)
+}
+
+func TestServeHTTPIdempotencyKeyTooLong(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), IdempotencyKey: headerIdempotencyKey})
+	r := newTestRequest("GET", "http://example.com/", nil)
+	r.Header.Set(headerIdempotencyKey, strings.Repeat("k", maxIdempotencyKey+1))
+	rec, called, err := serveTest(w, r)
+	if got := statusOf(rec, err); got != http.StatusBadRequest || called {
+		t.Errorf("status %d, next called %v; want %d and not called", got, called, http.StatusBadRequest)
+	}
+	host.expectNone(t)
+}
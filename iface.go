@@ -0,0 +1,181 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// interfaceIP returns the first IPv4, or with ipv6 IPv6, address of the
+// named interface.
+func interfaceIP(ifname string, ipv6 bool) (string, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && (n.IP.To4() == nil) == ipv6 {
+			return n.IP.String(), nil
+		}
+	}
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	return "", fmt.Errorf("interface %s has no %s address", ifname, family)
+}
+
+// interfaceControl returns a socket control function that binds sockets
+// to ifname, also setting SO_BROADCAST when broadcast is true.
+func interfaceControl(ifname string, broadcast bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, _ string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = bindInterface(fd, network, ifname)
+			if sockErr == nil && broadcast {
+				// Where SO_BROADCAST can't be set, try sending anyway
+				if err := setBroadcast(fd); !errors.Is(err, errBroadcastUnsupported) {
+					sockErr = err
+				}
+			}
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// writeOnInterface sends payload as a single datagram to addr, which may
+// be a broadcast address, through the named interface only.
+func writeOnInterface(ctx context.Context, ifname string, addr *net.UDPAddr, payload []byte, ttl int) error {
+	start := time.Now()
+	ipv6 := addr.IP.To4() == nil
+	local, err := interfaceLocalAddr(ifname, ipv6)
+	if err != nil {
+		return err
+	}
+	network := "udp4"
+	if ipv6 {
+		network = "udp6"
+	}
+	lc := net.ListenConfig{Control: interfaceControl(ifname, classifyDest(addr.IP) == destBroadcast)}
+	pc, err := lc.ListenPacket(ctx, network, net.JoinHostPort(local, "0"))
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	if err := setTTL(pc, addr.IP, ttl); err != nil {
+		return err
+	}
+	observePhase(ctx, phaseDial, start)
+
+	start = time.Now()
+	n, err := pc.WriteTo(payload, addr)
+	observePhase(ctx, phaseWrite, start)
+	if err != nil {
+		return err
+	}
+	return checkWritten(n, len(payload))
+}
+
+// broadcastOnInterface sends payload to the broadcast address through the
+// named interface only, on its shared socket if there is one.
+func broadcastOnInterface(ctx context.Context, ifname, broadcast string, port int, payload []byte, ttl int, opts sendOptions) error {
+	ip := net.ParseIP(broadcast)
+	if ip == nil {
+		return fmt.Errorf("invalid broadcast address %q", broadcast)
+	}
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	if sent, err := sharedBroadcastOn(ctx, opts, ifname, addr, payload, ttl); sent {
+		return err
+	}
+	return writeOnInterface(ctx, ifname, addr, payload, ttl)
+}
+
+// rawInterface returns the interface to send t's raw ethernet frames from:
+// its own, if bound to one, or raw_interface.
+func rawInterface(t Target, opts sendOptions) string {
+	if t.Interface != "" {
+		return t.Interface
+	}
+	return opts.RawInterface
+}
+
+// interfaceDialer returns a dialer for TCP connections to addr through the
+// named interface, or a plain one when ifname is empty.
+func interfaceDialer(ifname string, addr *net.UDPAddr, timeout time.Duration) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if ifname == "" {
+		return dialer, nil
+	}
+	local, err := interfaceLocalAddr(ifname, addr.IP.To4() == nil)
+	if err != nil {
+		return nil, err
+	}
+	if local != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(local)}
+	}
+	dialer.Control = interfaceControl(ifname, false)
+	return dialer, nil
+}
+
+// validateInterfaces checks that targets sharing a MAC, e.g. clones of one
+// VM image on different subnets, each send through an interface of their
+// own, so a packet for one can't wake the other, and that interfaces
+// aren't combined with settings that send from elsewhere.
+func (w *WakeOnLAN) validateInterfaces() error {
+	targets := w.allTargets()
+	for _, t := range targets {
+		if t.Interface != "" && (w.relayed() || w.SourcePortRange != "") {
+			return fmt.Errorf("target %s: interface cannot be combined with relay or source_port_range", t.label())
+		}
+	}
+	for mac, group := range duplicateMACs(targets) {
+		seen := make(map[string]bool, len(group))
+		for _, t := range group {
+			if t.Interface == "" || seen[t.Interface] {
+				return fmt.Errorf("targets %s share MAC %s; give each an interface of its own",
+					strings.Join(targetLabels(group), ", "), mac)
+			}
+			seen[t.Interface] = true
+		}
+	}
+	return nil
+}
+
+// targetLabels returns the labels of targets.
+func targetLabels(targets []Target) []string {
+	labels := make([]string, len(targets))
+	for i, t := range targets {
+		labels[i] = t.label()
+	}
+	return labels
+}
+
+// duplicateMACs groups the targets with a fixed MAC that another target
+// has too, by MAC.
+func duplicateMACs(targets []Target) map[string][]Target {
+	byMAC := make(map[string][]Target)
+	for _, t := range targets {
+		if isMACPattern(t.MAC) {
+			continue
+		}
+		if hw, err := t.hardwareAddr(); err == nil {
+			byMAC[hw.String()] = append(byMAC[hw.String()], t)
+		}
+	}
+	for mac, group := range byMAC {
+		if len(group) < 2 {
+			delete(byMAC, mac)
+		}
+	}
+	return byMAC
+}
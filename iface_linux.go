@@ -0,0 +1,20 @@
+//go:build linux
+
+package caddy_wakeonlan
+
+import "golang.org/x/sys/unix"
+
+// bindInterface makes the socket send through the named interface only,
+// whatever the routing table says, with SO_BINDTODEVICE.
+func bindInterface(fd uintptr, _, ifname string) error {
+	return unix.BindToDevice(int(fd), ifname)
+}
+
+// interfaceLocalAddr returns the local IP to bind sockets sending through
+// ifname to; any address, as SO_BINDTODEVICE picks the interface.
+func interfaceLocalAddr(ifname string, ipv6 bool) (string, error) {
+	return "", nil
+}
+
+// vrfSupported reports whether sockets can be bound to a VRF device here.
+const vrfSupported = true
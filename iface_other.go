@@ -0,0 +1,19 @@
+//go:build !linux && !windows
+
+package caddy_wakeonlan
+
+// bindInterface does nothing here: sockets are bound to the interface's
+// address instead.
+func bindInterface(fd uintptr, network, ifname string) error {
+	return nil
+}
+
+// interfaceLocalAddr returns the local IP to bind sockets sending through
+// ifname to: its address of the destination's family, which most systems
+// route from.
+func interfaceLocalAddr(ifname string, ipv6 bool) (string, error) {
+	return interfaceIP(ifname, ipv6)
+}
+
+// vrfSupported reports whether sockets can be bound to a VRF device here.
+const vrfSupported = false
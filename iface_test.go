@@ -0,0 +1,182 @@
+package caddy_wakeonlan
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+// loopbackAndOther returns the names of the loopback interface and of
+// another one that is up, skipping the test without them.
+func loopbackAndOther(t *testing.T) (string, string) {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("listing interfaces: %v", err)
+	}
+	var lo, other string
+	for _, iface := range ifaces {
+		switch {
+		case iface.Flags&net.FlagUp == 0:
+		case iface.Flags&net.FlagLoopback != 0 && lo == "":
+			lo = iface.Name
+		case iface.Flags&net.FlagLoopback == 0 && other == "":
+			other = iface.Name
+		}
+	}
+	if lo == "" || other == "" {
+		t.Skip("needs a loopback and another interface that is up")
+	}
+	return lo, other
+}
+
+func TestValidateInterfaces(t *testing.T) {
+	const twin = "52:54:00:12:34:56"
+	tests := []struct {
+		name    string
+		w       WakeOnLAN
+		wantErr bool
+	}{
+		{
+			name: "distinct interfaces",
+			w: WakeOnLAN{Targets: []Target{
+				{Name: "lab", MAC: twin, IP: "10.0.1.20", Interface: "eth1"},
+				{Name: "staging", MAC: twin, IP: "10.0.2.20", Interface: "eth2"},
+			}},
+		},
+		{
+			name: "spelt differently",
+			w: WakeOnLAN{Targets: []Target{
+				{Name: "lab", MAC: twin, IP: "10.0.1.20"},
+				{Name: "staging", MAC: "52-54-00-12-34-56", IP: "10.0.2.20"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "one without an interface",
+			w: WakeOnLAN{Targets: []Target{
+				{Name: "lab", MAC: twin, IP: "10.0.1.20", Interface: "eth1"},
+				{Name: "staging", MAC: twin, IP: "10.0.2.20"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "same interface",
+			w: WakeOnLAN{Targets: []Target{
+				{Name: "lab", MAC: twin, IP: "10.0.1.20", Interface: "eth1"},
+				{Name: "staging", MAC: twin, IP: "10.0.2.20", Interface: "eth1"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "distinct MACs without interfaces",
+			w: WakeOnLAN{Targets: []Target{
+				{Name: "lab", MAC: twin, IP: "10.0.1.20"},
+				{Name: "staging", MAC: "52:54:00:12:34:57", IP: "10.0.2.20"},
+			}},
+		},
+		{
+			name: "shared pattern",
+			w: WakeOnLAN{Broadcast: "192.0.2.255", Targets: []Target{
+				{Name: "bank-a", MAC: "52:54:00:12:34:**"},
+				{Name: "bank-b", MAC: "52:54:00:12:34:**"},
+			}},
+		},
+		{
+			name:    "with relay",
+			w:       WakeOnLAN{Relay: "192.0.2.10:9", Targets: []Target{{MAC: twin, IP: "10.0.1.20", Interface: "eth1"}}},
+			wantErr: true,
+		},
+		{
+			name:    "with source_port_range",
+			w:       WakeOnLAN{SourcePortRange: "40000-40010", Targets: []Target{{MAC: twin, IP: "10.0.1.20", Interface: "eth1"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.w.validateInterfaces(); (err != nil) != tt.wantErr {
+				t.Errorf("validateInterfaces = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInterfaceConfig(t *testing.T) {
+	lo, other := loopbackAndOther(t)
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "twins",
+			input: "target " + testMAC + " 10.0.1.20 {\n\t\tinterface " + lo + "\n\t}\n\ttarget " + testMAC + " 10.0.2.20 {\n\t\tinterface " + other + "\n\t}",
+			want:  []string{lo, other},
+		},
+		{name: "missing name", input: "target " + testMAC + " 10.0.1.20 {\n\t\tinterface\n\t}", wantErr: true},
+		{name: "unknown interface", input: "target " + testMAC + " 10.0.1.20 {\n\t\tinterface nosuchif0\n\t}", wantErr: true},
+		{name: "twins without interfaces", input: "target " + testMAC + " 10.0.1.20\n\ttarget " + testMAC + " 10.0.2.20", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got []string
+			for _, t := range w.Targets {
+				got = append(got, t.Interface)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("interfaces = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetKeyInterface(t *testing.T) {
+	a := Target{MAC: testMAC, IP: "10.0.1.20", Interface: "eth1"}
+	b := Target{MAC: testMAC, IP: "10.0.2.20", Interface: "eth2"}
+	if a.key() == b.key() {
+		t.Errorf("targets on distinct interfaces share key %q", a.key())
+	}
+	if same := (Target{MAC: "00-11-22-33-44-55", IP: "10.0.1.20", Interface: "eth1"}); same.key() != a.key() {
+		t.Errorf("key = %q, want %q", same.key(), a.key())
+	}
+}
+
+func TestServeHTTPDuplicateMACInterfaces(t *testing.T) {
+	// Both twins are at a loopback address; only the one bound to the
+	// loopback interface can reach it, so a packet arriving for the other
+	// would mean it left through the wrong interface
+	lo, other := loopbackAndOther(t)
+	loHost, otherHost := newFakeHost(t), newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		Targets: []Target{
+			{Name: "lo-twin", MAC: testMAC, IP: "127.0.0.1", Port: loHost.port(), Interface: lo},
+			{Name: "other-twin", MAC: testMAC, IP: "127.0.0.1", Port: otherHost.port(), Interface: other},
+		},
+		StatusHeader: "X-Wake-Result",
+	})
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Values("X-Wake-Result"); !slices.Contains(got, string(resultSent)+"; target=lo-twin") {
+		if slices.Contains(got, string(resultSendFailed)+"; target=lo-twin") {
+			t.Skipf("can't bind sockets to an interface here: %v", got)
+		}
+		t.Errorf("results %v, want lo-twin sent", got)
+	}
+	loHost.expect(t, 1)
+	loHost.expectNone(t)
+	otherHost.expectNone(t)
+}
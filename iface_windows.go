@@ -0,0 +1,50 @@
+//go:build windows
+
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// The socket options choosing the interface unicast and broadcast packets
+// leave through, missing from x/sys/windows.
+const (
+	ipUnicastIf   = 31
+	ipv6UnicastIf = 31
+)
+
+// bindInterface makes the socket send through the named interface,
+// rather than where the routing table says, with IP_UNICAST_IF or
+// IPV6_UNICAST_IF.
+func bindInterface(fd uintptr, network, ifname string) error {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	h := windows.Handle(fd)
+	if strings.HasSuffix(network, "6") {
+		err = windows.SetsockoptInt(h, windows.IPPROTO_IPV6, ipv6UnicastIf, iface.Index)
+	} else {
+		// The IPv4 option takes the index in network byte order
+		err = windows.SetsockoptInt(h, windows.IPPROTO_IP, ipUnicastIf, int(bits.ReverseBytes32(uint32(iface.Index))))
+	}
+	if err != nil {
+		return fmt.Errorf("binding to interface %s: %w", ifname, err)
+	}
+	return nil
+}
+
+// interfaceLocalAddr returns the local IP to bind sockets sending through
+// ifname to: its address of the destination's family, so replies and the
+// source of the packets match the interface chosen.
+func interfaceLocalAddr(ifname string, ipv6 bool) (string, error) {
+	return interfaceIP(ifname, ipv6)
+}
+
+// vrfSupported reports whether sockets can be bound to a VRF device here.
+const vrfSupported = false
@@ -0,0 +1,94 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestInitialDelayConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "initial_delay 500ms", want: 500 * time.Millisecond},
+		{input: "initial_delay 0s"},
+		{input: "initial_delay -1s", wantErr: true},
+		{input: "initial_delay", wantErr: true},
+		{input: "initial_delay soon", wantErr: true},
+		{input: "initial_delay 5s\n\tsend_until_up {\n\t\tprobe 192.0.2.1:22\n\t\tmax_duration 10s\n\t}", want: 5 * time.Second},
+		{input: "initial_delay 10s\n\tsend_until_up {\n\t\tprobe 192.0.2.1:22\n\t\tmax_duration 10s\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && time.Duration(w.InitialDelay) != tt.want {
+				t.Errorf("initial_delay %s, want %s", time.Duration(w.InitialDelay), tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPInitialDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Repeat: 2, InitialDelay: caddy.Duration(delay)})
+	start := time.Now()
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first packet is delayed, not each repeat
+	host.expect(t, 2)
+	if took := time.Since(start); took < delay || took > delay+time.Second {
+		t.Errorf("packets sent after %s, want after %s", took, delay)
+	}
+	host.expectNone(t)
+}
+
+func TestServeHTTPInitialDelayAlreadyUp(t *testing.T) {
+	// A host already up is neither delayed for nor sent to
+	host := newFakeHost(t)
+	up := newTCPHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:          testMAC,
+		IP:           "127.0.0.1",
+		Port:         host.port(),
+		Check:        up.addr(),
+		Wait:         caddy.Duration(time.Second),
+		InitialDelay: caddy.Duration(time.Second),
+		StatusHeader: "X-Wake-Result",
+	})
+	start := time.Now()
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took >= time.Second {
+		t.Errorf("request took %s, want no delay", took)
+	}
+	if got, want := rec.Header().Get("X-Wake-Result"), string(resultAlreadyUp)+"; target="+testMAC; got != want {
+		t.Errorf("result %q, want %q", got, want)
+	}
+	host.expectNone(t)
+}
+
+func TestInitialDelayCancelled(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), InitialDelay: caddy.Duration(time.Minute)})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result, err := w.wake(ctx, w.targets()[0], w.logger)
+	if result != resultError || err == nil {
+		t.Errorf("result %q, error %v; want %q with an error", result, err, resultError)
+	}
+	host.expectNone(t)
+}
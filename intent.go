@@ -0,0 +1,135 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// resultDenied reports a target the authorize route refused to wake.
+const resultDenied wakeResult = "denied"
+
+// errWakeDenied is the error of a denied target.
+var errWakeDenied = errors.New("wake denied by the authorize route")
+
+// Request variables and headers describing the target about to be woken,
+// set while the authorize route runs.
+const (
+	varIntentTarget = "wake_on_lan.intent.target"
+	varIntentMAC    = "wake_on_lan.intent.mac"
+	varIntentIP     = "wake_on_lan.intent.ip"
+	// Set to true by the authorize route to refuse the wake.
+	varIntentDeny = "wake_on_lan.intent.deny"
+
+	headerIntentTarget = "X-Wake-Intent-Target"
+	headerIntentMAC    = "X-Wake-Intent-MAC"
+	headerIntentIP     = "X-Wake-Intent-IP"
+)
+
+// authorizeTargets runs the authorize named route once for each target,
+// with the target's intent in request variables and headers, and returns
+// those it allowed. A target is denied when the route sets the deny
+// variable; handled is true when the route wrote the response itself
+// instead of reaching its end, as forward_auth does for a refused client,
+// and the request must stop there.
+func (w *WakeOnLAN) authorizeTargets(rw http.ResponseWriter, r *http.Request, targets []Target, logger *zap.Logger) (allowed []Target, handled bool, err error) {
+	// Clients can't pass an intent of their own off as the handler's
+	for _, h := range []string{headerIntentTarget, headerIntentMAC, headerIntentIP} {
+		r.Header.Del(h)
+	}
+	if w.Authorize == "" {
+		return targets, false, nil
+	}
+	server, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	if !ok {
+		return nil, false, errors.New("wake_on_lan: authorize: no server in the request context")
+	}
+	route, ok := server.NamedRoutes[w.Authorize]
+	if !ok {
+		return nil, false, fmt.Errorf("wake_on_lan: authorize: route '%s' not found", w.Authorize)
+	}
+	defer clearIntent(r)
+
+	src := w.newAuditSource(r)
+	for _, t := range targets {
+		setIntent(r, t)
+		reached := false
+		end := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			reached = true
+			return nil
+		})
+		if err := route.Compile(end).ServeHTTP(rw, r); err != nil {
+			return nil, false, err
+		}
+		if !reached {
+			logger.Debug("authorize route handled the request; not waking", zap.String("target", t.label()))
+			return nil, true, nil
+		}
+		if !intentDenied(r) {
+			allowed = append(allowed, t)
+			continue
+		}
+		w.record(logger, t, resultDenied, errWakeDenied)
+		w.audit(src, t, resultDenied, errWakeDenied)
+		if w.StatusHeader != "" {
+			rw.Header().Add(w.StatusHeader, string(resultDenied)+"; target="+t.label())
+		}
+	}
+	return allowed, false, nil
+}
+
+// namedRouteState is the Caddyfile adapter's state key for the named
+// routes a server block uses, as set by the invoke directive.
+const namedRouteState = "named_route"
+
+// addNamedRoute marks the named route as used by the server block being
+// parsed, so the Caddyfile adapter adds it to the server, as it does for
+// routes used by invoke.
+func addNamedRoute(h httpcaddyfile.Helper, name string) {
+	if h.State[namedRouteState] == nil {
+		h.State[namedRouteState] = map[string]struct{}{}
+	}
+	h.State[namedRouteState].(map[string]struct{})[name] = struct{}{}
+}
+
+// setIntent describes t to the authorize route.
+func setIntent(r *http.Request, t Target) {
+	ctx := r.Context()
+	caddyhttp.SetVar(ctx, varIntentTarget, t.label())
+	caddyhttp.SetVar(ctx, varIntentMAC, t.MAC)
+	caddyhttp.SetVar(ctx, varIntentIP, t.IP)
+	caddyhttp.SetVar(ctx, varIntentDeny, nil)
+	r.Header.Set(headerIntentTarget, t.label())
+	r.Header.Set(headerIntentMAC, t.MAC)
+	r.Header.Set(headerIntentIP, t.IP)
+}
+
+// clearIntent removes the intent once the targets are authorized, so it
+// doesn't reach the next handler or an upstream.
+func clearIntent(r *http.Request) {
+	ctx := r.Context()
+	for _, name := range []string{varIntentTarget, varIntentMAC, varIntentIP, varIntentDeny} {
+		caddyhttp.SetVar(ctx, name, nil)
+	}
+	for _, h := range []string{headerIntentTarget, headerIntentMAC, headerIntentIP} {
+		r.Header.Del(h)
+	}
+}
+
+// intentDenied reports whether the authorize route set the deny variable,
+// to true or, as the vars handler does, to a string that parses as true.
+func intentDenied(r *http.Request) bool {
+	switch v := caddyhttp.GetVar(r.Context(), varIntentDeny).(type) {
+	case bool:
+		return v
+	case string:
+		deny, err := strconv.ParseBool(v)
+		return err == nil && deny
+	}
+	return false
+}
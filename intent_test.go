@@ -0,0 +1,219 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestAuthorizeConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "authorize wake_authz", want: "wake_authz"},
+		{input: "authorize", wantErr: true},
+		{input: "authorize one two", wantErr: true},
+		{input: "authorize wake_authz\n\tfrom_body", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.Authorize != tt.want {
+				t.Errorf("authorize = %q, want %q", w.Authorize, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntentDenied(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want bool
+	}{
+		{name: "unset"},
+		{name: "true", v: true, want: true},
+		{name: "false", v: false},
+		{name: "true string", v: "true", want: true},
+		{name: "1 string", v: "1", want: true},
+		{name: "false string", v: "false"},
+		{name: "other string", v: "nope"},
+		{name: "number", v: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest("GET", "http://example.com/", nil)
+			if tt.v != nil {
+				caddyhttp.SetVar(r.Context(), varIntentDeny, tt.v)
+			}
+			if got := intentDenied(r); got != tt.want {
+				t.Errorf("intentDenied = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// authorizeFunc stands in for the authorize route's handlers as its
+// matcher, which needs no provisioning: it sees the intent as they would,
+// and matching ends the request in the terminal route, as a handler
+// writing the response does.
+type authorizeFunc func(r *http.Request) (bool, error)
+
+func (f authorizeFunc) MatchWithError(r *http.Request) (bool, error) {
+	return f(r)
+}
+
+// authorizeRoute is a named route running f.
+func authorizeRoute(f authorizeFunc) *caddyhttp.Route {
+	return &caddyhttp.Route{MatcherSets: caddyhttp.MatcherSets{{f}}, Terminal: true}
+}
+
+// denyWhen sets the deny variable for the targets matching, as a vars
+// handler would.
+func denyWhen(match func(r *http.Request) bool) authorizeFunc {
+	return func(r *http.Request) (bool, error) {
+		if match(r) {
+			caddyhttp.SetVar(r.Context(), varIntentDeny, "true")
+		}
+		return false, nil
+	}
+}
+
+// intentRecorder is the handler after wake_on_lan, recording the intent
+// left on the request.
+type intentRecorder struct {
+	called bool
+	header string
+	target any
+}
+
+func (h *intentRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) error {
+	h.called = true
+	h.header = r.Header.Get(headerIntentTarget)
+	h.target = caddyhttp.GetVar(r.Context(), varIntentTarget)
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func TestServeHTTPAuthorize(t *testing.T) {
+	const otherMAC = "00:11:22:aa:bb:cc"
+	tests := []struct {
+		name     string
+		route    authorizeFunc
+		required bool
+		// packets each target gets, nas then desktop
+		wantPackets [2]int
+		wantStatus  int
+		wantCalled  bool
+		wantResults []string
+	}{
+		{
+			name:        "allow",
+			route:       denyWhen(func(*http.Request) bool { return false }),
+			wantPackets: [2]int{1, 1},
+			wantStatus:  http.StatusNoContent,
+			wantCalled:  true,
+			wantResults: []string{"sent; target=nas", "sent; target=desktop"},
+		},
+		{
+			name:        "deny by header",
+			route:       denyWhen(func(r *http.Request) bool { return r.Header.Get(headerIntentTarget) == "desktop" }),
+			wantPackets: [2]int{1, 0},
+			wantStatus:  http.StatusNoContent,
+			wantCalled:  true,
+			wantResults: []string{"denied; target=desktop", "sent; target=nas"},
+		},
+		{
+			name:        "deny by variable",
+			route:       denyWhen(func(r *http.Request) bool { return caddyhttp.GetVar(r.Context(), varIntentMAC) == testMAC }),
+			wantPackets: [2]int{0, 1},
+			wantStatus:  http.StatusNoContent,
+			wantCalled:  true,
+			wantResults: []string{"denied; target=nas", "sent; target=desktop"},
+		},
+		{
+			name:        "deny all",
+			route:       denyWhen(func(*http.Request) bool { return true }),
+			wantStatus:  http.StatusNoContent,
+			wantCalled:  true,
+			wantResults: []string{"denied; target=nas", "denied; target=desktop"},
+		},
+		{
+			name:        "deny all required",
+			route:       denyWhen(func(*http.Request) bool { return true }),
+			required:    true,
+			wantStatus:  http.StatusForbidden,
+			wantResults: []string{"denied; target=nas", "denied; target=desktop"},
+		},
+		// As forward_auth does for a refused client
+		{
+			name: "route responds",
+			route: func(r *http.Request) (bool, error) {
+				return r.Header.Get(headerIntentTarget) == "nas", nil
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "route fails",
+			route: func(*http.Request) (bool, error) {
+				return false, caddyhttp.Error(http.StatusUnauthorized, errors.New("no credentials"))
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nas, desktop := newFakeHost(t), newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				Targets: []Target{
+					{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: nas.port()},
+					{Name: "desktop", MAC: otherMAC, IP: "127.0.0.1", Port: desktop.port()},
+				},
+				Authorize:    "wake_authz",
+				Required:     tt.required,
+				StatusHeader: "X-Wake-Result",
+			})
+			srv := &caddyhttp.Server{NamedRoutes: map[string]*caddyhttp.Route{"wake_authz": authorizeRoute(tt.route)}}
+			r := newTestRequest("GET", "http://example.com/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.ServerCtxKey, srv))
+			// A client can't claim an intent of its own
+			r.Header.Set(headerIntentTarget, "desktop")
+
+			rec := httptest.NewRecorder()
+			next := new(intentRecorder)
+			err := w.ServeHTTP(rec, r, next)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Errorf("status %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if next.called != tt.wantCalled {
+				t.Errorf("next handler called = %v, want %v", next.called, tt.wantCalled)
+			}
+			if next.header != "" || next.target != nil {
+				t.Errorf("next handler saw the intent: header %q, variable %v", next.header, next.target)
+			}
+			got := slices.Sorted(slices.Values(rec.Header().Values("X-Wake-Result")))
+			if !slices.Equal(got, slices.Sorted(slices.Values(tt.wantResults))) {
+				t.Errorf("results %q, want %q", got, tt.wantResults)
+			}
+			for i, host := range []*fakeHost{nas, desktop} {
+				if n := tt.wantPackets[i]; n > 0 {
+					host.expect(t, n)
+				}
+				host.expectNone(t)
+			}
+		})
+	}
+}
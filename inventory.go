@@ -0,0 +1,126 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// inventoryFile is the layout of an inventory file, in YAML or JSON:
+//
+//	targets:
+//	  nas:
+//	    mac: 10:ff:e0:cf:e6:0e
+//	    ip: 192.168.1.10
+//	    check: 192.168.1.10:22
+type inventoryFile struct {
+	Targets map[string]Target `json:"targets"`
+}
+
+// parseInventory parses and validates inventory file contents. JSON is
+// valid YAML, so both go through the YAML parser, then through JSON to
+// reuse the targets' JSON field names and duration format.
+func parseInventory(data []byte) (map[string]Target, error) {
+	var raw any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	asJSON, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var inv inventoryFile
+	if err := json.Unmarshal(asJSON, &inv); err != nil {
+		return nil, err
+	}
+	if len(inv.Targets) == 0 {
+		return nil, errors.New("no targets")
+	}
+	for name, t := range inv.Targets {
+		if err := t.Validate(false); err != nil {
+			return nil, fmt.Errorf("target %s: %w", name, err)
+		}
+		if t.Name == "" {
+			t.Name = name
+		}
+		inv.Targets[name] = t
+	}
+	return inv.Targets, nil
+}
+
+// loadInventory reads the inventory file and replaces the current targets.
+// On error the previous targets are kept.
+func (a *App) loadInventory() error {
+	info, err := os.Stat(a.Inventory)
+	if err != nil {
+		return fmt.Errorf("wake_on_lan: inventory: %w", err)
+	}
+	data, err := os.ReadFile(a.Inventory)
+	if err != nil {
+		return fmt.Errorf("wake_on_lan: inventory: %w", err)
+	}
+	a.mu.Lock()
+	// Remember the attempt even if it fails, so a broken file is reported
+	// once rather than on every poll
+	a.modTime, a.size = info.ModTime(), info.Size()
+	a.mu.Unlock()
+
+	targets, err := parseInventory(data)
+	if err != nil {
+		return fmt.Errorf("wake_on_lan: inventory %s: %w", a.Inventory, err)
+	}
+	a.mu.Lock()
+	a.targets = targets
+	// Targets from the file are replaced once the storage can be read
+	// again, changed or not
+	a.storageModTime, a.storageSize = time.Time{}, 0
+	a.mu.Unlock()
+	return nil
+}
+
+// watchInventory reloads the inventory whenever the file's modification
+// time or size changes, or with a storage key, whenever the key's does,
+// the file only being watched while the storage can't be read. It runs
+// until ctx is cancelled.
+func (a *App) watchInventory(ctx context.Context, poll time.Duration) {
+	defer close(a.done)
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if a.InventoryStorageKey != "" && a.pollStorageInventory(ctx) {
+			continue
+		}
+		if a.Inventory == "" {
+			continue
+		}
+		info, err := os.Stat(a.Inventory)
+		if err != nil {
+			continue
+		}
+		a.mu.RLock()
+		changed := !info.ModTime().Equal(a.modTime) || info.Size() != a.size
+		a.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := a.loadInventory(); err != nil {
+			a.logger.Error("reloading inventory; keeping the last good one", zap.Error(err))
+			continue
+		}
+		a.mu.RLock()
+		n := len(a.targets)
+		a.mu.RUnlock()
+		a.logger.Info("inventory reloaded", zap.String("path", a.Inventory), zap.Int("targets", n))
+	}
+}
@@ -0,0 +1,117 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// storageTimeout bounds each read of the inventory from storage.
+const storageTimeout = 10 * time.Second
+
+// loadStorageInventory reads the inventory from its key in Caddy's storage
+// and replaces the current targets. unavailable is true when the storage
+// couldn't be read, as opposed to holding an invalid inventory; either
+// way the previous targets are kept.
+func (a *App) loadStorageInventory(ctx context.Context) (unavailable bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	info, err := a.storage.Stat(ctx, a.InventoryStorageKey)
+	if err != nil {
+		return true, a.storageUnavailable(err)
+	}
+	data, err := a.storage.Load(ctx, a.InventoryStorageKey)
+	if err != nil {
+		return true, a.storageUnavailable(err)
+	}
+	a.mu.Lock()
+	a.storageErr = nil
+	// As for the file, a broken inventory is reported once
+	a.storageModTime, a.storageSize = info.Modified, info.Size
+	a.mu.Unlock()
+
+	targets, err := parseInventory(data)
+	if err != nil {
+		return false, fmt.Errorf("wake_on_lan: inventory in storage at %s: %w", a.InventoryStorageKey, err)
+	}
+	a.mu.Lock()
+	a.targets = targets
+	a.mu.Unlock()
+	return false, nil
+}
+
+// storageUnavailable records err as why the inventory couldn't be read
+// from storage and returns it wrapped.
+func (a *App) storageUnavailable(err error) error {
+	err = fmt.Errorf("wake_on_lan: inventory storage key %s: %w", a.InventoryStorageKey, err)
+	a.mu.Lock()
+	a.storageErr = err
+	a.mu.Unlock()
+	return err
+}
+
+// pollStorageInventory reloads the inventory from storage if its key
+// changed, reporting whether the storage could be read. While it can't,
+// the inventory file, if any, is watched instead.
+func (a *App) pollStorageInventory(ctx context.Context) bool {
+	statCtx, cancel := context.WithTimeout(ctx, storageTimeout)
+	info, err := a.storage.Stat(statCtx, a.InventoryStorageKey)
+	cancel()
+	a.mu.RLock()
+	wasUnavailable := a.storageErr != nil
+	changed := !info.Modified.Equal(a.storageModTime) || info.Size != a.storageSize
+	a.mu.RUnlock()
+	if err != nil {
+		err = a.storageUnavailable(err)
+		if !wasUnavailable {
+			a.logger.Warn("inventory storage unavailable; keeping the current inventory", zap.Error(err))
+		}
+		return false
+	}
+	if !changed {
+		if wasUnavailable {
+			a.mu.Lock()
+			a.storageErr = nil
+			a.mu.Unlock()
+			a.logger.Info("inventory storage available again", zap.String("storage_key", a.InventoryStorageKey))
+		}
+		return true
+	}
+	unavailable, err := a.loadStorageInventory(ctx)
+	switch {
+	case unavailable:
+		a.logger.Warn("inventory storage unavailable; keeping the current inventory", zap.Error(err))
+		return false
+	case err != nil:
+		a.logger.Error("reloading inventory; keeping the last good one", zap.Error(err))
+		return true
+	}
+	a.mu.RLock()
+	n := len(a.targets)
+	a.mu.RUnlock()
+	a.logger.Info("inventory reloaded", zap.String("storage_key", a.InventoryStorageKey), zap.Int("targets", n))
+	return true
+}
+
+// inventorySource describes where the inventory is read from, empty if
+// there is none.
+func (a *App) inventorySource() string {
+	if a.InventoryStorageKey != "" {
+		return "storage key " + a.InventoryStorageKey
+	}
+	return a.Inventory
+}
+
+// storeInventory writes data, a valid inventory, to the storage key and
+// loads it.
+func (a *App) storeInventory(ctx context.Context, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	if err := a.storage.Store(ctx, a.InventoryStorageKey, data); err != nil {
+		return a.storageUnavailable(err)
+	}
+	_, err := a.loadStorageInventory(ctx)
+	return err
+}
@@ -0,0 +1,221 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// flakyStorage is file storage that can be made unreachable, as a
+// networked storage backend might be.
+type flakyStorage struct {
+	certmagic.Storage
+	down atomic.Bool
+}
+
+var errStorageDown = errors.New("storage down")
+
+func (s *flakyStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if s.down.Load() {
+		return nil, errStorageDown
+	}
+	return s.Storage.Load(ctx, key)
+}
+
+func (s *flakyStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	if s.down.Load() {
+		return certmagic.KeyInfo{}, errStorageDown
+	}
+	return s.Storage.Stat(ctx, key)
+}
+
+// storageApp returns an app reading its inventory from the storage key
+// "inventory.json" of the returned storage, with a fallback inventory
+// file if file is set, and its logs.
+func storageApp(t *testing.T, file map[string]Target) (*App, *flakyStorage, *observer.ObservedLogs) {
+	t.Helper()
+	storage := &flakyStorage{Storage: &certmagic.FileStorage{Path: t.TempDir()}}
+	core, logs := observer.New(zapcore.DebugLevel)
+	a := &App{InventoryStorageKey: "inventory.json", storage: storage, logger: zap.New(core)}
+	if file != nil {
+		a.Inventory = filepath.Join(t.TempDir(), "inventory.json")
+		data, _ := json.Marshal(inventoryFile{Targets: file})
+		if err := os.WriteFile(a.Inventory, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a, storage, logs
+}
+
+// storeTargets writes an inventory holding targets to the storage key.
+func storeTargets(t *testing.T, s certmagic.Storage, targets map[string]Target) {
+	t.Helper()
+	data, _ := json.Marshal(inventoryFile{Targets: targets})
+	if err := s.Store(context.Background(), "inventory.json", data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInventoryStorageOption(t *testing.T) {
+	tests := []struct {
+		input    string
+		wantFile string
+		wantKey  string
+		wantErr  bool
+	}{
+		{input: "wake_on_lan_inventory {\n\tstorage wol/inventory.json\n}", wantKey: "wol/inventory.json"},
+		{input: "wake_on_lan_inventory /etc/wol.yaml {\n\tstorage wol/inventory.json\n}", wantFile: "/etc/wol.yaml", wantKey: "wol/inventory.json"},
+		{input: "wake_on_lan_inventory /etc/wol.yaml", wantFile: "/etc/wol.yaml"},
+		{input: "wake_on_lan_inventory", wantErr: true},
+		{input: "wake_on_lan_inventory {\n\tstorage\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			v, err := parseInventoryOption(caddyfile.NewTestDispenser(tt.input), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var app App
+			if err := json.Unmarshal(v.(httpcaddyfile.App).Value, &app); err != nil {
+				t.Fatal(err)
+			}
+			if app.Inventory != tt.wantFile || app.InventoryStorageKey != tt.wantKey {
+				t.Errorf("inventory %q, storage key %q; want %q, %q", app.Inventory, app.InventoryStorageKey, tt.wantFile, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestLoadStorageInventory(t *testing.T) {
+	a, storage, _ := storageApp(t, nil)
+	ctx := context.Background()
+
+	// Missing is unavailable: the key may not have been written yet
+	if unavailable, err := a.loadStorageInventory(ctx); !unavailable || err == nil {
+		t.Errorf("missing key: unavailable %v, error %v; want unavailable", unavailable, err)
+	}
+
+	storeTargets(t, storage, map[string]Target{"nas": {MAC: testMAC, IP: "192.0.2.1"}})
+	if unavailable, err := a.loadStorageInventory(ctx); unavailable || err != nil {
+		t.Fatalf("unavailable %v, error %v", unavailable, err)
+	}
+	if _, ok := a.target("nas"); !ok {
+		t.Error("target from storage not loaded")
+	}
+	if a.storageErr != nil {
+		t.Errorf("storage error %v after a good read", a.storageErr)
+	}
+
+	// A broken inventory is an error, but not unavailability
+	if err := storage.Store(ctx, "inventory.json", []byte("targets: [")); err != nil {
+		t.Fatal(err)
+	}
+	if unavailable, err := a.loadStorageInventory(ctx); unavailable || err == nil {
+		t.Errorf("broken inventory: unavailable %v, error %v; want an error", unavailable, err)
+	}
+	if _, ok := a.target("nas"); !ok {
+		t.Error("broken inventory replaced the last good one")
+	}
+
+	storage.down.Store(true)
+	if unavailable, err := a.loadStorageInventory(ctx); !unavailable || !errors.Is(err, errStorageDown) {
+		t.Errorf("storage down: unavailable %v, error %v; want unavailable", unavailable, err)
+	}
+	if !errors.Is(a.storageErr, errStorageDown) {
+		t.Errorf("storage error %v, want it recorded", a.storageErr)
+	}
+	if _, ok := a.target("nas"); !ok {
+		t.Error("targets dropped while the storage is down")
+	}
+}
+
+func TestPollStorageInventory(t *testing.T) {
+	a, storage, logs := storageApp(t, map[string]Target{"file": {MAC: "00:11:22:aa:bb:cc", IP: "192.0.2.9"}})
+	ctx := context.Background()
+	storeTargets(t, storage, map[string]Target{"nas": {MAC: testMAC, IP: "192.0.2.1"}})
+	if _, err := a.loadStorageInventory(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged: nothing reloaded
+	if !a.pollStorageInventory(ctx) {
+		t.Error("poll reported the storage unavailable")
+	}
+	if n := logs.FilterMessage("inventory reloaded").Len(); n != 0 {
+		t.Errorf("reloaded %d times without a change", n)
+	}
+
+	// Changed: reloaded
+	time.Sleep(10 * time.Millisecond)
+	storeTargets(t, storage, map[string]Target{"nas": {MAC: testMAC, IP: "192.0.2.1"}, "desktop": {MAC: "00:11:22:33:44:66", IP: "192.0.2.2"}})
+	if !a.pollStorageInventory(ctx) {
+		t.Error("poll reported the storage unavailable")
+	}
+	if _, ok := a.target("desktop"); !ok {
+		t.Error("changed inventory not reloaded")
+	}
+
+	// Down: the current inventory is kept, and the file watched instead
+	storage.down.Store(true)
+	for range 2 {
+		if a.pollStorageInventory(ctx) {
+			t.Error("poll reported the storage available while down")
+		}
+	}
+	if n := logs.FilterMessage("inventory storage unavailable; keeping the current inventory").Len(); n != 1 {
+		t.Errorf("warned %d times, want once", n)
+	}
+	if _, ok := a.target("desktop"); !ok {
+		t.Error("targets dropped while the storage is down")
+	}
+	if err := a.loadInventory(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.target("file"); !ok {
+		t.Fatal("fallback file not loaded")
+	}
+
+	// Back up: the storage's targets replace the file's, unchanged or not
+	storage.down.Store(false)
+	if !a.pollStorageInventory(ctx) {
+		t.Error("poll reported the storage unavailable once back")
+	}
+	if _, ok := a.target("nas"); !ok {
+		t.Error("storage inventory not reloaded once back")
+	}
+	if a.storageErr != nil {
+		t.Errorf("storage error %v once back", a.storageErr)
+	}
+}
+
+func TestStoreInventory(t *testing.T) {
+	a, storage, _ := storageApp(t, nil)
+	data, _ := json.Marshal(inventoryFile{Targets: map[string]Target{"nas": {MAC: testMAC, IP: "192.0.2.1"}}})
+	if err := a.storeInventory(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.target("nas"); !ok {
+		t.Error("stored inventory not loaded")
+	}
+	if got, err := storage.Load(context.Background(), "inventory.json"); err != nil || string(got) != string(data) {
+		t.Errorf("storage holds %q (%v), want %q", got, err, data)
+	}
+	if got := a.inventorySource(); got != "storage key inventory.json" {
+		t.Errorf("inventory source %q", got)
+	}
+}
@@ -0,0 +1,112 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// wakeStatus is the body json_response answers with: the outcome of the
+// target that failed first, or else of the first, and with several
+// targets each one's.
+type wakeStatus struct {
+	Target string `json:"target"`
+	Result string `json:"result"`
+	// Whether packets went out to the target
+	Sent bool `json:"sent"`
+	// Whether the target was confirmed up, woken or already
+	Confirmed bool `json:"confirmed"`
+	// How long the target's wake took, from its start until sent or,
+	// when waiting, until confirmed up or given up on
+	WakeDurationMS int64        `json:"wake_duration_ms"`
+	Error          *string      `json:"error"`
+	Targets        []wakeStatus `json:"targets,omitempty"`
+}
+
+// validateJSONResponse checks json_response against the settings that
+// answer the request some other way.
+func (w *WakeOnLAN) validateJSONResponse() error {
+	switch {
+	case !w.JSONResponse:
+		return nil
+	case w.AfterResponse || w.WaitingPage != nil || w.EarlyResponse != nil || w.BackoffResponse != nil || w.WakeOnFailure || w.ResponseDelay != nil:
+		return errors.New("json_response cannot be combined with after_response, waiting_page, early_response, backoff_response, wake_on_failure or response_delay, which answer the request otherwise")
+	case w.Action == actionSleep:
+		return errors.New("json_response only answers wakes; it cannot be combined with action sleep")
+	case w.IdempotencyKey != "":
+		return errors.New("json_response cannot be combined with idempotency_key, whose replays have no outcome to report")
+	case w.RetriableStatus != 0:
+		return errors.New("json_response cannot be combined with retriable_status; it answers failures with their own status")
+	}
+	return nil
+}
+
+// failedWake reports whether a wake that ended with r fails json_response:
+// as a failed send, or a host that didn't come up.
+func (r wakeResult) failedWake() bool {
+	return r.failed() || r == resultWakeTimeout || r == resultGroupFailed
+}
+
+// sent reports whether a wake that ended with r sent packets.
+func (r wakeResult) sent() bool {
+	return summaryAction(r) == summarySent
+}
+
+// newWakeStatus returns the json_response status of one target's outcome.
+func newWakeStatus(o summaryOutcome) wakeStatus {
+	s := wakeStatus{
+		Target:         o.target,
+		Result:         string(o.result),
+		Sent:           o.result.sent(),
+		Confirmed:      o.result.up(),
+		WakeDurationMS: o.took.Milliseconds(),
+	}
+	if o.err != "" {
+		s.Error = &o.err
+	}
+	return s
+}
+
+// writeJSONResponse answers r with the outcomes of its wakes as a JSON
+// body: 200 if every target succeeded, or else the status of the first
+// failure, such as 502 for a failed send or 504 for a host that didn't
+// come up.
+func (w *WakeOnLAN) writeJSONResponse(rw http.ResponseWriter, r *http.Request) error {
+	summary, ok := r.Context().Value(requestSummaryKey{}).(*requestSummary)
+	if !ok {
+		return caddyhttp.Error(http.StatusInternalServerError, errors.New("wake_on_lan: json_response: no outcome collected"))
+	}
+	summary.mu.Lock()
+	outcomes := summary.outcomes
+	summary.mu.Unlock()
+	if len(outcomes) == 0 {
+		return caddyhttp.Error(http.StatusInternalServerError, errors.New("wake_on_lan: json_response: no outcome collected"))
+	}
+	first := outcomes[0]
+	for _, o := range outcomes {
+		if o.result.failedWake() {
+			first = o
+			break
+		}
+	}
+	body := newWakeStatus(first)
+	if len(outcomes) > 1 {
+		for _, o := range outcomes {
+			body.Targets = append(body.Targets, newWakeStatus(o))
+		}
+	}
+	status := http.StatusOK
+	if first.result.failedWake() {
+		status = first.result.status()
+	}
+	out, err := json.Marshal(body)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, err = rw.Write(out)
+	return err
+}
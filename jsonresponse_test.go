@@ -0,0 +1,166 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestJSONResponseConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "json_response"},
+		{input: "json_response\n\tcheck 192.0.2.1:22\n\twait 1m"},
+		{input: "json_response yes", wantErr: true},
+		{input: "json_response\n\tafter_response", wantErr: true},
+		{input: "json_response\n\tretriable_status 503", wantErr: true},
+		{input: "json_response\n\taction sleep\n\tsleep_endpoint 192.0.2.1:9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.JSONResponse {
+				t.Error("json_response not set")
+			}
+		})
+	}
+}
+
+func TestServeHTTPJSONResponse(t *testing.T) {
+	up := newTCPHost(t)
+	tests := []struct {
+		name       string
+		w          func(port int) *WakeOnLAN
+		wantStatus int
+		want       wakeStatus
+		// the result of each target, with several
+		wantTargets []string
+		wantErr     bool
+		wantSent    bool
+		// the least the wake can have taken
+		wantMinDuration time.Duration
+	}{
+		{
+			name:       "sent",
+			w:          func(port int) *WakeOnLAN { return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port} },
+			wantStatus: http.StatusOK,
+			want:       wakeStatus{Target: testMAC, Result: string(resultSent), Sent: true},
+			wantSent:   true,
+		},
+		{
+			name: "already up",
+			w: func(port int) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port, Check: up.addr(), Wait: caddy.Duration(time.Second)}
+			},
+			wantStatus: http.StatusOK,
+			want:       wakeStatus{Target: testMAC, Result: string(resultAlreadyUp), Confirmed: true},
+		},
+		{
+			name: "never up",
+			w: func(port int) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port, Check: fmt.Sprintf("127.0.0.1:%d", closedPort(t)), Wait: caddy.Duration(300 * time.Millisecond)}
+			},
+			wantStatus: http.StatusGatewayTimeout,
+			want:       wakeStatus{Target: testMAC, Result: string(resultWakeTimeout), Sent: true},
+			wantSent:   true,
+			// Waited the whole wait
+			wantMinDuration: 300 * time.Millisecond,
+		},
+		{
+			name: "first failure",
+			w: func(port int) *WakeOnLAN {
+				return &WakeOnLAN{Targets: []Target{
+					{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: port},
+					{Name: "desktop", MAC: autoMAC, IP: "192.0.2.77"},
+				}}
+			},
+			wantStatus:  resultMACResolveFailed.status(),
+			want:        wakeStatus{Target: "desktop", Result: string(resultMACResolveFailed)},
+			wantTargets: []string{"nas=" + string(resultSent), "desktop=" + string(resultMACResolveFailed)},
+			wantErr:     true,
+			wantSent:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := tt.w(host.port())
+			w.JSONResponse = true
+			w = provisionTest(t, w)
+			rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if called {
+				t.Error("next handler called")
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type %q, want application/json", ct)
+			}
+			var got wakeStatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %q: %v", rec.Body, err)
+			}
+			if got.Target != tt.want.Target || got.Result != tt.want.Result || got.Sent != tt.want.Sent || got.Confirmed != tt.want.Confirmed {
+				t.Errorf("status %+v, want %+v", got, tt.want)
+			}
+			if (got.Error != nil) != tt.wantErr {
+				t.Errorf("error %v, want one %v", got.Error, tt.wantErr)
+			}
+			if !tt.wantErr && !strings.Contains(rec.Body.String(), `"error":null`) {
+				t.Errorf("body %s, want a null error", rec.Body)
+			}
+			if took := time.Duration(got.WakeDurationMS) * time.Millisecond; took < tt.wantMinDuration {
+				t.Errorf("wake_duration_ms %d, want at least %d", got.WakeDurationMS, tt.wantMinDuration.Milliseconds())
+			}
+			var targets []string
+			for _, s := range got.Targets {
+				targets = append(targets, s.Target+"="+s.Result)
+			}
+			if strings.Join(targets, " ") != strings.Join(tt.wantTargets, " ") {
+				t.Errorf("targets %q, want %q", targets, tt.wantTargets)
+			}
+			if tt.wantSent {
+				host.expect(t, 1)
+			} else {
+				host.expectNone(t)
+			}
+		})
+	}
+}
+
+func TestServeHTTPJSONResponseBulk(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{FromBody: true, JSONResponse: true})
+	body := fmt.Sprintf(`[{"mac":%q,"ip":"127.0.0.1","port":%d}]`, testMAC, host.port())
+	r := newTestRequest("POST", "http://example.com/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec, _, err := serveTest(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.expect(t, 1)
+	var results []bulkResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	if len(results) != 1 || results[0].Confirmed == nil || *results[0].Confirmed || results[0].WakeDurationMS == nil {
+		t.Errorf("results %s, want the entry unconfirmed, with its duration", rec.Body)
+	}
+}
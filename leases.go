@@ -0,0 +1,200 @@
+package caddy_wakeonlan
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// dhcpLeases maps IPs and client hostnames to the MACs that hold their
+// DHCP leases, as found in a dnsmasq or ISC dhcpd lease file. The file is
+// read again when its modification time or size changes.
+type dhcpLeases struct {
+	path   string
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	byIP    map[string]net.HardwareAddr
+	byHost  map[string]net.HardwareAddr
+}
+
+// openDHCPLeases reads the lease file at path, failing if it can't be read.
+func openDHCPLeases(path string, logger *zap.Logger) (*dhcpLeases, error) {
+	l := &dhcpLeases{path: path, logger: logger}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reload parses the file if it changed since it was last read.
+func (l *dhcpLeases) reload() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(l.modTime) && info.Size() == l.size && l.byIP != nil {
+		return nil
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	if looksLikeISCLeases(data) {
+		l.byIP, l.byHost = parseISCLeases(data)
+	} else {
+		l.byIP, l.byHost = parseDnsmasqLeases(data, time.Now())
+	}
+	l.modTime, l.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// lookup returns the MAC leased to the target's host or, once resolved, to
+// its address. A file that can't be read again is logged and its
+// previous contents used.
+func (l *dhcpLeases) lookup(host string, addr *net.UDPAddr) (net.HardwareAddr, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reload(); err != nil {
+		l.logger.Warn("reading DHCP leases; using the last read", zap.String("path", l.path), zap.Error(err))
+	}
+	if addr != nil {
+		if hw, ok := l.byIP[addr.IP.String()]; ok {
+			return hw, true
+		}
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return nil, false
+	}
+	// Leases carry the bare name a client sent, without a domain
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if hw, ok := l.byHost[host]; ok {
+		return hw, true
+	}
+	short, _, _ := strings.Cut(host, ".")
+	hw, ok := l.byHost[short]
+	return hw, ok
+}
+
+// looksLikeISCLeases reports whether data is in dhcpd.leases format, made
+// of "lease <ip> { ... }" blocks.
+func looksLikeISCLeases(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		return bytes.HasPrefix(line, []byte("lease ")) || bytes.HasPrefix(line, []byte("authoring-byte-order")) || bytes.HasPrefix(line, []byte("server-duid"))
+	}
+	return false
+}
+
+// parseDnsmasqLeases parses dnsmasq's lease file, one lease per line:
+//
+//	<expiry> <mac> <ip> <hostname|*> <client-id|*>
+//
+// Leases that expired before now are skipped; an expiry of 0 never
+// expires. DHCPv6 lines, which have no MAC, are skipped too.
+func parseDnsmasqLeases(data []byte, now time.Time) (map[string]net.HardwareAddr, map[string]net.HardwareAddr) {
+	byIP := make(map[string]net.HardwareAddr)
+	byHost := make(map[string]net.HardwareAddr)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || (expiry != 0 && time.Unix(expiry, 0).Before(now)) {
+			continue
+		}
+		hw, err := net.ParseMAC(fields[1])
+		if err != nil || len(hw) != 6 {
+			continue
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			continue
+		}
+		byIP[ip.String()] = hw
+		if name := fields[3]; name != "*" {
+			byHost[strings.ToLower(name)] = hw
+		}
+	}
+	return byIP, byHost
+}
+
+// parseISCLeases parses ISC dhcpd's lease file. It is a log: a later block
+// for an IP replaces earlier ones, and only leases whose binding state is
+// active (or unset, as in older files) count.
+//
+//	lease 192.168.1.10 {
+//	  binding state active;
+//	  hardware ethernet 10:ff:e0:cf:e6:0e;
+//	  client-hostname "nas";
+//	}
+func parseISCLeases(data []byte) (map[string]net.HardwareAddr, map[string]net.HardwareAddr) {
+	type lease struct {
+		hw     net.HardwareAddr
+		host   string
+		active bool
+	}
+	leases := make(map[string]lease)
+	var order []string
+	var ip string
+	var cur lease
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		switch {
+		case strings.HasPrefix(line, "lease ") && strings.HasSuffix(line, "{"):
+			ip = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "lease "), "{"))
+			cur = lease{active: true}
+		case ip == "":
+		case line == "}":
+			if parsed := net.ParseIP(ip); parsed != nil && cur.hw != nil {
+				key := parsed.String()
+				if _, ok := leases[key]; !ok {
+					order = append(order, key)
+				}
+				leases[key] = cur
+			}
+			ip = ""
+		case strings.HasPrefix(line, "binding state "):
+			cur.active = strings.TrimSuffix(strings.TrimPrefix(line, "binding state "), ";") == "active"
+		case strings.HasPrefix(line, "hardware ethernet "):
+			hw, err := net.ParseMAC(strings.TrimSuffix(strings.TrimPrefix(line, "hardware ethernet "), ";"))
+			if err == nil && len(hw) == 6 {
+				cur.hw = hw
+			}
+		case strings.HasPrefix(line, "client-hostname "):
+			cur.host = strings.Trim(strings.TrimSuffix(strings.TrimPrefix(line, "client-hostname "), ";"), `"`)
+		}
+	}
+
+	byIP := make(map[string]net.HardwareAddr)
+	byHost := make(map[string]net.HardwareAddr)
+	for _, key := range order {
+		l := leases[key]
+		if !l.active {
+			continue
+		}
+		byIP[key] = l.hw
+		if l.host != "" {
+			byHost[strings.ToLower(l.host)] = l.hw
+		}
+	}
+	return byIP, byHost
+}
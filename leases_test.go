@@ -0,0 +1,222 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestParseDHCPLeases(t *testing.T) {
+	dnsmasq, err := os.ReadFile("testdata/dnsmasq.leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	isc, err := os.ReadFile("testdata/dhcpd.leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	after := time.Unix(1893456000, 0).Add(time.Hour)
+	tests := []struct {
+		name       string
+		parse      func() (map[string]string, map[string]string)
+		wantByIP   map[string]string
+		wantByHost map[string]string
+	}{
+		{
+			name:  "dnsmasq",
+			parse: func() (map[string]string, map[string]string) { return hwStrings(parseDnsmasqLeases(dnsmasq, before)) },
+			wantByIP: map[string]string{
+				"192.168.1.10": "10:ff:e0:cf:e6:0e",
+				"192.168.1.11": "10:ff:e0:cf:e6:0f",
+				"192.168.1.12": "10:ff:e0:cf:e6:10",
+			},
+			wantByHost: map[string]string{"nas": "10:ff:e0:cf:e6:0e", "desktop": "10:ff:e0:cf:e6:0f"},
+		},
+		{
+			name:       "dnsmasq expired",
+			parse:      func() (map[string]string, map[string]string) { return hwStrings(parseDnsmasqLeases(dnsmasq, after)) },
+			wantByIP:   map[string]string{"192.168.1.10": "10:ff:e0:cf:e6:0e"},
+			wantByHost: map[string]string{"nas": "10:ff:e0:cf:e6:0e"},
+		},
+		{
+			name:       "isc",
+			parse:      func() (map[string]string, map[string]string) { return hwStrings(parseISCLeases(isc)) },
+			wantByIP:   map[string]string{"192.168.1.10": "10:ff:e0:cf:e6:0e"},
+			wantByHost: map[string]string{"nas": "10:ff:e0:cf:e6:0e"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			byIP, byHost := tt.parse()
+			if fmt.Sprint(byIP) != fmt.Sprint(tt.wantByIP) {
+				t.Errorf("by IP %v, want %v", byIP, tt.wantByIP)
+			}
+			if fmt.Sprint(byHost) != fmt.Sprint(tt.wantByHost) {
+				t.Errorf("by host %v, want %v", byHost, tt.wantByHost)
+			}
+		})
+	}
+}
+
+// hwStrings formats the MACs of lease maps, for comparing them.
+func hwStrings(byIP, byHost map[string]net.HardwareAddr) (map[string]string, map[string]string) {
+	format := func(m map[string]net.HardwareAddr) map[string]string {
+		out := make(map[string]string, len(m))
+		for k, hw := range m {
+			out[k] = hw.String()
+		}
+		return out
+	}
+	return format(byIP), format(byHost)
+}
+
+func TestLooksLikeISCLeases(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{data: "# dhcpd.leases\nlease 192.168.1.10 {\n}", want: true},
+		{data: "authoring-byte-order little-endian;\n", want: true},
+		{data: "server-duid \"\\000\";\n", want: true},
+		{data: "0 10:ff:e0:cf:e6:0e 192.168.1.10 nas *\n", want: false},
+		{data: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.data, func(t *testing.T) {
+			if got := looksLikeISCLeases([]byte(tt.data)); got != tt.want {
+				t.Errorf("looksLikeISCLeases = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeLeases writes a dnsmasq lease file of never-expiring leases, one
+// per "mac ip host" line, bumping its modification time so it is reread.
+func writeLeases(t *testing.T, path string, leases ...string) {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, l := range leases {
+		fmt.Fprintf(&buf, "0 %s *\n", l)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Now().Add(time.Duration(len(leases)) * time.Second)
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDHCPLeasesLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	writeLeases(t, path, "10:ff:e0:cf:e6:0e 192.168.1.10 nas")
+	l, err := openDHCPLeases(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		host string
+		ip   string
+		want string
+	}{
+		{name: "by IP", host: "192.168.1.10", ip: "192.168.1.10", want: "10:ff:e0:cf:e6:0e"},
+		{name: "by host", host: "nas", want: "10:ff:e0:cf:e6:0e"},
+		{name: "by FQDN", host: "NAS.example.com.", want: "10:ff:e0:cf:e6:0e"},
+		{name: "unknown IP", host: "192.168.1.99", ip: "192.168.1.99"},
+		{name: "unknown host", host: "desktop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addr *net.UDPAddr
+			if tt.ip != "" {
+				addr = &net.UDPAddr{IP: net.ParseIP(tt.ip), Port: 9}
+			}
+			hw, ok := l.lookup(tt.host, addr)
+			if ok != (tt.want != "") || (ok && hw.String() != tt.want) {
+				t.Errorf("lookup(%q) = %s, %v; want %q", tt.host, hw, ok, tt.want)
+			}
+		})
+	}
+
+	// A new NIC shows up in the file once it changes
+	writeLeases(t, path, "10:ff:e0:cf:e6:0e 192.168.1.10 nas", "10:ff:e0:cf:e6:99 192.168.1.11 desktop")
+	if hw, ok := l.lookup("desktop", nil); !ok || hw.String() != "10:ff:e0:cf:e6:99" {
+		t.Errorf("after the file changed, lookup(desktop) = %s, %v", hw, ok)
+	}
+	// A file gone missing keeps its last contents
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if hw, ok := l.lookup("nas", nil); !ok || hw.String() != "10:ff:e0:cf:e6:0e" {
+		t.Errorf("after the file went missing, lookup(nas) = %s, %v", hw, ok)
+	}
+}
+
+func TestDHCPLeasesConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "dnsmasq", input: "dhcp_leases testdata/dnsmasq.leases"},
+		{name: "isc", input: "dhcp_leases testdata/dhcpd.leases"},
+		{name: "missing path", input: "dhcp_leases", wantErr: true},
+		{name: "missing file", input: "dhcp_leases testdata/none.leases", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.168.1.10 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if err == nil {
+				ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+				defer cancel()
+				if err = w.Provision(ctx); err == nil {
+					w.Cleanup()
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeHTTPDHCPLeases(t *testing.T) {
+	const leased = "10:ff:e0:cf:e6:0e"
+	tests := []struct {
+		name    string
+		mac     string
+		leases  []string
+		wantMAC string
+	}{
+		{name: "leased", mac: testMAC, leases: []string{leased + " 127.0.0.1 nas"}, wantMAC: leased},
+		{name: "auto", mac: autoMAC, leases: []string{leased + " 127.0.0.1 nas"}, wantMAC: leased},
+		{name: "fallback", mac: testMAC, leases: []string{leased + " 192.168.1.10 nas"}, wantMAC: testMAC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+			writeLeases(t, path, tt.leases...)
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{MAC: tt.mac, IP: "127.0.0.1", Port: host.port(), DHCPLeases: path})
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			hw, _ := net.ParseMAC(tt.wantMAC)
+			if p := host.expect(t, 1)[0]; !bytes.Equal(p, buildMagicPacket(hw)) {
+				t.Errorf("packet % x, want the magic packet for %s", p, tt.wantMAC)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package caddy_wakeonlan
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// defaultRequestIDHeader is the request header read for a correlation ID.
+const defaultRequestIDHeader = "X-Request-ID"
+
+// requestLogger returns the handler's logger tagged with a wake_id that
+// correlates every log line of this request's wake. The ID comes from the
+// request ID header if present, or else Caddy's per-request UUID.
+func (w *WakeOnLAN) requestLogger(r *http.Request) *zap.Logger {
+	logger := w.logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return logger.With(zap.String("wake_id", w.wakeID(r)))
+}
+
+func (w *WakeOnLAN) wakeID(r *http.Request) string {
+	header := w.RequestIDHeader
+	if header == "" {
+		header = defaultRequestIDHeader
+	}
+	if id := r.Header.Get(header); id != "" {
+		return id
+	}
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		if id, ok := repl.GetString("http.request.uuid"); ok && id != "" {
+			return id
+		}
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,99 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logThrottle coalesces the error logs of a persistently failing target:
+// the first line for a target and kind of failure is logged, the repeats
+// within the interval are only counted and logged as one summary when it
+// ends. Once a whole interval passes without a repeat, the next failure is
+// logged in full again.
+type logThrottle struct {
+	interval time.Duration
+	logger   *zap.Logger
+
+	mu      sync.Mutex
+	entries map[throttleKey]*throttledLog
+}
+
+// throttleKey identifies the lines coalesced together.
+type throttleKey struct {
+	target string
+	kind   string
+}
+
+// throttledLog counts the lines suppressed since the last summary.
+type throttledLog struct {
+	level      zapcore.Level
+	suppressed int
+}
+
+func newLogThrottle(interval time.Duration, logger *zap.Logger) *logThrottle {
+	return &logThrottle{
+		interval: interval,
+		logger:   logger,
+		entries:  make(map[throttleKey]*throttledLog),
+	}
+}
+
+// allow reports whether a line of level about target failing with kind
+// should be logged, counting it for the next summary if not. A nil
+// throttle allows every line.
+func (l *logThrottle) allow(target, kind string, level zapcore.Level) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := throttleKey{target: target, kind: kind}
+	if e, ok := l.entries[key]; ok {
+		e.suppressed++
+		return false
+	}
+	l.entries[key] = &throttledLog{level: level}
+	return true
+}
+
+// flush logs a summary of every kind of failure repeated since the last
+// flush and forgets those that weren't.
+func (l *logThrottle) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, e := range l.entries {
+		if e.suppressed == 0 {
+			delete(l.entries, key)
+			continue
+		}
+		if ce := l.logger.Check(e.level, "repeated wake-on-lan failures"); ce != nil {
+			ce.Write(
+				zap.String("target", key.target),
+				zap.String("result", key.kind),
+				zap.Int("suppressed", e.suppressed),
+				zap.Duration("interval", l.interval),
+			)
+		}
+		e.suppressed = 0
+	}
+}
+
+// run flushes the summaries every interval until ctx is done, then one
+// last time.
+func (l *logThrottle) run(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.flush()
+			return
+		case <-ticker.C:
+			l.flush()
+		}
+	}
+}
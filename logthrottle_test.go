@@ -0,0 +1,171 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogThrottleConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "log_throttle 1m", want: time.Minute},
+		{input: "log_throttle 0s"},
+		{input: "log_throttle -1s", wantErr: true},
+		{input: "log_throttle", wantErr: true},
+		{input: "log_throttle often", wantErr: true},
+		{input: "log_throttle 1m 5m", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && time.Duration(w.LogThrottle) != tt.want {
+				t.Errorf("log_throttle = %s, want %s", time.Duration(w.LogThrottle), tt.want)
+			}
+		})
+	}
+}
+
+func TestLogThrottle(t *testing.T) {
+	type failure struct{ target, kind string }
+	tests := []struct {
+		name     string
+		failures []failure
+		// lines allowed through, and the suppressed count of each summary
+		// by target and kind
+		wantAllowed int
+		wantSummary map[failure]int64
+	}{
+		{name: "once", failures: []failure{{"nas", "send_failed"}}, wantAllowed: 1},
+		{
+			name:        "repeated",
+			failures:    []failure{{"nas", "send_failed"}, {"nas", "send_failed"}, {"nas", "send_failed"}},
+			wantAllowed: 1,
+			wantSummary: map[failure]int64{{"nas", "send_failed"}: 2},
+		},
+		{
+			name:        "by kind",
+			failures:    []failure{{"nas", "send_failed"}, {"nas", "resolve"}, {"nas", "resolve"}},
+			wantAllowed: 2,
+			wantSummary: map[failure]int64{{"nas", "resolve"}: 1},
+		},
+		{
+			name:        "by target",
+			failures:    []failure{{"nas", "send_failed"}, {"desktop", "send_failed"}, {"nas", "send_failed"}, {"desktop", "send_failed"}},
+			wantAllowed: 2,
+			wantSummary: map[failure]int64{{"nas", "send_failed"}: 1, {"desktop", "send_failed"}: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			l := newLogThrottle(time.Minute, zap.New(core))
+			allowed := 0
+			for _, f := range tt.failures {
+				if l.allow(f.target, f.kind, zapcore.ErrorLevel) {
+					allowed++
+				}
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("allowed %d lines, want %d", allowed, tt.wantAllowed)
+			}
+
+			l.flush()
+			summaries := logs.FilterMessage("repeated wake-on-lan failures").All()
+			if len(summaries) != len(tt.wantSummary) {
+				t.Fatalf("logged %d summaries, want %d", len(summaries), len(tt.wantSummary))
+			}
+			for _, s := range summaries {
+				fields := s.ContextMap()
+				target, _ := fields["target"].(string)
+				kind, _ := fields["result"].(string)
+				key := failure{target, kind}
+				if fields["suppressed"] != tt.wantSummary[key] || s.Level != zapcore.ErrorLevel {
+					t.Errorf("summary for %v: %v at %s, want %d suppressed", key, fields, s.Level, tt.wantSummary[key])
+				}
+			}
+
+			// A summarized kind stays throttled for another interval; the
+			// others are logged in full again, and after a quiet interval
+			// so are the summarized ones
+			for _, f := range tt.failures[:1] {
+				_, summarized := tt.wantSummary[f]
+				if got := l.allow(f.target, f.kind, zapcore.ErrorLevel); got == summarized {
+					t.Errorf("after the summary, %v allowed: %v, want %v", f, got, !summarized)
+				}
+			}
+			l.flush()
+			l.flush()
+			if f := tt.failures[0]; !l.allow(f.target, f.kind, zapcore.ErrorLevel) {
+				t.Errorf("after a quiet interval, %v throttled", f)
+			}
+		})
+	}
+}
+
+func TestServeHTTPLogThrottle(t *testing.T) {
+	// Every request fails to send to the closed TCP port
+	tests := []struct {
+		name        string
+		throttle    time.Duration
+		wantLogged  int
+		wantSummary bool
+	}{
+		{name: "unthrottled", wantLogged: 20},
+		{name: "throttled", throttle: time.Hour, wantLogged: 1, wantSummary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, &WakeOnLAN{
+				Name:        "nas",
+				MAC:         testMAC,
+				IP:          "127.0.0.1",
+				Port:        closedPort(t),
+				Protocol:    protocolTCP,
+				SendTimeout: caddy.Duration(time.Second),
+				LogThrottle: caddy.Duration(tt.throttle),
+			})
+			logs := observeLogs(w)
+			if w.logThrottle != nil {
+				w.logThrottle.logger = w.logger
+			}
+
+			for i := 0; i < 20; i++ {
+				rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+				if got := statusOf(rec, err); got != http.StatusNoContent {
+					t.Fatalf("request %d: status = %d, want %d (%v)", i+1, got, http.StatusNoContent, err)
+				}
+			}
+			if got := logs.FilterMessage("sending wake-on-lan packet").Len(); got != tt.wantLogged {
+				t.Errorf("logged %d send failures, want %d", got, tt.wantLogged)
+			}
+			if w.logThrottle != nil {
+				w.logThrottle.flush()
+			}
+			summaries := logs.FilterMessage("repeated wake-on-lan failures").All()
+			if got := len(summaries) == 1; got != tt.wantSummary {
+				t.Fatalf("logged %d summaries, want summary %v", len(summaries), tt.wantSummary)
+			}
+			if tt.wantSummary {
+				fields := summaries[0].ContextMap()
+				if fields["target"] != "nas" || fields["result"] != string(resultSendFailed) || fields["suppressed"] != int64(19) {
+					t.Errorf("summary %v, want 19 send_failed for nas", fields)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// loopbackTimeout bounds the whole loopback test: the send and waiting for
+// the packet to arrive.
+const loopbackTimeout = 2 * time.Second
+
+// loopbackRequest is the body of POST /wake_on_lan/loopback_test: either
+// the name or MAC of a running handler's target, or a target given inline.
+type loopbackRequest struct {
+	Target string `json:"target,omitempty"`
+
+	MAC            string `json:"mac,omitempty"`
+	SecureOn       string `json:"secureon,omitempty"`
+	PacketTemplate string `json:"packet_template,omitempty"`
+	Encoding       string `json:"encoding,omitempty"`
+	Checksum       string `json:"checksum,omitempty"`
+	PadTo          int    `json:"pad_to,omitempty"`
+}
+
+// loopbackResult is the response of POST /wake_on_lan/loopback_test.
+type loopbackResult struct {
+	Target string `json:"target"`
+	// The packet as built, and as it arrived, in hex
+	Expected string `json:"expected"`
+	Received string `json:"received"`
+	Length   int    `json:"length"`
+	Match    bool   `json:"match"`
+}
+
+// handleLoopbackTest sends the packet a target would get to a UDP listener
+// on loopback, spun up for the test, and reports what arrived. The packet
+// goes through the module's resolve and send path, so it checks SecureOn
+// passwords and templates on the wire without touching real hardware.
+func (adminAPI) handleLoopbackTest(rw http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	var req loopbackRequest
+	if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxAdminBodyBytes)).Decode(&req); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %w", err)}
+	}
+	t, opts, err := loopbackTarget(req)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	result, err := runLoopbackTest(r.Context(), t, opts)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(result)
+}
+
+// loopbackTarget returns the target to test and the options to build its
+// packet with: those of the handler it belongs to, or the defaults for an
+// inline one.
+func loopbackTarget(req loopbackRequest) (Target, sendOptions, error) {
+	if req.Target == "" {
+		t := Target{MAC: req.MAC, SecureOn: req.SecureOn, PacketTemplate: req.PacketTemplate, Encoding: req.Encoding, Checksum: req.Checksum}
+		if err := t.Validate(false); err != nil {
+			return Target{}, sendOptions{}, err
+		}
+		if err := t.validateChecksum(); err != nil {
+			return Target{}, sendOptions{}, err
+		}
+		return t, sendOptions{PadTo: req.PadTo}.withDefaults(), nil
+	}
+	if req.MAC != "" || req.SecureOn != "" || req.PacketTemplate != "" || req.Encoding != "" || req.Checksum != "" || req.PadTo != 0 {
+		return Target{}, sendOptions{}, errors.New("target cannot be combined with an inline target")
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for w := range registry.handlers {
+		for _, t := range w.allTargets() {
+			if t.label() == req.Target || macMatches(t, req.Target) {
+				return t, w.sendOptions(), nil
+			}
+		}
+	}
+	return Target{}, sendOptions{}, fmt.Errorf("no target named %q", req.Target)
+}
+
+// macMatches reports whether mac is t's fixed MAC, however written.
+func macMatches(t Target, mac string) bool {
+	hw, err := t.hardwareAddr()
+	if err != nil {
+		return false
+	}
+	want, err := parseMAC(mac)
+	return err == nil && bytes.Equal(hw, want)
+}
+
+// runLoopbackTest sends one packet for t to a fresh loopback listener and
+// returns what it received.
+func runLoopbackTest(ctx context.Context, t Target, opts sendOptions) (loopbackResult, error) {
+	hw, err := t.hardwareAddr()
+	if err != nil || isMACPattern(t.MAC) {
+		return loopbackResult{}, fmt.Errorf("target %s has no fixed MAC to test", t.label())
+	}
+	expected, err := buildPacket(t, hw, opts)
+	if err != nil {
+		return loopbackResult{}, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return loopbackResult{}, fmt.Errorf("opening loopback listener: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, loopbackTimeout)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return loopbackResult{}, err
+		}
+	}
+
+	// Only the packet itself is kept: where it goes, and how, is the test's
+	t.IP, t.Port = "127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port
+	t.SRV, t.MDNS, t.Interface = "", "", ""
+	opts.Transports = []string{protocolUDP}
+	opts.Broadcasts, opts.BroadcastConn, opts.SharedBroadcast, opts.SkipUnicast = nil, nil, nil, false
+	opts.Relays, opts.HelperSocket, opts.SourcePorts, opts.VRF = nil, "", nil, ""
+	opts.DHCPLeases, opts.SNMP, opts.Fuse = nil, nil, nil
+	if err := sendWOL(ctx, t, opts); err != nil {
+		return loopbackResult{}, fmt.Errorf("sending: %w", err)
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return loopbackResult{}, fmt.Errorf("receiving: %w", err)
+	}
+	return loopbackResult{
+		Target:   t.label(),
+		Expected: hex.EncodeToString(expected),
+		Received: hex.EncodeToString(buf[:n]),
+		Length:   n,
+		Match:    bytes.Equal(expected, buf[:n]),
+	}, nil
+}
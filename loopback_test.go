@@ -0,0 +1,68 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestHandleLoopbackTest(t *testing.T) {
+	mac, _ := parseMAC(testMAC)
+	standard := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(mac, 16)...)
+	secureOn := append(append([]byte{}, standard...), 1, 2, 3, 4, 5, 6)
+	provisionTest(t, &WakeOnLAN{Name: "loopback-test", MAC: testMAC, IP: "192.0.2.1", SecureOn: "01:02:03:04:05:06"})
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		want       []byte
+	}{
+		{name: "inline", body: `{"mac":"` + testMAC + `"}`, want: standard},
+		{name: "inline secureon", body: `{"mac":"` + testMAC + `","secureon":"01:02:03:04:05:06"}`, want: secureOn},
+		{name: "inline template", body: `{"mac":"` + testMAC + `","packet_template":"ff*6 {mac_bytes}*2"}`, want: append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(mac, 2)...)},
+		{name: "by name", body: `{"target":"loopback-test"}`, want: secureOn},
+		{name: "by MAC", body: `{"target":"00-11-22-33-44-55"}`, want: secureOn},
+		{name: "unknown target", body: `{"target":"nowhere"}`, wantStatus: http.StatusBadRequest},
+		{name: "target and inline", body: `{"target":"loopback-test","mac":"` + testMAC + `"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid MAC", body: `{"mac":"00:11:22"}`, wantStatus: http.StatusBadRequest},
+		{name: "MAC pattern", body: `{"mac":"00:11:22:33:44:**"}`, wantStatus: http.StatusInternalServerError},
+		{name: "not JSON", body: `mac=` + testMAC, wantStatus: http.StatusBadRequest},
+		{name: "GET", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			rec := httptest.NewRecorder()
+			err := adminAPI{}.handleLoopbackTest(rec, httptest.NewRequest(method, "/wake_on_lan/loopback_test", strings.NewReader(tt.body)))
+			if tt.wantStatus != 0 {
+				var apiErr caddy.APIError
+				if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.wantStatus {
+					t.Errorf("error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result loopbackResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatalf("decoding %q: %v", rec.Body, err)
+			}
+			if want := hex.EncodeToString(tt.want); result.Received != want || !result.Match || result.Length != len(tt.want) {
+				t.Errorf("result %+v, want %s received and matching", result, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// macKind names the hardware addresses net.ParseMAC accepts besides the
+// 6-byte Ethernet MAC, which no magic packet sent over IPv4 or as an
+// Ethernet frame can wake.
+func macKind(hw net.HardwareAddr) string {
+	switch len(hw) {
+	case 8:
+		return "EUI-64"
+	case 20:
+		return "InfiniBand"
+	}
+	return ""
+}
+
+// macFamilyMismatch returns why t's MAC obviously can't be woken where
+// its packets go, empty if it can or that isn't known before sending. An
+// 8-byte EUI-64 or 20-byte InfiniBand address is flagged with an IPv4 IP
+// or broadcast address, or with the raw_ethernet transport; with IPv6 or
+// a host name, and for "auto" MACs and patterns, nothing is.
+func (w *WakeOnLAN) macFamilyMismatch(t Target) string {
+	hw, err := t.hardwareAddr()
+	if err != nil || macKind(hw) == "" {
+		return ""
+	}
+	kind := macKind(hw)
+	if addr, err := netip.ParseAddr(t.IP); err == nil && addr.Unmap().Is4() {
+		return fmt.Sprintf("%d-byte %s MAC sent to over IPv4, at %s", len(hw), kind, t.IP)
+	}
+	if addr, err := netip.ParseAddr(w.Broadcast); err == nil && addr.Unmap().Is4() {
+		return fmt.Sprintf("%d-byte %s MAC broadcast over IPv4, to %s", len(hw), kind, w.Broadcast)
+	}
+	if slices.Contains(w.Transports, transportRawEthernet) {
+		return fmt.Sprintf("%d-byte %s MAC sent as an Ethernet frame, which carries 6-byte MACs", len(hw), kind)
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package caddy_wakeonlan
+
+import (
+	"strings"
+	"testing"
+)
+
+// MACs of the kinds net.ParseMAC accepts besides Ethernet's.
+const (
+	testEUI64      = "00:11:22:33:44:55:66:77"
+	testInfiniBand = "00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"
+)
+
+func TestMACKind(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want string
+	}{
+		{mac: testMAC, want: ""},
+		{mac: testEUI64, want: "EUI-64"},
+		{mac: testInfiniBand, want: "InfiniBand"},
+	}
+	for _, tt := range tests {
+		hw, err := parseMAC(tt.mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := macKind(hw); got != tt.want {
+			t.Errorf("macKind(%s) = %q, want %q", tt.mac, got, tt.want)
+		}
+	}
+}
+
+func TestMACFamilyMismatch(t *testing.T) {
+	tests := []struct {
+		name string
+		w    WakeOnLAN
+		t    Target
+		// part of the problem reported, empty for none
+		want string
+	}{
+		{name: "ethernet over IPv4", t: Target{MAC: testMAC, IP: "192.0.2.1"}},
+		{name: "EUI-64 over IPv4", t: Target{MAC: testEUI64, IP: "192.0.2.1"}, want: "8-byte EUI-64 MAC sent to over IPv4, at 192.0.2.1"},
+		{name: "InfiniBand over IPv4", t: Target{MAC: testInfiniBand, IP: "192.0.2.1"}, want: "20-byte InfiniBand MAC sent to over IPv4"},
+		{name: "IPv4-mapped", t: Target{MAC: testEUI64, IP: "::ffff:192.0.2.1"}, want: "over IPv4"},
+		{name: "over IPv6", t: Target{MAC: testEUI64, IP: "2001:db8::1"}},
+		{name: "host name", t: Target{MAC: testInfiniBand, IP: "ib.example.com"}},
+		{name: "IPv4 broadcast", w: WakeOnLAN{Broadcast: "192.0.2.255"}, t: Target{MAC: testEUI64}, want: "broadcast over IPv4, to 192.0.2.255"},
+		{name: "raw ethernet", w: WakeOnLAN{Transports: []string{transportRawEthernet}}, t: Target{MAC: testEUI64, IP: "2001:db8::1"}, want: "sent as an Ethernet frame"},
+		{name: "auto", t: Target{MAC: autoMAC, IP: "192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.w.macFamilyMismatch(tt.t)
+			if (got == "") != (tt.want == "") || !strings.Contains(got, tt.want) {
+				t.Errorf("problem %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStrictMACFamily(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "warns", input: "wake_on_lan " + testEUI64 + " 192.0.2.1"},
+		{name: "strict", input: "wake_on_lan " + testEUI64 + " 192.0.2.1 {\n\tstrict\n}", wantErr: true},
+		{name: "strict over IPv6", input: "wake_on_lan " + testEUI64 + " 2001:db8::1 {\n\tstrict\n}"},
+		{name: "strict ethernet", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tstrict\n}"},
+		{name: "strict with an argument", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tstrict yes\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Without strict, only a warning
+	w := provisionTest(t, &WakeOnLAN{MAC: testEUI64, IP: "192.0.2.1"})
+	logs := observeLogs(w)
+	w.warnSafety()
+	if logs.FilterMessage("MAC doesn't fit the destination; the target likely won't wake").Len() != 1 {
+		t.Error("no warning about the EUI-64 MAC sent over IPv4")
+	}
+}
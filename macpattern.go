@@ -0,0 +1,143 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// macWildcard stands for any value of one byte of a MAC pattern.
+const macWildcard = "**"
+
+// Bounds on how many MACs a pattern may expand to.
+const (
+	defaultMaxMACExpansion = 256
+	maxMACExpansion        = 65536
+)
+
+// isMACPattern reports whether mac has wildcard bytes, e.g.
+// 00:11:22:33:**:**.
+func isMACPattern(mac string) bool {
+	return strings.Contains(mac, macWildcard)
+}
+
+// parseMACPattern parses a MAC with wildcard bytes, returning the fixed
+// bytes and the positions of the wildcards.
+func parseMACPattern(pattern string) (net.HardwareAddr, []int, error) {
+	parts := strings.FieldsFunc(pattern, func(r rune) bool { return r == ':' || r == '-' })
+	if len(parts) != 6 {
+		return nil, nil, errors.New("MAC pattern must have 6 bytes")
+	}
+	hw := make(net.HardwareAddr, 6)
+	var wild []int
+	for i, part := range parts {
+		if part == macWildcard {
+			wild = append(wild, i)
+			continue
+		}
+		v, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return nil, nil, fmt.Errorf("invalid byte %q in MAC pattern", part)
+		}
+		hw[i] = byte(v)
+	}
+	if len(wild) == 0 {
+		return nil, nil, errors.New("MAC pattern has no wildcard bytes")
+	}
+	return hw, wild, nil
+}
+
+// macPatternSize returns how many MACs pattern expands to.
+func macPatternSize(pattern string) (int, error) {
+	_, wild, err := parseMACPattern(pattern)
+	if err != nil {
+		return 0, err
+	}
+	if len(wild) > 2 {
+		// Always over the hard cap
+		return maxMACExpansion + 1, nil
+	}
+	return 1 << (8 * len(wild)), nil
+}
+
+// expandMACPattern returns every MAC pattern matches, in order, failing if
+// there are more than limit (0 for the default).
+func expandMACPattern(pattern string, limit int) ([]net.HardwareAddr, error) {
+	if limit == 0 {
+		limit = defaultMaxMACExpansion
+	}
+	size, err := macPatternSize(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if size > limit {
+		return nil, fmt.Errorf("MAC pattern %s expands to more than %d addresses (max_mac_expansion)", pattern, limit)
+	}
+	base, wild, _ := parseMACPattern(pattern)
+	macs := make([]net.HardwareAddr, size)
+	for n := range macs {
+		hw := append(net.HardwareAddr(nil), base...)
+		// The last wildcard byte varies fastest
+		for i, v := len(wild)-1, n; i >= 0; i, v = i-1, v>>8 {
+			hw[wild[i]] = byte(v)
+		}
+		macs[n] = hw
+	}
+	return macs, nil
+}
+
+// validateMACPatterns checks the handler's pattern targets: they are sent
+// to the broadcast address only, and must stay within max_mac_expansion.
+func (w *WakeOnLAN) validateMACPatterns() error {
+	if w.MaxMACExpansion < 0 || w.MaxMACExpansion > maxMACExpansion {
+		return fmt.Errorf("invalid max_mac_expansion %d: must be at most %d", w.MaxMACExpansion, maxMACExpansion)
+	}
+	for _, t := range w.allTargets() {
+		if !isMACPattern(t.MAC) {
+			continue
+		}
+		if w.Broadcast == "" || w.relayed() {
+			return fmt.Errorf("target %s: MAC patterns require broadcast and can't be relayed", t.label())
+		}
+		if _, err := expandMACPattern(t.MAC, w.MaxMACExpansion); err != nil {
+			return fmt.Errorf("target %s: %w", t.label(), err)
+		}
+	}
+	return nil
+}
+
+// sendMACPattern broadcasts one packet for every MAC t's pattern matches.
+func sendMACPattern(ctx context.Context, t Target, port int, opts sendOptions) error {
+	macs, err := expandMACPattern(t.MAC, opts.MaxMACExpansion)
+	if err != nil {
+		return wakeError(ErrParseMAC, macResolveError{err})
+	}
+	if len(opts.Broadcasts) == 0 {
+		return errors.New("MAC patterns require a broadcast address")
+	}
+	for _, hw := range macs {
+		packet, err := buildPacket(t, hw, opts)
+		if err != nil {
+			return err
+		}
+		logPacket(opts, t, nil, packet)
+		// A broadcast that fails for one MAC fails for all of them
+		for _, broadcast := range opts.Broadcasts {
+			var err error
+			if opts.HelperSocket != "" {
+				h := helperBroadcast(broadcast, port, t.Interface)
+				recordHelperDelivery(ctx, h, hw, len(packet))
+				err = sendHelper(ctx, opts.HelperSocket, h, packet, opts.SendTimeout)
+			} else {
+				err = sendTargetBroadcast(ctx, t, broadcast, port, packet, opts)
+			}
+			if err != nil {
+				return deliveryError(err)
+			}
+		}
+	}
+	return nil
+}
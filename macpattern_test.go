@@ -0,0 +1,171 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseMACPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		wantBase string
+		wantWild []int
+		wantErr  bool
+	}{
+		{pattern: "00:11:22:33:44:**", wantBase: "00:11:22:33:44:00", wantWild: []int{5}},
+		{pattern: "00-11-22-33-**-**", wantBase: "00:11:22:33:00:00", wantWild: []int{4, 5}},
+		{pattern: "00:**:22:33:**:55", wantBase: "00:00:22:33:00:55", wantWild: []int{1, 4}},
+		{pattern: "00:11:22:33:**", wantErr: true},
+		{pattern: "00:11:22:33:44:55", wantErr: true},
+		{pattern: "00:11:22:33:4:**", wantErr: true},
+		{pattern: "00:11:22:33:zz:**", wantErr: true},
+		{pattern: "00:11:22:33:*:**", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			base, wild, err := parseMACPattern(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if base.String() != tt.wantBase {
+				t.Errorf("base = %s, want %s", base, tt.wantBase)
+			}
+			if !slices.Equal(wild, tt.wantWild) {
+				t.Errorf("wildcards = %v, want %v", wild, tt.wantWild)
+			}
+		})
+	}
+}
+
+func TestExpandMACPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		limit   int
+		// first, second and last MACs of the expansion
+		wantLen                       int
+		wantFirst, wantNext, wantLast string
+		wantErr                       bool
+	}{
+		{name: "one byte", pattern: "00:11:22:33:44:**", wantLen: 256, wantFirst: "00:11:22:33:44:00", wantNext: "00:11:22:33:44:01", wantLast: "00:11:22:33:44:ff"},
+		{name: "two bytes", pattern: "00:11:22:33:**:**", limit: maxMACExpansion, wantLen: 65536, wantFirst: "00:11:22:33:00:00", wantNext: "00:11:22:33:00:01", wantLast: "00:11:22:33:ff:ff"},
+		{name: "split bytes", pattern: "00:**:22:33:44:**", limit: maxMACExpansion, wantLen: 65536, wantFirst: "00:00:22:33:44:00", wantNext: "00:00:22:33:44:01", wantLast: "00:ff:22:33:44:ff"},
+		{name: "two bytes over the default cap", pattern: "00:11:22:33:**:**", wantErr: true},
+		{name: "one byte over a lower cap", pattern: "00:11:22:33:44:**", limit: 255, wantErr: true},
+		{name: "three bytes over the hard cap", pattern: "00:11:22:**:**:**", limit: maxMACExpansion, wantErr: true},
+		{name: "invalid", pattern: "00:11:22:33:**", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			macs, err := expandMACPattern(tt.pattern, tt.limit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(macs) != tt.wantLen {
+				t.Fatalf("expanded to %d MACs, want %d", len(macs), tt.wantLen)
+			}
+			if macs[0].String() != tt.wantFirst || macs[1].String() != tt.wantNext || macs[len(macs)-1].String() != tt.wantLast {
+				t.Errorf("expanded to %s, %s ... %s, want %s, %s ... %s", macs[0], macs[1], macs[len(macs)-1], tt.wantFirst, tt.wantNext, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestMACPatternConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{name: "default cap", input: "wake_on_lan 00:11:22:33:44:** {\n\tbroadcast 192.0.2.255\n}"},
+		{name: "raised cap", input: "wake_on_lan 00:11:22:33:**:** {\n\tbroadcast 192.0.2.255\n\tmax_mac_expansion 65536\n}", want: 65536},
+		{name: "over the cap", input: "wake_on_lan 00:11:22:33:**:** {\n\tbroadcast 192.0.2.255\n}", wantErr: true},
+		{name: "over the hard cap", input: "wake_on_lan 00:11:22:33:44:** {\n\tbroadcast 192.0.2.255\n\tmax_mac_expansion 65537\n}", wantErr: true},
+		{name: "negative cap", input: "wake_on_lan 00:11:22:33:44:** {\n\tbroadcast 192.0.2.255\n\tmax_mac_expansion -1\n}", wantErr: true},
+		{name: "cap without count", input: "wake_on_lan 00:11:22:33:44:** {\n\tbroadcast 192.0.2.255\n\tmax_mac_expansion\n}", wantErr: true},
+		{name: "without broadcast", input: "wake_on_lan 00:11:22:33:44:**", wantErr: true},
+		{name: "with IP", input: "wake_on_lan 00:11:22:33:44:** 192.0.2.1 {\n\tbroadcast 192.0.2.255\n}", wantErr: true},
+		{name: "relayed", input: "wake_on_lan 00:11:22:33:44:** {\n\tbroadcast 192.0.2.255\n\trelay 192.0.2.10:9\n}", wantErr: true},
+		{name: "short pattern", input: "wake_on_lan 00:11:22:33:** {\n\tbroadcast 192.0.2.255\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.MaxMACExpansion != tt.want {
+				t.Errorf("max_mac_expansion = %d, want %d", w.MaxMACExpansion, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPMACPattern(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:       "00:11:22:33:44:**",
+		Port:      host.port(),
+		Broadcast: "127.0.0.1",
+	})
+
+	// Drain the packets while they are sent, so none are dropped
+	done := make(chan [][]byte)
+	go func() {
+		var got [][]byte
+		timeout := time.After(5 * time.Second)
+		for len(got) < 256 {
+			select {
+			case p := <-host.packets:
+				got = append(got, p)
+			case <-timeout:
+				done <- got
+				return
+			}
+		}
+		done <- got
+	}()
+
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if got := statusOf(rec, err); got != http.StatusNoContent {
+		t.Errorf("status = %d, want %d (%v)", got, http.StatusNoContent, err)
+	}
+	got := <-done
+	if len(got) != 256 {
+		t.Fatalf("got %d packets, want 256", len(got))
+	}
+	for i, packet := range got {
+		want := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, byte(i)}
+		if !bytes.Equal(packet[6:12], want) {
+			t.Fatalf("packet %d is for %s, want %s", i, net.HardwareAddr(packet[6:12]), want)
+		}
+	}
+	host.expectNone(t)
+}
+
+func TestServeHTTPMACPatternFromRequest(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{FromQuery: &QueryParams{}, Broadcast: "127.0.0.1"})
+	r := newTestRequest("GET", "http://example.com/wake?mac=00:11:22:33:44:**&port="+strconv.Itoa(host.port()), nil)
+
+	rec, _, err := serveTest(w, r)
+	if got := statusOf(rec, err); got != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d (%v)", got, http.StatusBadRequest, err)
+	}
+	host.expectNone(t)
+}
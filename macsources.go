@@ -0,0 +1,313 @@
+package caddy_wakeonlan
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Sources of a target's MAC, as mac_sources names them.
+const (
+	macSourceStatic = "static"
+	macSourceEthers = "ethers"
+	macSourceDHCP   = "dhcp_leases"
+	macSourceSNMP   = "snmp"
+	macSourceARP    = "arp"
+)
+
+// defaultEthersFile is the ethers(5) file the ethers source reads.
+const defaultEthersFile = "/etc/ethers"
+
+// macSource is one source of the MAC to wake a target at.
+type macSource interface {
+	// lookupMAC returns t's MAC, looked up by its IP or its address addr
+	// (nil if it has none), and whether to send to the target itself
+	// rather than only to the broadcast addresses. A source with no entry
+	// for t returns a nil MAC and error, and one that can't tell an
+	// error; with a MAC, an error refuses it, ending the lookup.
+	lookupMAC(t Target, addr *net.UDPAddr, opts sendOptions) (hw net.HardwareAddr, unicast bool, err error)
+}
+
+// macSources are the sources mac_sources can list, by name.
+var macSources = map[string]macSource{
+	macSourceStatic: staticMACSource{},
+	macSourceEthers: ethersMACSource{},
+	macSourceDHCP:   dhcpMACSource{},
+	macSourceSNMP:   snmpMACSource{},
+	macSourceARP:    arpMACSource{},
+}
+
+// validateMACSources checks mac_sources and the settings its sources need.
+func (w *WakeOnLAN) validateMACSources() error {
+	if w.EthersFile != "" && !slices.Contains(w.MACSources, macSourceEthers) {
+		return errors.New("ethers_file requires ethers in mac_sources")
+	}
+	for i, name := range w.MACSources {
+		if _, ok := macSources[name]; !ok {
+			return fmt.Errorf("mac_sources: unknown source %q: want static, ethers, dhcp_leases, snmp or arp", name)
+		}
+		if slices.Contains(w.MACSources[:i], name) {
+			return fmt.Errorf("mac_sources: %s listed twice", name)
+		}
+		switch {
+		case name == macSourceDHCP && w.DHCPLeases == "":
+			return errors.New("mac_sources: dhcp_leases requires the dhcp_leases file")
+		case name == macSourceSNMP && w.SNMP == nil:
+			return errors.New("mac_sources: snmp requires the snmp switch")
+		}
+	}
+	return nil
+}
+
+// provisionEthers reads the ethers file if mac_sources lists ethers.
+func (w *WakeOnLAN) provisionEthers() error {
+	if !slices.Contains(w.MACSources, macSourceEthers) {
+		return nil
+	}
+	path := w.EthersFile
+	if path == "" {
+		path = defaultEthersFile
+	}
+	ethers, err := openEthers(path, w.logger)
+	if err != nil {
+		return fmt.Errorf("wake_on_lan: ethers: %w", err)
+	}
+	w.ethers = ethers
+	return nil
+}
+
+// sourceNames returns the MAC sources to try, in order: mac_sources, or
+// else the DHCP leases and the switch if set, then the configured MAC and,
+// for "auto", the neighbor table.
+func (opts sendOptions) sourceNames() []string {
+	if len(opts.MACSources) > 0 {
+		return opts.MACSources
+	}
+	var names []string
+	if opts.DHCPLeases != nil {
+		names = append(names, macSourceDHCP)
+	}
+	if opts.SNMP != nil {
+		names = append(names, macSourceSNMP)
+	}
+	return append(names, macSourceStatic, macSourceARP)
+}
+
+// staticMACSource is the MAC configured for the target, unless "auto".
+type staticMACSource struct{}
+
+func (staticMACSource) lookupMAC(t Target, _ *net.UDPAddr, _ sendOptions) (net.HardwareAddr, bool, error) {
+	if t.MAC == autoMAC {
+		return nil, false, nil
+	}
+	hw, err := t.hardwareAddr()
+	return hw, true, err
+}
+
+// ethersMACSource is the MAC an ethers(5) file lists for the target's host
+// name or address.
+type ethersMACSource struct{}
+
+func (ethersMACSource) lookupMAC(t Target, addr *net.UDPAddr, opts sendOptions) (net.HardwareAddr, bool, error) {
+	if opts.Ethers == nil {
+		return nil, false, nil
+	}
+	if hw, ok := opts.Ethers.lookup(t.IP, addr); ok {
+		return hw, true, checkOUI(opts.AllowOUI, hw)
+	}
+	return nil, false, nil
+}
+
+// dhcpMACSource is the MAC holding the target's DHCP lease.
+type dhcpMACSource struct{}
+
+func (dhcpMACSource) lookupMAC(t Target, addr *net.UDPAddr, opts sendOptions) (net.HardwareAddr, bool, error) {
+	if opts.DHCPLeases == nil {
+		return nil, false, nil
+	}
+	if hw, ok := opts.DHCPLeases.lookup(t.IP, addr); ok {
+		return hw, true, checkOUI(opts.AllowOUI, hw)
+	}
+	return nil, false, nil
+}
+
+// snmpMACSource is the MAC the switch's ARP table holds for the target's
+// address.
+type snmpMACSource struct{}
+
+func (snmpMACSource) lookupMAC(_ Target, addr *net.UDPAddr, opts sendOptions) (net.HardwareAddr, bool, error) {
+	if opts.SNMP == nil || addr == nil {
+		return nil, false, nil
+	}
+	if hw, ok := opts.SNMP.lookup(addr.IP); ok {
+		return hw, true, checkOUI(opts.AllowOUI, hw)
+	}
+	return nil, false, nil
+}
+
+// arpMACSource is the MAC the neighbor table holds for the target's
+// address. When the table has lost a MAC seen before and broadcast
+// addresses are set, that MAC is sent to them only: a sleeping host often
+// drops out of the table, and unicast to it then wouldn't arrive anyway.
+type arpMACSource struct{}
+
+func (arpMACSource) lookupMAC(t Target, addr *net.UDPAddr, opts sendOptions) (net.HardwareAddr, bool, error) {
+	if addr == nil {
+		if t.MAC == autoMAC {
+			return nil, false, errors.New("auto MAC requires an IP")
+		}
+		return nil, false, errors.New("no IP to look up in the neighbor table")
+	}
+	if opts.MACCache == nil {
+		hw, err := lookupNeighborMAC(addr.IP)
+		if err != nil {
+			return nil, false, err
+		}
+		return hw, true, checkOUI(opts.AllowOUI, hw)
+	}
+	hw, last, err := opts.MACCache.resolve(addr.IP, opts.MACCacheTTL, opts.MACMissTTL)
+	unicast := true
+	if err != nil {
+		if last == nil || len(opts.Broadcasts) == 0 {
+			return nil, false, err
+		}
+		hw, unicast = last, false
+	}
+	return hw, unicast, checkOUI(opts.AllowOUI, hw)
+}
+
+// ethersFile maps host names and IPs to the MACs an ethers(5) file lists
+// for them. The file is read again when its modification time or size
+// changes.
+type ethersFile struct {
+	path   string
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	byName  map[string]net.HardwareAddr
+}
+
+// openEthers reads the ethers file at path, failing if it can't be read.
+func openEthers(path string, logger *zap.Logger) (*ethersFile, error) {
+	e := &ethersFile{path: path, logger: logger}
+	if err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// reload parses the file if it changed since it was last read.
+func (e *ethersFile) reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(e.modTime) && info.Size() == e.size && e.byName != nil {
+		return nil
+	}
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	e.byName = parseEthers(data)
+	e.modTime, e.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// lookup returns the MAC listed for the target's host or, once resolved,
+// its address. A file that can't be read again is logged and its previous
+// contents used.
+func (e *ethersFile) lookup(host string, addr *net.UDPAddr) (net.HardwareAddr, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.reload(); err != nil {
+		e.logger.Warn("reading the ethers file; using the last read", zap.String("path", e.path), zap.Error(err))
+	}
+	if addr != nil {
+		if hw, ok := e.byName[addr.IP.String()]; ok {
+			return hw, true
+		}
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return nil, false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if hw, ok := e.byName[host]; ok {
+		return hw, true
+	}
+	short, _, _ := strings.Cut(host, ".")
+	hw, ok := e.byName[short]
+	return hw, ok
+}
+
+// parseEthers parses an ethers(5) file, one MAC and the host name or IP it
+// belongs to per line:
+//
+//	8:0:20:1:2:3 nas.lan
+//
+// Comments start with #; lines whose MAC doesn't parse are skipped. The
+// first entry of a host counts, and a host name is also listed without its
+// domain unless another entry has that name.
+func parseEthers(data []byte) map[string]net.HardwareAddr {
+	byName := make(map[string]net.HardwareAddr)
+	short := make(map[string]net.HardwareAddr)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		hw, err := parseEthersMAC(fields[0])
+		if err != nil {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSuffix(fields[1], "."))
+		if ip := net.ParseIP(name); ip != nil {
+			name = ip.String()
+		} else if host, _, ok := strings.Cut(name, "."); ok {
+			if _, ok := short[host]; !ok {
+				short[host] = hw
+			}
+		}
+		if _, ok := byName[name]; !ok {
+			byName[name] = hw
+		}
+	}
+	for host, hw := range short {
+		if _, ok := byName[host]; !ok {
+			byName[host] = hw
+		}
+	}
+	return byName
+}
+
+// parseEthersMAC parses a MAC of six hex bytes separated by colons or
+// dashes, whose leading zeros ethers files may leave out.
+func parseEthersMAC(s string) (net.HardwareAddr, error) {
+	parts := strings.Split(strings.ReplaceAll(s, "-", ":"), ":")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("invalid MAC %q", s)
+	}
+	hw := make(net.HardwareAddr, 6)
+	for i, p := range parts {
+		b, err := strconv.ParseUint(p, 16, 8)
+		if err != nil || len(p) > 2 {
+			return nil, fmt.Errorf("invalid MAC %q", s)
+		}
+		hw[i] = byte(b)
+	}
+	return hw, nil
+}
@@ -0,0 +1,225 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMACSourcesConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "sources", input: "mac_sources ethers static arp", want: []string{"ethers", "static", "arp"}},
+		{name: "ethers_file", input: "mac_sources ethers\n\tethers_file /etc/ethers.lan", want: []string{"ethers"}},
+		{name: "dhcp_leases", input: "mac_sources dhcp_leases static\n\tdhcp_leases testdata/dnsmasq.leases", want: []string{"dhcp_leases", "static"}},
+		{name: "empty", input: "mac_sources", wantErr: true},
+		{name: "unknown", input: "mac_sources static lldp", wantErr: true},
+		{name: "twice", input: "mac_sources static arp static", wantErr: true},
+		{name: "ethers_file without ethers", input: "mac_sources static\n\tethers_file /etc/ethers.lan", wantErr: true},
+		{name: "dhcp_leases without file", input: "mac_sources dhcp_leases", wantErr: true},
+		{name: "snmp without switch", input: "mac_sources snmp", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && strings.Join(w.MACSources, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("mac_sources %q, want %q", w.MACSources, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEthersMAC(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "8:0:20:1:2:3", want: "08:00:20:01:02:03"},
+		{input: "00:11:22:AA:bb:cc", want: "00:11:22:aa:bb:cc"},
+		{input: "00-11-22-aa-bb-cc", want: "00:11:22:aa:bb:cc"},
+		{input: "8:0:20:1:2", wantErr: true},
+		{input: "8:0:20:1:2:3:4", wantErr: true},
+		{input: "8:0:20:1:2:100", wantErr: true},
+		{input: "8:0:20:1:2:003", wantErr: true},
+		{input: "8:0:20:1:2:zz", wantErr: true},
+		{input: "8:0:20:1::3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			hw, err := parseEthersMAC(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && hw.String() != tt.want {
+				t.Errorf("MAC %s, want %s", hw, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEthers(t *testing.T) {
+	data := []byte(`# hosts on the LAN
+8:0:20:1:2:3	nas.lan.	# the NAS
+00:11:22:33:44:55 192.0.2.10
+00:11:22:33:44:66 NAS.lan
+00:11:22:33:44:77 printer.lan
+00:11:22:33:44:88 printer
+not-a-mac desktop
+00:11:22:33:44:99
+`)
+	got := make(map[string]string)
+	for name, hw := range parseEthers(data) {
+		got[name] = hw.String()
+	}
+	want := map[string]string{
+		// The first entry of a host counts
+		"nas.lan":     "08:00:20:01:02:03",
+		"nas":         "08:00:20:01:02:03",
+		"192.0.2.10":  "00:11:22:33:44:55",
+		"printer.lan": "00:11:22:33:44:77",
+		// An entry named so outranks the short name of another
+		"printer": "00:11:22:33:44:88",
+	}
+	if len(got) != len(want) {
+		t.Errorf("entries %v, want %v", got, want)
+	}
+	for name, hw := range want {
+		if got[name] != hw {
+			t.Errorf("%s: MAC %q, want %s", name, got[name], hw)
+		}
+	}
+}
+
+// writeEthers writes an ethers file of lines, bumping its modification
+// time so it is reread.
+func writeEthers(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Now().Add(time.Duration(len(lines)) * time.Second)
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEthersLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ethers")
+	writeEthers(t, path, "10:ff:e0:cf:e6:0e nas.lan", "10:ff:e0:cf:e6:0f 192.0.2.10")
+	e, err := openEthers(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		host string
+		ip   string
+		want string
+	}{
+		{name: "by IP", host: "192.0.2.10", ip: "192.0.2.10", want: "10:ff:e0:cf:e6:0f"},
+		{name: "by host", host: "NAS.lan.", want: "10:ff:e0:cf:e6:0e"},
+		{name: "by short name", host: "nas", want: "10:ff:e0:cf:e6:0e"},
+		{name: "by short name of another domain", host: "nas.example.com", want: "10:ff:e0:cf:e6:0e"},
+		{name: "IP before host", host: "nas.lan", ip: "192.0.2.10", want: "10:ff:e0:cf:e6:0f"},
+		{name: "unknown IP", host: "192.0.2.99", ip: "192.0.2.99"},
+		{name: "unknown host", host: "desktop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addr *net.UDPAddr
+			if tt.ip != "" {
+				addr = &net.UDPAddr{IP: net.ParseIP(tt.ip), Port: 9}
+			}
+			hw, ok := e.lookup(tt.host, addr)
+			if ok != (tt.want != "") || (ok && hw.String() != tt.want) {
+				t.Errorf("lookup(%q) = %s, %v; want %q", tt.host, hw, ok, tt.want)
+			}
+		})
+	}
+
+	writeEthers(t, path, "10:ff:e0:cf:e6:0e nas.lan", "10:ff:e0:cf:e6:10 desktop.lan", "10:ff:e0:cf:e6:0f 192.0.2.10")
+	if hw, ok := e.lookup("desktop", nil); !ok || hw.String() != "10:ff:e0:cf:e6:10" {
+		t.Errorf("after the file changed, lookup(desktop) = %s, %v", hw, ok)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if hw, ok := e.lookup("nas", nil); !ok || hw.String() != "10:ff:e0:cf:e6:0e" {
+		t.Errorf("after the file went missing, lookup(nas) = %s, %v", hw, ok)
+	}
+	if _, err := openEthers(path, zap.NewNop()); err == nil {
+		t.Error("missing file opened")
+	}
+}
+
+func TestTargetMACSources(t *testing.T) {
+	const listed = "10:ff:e0:cf:e6:0e"
+	path := filepath.Join(t.TempDir(), "ethers")
+	writeEthers(t, path, listed+" 192.0.2.1")
+	ethers, err := openEthers(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9}
+	tests := []struct {
+		name    string
+		sources []string
+		mac     string
+		addr    *net.UDPAddr
+		want    string
+		wantErr bool
+	}{
+		{name: "ethers first", sources: []string{"ethers", "static"}, mac: testMAC, addr: addr, want: listed},
+		{name: "static first", sources: []string{"static", "ethers"}, mac: testMAC, addr: addr, want: testMAC},
+		{name: "auto skips static", sources: []string{"static", "ethers"}, mac: autoMAC, addr: addr, want: listed},
+		{name: "not listed", sources: []string{"ethers", "static"}, mac: testMAC, addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 9}, want: testMAC},
+		{name: "none has it", sources: []string{"ethers"}, mac: autoMAC, addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 9}, wantErr: true},
+		{name: "arp without an address", sources: []string{"arp"}, mac: testMAC, wantErr: true},
+		// The default: the configured MAC, ethers unused
+		{name: "default", mac: testMAC, addr: addr, want: testMAC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := sendOptions{MACSources: tt.sources, Ethers: ethers}
+			hw, _, err := targetMAC(Target{MAC: tt.mac, IP: "192.0.2.1"}, tt.addr, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && hw.String() != tt.want {
+				t.Errorf("MAC %s, want %s", hw, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPMACSources(t *testing.T) {
+	const listed = "10:ff:e0:cf:e6:0e"
+	path := filepath.Join(t.TempDir(), "ethers")
+	writeEthers(t, path, listed+" 127.0.0.1")
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), MACSources: []string{"ethers", "static"}, EthersFile: path})
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	hw, _ := net.ParseMAC(listed)
+	if p := host.expect(t, 1)[0]; !bytes.Equal(p, buildMagicPacket(hw)) {
+		t.Errorf("packet % x, want the magic packet for %s", p, listed)
+	}
+}
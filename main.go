@@ -1,17 +1,28 @@
 package caddy_wakeonlan
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
 )
 
 // WakeOnLAN is an HTTP middleware handler that sends a Wake-On-LAN magic packet
@@ -19,13 +30,911 @@ import (
 //
 // Example Caddyfile usage:
 //
-//	wake_on_lan <mac> <ip> [port]
+//	wake_on_lan [<mac> [<ip> [port]]] {
+//		repeat <count>
+//		interval <duration>
+//		initial_delay <duration>
+//		target <mac> <ip> [port] {
+//			repeat <count>
+//			interval <duration>
+//			check <host:port>
+//			srv <record>
+//			mdns <name>
+//			name <friendly-name>
+//			secureon <password>
+//			packet_template <template>
+//			encoding standard|short|vendor:<name>
+//			checksum none|sum8|crc16|xor
+//			interface <name>
+//			ttl <n>
+//			depends_on <target-name...>
+//			weight <n>
+//			sites <site-name...>
+//			bmc [<endpoint>] {
+//				type redfish|ipmi
+//				endpoint <url|host[:port]>
+//				system <path>
+//				reset_type <type>
+//				username <name>
+//				password <password>
+//				ca <file>
+//				insecure_skip_verify
+//				timeout <duration>
+//			}
+//			meta {
+//				display_name <name>
+//				location <location>
+//				owner <owner>
+//			}
+//		}
+//		host_map {
+//			<hostname> <mac> <ip> [port]
+//		}
+//		sni_map {
+//			<server-name> <mac> <ip> [port]
+//		}
+//		resolve_retries <count>
+//		resolve_backoff <duration>
+//		prefer ipv4|ipv6|both [only]
+//		srv <record>
+//		mdns <name>
+//		mdns_timeout <duration>
+//		mdns_ttl <duration>
+//		check <host:port> [timeout]
+//		check_port_from_request [<placeholder>]
+//		wait <duration>
+//		on_timeout next|retry|error|notify
+//		on_timeout_retries <n>
+//		group <name>
+//		waiting_page [<file>|<html>] {
+//			refresh <duration>
+//		}
+//		response_delay <duration>|until_up [<max>]
+//		early_response [<estimate>]
+//		backoff_response [<initial> [<max>]] {
+//			initial <duration>
+//			max <duration>
+//			factor <n>
+//			ttl <duration>
+//		}
+//		maintenance_window [<reason>] {
+//			reason <text>
+//			timezone <zone>
+//			between <start> <end>
+//			recurring [<days>] <start> <end>
+//			status <code>
+//			body <text>
+//		}
+//		wait_http [<url>] {
+//			url <url>
+//			header <name> <value>
+//			expect_status <code...>
+//			up_status <code...>
+//			retry_status <code...>
+//			expect_body_contains <text>
+//			expect_body_regex <regexp>
+//			expect_json <path> <value>
+//			timeout <duration>
+//		}
+//		confirm_exec <command> [<args...>]
+//		confirm_exec_timeout <duration>
+//		wait_arp
+//		confirm_arp_learned
+//		ack [<port>] {
+//			port <port>
+//			timeout <duration>
+//		}
+//		confirm_tx
+//		confirm_listen [<port>] {
+//			port <port>
+//			from <ip>
+//			contains [hex] <data>
+//		}
+//		status_header <name>
+//		debug_header
+//		access_log_fields
+//		name <friendly-name>
+//		grace_period <duration>
+//		batch_window <duration>
+//		idempotency_key [<header>]
+//		idempotency_ttl <duration>
+//		header_overrides {
+//			repeat <max>
+//			wait <max>
+//			retries <max>
+//			clamp
+//		}
+//		ip <ip-or-host>
+//		broadcast <address>
+//		broadcast_source largest_subnet|default_route|all
+//		send_buffer <bytes>
+//		shared_broadcast_socket
+//		required
+//		strict
+//		strictness [off|warn|error] {
+//			mac_family|mac_group|loopback|shared_mac off|warn|error
+//		}
+//		json_errors
+//		json_response
+//		retriable_status <code>
+//		retriable_delay <duration>
+//		after_response
+//		admin_trigger
+//		cancel_on_client_disconnect
+//		mac_cache_ttl <duration>
+//		mac_miss_ttl <duration>
+//		dhcp_leases <path>
+//		snmp <switch> {
+//			version 2c|3
+//			community <string>
+//			user <name>
+//			auth <protocol> <passphrase>
+//			priv <protocol> <passphrase>
+//			oid <base>
+//			timeout <duration>
+//			cache_ttl <duration>
+//			check_on_load
+//		}
+//		mac_sources <source...>
+//		ethers_file <path>
+//		notify <url>
+//		notify_template <body>
+//		notify_timeout <duration>
+//		notify_transport <module> {
+//			...
+//		}
+//		on_wake_exec <command> [<args...>]
+//		on_wake_exec_timeout <duration>
+//		protocol udp|tcp
+//		transports <udp|tcp|raw_ethernet...>
+//		dedupe_sends
+//		transport <name>
+//		raw_interface <name>
+//		vrf <name>
+//		ttl <n>
+//		relay <host:port...>
+//		relay_strategy failover|parallel
+//		relay_protocol line|json
+//		site <name> <host:port...>
+//		helper_socket <path>
+//		publish <backend> <args...>
+//		grpc <host:port> {
+//			method /<package>.<service>/<method>
+//			plaintext
+//			ca <file>
+//			cert <file>
+//			key <file>
+//			server_name <name>
+//			token <token>
+//		}
+//		send_timeout <duration>
+//		escalate {
+//			unicast|broadcast|all_interfaces <wait>
+//		}
+//		send_until_up {
+//			interval <duration>
+//			max_packets <count>
+//			max_duration <duration>
+//			probe <host:port>
+//		}
+//		broadcast_fallback {
+//			after <count>
+//			interval <duration>
+//			subnet <cidr>|<mask>
+//		}
+//		once_per_boot {
+//			probe <host:port>
+//			rearm_interval <duration>
+//		}
+//		confirm_cache_ttl <duration>
+//		inventory <name...>
+//		profile <name>
+//		from_body
+//		from_query {
+//			mac|ip|port <param>
+//		}
+//		target_var <name>
+//		skip_if_var <name>
+//		dynamic
+//		max_body_targets <n>
+//		max_body_bytes <n>
+//		body_content_type <type>
+//		bulk_concurrency <n>
+//		rate <n>/<s|min|h>
+//		wake_budget <n>
+//		burst <n>
+//		trigger_threshold <n> <window>
+//		shared_limit <interval> {
+//			prefix <key>
+//			lock_timeout <duration>
+//			on_error open|closed
+//		}
+//		cooldown_jitter <duration>
+//		max_lifetime_packets <n>
+//		authorize <route>
+//		select all|random|round_robin|weighted|least_recent
+//		order serial|parallel|staggered
+//		stagger <duration>
+//		wake_on_failure
+//		on_websocket_upgrade
+//		upstream_retries <n>
+//		failure_status <code...>
+//		retry_delay <duration>
+//		allow_oui <prefix...>
+//		verify_mac_ip [allow|deny]
+//		allow_from <cidr...>
+//		deny_from <cidr...>
+//		source_port_range <lo>-<hi>
+//		socket_reuse addr|port|both
+//		retry_probe <host:port> [timeout]
+//		retry_ports <port...>
+//		warm_up
+//		self_test
+//		audit_log <path> {
+//			roll_size <size>
+//			roll_keep <count>
+//		}
+//		pad_to <bytes>
+//		max_mac_expansion <count>
+//		secureon <password>
+//		packet_template <template>
+//		encoding standard|short|vendor:<name>
+//		checksum none|sum8|crc16|xor
+//		warn_size <bytes>
+//		allow_large_packet
+//		request_id_header <name>
+//		log_throttle <interval>
+//		log_packet
+//		slow_send <threshold>
+//		summary_log
+//		action wake|sleep
+//		sleep_endpoint <host:port>
+//		sleep_payload [hex] <data>
+//	}
 //
 // If port is omitted, UDP/9 is used by default.
 type WakeOnLAN struct {
 	MAC  string `json:"mac,omitempty"`
 	IP   string `json:"ip,omitempty"`
 	Port int    `json:"port,omitempty"`
+	// SRV record (e.g. _wol._udp.example.com) to take the target's host,
+	// and its port unless set, from instead of IP.
+	SRV string `json:"srv,omitempty"`
+	// mDNS host, service or service instance in .local to discover the
+	// target's IP from instead of IP.
+	MDNS string `json:"mdns,omitempty"`
+	// How long an mDNS query waits for answers. Default: 2s.
+	MDNSTimeout caddy.Duration `json:"mdns_timeout,omitempty"`
+	// How long an address discovered over mDNS is reused. Default: 1m.
+	MDNSTTL caddy.Duration `json:"mdns_ttl,omitempty"`
+	// Friendly name for the target above, used in logs, metrics and the
+	// status header. Defaults to the MAC.
+	Name string `json:"name,omitempty"`
+	// SecureOn password for the target above.
+	SecureOn string `json:"secureon,omitempty"`
+
+	// How many packets to send to each target. Defaults to 1.
+	Repeat int `json:"repeat,omitempty"`
+	// How long to wait between repeated packets.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// How long to wait before the first packet of each wake, for devices
+	// that only accept a wake a moment after the request. It holds the
+	// response unless after_response is set. Defaults to 0.
+	InitialDelay caddy.Duration `json:"initial_delay,omitempty"`
+	// Address (host:port) probed over TCP before each repeated packet;
+	// once it accepts a connection the remaining repeats are skipped, so
+	// repeat becomes the maximum number of packets.
+	RetryProbe string `json:"retry_probe,omitempty"`
+	// Timeout for each retry probe. Default: 1s.
+	RetryProbeTimeout caddy.Duration `json:"retry_probe_timeout,omitempty"`
+	// Destination ports the repeated packets cycle through, one per
+	// packet, in place of each target's port: the first packet goes to
+	// the first port, the second to the next, and so on.
+	RetryPorts []int `json:"retry_ports,omitempty"`
+
+	// Additional machines to wake. Each target may override Repeat and
+	// Interval; unset values fall back to the handler-level ones.
+	Targets []Target `json:"targets,omitempty"`
+
+	// Maps request hostnames (optionally with a leading "*" label) to the
+	// target to wake for them. Requests for unmapped hosts wake the targets
+	// above, or get a 404 if there are none.
+	HostMap map[string]Target `json:"host_map,omitempty"`
+
+	// Maps the server names clients send in the TLS handshake (SNI),
+	// optionally with a leading "*" label, to the target to wake for
+	// them, ahead of host_map. Requests without SNI, such as plain HTTP
+	// ones, or with an unmapped name wake host_map's or the targets
+	// above; with none, those without SNI are passed on without waking
+	// and the others get a 404.
+	SNIMap map[string]Target `json:"sni_map,omitempty"`
+
+	// How many times to retry a failed hostname lookup before giving up on
+	// a packet, at most 100. Defaults to 0 (no retries).
+	ResolveRetries int `json:"resolve_retries,omitempty"`
+	// Delay before the first lookup retry; it doubles after each attempt,
+	// up to 30s. Defaults to 250ms.
+	ResolveBackoff caddy.Duration `json:"resolve_backoff,omitempty"`
+	// Family whose address is sent to when a hostname resolves to both:
+	// "ipv4", "ipv6", or "both" to take the resolver's first answer.
+	// Defaults to IPv4, like Go's own resolution.
+	Prefer string `json:"prefer,omitempty"`
+	// If true, a hostname without an address of the Prefer family fails
+	// instead of falling back to the other.
+	PreferOnly bool `json:"prefer_only,omitempty"`
+
+	// Address (host:port) probed over TCP to tell whether a target is up.
+	// While it accepts connections, no packet is sent. Targets may set
+	// their own address.
+	Check string `json:"check,omitempty"`
+	// Placeholder for the port to probe each target's check address at on
+	// a request, instead of its own, e.g. {http.request.local.port} for the
+	// port the client connected to. Wakes without a request, such as
+	// scheduled ones, keep the address's port.
+	CheckPortFromRequest string `json:"check_port_from_request,omitempty"`
+	// Timeout for a single probe of Check. Defaults to 1s.
+	CheckTimeout caddy.Duration `json:"check_timeout,omitempty"`
+	// How long to wait for Check to come up after sending, before calling
+	// the next handler. Defaults to 0 (don't wait).
+	Wait caddy.Duration `json:"wait,omitempty"`
+	// What to do when a target was sent to but didn't come up within the
+	// wait: "next" (the default) calls the next handler anyway, "retry"
+	// wakes it again up to OnTimeoutRetries times, "error" fails the
+	// request with 504 and "notify" proceeds after the webhook was told.
+	OnTimeout string `json:"on_timeout,omitempty"`
+	// How often on_timeout retry wakes again. Default: 2.
+	OnTimeoutRetries int `json:"on_timeout_retries,omitempty"`
+	// If set, the targets are woken as a group of this name: the request
+	// only proceeds once every one of them came up within the wait, and
+	// otherwise fails with 504 listing each member's result, whatever
+	// required says. Members that came up are left running.
+	Group string `json:"group,omitempty"`
+	// If set, requests don't wait for the targets: until every target's
+	// check address is up, each request sends the packets and gets this
+	// self-refreshing page with a 503 instead of reaching the next handler.
+	WaitingPage *WaitingPage `json:"waiting_page,omitempty"`
+	// If set, requests don't wait for the targets either: until every
+	// target is up, each request sends the packets and gets a 425 Too Early
+	// with a Retry-After of the estimated boot time left. The wait is how
+	// long a wake is watched to measure that time.
+	EarlyResponse *EarlyResponse `json:"early_response,omitempty"`
+	// If set, requests don't wait for the targets either: until every
+	// target is up, each request probes them, sending the packets to those
+	// down, and gets a 503 with a Retry-After that grows with each retry
+	// of the same client.
+	BackoffResponse *BackoffResponse `json:"backoff_response,omitempty"`
+	// If set, wakes are suppressed while one of its periods is on: the
+	// requests are answered with its status and body instead, with
+	// nothing sent and the next handler not run.
+	MaintenanceWindow *MaintenanceWindow `json:"maintenance_window,omitempty"`
+	// If set, the next handler, such as a respond or redir, only runs a
+	// while after packets were sent, or once the targets are up, so the
+	// response doesn't send the client to a host still booting.
+	ResponseDelay *ResponseDelay `json:"response_delay,omitempty"`
+	// If set, a target only counts as up once this HTTP readiness check
+	// passes too, after its check address, if any, accepts connections.
+	// Requires wait.
+	WaitHTTP *WaitHTTP `json:"wait_http,omitempty"`
+	// Command and arguments run to confirm a target up, after its check
+	// address and wait_http, if any: it counts as up once the command
+	// exits with 0, and the command runs again until then. The target is
+	// in the WAKE_TARGET, WAKE_MAC, WAKE_IP, WAKE_PORT and WAKE_CHECK
+	// environment variables; its output is logged. Requires wait, and
+	// only allowed with allow_exec in the wake_on_lan app.
+	ConfirmExec []string `json:"confirm_exec,omitempty"`
+	// Time after which one run of the confirm_exec command is killed and
+	// counts as not up. Default: 5s.
+	ConfirmExecTimeout caddy.Duration `json:"confirm_exec_timeout,omitempty"`
+	// If true, targets without a check address count as up once the
+	// neighbor (ARP) table shows their IP answering, for devices that open
+	// no port to check. Requires wait and an IP on those targets.
+	WaitARP bool `json:"wait_arp,omitempty"`
+	// If true, like WaitARP, but targets only count as up once the
+	// neighbor table learns their entry anew after the send, not while an
+	// entry from before is still reachable. Requires wait and an IP on
+	// those targets.
+	ConfirmARPLearned bool `json:"confirm_arp_learned,omitempty"`
+	// If set, a target only counts as up once it sends a matching datagram
+	// to this port, after its check address, if any, accepts connections.
+	// Requires wait.
+	ConfirmListen *ConfirmListen `json:"confirm_listen,omitempty"`
+	// If set, an agent on the target's segment is asked to acknowledge
+	// each wake's packets; a wake it acknowledges reports ack_received
+	// instead of sent when there is nothing to wait for.
+	Ack *Ack `json:"ack,omitempty"`
+	// If set, the TX packet counter of the interface the packets leave
+	// through is read before and after the send, on Linux; a wake it saw
+	// leave reports tx_confirmed instead of sent when there is nothing to
+	// wait for.
+	ConfirmTX bool `json:"confirm_tx,omitempty"`
+
+	// If set, the outcome for each target is added to the response under
+	// this header name.
+	StatusHeader string `json:"status_header,omitempty"`
+	// If set, an X-Wake-Debug response header describes each packet sent
+	// for the request: its destination, size, transport and interface as
+	// resolved, with the target's result. Off by default, as it reveals
+	// the network's internals.
+	DebugHeader bool `json:"debug_header,omitempty"`
+	// If true, the outcome the result variables describe is also added
+	// to the request's access log entry, as the fields wake_on_lan_target,
+	// wake_on_lan_result and wake_on_lan_error.
+	AccessLogFields bool `json:"access_log_fields,omitempty"`
+
+	// Requests for a target that is already being woken share that wake and
+	// its wait. For this long after a packet was sent, new requests wait for
+	// the target again instead of sending another packet. Defaults to 0
+	// (every request wakes independently).
+	GracePeriod caddy.Duration `json:"grace_period,omitempty"`
+	// Requests for the same target arriving within this long of the first
+	// are collected and woken with a single send once it has passed, all
+	// sharing its result. Defaults to 0 (no batching).
+	BatchWindow caddy.Duration `json:"batch_window,omitempty"`
+	// Name of a request header, such as Idempotency-Key, carrying a key
+	// the client picks per wake. A request repeating a key within
+	// IdempotencyTTL gets the first one's outcome instead of waking again,
+	// so clients can retry a request that timed out.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// How long the outcome for a key is kept. Default: 10m.
+	IdempotencyTTL caddy.Duration `json:"idempotency_ttl,omitempty"`
+	// Lets requests set repeat, wait and on_timeout_retries with the
+	// X-Wake-Repeat, X-Wake-Wait and X-Wake-Retries headers, up to the caps
+	// it sets. Default: disabled.
+	HeaderOverrides *HeaderOverrides `json:"header_overrides,omitempty"`
+
+	// What the handler does: "wake" (the default) sends the magic packet;
+	// "sleep" sends SleepPayload to SleepEndpoint instead, for use with an
+	// agent on the target that suspends it.
+	Action string `json:"action,omitempty"`
+	// UDP host:port of the agent receiving sleep commands.
+	SleepEndpoint string `json:"sleep_endpoint,omitempty"`
+	// The datagram sent as the sleep command.
+	SleepPayload []byte `json:"sleep_payload,omitempty"`
+
+	// IPv4 broadcast address (e.g. 192.168.1.255) to send every packet to,
+	// in addition to each target's IP. Targets may then omit their IP.
+	// Packets go out on one socket opened at provision time.
+	Broadcast string `json:"broadcast,omitempty"`
+	// Which interfaces packets to 255.255.255.255 leave through on a
+	// multi-homed host: "largest_subnet", "default_route" or "all".
+	// Default: whichever the system routes them to.
+	BroadcastSource string `json:"broadcast_source,omitempty"`
+	// Size in bytes of the send buffer (SO_SNDBUF) of the socket
+	// broadcasts share, for bursts of many packets, 4096 to 16 MiB. The
+	// system may round or clamp it; the size it settled on is logged.
+	// Default: the system's.
+	SendBuffer int `json:"send_buffer,omitempty"`
+	// If true, broadcasts go out on sockets opened once per interface
+	// and shared by every target and every handler setting it, kept
+	// across config reloads until no handler uses them. Broadcasts with a
+	// target ttl still get a socket each.
+	SharedBroadcastSocket bool `json:"shared_broadcast_socket,omitempty"`
+
+	// If true, a failed send ends the request with an error instead of
+	// calling the next handler: 500 when the MAC could not be determined,
+	// 502 when the packet could not be delivered.
+	Required bool `json:"required,omitempty"`
+	// If true, a target whose MAC obviously can't be woken where its
+	// packets go, such as an InfiniBand address sent to over IPv4, fails
+	// the config instead of logging a warning: the mac_family check at
+	// level error, unless StrictChecks sets it.
+	Strict bool `json:"strict,omitempty"`
+	// Level of every safety check run on the targets when the config
+	// loads: "off" skips them, "warn" (the default) logs the issues found
+	// and "error" fails the config.
+	Strictness string `json:"strictness,omitempty"`
+	// Levels of single checks, by name (mac_family, mac_group, loopback
+	// or shared_mac), overriding Strictness.
+	StrictChecks map[string]string `json:"strict_checks,omitempty"`
+
+	// If true, required failures are answered with a JSON body such as
+	// {"error":"send_failed","detail":"..."} instead of Caddy's error
+	// handling.
+	JSONErrors bool `json:"json_errors,omitempty"`
+	// If true, the handler answers each request it wakes targets for
+	// itself instead of calling the next handler, with a JSON body such as
+	// {"target":"nas","result":"woken","sent":true,"confirmed":true,
+	// "wake_duration_ms":1234,"error":null}: 200 if every target
+	// succeeded, or else the status of the first failure, 502 for a failed
+	// send and 504 for a host that didn't come up. With FromBody, each
+	// entry also gets confirmed and wake_duration_ms.
+	JSONResponse bool `json:"json_response,omitempty"`
+	// Status that failures running the wake again may fix (send_failed,
+	// mac_resolve_failed, busy, wake_timeout, group_failed and
+	// dependency_down) fail the request with instead of their own, with an
+	// error starting "wake_on_lan: retriable wake failure" and the
+	// wake_on_lan.retriable variable set to "true", for a handle_errors
+	// route to match and run the wake again. Default: 0 (their own).
+	RetriableStatus int `json:"retriable_status,omitempty"`
+	// How long such a failure waits before failing the request, pacing a
+	// handle_errors route that runs the wake again. Default: 0.
+	RetriableDelay caddy.Duration `json:"retriable_delay,omitempty"`
+
+	// If true, the next handler runs first and the packets go out once it
+	// has returned, so waking adds nothing to the response time. The wake
+	// then outlives the request, bounded by the config's lifetime; it
+	// cannot be combined with required, wait or status_header.
+	AfterResponse bool `json:"after_response,omitempty"`
+	// If true, the handler's configured targets can also be woken through
+	// the admin API, with POST /wake_on_lan/@<target>, e.g. by a DNS server
+	// when the target's name is looked up. The wake runs in the background
+	// under the handler's settings, one per target at a time.
+	AdminTrigger bool `json:"admin_trigger,omitempty"`
+	// If true, a client going away ends the wakes it started, sends,
+	// waits and send_until_up loops alike, with the client_disconnected
+	// result. By default they carry on to the end, bounded by the config's
+	// lifetime, so the host still comes up for the next request.
+	CancelOnClientDisconnect bool `json:"cancel_on_client_disconnect,omitempty"`
+
+	// How long a MAC looked up for an "auto" target is reused. Default: 5m.
+	MACCacheTTL caddy.Duration `json:"mac_cache_ttl,omitempty"`
+	// How long a failed "auto" lookup is remembered before the neighbor
+	// table is consulted again. Default: 10s.
+	MACMissTTL caddy.Duration `json:"mac_miss_ttl,omitempty"`
+	// dnsmasq or ISC dhcpd lease file to take each target's MAC from at
+	// send time, by its IP or hostname. Targets without a lease fall back
+	// to their configured MAC ("auto" then uses the neighbor table).
+	DHCPLeases string `json:"dhcp_leases,omitempty"`
+	// Switch to look up each target's MAC from its IP over SNMP at send
+	// time. Targets the switch has no entry for, or every target while it
+	// can't be queried, fall back to their configured MAC.
+	SNMP *SNMP `json:"snmp,omitempty"`
+	// Sources to take each target's MAC from, tried in order until one
+	// has it: "static" (the configured MAC), "ethers" (an ethers(5)
+	// file), "dhcp_leases", "snmp" and "arp" (the neighbor table).
+	// Default: dhcp_leases and snmp if set, then static and arp.
+	MACSources []string `json:"mac_sources,omitempty"`
+	// ethers(5) file the ethers source reads. Default: /etc/ethers.
+	EthersFile string `json:"ethers_file,omitempty"`
+
+	// Protocol the packet is sent to each target's IP with: "udp" (the
+	// default) or "tcp", for devices that only accept it over TCP.
+	// Broadcasts are always UDP.
+	Protocol string `json:"protocol,omitempty"`
+	// Transports to send each target's packet over, all of them every
+	// time: "udp", "tcp", "raw_ethernet" or the name of a Sender a plugin
+	// registered. Replaces protocol. raw_ethernet broadcasts a layer 2
+	// frame on RawInterface and is skipped with a warning where
+	// unsupported (outside Linux).
+	Transports []string `json:"transports,omitempty"`
+	// If true, a packet another handler with DedupeSends already sent to
+	// the same host over the same transport, or broadcast address, while
+	// serving the request isn't sent again, for chains composing handlers
+	// that wake overlapping targets.
+	DedupeSends bool `json:"dedupe_sends,omitempty"`
+	// Network interface raw ethernet frames are sent on.
+	RawInterface string `json:"raw_interface,omitempty"`
+	// Linux VRF device to send packets from, so they are routed by its
+	// table rather than the main one. Targets with their own interface
+	// use that instead.
+	VRF string `json:"vrf,omitempty"`
+	// Hop limit of the UDP packets sent to targets without their own, so
+	// directed broadcasts can cross routers to another segment, or are
+	// kept from doing so. Default: the system's.
+	TTL int `json:"ttl,omitempty"`
+	// host:port of a WOL relay on the target's LAN to hand each wake to
+	// over TCP, instead of sending packets from here.
+	Relay string `json:"relay,omitempty"`
+	// host:port of several relays, instead of Relay, tried as
+	// RelayStrategy says.
+	Relays []string `json:"relays,omitempty"`
+	// How a wake uses the relays: "failover" (the default) tries them in
+	// order until one accepts it, "parallel" hands it to all at once and
+	// succeeds if any accepts it.
+	RelayStrategy string `json:"relay_strategy,omitempty"`
+	// Wire format the relay speaks: "line" (the default; the MAC on a
+	// line, answered with "OK") or "json".
+	RelayProtocol string `json:"relay_protocol,omitempty"`
+	// Relays by site, instead of Relay, for targets that may be on any of
+	// several LANs: each wake is handed to every site of its target, or
+	// every site if it names none, at once, each trying its relays as
+	// RelayStrategy says, and succeeds if any site accepts it.
+	Sites map[string][]string `json:"sites,omitempty"`
+	// Path of a Unix datagram socket where a privileged helper listens:
+	// each packet is handed to it, with a JSON header naming its
+	// destination and transport, instead of being sent from here.
+	HelperSocket string `json:"helper_socket,omitempty"`
+	// If set, each wake is published as a JSON wake request to a message
+	// queue, for a worker to act on, instead of packets being sent.
+	Publish *Publish `json:"publish,omitempty"`
+	// If set, each target is woken by calling a management service's
+	// gRPC Wake method instead of sending packets.
+	GRPC *GRPC `json:"grpc,omitempty"`
+	// Timeout for connecting and writing a TCP packet, or for the whole
+	// exchange with a relay or publish backend. Default: 5s.
+	SendTimeout caddy.Duration `json:"send_timeout,omitempty"`
+
+	// URL to POST a JSON notification to after each wake or sleep
+	// command, e.g. a Discord, Slack or ntfy webhook. Sent in the
+	// background; failures are only logged.
+	Notify string `json:"notify,omitempty"`
+	// Body to send instead of the default JSON, with the placeholders
+	// {wake.target}, {wake.mac}, {wake.ip}, {wake.result}, {wake.error}
+	// and {wake.timestamp}.
+	NotifyTemplate string `json:"notify_template,omitempty"`
+	// Timeout for a notification request. Default: 5s.
+	NotifyTimeout caddy.Duration `json:"notify_timeout,omitempty"`
+	// Transport to send notifications through, one of the reverse proxy's
+	// (usually "http"), for proxies, custom CAs and client certificates.
+	// Default: Go's, honoring HTTP_PROXY and the system trust store.
+	NotifyTransportRaw json.RawMessage `json:"notify_transport,omitempty" caddy:"namespace=http.reverse_proxy.transport inline_key=protocol"`
+
+	// Command and arguments to run after each successful wake, e.g. to
+	// mount a share the host serves, with the target in the WAKE_TARGET,
+	// WAKE_MAC, WAKE_IP, WAKE_PORT, WAKE_CHECK and WAKE_RESULT environment
+	// variables.
+	// Runs in the background as Caddy's user; its output is logged. Only
+	// allowed with allow_exec in the wake_on_lan app.
+	OnWakeExec []string `json:"on_wake_exec,omitempty"`
+	// Time after which the command is killed. Default: 30s.
+	OnWakeExecTimeout caddy.Duration `json:"on_wake_exec_timeout,omitempty"`
+
+	// Escalation ladder replacing the single send and wait: each step
+	// sends with its strategy ("unicast", "broadcast" or
+	// "all_interfaces"), then waits for the check address before the next,
+	// more aggressive step. Requires a check address on every target.
+	Escalate []EscalationStep `json:"escalate,omitempty"`
+	// Send-while-waiting loop replacing the single send and wait: a packet
+	// per interval until the probe succeeds or a cap is reached.
+	SendUntilUp *SendUntilUp `json:"send_until_up,omitempty"`
+	// Unicast sends, each waiting for the check address, followed by one
+	// broadcast to the target's subnet if none was confirmed; replaces the
+	// single send and wait.
+	BroadcastFallback *BroadcastFallback `json:"broadcast_fallback,omitempty"`
+	// If set, a target confirmed up isn't sent to again until a background
+	// probe finds it down, rather than on every request.
+	OncePerBoot *OncePerBoot `json:"once_per_boot,omitempty"`
+	// How long a target confirmed up, found already up or seen coming up
+	// after a wake, is trusted to still be: requests within it answer
+	// already_up without probing or sending. Default: 0 (probe every
+	// request).
+	ConfirmCacheTTL caddy.Duration `json:"confirm_cache_ttl,omitempty"`
+
+	// If true, the handler is a bulk wake endpoint: it reads a JSON array
+	// of targets from a POST body, each {"name"} of a configured target or
+	// {"mac","ip","port"}, wakes them and answers with a JSON result per
+	// target instead of calling the next handler.
+	FromBody bool `json:"from_body,omitempty"`
+	// If set, the handler wakes the single target given by the request's
+	// query parameters, e.g. ?mac=...&ip=...&port=9, checked like a
+	// from_body entry, instead of its configured targets.
+	FromQuery *QueryParams `json:"from_query,omitempty"`
+	// If set, the handler wakes the single target held by this request
+	// variable, "<mac> [<ip> [<port>]]", checked like a from_body entry,
+	// for routes that set it before invoking a shared handler. Requests
+	// without it wake the configured targets.
+	TargetVar string `json:"target_var,omitempty"`
+	// Request variable another module sets to true while a target is up,
+	// such as a health monitor; flagged targets are sent nothing and
+	// aren't probed. {target} in the name is replaced by each target's
+	// name, e.g. "host_up:{target}".
+	SkipIfVar string `json:"skip_if_var,omitempty"`
+	// If true, every target comes from requests, through FromBody,
+	// FromQuery or TargetVar, and none from the config: the safety checks
+	// run on each request's targets instead of when the config loads,
+	// failing the request with a 400 at level error.
+	Dynamic bool `json:"dynamic,omitempty"`
+	// Maximum number of targets in a bulk request. Default: 32.
+	MaxBodyTargets int `json:"max_body_targets,omitempty"`
+	// Maximum size of a bulk request's body, in bytes; larger ones are
+	// refused with 413 before being parsed. Default: 4096.
+	MaxBodyBytes int `json:"max_body_bytes,omitempty"`
+	// Media type bulk requests must be sent as, or "*" for any; others
+	// are refused with 415. Default: application/json.
+	BodyContentType string `json:"body_content_type,omitempty"`
+	// Maximum number of targets a bulk request, or a handler in parallel
+	// order, wakes at once. Default: 4.
+	BulkConcurrency int `json:"bulk_concurrency,omitempty"`
+
+	// Names of targets from the inventory file configured with the
+	// wake_on_lan_inventory global option. They are looked up on every
+	// request, so inventory changes apply without a reload.
+	Inventory []string `json:"inventory,omitempty"`
+	// Name of a profile defined in the wake_on_lan app whose settings the
+	// handler inherits unless it sets them itself.
+	Profile string `json:"profile,omitempty"`
+
+	// Maximum sustained send rate per target, as <n>/<s|min|h>, e.g.
+	// "10/min". Wakes beyond it are skipped with the rate_limited result.
+	Rate string `json:"rate,omitempty"`
+	// Number of sends a target may burst to above Rate. Default: 1.
+	Burst int `json:"burst,omitempty"`
+	// If set, a target is only woken once this many requests for it have
+	// arrived within the window; the requests before just pass through.
+	TriggerThreshold *TriggerThreshold `json:"trigger_threshold,omitempty"`
+	// If set, each target is woken at most once per interval by all the
+	// instances sharing Caddy's configured storage, and across restarts.
+	SharedLimit *SharedLimit `json:"shared_limit,omitempty"`
+	// Most time added at random to the shared_limit interval each time a
+	// target's last wake is checked against it, so instances whose
+	// intervals expire together don't all wake it at once. Requires
+	// shared_limit.
+	CooldownJitter caddy.Duration `json:"cooldown_jitter,omitempty"`
+	// Most packets sent to each target, by this handler, since the config
+	// was loaded: once reached, every wake of the target fails with
+	// fuse_blown until a reload or a reset through the admin API. A last
+	// resort against a misconfiguration sending without end. Default: no
+	// limit.
+	MaxLifetimePackets int `json:"max_lifetime_packets,omitempty"`
+	// Name of a named route (Caddyfile &(name)) run for each target before
+	// it is woken, with the target in the wake_on_lan.intent.* variables and
+	// X-Wake-Intent-* request headers. Setting wake_on_lan.intent.deny to
+	// true denies the target; a route that writes a response itself, such
+	// as forward_auth refusing the client, ends the request there.
+	Authorize string `json:"authorize,omitempty"`
+	// Most wakes one client request may start, across every invocation of
+	// this and other wake_on_lan handlers while it is served, such as by
+	// handle_errors routes or on_timeout retries. Defaults to 0 (no limit).
+	WakeBudget int `json:"wake_budget,omitempty"`
+
+	// Which targets a request wakes: "all" (the default), or a single one
+	// picked by "random" or "round_robin", to spread load over a pool of
+	// identical machines, by "weighted", at random in proportion to each
+	// target's weight, or by "least_recent", the one picked longest ago.
+	Select string `json:"select,omitempty"`
+
+	// MAC prefixes (OUIs, e.g. 00:11:22) that MACs not fixed in the
+	// config may have: those of from_body requests and "auto" lookups.
+	// Other MACs are refused.
+	AllowOUI []string `json:"allow_oui,omitempty"`
+	// If set, a MAC and IP taken from the request must be paired in the
+	// neighbor table, or the target is refused with a 409.
+	VerifyMACIP *VerifyMACIP `json:"verify_mac_ip,omitempty"`
+
+	// Order to wake several targets in: "serial" (the default), "parallel"
+	// or "staggered", which starts each target Stagger after the previous.
+	Order string `json:"order,omitempty"`
+	// Pause between targets in staggered order. Default: 100ms.
+	Stagger caddy.Duration `json:"stagger,omitempty"`
+
+	// If true, the next handler (typically reverse_proxy) runs first, and
+	// the targets are woken only if it fails with one of FailureStatus;
+	// the next handler then runs again, up to UpstreamRetries times.
+	WakeOnFailure bool `json:"wake_on_failure,omitempty"`
+	// If true, only requests opening a WebSocket (with the Connection:
+	// upgrade and Upgrade: websocket headers) wake the targets; the rest
+	// are passed to the next handler untouched.
+	OnWebSocketUpgrade bool `json:"on_websocket_upgrade,omitempty"`
+	// How many times to wake and retry the next handler. Default: 1.
+	UpstreamRetries int `json:"upstream_retries,omitempty"`
+	// Handler error statuses that mean the upstream is down. Default:
+	// 502, 503 and 504.
+	FailureStatus []int `json:"failure_status,omitempty"`
+	// Pause before retrying when no check address confirmed the targets
+	// are up. Default: 5s.
+	RetryDelay caddy.Duration `json:"retry_delay,omitempty"`
+
+	// Client IPs or CIDRs allowed to trigger a send. When set, other
+	// clients pass through to the next handler without a send (or get a
+	// 403 if Required).
+	AllowFrom []string `json:"allow_from,omitempty"`
+	// Client IPs or CIDRs never allowed to trigger a send; takes
+	// precedence over AllowFrom.
+	DenyFrom []string `json:"deny_from,omitempty"`
+
+	// Local UDP ports to send from, as "<lo>-<hi>", for NAT and firewall
+	// rules that match on the source port. Each target keeps the port it
+	// first sent from unless it is taken; the shared broadcast socket is
+	// bound within the range too.
+	SourcePortRange string `json:"source_port_range,omitempty"`
+	// Socket options set on every socket bound from source_port_range so
+	// other handlers, or other Caddy instances, can bind the same ports:
+	// "addr" for SO_REUSEADDR, "port" for SO_REUSEPORT or "both". Every
+	// socket sharing a port must set them. Windows has only "addr".
+	SocketReuse string `json:"socket_reuse,omitempty"`
+	// If true, static targets' host names are looked up when the config
+	// loads, priming the system resolver's cache before the first wake,
+	// and their source ports are pinned. Failures only log a warning.
+	WarmUp bool `json:"warm_up,omitempty"`
+	// If true, the sockets the configured send path needs are opened with
+	// the options it sets when the config loads, and a datagram is sent
+	// over loopback, failing the config if the host lacks a capability
+	// such as broadcasting or binding an interface. Nothing is sent to
+	// targets; those that don't resolve only log a warning.
+	SelfTest bool `json:"self_test,omitempty"`
+
+	// Minimum magic packet length in bytes; shorter packets are padded
+	// with zeros. Default: unpadded (102 bytes).
+	PadTo int `json:"pad_to,omitempty"`
+	// Most MACs a target's MAC pattern (e.g. 00:11:22:33:**:**) may
+	// expand to; each match gets its own broadcast packet. Default: 256.
+	MaxMACExpansion int `json:"max_mac_expansion,omitempty"`
+	// Template the packets of targets without their own are built from,
+	// as space-separated hex bytes and {mac}, {mac_bytes} or {secureon}
+	// placeholders, each optionally repeated with *<count>. Default: the
+	// standard magic packet, "ff*6 {mac_bytes}*16", followed by the
+	// target's SecureOn password if it has one.
+	PacketTemplate string `json:"packet_template,omitempty"`
+	// Encoding the packets of targets without their own packet template
+	// or encoding are built with: standard, short (6 x 0xFF, the MAC 4
+	// times and a checksum byte) or vendor:<name>. Default: standard.
+	Encoding string `json:"encoding,omitempty"`
+	// Checksum appended to the packets of targets without their own,
+	// when built from a template or an encoding: none, sum8 (the low byte
+	// of the sum of the bytes), xor (the bytes XORed together) or crc16
+	// (CRC-16/CCITT-FALSE, big-endian). Default: none.
+	Checksum string `json:"checksum,omitempty"`
+
+	// Packet size in bytes above which a warning about possible IP
+	// fragmentation is logged when the config loads. Default: 512.
+	WarnSize int `json:"warn_size,omitempty"`
+	// If true, packets, padding and templates may be up to 65507 bytes,
+	// the largest UDP payload, instead of the 1472 that fit a 1500-byte
+	// MTU. Configs that would build anything larger fail to load.
+	AllowLargePacket bool `json:"allow_large_packet,omitempty"`
+
+	// File to append a JSON line to for every wake and sleep attempt,
+	// recording who triggered it and the outcome; rotated by size.
+	AuditLog *AuditLog `json:"audit_log,omitempty"`
+
+	// Request header carrying a correlation ID, logged as wake_id with
+	// every line about the request's wake. Defaults to X-Request-ID; when
+	// absent, Caddy's request UUID is used.
+	RequestIDHeader string `json:"request_id_header,omitempty"`
+	// If set, failures of a target are logged once per kind, and their
+	// repeats within this interval as one summary line when it ends,
+	// instead of a line each. Default: 0 (log every failure).
+	LogThrottle caddy.Duration `json:"log_throttle,omitempty"`
+	// If set, each packet is logged in hex at debug level before it is
+	// sent, to compare against a capture. SecureOn passwords are redacted.
+	LogPacket bool `json:"log_packet,omitempty"`
+	// If set, sends taking at least this long are logged as a warning, with
+	// the time spent resolving the address, setting up the socket and
+	// writing the packet. Default: 0 (don't log them).
+	SlowSend caddy.Duration `json:"slow_send,omitempty"`
+	// If set, each request is logged as one line at info level once the
+	// handler is done with it, whatever the outcome: the target, what was
+	// done (sent, skipped_awake, skipped_cooldown, rate_limited, skipped
+	// or error), the destinations and the time it took.
+	SummaryLog bool `json:"summary_log,omitempty"`
+
+	ctx             caddy.Context
+	macCache        *macCache
+	dhcpLeases      *dhcpLeases
+	snmp            *snmpResolver
+	ethers          *ethersFile
+	packetTemplates map[string]*packetTemplate
+	// Default send_until_up max_duration, derived in Provision.
+	untilUpMaxDuration time.Duration
+	boot               *bootTracker
+	confirmed          *confirmCache
+	logThrottle        *logThrottle
+	app                *App
+	roundRobin         *atomic.Uint64
+	lastPicked         *pickTimes
+	fuse               *packetFuse
+	adminTriggers      *adminTriggerSet
+	limiters           *rateLimiters
+	trigger            *triggerCounter
+	storage            certmagic.Storage
+	sourcePorts        *sourcePorts
+	transports         []string
+	defaultPort        int
+	profileApplied     bool
+	mdnsCache          *mdnsCache
+	auditWriter        *auditWriter
+	notifyClient       *http.Client
+	idempotency        *idempotencyCache
+	publisher          Publisher
+	grpcConn           *grpc.ClientConn
+	grpcToken          string
+	execPath           string
+	confirmExecPath    string
+	waitingBody        string
+	early              *bootEstimates
+	backoff            *backoffClients
+	allowFrom          []netip.Prefix
+	denyFrom           []netip.Prefix
+	allowOUI           [][3]byte
+	neighborLookup     func(net.IP) (net.HardwareAddr, error)
+	neighborState      func(net.IP) (neighborEntry, error)
+	coordinator        *wakeCoordinator
+	batcher            *wakeBatcher
+	broadcastConn      *net.UDPConn
+	broadcastErr       error
+	sharedBroadcast    *broadcastSockets
+	provisionedAt      time.Time
+	logger             *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -36,71 +945,2156 @@ func (WakeOnLAN) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision sets up the handler.
+func (w *WakeOnLAN) Provision(ctx caddy.Context) error {
+	w.ctx = ctx
+	w.logger = ctx.Logger()
+	w.coordinator = new(wakeCoordinator)
+	w.batcher = new(wakeBatcher)
+	w.macCache = newMACCache()
+	w.mdnsCache = newMDNSCache()
+	w.roundRobin = new(atomic.Uint64)
+	w.lastPicked = newPickTimes()
+	if w.MaxLifetimePackets > 0 {
+		w.fuse = newPacketFuse(w.MaxLifetimePackets, w.logger)
+	}
+	if w.AdminTrigger {
+		w.adminTriggers = &adminTriggerSet{running: make(map[string]struct{})}
+	}
+	if w.Rate != "" {
+		limit, err := parseRate(w.Rate)
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+		w.limiters = newRateLimiters(limit, w.Burst)
+	}
+	if w.TriggerThreshold != nil {
+		w.trigger = newTriggerCounter(w.TriggerThreshold)
+	}
+	if w.SharedLimit != nil {
+		w.storage = ctx.Storage()
+	}
+	if w.EarlyResponse != nil {
+		w.early = newBootEstimates(time.Duration(w.EarlyResponse.Estimate))
+	}
+	if w.BackoffResponse != nil {
+		w.backoff = newBackoffClients(time.Duration(w.BackoffResponse.TTL))
+	}
+	if len(w.Inventory) > 0 || w.Profile != "" || len(w.OnWakeExec) > 0 || len(w.ConfirmExec) > 0 {
+		app, err := ctx.App("wake_on_lan")
+		if err != nil {
+			return err
+		}
+		w.app = app.(*App)
+	} else if app, err := ctx.AppIfConfigured("wake_on_lan"); err == nil {
+		w.app = app.(*App)
+	}
+	if w.Profile != "" {
+		profile, ok := w.app.Profiles[w.Profile]
+		if !ok {
+			return fmt.Errorf("wake_on_lan: profile %q not defined", w.Profile)
+		}
+		w.applyProfile(profile)
+	}
+	if w.app != nil && w.app.Defaults != nil {
+		w.applyDefaults(w.app.Defaults)
+	}
+	if len(w.Inventory) > 0 {
+		for _, name := range w.Inventory {
+			if _, ok := w.app.target(name); !ok {
+				return fmt.Errorf("wake_on_lan: target %q not in inventory", name)
+			}
+		}
+	}
+	if err := w.provisionExec(); err != nil {
+		return err
+	}
+	if err := w.provisionWaitHTTP(); err != nil {
+		return err
+	}
+	w.provisionWaitARP()
+	if err := w.provisionMaintenance(); err != nil {
+		return err
+	}
+	w.provisionIdempotency()
+	if err := w.provisionWaitingPage(); err != nil {
+		return err
+	}
+	if w.DHCPLeases != "" {
+		leases, err := openDHCPLeases(w.DHCPLeases, w.logger)
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: dhcp_leases: %w", err)
+		}
+		w.dhcpLeases = leases
+	}
+	if w.SNMP != nil {
+		resolver, err := newSNMPResolver(w.SNMP, w.logger)
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: snmp: querying %s: %w", w.SNMP.Switch, err)
+		}
+		w.snmp = resolver
+	}
+	if err := w.provisionEthers(); err != nil {
+		return err
+	}
+	if err := w.provisionNotify(ctx); err != nil {
+		return err
+	}
+	if err := w.provisionPublish(); err != nil {
+		return err
+	}
+	if err := w.provisionGRPC(); err != nil {
+		return err
+	}
+	initMetrics(ctx.GetMetricsRegistry())
+
+	if err := w.provisionPacketTemplates(); err != nil {
+		return err
+	}
+	// The HTTP app provisions each server's handlers with it in the context
+	var writeTimeout time.Duration
+	if srv, ok := ctx.Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok {
+		writeTimeout = time.Duration(srv.WriteTimeout)
+	}
+	w.provisionDurations(writeTimeout)
+	w.checkPacketSize()
+	if w.LogPacket && !w.logger.Core().Enabled(zapcore.DebugLevel) {
+		w.logger.Warn("log_packet: packets are logged at debug level, which this logger doesn't write")
+	}
+	if err := txCountersAvailable(); w.ConfirmTX && err != nil {
+		w.logger.Warn("confirm_tx: interface counters can't be read here; wakes report sent", zap.Error(err))
+	}
+	w.warnSafety()
+	w.provisionTransports()
+
+	if w.SourcePortRange != "" {
+		lo, hi, err := parsePortRange(w.SourcePortRange)
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: source_port_range: %w", err)
+		}
+		w.sourcePorts = newSourcePorts(lo, hi)
+		w.sourcePorts.reuse = w.SocketReuse
+	}
+
+	if err := w.provisionSharedBroadcast(); err != nil {
+		return err
+	}
+	if w.sharesBroadcastConn() && !w.SharedBroadcastSocket {
+		conn, err := openBroadcastConn(w.sourcePorts)
+		if err != nil && w.WarmUp {
+			return fmt.Errorf("wake_on_lan: warm-up: opening broadcast socket: %w", err)
+		} else if err != nil {
+			// Not fatal; each packet dials its own socket instead
+			w.logger.Warn("opening broadcast socket; falling back to per-packet sockets", zap.Error(err))
+			w.broadcastErr = err
+		} else {
+			w.broadcastConn = conn
+			w.sizeSendBuffer()
+		}
+	}
+	if w.AuditLog != nil {
+		writer, err := openAuditWriter(w.AuditLog)
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: audit_log: %w", err)
+		}
+		w.auditWriter = writer
+	}
+	if w.SelfTest {
+		if err := w.selfTest(); err != nil {
+			return err
+		}
+	}
+	if w.WarmUp {
+		if err := w.warmUp(); err != nil {
+			return err
+		}
+	}
+	if w.LogThrottle > 0 {
+		w.logThrottle = newLogThrottle(time.Duration(w.LogThrottle), w.logger)
+		go w.logThrottle.run(w.ctx)
+	}
+	if w.OncePerBoot != nil {
+		w.boot = newBootTracker(w.OncePerBoot, time.Duration(w.CheckTimeout), w.logger)
+		go w.boot.run(w.ctx)
+	}
+	if w.ConfirmCacheTTL > 0 {
+		w.confirmed = newConfirmCache(time.Duration(w.ConfirmCacheTTL))
+	}
+	w.provisionedAt = time.Now()
+	registerHandler(w)
+	return nil
+}
+
+// checkPacketSize warns when the packets this handler sends are large
+// enough to risk fragmentation, which some networks drop.
+func (w *WakeOnLAN) checkPacketSize() {
+	limit := w.WarnSize
+	if limit == 0 {
+		limit = defaultWarnSize
+	}
+	size, _ := w.largestPacket()
+	w.logger.Debug("packet size", zap.Int("size", size))
+	if size > limit {
+		w.logger.Warn("packet may be fragmented; wakes can fail on networks dropping fragments",
+			zap.Int("size", size), zap.Int("warn_size", limit))
+	}
+}
+
+// largestPacket returns the size of the largest packet this handler builds,
+// computed from the config without building any, and what sends it: a
+// target's label, or sleep_payload.
+func (w *WakeOnLAN) largestPacket() (size int, source string) {
+	if w.Action == actionSleep {
+		return len(w.SleepPayload), "sleep_payload"
+	}
+	size, source = max(magicPacketSize(), w.PadTo), "pad_to"
+	opts := w.sendOptions()
+	for _, t := range w.allTargets() {
+		if n := packetSize(t, opts); n > size {
+			size, source = n, "target "+t.label()
+		}
+	}
+	return size, source
+}
+
+// packetLimit returns the largest packet this handler may build.
+func (w *WakeOnLAN) packetLimit() int {
+	if w.AllowLargePacket {
+		return maxLargePacketSize
+	}
+	return maxPacketSize
+}
+
+// validatePacketSize refuses a config that would build packets over the
+// limit, which networks drop rather than deliver. A relay builds its own.
+func (w *WakeOnLAN) validatePacketSize() error {
+	if w.relayed() {
+		return nil
+	}
+	size, source := w.largestPacket()
+	if limit := w.packetLimit(); size > limit {
+		hint := "; set allow_large_packet to send it anyway"
+		if w.AllowLargePacket {
+			hint = ""
+		}
+		return fmt.Errorf("%s: packet of %d bytes is larger than %d%s", source, size, limit, hint)
+	}
+	return nil
+}
+
+// Cleanup releases the handler's sockets and removes it from the admin
+// API.
+func (w *WakeOnLAN) Cleanup() error {
+	unregisterHandler(w)
+	if w.auditWriter != nil {
+		releaseAuditWriter(w.AuditLog)
+	}
+	if w.grpcConn != nil {
+		w.grpcConn.Close()
+	}
+	if w.sharedBroadcast != nil {
+		w.sharedBroadcast.release()
+	}
+	if w.broadcastConn != nil {
+		return w.broadcastConn.Close()
+	}
+	return nil
+}
+
 // Validate ensures the configuration is sane.
 func (w *WakeOnLAN) Validate() error {
-	if w.MAC == "" {
-		return errors.New("wake_on_lan: MAC must be specified")
+	var err error
+	if w.allowFrom, err = parsePrefixes(w.AllowFrom); err != nil {
+		return fmt.Errorf("wake_on_lan: allow_from: %w", err)
+	}
+	if w.denyFrom, err = parsePrefixes(w.DenyFrom); err != nil {
+		return fmt.Errorf("wake_on_lan: deny_from: %w", err)
+	}
+	if w.allowOUI, err = parseOUIs(w.AllowOUI); err != nil {
+		return fmt.Errorf("wake_on_lan: allow_oui: %w", err)
+	}
+	if w.SourcePortRange != "" {
+		if _, _, err := parsePortRange(w.SourcePortRange); err != nil {
+			return fmt.Errorf("wake_on_lan: source_port_range: %w", err)
+		}
+	}
+	if err := w.validateSocketReuse(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if w.PadTo < 0 || w.PadTo > w.packetLimit() {
+		return fmt.Errorf("wake_on_lan: pad_to must be between 0 and %d, got %d", w.packetLimit(), w.PadTo)
 	}
-	if _, err := parseMAC(w.MAC); err != nil {
-		return fmt.Errorf("wake_on_lan: invalid MAC %q: %w", w.MAC, err)
+	if err := w.validatePacketSize(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
 	}
-	if w.IP == "" {
-		return errors.New("wake_on_lan: IP must be specified")
+	if w.AuditLog != nil {
+		if err := w.AuditLog.validate(); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+	}
+	if w.WarnSize < 0 {
+		return fmt.Errorf("wake_on_lan: invalid warn_size %d", w.WarnSize)
+	}
+	if w.LogThrottle < 0 {
+		return fmt.Errorf("wake_on_lan: invalid log_throttle %s", time.Duration(w.LogThrottle))
+	}
+	if w.SlowSend < 0 {
+		return fmt.Errorf("wake_on_lan: invalid slow_send %s", time.Duration(w.SlowSend))
 	}
-	if net.ParseIP(w.IP) == nil {
-		// Allow hostnames too, as ResolveUDPAddr will handle those at runtime
-		if _, err := net.ResolveUDPAddr("udp", net.JoinHostPort(w.IP, strconv.Itoa(w.portOrDefault()))); err != nil {
-			return fmt.Errorf("wake_on_lan: invalid IP/host %q: %w", w.IP, err)
+
+	switch w.Action {
+	case "", actionWake:
+	case actionSleep:
+		if err := w.validateNotify(); err != nil {
+			return err
+		}
+		if w.AfterResponse || w.FromBody || w.FromQuery != nil || w.TargetVar != "" || w.Dynamic || w.WakeOnFailure || w.OnWebSocketUpgrade {
+			return errors.New("wake_on_lan: after_response, from_body, from_query, target_var, dynamic, wake_on_failure and on_websocket_upgrade apply only to the wake action")
+		}
+		// Sleeping is independent of the wake targets
+		if err := w.validateSleep(); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
 		}
+		return nil
+	default:
+		return fmt.Errorf("wake_on_lan: unknown action %q", w.Action)
+	}
+
+	if err := w.validateDynamic(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateSkipIfVar(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	// The positional target may be omitted only when the block lists
+	// targets or they come from the request
+	if w.MAC != "" || w.IP != "" || w.SRV != "" || w.MDNS != "" || (len(w.Targets) == 0 && len(w.HostMap) == 0 && len(w.SNIMap) == 0 && len(w.Inventory) == 0 && !w.FromBody && w.FromQuery == nil && w.TargetVar == "") {
+		if err := (Target{MAC: w.MAC, IP: w.IP, Port: w.Port, SRV: w.SRV, MDNS: w.MDNS}).Validate(w.requiresIP()); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+	}
+	if w.Broadcast != "" {
+		if err := validateBroadcast(w.Broadcast); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+	}
+	switch w.Protocol {
+	case "", protocolUDP:
+	case protocolTCP:
+		if w.Broadcast != "" {
+			return errors.New("wake_on_lan: protocol tcp cannot be combined with broadcast")
+		}
+	default:
+		return fmt.Errorf("wake_on_lan: unknown protocol %q", w.Protocol)
+	}
+	if err := w.validateTransports(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateHelperSocket(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateSites(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateRelay(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validatePublish(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateGRPC(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateBMC(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateNotify(); err != nil {
+		return err
+	}
+	if w.OnWakeExecTimeout < 0 {
+		return fmt.Errorf("wake_on_lan: invalid on_wake_exec_timeout %s", time.Duration(w.OnWakeExecTimeout))
+	}
+	if err := validateSelect(w.Select); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if w.Rate != "" {
+		if _, err := parseRate(w.Rate); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+	}
+	if w.Burst < 0 || (w.Burst > 0 && w.Rate == "") {
+		return fmt.Errorf("wake_on_lan: invalid burst %d", w.Burst)
+	}
+	if w.TriggerThreshold != nil {
+		if err := w.TriggerThreshold.validate(); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+		if w.FromBody {
+			return errors.New("wake_on_lan: trigger_threshold cannot be combined with from_body")
+		}
+	}
+	if w.Authorize != "" && w.FromBody {
+		return errors.New("wake_on_lan: authorize cannot be combined with from_body")
+	}
+	if w.WakeBudget < 0 {
+		return fmt.Errorf("wake_on_lan: invalid wake_budget %d", w.WakeBudget)
+	}
+	if w.MACCacheTTL < 0 {
+		return fmt.Errorf("wake_on_lan: invalid mac_cache_ttl %s", time.Duration(w.MACCacheTTL))
+	}
+	if w.MACMissTTL < 0 {
+		return fmt.Errorf("wake_on_lan: invalid mac_miss_ttl %s", time.Duration(w.MACMissTTL))
+	}
+	if w.SendTimeout < 0 {
+		return fmt.Errorf("wake_on_lan: invalid send_timeout %s", time.Duration(w.SendTimeout))
+	}
+	if err := validateRetry(w.Repeat, w.Interval); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if w.InitialDelay < 0 {
+		return fmt.Errorf("wake_on_lan: invalid initial_delay %s", time.Duration(w.InitialDelay))
+	}
+	if s := w.SendUntilUp; s != nil && s.MaxDuration > 0 && w.InitialDelay >= s.MaxDuration {
+		return fmt.Errorf("wake_on_lan: initial_delay %s leaves nothing of send_until_up max_duration %s", time.Duration(w.InitialDelay), time.Duration(s.MaxDuration))
+	}
+	if w.MDNSTimeout < 0 {
+		return fmt.Errorf("wake_on_lan: invalid mdns_timeout %s", time.Duration(w.MDNSTimeout))
+	}
+	if w.MDNSTTL < 0 {
+		return fmt.Errorf("wake_on_lan: invalid mdns_ttl %s", time.Duration(w.MDNSTTL))
+	}
+	if w.ResolveRetries < 0 || w.ResolveRetries > maxResolveRetries {
+		return fmt.Errorf("wake_on_lan: invalid resolve_retries %d: want at most %d", w.ResolveRetries, maxResolveRetries)
+	}
+	if err := validateIPPreference(w.Prefer, w.PreferOnly); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if w.ResolveBackoff < 0 {
+		return fmt.Errorf("wake_on_lan: invalid resolve_backoff %s", time.Duration(w.ResolveBackoff))
+	}
+	if err := validateProbeAddress(w.Check); err != nil {
+		return fmt.Errorf("wake_on_lan: check: %w", err)
+	}
+	if err := w.validateCheckPortFromRequest(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := validateProbeAddress(w.RetryProbe); err != nil {
+		return fmt.Errorf("wake_on_lan: retry_probe: %w", err)
+	}
+	if w.RetryProbeTimeout < 0 {
+		return fmt.Errorf("wake_on_lan: invalid retry_probe timeout %s", time.Duration(w.RetryProbeTimeout))
+	}
+	if err := validateRetryPorts(w.RetryPorts); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if w.CheckTimeout < 0 {
+		return fmt.Errorf("wake_on_lan: invalid check timeout %s", time.Duration(w.CheckTimeout))
+	}
+	if w.Wait < 0 {
+		return fmt.Errorf("wake_on_lan: invalid wait %s", time.Duration(w.Wait))
+	}
+	if w.GracePeriod < 0 {
+		return fmt.Errorf("wake_on_lan: invalid grace_period %s", time.Duration(w.GracePeriod))
+	}
+	if w.BatchWindow < 0 {
+		return fmt.Errorf("wake_on_lan: invalid batch_window %s", time.Duration(w.BatchWindow))
+	}
+	for i, t := range w.Targets {
+		if err := t.Validate(w.requiresIP()); err != nil {
+			return fmt.Errorf("wake_on_lan: target %d: %w", i, err)
+		}
+	}
+	if w.Encoding != "" {
+		if w.PacketTemplate != "" {
+			return errors.New("wake_on_lan: encoding cannot be combined with packet_template")
+		}
+		// The handler's encoding must also suit the targets it applies to
+		for _, t := range w.allTargets() {
+			if err := t.validateEncoding(); err != nil {
+				return fmt.Errorf("wake_on_lan: target %s: %w", t.label(), err)
+			}
+		}
+	}
+	if err := validateChecksumName(w.Checksum); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	for _, t := range w.allTargets() {
+		if err := t.validateChecksum(); err != nil {
+			return fmt.Errorf("wake_on_lan: target %s: %w", t.label(), err)
+		}
+	}
+	for host, t := range w.HostMap {
+		if host == "" {
+			return errors.New("wake_on_lan: host_map: empty hostname")
+		}
+		if err := t.Validate(w.requiresIP()); err != nil {
+			return fmt.Errorf("wake_on_lan: host_map %s: %w", host, err)
+		}
+	}
+	if err := w.validateSNIMap(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := validateOrder(w.Order, w.Stagger); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateWakeOnFailure(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateGroup(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateOnTimeout(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateWaitHTTP(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateConfirmExec(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateConfirmListen(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateAck(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateConfirmTX(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateAdminTrigger(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateIdempotency(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateDedupeSends(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateHeaderOverrides(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if w.MaxLifetimePackets < 0 {
+		return fmt.Errorf("wake_on_lan: invalid max_lifetime_packets %d", w.MaxLifetimePackets)
+	}
+	if err := w.validateSharedLimit(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateDependencies(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateWaitARP(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateWaitingPage(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateEarlyResponse(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateBackoffResponse(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
 	}
-	if w.Port < 0 || w.Port > 65535 {
-		return fmt.Errorf("wake_on_lan: invalid port %d", w.Port)
+	if err := w.validateMaintenance(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateResponseDelay(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateSendUntilUp(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateBroadcastFallback(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateOncePerBoot(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateConfirmCache(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateMACPatterns(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateStrictness(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateInterfaces(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateSendBuffer(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateSharedBroadcastSocket(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateBroadcastSource(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateVRF(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := validateTTL(w.TTL); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if w.relayed() || w.HelperSocket != "" {
+		for _, t := range w.allTargets() {
+			if t.TTL != 0 {
+				return errors.New("wake_on_lan: ttl cannot be combined with relay or helper_socket, which send the packets themselves")
+			}
+		}
+	}
+	if w.SNMP != nil {
+		if err := w.SNMP.validate(); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+	}
+	if err := w.validateMACSources(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateRetriable(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if err := w.validateJSONResponse(); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if w.FromQuery != nil {
+		if w.FromBody {
+			return errors.New("wake_on_lan: from_query cannot be combined with from_body")
+		}
+		if err := w.FromQuery.validate(); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+	}
+	if w.TargetVar != "" && (w.FromBody || w.FromQuery != nil) {
+		return errors.New("wake_on_lan: target_var cannot be combined with from_body or from_query")
+	}
+	if w.VerifyMACIP != nil {
+		if !w.FromBody && w.FromQuery == nil && w.TargetVar == "" {
+			return errors.New("wake_on_lan: verify_mac_ip applies only to from_body, from_query and target_var")
+		}
+		if err := w.VerifyMACIP.validate(); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+	}
+	if w.FromBody {
+		if w.AfterResponse {
+			return errors.New("wake_on_lan: from_body cannot be combined with after_response")
+		}
+		if w.OnWebSocketUpgrade {
+			return errors.New("wake_on_lan: from_body cannot be combined with on_websocket_upgrade")
+		}
+		if w.MaxBodyTargets < 0 {
+			return fmt.Errorf("wake_on_lan: invalid max_body_targets %d", w.MaxBodyTargets)
+		}
+		if w.BulkConcurrency < 0 {
+			return fmt.Errorf("wake_on_lan: invalid bulk_concurrency %d", w.BulkConcurrency)
+		}
+		if w.MaxBodyBytes < 0 || w.MaxBodyBytes > maxMaxBodyBytes {
+			return fmt.Errorf("wake_on_lan: invalid max_body_bytes %d: want at most %d", w.MaxBodyBytes, maxMaxBodyBytes)
+		}
+		if t := w.BodyContentType; t != "" && t != anyContentType {
+			if _, _, err := mime.ParseMediaType(t); err != nil {
+				return fmt.Errorf("wake_on_lan: invalid body_content_type %q: %w", t, err)
+			}
+		}
+	} else if w.MaxBodyBytes != 0 || w.BodyContentType != "" {
+		return errors.New("wake_on_lan: max_body_bytes and body_content_type require from_body")
+	}
+	if w.AfterResponse {
+		// Nothing is left to hold or report to once the response is written
+		switch {
+		case w.Required:
+			return errors.New("wake_on_lan: after_response cannot be combined with required")
+		case w.Wait > 0:
+			return errors.New("wake_on_lan: after_response cannot be combined with wait")
+		case w.StatusHeader != "":
+			return errors.New("wake_on_lan: after_response cannot be combined with status_header")
+		case w.AccessLogFields:
+			return errors.New("wake_on_lan: after_response cannot be combined with access_log_fields, as the request is logged before the wake")
+		}
+	}
+	if len(w.Escalate) > 0 {
+		if err := validateEscalation(w.Escalate); err != nil {
+			return fmt.Errorf("wake_on_lan: %w", err)
+		}
+		if w.Wait > 0 {
+			return errors.New("wake_on_lan: escalate sets its own waits; remove wait")
+		}
+		for _, t := range w.allTargets() {
+			if t.Check == "" && w.Check == "" {
+				return errors.New("wake_on_lan: escalate requires a check address")
+			}
+		}
+	}
+	if w.Wait > 0 && w.WaitHTTP == nil && len(w.ConfirmExec) == 0 && !w.waitsARP() && w.ConfirmListen == nil {
+		for _, t := range w.allTargets() {
+			if t.Check == "" && w.Check == "" {
+				return errors.New("wake_on_lan: wait requires a check address, wait_http, confirm_exec, wait_arp, confirm_arp_learned or confirm_listen")
+			}
+		}
 	}
 	return nil
 }
 
-func (w *WakeOnLAN) portOrDefault() int {
-	if w.Port == 0 {
-		return 9
+// targets returns every configured target with handler-level defaults
+// applied, including the inventory targets currently known.
+func (w *WakeOnLAN) targets() []Target {
+	all := make([]Target, 0, len(w.Targets)+len(w.Inventory)+1)
+	if w.MAC != "" {
+		all = append(all, Target{MAC: w.MAC, IP: w.IP, Port: w.Port, SRV: w.SRV, MDNS: w.MDNS, Name: w.Name, SecureOn: w.SecureOn})
+	}
+	all = append(all, w.Targets...)
+	if w.app != nil {
+		for _, name := range w.Inventory {
+			t, ok := w.app.target(name)
+			if !ok {
+				// Removed from the inventory since the config loaded
+				w.logger.Warn("target not in inventory", zap.String("name", name))
+				continue
+			}
+			all = append(all, t)
+		}
 	}
-	return w.Port
+	for i := range all {
+		all[i] = w.withDefaults(all[i])
+	}
+	return all
 }
 
-// ServeHTTP sends the WOL magic packet, then calls the next handler in the chain.
+// withDefaults fills in the target's unset retry settings from the handler,
+// and its unset port from the app defaults.
+func (w *WakeOnLAN) withDefaults(t Target) Target {
+	if t.Port == 0 && t.SRV == "" {
+		// Unset SRV ports come from the record instead
+		t.Port = w.defaultPort
+	}
+	if t.Repeat == 0 {
+		t.Repeat = w.Repeat
+	}
+	if t.Repeat == 0 {
+		t.Repeat = 1
+	}
+	if t.Interval == 0 {
+		t.Interval = w.Interval
+	}
+	if t.TTL == 0 {
+		t.TTL = w.TTL
+	}
+	if t.Check == "" {
+		t.Check = w.Check
+	}
+	// A target choosing its own packet format takes neither from the
+	// handler
+	if t.PacketTemplate == "" && t.Encoding == "" {
+		t.PacketTemplate, t.Encoding = w.PacketTemplate, w.Encoding
+		if t.Checksum == "" {
+			t.Checksum = w.Checksum
+		}
+	}
+	return t
+}
+
+// allTargets returns every statically configured target, including those
+// only used for some request hosts or server names.
+func (w *WakeOnLAN) allTargets() []Target {
+	all := w.targets()
+	for _, t := range w.HostMap {
+		all = append(all, w.withDefaults(t))
+	}
+	for _, t := range w.SNIMap {
+		all = append(all, w.withDefaults(t))
+	}
+	return all
+}
+
+// ServeHTTP sends the WOL magic packet, then calls the next handler in the
+// chain. With AfterResponse the order is reversed.
 func (w *WakeOnLAN) ServeHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// Best-effort; don't block the request if sending fails.
-	_ = sendWOL(w.MAC, w.IP, w.portOrDefault())
+	if w.SummaryLog || w.JSONResponse {
+		var summary *requestSummary
+		r, summary = withRequestSummary(r)
+		if w.SummaryLog {
+			defer summary.log(w.requestLogger(r))
+		}
+	}
+	if !w.clientAllowed(r) {
+		w.requestLogger(r).Debug("client not allowed to trigger a send", zap.String("client_ip", clientIP(r)))
+		noteSkipped(r, "client_not_allowed")
+		if w.Required {
+			return w.fail(rw, http.StatusForbidden, "client_not_allowed", errors.New("wake_on_lan: client not allowed"))
+		}
+		return next.ServeHTTP(rw, r)
+	}
+
+	if w.Action == actionSleep {
+		// Best-effort, like waking
+		result, err := w.sendSleep(r.Context(), w.requestLogger(r))
+		w.auditSleep(w.newAuditSource(r), result, err)
+		noteOutcomes(r.Context(), []summaryOutcome{sleepOutcome(w.sleepLabel(), result, err)})
+		if w.StatusHeader != "" {
+			rw.Header().Add(w.StatusHeader, string(result)+"; target="+w.sleepLabel())
+		}
+		if err != nil && w.Required {
+			return w.fail(rw, result.status(), string(result), err)
+		}
+		return next.ServeHTTP(rw, r)
+	}
+
+	if w.OnWebSocketUpgrade && !isWebSocketUpgrade(r) {
+		w.requestLogger(r).Debug("not a WebSocket upgrade; not waking")
+		noteSkipped(r, "not_websocket_upgrade")
+		return next.ServeHTTP(rw, r)
+	}
+	if w.MaintenanceWindow != nil {
+		if until, ok := w.MaintenanceWindow.activeAt(time.Now()); ok {
+			noteSkipped(r, "maintenance")
+			return w.serveMaintenance(rw, r, until, w.requestLogger(r))
+		}
+	}
+
+	if w.DedupeSends {
+		r = withSendClaims(r)
+	}
+	budget := w.requestBudget(r)
+	if w.FromBody {
+		return w.serveBulk(rw, r, w.requestLogger(r))
+	}
+	if budget != nil && budget.exhausted() {
+		w.requestLogger(r).Debug("wake budget for the request exhausted; not waking")
+		noteSkipped(r, "budget_exhausted")
+		return next.ServeHTTP(rw, r)
+	}
+
+	targets := w.targets()
+	if w.FromQuery != nil {
+		t, err := w.queryTarget(r)
+		if err != nil {
+			return err
+		}
+		targets = []Target{t}
+	} else if t, ok, err := w.varTarget(r); err != nil {
+		return err
+	} else if ok {
+		targets = []Target{t}
+	} else if w.Dynamic && w.TargetVar != "" {
+		// The request had to name its target
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: target_var %q not set", w.TargetVar))
+	} else if w.TargetVar != "" && len(targets) == 0 && len(w.HostMap) == 0 && len(w.SNIMap) == 0 {
+		return fmt.Errorf("wake_on_lan: target_var %q not set and no targets configured", w.TargetVar)
+	} else if t, ok := w.sniTarget(r); ok {
+		targets = []Target{w.withDefaults(t)}
+	} else if t, ok := lookupHostMap(w.HostMap, r.Host); ok {
+		targets = []Target{w.withDefaults(t)}
+	} else if len(w.HostMap) > 0 && len(targets) == 0 {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("wake_on_lan: no target mapped for host %q", r.Host))
+	} else if len(w.SNIMap) > 0 && len(targets) == 0 && requestSNI(r) == "" {
+		noteSkipped(r, "no_sni")
+		return next.ServeHTTP(rw, r)
+	} else if len(w.SNIMap) > 0 && len(targets) == 0 {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("wake_on_lan: no target mapped for server name %q", requestSNI(r)))
+	}
+
+	targets, err := w.withRequestCheckPort(r, w.selectTargets(targets))
+	if err != nil {
+		return err
+	}
+	logger := w.requestLogger(r)
+	// From here on w is the request's copy if its headers override settings
+	w, repeat, err := w.withHeaderOverrides(r, logger)
+	if err != nil {
+		return err
+	}
+	if targets = w.unflagged(r, targets, logger); len(targets) == 0 {
+		noteSkipped(r, "skip_if_var")
+		return next.ServeHTTP(rw, r)
+	}
+	if targets = w.triggered(targets, logger); len(targets) == 0 {
+		noteSkipped(r, "trigger_threshold")
+		return next.ServeHTTP(rw, r)
+	}
+	targets = w.withDependencies(targets)
+	if repeat > 0 {
+		for i := range targets {
+			targets[i].Repeat = repeat
+		}
+	}
+	targets, handled, err := w.authorizeTargets(rw, r, targets, logger)
+	if err != nil || handled {
+		return err
+	}
+	if len(targets) == 0 {
+		noteSkipped(r, string(resultDenied))
+		if w.Required {
+			return w.fail(rw, resultDenied.status(), string(resultDenied), errWakeDenied)
+		}
+		return next.ServeHTTP(rw, r)
+	}
+	if w.AfterResponse {
+		noteSkipped(r, "after_response")
+		err := next.ServeHTTP(rw, r)
+		go w.wakeAfterResponse(targets, w.newAuditSource(r), logger)
+		return err
+	}
+
+	if w.WaitingPage != nil {
+		return w.serveWaiting(rw, r, next, targets, logger)
+	}
+	if w.EarlyResponse != nil {
+		return w.serveEarly(rw, r, next, targets, logger)
+	}
+	if w.BackoffResponse != nil {
+		return w.serveBackoff(rw, r, next, targets, logger)
+	}
+	if w.WakeOnFailure {
+		return w.serveWakeOnFailure(rw, r, next, targets, logger)
+	}
+
+	key, err := w.idempotencyKey(r, targets)
+	if err != nil {
+		return err
+	}
+	var results []wakeResult
+	var failure wakeResult
+	if key != "" {
+		results, failure, err = w.wakeIdempotent(rw, r, targets, key, logger)
+	} else {
+		results, failure, err = w.wakeUntilUp(rw, r, targets, logger)
+	}
+	if w.JSONResponse {
+		return w.writeJSONResponse(rw, r)
+	}
+	if w.failsRequest(err) {
+		return w.failWake(rw, r, failure, err)
+	}
+	// A replayed outcome sent nothing to hold the response for
+	if results != nil {
+		w.delayResponse(r, targets, results, logger)
+	}
 	return next.ServeHTTP(rw, r)
 }
 
+// wakeTargets wakes the targets in the configured order, adding each
+// outcome to the status header. It returns every target's result and the
+// first failure.
+func (w *WakeOnLAN) wakeTargets(rw http.ResponseWriter, r *http.Request, targets []Target, logger *zap.Logger) ([]wakeResult, wakeResult, error) {
+	ctx, cancel := w.wakeContext(r)
+	defer cancel()
+	ctx, span := startSpan(ctx, "wake_on_lan", attribute.Int("wake_on_lan.targets", len(targets)))
+	src := w.newAuditSource(r)
+	results := make([]wakeResult, len(targets))
+	errs := make([]error, len(targets))
+	deliveries := make([]*deliveryLog, len(targets))
+	took := make([]time.Duration, len(targets))
+	deps := dependencyIndexes(targets)
+	done := make([]chan struct{}, len(targets))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	started, err := w.eachTarget(ctx, len(targets), func(i int) {
+		defer close(done[i])
+		start := time.Now()
+		ctx := ctx
+		if w.DebugHeader || w.SummaryLog {
+			ctx, deliveries[i] = withDeliveryLog(ctx)
+		}
+		// Best-effort unless required; don't block the request if sending fails.
+		if deps != nil {
+			results[i], errs[i] = w.wakeAfterDependencies(ctx, targets, i, deps[i], done, results, logger)
+		} else {
+			results[i], errs[i] = w.wake(ctx, targets[i], logger)
+		}
+		if w.CancelOnClientDisconnect && r.Context().Err() != nil && !results[i].up() {
+			results[i], errs[i] = resultClientDisconnected, errClientDisconnected
+		}
+		took[i] = time.Since(start)
+		w.record(logger, targets[i], results[i], errs[i])
+		w.audit(src, targets[i], results[i], errs[i])
+	})
+	for i := started; i < len(targets); i++ {
+		results[i], errs[i] = resultError, err
+	}
+
+	var firstErr error
+	var firstFailure wakeResult
+	for i, t := range targets {
+		if w.StatusHeader != "" {
+			rw.Header().Add(w.StatusHeader, string(results[i])+"; target="+t.label())
+		}
+		if w.DebugHeader {
+			addDebugHeader(rw, deliveries[i], t, results[i])
+		}
+		if errs[i] != nil && results[i].failed() && firstErr == nil {
+			firstErr, firstFailure = errs[i], results[i]
+		}
+	}
+	w.setResultVars(r, targets, results, errs)
+	noteOutcomes(r.Context(), wakeOutcomes(targets, results, errs, deliveries, took))
+	endSpan(span, firstFailure, firstErr)
+	return results, firstFailure, firstErr
+}
+
 // UnmarshalCaddyfile sets up the handler from Caddyfile tokens.
 func (w *WakeOnLAN) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		args := d.RemainingArgs()
-		if len(args) < 2 || len(args) > 3 {
-			return d.ArgErr()
-		}
-		w.MAC = args[0]
-		w.IP = args[1]
-		w.Port = 0
-		if len(args) == 3 {
-			p, err := strconv.Atoi(args[2])
+		switch len(args) {
+		case 0:
+			// Targets are given in the block
+		case 1, 2, 3:
+			mac, ip, port, err := parseTargetArgs(d, args)
 			if err != nil {
-				return d.Errf("invalid port %q: %v", args[2], err)
+				return err
 			}
-			w.Port = p
+			w.MAC, w.IP, w.Port = mac, ip, port
+		default:
+			return d.Errf("wake_on_lan takes at most three arguments, <mac> [<ip> [port]]; other options go in its block")
 		}
-		// No nested block expected
-		if d.NextBlock(0) {
-			return d.ArgErr()
+
+		var last string
+		for d.NextBlock(0) {
+			if d.Val() == "{" {
+				return blockNotAccepted(d, last)
+			}
+			last = d.Val()
+			switch d.Val() {
+			case "repeat":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.Repeat = n
+			case "interval":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.Interval = dur
+			case "initial_delay":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.InitialDelay = dur
+			case "target":
+				t, err := parseTarget(d)
+				if err != nil {
+					return err
+				}
+				w.Targets = append(w.Targets, t)
+			case "resolve_retries":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.ResolveRetries = n
+			case "resolve_backoff":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.ResolveBackoff = dur
+			case "prefer":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "only") {
+					return d.ArgErr()
+				}
+				w.Prefer = args[0]
+				w.PreferOnly = len(args) == 2
+			case "srv":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.SRV = name
+			case "mdns":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.MDNS = name
+			case "mdns_timeout":
+				timeout, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.MDNSTimeout = timeout
+			case "mdns_ttl":
+				ttl, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.MDNSTTL = ttl
+			case "check":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				w.Check = args[0]
+				if len(args) == 2 {
+					dur, err := caddy.ParseDuration(args[1])
+					if err != nil {
+						return d.Errf("invalid check timeout %q: %v", args[1], err)
+					}
+					w.CheckTimeout = caddy.Duration(dur)
+				}
+			case "check_port_from_request":
+				args := d.RemainingArgs()
+				switch len(args) {
+				case 0:
+					w.CheckPortFromRequest = defaultCheckPortSource
+				case 1:
+					w.CheckPortFromRequest = args[0]
+				default:
+					return d.ArgErr()
+				}
+			case "wait":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.Wait = dur
+			case "on_timeout":
+				mode, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.OnTimeout = mode
+			case "on_timeout_retries":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.OnTimeoutRetries = n
+			case "group":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Group = name
+			case "waiting_page":
+				page, err := parseWaitingPage(d)
+				if err != nil {
+					return err
+				}
+				w.WaitingPage = page
+			case "early_response":
+				e, err := parseEarlyResponse(d)
+				if err != nil {
+					return err
+				}
+				w.EarlyResponse = e
+			case "backoff_response":
+				b, err := parseBackoffResponse(d)
+				if err != nil {
+					return err
+				}
+				w.BackoffResponse = b
+			case "maintenance_window":
+				m, err := parseMaintenanceWindow(d)
+				if err != nil {
+					return err
+				}
+				w.MaintenanceWindow = m
+			case "wait_http":
+				h, err := parseWaitHTTP(d)
+				if err != nil {
+					return err
+				}
+				w.WaitHTTP = h
+			case "confirm_exec":
+				w.ConfirmExec = d.RemainingArgs()
+				if len(w.ConfirmExec) == 0 {
+					return d.ArgErr()
+				}
+			case "confirm_exec_timeout":
+				timeout, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.ConfirmExecTimeout = timeout
+			case "wait_arp":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.WaitARP = true
+			case "confirm_arp_learned":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.ConfirmARPLearned = true
+			case "ack":
+				a, err := parseAck(d)
+				if err != nil {
+					return err
+				}
+				w.Ack = a
+			case "confirm_tx":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.ConfirmTX = true
+			case "confirm_listen":
+				c, err := parseConfirmListen(d)
+				if err != nil {
+					return err
+				}
+				w.ConfirmListen = c
+			case "name":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Name = name
+			case "ip":
+				ip, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				if w.IP != "" {
+					return d.Errf("ip %q already given as an argument", w.IP)
+				}
+				w.IP = ip
+			case "broadcast":
+				addr, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Broadcast = addr
+			case "broadcast_source":
+				policy, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.BroadcastSource = policy
+			case "send_buffer":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.SendBuffer = n
+			case "shared_broadcast_socket":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.SharedBroadcastSocket = true
+			case "required":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.Required = true
+			case "strict":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.Strict = true
+			case "strictness":
+				level, checks, err := parseStrictness(d)
+				if err != nil {
+					return err
+				}
+				w.Strictness = level
+				for check, checkLevel := range checks {
+					if w.StrictChecks == nil {
+						w.StrictChecks = make(map[string]string)
+					}
+					w.StrictChecks[check] = checkLevel
+				}
+			case "json_errors":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.JSONErrors = true
+			case "json_response":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.JSONResponse = true
+			case "retriable_status":
+				status, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.RetriableStatus = status
+			case "retriable_delay":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.RetriableDelay = dur
+			case "after_response":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.AfterResponse = true
+			case "admin_trigger":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.AdminTrigger = true
+			case "cancel_on_client_disconnect":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.CancelOnClientDisconnect = true
+			case "mac_cache_ttl":
+				ttl, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.MACCacheTTL = ttl
+			case "mac_miss_ttl":
+				ttl, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.MACMissTTL = ttl
+			case "dhcp_leases":
+				path, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.DHCPLeases = path
+			case "snmp":
+				s, err := parseSNMP(d)
+				if err != nil {
+					return err
+				}
+				w.SNMP = s
+			case "mac_sources":
+				w.MACSources = d.RemainingArgs()
+				if len(w.MACSources) == 0 {
+					return d.ArgErr()
+				}
+			case "ethers_file":
+				path, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.EthersFile = path
+			case "notify":
+				u, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Notify = u
+			case "notify_template":
+				tmpl, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.NotifyTemplate = tmpl
+			case "notify_timeout":
+				timeout, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.NotifyTimeout = timeout
+			case "notify_transport":
+				raw, err := parseNotifyTransport(d)
+				if err != nil {
+					return err
+				}
+				w.NotifyTransportRaw = raw
+			case "on_wake_exec":
+				w.OnWakeExec = d.RemainingArgs()
+				if len(w.OnWakeExec) == 0 {
+					return d.ArgErr()
+				}
+			case "on_wake_exec_timeout":
+				timeout, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.OnWakeExecTimeout = timeout
+			case "protocol":
+				protocol, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Protocol = protocol
+			case "transports":
+				w.Transports = d.RemainingArgs()
+				if len(w.Transports) == 0 {
+					return d.ArgErr()
+				}
+			case "transport":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Transports = append(w.Transports, name)
+			case "dedupe_sends":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.DedupeSends = true
+			case "raw_interface":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.RawInterface = name
+			case "vrf":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.VRF = name
+			case "ttl":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.TTL = n
+			case "relay":
+				addrs := d.RemainingArgs()
+				if len(addrs) == 0 {
+					return d.ArgErr()
+				}
+				// One relay stays in relay; more, here or on repeated
+				// lines, go to relays
+				if w.Relay == "" && len(w.Relays) == 0 && len(addrs) == 1 {
+					w.Relay = addrs[0]
+					break
+				}
+				if w.Relay != "" {
+					w.Relays, w.Relay = append(w.Relays, w.Relay), ""
+				}
+				w.Relays = append(w.Relays, addrs...)
+			case "relay_strategy":
+				strategy, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.RelayStrategy = strategy
+			case "relay_protocol":
+				protocol, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.RelayProtocol = protocol
+			case "site":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return d.ArgErr()
+				}
+				if w.Sites == nil {
+					w.Sites = make(map[string][]string)
+				}
+				w.Sites[args[0]] = append(w.Sites[args[0]], args[1:]...)
+			case "helper_socket":
+				path, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.HelperSocket = path
+			case "publish":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				w.Publish = &Publish{Backend: args[0], Args: args[1:]}
+			case "grpc":
+				g, err := parseGRPC(d)
+				if err != nil {
+					return err
+				}
+				w.GRPC = g
+			case "send_timeout":
+				timeout, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.SendTimeout = timeout
+			case "escalate":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					strategy := d.Val()
+					wait, err := parseDurationArg(d)
+					if err != nil {
+						return err
+					}
+					w.Escalate = append(w.Escalate, EscalationStep{Strategy: strategy, Wait: wait})
+				}
+			case "response_delay":
+				delay, err := parseResponseDelay(d)
+				if err != nil {
+					return err
+				}
+				w.ResponseDelay = delay
+			case "send_until_up":
+				s, err := parseSendUntilUp(d)
+				if err != nil {
+					return err
+				}
+				w.SendUntilUp = s
+			case "broadcast_fallback":
+				f, err := parseBroadcastFallback(d)
+				if err != nil {
+					return err
+				}
+				w.BroadcastFallback = f
+			case "once_per_boot":
+				o, err := parseOncePerBoot(d)
+				if err != nil {
+					return err
+				}
+				w.OncePerBoot = o
+			case "confirm_cache_ttl":
+				ttl, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.ConfirmCacheTTL = ttl
+			case "inventory":
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.ArgErr()
+				}
+				w.Inventory = append(w.Inventory, names...)
+			case "profile":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Profile = name
+			case "from_body":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.FromBody = true
+			case "from_query":
+				params, err := parseFromQuery(d)
+				if err != nil {
+					return err
+				}
+				w.FromQuery = params
+			case "dynamic":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.Dynamic = true
+			case "target_var":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.TargetVar = name
+			case "skip_if_var":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.SkipIfVar = name
+			case "max_body_targets":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.MaxBodyTargets = n
+			case "max_body_bytes":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.MaxBodyBytes = n
+			case "body_content_type":
+				contentType, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.BodyContentType = contentType
+			case "bulk_concurrency":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.BulkConcurrency = n
+			case "rate":
+				r, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Rate = r
+			case "burst":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.Burst = n
+			case "trigger_threshold":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(args[0])
+				if err != nil {
+					return d.Errf("invalid trigger_threshold count %q", args[0])
+				}
+				window, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("invalid trigger_threshold window %q: %v", args[1], err)
+				}
+				w.TriggerThreshold = &TriggerThreshold{Count: n, Window: caddy.Duration(window)}
+			case "shared_limit":
+				l, err := parseSharedLimit(d)
+				if err != nil {
+					return err
+				}
+				w.SharedLimit = l
+			case "cooldown_jitter":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.CooldownJitter = dur
+			case "max_lifetime_packets":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.MaxLifetimePackets = n
+			case "authorize":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Authorize = name
+			case "wake_budget":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.WakeBudget = n
+			case "select":
+				policy, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Select = policy
+			case "allow_oui":
+				ouis := d.RemainingArgs()
+				if len(ouis) == 0 {
+					return d.ArgErr()
+				}
+				w.AllowOUI = append(w.AllowOUI, ouis...)
+			case "verify_mac_ip":
+				v := new(VerifyMACIP)
+				if d.NextArg() {
+					v.OnUnknown = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.VerifyMACIP = v
+			case "order":
+				order, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Order = order
+			case "stagger":
+				stagger, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.Stagger = stagger
+			case "wake_on_failure":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.WakeOnFailure = true
+			case "on_websocket_upgrade":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.OnWebSocketUpgrade = true
+			case "upstream_retries":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.UpstreamRetries = n
+			case "failure_status":
+				codes := d.RemainingArgs()
+				if len(codes) == 0 {
+					return d.ArgErr()
+				}
+				for _, c := range codes {
+					code, err := strconv.Atoi(c)
+					if err != nil {
+						return d.Errf("invalid failure_status %q: %v", c, err)
+					}
+					w.FailureStatus = append(w.FailureStatus, code)
+				}
+			case "retry_delay":
+				delay, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.RetryDelay = delay
+			case "allow_from", "deny_from":
+				name := d.Val()
+				cidrs := d.RemainingArgs()
+				if len(cidrs) == 0 {
+					return d.ArgErr()
+				}
+				if name == "allow_from" {
+					w.AllowFrom = append(w.AllowFrom, cidrs...)
+				} else {
+					w.DenyFrom = append(w.DenyFrom, cidrs...)
+				}
+			case "source_port_range":
+				r, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.SourcePortRange = r
+			case "socket_reuse":
+				mode, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.SocketReuse = mode
+			case "retry_ports":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, arg := range args {
+					port, err := strconv.Atoi(arg)
+					if err != nil {
+						return d.Errf("invalid retry_ports port %q", arg)
+					}
+					w.RetryPorts = append(w.RetryPorts, port)
+				}
+			case "retry_probe":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				w.RetryProbe = args[0]
+				if len(args) == 2 {
+					dur, err := caddy.ParseDuration(args[1])
+					if err != nil {
+						return d.Errf("invalid retry_probe timeout %q: %v", args[1], err)
+					}
+					w.RetryProbeTimeout = caddy.Duration(dur)
+				}
+			case "audit_log":
+				audit, err := parseAuditLog(d)
+				if err != nil {
+					return err
+				}
+				w.AuditLog = audit
+			case "warm_up":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.WarmUp = true
+			case "self_test":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.SelfTest = true
+			case "pad_to":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.PadTo = n
+			case "max_mac_expansion":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.MaxMACExpansion = n
+			case "secureon":
+				password, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.SecureOn = password
+			case "packet_template":
+				tmpl, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.PacketTemplate = tmpl
+			case "encoding":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Encoding = name
+			case "checksum":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Checksum = name
+			case "warn_size":
+				n, err := parseIntArg(d)
+				if err != nil {
+					return err
+				}
+				w.WarnSize = n
+			case "allow_large_packet":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.AllowLargePacket = true
+			case "log_throttle":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.LogThrottle = dur
+			case "log_packet":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.LogPacket = true
+			case "slow_send":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.SlowSend = dur
+			case "summary_log":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.SummaryLog = true
+			case "request_id_header":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.RequestIDHeader = name
+			case "grace_period":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.GracePeriod = dur
+			case "idempotency_key":
+				args := d.RemainingArgs()
+				switch len(args) {
+				case 0:
+					w.IdempotencyKey = headerIdempotencyKey
+				case 1:
+					w.IdempotencyKey = args[0]
+				default:
+					return d.ArgErr()
+				}
+			case "idempotency_ttl":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.IdempotencyTTL = dur
+			case "header_overrides":
+				o, err := parseHeaderOverrides(d)
+				if err != nil {
+					return err
+				}
+				w.HeaderOverrides = o
+			case "batch_window":
+				dur, err := parseDurationArg(d)
+				if err != nil {
+					return err
+				}
+				w.BatchWindow = dur
+			case "action":
+				action, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.Action = action
+			case "sleep_endpoint":
+				endpoint, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.SleepEndpoint = endpoint
+			case "sleep_payload":
+				args := d.RemainingArgs()
+				switch {
+				case len(args) == 1:
+					w.SleepPayload = []byte(args[0])
+				case len(args) == 2 && args[0] == "hex":
+					b, err := hex.DecodeString(args[1])
+					if err != nil {
+						return d.Errf("invalid hex sleep_payload %q: %v", args[1], err)
+					}
+					w.SleepPayload = b
+				default:
+					return d.ArgErr()
+				}
+			case "status_header":
+				name, err := parseStringArg(d)
+				if err != nil {
+					return err
+				}
+				w.StatusHeader = name
+			case "debug_header":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.DebugHeader = true
+			case "access_log_fields":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.AccessLogFields = true
+			case "host_map":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if w.HostMap == nil {
+					w.HostMap = make(map[string]Target)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					host := strings.ToLower(d.Val())
+					t, err := parseTarget(d)
+					if err != nil {
+						return err
+					}
+					w.HostMap[host] = t
+				}
+			case "sni_map":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if w.SNIMap == nil {
+					w.SNIMap = make(map[string]Target)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					name := strings.ToLower(d.Val())
+					t, err := parseTarget(d)
+					if err != nil {
+						return err
+					}
+					w.SNIMap[name] = t
+				}
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
 		}
 	}
 	return nil
 }
 
+// parseTarget parses a `target <mac> <ip> [port] { ... }` subdirective, or
+// any other line of the form `<key> <mac> <ip> [port] { ... }`.
+func parseTarget(d *caddyfile.Dispenser) (Target, error) {
+	var t Target
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 3 {
+		return t, d.ArgErr()
+	}
+	mac, ip, port, err := parseTargetArgs(d, args)
+	if err != nil {
+		return t, err
+	}
+	t.MAC, t.IP, t.Port = mac, ip, port
+
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return t, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "repeat":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.Repeat = n
+		case "interval":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.Interval = dur
+		case "check":
+			addr, err := parseStringArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.Check = addr
+		case "srv":
+			name, err := parseStringArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.SRV = name
+		case "mdns":
+			name, err := parseStringArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.MDNS = name
+		case "name":
+			name, err := parseStringArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.Name = name
+		case "secureon":
+			password, err := parseStringArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.SecureOn = password
+		case "packet_template":
+			tmpl, err := parseStringArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.PacketTemplate = tmpl
+		case "encoding":
+			name, err := parseStringArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.Encoding = name
+		case "checksum":
+			name, err := parseStringArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.Checksum = name
+		case "interface":
+			name, err := parseStringArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.Interface = name
+		case "ttl":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.TTL = n
+		case "depends_on":
+			names := d.RemainingArgs()
+			if len(names) == 0 {
+				return t, d.ArgErr()
+			}
+			t.DependsOn = append(t.DependsOn, names...)
+		case "weight":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return t, err
+			}
+			t.Weight = n
+		case "sites":
+			names := d.RemainingArgs()
+			if len(names) == 0 {
+				return t, d.ArgErr()
+			}
+			t.Sites = append(t.Sites, names...)
+		case "bmc":
+			b, err := parseBMC(d)
+			if err != nil {
+				return t, err
+			}
+			t.BMC = b
+		case "meta":
+			m, err := parseTargetMeta(d)
+			if err != nil {
+				return t, err
+			}
+			t.Meta = m
+		default:
+			return t, d.Errf("unrecognized target subdirective '%s'", d.Val())
+		}
+	}
+	return t, nil
+}
+
+// parseTargetArgs parses the `<mac> [<ip> [port]]` argument form. The IP
+// may only be left out when packets are broadcast.
+func parseTargetArgs(d *caddyfile.Dispenser, args []string) (string, string, int, error) {
+	var ip string
+	if len(args) >= 2 {
+		ip = args[1]
+	}
+	port := 0
+	if len(args) == 3 {
+		p, err := strconv.Atoi(args[2])
+		if err != nil {
+			return "", "", 0, d.Errf("invalid port %q: %v", args[2], err)
+		}
+		port = p
+	}
+	return args[0], ip, port, nil
+}
+
+// blockNotAccepted reports a block opened after a subdirective that takes
+// none, which would otherwise surface as an unrecognized subdirective '{'.
+func blockNotAccepted(d *caddyfile.Dispenser, subdirective string) error {
+	if subdirective == "" {
+		return d.Err("unexpected block")
+	}
+	return d.Errf("subdirective '%s' does not accept a block", subdirective)
+}
+
+// parseIntArg parses the single integer argument of the current subdirective.
+func parseIntArg(d *caddyfile.Dispenser) (int, error) {
+	name := d.Val()
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	n, err := strconv.Atoi(d.Val())
+	if err != nil {
+		return 0, d.Errf("invalid %s %q: %v", name, d.Val(), err)
+	}
+	if d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	return n, nil
+}
+
+// parseDurationArg parses the single duration argument of the current subdirective.
+func parseDurationArg(d *caddyfile.Dispenser) (caddy.Duration, error) {
+	name := d.Val()
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return 0, d.Errf("invalid %s %q: %v", name, d.Val(), err)
+	}
+	if d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	return caddy.Duration(dur), nil
+}
+
+// parseStringArg parses the single argument of the current subdirective.
+func parseStringArg(d *caddyfile.Dispenser) (string, error) {
+	if !d.NextArg() {
+		return "", d.ArgErr()
+	}
+	val := d.Val()
+	if d.NextArg() {
+		return "", d.ArgErr()
+	}
+	return val, nil
+}
+
 // Interface guards
 var (
 	_ caddy.Module                = (*WakeOnLAN)(nil)
+	_ caddy.Provisioner           = (*WakeOnLAN)(nil)
+	_ caddy.Validator             = (*WakeOnLAN)(nil)
+	_ caddy.CleanerUpper          = (*WakeOnLAN)(nil)
 	_ caddyhttp.MiddlewareHandler = (*WakeOnLAN)(nil)
 	_ caddyfile.Unmarshaler       = (*WakeOnLAN)(nil)
 )
@@ -108,6 +3102,9 @@ var (
 func init() {
 	caddy.RegisterModule(WakeOnLAN{})
 	httpcaddyfile.RegisterHandlerDirective("wake_on_lan", func(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+		if err := checkAppOptions(h); err != nil {
+			return nil, err
+		}
 		var w WakeOnLAN
 		if err := w.UnmarshalCaddyfile(h.Dispenser); err != nil {
 			return nil, err
@@ -115,8 +3112,14 @@ func init() {
 		if err := w.Validate(); err != nil {
 			return nil, err
 		}
+		if w.Authorize != "" {
+			addNamedRoute(h, w.Authorize)
+		}
 		return &w, nil
 	})
+	// Wake before proxying to the host; the global `order` option can
+	// still move it
+	httpcaddyfile.RegisterDirectiveOrder("wake_on_lan", httpcaddyfile.Before, "reverse_proxy")
 }
 
 // parseMAC parses MAC addresses in common formats (with ':' or '-' separators, or raw hex).
@@ -140,33 +3143,3 @@ func parseMAC(s string) (net.HardwareAddr, error) {
 	}
 	return net.HardwareAddr(b), nil
 }
-
-func sendWOL(macStr, ip string, port int) error {
-	hw, err := parseMAC(macStr)
-	if err != nil {
-		return err
-	}
-
-	// Build magic packet: 6 x 0xFF followed by MAC repeated 16 times
-	packet := make([]byte, 6+16*6)
-	for i := 0; i < 6; i++ {
-		packet[i] = 0xFF
-	}
-	for i := 0; i < 16; i++ {
-		copy(packet[6+i*6:], hw)
-	}
-
-	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(port)))
-	if err != nil {
-		return err
-	}
-
-	conn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	_, err = conn.Write(packet)
-	return err
-}
@@ -0,0 +1,519 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	_ "github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// testMAC is the MAC the tests wake.
+const testMAC = "00:11:22:33:44:55"
+
+// fakeHost is a UDP listener standing in for the host being woken, so
+// tests can see the packets a handler sends.
+type fakeHost struct {
+	conn    *net.UDPConn
+	packets chan []byte
+}
+
+// newFakeHost listens on a free loopback port until the test ends.
+func newFakeHost(t *testing.T) *fakeHost {
+	t.Helper()
+	return newFakeHostOn(t, net.IPv4(127, 0, 0, 1))
+}
+
+// newFakeHostOn is newFakeHost listening on ip, such as the wildcard
+// address to catch broadcasts.
+func newFakeHostOn(t *testing.T, ip net.IP) *fakeHost {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newFakeHostConn(t, conn)
+}
+
+// newFakeHostConn is newFakeHost receiving on conn, such as one that
+// joined a multicast group.
+func newFakeHostConn(t *testing.T, conn *net.UDPConn) *fakeHost {
+	t.Helper()
+	h := &fakeHost{conn: conn, packets: make(chan []byte, 64)}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				close(h.packets)
+				return
+			}
+			h.packets <- bytes.Clone(buf[:n])
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return h
+}
+
+// port returns the port the fake host listens on.
+func (h *fakeHost) port() int {
+	return h.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// expect waits for n packets and returns them, failing the test if they
+// don't arrive in time.
+func (h *fakeHost) expect(t *testing.T, n int) [][]byte {
+	t.Helper()
+	var got [][]byte
+	timeout := time.After(2 * time.Second)
+	for len(got) < n {
+		select {
+		case p := <-h.packets:
+			got = append(got, p)
+		case <-timeout:
+			t.Fatalf("got %d packets, want %d", len(got), n)
+		}
+	}
+	return got
+}
+
+// expectNone fails the test if a packet arrives within a short while.
+func (h *fakeHost) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case p := <-h.packets:
+		t.Fatalf("got a packet of %d bytes, want none", len(p))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// provisionTest provisions and validates w as Caddy would, cleaning it up
+// when the test ends.
+func provisionTest(t *testing.T, w *WakeOnLAN) *WakeOnLAN {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	return provisionIn(t, ctx, w)
+}
+
+// provisionIn is provisionTest in ctx, such as one loadApp returned.
+func provisionIn(t *testing.T, ctx caddy.Context, w *WakeOnLAN) *WakeOnLAN {
+	t.Helper()
+	if err := w.Provision(ctx); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	t.Cleanup(func() { w.Cleanup() })
+	if err := w.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	return w
+}
+
+// newTestRequest returns a request carrying the replacer and variables
+// Caddy's HTTP server sets up.
+func newTestRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+	return r.WithContext(ctx)
+}
+
+// observeLogs sends w's logs, from debug level up, to the returned
+// observer instead.
+func observeLogs(w *WakeOnLAN) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.DebugLevel)
+	w.logger = zap.New(core)
+	return logs
+}
+
+// nextHandler is the handler after wake_on_lan, recording whether it ran.
+type nextHandler struct {
+	called bool
+}
+
+func (n *nextHandler) ServeHTTP(rw http.ResponseWriter, _ *http.Request) error {
+	n.called = true
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// serveTest runs r through w, returning the response, whether the next
+// handler ran, and the handler's error.
+func serveTest(w *WakeOnLAN, r *http.Request) (*httptest.ResponseRecorder, bool, error) {
+	rec := httptest.NewRecorder()
+	next := new(nextHandler)
+	err := w.ServeHTTP(rec, r, next)
+	return rec, next.called, err
+}
+
+// statusOf returns the status a request got: that of the handler error if
+// there is one, as Caddy would write it, or else the recorded one.
+func statusOf(rec *httptest.ResponseRecorder, err error) int {
+	if err != nil {
+		var herr caddyhttp.HandlerError
+		if errors.As(err, &herr) && herr.StatusCode != 0 {
+			return herr.StatusCode
+		}
+		return http.StatusInternalServerError
+	}
+	return rec.Code
+}
+
+// parseTest parses input as a wake_on_lan directive.
+func parseTest(input string) (*WakeOnLAN, error) {
+	w := new(WakeOnLAN)
+	err := w.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input))
+	return w, err
+}
+
+func TestParseMAC(t *testing.T) {
+	want := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{in: "00:11:22:33:44:55"},
+		{in: "00-11-22-33-44-55"},
+		{in: "001122334455"},
+		{in: "AA:bb:cc:DD:ee:ff"},
+		{in: "00:11:22:33:44", wantErr: true},
+		{in: "0011223344556", wantErr: true},
+		{in: "00:11:22:33:44:zz", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		hw, err := parseMAC(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseMAC(%q) = %s, want an error", tt.in, hw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMAC(%q): %v", tt.in, err)
+			continue
+		}
+		if tt.in != "AA:bb:cc:DD:ee:ff" && !bytes.Equal(hw, want) {
+			t.Errorf("parseMAC(%q) = %s, want %s", tt.in, hw, want)
+		}
+	}
+}
+
+func TestBuildMagicPacket(t *testing.T) {
+	hw, _ := parseMAC(testMAC)
+	packet := buildMagicPacket(hw)
+	if len(packet) != 102 {
+		t.Fatalf("packet is %d bytes, want 102", len(packet))
+	}
+	if !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xFF}, 6)) {
+		t.Errorf("header = % x, want six 0xFF", packet[:6])
+	}
+	for i := 0; i < 16; i++ {
+		if got := packet[6+i*6 : 12+i*6]; !bytes.Equal(got, hw) {
+			t.Errorf("repetition %d = % x, want % x", i, got, hw)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		w       WakeOnLAN
+		wantErr string
+	}{
+		{name: "valid", w: WakeOnLAN{MAC: testMAC, IP: "192.168.1.10"}},
+		{name: "valid with port", w: WakeOnLAN{MAC: testMAC, IP: "192.168.1.10", Port: 7}},
+		{name: "missing MAC", w: WakeOnLAN{IP: "192.168.1.10"}, wantErr: "MAC must be specified"},
+		{name: "invalid MAC", w: WakeOnLAN{MAC: "00:11:22", IP: "192.168.1.10"}, wantErr: "invalid MAC"},
+		{name: "missing IP", w: WakeOnLAN{MAC: testMAC}, wantErr: "IP must be specified"},
+		{name: "port too large", w: WakeOnLAN{MAC: testMAC, IP: "192.168.1.10", Port: 70000}, wantErr: "invalid port"},
+		{name: "negative port", w: WakeOnLAN{MAC: testMAC, IP: "192.168.1.10", Port: -1}, wantErr: "invalid port"},
+		{name: "broadcast without IP", w: WakeOnLAN{MAC: testMAC, Broadcast: "192.168.1.255"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.w.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("Validate succeeded, want an error containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("Validate: %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    WakeOnLAN
+		wantErr bool
+	}{
+		{
+			name:  "mac and ip",
+			input: `wake_on_lan 00:11:22:33:44:55 192.168.1.10`,
+			want:  WakeOnLAN{MAC: testMAC, IP: "192.168.1.10"},
+		},
+		{
+			name:  "mac, ip and port",
+			input: `wake_on_lan 00:11:22:33:44:55 192.168.1.10 7`,
+			want:  WakeOnLAN{MAC: testMAC, IP: "192.168.1.10", Port: 7},
+		},
+		{
+			name: "block",
+			input: `wake_on_lan 00:11:22:33:44:55 192.168.1.10 {
+				repeat 3
+				interval 100ms
+			}`,
+			want: WakeOnLAN{MAC: testMAC, IP: "192.168.1.10", Repeat: 3, Interval: caddy.Duration(100 * time.Millisecond)},
+		},
+		{name: "too many args", input: `wake_on_lan 00:11:22:33:44:55 192.168.1.10 9 extra`, wantErr: true},
+		{name: "bad port", input: `wake_on_lan 00:11:22:33:44:55 192.168.1.10 nine`, wantErr: true},
+		{name: "unknown subdirective", input: "wake_on_lan 00:11:22:33:44:55 192.168.1.10 {\n\tbogus\n}", wantErr: true},
+		{name: "missing repeat count", input: "wake_on_lan 00:11:22:33:44:55 192.168.1.10 {\n\trepeat\n}", wantErr: true},
+		{name: "extra repeat arg", input: "wake_on_lan 00:11:22:33:44:55 192.168.1.10 {\n\trepeat 3 4\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("UnmarshalCaddyfile succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnmarshalCaddyfile: %v", err)
+			}
+			if w.MAC != tt.want.MAC || w.IP != tt.want.IP || w.Port != tt.want.Port || w.Repeat != tt.want.Repeat || w.Interval != tt.want.Interval {
+				t.Fatalf("got mac=%q ip=%q port=%d repeat=%d interval=%s, want mac=%q ip=%q port=%d repeat=%d interval=%s",
+					w.MAC, w.IP, w.Port, w.Repeat, time.Duration(w.Interval),
+					tt.want.MAC, tt.want.IP, tt.want.Port, tt.want.Repeat, time.Duration(tt.want.Interval))
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileTooFewArgs(t *testing.T) {
+	// Without a positional target the block must list one
+	w, err := parseTest(`wake_on_lan`)
+	if err == nil {
+		err = w.Validate()
+	}
+	if err == nil {
+		t.Fatal("a handler without targets was accepted")
+	}
+}
+
+func TestServeHTTPSendsAndCallsNext(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Repeat: 2})
+
+	_, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if !called {
+		t.Error("next handler not called")
+	}
+	hw, _ := parseMAC(testMAC)
+	for i, p := range host.expect(t, 2) {
+		if !bytes.Equal(p[:102], buildMagicPacket(hw)) {
+			t.Errorf("packet %d isn't the magic packet for %s", i, testMAC)
+		}
+	}
+}
+
+func TestServeHTTPSkips(t *testing.T) {
+	tests := []struct {
+		name string
+		w    func(host *fakeHost) *WakeOnLAN
+	}{
+		{
+			name: "client not allowed",
+			w: func(host *fakeHost) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), AllowFrom: []string{"10.0.0.0/8"}}
+			},
+		},
+		{
+			name: "already up",
+			w: func(host *fakeHost) *WakeOnLAN {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { ln.Close() })
+				go func() {
+					for {
+						c, err := ln.Accept()
+						if err != nil {
+							return
+						}
+						c.Close()
+					}
+				}()
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Check: ln.Addr().String()}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, tt.w(host))
+			r := newTestRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			_, called, err := serveTest(w, r)
+			if err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if !called {
+				t.Error("next handler not called")
+			}
+			host.expectNone(t)
+		})
+	}
+}
+
+// adaptedHandlers adapts a Caddyfile and returns the handlers of its first
+// route in the order they run, flattening subroutes.
+func adaptedHandlers(t *testing.T, input string) []map[string]any {
+	t.Helper()
+	config, _, err := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("adapting:\n%s\n%v", input, err)
+	}
+	var cfg struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Routes []map[string]any `json:"routes"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	var handlers []map[string]any
+	var walk func(routes []any)
+	walk = func(routes []any) {
+		for _, route := range routes {
+			handle, _ := route.(map[string]any)["handle"].([]any)
+			for _, h := range handle {
+				h := h.(map[string]any)
+				if h["handler"] == "subroute" {
+					walk(h["routes"].([]any))
+					continue
+				}
+				handlers = append(handlers, h)
+			}
+		}
+	}
+	for _, srv := range cfg.Apps.HTTP.Servers {
+		for _, route := range srv.Routes {
+			walk([]any{route})
+		}
+	}
+	return handlers
+}
+
+func TestDirectiveOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		site  string
+		order []string
+	}{
+		{
+			name:  "after reverse_proxy",
+			site:  "reverse_proxy 127.0.0.1:8080\n\twake_on_lan %s 127.0.0.1 %d",
+			order: []string{"wake_on_lan", "reverse_proxy"},
+		},
+		{
+			name:  "before reverse_proxy",
+			site:  "wake_on_lan %s 127.0.0.1 %d\n\treverse_proxy 127.0.0.1:8080",
+			order: []string{"wake_on_lan", "reverse_proxy"},
+		},
+		{
+			// The global order option would do too, but it changes the
+			// order for the whole process
+			name:  "route block",
+			site:  "route {\n\t\treverse_proxy 127.0.0.1:8080\n\t\twake_on_lan %s 127.0.0.1 %d\n\t}",
+			order: []string{"reverse_proxy", "wake_on_lan"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			handlers := adaptedHandlers(t, "example.com {\n\t"+fmt.Sprintf(tt.site, testMAC, host.port())+"\n}\n")
+			var order []string
+			for _, h := range handlers {
+				order = append(order, h["handler"].(string))
+			}
+			if !slices.Equal(order, tt.order) {
+				t.Fatalf("handlers run in order %v, want %v", order, tt.order)
+			}
+
+			// Run the adapted chain, with a stand-in for reverse_proxy that
+			// records whether the packet had arrived when it was reached
+			var proxied, wokenFirst bool
+			next := caddyhttp.Handler(caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+			for i := len(handlers) - 1; i >= 0; i-- {
+				then := next
+				switch handlers[i]["handler"] {
+				case "wake_on_lan":
+					raw, err := json.Marshal(handlers[i])
+					if err != nil {
+						t.Fatal(err)
+					}
+					w := new(WakeOnLAN)
+					if err := json.Unmarshal(raw, w); err != nil {
+						t.Fatal(err)
+					}
+					provisionTest(t, w)
+					next = caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+						return w.ServeHTTP(rw, r, then)
+					})
+				case "reverse_proxy":
+					next = caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+						proxied = true
+						select {
+						case <-host.packets:
+							wokenFirst = true
+						case <-time.After(500 * time.Millisecond):
+						}
+						return then.ServeHTTP(rw, r)
+					})
+				}
+			}
+			if err := next.ServeHTTP(httptest.NewRecorder(), newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			if !proxied {
+				t.Fatal("never reached reverse_proxy")
+			}
+			if wantFirst := tt.order[0] == "wake_on_lan"; wokenFirst != wantFirst {
+				t.Errorf("packet sent before proxying = %v, want %v", wokenFirst, wantFirst)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Layouts of the maintenance window's times.
+const (
+	maintenanceDateTime = "2006-01-02T15:04"
+	maintenanceDate     = "2006-01-02"
+	maintenanceClock    = "15:04"
+)
+
+// maintenanceDays are the days a recurring period can start on, by the
+// names they are configured with.
+var maintenanceDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// MaintenanceWindow suppresses wakes during explicit blackouts, e.g. a
+// patching window when machines must stay off. While one of its periods
+// is on, requests aren't woken for, nor passed on: they are answered with
+// its status and body, and a Retry-After of the period's end.
+type MaintenanceWindow struct {
+	// Why wakes are suppressed, told to clients.
+	Reason string `json:"reason,omitempty"`
+	// IANA time zone the periods are in, e.g. Europe/Warsaw. Default: the
+	// server's local time.
+	Timezone string `json:"timezone,omitempty"`
+	// One-off periods.
+	Between []MaintenancePeriod `json:"between,omitempty"`
+	// Periods recurring every week.
+	Recurring []MaintenanceRecurrence `json:"recurring,omitempty"`
+	// Status the requests are answered with. Default: 503.
+	Status int `json:"status,omitempty"`
+	// Body the requests are answered with, with the placeholders
+	// {wake.reason} and {wake.until}, the period's end. Default: a line
+	// saying wakes are suspended, until when and why.
+	Body string `json:"body,omitempty"`
+
+	loc     *time.Location
+	between [][2]time.Time
+}
+
+// MaintenancePeriod is a one-off period of a maintenance window.
+type MaintenancePeriod struct {
+	// Start and end, as 2006-01-02T15:04, or a date: a start date begins
+	// the day, an end date covers it.
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// MaintenanceRecurrence is a period of a maintenance window recurring
+// every week.
+type MaintenanceRecurrence struct {
+	// Days the period starts on, mon to sun. Default: every day.
+	Days []string `json:"days,omitempty"`
+	// Times of day the period starts and ends, as 15:04. An end no later
+	// than the start is on the next day.
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// validateMaintenance checks maintenance_window.
+func (w *WakeOnLAN) validateMaintenance() error {
+	m := w.MaintenanceWindow
+	if m == nil {
+		return nil
+	}
+	if _, err := m.compile(); err != nil {
+		return fmt.Errorf("maintenance_window: %w", err)
+	}
+	if m.Status != 0 && (m.Status < 200 || m.Status > 599) {
+		return fmt.Errorf("maintenance_window: invalid status %d", m.Status)
+	}
+	return nil
+}
+
+// provisionMaintenance loads the time zone and parses the one-off
+// periods of maintenance_window.
+func (w *WakeOnLAN) provisionMaintenance() error {
+	m := w.MaintenanceWindow
+	if m == nil {
+		return nil
+	}
+	between, err := m.compile()
+	if err != nil {
+		return fmt.Errorf("wake_on_lan: maintenance_window: %w", err)
+	}
+	m.between = between
+	return nil
+}
+
+// compile loads the time zone, setting m.loc, checks the recurring
+// periods and returns the one-off ones parsed.
+func (m *MaintenanceWindow) compile() ([][2]time.Time, error) {
+	if len(m.Between) == 0 && len(m.Recurring) == 0 {
+		return nil, errors.New("no periods; want between or recurring")
+	}
+	m.loc = time.Local
+	if m.Timezone != "" {
+		loc, err := time.LoadLocation(m.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %w", err)
+		}
+		m.loc = loc
+	}
+	between := make([][2]time.Time, 0, len(m.Between))
+	for _, p := range m.Between {
+		start, _, err := m.parseTime(p.Start)
+		if err != nil {
+			return nil, fmt.Errorf("between start: %w", err)
+		}
+		end, dateOnly, err := m.parseTime(p.End)
+		if err != nil {
+			return nil, fmt.Errorf("between end: %w", err)
+		}
+		if dateOnly {
+			end = end.AddDate(0, 0, 1)
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("between %s and %s: the end isn't after the start", p.Start, p.End)
+		}
+		between = append(between, [2]time.Time{start, end})
+	}
+	for _, r := range m.Recurring {
+		for _, day := range r.Days {
+			if _, ok := maintenanceDays[day]; !ok {
+				return nil, fmt.Errorf("recurring: unknown day %q: want mon, tue, wed, thu, fri, sat or sun", day)
+			}
+		}
+		start, err := time.Parse(maintenanceClock, r.Start)
+		if err != nil {
+			return nil, fmt.Errorf("recurring: invalid start %q: want 15:04", r.Start)
+		}
+		end, err := time.Parse(maintenanceClock, r.End)
+		if err != nil {
+			return nil, fmt.Errorf("recurring: invalid end %q: want 15:04", r.End)
+		}
+		if start.Equal(end) {
+			return nil, fmt.Errorf("recurring: start and end are both %s", r.Start)
+		}
+	}
+	return between, nil
+}
+
+// parseTime parses a one-off period's time in the window's time zone,
+// reporting whether it was a date alone.
+func (m *MaintenanceWindow) parseTime(s string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation(maintenanceDateTime, s, m.loc); err == nil {
+		return t, false, nil
+	}
+	t, err := time.ParseInLocation(maintenanceDate, s, m.loc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid time %q: want 2006-01-02T15:04 or 2006-01-02", s)
+	}
+	return t, true, nil
+}
+
+// activeAt returns the end of the period on at now, reporting false if
+// none is. Of overlapping periods, the one ending last counts.
+func (m *MaintenanceWindow) activeAt(now time.Time) (time.Time, bool) {
+	var until time.Time
+	for _, p := range m.between {
+		if !now.Before(p[0]) && now.Before(p[1]) && p[1].After(until) {
+			until = p[1]
+		}
+	}
+	now = now.In(m.loc)
+	for _, r := range m.Recurring {
+		// Validated in Provision
+		start, _ := time.Parse(maintenanceClock, r.Start)
+		end, _ := time.Parse(maintenanceClock, r.End)
+		// A period crossing midnight may have started yesterday
+		for _, day := range []time.Time{now.AddDate(0, 0, -1), now} {
+			if !r.startsOn(day.Weekday()) {
+				continue
+			}
+			y, mo, d := day.Date()
+			from := time.Date(y, mo, d, start.Hour(), start.Minute(), 0, 0, m.loc)
+			to := time.Date(y, mo, d, end.Hour(), end.Minute(), 0, 0, m.loc)
+			if !to.After(from) {
+				to = to.AddDate(0, 0, 1)
+			}
+			if !now.Before(from) && now.Before(to) && to.After(until) {
+				until = to
+			}
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// startsOn reports whether the period starts on day.
+func (r MaintenanceRecurrence) startsOn(day time.Weekday) bool {
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, name := range r.Days {
+		if maintenanceDays[name] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// serveMaintenance answers a request arriving during a period of the
+// maintenance window ending at until, waking nothing.
+func (w *WakeOnLAN) serveMaintenance(rw http.ResponseWriter, r *http.Request, until time.Time, logger *zap.Logger) error {
+	m := w.MaintenanceWindow
+	logger.Debug("maintenance window on; not waking", zap.Time("until", until), zap.String("reason", m.Reason))
+	status := m.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	retry := time.Until(until)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Retry-After", strconv.Itoa(int((max(retry, 0)+time.Second-1)/time.Second)))
+
+	untilText := until.In(m.loc).Format(time.RFC3339)
+	if w.JSONErrors {
+		msg := "wakes suspended for maintenance until " + untilText
+		if m.Reason != "" {
+			msg += ": " + m.Reason
+		}
+		return w.fail(rw, status, "maintenance", errors.New(msg))
+	}
+	body := m.Body
+	if body == "" {
+		body = "Wakes are suspended for maintenance until " + untilText
+		if m.Reason != "" {
+			body += ": " + m.Reason
+		}
+		body += ".\n"
+	} else {
+		repl := caddy.NewReplacer()
+		repl.Set("wake.reason", m.Reason)
+		repl.Set("wake.until", untilText)
+		body = repl.ReplaceKnown(body, "")
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := rw.Write([]byte(body))
+	return err
+}
+
+// parseMaintenanceWindow parses maintenance_window: an optional reason,
+// then a block of periods and the response.
+func parseMaintenanceWindow(d *caddyfile.Dispenser) (*MaintenanceWindow, error) {
+	m := new(MaintenanceWindow)
+	if d.NextArg() {
+		m.Reason = d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "reason":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			m.Reason = v
+		case "timezone":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			m.Timezone = v
+		case "between":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			m.Between = append(m.Between, MaintenancePeriod{Start: args[0], End: args[1]})
+		case "recurring":
+			args := d.RemainingArgs()
+			var r MaintenanceRecurrence
+			switch len(args) {
+			case 2:
+			case 3:
+				days, err := parseMaintenanceDays(args[0])
+				if err != nil {
+					return nil, d.Err(err.Error())
+				}
+				r.Days, args = days, args[1:]
+			default:
+				return nil, d.ArgErr()
+			}
+			r.Start, r.End = args[0], args[1]
+			m.Recurring = append(m.Recurring, r)
+		case "status":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			m.Status = n
+		case "body":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			m.Body = v
+		default:
+			return nil, d.Errf("unrecognized maintenance_window subdirective '%s'", d.Val())
+		}
+	}
+	return m, nil
+}
+
+// parseMaintenanceDays parses a comma-separated list of days and ranges of
+// them, e.g. mon-fri or sat,sun, into the days it covers.
+func parseMaintenanceDays(s string) ([]string, error) {
+	names := []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	var days []string
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := maintenanceDays[from]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q: want mon, tue, wed, thu, fri, sat or sun", from)
+		}
+		if !isRange {
+			days = append(days, from)
+			continue
+		}
+		end, ok := maintenanceDays[to]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q: want mon, tue, wed, thu, fri, sat or sun", to)
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days = append(days, names[day])
+			if day == end {
+				break
+			}
+		}
+	}
+	return days, nil
+}
@@ -0,0 +1,178 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "between", input: "maintenance_window patching {\n\t\tbetween 2026-11-01T22:00 2026-11-02T06:00\n\t}", want: "patching"},
+		{name: "dates", input: "maintenance_window {\n\t\tbetween 2026-12-24 2026-12-26\n\t\ttimezone Europe/Warsaw\n\t}"},
+		{name: "recurring", input: "maintenance_window {\n\t\treason \"weekly backups\"\n\t\trecurring sat,sun 01:00 05:00\n\t\trecurring 23:30 00:30\n\t\tstatus 423\n\t\tbody \"{wake.reason}\"\n\t}", want: "weekly backups"},
+		{name: "no periods", input: "maintenance_window patching", wantErr: true},
+		{name: "two reasons", input: "maintenance_window patching now {\n\t\trecurring 01:00 02:00\n\t}", wantErr: true},
+		{name: "bad time", input: "maintenance_window {\n\t\tbetween 2026-11-01T22 2026-11-02\n\t}", wantErr: true},
+		{name: "end before start", input: "maintenance_window {\n\t\tbetween 2026-11-02 2026-11-01\n\t}", wantErr: true},
+		{name: "between one argument", input: "maintenance_window {\n\t\tbetween 2026-11-01\n\t}", wantErr: true},
+		{name: "unknown timezone", input: "maintenance_window {\n\t\ttimezone Mars/Olympus\n\t\trecurring 01:00 02:00\n\t}", wantErr: true},
+		{name: "unknown day", input: "maintenance_window {\n\t\trecurring mon-fry 01:00 02:00\n\t}", wantErr: true},
+		{name: "bad clock", input: "maintenance_window {\n\t\trecurring 1am 02:00\n\t}", wantErr: true},
+		{name: "empty period", input: "maintenance_window {\n\t\trecurring 01:00 01:00\n\t}", wantErr: true},
+		{name: "recurring one argument", input: "maintenance_window {\n\t\trecurring 01:00\n\t}", wantErr: true},
+		{name: "bad status", input: "maintenance_window {\n\t\trecurring 01:00 02:00\n\t\tstatus 99\n\t}", wantErr: true},
+		{name: "unknown subdirective", input: "maintenance_window {\n\t\trecurring 01:00 02:00\n\t\tevery week\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.MaintenanceWindow.Reason != tt.want {
+				t.Errorf("reason %q, want %q", w.MaintenanceWindow.Reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceDays(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: "mon", want: []string{"mon"}},
+		{input: "sat,sun", want: []string{"sat", "sun"}},
+		{input: "mon-fri", want: []string{"mon", "tue", "wed", "thu", "fri"}},
+		{input: "fri-mon", want: []string{"fri", "sat", "sun", "mon"}},
+		{input: "mon,wed-thu", want: []string{"mon", "wed", "thu"}},
+		{input: "monday", wantErr: true},
+		{input: "mon-", wantErr: true},
+		{input: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseMaintenanceDays(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("days %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceActiveAt(t *testing.T) {
+	m := &MaintenanceWindow{
+		Timezone: "UTC",
+		Between: []MaintenancePeriod{
+			{Start: "2026-10-20", End: "2026-10-21"},
+			{Start: "2026-10-21T12:00", End: "2026-10-23T06:00"},
+		},
+		Recurring: []MaintenanceRecurrence{
+			// Weeknights, ending the next morning
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "22:00", End: "02:00"},
+		},
+	}
+	w := &WakeOnLAN{MaintenanceWindow: m}
+	if err := w.provisionMaintenance(); err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		ts, err := time.Parse(maintenanceDateTime, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	tests := []struct {
+		// 2026-10-12 is a Monday
+		now       string
+		wantUntil string
+	}{
+		{now: "2026-10-12T21:59"},
+		{now: "2026-10-12T22:00", wantUntil: "2026-10-13T02:00"},
+		{now: "2026-10-13T01:59", wantUntil: "2026-10-13T02:00"},
+		{now: "2026-10-13T02:00"},
+		// Friday night's period runs into Saturday, but none starts then
+		{now: "2026-10-17T01:00", wantUntil: "2026-10-17T02:00"},
+		{now: "2026-10-17T22:30"},
+		{now: "2026-10-18T01:00"},
+		// An end date covers the day; the overlapping period ending last
+		// counts
+		{now: "2026-10-20T00:00", wantUntil: "2026-10-22T00:00"},
+		{now: "2026-10-21T13:00", wantUntil: "2026-10-23T06:00"},
+		{now: "2026-10-23T06:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.now, func(t *testing.T) {
+			until, ok := m.activeAt(at(tt.now))
+			if ok != (tt.wantUntil != "") {
+				t.Fatalf("active %v, want %v", ok, tt.wantUntil != "")
+			}
+			if ok && !until.Equal(at(tt.wantUntil)) {
+				t.Errorf("until %s, want %s", until, tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestServeHTTPMaintenanceWindow(t *testing.T) {
+	now := time.Now().UTC()
+	during := []MaintenancePeriod{{Start: now.Add(-time.Hour).Format(maintenanceDateTime), End: now.Add(time.Hour).Format(maintenanceDateTime)}}
+	tests := []struct {
+		name       string
+		m          MaintenanceWindow
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "outside", m: MaintenanceWindow{Between: []MaintenancePeriod{{Start: "2020-01-01", End: "2020-01-02"}}}, wantStatus: http.StatusNoContent},
+		{name: "during", m: MaintenanceWindow{Reason: "patching", Between: during}, wantStatus: http.StatusServiceUnavailable, wantBody: "Wakes are suspended for maintenance until "},
+		{name: "custom response", m: MaintenanceWindow{Reason: "patching", Between: during, Status: http.StatusLocked, Body: "down for {wake.reason}"}, wantStatus: http.StatusLocked, wantBody: "down for patching"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			m := tt.m
+			m.Timezone = "UTC"
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), MaintenanceWindow: &m})
+			rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if tt.wantStatus == http.StatusNoContent {
+				if !called {
+					t.Error("next handler not called outside the window")
+				}
+				host.expect(t, 1)
+				return
+			}
+			if called {
+				t.Error("next handler called during the window")
+			}
+			host.expectNone(t)
+			if !strings.HasPrefix(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body %q, want it to start with %q", rec.Body, tt.wantBody)
+			}
+			// Until the end of the minute an hour from now
+			retry, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+			if retry < 59*60 || retry > 60*60 {
+				t.Errorf("Retry-After %q, want about an hour", rec.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
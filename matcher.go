@@ -0,0 +1,96 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// MatchHostOffline matches requests while a host does not accept TCP
+// connections on the given address. It is useful for gating wake_on_lan
+// (or any other handler) so it only runs when the backend is down.
+//
+// Example Caddyfile usage:
+//
+//	@asleep host_offline <host:port> [timeout]
+//
+// If timeout is omitted, the probe gives up after 1s.
+type MatchHostOffline struct {
+	Address string         `json:"address,omitempty"`
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (MatchHostOffline) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.host_offline",
+		New: func() caddy.Module { return new(MatchHostOffline) },
+	}
+}
+
+// Validate ensures the configuration is sane.
+func (m *MatchHostOffline) Validate() error {
+	if m.Address == "" {
+		return errors.New("host_offline: address must be specified")
+	}
+	// The same checks as the handler's probe addresses
+	if _, _, err := splitEndpoint(m.Address); err != nil {
+		return fmt.Errorf("host_offline: %w", err)
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("host_offline: invalid timeout %s", time.Duration(m.Timeout))
+	}
+	return nil
+}
+
+// Match returns true if the host is offline.
+func (m MatchHostOffline) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+// MatchWithError returns true if the host is offline.
+func (m MatchHostOffline) MatchWithError(r *http.Request) (bool, error) {
+	return !probeTCP(r.Context(), m.Address, time.Duration(m.Timeout)), nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens.
+func (m *MatchHostOffline) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		args := d.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return d.ArgErr()
+		}
+		m.Address = args[0]
+		m.Timeout = 0
+		if len(args) == 2 {
+			dur, err := caddy.ParseDuration(args[1])
+			if err != nil {
+				return d.Errf("invalid timeout %q: %v", args[1], err)
+			}
+			m.Timeout = caddy.Duration(dur)
+		}
+		// No nested block expected
+		if d.NextBlock(0) {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module                      = (*MatchHostOffline)(nil)
+	_ caddy.Validator                   = (*MatchHostOffline)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchHostOffline)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchHostOffline)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(MatchHostOffline{})
+}
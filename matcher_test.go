@@ -0,0 +1,97 @@
+package caddy_wakeonlan
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestMatchHostOfflineUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    MatchHostOffline
+		wantErr bool
+	}{
+		{input: "host_offline 192.168.1.10:22", want: MatchHostOffline{Address: "192.168.1.10:22"}},
+		{input: "host_offline 192.168.1.10:22 250ms", want: MatchHostOffline{Address: "192.168.1.10:22", Timeout: caddy.Duration(250 * time.Millisecond)}},
+		{input: "host_offline", wantErr: true},
+		{input: "host_offline 192.168.1.10:22 1s extra", wantErr: true},
+		{input: "host_offline 192.168.1.10:22 soon", wantErr: true},
+		{input: "host_offline 192.168.1.10:22 {\n\ttimeout 1s\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var m MatchHostOffline
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && m != tt.want {
+				t.Errorf("got %+v, want %+v", m, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchHostOfflineValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       MatchHostOffline
+		wantErr bool
+	}{
+		{name: "valid", m: MatchHostOffline{Address: "192.168.1.10:22", Timeout: caddy.Duration(time.Second)}},
+		{name: "no address", m: MatchHostOffline{}, wantErr: true},
+		{name: "no port", m: MatchHostOffline{Address: "192.168.1.10"}, wantErr: true},
+		{name: "negative timeout", m: MatchHostOffline{Address: "192.168.1.10:22", Timeout: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.m.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatchHostOfflineAddressLikeProbe(t *testing.T) {
+	addresses := []string{
+		"192.168.1.10:22", "nas.lan:445", "[fe80::1%eth0]:22",
+		"192.168.1.10", "192.168.1.10:", ":22", "192.168.1.10:0", "192.168.1.10:65536", "192.168.1.10:ssh", "[fe80::1:22",
+	}
+	for _, addr := range addresses {
+		t.Run(addr, func(t *testing.T) {
+			matcherErr := (&MatchHostOffline{Address: addr}).Validate()
+			probeErr := validateProbeAddress(addr)
+			if (matcherErr != nil) != (probeErr != nil) {
+				t.Errorf("matcher error %v, probe error %v; want both or neither", matcherErr, probeErr)
+			}
+		})
+	}
+}
+
+func TestMatchHostOffline(t *testing.T) {
+	up := newTCPHost(t)
+	tests := []struct {
+		name    string
+		address string
+		want    bool
+	}{
+		{name: "host up", address: up.addr(), want: false},
+		{name: "host down", address: "127.0.0.1:" + strconv.Itoa(closedPort(t)), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := MatchHostOffline{Address: tt.address, Timeout: caddy.Duration(time.Second)}
+			got, err := m.MatchWithError(newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("MatchWithError = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Defaults for mDNS discovery.
+const (
+	defaultMDNSTimeout = 2 * time.Second
+	defaultMDNSTTL     = time.Minute
+)
+
+// mdnsGroup is the IPv4 mDNS multicast address.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// validateMDNSName checks that name is a host (nas.local), a service
+// (_smb._tcp.local) or a service instance (NAS._smb._tcp.local) in the
+// .local domain.
+func validateMDNSName(name string) error {
+	name = canonicalMDNSName(name)
+	if !strings.HasSuffix(name, ".local") || len(name) > 253 {
+		return fmt.Errorf("mDNS name %q must end in .local", name)
+	}
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid mDNS name %q", name)
+		}
+	}
+	for i, label := range labels {
+		if label == "_tcp" || label == "_udp" {
+			if i == 0 || !strings.HasPrefix(labels[i-1], "_") || i != len(labels)-2 {
+				return fmt.Errorf("invalid mDNS service name %q: want [instance.]_service._tcp.local", name)
+			}
+		}
+	}
+	return nil
+}
+
+// canonicalMDNSName lowercases name and drops a trailing dot.
+func canonicalMDNSName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// isMDNSService reports whether name is a service to browse rather than
+// an instance or host.
+func isMDNSService(name string) bool {
+	return strings.HasPrefix(name, "_")
+}
+
+// mdnsCache remembers the addresses discovered over mDNS. Failures are not
+// cached, so a device that was away is found as soon as it answers again.
+type mdnsCache struct {
+	mu      sync.Mutex
+	entries map[string]mdnsEntry
+}
+
+type mdnsEntry struct {
+	addr    netip.Addr
+	expires time.Time
+}
+
+func newMDNSCache() *mdnsCache {
+	return &mdnsCache{entries: make(map[string]mdnsEntry)}
+}
+
+// resolve returns the IPv4 address name resolves to, from the cache while
+// fresh or by querying the network for up to timeout.
+func (c *mdnsCache) resolve(ctx context.Context, name string, timeout, ttl time.Duration) (netip.Addr, error) {
+	name = canonicalMDNSName(name)
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addr, nil
+	}
+
+	addr, err := queryMDNS(ctx, name, timeout)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	c.mu.Lock()
+	c.entries[name] = mdnsEntry{addr: addr, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+	return addr, nil
+}
+
+// mdnsRecords collects the records seen in mDNS responses.
+type mdnsRecords struct {
+	ptr  map[string]string // service -> first instance
+	srv  map[string]string // instance -> host
+	addr map[string]netip.Addr
+}
+
+// add records the PTR, SRV and A resources of msg.
+func (r *mdnsRecords) add(msg *dnsmessage.Message) {
+	for _, res := range append(msg.Answers, msg.Additionals...) {
+		name := canonicalMDNSName(res.Header.Name.String())
+		switch body := res.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if _, ok := r.ptr[name]; !ok {
+				r.ptr[name] = canonicalMDNSName(body.PTR.String())
+			}
+		case *dnsmessage.SRVResource:
+			r.srv[name] = canonicalMDNSName(body.Target.String())
+		case *dnsmessage.AResource:
+			r.addr[name] = netip.AddrFrom4(body.A)
+		}
+	}
+}
+
+// next follows name through the records seen so far. It returns the
+// address once known, or otherwise the query that would get further.
+func (r *mdnsRecords) next(name string) (netip.Addr, string, dnsmessage.Type) {
+	if isMDNSService(name) {
+		instance, ok := r.ptr[name]
+		if !ok {
+			return netip.Addr{}, name, dnsmessage.TypePTR
+		}
+		name = instance
+	}
+	if strings.Contains(name, "._") {
+		host, ok := r.srv[name]
+		if !ok {
+			return netip.Addr{}, name, dnsmessage.TypeSRV
+		}
+		name = host
+	}
+	if addr, ok := r.addr[name]; ok {
+		return addr, "", 0
+	}
+	return netip.Addr{}, name, dnsmessage.TypeA
+}
+
+// queryMDNS resolves name with one-shot mDNS queries, following a service
+// to its first instance and an instance to its host. Responders answer a
+// query from a port other than 5353 directly to the querier.
+func queryMDNS(ctx context.Context, name string, timeout time.Duration) (netip.Addr, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return netip.Addr{}, err
+	}
+	// Unblock the read if the request goes away
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	records := mdnsRecords{ptr: make(map[string]string), srv: make(map[string]string), addr: make(map[string]netip.Addr)}
+	asked := make(map[string]bool)
+	buf := make([]byte, 9000)
+	for {
+		addr, query, qtype := records.next(name)
+		if addr.IsValid() {
+			return addr, nil
+		}
+		if key := qtype.String() + " " + query; !asked[key] {
+			asked[key] = true
+			if err := sendMDNSQuery(conn, query, qtype); err != nil {
+				return netip.Addr{}, err
+			}
+		}
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return netip.Addr{}, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return netip.Addr{}, fmt.Errorf("no mDNS answer for %q within %s", name, timeout)
+			}
+			return netip.Addr{}, err
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+		records.add(&msg)
+	}
+}
+
+// sendMDNSQuery multicasts a query for name.
+func sendMDNSQuery(conn *net.UDPConn, name string, qtype dnsmessage.Type) error {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return err
+	}
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteToUDP(packet, mdnsGroup)
+	return err
+}
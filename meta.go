@@ -0,0 +1,93 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// maxMetaValue is the longest metadata value accepted, in bytes.
+const maxMetaValue = 256
+
+// TargetMeta describes a target for people: dashboards reading the admin
+// API, webhook notifications and the audit log carry it along. It changes
+// nothing about how the target is woken.
+type TargetMeta struct {
+	// Name to show instead of the target's name, e.g. "Media server".
+	DisplayName string `json:"display_name,omitempty"`
+	// Where the machine is, e.g. "Rack 2, basement".
+	Location string `json:"location,omitempty"`
+	// Who to ask about it, e.g. a team or an email address.
+	Owner string `json:"owner,omitempty"`
+}
+
+// validate checks every value is a single line of printable UTF-8 of at
+// most maxMetaValue bytes.
+func (m *TargetMeta) validate() error {
+	if m == nil {
+		return nil
+	}
+	if *m == (TargetMeta{}) {
+		return errors.New("empty meta")
+	}
+	for _, f := range []struct{ name, value string }{
+		{"display_name", m.DisplayName},
+		{"location", m.Location},
+		{"owner", m.Owner},
+	} {
+		if len(f.value) > maxMetaValue {
+			return fmt.Errorf("meta %s longer than %d bytes", f.name, maxMetaValue)
+		}
+		if !utf8.ValidString(f.value) {
+			return fmt.Errorf("meta %s is not valid UTF-8", f.name)
+		}
+		for _, r := range f.value {
+			if !unicode.IsPrint(r) {
+				return fmt.Errorf("meta %s contains the non-printable character %U", f.name, r)
+			}
+		}
+	}
+	return nil
+}
+
+// parseTargetMeta parses a target's meta block of display_name, location
+// and owner.
+func parseTargetMeta(d *caddyfile.Dispenser) (*TargetMeta, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	m := new(TargetMeta)
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "display_name":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			m.DisplayName = v
+		case "location":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			m.Location = v
+		case "owner":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			m.Owner = v
+		default:
+			return nil, d.Errf("unrecognized meta subdirective '%s'", d.Val())
+		}
+	}
+	return m, nil
+}
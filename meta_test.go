@@ -0,0 +1,133 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTargetMetaConfig(t *testing.T) {
+	target := func(block string) string {
+		return "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tmeta {\n" + block + "\t\t}\n\t}\n}"
+	}
+	tests := []struct {
+		name    string
+		input   string
+		want    TargetMeta
+		wantErr bool
+	}{
+		{
+			name:  "all",
+			input: target("\t\t\tdisplay_name \"Media server\"\n\t\t\tlocation \"Rack 2, basement\"\n\t\t\towner infra@example.com\n"),
+			want:  TargetMeta{DisplayName: "Media server", Location: "Rack 2, basement", Owner: "infra@example.com"},
+		},
+		{name: "one", input: target("\t\t\towner infra\n"), want: TargetMeta{Owner: "infra"}},
+		{name: "empty", input: target(""), wantErr: true},
+		{name: "argument", input: "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tmeta media\n\t}\n}", wantErr: true},
+		{name: "unknown", input: target("\t\t\track 2\n"), wantErr: true},
+		{name: "no value", input: target("\t\t\tlocation\n"), wantErr: true},
+		{name: "two values", input: target("\t\t\tlocation rack 2\n"), wantErr: true},
+		{name: "too long", input: target("\t\t\tlocation " + strings.Repeat("a", maxMetaValue+1) + "\n"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.Targets[0].Meta != tt.want {
+				t.Errorf("meta %+v, want %+v", *w.Targets[0].Meta, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetMetaValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		meta    *TargetMeta
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "set", meta: &TargetMeta{DisplayName: "Médiathèque", Location: "Rack 2"}},
+		{name: "longest", meta: &TargetMeta{Owner: strings.Repeat("a", maxMetaValue)}},
+		{name: "empty", meta: &TargetMeta{}, wantErr: true},
+		{name: "too long", meta: &TargetMeta{Owner: strings.Repeat("a", maxMetaValue+1)}, wantErr: true},
+		{name: "newline", meta: &TargetMeta{Location: "Rack 2\nbasement"}, wantErr: true},
+		{name: "control character", meta: &TargetMeta{DisplayName: "NAS\x1b[31m"}, wantErr: true},
+		{name: "invalid UTF-8", meta: &TargetMeta{Owner: "\xff"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.meta.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNotifyBodyMeta(t *testing.T) {
+	meta := &TargetMeta{DisplayName: "Media server", Location: "basement", Owner: "infra"}
+	ev := newNotifyEvent("nas", testMAC, "192.0.2.1", meta, resultSent, nil)
+
+	body, err := (&WakeOnLAN{}).notifyBody(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got notifyEvent
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	if got.Meta == nil || *got.Meta != *meta {
+		t.Errorf("meta %+v, want %+v", got.Meta, meta)
+	}
+
+	w := &WakeOnLAN{NotifyTemplate: "{wake.display_name} ({wake.location}, {wake.owner}): {wake.result}"}
+	body, err = w.notifyBody(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Media server (basement, infra): sent"; string(body) != want {
+		t.Errorf("body %q, want %q", body, want)
+	}
+	// Without meta, the placeholders are empty
+	body, err = w.notifyBody(newNotifyEvent("nas", testMAC, "192.0.2.1", nil, resultSent, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := " (, ): sent"; string(body) != want {
+		t.Errorf("body %q, want %q", body, want)
+	}
+}
+
+func TestServeHTTPMetaAudit(t *testing.T) {
+	host := newFakeHost(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	meta := &TargetMeta{DisplayName: "Media server", Owner: "infra"}
+	w := provisionTest(t, &WakeOnLAN{
+		Targets:  []Target{{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Meta: meta}},
+		AuditLog: &AuditLog{Path: path},
+	})
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	host.expect(t, 1)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec auditRecord
+	if err := json.Unmarshal(bytes.TrimSpace(data), &rec); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	if rec.Target != "nas" || rec.Meta == nil || *rec.Meta != *meta {
+		t.Errorf("audit record %+v, want the target's meta", rec)
+	}
+}
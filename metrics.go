@@ -0,0 +1,82 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var wakeMetrics = struct {
+	once         sync.Once
+	results      *prometheus.CounterVec
+	wakeDuration *prometheus.HistogramVec
+	lastSuccess  *prometheus.GaugeVec
+	sendPhase    *prometheus.HistogramVec
+}{}
+
+// countResult counts result for t and, for a packet sent, acknowledged or
+// the target confirmed up after one, sets its last success time to now.
+// Targets from requests are counted together, under dynamicLabel.
+func countResult(t Target, result wakeResult) {
+	wakeMetrics.results.WithLabelValues(t.metricLabel(), string(result)).Inc()
+	if result == resultSent || result == resultAckReceived || result == resultTXConfirmed || result == resultWoken {
+		wakeMetrics.lastSuccess.WithLabelValues(t.metricLabel()).SetToCurrentTime()
+	}
+}
+
+// observeWakeDuration records how long t took to come up after the first
+// packet sent at sentAt, in the metrics and t's summary.
+func observeWakeDuration(t Target, sentAt time.Time) {
+	took := time.Since(sentAt)
+	wakeMetrics.wakeDuration.WithLabelValues(t.metricLabel()).Observe(took.Seconds())
+	recordLatency(t, took)
+}
+
+// initMetrics creates the module's collectors (once) and registers them with
+// the given registry.
+func initMetrics(registry *prometheus.Registry) {
+	const ns, sub = "caddy", "wake_on_lan"
+
+	wakeMetrics.once.Do(func() {
+		wakeMetrics.results = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "result_total",
+			Help:      "Outcomes of wake attempts, by target and result.",
+		}, []string{"target", "result"})
+		wakeMetrics.wakeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "wake_duration_seconds",
+			Help:      "Time from sending a wake to the target's check address coming up, by target. Timeouts are not observed.",
+			Buckets:   []float64{1, 2, 5, 10, 20, 30, 45, 60, 90, 120, 180, 300},
+		}, []string{"target"})
+		wakeMetrics.lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Unix time of the last wake that sent a packet or confirmed the target up, by target.",
+		}, []string{"target"})
+		wakeMetrics.sendPhase = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "send_phase_seconds",
+			Help:      "Time a send spent resolving the target's address, setting up the socket and writing the packet, by phase.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"phase"})
+	})
+
+	if registry == nil {
+		return
+	}
+	// Every handler instance registers the same collectors; only the first
+	// registration per registry takes effect.
+	for _, c := range []prometheus.Collector{wakeMetrics.results, wakeMetrics.wakeDuration, wakeMetrics.lastSuccess, wakeMetrics.sendPhase} {
+		if err := registry.Register(c); err != nil &&
+			!errors.Is(err, prometheus.AlreadyRegisteredError{ExistingCollector: c, NewCollector: c}) {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// wakeDurations returns the count and sum of the wake durations observed
+// for the target labelled label.
+func wakeDurations(t *testing.T, label string) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := wakeMetrics.wakeDuration.WithLabelValues(label).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+// lastSuccess returns the last success time recorded for the target
+// labelled label, 0 if there is none.
+func lastSuccess(t *testing.T, label string) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := wakeMetrics.lastSuccess.WithLabelValues(label).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+// listenAfter starts listening on the TCP port after delay, standing in
+// for a host that takes that long to boot; a negative delay never does.
+func listenAfter(t *testing.T, port int, delay time.Duration) {
+	t.Helper()
+	if delay < 0 {
+		return
+	}
+	listen := func() {
+		l, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		t.Cleanup(func() { l.Close() })
+	}
+	if delay == 0 {
+		listen()
+		return
+	}
+	timer := time.AfterFunc(delay, listen)
+	t.Cleanup(func() { timer.Stop() })
+}
+
+func TestServeHTTPResultDynamicTarget(t *testing.T) {
+	newFakeDNS(t, func(string, dnsmessage.Type, int) ([]net.IP, dnsmessage.RCode) {
+		return nil, dnsmessage.RCodeNameError
+	})
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{FromQuery: &QueryParams{}})
+	series := testutil.CollectAndCount(wakeMetrics.results)
+	beforeSent := testutil.ToFloat64(wakeMetrics.results.WithLabelValues(dynamicLabel, string(resultSent)))
+
+	// A MAC of its own per request, every other one failing to resolve
+	const n = 20
+	for i := range n {
+		query := fmt.Sprintf("mac=00:11:22:33:44:%02x&ip=127.0.0.1&port=%d", i, host.port())
+		if i%2 == 1 {
+			query = fmt.Sprintf("mac=00:11:22:33:44:%02x&ip=nas.test.", i)
+		}
+		serveTest(w, newTestRequest("GET", "http://example.com/wake?"+query, nil))
+	}
+	host.expect(t, n/2)
+	if got := testutil.ToFloat64(wakeMetrics.results.WithLabelValues(dynamicLabel, string(resultSent))) - beforeSent; got != n/2 {
+		t.Errorf("result_total of %s sent went up by %v, want %d", dynamicLabel, got, n/2)
+	}
+	// A series per result, not per MAC
+	if got := testutil.CollectAndCount(wakeMetrics.results) - series; got > 2 {
+		t.Errorf("result_total gained %d series, want at most 2", got)
+	}
+}
+
+func TestServeHTTPWakeDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		// how long the host takes to come up, negative for never
+		upAfter   time.Duration
+		wantCount uint64
+	}{
+		{name: "slow-boot", upAfter: 600 * time.Millisecond, wantCount: 1},
+		{name: "never-up", upAfter: -1, wantCount: 0},
+		{name: "already-up", upAfter: 0, wantCount: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			checkPort := closedPort(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:   testMAC,
+				IP:    "127.0.0.1",
+				Port:  host.port(),
+				Name:  "duration-" + tt.name,
+				Check: fmt.Sprintf("127.0.0.1:%d", checkPort),
+				Wait:  caddy.Duration(1500 * time.Millisecond),
+			})
+			beforeCount, beforeSum := wakeDurations(t, w.Name)
+			listenAfter(t, checkPort, tt.upAfter)
+			start := time.Now()
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			took := time.Since(start)
+
+			count, sum := wakeDurations(t, w.Name)
+			if count-beforeCount != tt.wantCount {
+				t.Fatalf("observed %d wake durations, want %d", count-beforeCount, tt.wantCount)
+			}
+			if tt.wantCount == 0 {
+				return
+			}
+			if d := time.Duration((sum - beforeSum) * float64(time.Second)); d < tt.upAfter || d > took {
+				t.Errorf("observed %s, want between %s and %s", d, tt.upAfter, took)
+			}
+		})
+	}
+}
+
+func TestServeHTTPLastSuccess(t *testing.T) {
+	tests := []struct {
+		name string
+		// how long the host takes to come up, negative for never
+		upAfter time.Duration
+		// send over TCP to a closed port, failing the send
+		failSend bool
+		wantSet  bool
+	}{
+		{name: "woken", upAfter: 200 * time.Millisecond, wantSet: true},
+		{name: "timed-out", upAfter: -1},
+		{name: "already-up", upAfter: 0},
+		{name: "send-failed", upAfter: -1, failSend: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			checkPort := closedPort(t)
+			w := &WakeOnLAN{
+				MAC:   testMAC,
+				IP:    "127.0.0.1",
+				Port:  host.port(),
+				Name:  "last-success-" + tt.name,
+				Check: fmt.Sprintf("127.0.0.1:%d", checkPort),
+				Wait:  caddy.Duration(600 * time.Millisecond),
+			}
+			if tt.failSend {
+				w.Port, w.Protocol = closedPort(t), protocolTCP
+			}
+			provisionTest(t, w)
+			listenAfter(t, checkPort, tt.upAfter)
+			start := time.Now()
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			got := lastSuccess(t, w.Name)
+			if !tt.wantSet {
+				if got != 0 {
+					t.Errorf("last success set to %v, want unset", got)
+				}
+				return
+			}
+			if at := time.Unix(0, int64(got*float64(time.Second))); at.Before(start.Add(-time.Second)) || at.After(time.Now().Add(time.Second)) {
+				t.Errorf("last success at %s, want about %s", at, start)
+			}
+		})
+	}
+
+	// Without a check, the packet going out is the success
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Name: "last-success-sent"})
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if lastSuccess(t, w.Name) == 0 {
+		t.Error("last success not set for a packet sent")
+	}
+}
+
+func TestServeHTTPLastSuccessDynamicTarget(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{FromQuery: &QueryParams{}})
+	series := testutil.CollectAndCount(wakeMetrics.lastSuccess)
+	start := time.Now()
+	for i := range 10 {
+		query := fmt.Sprintf("mac=00:11:22:33:55:%02x&ip=127.0.0.1&port=%d", i, host.port())
+		if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/wake?"+query, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host.expect(t, 10)
+	// The gauges of request MACs would never go away; they share one
+	if got := testutil.CollectAndCount(wakeMetrics.lastSuccess) - series; got > 1 {
+		t.Errorf("last_success gained %d series, want at most 1", got)
+	}
+	if at := lastSuccess(t, dynamicLabel); at < float64(start.Add(-time.Second).Unix()) {
+		t.Errorf("last success of %s at %v, want about %v", dynamicLabel, at, start.Unix())
+	}
+}
@@ -0,0 +1,123 @@
+package caddy_wakeonlan
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// autoMAC is the MAC value that asks for the MAC to be looked up in the
+// system's neighbor (ARP) table from the target's IP.
+const autoMAC = "auto"
+
+// arpTablePath is the Linux ARP table.
+const arpTablePath = "/proc/net/arp"
+
+// macResolveError marks a failure to determine the MAC address to wake, as
+// opposed to a failure to deliver the packet.
+type macResolveError struct {
+	err error
+}
+
+func (e macResolveError) Error() string { return "resolving MAC: " + e.err.Error() }
+func (e macResolveError) Unwrap() error { return e.err }
+
+// parseARPTable finds ip in the contents of /proc/net/arp:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.10     0x1         0x2         10:ff:e0:cf:e6:0e     *        eth0
+func parseARPTable(data []byte, ip net.IP) (net.HardwareAddr, error) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || !ip.Equal(net.ParseIP(fields[0])) {
+			continue
+		}
+		// Flags 0x0 marks an incomplete entry without a usable MAC
+		if fields[2] == "0x0" {
+			continue
+		}
+		hw, err := net.ParseMAC(fields[3])
+		if err != nil || isZeroMAC(hw) {
+			continue
+		}
+		return hw, nil
+	}
+	return nil, fmt.Errorf("no neighbor entry for %s", ip)
+}
+
+func isZeroMAC(hw net.HardwareAddr) bool {
+	for _, b := range hw {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Default lifetimes of cached neighbor lookups for "auto" MACs.
+const (
+	defaultMACCacheTTL = 5 * time.Minute
+	defaultMACMissTTL  = 10 * time.Second
+)
+
+// macCache caches neighbor table lookups by IP. Misses are cached too, so
+// a host missing from the table isn't looked up again on every request.
+// Entries remember the last MAC seen for an IP after they expire.
+type macCache struct {
+	mu      sync.Mutex
+	entries map[string]*macEntry
+	lookup  func(net.IP) (net.HardwareAddr, error)
+	now     func() time.Time
+}
+
+type macEntry struct {
+	hw        net.HardwareAddr // last MAC seen, possibly stale
+	expires   time.Time        // end of the positive TTL
+	missUntil time.Time        // end of the negative TTL after a miss
+	missErr   error
+}
+
+func newMACCache() *macCache {
+	return &macCache{
+		entries: make(map[string]*macEntry),
+		lookup:  lookupNeighborMAC,
+		now:     time.Now,
+	}
+}
+
+// resolve returns the MAC for ip, from the cache while fresh. On a miss,
+// cached or not, it returns the error along with the last MAC seen for
+// ip, if any.
+func (c *macCache) resolve(ip net.IP, ttl, missTTL time.Duration) (hw, last net.HardwareAddr, err error) {
+	key := ip.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	e := c.entries[key]
+	if e != nil {
+		if e.hw != nil && now.Before(e.expires) {
+			return e.hw, e.hw, nil
+		}
+		if now.Before(e.missUntil) {
+			return nil, e.hw, e.missErr
+		}
+	} else {
+		e = new(macEntry)
+		c.entries[key] = e
+	}
+
+	hw, err = c.lookup(ip)
+	if err != nil {
+		e.missUntil, e.missErr = now.Add(missTTL), err
+		return nil, e.hw, err
+	}
+	e.hw, e.expires, e.missUntil, e.missErr = hw, now.Add(ttl), time.Time{}, nil
+	return hw, hw, nil
+}
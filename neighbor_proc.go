@@ -0,0 +1,18 @@
+//go:build !windows
+
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// lookupNeighborMAC returns the MAC address the neighbor table holds for ip.
+func lookupNeighborMAC(ip net.IP) (net.HardwareAddr, error) {
+	data, err := os.ReadFile(arpTablePath)
+	if err != nil {
+		return nil, fmt.Errorf("neighbor table not available: %w", err)
+	}
+	return parseARPTable(data, ip)
+}
@@ -0,0 +1,212 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseARPTable(t *testing.T) {
+	table := []byte(`IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.10     0x1         0x2         10:ff:e0:cf:e6:0e     *        eth0
+192.168.1.11     0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.1.12     0x1         0x2         00:00:00:00:00:00     *        eth0
+192.168.1.13     0x1         0x0         10:ff:e0:cf:e6:0f     *        eth0
+`)
+	tests := []struct {
+		ip      string
+		want    string
+		wantErr bool
+	}{
+		{ip: "192.168.1.10", want: "10:ff:e0:cf:e6:0e"},
+		{ip: "192.168.1.11", wantErr: true},
+		{ip: "192.168.1.12", wantErr: true},
+		{ip: "192.168.1.13", wantErr: true},
+		{ip: "192.168.1.99", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			hw, err := parseARPTable(table, net.ParseIP(tt.ip))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseARPTable error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && hw.String() != tt.want {
+				t.Errorf("parseARPTable = %s, want %s", hw, tt.want)
+			}
+		})
+	}
+}
+
+// fakeNeighbors is a neighbor table for macCache, counting its lookups.
+type fakeNeighbors struct {
+	mu      sync.Mutex
+	table   map[string]net.HardwareAddr
+	lookups int
+}
+
+func (n *fakeNeighbors) set(ip string, mac string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if mac == "" {
+		delete(n.table, ip)
+		return
+	}
+	hw, _ := net.ParseMAC(mac)
+	n.table[ip] = hw
+}
+
+func (n *fakeNeighbors) lookup(ip net.IP) (net.HardwareAddr, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lookups++
+	if hw, ok := n.table[ip.String()]; ok {
+		return hw, nil
+	}
+	return nil, fmt.Errorf("no neighbor entry for %s", ip)
+}
+
+// newFakeNeighborCache returns a macCache over a fake neighbor table, with
+// a clock that only moves when the test advances it.
+func newFakeNeighborCache() (*macCache, *fakeNeighbors, func(time.Duration)) {
+	n := &fakeNeighbors{table: make(map[string]net.HardwareAddr)}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newMACCache()
+	c.lookup = n.lookup
+	c.now = func() time.Time { return now }
+	return c, n, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestMACCache(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		// MAC the table holds from this step on, "-" for none
+		table       string
+		wantHW      string
+		wantLast    string
+		wantLookups int
+	}
+	const mac = "10:ff:e0:cf:e6:0e"
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "hit",
+			steps: []step{
+				{table: mac, wantHW: mac, wantLast: mac, wantLookups: 1},
+				{advance: time.Minute, wantHW: mac, wantLast: mac, wantLookups: 1},
+			},
+		},
+		{
+			name: "expiry",
+			steps: []step{
+				{table: mac, wantHW: mac, wantLast: mac, wantLookups: 1},
+				{advance: 5 * time.Minute, wantHW: mac, wantLast: mac, wantLookups: 2},
+			},
+		},
+		{
+			name: "negative cache",
+			steps: []step{
+				{table: "-", wantLookups: 1},
+				{advance: 5 * time.Second, table: mac, wantLookups: 1},
+				{advance: 5 * time.Second, wantHW: mac, wantLast: mac, wantLookups: 2},
+			},
+		},
+		{
+			name: "last MAC after it drops out",
+			steps: []step{
+				{table: mac, wantHW: mac, wantLast: mac, wantLookups: 1},
+				{advance: 5 * time.Minute, table: "-", wantLast: mac, wantLookups: 2},
+				{advance: time.Second, wantLast: mac, wantLookups: 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, n, advance := newFakeNeighborCache()
+			ip := net.ParseIP("192.168.1.10")
+			for i, s := range tt.steps {
+				advance(s.advance)
+				switch s.table {
+				case "":
+				case "-":
+					n.set(ip.String(), "")
+				default:
+					n.set(ip.String(), s.table)
+				}
+				hw, last, err := c.resolve(ip, defaultMACCacheTTL, defaultMACMissTTL)
+				if (err == nil) != (s.wantHW != "") {
+					t.Errorf("step %d: error %v", i, err)
+				}
+				if hwString(hw) != s.wantHW || hwString(last) != s.wantLast {
+					t.Errorf("step %d: resolved %q, last %q; want %q, %q", i, hwString(hw), hwString(last), s.wantHW, s.wantLast)
+				}
+				if n.lookups != s.wantLookups {
+					t.Errorf("step %d: %d lookups, want %d", i, n.lookups, s.wantLookups)
+				}
+			}
+		})
+	}
+}
+
+// hwString is hw as a string, empty for none.
+func hwString(hw net.HardwareAddr) string {
+	if hw == nil {
+		return ""
+	}
+	return hw.String()
+}
+
+func TestMACCacheConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "mac_cache_ttl 1m\n\tmac_miss_ttl 5s"},
+		{input: "mac_cache_ttl soon", wantErr: true},
+		{input: "mac_miss_ttl", wantErr: true},
+		{input: "mac_miss_ttl -1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan auto 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeHTTPMACCacheBroadcastFallback(t *testing.T) {
+	// The broadcast address is the unicast one, so a send with both
+	// arrives twice
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: autoMAC, IP: "127.0.0.1", Port: host.port(), Broadcast: "127.0.0.1"})
+	c, n, advance := newFakeNeighborCache()
+	w.macCache = c
+	hw, _ := parseMAC(testMAC)
+
+	n.set("127.0.0.1", testMAC)
+	serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	for _, p := range host.expect(t, 2) {
+		if !bytes.Equal(p, buildMagicPacket(hw)) {
+			t.Errorf("got % x, want the magic packet for %s", p, testMAC)
+		}
+	}
+
+	// Dropped out of the table: the last MAC seen goes to the broadcast
+	// address only
+	n.set("127.0.0.1", "")
+	advance(defaultMACCacheTTL)
+	serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if p := host.expect(t, 1)[0]; !bytes.Equal(p, buildMagicPacket(hw)) {
+		t.Errorf("got % x, want the magic packet for %s", p, testMAC)
+	}
+	host.expectNone(t)
+}
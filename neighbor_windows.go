@@ -0,0 +1,94 @@
+//go:build windows
+
+package caddy_wakeonlan
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	iphlpapi           = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetIpNetTable2 = iphlpapi.NewProc("GetIpNetTable2")
+	procFreeMibTable   = iphlpapi.NewProc("FreeMibTable")
+)
+
+// States of NL_NEIGHBOR_STATE: below probe, an entry has no usable MAC.
+const (
+	nlnsProbe     = 2
+	nlnsReachable = 5
+	nlnsPermanent = 6
+)
+
+// mibIPNetRow2 is MIB_IPNET_ROW2, one entry of the neighbor table.
+type mibIPNetRow2 struct {
+	address               [28]byte // SOCKADDR_INET
+	interfaceIndex        uint32
+	interfaceLUID         uint64
+	physicalAddress       [32]byte
+	physicalAddressLength uint32
+	state                 uint32
+	flags                 uint8
+	_                     [3]byte
+	reachabilityTime      uint32
+}
+
+// mibIPNetTable2 is MIB_IPNET_TABLE2, whose rows follow the count.
+type mibIPNetTable2 struct {
+	numEntries uint32
+	_          uint32
+	table      [1]mibIPNetRow2
+}
+
+// lookupNeighborMAC returns the MAC address the neighbor table holds for ip.
+func lookupNeighborMAC(ip net.IP) (net.HardwareAddr, error) {
+	entries, err := windowsNeighbors()
+	if err != nil {
+		return nil, fmt.Errorf("neighbor table not available: %w", err)
+	}
+	e, err := bestNeighbor(entries, ip)
+	if err != nil {
+		return nil, err
+	}
+	return e.hw, nil
+}
+
+// windowsNeighbors reads the IPv4 and IPv6 neighbor tables with
+// GetIpNetTable2, which tells reachable entries apart from stale ones.
+func windowsNeighbors() ([]neighborEntry, error) {
+	if err := procGetIpNetTable2.Find(); err != nil {
+		return nil, err
+	}
+	var table *mibIPNetTable2
+	if r, _, _ := procGetIpNetTable2.Call(uintptr(windows.AF_UNSPEC), uintptr(unsafe.Pointer(&table))); r != 0 {
+		return nil, fmt.Errorf("GetIpNetTable2: %w", windows.Errno(r))
+	}
+	defer procFreeMibTable.Call(uintptr(unsafe.Pointer(table)))
+
+	var entries []neighborEntry
+	for _, row := range unsafe.Slice(&table.table[0], table.numEntries) {
+		if row.state < nlnsProbe || row.physicalAddressLength == 0 || row.physicalAddressLength > 32 {
+			continue
+		}
+		var ip net.IP
+		switch binary.LittleEndian.Uint16(row.address[0:2]) {
+		case windows.AF_INET:
+			ip = net.IP(slices.Clone(row.address[4:8]))
+		case windows.AF_INET6:
+			ip = net.IP(slices.Clone(row.address[8:24]))
+		default:
+			continue
+		}
+		entries = append(entries, neighborEntry{
+			ip:        ip,
+			hw:        net.HardwareAddr(slices.Clone(row.physicalAddress[:row.physicalAddressLength])),
+			reachable: row.state == nlnsReachable || row.state == nlnsPermanent,
+		})
+	}
+	return entries, nil
+}
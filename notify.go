@@ -0,0 +1,210 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	// Registers the transports notify_transport takes
+	_ "github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// defaultNotifyTimeout bounds a webhook notification.
+const defaultNotifyTimeout = 5 * time.Second
+
+// notifyEvent is the default JSON payload of a webhook notification.
+type notifyEvent struct {
+	Target    string      `json:"target"`
+	MAC       string      `json:"mac,omitempty"`
+	IP        string      `json:"ip,omitempty"`
+	Result    string      `json:"result"`
+	Error     string      `json:"error,omitempty"`
+	Meta      *TargetMeta `json:"meta,omitempty"`
+	Timestamp string      `json:"timestamp"`
+}
+
+// validateNotifyURL checks that the webhook URL is absolute HTTP(S).
+func validateNotifyURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid notify URL %q: %w", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("notify URL %q must be an absolute http or https URL", s)
+	}
+	return nil
+}
+
+// validateNotify checks the webhook settings.
+func (w *WakeOnLAN) validateNotify() error {
+	if w.Notify == "" {
+		if w.NotifyTemplate != "" {
+			return errors.New("wake_on_lan: notify_template requires notify")
+		}
+		if w.NotifyTransportRaw != nil {
+			return errors.New("wake_on_lan: notify_transport requires notify")
+		}
+		return nil
+	}
+	if err := validateNotifyURL(w.Notify); err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	if w.NotifyTimeout < 0 {
+		return fmt.Errorf("wake_on_lan: invalid notify_timeout %s", time.Duration(w.NotifyTimeout))
+	}
+	return nil
+}
+
+// provisionNotify sets up the webhook client, loading notify_transport if
+// configured.
+func (w *WakeOnLAN) provisionNotify(ctx caddy.Context) error {
+	if w.Notify == "" {
+		return nil
+	}
+	timeout := time.Duration(w.NotifyTimeout)
+	if timeout == 0 {
+		timeout = defaultNotifyTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	if w.NotifyTransportRaw != nil {
+		rt, err := loadNotifyTransport(ctx, w.NotifyTransportRaw)
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: loading notify_transport: %w", err)
+		}
+		client.Transport = rt
+	}
+	w.notifyClient = client
+	return nil
+}
+
+// loadNotifyTransport loads and provisions the transport module raw names
+// in its "protocol" key. It takes the key out itself rather than through
+// ctx.LoadModule, whose check for json.RawMessage fields doesn't hold on
+// every toolchain.
+func loadNotifyTransport(ctx caddy.Context, raw json.RawMessage) (http.RoundTripper, error) {
+	var config map[string]any
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	name, ok := config["protocol"].(string)
+	if !ok || name == "" {
+		return nil, errors.New(`module name not specified with key "protocol"`)
+	}
+	delete(config, "protocol")
+	rest, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := ctx.LoadModuleByID("http.reverse_proxy.transport."+name, rest)
+	if err != nil {
+		return nil, err
+	}
+	rt, ok := mod.(http.RoundTripper)
+	if !ok {
+		return nil, fmt.Errorf("module %s (%T) is not an http.RoundTripper", name, mod)
+	}
+	return rt, nil
+}
+
+// parseNotifyTransport parses `notify_transport <module> { ... }` with the
+// module's own Caddyfile syntax, as reverse_proxy's transport is.
+func parseNotifyTransport(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	modID := "http.reverse_proxy.transport." + name
+	unm, err := caddyfile.UnmarshalModule(d, modID)
+	if err != nil {
+		return nil, err
+	}
+	rt, ok := unm.(http.RoundTripper)
+	if !ok {
+		return nil, d.Errf("module %s (%T) is not an http.RoundTripper", modID, unm)
+	}
+	return caddyconfig.JSONModuleObject(rt, "protocol", name, nil), nil
+}
+
+// notify POSTs ev to the webhook URL in the background. Notifications are
+// best-effort: failures are logged and never affect the wake.
+func (w *WakeOnLAN) notify(logger *zap.Logger, ev notifyEvent) {
+	if w.Notify == "" || w.notifyClient == nil {
+		return
+	}
+	body, err := w.notifyBody(ev)
+	if err != nil {
+		logger.Warn("building wake notification", zap.Error(err))
+		return
+	}
+	ctx := w.ctx.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go func() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.Notify, bytes.NewReader(body))
+		if err != nil {
+			logger.Warn("sending wake notification", zap.Error(err))
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := w.notifyClient.Do(req)
+		if err != nil {
+			logger.Warn("sending wake notification", zap.Error(err))
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Warn("wake notification rejected", zap.Int("status", resp.StatusCode))
+		}
+	}()
+}
+
+// notifyBody renders the payload: the JSON event by default, or
+// NotifyTemplate with {wake.*} placeholders replaced.
+func (w *WakeOnLAN) notifyBody(ev notifyEvent) ([]byte, error) {
+	if w.NotifyTemplate == "" {
+		return json.Marshal(ev)
+	}
+	repl := caddy.NewReplacer()
+	repl.Set("wake.target", ev.Target)
+	repl.Set("wake.mac", ev.MAC)
+	repl.Set("wake.ip", ev.IP)
+	repl.Set("wake.result", ev.Result)
+	repl.Set("wake.error", ev.Error)
+	repl.Set("wake.timestamp", ev.Timestamp)
+	var meta TargetMeta
+	if ev.Meta != nil {
+		meta = *ev.Meta
+	}
+	repl.Set("wake.display_name", meta.DisplayName)
+	repl.Set("wake.location", meta.Location)
+	repl.Set("wake.owner", meta.Owner)
+	return []byte(repl.ReplaceKnown(w.NotifyTemplate, "")), nil
+}
+
+// newNotifyEvent describes a wake outcome for a notification, with the
+// target's metadata if it has any.
+func newNotifyEvent(target, mac, ip string, meta *TargetMeta, result wakeResult, err error) notifyEvent {
+	ev := notifyEvent{
+		Target:    target,
+		MAC:       strings.ToLower(mac),
+		IP:        ip,
+		Meta:      meta,
+		Result:    string(result),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	return ev
+}
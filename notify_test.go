@@ -0,0 +1,146 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestNotifyTransportConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantJSON map[string]any
+		wantErr  bool
+	}{
+		{
+			name:     "http",
+			input:    "notify https://hooks.example.com/wol\n\tnotify_transport http {\n\t\ttls_insecure_skip_verify\n\t}",
+			wantJSON: map[string]any{"protocol": "http"},
+		},
+		{name: "missing module", input: "notify https://hooks.example.com/wol\n\tnotify_transport", wantErr: true},
+		{name: "unknown module", input: "notify https://hooks.example.com/wol\n\tnotify_transport carrier_pigeon", wantErr: true},
+		{name: "unknown subdirective", input: "notify https://hooks.example.com/wol\n\tnotify_transport http {\n\t\tno_such_option\n\t}", wantErr: true},
+		{name: "without notify", input: "notify_transport http", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got map[string]any
+			if err := json.Unmarshal(w.NotifyTransportRaw, &got); err != nil {
+				t.Fatalf("decoding %s: %v", w.NotifyTransportRaw, err)
+			}
+			for k, v := range tt.wantJSON {
+				if got[k] != v {
+					t.Errorf("notify_transport %s = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestProvisionNotifyTransport(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport string
+		wantErr   bool
+	}{
+		{name: "default"},
+		{name: "http", transport: `{"protocol":"http"}`},
+		{name: "missing protocol", transport: `{"tls":{}}`, wantErr: true},
+		{name: "unknown protocol", transport: `{"protocol":"carrier_pigeon"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Notify: "https://hooks.example.com/wol"}
+			if tt.transport != "" {
+				w.NotifyTransportRaw = json.RawMessage(tt.transport)
+			}
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			err := w.Provision(ctx)
+			if err == nil {
+				defer w.Cleanup()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := w.notifyClient.Transport != nil; got != (tt.transport != "") {
+				t.Errorf("custom transport set: %v, want %v", got, tt.transport != "")
+			}
+		})
+	}
+}
+
+func TestServeHTTPNotifyTransport(t *testing.T) {
+	// The webhook's certificate is self-signed: only a transport that
+	// doesn't verify it gets the notification through
+	tests := []struct {
+		name      string
+		transport string
+		wantSent  bool
+	}{
+		{name: "default"},
+		{name: "skipping verification", transport: "\n\tnotify_transport http {\n\t\ttls_insecure_skip_verify\n\t}", wantSent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notified := make(chan notifyEvent, 4)
+			hook := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				var event notifyEvent
+				if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+					t.Errorf("decoding notification: %v", err)
+				}
+				notified <- event
+			}))
+			t.Cleanup(hook.Close)
+
+			host := newFakeHost(t)
+			w, err := parseTest("wake_on_lan " + testMAC + " 127.0.0.1 {\n\tnotify " + hook.URL + tt.transport + "\n}")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Port = host.port()
+			provisionTest(t, w)
+
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != http.StatusNoContent {
+				t.Fatalf("status = %d, want %d (%v)", got, http.StatusNoContent, err)
+			}
+			host.expect(t, 1)
+			wait := 500 * time.Millisecond
+			if tt.wantSent {
+				wait = 3 * time.Second
+			}
+			select {
+			case event := <-notified:
+				if !tt.wantSent {
+					t.Errorf("notified %+v through Go's default transport", event)
+				} else if event.Result != string(resultSent) {
+					t.Errorf("notified %q, want %q", event.Result, resultSent)
+				}
+			case <-time.After(wait):
+				if tt.wantSent {
+					t.Error("notification never arrived")
+				}
+			}
+		})
+	}
+}
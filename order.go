@@ -0,0 +1,93 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Orders a handler's targets can be woken in.
+const (
+	// One target after the other, each wake finishing before the next.
+	orderSerial = "serial"
+	// All targets at once, bulk_concurrency at a time.
+	orderParallel = "parallel"
+	// Each target starting stagger after the previous one, without
+	// waiting for it to finish.
+	orderStaggered = "staggered"
+)
+
+// defaultStagger is the pause between targets in staggered order.
+const defaultStagger = 100 * time.Millisecond
+
+// validateOrder checks the order and stagger settings.
+func validateOrder(order string, stagger caddy.Duration) error {
+	switch order {
+	case "", orderSerial, orderParallel:
+		if stagger != 0 {
+			return errors.New("stagger requires order staggered")
+		}
+	case orderStaggered:
+		if stagger < 0 {
+			return fmt.Errorf("invalid stagger %s", time.Duration(stagger))
+		}
+	default:
+		return fmt.Errorf("unknown order %q", order)
+	}
+	return nil
+}
+
+// eachTarget calls wake for the indexes 0 to n-1 in the configured order
+// and returns once all calls have. If ctx is cancelled while staggering,
+// the targets not yet started are skipped: the returned count says how
+// many were started, and err why the rest were not.
+func (w *WakeOnLAN) eachTarget(ctx context.Context, n int, wake func(i int)) (int, error) {
+	var wg sync.WaitGroup
+	switch w.Order {
+	case orderParallel:
+		concurrent := w.BulkConcurrency
+		if concurrent == 0 {
+			concurrent = defaultBulkConcurrent
+		}
+		// Taking slots in order, a target never waits on a dependency
+		// that can't start
+		sem := make(chan struct{}, concurrent)
+		for i := 0; i < n; i++ {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				wake(i)
+			}(i)
+		}
+	case orderStaggered:
+		stagger := time.Duration(w.Stagger)
+		if stagger == 0 {
+			stagger = defaultStagger
+		}
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				if err := sleepCtx(ctx, stagger); err != nil {
+					wg.Wait()
+					return i, err
+				}
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				wake(i)
+			}(i)
+		}
+	default:
+		for i := 0; i < n; i++ {
+			wake(i)
+		}
+	}
+	wg.Wait()
+	return n, nil
+}
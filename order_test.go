@@ -0,0 +1,154 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestOrderConfig(t *testing.T) {
+	tests := []struct {
+		input       string
+		wantOrder   string
+		wantStagger time.Duration
+		wantErr     bool
+	}{
+		{input: "order serial", wantOrder: orderSerial},
+		{input: "order parallel", wantOrder: orderParallel},
+		{input: "order staggered\n\tstagger 250ms", wantOrder: orderStaggered, wantStagger: 250 * time.Millisecond},
+		{input: "order staggered", wantOrder: orderStaggered},
+		{input: "order random", wantErr: true},
+		{input: "order", wantErr: true},
+		{input: "order serial\n\tstagger 1s", wantErr: true},
+		{input: "order staggered\n\tstagger -1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan {\n\ttarget 00:11:22:33:44:01 192.0.2.1\n\ttarget 00:11:22:33:44:02 192.0.2.2\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (w.Order != tt.wantOrder || time.Duration(w.Stagger) != tt.wantStagger) {
+				t.Errorf("order %q, stagger %s; want %q, %s", w.Order, time.Duration(w.Stagger), tt.wantOrder, tt.wantStagger)
+			}
+		})
+	}
+}
+
+// wakeTimes records when each of the wakes eachTarget makes starts, and
+// how many run at once.
+type wakeTimes struct {
+	mu      sync.Mutex
+	started []time.Time
+	running int
+	peak    int
+}
+
+// wake returns a wake function taking d.
+func (w *wakeTimes) wake(n int, d time.Duration) func(i int) {
+	w.started = make([]time.Time, n)
+	return func(i int) {
+		w.mu.Lock()
+		w.started[i] = time.Now()
+		w.running++
+		w.peak = max(w.peak, w.running)
+		w.mu.Unlock()
+		time.Sleep(d)
+		w.mu.Lock()
+		w.running--
+		w.mu.Unlock()
+	}
+}
+
+func TestEachTarget(t *testing.T) {
+	const (
+		n    = 4
+		wake = 50 * time.Millisecond
+		// Scheduling slack allowed on the timings
+		slack = 40 * time.Millisecond
+	)
+	tests := []struct {
+		name        string
+		w           *WakeOnLAN
+		wantPeak    int
+		wantGap     time.Duration
+		wantElapsed time.Duration
+	}{
+		{name: "serial", w: &WakeOnLAN{Order: orderSerial}, wantPeak: 1, wantGap: wake, wantElapsed: n * wake},
+		{name: "parallel", w: &WakeOnLAN{Order: orderParallel}, wantPeak: n, wantElapsed: wake},
+		{name: "parallel limited", w: &WakeOnLAN{Order: orderParallel, BulkConcurrency: 2}, wantPeak: 2, wantElapsed: 2 * wake},
+		{name: "staggered", w: &WakeOnLAN{Order: orderStaggered, Stagger: caddy.Duration(30 * time.Millisecond)}, wantPeak: 2, wantGap: 30 * time.Millisecond, wantElapsed: 3*30*time.Millisecond + wake},
+		{name: "staggered by default", w: &WakeOnLAN{Order: orderStaggered}, wantPeak: 1, wantGap: defaultStagger, wantElapsed: 3*defaultStagger + wake},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var times wakeTimes
+			start := time.Now()
+			started, err := tt.w.eachTarget(t.Context(), n, times.wake(n, wake))
+			elapsed := time.Since(start)
+			if started != n || err != nil {
+				t.Fatalf("eachTarget = %d, %v; want %d, nil", started, err, n)
+			}
+			if times.peak != tt.wantPeak {
+				t.Errorf("%d wakes ran at once, want %d", times.peak, tt.wantPeak)
+			}
+			if elapsed < tt.wantElapsed || elapsed > tt.wantElapsed+slack {
+				t.Errorf("took %s, want %s", elapsed, tt.wantElapsed)
+			}
+			for i := 1; i < n && tt.wantGap > 0; i++ {
+				if gap := times.started[i].Sub(times.started[i-1]); gap < tt.wantGap || gap > tt.wantGap+slack {
+					t.Errorf("wake %d started %s after the previous one, want %s", i, gap, tt.wantGap)
+				}
+			}
+		})
+	}
+}
+
+func TestEachTargetStaggeredCancelled(t *testing.T) {
+	w := &WakeOnLAN{Order: orderStaggered, Stagger: caddy.Duration(time.Second)}
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	var times wakeTimes
+	started, err := w.eachTarget(ctx, 3, times.wake(3, 0))
+	if started != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("eachTarget = %d, %v; want 1 started, then the deadline", started, err)
+	}
+}
+
+func TestServeHTTPStaggered(t *testing.T) {
+	const stagger = 80 * time.Millisecond
+	targets, hosts := testPool(t, 3)
+	w := provisionTest(t, &WakeOnLAN{Targets: targets, Order: orderStaggered, Stagger: caddy.Duration(stagger)})
+	arrived := make([]chan time.Time, len(hosts))
+	for i, h := range hosts {
+		arrived[i] = make(chan time.Time, 1)
+		go func() {
+			if _, ok := <-h.packets; ok {
+				arrived[i] <- time.Now()
+			}
+		}()
+	}
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var last time.Time
+	for i := range hosts {
+		select {
+		case at := <-arrived[i]:
+			// Targets start in order, so their packets arrive in order
+			if i > 0 && at.Sub(last) < stagger-10*time.Millisecond {
+				t.Errorf("packet %d arrived %s after the previous one, want about %s", i, at.Sub(last), stagger)
+			}
+			last = at
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no packet for target %d", i)
+		}
+	}
+}
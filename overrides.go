@@ -0,0 +1,182 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Request headers header_overrides reads.
+const (
+	headerWakeRepeat  = "X-Wake-Repeat"
+	headerWakeWait    = "X-Wake-Wait"
+	headerWakeRetries = "X-Wake-Retries"
+)
+
+// HeaderOverrides lets a request tune how hard its targets are woken with
+// headers, within caps the config sets. Only the settings given a cap can
+// be overridden; the headers of the others are ignored.
+type HeaderOverrides struct {
+	// Most packets X-Wake-Repeat may ask for per target.
+	Repeat int `json:"repeat,omitempty"`
+	// Longest wait X-Wake-Wait may ask for. Requires wait.
+	Wait caddy.Duration `json:"wait,omitempty"`
+	// Most on_timeout retries X-Wake-Retries may ask for. Requires
+	// on_timeout retry.
+	Retries int `json:"retries,omitempty"`
+	// Lower a value over its cap to the cap instead of refusing the request
+	// with a 400.
+	Clamp bool `json:"clamp,omitempty"`
+}
+
+// validateHeaderOverrides checks header_overrides and the settings it
+// depends on.
+func (w *WakeOnLAN) validateHeaderOverrides() error {
+	o := w.HeaderOverrides
+	if o == nil {
+		return nil
+	}
+	switch {
+	case o.Repeat < 0:
+		return fmt.Errorf("invalid header_overrides repeat %d", o.Repeat)
+	case o.Wait < 0:
+		return fmt.Errorf("invalid header_overrides wait %s", time.Duration(o.Wait))
+	case o.Retries < 0:
+		return fmt.Errorf("invalid header_overrides retries %d", o.Retries)
+	case o.Repeat == 0 && o.Wait == 0 && o.Retries == 0:
+		return errors.New("header_overrides requires repeat, wait or retries")
+	case o.Wait > 0 && w.Wait <= 0:
+		return errors.New("header_overrides wait requires wait")
+	case o.Retries > 0 && w.OnTimeout != onTimeoutRetry:
+		return errors.New("header_overrides retries requires on_timeout retry")
+	case w.FromBody:
+		return errors.New("header_overrides cannot be combined with from_body")
+	}
+	return nil
+}
+
+// withHeaderOverrides returns the handler to wake r's targets with, a copy
+// of w with the wait and retries r's headers ask for, and the repeat they
+// ask for, 0 if none. A value that isn't valid, or is over its cap without
+// clamp, is a 400.
+func (w *WakeOnLAN) withHeaderOverrides(r *http.Request, logger *zap.Logger) (*WakeOnLAN, int, error) {
+	o := w.HeaderOverrides
+	if o == nil {
+		return w, 0, nil
+	}
+	over := func(name string, value, limit string) error {
+		if o.Clamp {
+			logger.Debug("override over its cap; clamped",
+				zap.String("header", name), zap.String("value", value), zap.String("cap", limit))
+			return nil
+		}
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: %s %s over the maximum of %s", name, value, limit))
+	}
+
+	var repeat int
+	if s := r.Header.Get(headerWakeRepeat); s != "" && o.Repeat > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, 0, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: invalid %s %q", headerWakeRepeat, s))
+		}
+		if n > o.Repeat {
+			if err := over(headerWakeRepeat, s, strconv.Itoa(o.Repeat)); err != nil {
+				return nil, 0, err
+			}
+			n = o.Repeat
+		}
+		repeat = n
+	}
+
+	overridden := w
+	if s := r.Header.Get(headerWakeWait); s != "" && o.Wait > 0 {
+		dur, err := caddy.ParseDuration(s)
+		if err != nil || dur < 0 {
+			return nil, 0, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: invalid %s %q", headerWakeWait, s))
+		}
+		if dur > time.Duration(o.Wait) {
+			if err := over(headerWakeWait, s, time.Duration(o.Wait).String()); err != nil {
+				return nil, 0, err
+			}
+			dur = time.Duration(o.Wait)
+		}
+		c := *overridden
+		c.Wait = caddy.Duration(dur)
+		overridden = &c
+	}
+	if s := r.Header.Get(headerWakeRetries); s != "" && o.Retries > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, 0, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: invalid %s %q", headerWakeRetries, s))
+		}
+		if n > o.Retries {
+			if err := over(headerWakeRetries, s, strconv.Itoa(o.Retries)); err != nil {
+				return nil, 0, err
+			}
+			n = o.Retries
+		}
+		c := *overridden
+		c.OnTimeoutRetries = n
+		if n == 0 {
+			// 0 would mean the default number of retries
+			c.OnTimeout = onTimeoutNext
+		}
+		overridden = &c
+	}
+	if repeat > 0 || overridden != w {
+		logger.Debug("wake settings overridden by request headers",
+			zap.Int("repeat", repeat), zap.Duration("wait", time.Duration(overridden.Wait)), zap.Int("on_timeout_retries", overridden.OnTimeoutRetries))
+	}
+	return overridden, repeat, nil
+}
+
+// parseHeaderOverrides parses the header_overrides block: repeat, wait and
+// retries with their caps, and clamp.
+func parseHeaderOverrides(d *caddyfile.Dispenser) (*HeaderOverrides, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	o := new(HeaderOverrides)
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "repeat":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			o.Repeat = n
+		case "wait":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			o.Wait = dur
+		case "retries":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			o.Retries = n
+		case "clamp":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			o.Clamp = true
+		default:
+			return nil, d.Errf("unrecognized header_overrides subdirective '%s'", d.Val())
+		}
+	}
+	return o, nil
+}
@@ -0,0 +1,162 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestHeaderOverridesConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    HeaderOverrides
+		wantErr bool
+	}{
+		{input: "header_overrides {\n\t\trepeat 10\n\t}", want: HeaderOverrides{Repeat: 10}},
+		{
+			input: "check 192.0.2.1:22\n\twait 1m\n\ton_timeout retry\n\theader_overrides {\n\t\trepeat 10\n\t\twait 5m\n\t\tretries 3\n\t\tclamp\n\t}",
+			want:  HeaderOverrides{Repeat: 10, Wait: caddy.Duration(5 * time.Minute), Retries: 3, Clamp: true},
+		},
+		{input: "header_overrides {\n\t\tclamp\n\t}", wantErr: true},
+		{input: "header_overrides", wantErr: true},
+		{input: "header_overrides yes {\n\t\trepeat 10\n\t}", wantErr: true},
+		{input: "header_overrides {\n\t\trepeat -1\n\t}", wantErr: true},
+		{input: "header_overrides {\n\t\twait 5m\n\t}", wantErr: true},
+		{input: "check 192.0.2.1:22\n\twait 1m\n\theader_overrides {\n\t\tretries 3\n\t}", wantErr: true},
+		{input: "header_overrides {\n\t\trepeat 10\n\t\tclamp yes\n\t}", wantErr: true},
+		{input: "header_overrides {\n\t\tdelay 1s\n\t}", wantErr: true},
+		{input: "from_body\n\theader_overrides {\n\t\trepeat 10\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.HeaderOverrides != tt.want {
+				t.Errorf("header_overrides %+v, want %+v", *w.HeaderOverrides, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithHeaderOverrides(t *testing.T) {
+	base := WakeOnLAN{Wait: caddy.Duration(time.Minute), OnTimeout: onTimeoutRetry, OnTimeoutRetries: 1}
+	caps := HeaderOverrides{Repeat: 10, Wait: caddy.Duration(5 * time.Minute), Retries: 3}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		clamp   bool
+		// no caps but repeat's
+		repeatOnly  bool
+		wantRepeat  int
+		wantWait    time.Duration
+		wantRetries int
+		wantOnTime  string
+		wantStatus  int
+	}{
+		{name: "none", wantWait: time.Minute, wantRetries: 1, wantOnTime: onTimeoutRetry},
+		{
+			name:       "all",
+			headers:    map[string]string{headerWakeRepeat: "5", headerWakeWait: "2m", headerWakeRetries: "2"},
+			wantRepeat: 5, wantWait: 2 * time.Minute, wantRetries: 2, wantOnTime: onTimeoutRetry,
+		},
+		{name: "no retries", headers: map[string]string{headerWakeRetries: "0"}, wantWait: time.Minute, wantOnTime: onTimeoutNext},
+		{name: "repeat over", headers: map[string]string{headerWakeRepeat: "11"}, wantStatus: http.StatusBadRequest},
+		{name: "wait over", headers: map[string]string{headerWakeWait: "1h"}, wantStatus: http.StatusBadRequest},
+		{name: "retries over", headers: map[string]string{headerWakeRetries: "4"}, wantStatus: http.StatusBadRequest},
+		{
+			name:       "clamped",
+			headers:    map[string]string{headerWakeRepeat: "50", headerWakeWait: "1h", headerWakeRetries: "9"},
+			clamp:      true,
+			wantRepeat: 10, wantWait: 5 * time.Minute, wantRetries: 3, wantOnTime: onTimeoutRetry,
+		},
+		{name: "repeat not a number", headers: map[string]string{headerWakeRepeat: "many"}, clamp: true, wantStatus: http.StatusBadRequest},
+		{name: "repeat zero", headers: map[string]string{headerWakeRepeat: "0"}, wantStatus: http.StatusBadRequest},
+		{name: "negative wait", headers: map[string]string{headerWakeWait: "-1s"}, wantStatus: http.StatusBadRequest},
+		{name: "negative retries", headers: map[string]string{headerWakeRetries: "-1"}, wantStatus: http.StatusBadRequest},
+		{
+			name:       "uncapped ignored",
+			headers:    map[string]string{headerWakeRepeat: "5", headerWakeWait: "garbage", headerWakeRetries: "99"},
+			repeatOnly: true,
+			wantRepeat: 5, wantWait: time.Minute, wantRetries: 1, wantOnTime: onTimeoutRetry,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := base
+			o := caps
+			if tt.repeatOnly {
+				o = HeaderOverrides{Repeat: caps.Repeat}
+			}
+			o.Clamp = tt.clamp
+			w.HeaderOverrides = &o
+			r := newTestRequest("GET", "http://example.com/", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			got, repeat, err := w.withHeaderOverrides(r, zap.NewNop())
+			if tt.wantStatus != 0 {
+				if err == nil {
+					t.Fatalf("no error, want status %d", tt.wantStatus)
+				}
+				if status := statusOf(nil, err); status != tt.wantStatus {
+					t.Fatalf("status %d, want %d (%v)", status, tt.wantStatus, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repeat != tt.wantRepeat || time.Duration(got.Wait) != tt.wantWait || got.OnTimeoutRetries != tt.wantRetries || got.OnTimeout != tt.wantOnTime {
+				t.Errorf("repeat %d, wait %s, retries %d, on_timeout %q; want %d, %s, %d, %q",
+					repeat, time.Duration(got.Wait), got.OnTimeoutRetries, got.OnTimeout, tt.wantRepeat, tt.wantWait, tt.wantRetries, tt.wantOnTime)
+			}
+			// The handler itself is never changed
+			if w.Wait != base.Wait || w.OnTimeoutRetries != base.OnTimeoutRetries || w.OnTimeout != base.OnTimeout {
+				t.Error("the handler's own settings changed")
+			}
+		})
+	}
+}
+
+func TestServeHTTPHeaderOverridesRepeat(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:             testMAC,
+		IP:              "127.0.0.1",
+		Port:            host.port(),
+		Repeat:          2,
+		HeaderOverrides: &HeaderOverrides{Repeat: 5},
+	})
+	tests := []struct {
+		header      string
+		wantStatus  int
+		wantPackets int
+	}{
+		{header: "4", wantStatus: http.StatusNoContent, wantPackets: 4},
+		// The override is the request's only
+		{wantStatus: http.StatusNoContent, wantPackets: 2},
+		{header: "6", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := newTestRequest("GET", "http://example.com/", nil)
+		if tt.header != "" {
+			r.Header.Set(headerWakeRepeat, tt.header)
+		}
+		rec, _, err := serveTest(w, r)
+		if got := statusOf(rec, err); got != tt.wantStatus {
+			t.Errorf("%s %q: status %d, want %d (%v)", headerWakeRepeat, tt.header, got, tt.wantStatus, err)
+		}
+		if tt.wantPackets > 0 {
+			host.expect(t, tt.wantPackets)
+		}
+		host.expectNone(t)
+	}
+}
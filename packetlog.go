@@ -0,0 +1,63 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// redactedHex stands in for the 6 bytes of a SecureOn password in a
+// logged packet.
+const redactedHex = "xxxxxxxxxxxx"
+
+// logPacket logs the packet about to be sent to t as hex at debug level,
+// with where it goes, if log_packet is set. SecureOn passwords are
+// replaced by x's: the bytes around them still compare against a capture.
+func logPacket(opts sendOptions, t Target, addr *net.UDPAddr, packet []byte) {
+	if opts.PacketLogger == nil {
+		return
+	}
+	var password net.HardwareAddr
+	if t.SecureOn != "" {
+		password, _ = parseSecureOn(t.SecureOn)
+	}
+	fields := []zap.Field{
+		zap.String("target", t.label()),
+		zap.Int("size", len(packet)),
+		zap.String("packet", packetHex(packet, password)),
+	}
+	if addr != nil {
+		fields = append(fields, zap.String("dest", addr.String()))
+	}
+	if len(opts.Broadcasts) > 0 {
+		fields = append(fields, zap.Strings("broadcasts", opts.Broadcasts))
+	}
+	if password != nil {
+		fields = append(fields, zap.Bool("secureon_redacted", true))
+	}
+	opts.PacketLogger.Debug("packet", fields...)
+}
+
+// packetHex returns packet in hex, with each occurrence of password, if
+// set, redacted.
+func packetHex(packet []byte, password net.HardwareAddr) string {
+	if len(password) == 0 {
+		return hex.EncodeToString(packet)
+	}
+	var b strings.Builder
+	b.Grow(2 * len(packet))
+	for len(packet) > 0 {
+		i := bytes.Index(packet, password)
+		if i < 0 {
+			b.WriteString(hex.EncodeToString(packet))
+			break
+		}
+		b.WriteString(hex.EncodeToString(packet[:i]))
+		b.WriteString(redactedHex)
+		packet = packet[i+len(password):]
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestLogPacketConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    bool
+		wantErr bool
+	}{
+		{input: "log_packet", want: true},
+		{input: "log_packet\n\tsecureon 01:02:03:04:05:06", want: true},
+		{input: "log_packet yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.LogPacket != tt.want {
+				t.Errorf("log_packet = %v, want %v", w.LogPacket, tt.want)
+			}
+		})
+	}
+}
+
+func TestPacketHex(t *testing.T) {
+	password := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	tests := []struct {
+		name     string
+		packet   []byte
+		password []byte
+		want     string
+	}{
+		{name: "no password", packet: []byte{0xff, 0x00, 0x11}, want: "ff0011"},
+		{name: "password not in the packet", packet: []byte{0xff, 0x00, 0x11}, password: password, want: "ff0011"},
+		{name: "trailing password", packet: append([]byte{0xff, 0x00}, password...), password: password, want: "ff00" + redactedHex},
+		{
+			name:     "password twice",
+			packet:   append(append(append([]byte{0xaa}, password...), 0xbb), password...),
+			password: password,
+			want:     "aa" + redactedHex + "bb" + redactedHex,
+		},
+		{name: "only the password", packet: password, password: password, want: redactedHex},
+		{name: "empty", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := packetHex(tt.packet, tt.password); got != tt.want {
+				t.Errorf("packetHex = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPLogPacket(t *testing.T) {
+	hw, _ := parseMAC(testMAC)
+	magic := hex.EncodeToString(buildMagicPacket(hw))
+	tests := []struct {
+		name      string
+		logPacket bool
+		secureOn  string
+		// the packet field logged, none if empty
+		want         string
+		wantRedacted bool
+	}{
+		{name: "off"},
+		{name: "on", logPacket: true, want: magic},
+		{name: "secureon", logPacket: true, secureOn: "01:02:03:04:05:06", want: magic + redactedHex, wantRedacted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:       testMAC,
+				IP:        "127.0.0.1",
+				Port:      host.port(),
+				SecureOn:  tt.secureOn,
+				LogPacket: tt.logPacket,
+			})
+			logs := observeLogs(w)
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			sent := host.expect(t, 1)[0]
+
+			entries := logs.FilterMessage("packet").All()
+			if tt.want == "" {
+				if len(entries) != 0 {
+					t.Errorf("logged %d packets, want none", len(entries))
+				}
+				return
+			}
+			if len(entries) != 1 {
+				t.Fatalf("logged %d packets, want 1", len(entries))
+			}
+			fields := entries[0].ContextMap()
+			if got := fields["packet"]; got != tt.want {
+				t.Errorf("packet = %v, want %s", got, tt.want)
+			}
+			if got := fields["size"]; got != int64(len(sent)) {
+				t.Errorf("size = %v, want %d", got, len(sent))
+			}
+			if got, _ := fields["dest"].(string); !strings.HasPrefix(got, "127.0.0.1:") {
+				t.Errorf("dest = %q, want the target's address", got)
+			}
+			if got, _ := fields["secureon_redacted"].(bool); got != tt.wantRedacted {
+				t.Errorf("secureon_redacted = %v, want %v", got, tt.wantRedacted)
+			}
+			// The bytes around the password match what was sent
+			if !strings.HasPrefix(hex.EncodeToString(sent), strings.TrimSuffix(tt.want, redactedHex)) {
+				t.Errorf("logged %s, sent %x", tt.want, sent)
+			}
+		})
+	}
+}
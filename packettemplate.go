@@ -0,0 +1,216 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Placeholders a packet template can reference.
+const (
+	// The target's MAC as text, e.g. 10:ff:e0:cf:e6:0e.
+	placeholderMAC = "{mac}"
+	// The target's MAC as 6 bytes.
+	placeholderMACBytes = "{mac_bytes}"
+	// The target's SecureOn password as 6 bytes.
+	placeholderSecureOn = "{secureon}"
+)
+
+// packetPart is one part of a packet template: literal bytes or a
+// placeholder, repeated count times.
+type packetPart struct {
+	literal     []byte
+	placeholder string
+	count       int
+}
+
+// packetTemplate describes the bytes of a packet as a sequence of
+// space-separated parts, each hex bytes or a placeholder, optionally
+// followed by *<count> to repeat it. The standard magic packet is
+//
+//	ff*6 {mac_bytes}*16
+type packetTemplate struct {
+	parts []packetPart
+	size  int
+}
+
+// parsePacketTemplate parses s, checking its syntax, placeholders and size.
+func parsePacketTemplate(s string) (*packetTemplate, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, errors.New("empty packet template")
+	}
+	p := new(packetTemplate)
+	for _, field := range fields {
+		atom, count := field, 1
+		if i := strings.LastIndex(field, "*"); i >= 0 {
+			n, err := strconv.Atoi(field[i+1:])
+			if err != nil || n < 1 || n > maxLargePacketSize {
+				return nil, fmt.Errorf("invalid repetition in %q", field)
+			}
+			atom, count = field[:i], n
+		}
+		part := packetPart{count: count}
+		size := 0
+		switch {
+		case atom == placeholderMAC:
+			part.placeholder, size = atom, len("00:00:00:00:00:00")
+		case atom == placeholderMACBytes, atom == placeholderSecureOn:
+			part.placeholder, size = atom, 6
+		case strings.HasPrefix(atom, "{"):
+			return nil, fmt.Errorf("unknown placeholder %s in packet template", atom)
+		default:
+			b, err := hex.DecodeString(atom)
+			if err != nil || len(b) == 0 {
+				return nil, fmt.Errorf("invalid hex bytes %q in packet template", atom)
+			}
+			part.literal, size = b, len(b)
+		}
+		p.parts = append(p.parts, part)
+		p.size += size * count
+		if p.size > maxLargePacketSize {
+			return nil, fmt.Errorf("packet template is larger than %d bytes", maxLargePacketSize)
+		}
+	}
+	return p, nil
+}
+
+// usesSecureOn reports whether the template needs a SecureOn password.
+func (p *packetTemplate) usesSecureOn() bool {
+	for _, part := range p.parts {
+		if part.placeholder == placeholderSecureOn {
+			return true
+		}
+	}
+	return false
+}
+
+// build produces the packet for hw and, if referenced, password.
+func (p *packetTemplate) build(hw, password net.HardwareAddr) []byte {
+	packet := make([]byte, 0, p.size)
+	for _, part := range p.parts {
+		b := part.literal
+		switch part.placeholder {
+		case placeholderMAC:
+			b = []byte(hw.String())
+		case placeholderMACBytes:
+			b = hw
+		case placeholderSecureOn:
+			b = password
+		}
+		for i := 0; i < part.count; i++ {
+			packet = append(packet, b...)
+		}
+	}
+	return packet
+}
+
+// parseSecureOn parses a SecureOn password: 6 bytes written like a MAC,
+// or as 12 hex digits.
+func parseSecureOn(s string) (net.HardwareAddr, error) {
+	if strings.ContainsAny(s, ":-.") {
+		hw, err := net.ParseMAC(s)
+		if err != nil || len(hw) != 6 {
+			return nil, errors.New("must be 6 bytes")
+		}
+		return hw, nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 6 {
+		return nil, errors.New("must be 6 bytes")
+	}
+	return b, nil
+}
+
+// provisionPacketTemplates parses the handler's packet template and those
+// of its targets, so sends don't parse them again.
+func (w *WakeOnLAN) provisionPacketTemplates() error {
+	for _, t := range w.allTargets() {
+		if t.PacketTemplate == "" || w.packetTemplates[t.PacketTemplate] != nil {
+			continue
+		}
+		tmpl, err := parsePacketTemplate(t.PacketTemplate)
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: target %s: %w", t.label(), err)
+		}
+		if tmpl.usesSecureOn() && t.SecureOn == "" {
+			return fmt.Errorf("wake_on_lan: target %s: packet template uses %s but no secureon password is set", t.label(), placeholderSecureOn)
+		}
+		if w.packetTemplates == nil {
+			w.packetTemplates = make(map[string]*packetTemplate)
+		}
+		w.packetTemplates[t.PacketTemplate] = tmpl
+	}
+	return nil
+}
+
+// buildPacket produces the packet to wake t: from its template if it has
+// one, otherwise with its encoding, by default the standard magic packet
+// followed by its SecureOn password, if set, and then its checksum. The
+// packet is then padded to opts.PadTo, and refused if that makes it larger
+// than opts.MaxPacketSize.
+func buildPacket(t Target, hw net.HardwareAddr, opts sendOptions) ([]byte, error) {
+	packet, err := assemblePacket(t, hw, opts)
+	if err != nil {
+		return nil, err
+	}
+	packet = append(packet, opts.AckTrailer...)
+	limit := opts.MaxPacketSize
+	if limit == 0 {
+		limit = maxPacketSize
+	}
+	if len(packet) > limit {
+		return nil, fmt.Errorf("packet of %d bytes is larger than %d", len(packet), limit)
+	}
+	return packet, nil
+}
+
+// assemblePacket produces the packet buildPacket checks.
+func assemblePacket(t Target, hw net.HardwareAddr, opts sendOptions) ([]byte, error) {
+	var password net.HardwareAddr
+	if t.SecureOn != "" {
+		var err error
+		if password, err = parseSecureOn(t.SecureOn); err != nil {
+			return nil, fmt.Errorf("invalid secureon password: %w", err)
+		}
+	}
+	if t.PacketTemplate == "" {
+		packet, err := encodePacket(t.Encoding, hw, t.SecureOn)
+		if err != nil {
+			return nil, err
+		}
+		return padPacket(appendChecksum(packet, t.Checksum), opts.PadTo), nil
+	}
+	// Targets added after the config loaded weren't parsed up front
+	tmpl, ok := opts.PacketTemplates[t.PacketTemplate]
+	if !ok {
+		var err error
+		if tmpl, err = parsePacketTemplate(t.PacketTemplate); err != nil {
+			return nil, err
+		}
+	}
+	if tmpl.usesSecureOn() && password == nil {
+		return nil, fmt.Errorf("packet template uses %s but no secureon password is set", placeholderSecureOn)
+	}
+	return padPacket(appendChecksum(tmpl.build(hw, password), t.Checksum), opts.PadTo), nil
+}
+
+// packetSize returns the size of the packet that wakes t.
+func packetSize(t Target, opts sendOptions) int {
+	size := magicPacketSize()
+	if t.SecureOn != "" {
+		size += 6
+	}
+	if tmpl, ok := opts.PacketTemplates[t.PacketTemplate]; ok {
+		size = tmpl.size
+	} else if t.Encoding != "" {
+		// Encoded for a placeholder MAC; the size doesn't depend on it
+		if packet, err := encodePacket(t.Encoding, make(net.HardwareAddr, 6), t.SecureOn); err == nil {
+			size = len(packet)
+		}
+	}
+	return max(size+checksumSize(t.Checksum), opts.PadTo)
+}
@@ -0,0 +1,332 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestPacketSize(t *testing.T) {
+	tests := []struct {
+		name string
+		w    *WakeOnLAN
+		want int
+	}{
+		{name: "standard", w: &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1"}, want: 102},
+		{name: "secureon", w: &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", SecureOn: "01:02:03:04:05:06"}, want: 108},
+		{name: "custom repetitions", w: &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", PacketTemplate: "ff*6 {mac_bytes}*32"}, want: 198},
+		{name: "custom repetitions with secureon", w: &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", SecureOn: "01:02:03:04:05:06", PacketTemplate: "ff*6 {mac_bytes}*100 {secureon}"}, want: 612},
+		{name: "padded", w: &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", PadTo: 144}, want: 144},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, tt.w)
+			target := w.targets()[0]
+			if got := packetSize(target, w.sendOptions()); got != tt.want {
+				t.Errorf("packetSize = %d, want %d", got, tt.want)
+			}
+			// The computed size is that of the packet actually built
+			hw, _ := target.hardwareAddr()
+			packet, err := buildPacket(target, hw, w.sendOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packet) != tt.want {
+				t.Errorf("built a %d-byte packet, want %d", len(packet), tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnSizeConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{input: "warn_size 1400", want: 1400},
+		{input: "warn_size", wantErr: true},
+		{input: "warn_size big", wantErr: true},
+		{input: "warn_size -1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.WarnSize != tt.want {
+				t.Errorf("warn_size = %d, want %d", w.WarnSize, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPacketSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		warnSize int
+		wantWarn bool
+	}{
+		{name: "standard", wantWarn: false},
+		{name: "over the default", template: "ff*6 {mac_bytes}*100", wantWarn: true},
+		{name: "over warn_size", template: "ff*6 {mac_bytes}*32", warnSize: 150, wantWarn: true},
+		{name: "under warn_size", template: "ff*6 {mac_bytes}*100", warnSize: 1400, wantWarn: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", PacketTemplate: tt.template, WarnSize: tt.warnSize})
+			logs := observeLogs(w)
+			w.checkPacketSize()
+			size, _ := w.largestPacket()
+			if logs.FilterMessage("packet size").FilterField(zap.Int("size", size)).Len() != 1 {
+				t.Errorf("packet size %d not logged at debug", size)
+			}
+			if got := logs.FilterMessage("packet may be fragmented; wakes can fail on networks dropping fragments").Len() > 0; got != tt.wantWarn {
+				t.Errorf("warned = %v, want %v", got, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestParsePacketTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantSize int
+		wantErr  bool
+	}{
+		{name: "standard", template: "ff*6 {mac_bytes}*16", wantSize: 102},
+		{name: "text MAC", template: "{mac}", wantSize: 17},
+		{name: "multi-byte literal", template: "0842 ffffffffffff {mac_bytes}*16", wantSize: 104},
+		{name: "secureon", template: "ff*6 {mac_bytes}*16 {secureon}", wantSize: 108},
+		{name: "empty", template: "  ", wantErr: true},
+		{name: "unknown placeholder", template: "ff*6 {ip}", wantErr: true},
+		{name: "odd hex", template: "fff", wantErr: true},
+		{name: "not hex", template: "zz", wantErr: true},
+		{name: "zero repetitions", template: "ff*0", wantErr: true},
+		{name: "bad repetitions", template: "ff*x", wantErr: true},
+		{name: "too large", template: "{mac_bytes}*11000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parsePacketTemplate(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tmpl.size != tt.wantSize {
+				t.Errorf("size = %d, want %d", tmpl.size, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestPacketTemplateBuild(t *testing.T) {
+	hw, _ := net.ParseMAC(testMAC)
+	password := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	tests := []struct {
+		name     string
+		template string
+		want     []byte
+	}{
+		{name: "standard", template: "ff*6 {mac_bytes}*16", want: buildMagicPacket(hw)},
+		{name: "secureon", template: "ff*6 {mac_bytes}*16 {secureon}", want: append(buildMagicPacket(hw), password...)},
+		{
+			name:     "vendor variant",
+			template: "0842 ff*6 {mac_bytes}*4 {mac}",
+			want:     slices.Concat([]byte{0x08, 0x42}, bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(hw, 4), []byte(testMAC)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parsePacketTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tmpl.build(hw, password)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("built % x, want % x", got, tt.want)
+			}
+			if len(got) != tmpl.size {
+				t.Errorf("built %d bytes, template size %d", len(got), tmpl.size)
+			}
+		})
+	}
+}
+
+func TestParseSecureOn(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "01:02:03:04:05:06", want: "01:02:03:04:05:06"},
+		{in: "01-02-03-04-05-06", want: "01:02:03:04:05:06"},
+		{in: "010203040506", want: "01:02:03:04:05:06"},
+		{in: "01:02:03:04:05", wantErr: true},
+		{in: "0102030405", wantErr: true},
+		{in: "hunter2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSecureOn(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("parseSecureOn = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPacketTemplateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "standard", input: "packet_template \"ff*6 {mac_bytes}*16\""},
+		{name: "secureon", input: "secureon 01:02:03:04:05:06\n\tpacket_template \"ff*6 {mac_bytes}*16 {secureon}\""},
+		{name: "secureon missing", input: "packet_template \"ff*6 {mac_bytes}*16 {secureon}\"", wantErr: true},
+		{name: "bad syntax", input: "packet_template \"ff*6 {mac_bytes*16\"", wantErr: true},
+		{name: "no template", input: "packet_template", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if err == nil {
+				ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+				defer cancel()
+				if err = w.Provision(ctx); err == nil {
+					w.Cleanup()
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeHTTPPacketTemplate(t *testing.T) {
+	hw, _ := net.ParseMAC(testMAC)
+	tests := []struct {
+		name     string
+		template string
+		secureOn string
+		want     []byte
+	}{
+		{name: "standard", template: "ff*6 {mac_bytes}*16", want: buildMagicPacket(hw)},
+		{name: "custom", template: "ff*6 {mac_bytes}*20 {secureon}", secureOn: "010203040506", want: slices.Concat(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(hw, 20), []byte{1, 2, 3, 4, 5, 6})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), PacketTemplate: tt.template, SecureOn: tt.secureOn})
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			if p := host.expect(t, 1)[0]; !bytes.Equal(p, tt.want) {
+				t.Errorf("packet % x, want % x", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowLargePacketConfig(t *testing.T) {
+	sleep := func(n int) string {
+		return "action sleep\n\tsleep_endpoint 192.0.2.1:9\n\tsleep_payload " + strings.Repeat("z", n)
+	}
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		// 6 + 6*244 = 1470 bytes, and 6 + 6*245 = 1476
+		{name: "template under the cap", input: "packet_template \"ff*6 {mac_bytes}*244\""},
+		{name: "template over the cap", input: "packet_template \"ff*6 {mac_bytes}*245\"", wantErr: "target " + testMAC + ": packet of 1476 bytes is larger than 1472; set allow_large_packet"},
+		{name: "template allowed", input: "packet_template \"ff*6 {mac_bytes}*245\"\n\tallow_large_packet"},
+		{name: "padded to the cap", input: "pad_to 1472\n\tsecureon 01:02:03:04:05:06"},
+		{name: "padded template over the cap", input: "packet_template \"ff*6 {mac_bytes}*245\"\n\tpad_to 1000", wantErr: "larger than 1472"},
+		{name: "padded to the large cap", input: "pad_to 65507\n\tallow_large_packet"},
+		{name: "padded over the large cap", input: "pad_to 65508\n\tallow_large_packet", wantErr: "pad_to must be between 0 and 65507"},
+		{name: "large template over the large cap", input: "packet_template \"ff*6 {mac_bytes}*10917\"\n\tallow_large_packet", wantErr: "larger than 65507"},
+		{name: "sleep payload at the cap", input: sleep(1472)},
+		{name: "sleep payload over the cap", input: sleep(1473), wantErr: "sleep_payload: packet of 1473 bytes is larger than 1472"},
+		{name: "sleep payload allowed", input: sleep(1473) + "\n\tallow_large_packet"},
+		{name: "argument", input: "allow_large_packet yes", wantErr: "wrong argument count"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Templates are parsed in Provision, which Caddy runs first
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+				defer cancel()
+				if err = w.Provision(ctx); err == nil {
+					defer w.Cleanup()
+					err = w.Validate()
+				}
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildPacketLimit(t *testing.T) {
+	// Targets added at runtime are held to the cap as they are built
+	hw, _ := parseMAC(testMAC)
+	tests := []struct {
+		name    string
+		opts    sendOptions
+		wantErr bool
+	}{
+		{name: "padded to the cap", opts: sendOptions{PadTo: maxPacketSize}},
+		{name: "padded over the cap", opts: sendOptions{PadTo: maxPacketSize + 1}, wantErr: true},
+		{name: "padded over the raised cap", opts: sendOptions{PadTo: 2000, MaxPacketSize: 1800}, wantErr: true},
+		{name: "padded under the raised cap", opts: sendOptions{PadTo: 2000, MaxPacketSize: maxLargePacketSize}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet, err := buildPacket(Target{MAC: testMAC}, hw, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && len(packet) != tt.opts.PadTo {
+				t.Errorf("built %d bytes, want %d", len(packet), tt.opts.PadTo)
+			}
+		})
+	}
+}
+
+func TestServeHTTPAllowLargePacket(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), PadTo: 2000, AllowLargePacket: true})
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if p := host.expect(t, 1)[0]; len(p) != 2000 {
+		t.Errorf("got a %d-byte packet, want 2000", len(p))
+	}
+}
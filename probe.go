@@ -0,0 +1,88 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaultProbeTimeout bounds a single reachability probe when none is configured.
+const defaultProbeTimeout = time.Second
+
+// probeTCP reports whether a TCP connection to addr (host:port) can be
+// established within timeout.
+func probeTCP(ctx context.Context, addr string, timeout time.Duration) bool {
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// waitPollInterval is the pause between probes while waiting for a host.
+const waitPollInterval = 500 * time.Millisecond
+
+// waitTCP probes addr until it accepts a connection or wait elapses.
+func waitTCP(ctx context.Context, addr string, probeTimeout, wait time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	for {
+		if probeTCP(ctx, addr, probeTimeout) {
+			return true
+		}
+		if sleepCtx(ctx, waitPollInterval) != nil {
+			return false
+		}
+	}
+}
+
+// validateProbeAddress checks that addr, if set, is a host:port pair that
+// can actually be probed.
+func validateProbeAddress(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	_, _, err := splitEndpoint(addr)
+	return err
+}
+
+// splitEndpoint splits a host:port endpoint into its parts, rejecting a
+// missing host, a missing port and ports outside 1-65535.
+func splitEndpoint(endpoint string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		var addrErr *net.AddrError
+		if errors.As(err, &addrErr) && addrErr.Err == "missing port in address" {
+			return "", 0, fmt.Errorf("address %q is missing a port (expected host:port)", endpoint)
+		}
+		return "", 0, fmt.Errorf("invalid address %q: %w", endpoint, err)
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("address %q is missing a host", endpoint)
+	}
+	if portStr == "" {
+		return "", 0, fmt.Errorf("address %q is missing a port (expected host:port)", endpoint)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q in address %q", portStr, endpoint)
+	}
+	if port == 0 {
+		return "", 0, fmt.Errorf("port 0 in address %q cannot be connected to", endpoint)
+	}
+	if port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("port %d in address %q is out of range (1-65535)", port, endpoint)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,79 @@
+package caddy_wakeonlan
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSplitEndpoint(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantHost string
+		wantPort int
+		wantErr  bool
+	}{
+		{in: "192.168.1.10:22", wantHost: "192.168.1.10", wantPort: 22},
+		{in: "nas.lan:65535", wantHost: "nas.lan", wantPort: 65535},
+		{in: "[fe80::1%eth0]:22", wantHost: "fe80::1%eth0", wantPort: 22},
+		{in: "192.168.1.10", wantErr: true},
+		{in: "192.168.1.10:", wantErr: true},
+		{in: "192.168.1.10:0", wantErr: true},
+		{in: "192.168.1.10:65536", wantErr: true},
+		{in: "192.168.1.10:ssh", wantErr: true},
+		{in: ":22", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			host, port, err := splitEndpoint(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitEndpoint(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("splitEndpoint(%q) = %q, %d, want %q, %d", tt.in, host, port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestValidateProbePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "check", input: "check 192.168.1.10:22"},
+		{name: "check missing port", input: "check 192.168.1.10", wantErr: true},
+		{name: "check zero port", input: "check 192.168.1.10:0", wantErr: true},
+		{name: "check port out of range", input: "check 192.168.1.10:70000", wantErr: true},
+		{name: "retry_probe missing port", input: "retry_probe 192.168.1.10", wantErr: true},
+		{name: "retry_probe zero port", input: "retry_probe 192.168.1.10:0", wantErr: true},
+		{name: "target check zero port", input: "target " + testMAC + " 192.168.1.10 {\n\t\tcheck 192.168.1.10:0\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWaitTCP(t *testing.T) {
+	up := newTCPHost(t)
+	down := "127.0.0.1:" + strconv.Itoa(closedPort(t))
+	if !waitTCP(t.Context(), up.addr(), time.Second, time.Second) {
+		t.Error("waitTCP gave up on a listening host")
+	}
+	start := time.Now()
+	if waitTCP(t.Context(), down, 100*time.Millisecond, 200*time.Millisecond) {
+		t.Error("waitTCP found a closed port up")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("waitTCP took %s, want about the wait", took)
+	}
+}
@@ -0,0 +1,159 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+// Profile is a named preset of handler settings for a class of devices,
+// defined in the wake_on_lan app and selected by handlers with profile.
+// A handler's own settings take precedence over its profile's, which take
+// precedence over the app's defaults.
+type Profile struct {
+	Defaults
+	// Broadcast address packets are also sent to.
+	Broadcast string `json:"broadcast,omitempty"`
+	// Protocol the packet is sent to each target's IP with.
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// validate checks the profile like the handler checks its own values.
+func (p *Profile) validate() error {
+	if err := p.Defaults.validate(); err != nil {
+		return err
+	}
+	if p.Broadcast != "" {
+		if err := validateBroadcast(p.Broadcast); err != nil {
+			return err
+		}
+	}
+	switch p.Protocol {
+	case "", protocolUDP:
+	case protocolTCP:
+		if p.Broadcast != "" {
+			return errors.New("protocol tcp cannot be combined with broadcast")
+		}
+	default:
+		return fmt.Errorf("unknown protocol %q", p.Protocol)
+	}
+	return nil
+}
+
+// applyProfile fills in the handler's unset settings from p. Settings the
+// handler can't combine with its own are left out: broadcast with a relay
+// or protocol tcp, protocol with a broadcast, transports or a relay.
+func (w *WakeOnLAN) applyProfile(p *Profile) {
+	if w.Repeat == 0 {
+		w.Repeat = p.Repeat
+	}
+	if w.Interval == 0 {
+		w.Interval = p.Interval
+	}
+	if w.Broadcast == "" && w.Protocol != protocolTCP && !w.relayed() {
+		w.Broadcast = p.Broadcast
+	}
+	if w.Protocol == "" && w.Broadcast == "" && len(w.Transports) == 0 && !w.relayed() {
+		w.Protocol = p.Protocol
+	}
+	w.defaultPort = p.Port
+	w.profileApplied = true
+}
+
+// parseProfile parses a profile's name and block. broadcast without an
+// address means the limited broadcast address.
+func parseProfile(d *caddyfile.Dispenser) (string, *Profile, error) {
+	if !d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	name := d.Val()
+	if d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	profile := new(Profile)
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return "", nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		ok, err := profile.Defaults.parseSubdirective(d)
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			continue
+		}
+		switch d.Val() {
+		case "broadcast":
+			profile.Broadcast = net.IPv4bcast.String()
+			if d.NextArg() {
+				profile.Broadcast = d.Val()
+			}
+			if d.NextArg() {
+				return "", nil, d.ArgErr()
+			}
+		case "protocol":
+			protocol, err := parseStringArg(d)
+			if err != nil {
+				return "", nil, err
+			}
+			profile.Protocol = protocol
+		default:
+			return "", nil, d.Errf("unrecognized profile subdirective '%s'", d.Val())
+		}
+	}
+	if err := profile.validate(); err != nil {
+		return "", nil, d.Errf("profile %s: %v", name, err)
+	}
+	return name, profile, nil
+}
+
+// addProfile adds a parsed profile to app, rejecting a name defined twice.
+func addProfile(d *caddyfile.Dispenser, app *App, name string, profile *Profile) error {
+	if _, ok := app.Profiles[name]; ok {
+		return d.Errf("profile %s defined more than once", name)
+	}
+	if app.Profiles == nil {
+		app.Profiles = make(map[string]*Profile)
+	}
+	app.Profiles[name] = profile
+	return nil
+}
+
+// parseProfileOption parses the wake_on_lan_profile global option, a
+// shorthand for a profile of the wake_on_lan one. It may be repeated, once
+// per profile:
+//
+//	wake_on_lan_profile <name> {
+//		broadcast [<address>]
+//		protocol udp|tcp
+//		port <port>
+//		repeat <count>
+//		interval <duration>
+//	}
+func parseProfileOption(d *caddyfile.Dispenser, existing any) (any, error) {
+	app := new(App)
+	if existing != nil {
+		prev, ok := existing.(httpcaddyfile.App)
+		if !ok {
+			return nil, d.Errf("existing wake_on_lan_profile value of unexpected type: %T", existing)
+		}
+		if err := json.Unmarshal(prev.Value, app); err != nil {
+			return nil, err
+		}
+	}
+	d.Next() // consume option name
+	name, profile, err := parseProfile(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := addProfile(d, app, name, profile); err != nil {
+		return nil, err
+	}
+	return appOption(app), nil
+}
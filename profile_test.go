@@ -0,0 +1,217 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestProfileOption(t *testing.T) {
+	tests := []struct {
+		name string
+		// one option per entry, parsed in order
+		inputs  []string
+		want    map[string]Profile
+		wantErr bool
+	}{
+		{
+			name:   "desktop",
+			inputs: []string{"wake_on_lan_profile desktop {\n\tbroadcast\n\trepeat 3\n}"},
+			want:   map[string]Profile{"desktop": {Defaults: Defaults{Repeat: 3}, Broadcast: "255.255.255.255"}},
+		},
+		{
+			name: "repeated",
+			inputs: []string{
+				"wake_on_lan_profile desktop {\n\tbroadcast 192.0.2.255\n}",
+				"wake_on_lan_profile server {\n\tprotocol tcp\n\tport 7\n}",
+			},
+			want: map[string]Profile{
+				"desktop": {Broadcast: "192.0.2.255"},
+				"server":  {Defaults: Defaults{Port: 7}, Protocol: protocolTCP},
+			},
+		},
+		{name: "defined twice", inputs: []string{"wake_on_lan_profile desktop {\n\trepeat 2\n}", "wake_on_lan_profile desktop {\n\trepeat 3\n}"}, wantErr: true},
+		{name: "no name", inputs: []string{"wake_on_lan_profile {\n\trepeat 2\n}"}, wantErr: true},
+		{name: "unknown protocol", inputs: []string{"wake_on_lan_profile desktop {\n\tprotocol sctp\n}"}, wantErr: true},
+		{name: "tcp broadcast", inputs: []string{"wake_on_lan_profile desktop {\n\tprotocol tcp\n\tbroadcast\n}"}, wantErr: true},
+		{name: "unknown", inputs: []string{"wake_on_lan_profile desktop {\n\tcheck 192.0.2.1:22\n}"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			var err error
+			for _, input := range tt.inputs {
+				if v, err = parseProfileOption(caddyfile.NewTestDispenser(input), v); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var app App
+			if err := json.Unmarshal(v.(httpcaddyfile.App).Value, &app); err != nil {
+				t.Fatal(err)
+			}
+			if len(app.Profiles) != len(tt.want) {
+				t.Fatalf("profiles %v, want %v", app.Profiles, tt.want)
+			}
+			for name, want := range tt.want {
+				if got, ok := app.Profiles[name]; !ok || *got != want {
+					t.Errorf("profile %s = %+v, want %+v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProfileApplied(t *testing.T) {
+	const app = `{
+		"defaults": {"port": 7, "repeat": 5},
+		"profiles": {
+			"desktop": {"broadcast": "192.0.2.255", "repeat": 3},
+			"server": {"protocol": "tcp", "port": 623, "interval": "2s"}
+		}
+	}`
+	tests := []struct {
+		name          string
+		w             *WakeOnLAN
+		wantBroadcast string
+		wantProtocol  string
+		wantPort      int
+		wantRepeat    int
+		wantInterval  time.Duration
+	}{
+		{
+			name:          "desktop",
+			w:             &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Profile: "desktop"},
+			wantBroadcast: "192.0.2.255",
+			wantPort:      7,
+			wantRepeat:    3,
+		},
+		{
+			name:         "server",
+			w:            &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Profile: "server"},
+			wantProtocol: protocolTCP,
+			wantPort:     623,
+			wantRepeat:   5,
+			wantInterval: 2 * time.Second,
+		},
+		{
+			name:          "handler overrides",
+			w:             &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Port: 9, Repeat: 1, Broadcast: "192.0.2.127", Profile: "desktop"},
+			wantBroadcast: "192.0.2.127",
+			wantPort:      9,
+			wantRepeat:    1,
+		},
+		{
+			name:          "handler broadcast shadows protocol",
+			w:             &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Broadcast: "192.0.2.127", Profile: "server"},
+			wantBroadcast: "192.0.2.127",
+			wantPort:      623,
+			wantRepeat:    5,
+			wantInterval:  2 * time.Second,
+		},
+		{
+			name:         "handler tcp shadows broadcast",
+			w:            &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Protocol: protocolTCP, Profile: "desktop"},
+			wantProtocol: protocolTCP,
+			wantPort:     7,
+			wantRepeat:   3,
+		},
+		{
+			name:         "transports shadow protocol",
+			w:            &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Transports: []string{protocolUDP}, Profile: "server"},
+			wantPort:     623,
+			wantRepeat:   5,
+			wantInterval: 2 * time.Second,
+		},
+		{
+			name:       "no profile",
+			w:          &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1"},
+			wantPort:   7,
+			wantRepeat: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := loadApp(t, app)
+			w := provisionIn(t, ctx, tt.w)
+			if w.Broadcast != tt.wantBroadcast || w.Protocol != tt.wantProtocol {
+				t.Errorf("broadcast %q, protocol %q; want %q, %q", w.Broadcast, w.Protocol, tt.wantBroadcast, tt.wantProtocol)
+			}
+			target := w.targets()[0]
+			if target.Port != tt.wantPort || target.Repeat != tt.wantRepeat || time.Duration(target.Interval) != tt.wantInterval {
+				t.Errorf("target port %d, repeat %d, interval %s; want %d, %d, %s",
+					target.Port, target.Repeat, time.Duration(target.Interval), tt.wantPort, tt.wantRepeat, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestProfileBroadcastWithoutIP(t *testing.T) {
+	// The IP a handler without one needs is only known once the profile is
+	// applied
+	adaptedHandlers(t, "{\n\twake_on_lan_profile lan {\n\t\tbroadcast 192.0.2.255\n\t}\n}\n:80 {\n\twake_on_lan "+testMAC+" {\n\t\tprofile lan\n\t}\n}")
+
+	ctx := loadApp(t, `{"profiles": {"lan": {"broadcast": "192.0.2.255"}, "server": {"port": 623}}}`)
+	w := provisionIn(t, ctx, &WakeOnLAN{MAC: testMAC, Profile: "lan"})
+	if w.Broadcast != "192.0.2.255" {
+		t.Errorf("broadcast %q, want the profile's", w.Broadcast)
+	}
+	w = &WakeOnLAN{MAC: testMAC, Profile: "server"}
+	if err := w.Provision(ctx); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	t.Cleanup(func() { w.Cleanup() })
+	if err := w.Validate(); err == nil {
+		t.Error("validated without an IP or a broadcast address")
+	}
+}
+
+func TestProfileUndefined(t *testing.T) {
+	ctx := loadApp(t, `{"profiles": {"desktop": {"repeat": 3}}}`)
+	w := &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Profile: "laptop"}
+	if err := w.Provision(ctx); err == nil {
+		w.Cleanup()
+		t.Fatal("provisioned with an undefined profile")
+	}
+}
+
+func TestProfileAppValidate(t *testing.T) {
+	config := `{"admin": {"disabled": true}, "apps": {"wake_on_lan": {"profiles": {"desktop": {"protocol": "sctp"}}}}}`
+	if err := caddy.Load([]byte(config), true); err == nil {
+		caddy.Stop()
+		t.Fatal("loaded a profile with an unknown protocol")
+	}
+}
+
+func TestServeHTTPProfile(t *testing.T) {
+	tests := []struct {
+		name   string
+		repeat int
+		want   int
+	}{
+		{name: "profile repeat", want: 3},
+		{name: "handler repeat", repeat: 1, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			ctx := loadApp(t, fmt.Sprintf(`{"profiles": {"desktop": {"port": %d, "repeat": 3}}}`, host.port()))
+			w := provisionIn(t, ctx, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Repeat: tt.repeat, Profile: "desktop"})
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			host.expect(t, tt.want)
+			host.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package caddy_wakeonlan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// defaultPublishTimeout bounds publishing one wake request when
+// send_timeout isn't set.
+const defaultPublishTimeout = 5 * time.Second
+
+// Publish hands wake requests to a message queue instead of sending
+// packets, for setups where a dedicated worker does the waking.
+type Publish struct {
+	// Name of the backend: "redis", "http" or one a plugin registered.
+	Backend string `json:"backend"`
+	// The backend's arguments, with Caddy's global placeholders such as
+	// {env.*}: for redis, the server's URL and the list's key; for http,
+	// the URL to POST to.
+	Args []string `json:"args,omitempty"`
+}
+
+// Publisher delivers a wake request, a JSON object, to a message queue.
+// Plugins register a constructor under a backend name with
+// RegisterPublisher, typically from an init function, and configs select
+// it in publish. Publish must return once the queue accepted the message
+// or ctx, bounded by send_timeout, is done.
+type Publisher interface {
+	Publish(ctx context.Context, message []byte) error
+}
+
+// NewPublisher returns the publisher for a handler's backend arguments, or
+// an error if they are invalid. It runs when the config loads and must not
+// connect to anything.
+type NewPublisher func(args []string) (Publisher, error)
+
+var publishers = struct {
+	sync.RWMutex
+	m map[string]NewPublisher
+}{m: make(map[string]NewPublisher)}
+
+func init() {
+	RegisterPublisher("redis", newRedisPublisher)
+	RegisterPublisher("http", newHTTPPublisher)
+}
+
+// RegisterPublisher makes newPublisher available as the publish backend
+// name. It panics if the name is empty or already registered, like
+// RegisterSender.
+func RegisterPublisher(name string, newPublisher NewPublisher) {
+	if name == "" || newPublisher == nil {
+		panic("wake_on_lan: publisher name and constructor required")
+	}
+	publishers.Lock()
+	defer publishers.Unlock()
+	if _, ok := publishers.m[name]; ok {
+		panic(fmt.Sprintf("wake_on_lan: publisher %q already registered", name))
+	}
+	publishers.m[name] = newPublisher
+}
+
+// newPublisher returns the publisher p configures, its arguments' global
+// placeholders replaced.
+func (p *Publish) newPublisher() (Publisher, error) {
+	publishers.RLock()
+	newPublisher, ok := publishers.m[p.Backend]
+	publishers.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown publish backend %q", p.Backend)
+	}
+	repl := caddy.NewReplacer()
+	args := make([]string, len(p.Args))
+	for i, arg := range p.Args {
+		args[i] = repl.ReplaceKnown(arg, "")
+	}
+	pub, err := newPublisher(args)
+	if err != nil {
+		return nil, fmt.Errorf("publish %s: %w", p.Backend, err)
+	}
+	return pub, nil
+}
+
+// validatePublish checks publish and the settings it depends on.
+func (w *WakeOnLAN) validatePublish() error {
+	if w.Publish == nil {
+		return nil
+	}
+	if w.relayed() || w.HelperSocket != "" || len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil {
+		return errors.New("publish cannot be combined with relay, helper_socket, escalate, send_until_up or broadcast_fallback")
+	}
+	_, err := w.Publish.newPublisher()
+	return err
+}
+
+// provisionPublish sets up the publisher.
+func (w *WakeOnLAN) provisionPublish() error {
+	if w.Publish == nil {
+		return nil
+	}
+	pub, err := w.Publish.newPublisher()
+	if err != nil {
+		return fmt.Errorf("wake_on_lan: %w", err)
+	}
+	w.publisher = pub
+	return nil
+}
+
+// wakeRequest is the message published for a target.
+type wakeRequest struct {
+	Target    string `json:"target"`
+	MAC       string `json:"mac"`
+	IP        string `json:"ip,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	SecureOn  string `json:"secureon,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// publish publishes the wake request for t, in place of sending packets.
+func (w *WakeOnLAN) publish(ctx context.Context, t Target, logger *zap.Logger) error {
+	message, err := json.Marshal(wakeRequest{
+		Target:    t.label(),
+		MAC:       t.MAC,
+		IP:        t.IP,
+		Port:      t.Port,
+		Interface: t.Interface,
+		SecureOn:  t.SecureOn,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(w.SendTimeout)
+	if timeout == 0 {
+		timeout = defaultPublishTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := w.publisher.Publish(ctx, message); err != nil {
+		return fmt.Errorf("publishing to %s: %w", w.Publish.Backend, err)
+	}
+	logger.Debug("wake request published", zap.String("backend", w.Publish.Backend))
+	return nil
+}
+
+// redisPublisher pushes wake requests onto a Redis list with LPUSH, for a
+// worker to take them off with BRPOP.
+type redisPublisher struct {
+	addr     string
+	username string
+	password string
+	db       int
+	key      string
+}
+
+// newRedisPublisher takes the server as redis://[user:password@]host[:port][/db]
+// and the key of the list.
+func newRedisPublisher(args []string) (Publisher, error) {
+	if len(args) != 2 {
+		return nil, errors.New("want the server's URL and the list's key")
+	}
+	u, err := url.Parse(args[0])
+	if err != nil || u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid server URL %q: want redis://[user:password@]host[:port][/db]", args[0])
+	}
+	p := &redisPublisher{addr: u.Host, key: args[1]}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		p.password, _ = u.User.Password()
+		if p.password == "" {
+			// redis://password@host, as some clients take it
+			p.password = u.User.Username()
+		} else {
+			p.username = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if p.db, err = strconv.Atoi(db); err != nil || p.db < 0 {
+			return nil, fmt.Errorf("invalid database %q in server URL", db)
+		}
+	}
+	if p.key == "" {
+		return nil, errors.New("empty list key")
+	}
+	return p, nil
+}
+
+// Publish connects for each message, rare as wakes are, so a restarted
+// server never leaves a stale connection behind.
+func (p *redisPublisher) Publish(ctx context.Context, message []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	r := bufio.NewReader(conn)
+	if p.password != "" {
+		args := []string{"AUTH", p.password}
+		if p.username != "" {
+			args = []string{"AUTH", p.username, p.password}
+		}
+		if err := redisCommand(conn, r, args...); err != nil {
+			return fmt.Errorf("AUTH: %w", err)
+		}
+	}
+	if p.db != 0 {
+		if err := redisCommand(conn, r, "SELECT", strconv.Itoa(p.db)); err != nil {
+			return fmt.Errorf("SELECT: %w", err)
+		}
+	}
+	if err := redisCommand(conn, r, "LPUSH", p.key, string(message)); err != nil {
+		return fmt.Errorf("LPUSH: %w", err)
+	}
+	return nil
+}
+
+// redisCommand sends a command in the Redis protocol and reads its reply,
+// returning the server's error if it replied with one.
+func redisCommand(w io.Writer, r *bufio.Reader, args ...string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case line == "":
+		return errors.New("empty reply")
+	case line[0] == '-':
+		return errors.New(line[1:])
+	case line[0] != '+' && line[0] != ':':
+		return fmt.Errorf("unexpected reply %q", line)
+	}
+	return nil
+}
+
+// httpPublisher POSTs wake requests to a URL, such as a queue's HTTP API
+// or a shim in front of one.
+type httpPublisher struct {
+	url string
+}
+
+// newHTTPPublisher takes the absolute http or https URL to POST to.
+func newHTTPPublisher(args []string) (Publisher, error) {
+	if len(args) != 1 {
+		return nil, errors.New("want the URL to POST to")
+	}
+	u, err := url.Parse(args[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("URL %q must be an absolute http or https URL", args[0])
+	}
+	return httpPublisher{url: args[0]}, nil
+}
+
+func (p httpPublisher) Publish(ctx context.Context, message []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package caddy_wakeonlan
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPublisher is a stub backend recording the messages published,
+// failing with err.
+type recordingPublisher struct {
+	mu       sync.Mutex
+	args     []string
+	messages [][]byte
+	err      error
+}
+
+func (p *recordingPublisher) Publish(_ context.Context, message []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, message)
+	return p.err
+}
+
+func (p *recordingPublisher) published() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]byte(nil), p.messages...)
+}
+
+// registerTestPublisher registers p under a backend name unique to the
+// test, as publishers can't be unregistered. The backend takes one
+// argument, recorded in p.
+func registerTestPublisher(t *testing.T, p *recordingPublisher) string {
+	t.Helper()
+	name := "test-" + strings.NewReplacer("/", "-", " ", "-").Replace(t.Name())
+	RegisterPublisher(name, func(args []string) (Publisher, error) {
+		if len(args) != 1 {
+			return nil, errors.New("want one argument")
+		}
+		p.args = args
+		return p, nil
+	})
+	return name
+}
+
+func TestRegisterPublisher(t *testing.T) {
+	newStub := func([]string) (Publisher, error) { return &recordingPublisher{}, nil }
+	tests := []struct {
+		name         string
+		newPublisher NewPublisher
+	}{
+		{name: "", newPublisher: newStub},
+		{name: "nil-constructor"},
+		{name: "redis", newPublisher: newStub},
+		{name: "http", newPublisher: newStub},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.name), func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterPublisher(%q) did not panic", tt.name)
+				}
+			}()
+			RegisterPublisher(tt.name, tt.newPublisher)
+		})
+	}
+}
+
+func TestPublishConfig(t *testing.T) {
+	t.Setenv("WOL_TEST_QUEUE", "wakes")
+	stub := &recordingPublisher{}
+	name := registerTestPublisher(t, stub)
+	tests := []struct {
+		input    string
+		want     Publish
+		wantArgs []string
+		wantErr  bool
+	}{
+		{input: "publish redis redis://192.0.2.10 wakes", want: Publish{Backend: "redis", Args: []string{"redis://192.0.2.10", "wakes"}}},
+		{input: "publish http https://queue.example.com/wakes", want: Publish{Backend: "http", Args: []string{"https://queue.example.com/wakes"}}},
+		{input: "publish " + name + " {env.WOL_TEST_QUEUE}", want: Publish{Backend: name, Args: []string{"{env.WOL_TEST_QUEUE}"}}, wantArgs: []string{"wakes"}},
+		{input: "publish", wantErr: true},
+		{input: "publish nats nats://192.0.2.10", wantErr: true},
+		{input: "publish redis redis://192.0.2.10", wantErr: true},
+		{input: "publish http /wakes", wantErr: true},
+		{input: "publish " + name, wantErr: true},
+		{input: "publish http https://queue.example.com/wakes\n\trelay 192.0.2.10:9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if w.Publish.Backend != tt.want.Backend || strings.Join(w.Publish.Args, " ") != strings.Join(tt.want.Args, " ") {
+				t.Errorf("publish = %+v, want %+v", *w.Publish, tt.want)
+			}
+			if tt.wantArgs != nil && strings.Join(stub.args, " ") != strings.Join(tt.wantArgs, " ") {
+				t.Errorf("backend arguments %q, want %q", stub.args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestNewRedisPublisher(t *testing.T) {
+	tests := []struct {
+		url     string
+		key     string
+		want    redisPublisher
+		wantErr bool
+	}{
+		{url: "redis://192.0.2.10", key: "wakes", want: redisPublisher{addr: "192.0.2.10:6379", key: "wakes"}},
+		{url: "redis://192.0.2.10:6380/2", key: "wakes", want: redisPublisher{addr: "192.0.2.10:6380", db: 2, key: "wakes"}},
+		{url: "redis://hunter2@queue.lan", key: "wakes", want: redisPublisher{addr: "queue.lan:6379", password: "hunter2", key: "wakes"}},
+		{
+			url:  "redis://wol:hunter2@[2001:db8::10]:6380",
+			key:  "wakes",
+			want: redisPublisher{addr: "[2001:db8::10]:6380", username: "wol", password: "hunter2", key: "wakes"},
+		},
+		{url: "http://192.0.2.10", key: "wakes", wantErr: true},
+		{url: "redis:///0", key: "wakes", wantErr: true},
+		{url: "redis://192.0.2.10/one", key: "wakes", wantErr: true},
+		{url: "redis://192.0.2.10/-1", key: "wakes", wantErr: true},
+		{url: "redis://192.0.2.10", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url+" "+tt.key, func(t *testing.T) {
+			p, err := newRedisPublisher([]string{tt.url, tt.key})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *p.(*redisPublisher) != tt.want {
+				t.Errorf("publisher %+v, want %+v", *p.(*redisPublisher), tt.want)
+			}
+		})
+	}
+	if _, err := newRedisPublisher([]string{"redis://192.0.2.10"}); err == nil {
+		t.Error("no error without a key")
+	}
+}
+
+// fakeRedis is a Redis server recording the commands it gets, answering
+// AUTH with password and the rest with +OK, or fail for LPUSH.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+	fail     string
+	mu       sync.Mutex
+	commands [][]string
+}
+
+func newFakeRedis(t *testing.T, password, fail string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln, password: password, fail: fail}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		cmd, err := readRESPArray(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+		reply := "+OK\r\n"
+		switch {
+		case cmd[0] == "AUTH" && cmd[len(cmd)-1] != s.password:
+			reply = "-WRONGPASS invalid password\r\n"
+		case cmd[0] == "LPUSH" && s.fail != "":
+			reply = "-" + s.fail + "\r\n"
+		case cmd[0] == "LPUSH":
+			reply = ":1\r\n"
+		}
+		io.WriteString(conn, reply)
+	}
+}
+
+func (s *fakeRedis) received() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.commands...)
+}
+
+// readRESPArray reads a command sent as an array of bulk strings.
+func readRESPArray(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "*"), "\r\n"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("not an array: %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "$"), "\r\n"))
+		if err != nil {
+			return nil, fmt.Errorf("not a bulk string: %q", line)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisPublisher(t *testing.T) {
+	tests := []struct {
+		name string
+		// the server's password, and the URL's userinfo and path
+		password, userinfo, path string
+		fail                     string
+		want                     []string
+		wantErr                  bool
+	}{
+		{name: "push", want: []string{"LPUSH wakes {}"}},
+		{name: "password", password: "hunter2", userinfo: "hunter2@", want: []string{"AUTH hunter2", "LPUSH wakes {}"}},
+		{name: "user", password: "hunter2", userinfo: "wol:hunter2@", want: []string{"AUTH wol hunter2", "LPUSH wakes {}"}},
+		{name: "database", path: "/3", want: []string{"SELECT 3", "LPUSH wakes {}"}},
+		{name: "wrong password", password: "hunter2", userinfo: "guess@", want: []string{"AUTH guess"}, wantErr: true},
+		{name: "push refused", fail: "WRONGTYPE not a list", want: []string{"LPUSH wakes {}"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeRedis(t, tt.password, tt.fail)
+			p, err := newRedisPublisher([]string{"redis://" + tt.userinfo + s.ln.Addr().String() + tt.path, "wakes"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+			defer cancel()
+			if err := p.Publish(ctx, []byte("{}")); (err != nil) != tt.wantErr {
+				t.Fatalf("Publish = %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, cmd := range s.received() {
+				got = append(got, strings.Join(cmd, " "))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("commands %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if err := (&redisPublisher{addr: fmt.Sprintf("127.0.0.1:%d", closedPort(t)), key: "wakes"}).Publish(t.Context(), []byte("{}")); err == nil {
+		t.Error("published to a server that isn't there")
+	}
+}
+
+func TestHTTPPublisher(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "accepted", status: http.StatusAccepted},
+		{name: "refused", status: http.StatusServiceUnavailable, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			var contentType string
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				got, _ = io.ReadAll(r.Body)
+				contentType = r.Header.Get("Content-Type")
+				rw.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			p, err := newHTTPPublisher([]string{srv.URL + "/wakes"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Publish(t.Context(), []byte(`{"target":"nas"}`)); (err != nil) != tt.wantErr {
+				t.Fatalf("Publish = %v, want error %v", err, tt.wantErr)
+			}
+			if string(got) != `{"target":"nas"}` || contentType != "application/json" {
+				t.Errorf("posted %q as %q", got, contentType)
+			}
+		})
+	}
+	for _, args := range [][]string{nil, {"/wakes"}, {"ftp://queue.lan/wakes"}, {"https://queue.lan", "extra"}} {
+		if _, err := newHTTPPublisher(args); err == nil {
+			t.Errorf("newHTTPPublisher(%q) accepted", args)
+		}
+	}
+}
+
+func TestServeHTTPPublish(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantResult wakeResult
+	}{
+		{name: "published", wantResult: resultSent},
+		{name: "failed", err: errors.New("queue full"), wantResult: resultSendFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			stub := &recordingPublisher{err: tt.err}
+			w := provisionTest(t, &WakeOnLAN{
+				Targets: []Target{{
+					Name:      "nas",
+					MAC:       testMAC,
+					IP:        "127.0.0.1",
+					Port:      host.port(),
+					SecureOn:  "01:02:03:04:05:06",
+					Interface: "lo",
+				}},
+				Publish:      &Publish{Backend: registerTestPublisher(t, stub), Args: []string{"queue"}},
+				StatusHeader: "X-Wake-Result",
+			})
+			before := time.Now().UTC().Truncate(time.Second)
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target=nas"; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			// Published in place of the packet
+			host.expectNone(t)
+
+			messages := stub.published()
+			if len(messages) != 1 {
+				t.Fatalf("published %d messages, want 1", len(messages))
+			}
+			var got wakeRequest
+			if err := json.Unmarshal(messages[0], &got); err != nil {
+				t.Fatalf("decoding %s: %v", messages[0], err)
+			}
+			want := wakeRequest{Target: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Interface: "lo", SecureOn: "01:02:03:04:05:06", Timestamp: got.Timestamp}
+			if got != want {
+				t.Errorf("published %+v, want %+v", got, want)
+			}
+			ts, err := time.Parse(time.RFC3339, got.Timestamp)
+			if err != nil || ts.Before(before) || ts.After(time.Now()) {
+				t.Errorf("timestamp %q, want the time of the request", got.Timestamp)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// QueryParams names the query parameters a from_query handler reads its
+// target from.
+type QueryParams struct {
+	// Parameter holding the MAC address. Default: mac.
+	MAC string `json:"mac,omitempty"`
+	// Parameter holding the IP or hostname. Default: ip.
+	IP string `json:"ip,omitempty"`
+	// Parameter holding the port. Default: port.
+	Port string `json:"port,omitempty"`
+}
+
+// names returns the parameter names with defaults filled in.
+func (q *QueryParams) names() (mac, ip, port string) {
+	mac, ip, port = q.MAC, q.IP, q.Port
+	if mac == "" {
+		mac = "mac"
+	}
+	if ip == "" {
+		ip = "ip"
+	}
+	if port == "" {
+		port = "port"
+	}
+	return mac, ip, port
+}
+
+// validate checks that the parameter names are distinct.
+func (q *QueryParams) validate() error {
+	mac, ip, port := q.names()
+	if mac == ip || mac == port || ip == port {
+		return fmt.Errorf("from_query parameters must be distinct, got %q, %q and %q", mac, ip, port)
+	}
+	return nil
+}
+
+// queryTarget builds the target named by the query string of r, checked
+// like a from_body entry. A missing or invalid parameter is a 400 and a MAC
+// outside allow_oui a 403.
+func (w *WakeOnLAN) queryTarget(r *http.Request) (Target, error) {
+	macParam, ipParam, portParam := w.FromQuery.names()
+	query := r.URL.Query()
+	entry := bulkRequestTarget{MAC: query.Get(macParam), IP: query.Get(ipParam)}
+	if entry.MAC == "" {
+		return Target{}, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: missing query parameter %q", macParam))
+	}
+	if s := query.Get(portParam); s != "" {
+		port, err := strconv.Atoi(s)
+		if err != nil {
+			return Target{}, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: invalid query parameter %q: %q", portParam, s))
+		}
+		entry.Port = port
+	}
+	t, err := w.bulkTarget(entry)
+	if err != nil {
+		if errors.Is(err, errOUINotAllowed) {
+			return Target{}, caddyhttp.Error(http.StatusForbidden, fmt.Errorf("wake_on_lan: %w", err))
+		}
+		if errors.Is(err, errMACIPMismatch) {
+			return Target{}, caddyhttp.Error(http.StatusConflict, fmt.Errorf("wake_on_lan: %w", err))
+		}
+		return Target{}, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: %w", err))
+	}
+	return t, nil
+}
+
+// parseFromQuery parses the from_query subdirective.
+func parseFromQuery(d *caddyfile.Dispenser) (*QueryParams, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	params := new(QueryParams)
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		var dest *string
+		switch d.Val() {
+		case "mac":
+			dest = &params.MAC
+		case "ip":
+			dest = &params.IP
+		case "port":
+			dest = &params.Port
+		default:
+			return nil, d.Errf("unrecognized from_query subdirective '%s'", d.Val())
+		}
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		*dest = d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	return params, nil
+}
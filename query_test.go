@@ -0,0 +1,75 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFromQueryConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    QueryParams
+		wantErr bool
+	}{
+		{name: "defaults", input: "from_query", want: QueryParams{}},
+		{name: "renamed", input: "from_query {\n\t\tmac hw\n\t\tport p\n\t}", want: QueryParams{MAC: "hw", Port: "p"}},
+		{name: "duplicate", input: "from_query {\n\t\tip mac\n\t}", wantErr: true},
+		{name: "unknown", input: "from_query {\n\t\thost h\n\t}", wantErr: true},
+		{name: "no name", input: "from_query {\n\t\tmac\n\t}", wantErr: true},
+		{name: "argument", input: "from_query yes", wantErr: true},
+		{name: "with from_body", input: "from_query\n\tfrom_body", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.FromQuery != tt.want {
+				t.Errorf("from_query = %+v, want %+v", *w.FromQuery, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPFromQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		params QueryParams
+		// query string, with {port} replaced by the fake host's port
+		query      string
+		wantStatus int
+	}{
+		{name: "valid", query: "mac=00:11:22:33:44:55&ip=127.0.0.1&port={port}", wantStatus: http.StatusNoContent},
+		{name: "renamed", params: QueryParams{MAC: "hw", IP: "host", Port: "p"}, query: "hw=00-11-22-33-44-55&host=127.0.0.1&p={port}", wantStatus: http.StatusNoContent},
+		{name: "missing mac", query: "ip=127.0.0.1&port={port}", wantStatus: http.StatusBadRequest},
+		{name: "renamed mac ignored", params: QueryParams{MAC: "hw"}, query: "mac=00:11:22:33:44:55&ip=127.0.0.1&port={port}", wantStatus: http.StatusBadRequest},
+		{name: "invalid mac", query: "mac=00:11:22:33:44&ip=127.0.0.1&port={port}", wantStatus: http.StatusBadRequest},
+		{name: "invalid port", query: "mac=00:11:22:33:44:55&ip=127.0.0.1&port=nine", wantStatus: http.StatusBadRequest},
+		{name: "port out of range", query: "mac=00:11:22:33:44:55&ip=127.0.0.1&port=70000", wantStatus: http.StatusBadRequest},
+		{name: "oui refused", query: "mac=aa:bb:cc:33:44:55&ip=127.0.0.1&port={port}", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			params := tt.params
+			w := provisionTest(t, &WakeOnLAN{FromQuery: &params, AllowOUI: []string{"00:11:22"}})
+			r := newTestRequest("GET", "http://example.com/wake?"+strings.ReplaceAll(tt.query, "{port}", strconv.Itoa(host.port())), nil)
+
+			rec, _, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if tt.wantStatus == http.StatusNoContent {
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+		})
+	}
+}
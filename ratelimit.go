@@ -0,0 +1,90 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// errRateLimited is returned for a wake skipped because the target's send
+// rate is exhausted.
+var errRateLimited = errors.New("send rate limit exceeded")
+
+// parseRate parses a rate like "10/min" into a limit. The unit is one of
+// s, min or h.
+func parseRate(s string) (rate.Limit, error) {
+	count, unit, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q: want <n>/<s|min|h>", s)
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q: count must be a positive number", s)
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "min":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return 0, fmt.Errorf("invalid rate %q: unknown unit %q", s, unit)
+	}
+	return rate.Limit(n / per.Seconds()), nil
+}
+
+// minRateSweep is the number of buckets rateLimiters holds before it first
+// drops the idle ones.
+const minRateSweep = 1024
+
+// rateLimiters holds a token bucket per target.
+type rateLimiters struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*rate.Limiter
+	// Number of buckets at which the idle ones are next dropped
+	sweepAt int
+}
+
+func newRateLimiters(limit rate.Limit, burst int) *rateLimiters {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiters{limit: limit, burst: burst, limiters: make(map[string]*rate.Limiter), sweepAt: minRateSweep}
+}
+
+// allow takes a token from the bucket of the target with the given key.
+func (r *rateLimiters) allow(key string) bool {
+	r.mu.Lock()
+	l, ok := r.limiters[key]
+	if !ok {
+		if len(r.limiters) >= r.sweepAt {
+			r.sweep(time.Now())
+		}
+		l = rate.NewLimiter(r.limit, r.burst)
+		r.limiters[key] = l
+	}
+	r.mu.Unlock()
+	return l.Allow()
+}
+
+// sweep drops the buckets that have refilled, which a new one would stand
+// in for unchanged, so targets taken from requests can't grow the map
+// without bound. The next sweep is put off until the map has doubled, to
+// keep allow amortized constant time. The caller holds r.mu.
+func (r *rateLimiters) sweep(now time.Time) {
+	for key, l := range r.limiters {
+		if l.TokensAt(now) >= float64(r.burst) {
+			delete(r.limiters, key)
+		}
+	}
+	r.sweepAt = max(2*len(r.limiters), minRateSweep)
+}
@@ -0,0 +1,107 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/time/rate"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    rate.Limit
+		wantErr bool
+	}{
+		{in: "2/s", want: 2},
+		{in: "30/min", want: 0.5},
+		{in: "36/h", want: 0.01},
+		{in: "10", wantErr: true},
+		{in: "0/s", wantErr: true},
+		{in: "x/s", wantErr: true},
+		{in: "1/day", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseRate(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRate(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseRate(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitersAllow(t *testing.T) {
+	r := newRateLimiters(rate.Every(time.Hour), 2)
+	for i, want := range []bool{true, true, false} {
+		if got := r.allow("a"); got != want {
+			t.Errorf("allow %d = %v, want %v", i+1, got, want)
+		}
+	}
+	if !r.allow("b") {
+		t.Error("another target shares the first one's bucket")
+	}
+}
+
+func TestRateLimitersSweep(t *testing.T) {
+	r := newRateLimiters(rate.Inf, 1)
+	for i := 0; i < 10*minRateSweep; i++ {
+		r.allow(strconv.Itoa(i))
+	}
+	// Every bucket refills at once, so none outlives a sweep for long
+	if n := len(r.limiters); n > minRateSweep {
+		t.Errorf("holding %d buckets, want at most %d", n, minRateSweep)
+	}
+
+	// A bucket still refilling is kept
+	r = newRateLimiters(rate.Every(time.Hour), 1)
+	r.allow("busy")
+	for i := 0; i < minRateSweep; i++ {
+		r.limiters[strconv.Itoa(i)] = rate.NewLimiter(r.limit, r.burst)
+	}
+	r.allow("new")
+	if _, ok := r.limiters["busy"]; !ok {
+		t.Error("a bucket out of tokens was dropped")
+	}
+	if r.allow("busy") {
+		t.Error("a sweep refilled a bucket")
+	}
+}
+
+func TestServeHTTPRateLimited(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Required: true, Rate: "1/h"})
+	for i, want := range []int{http.StatusNoContent, http.StatusTooManyRequests} {
+		rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		if got := statusOf(rec, err); got != want {
+			t.Errorf("request %d: status %d, want %d", i+1, got, want)
+		}
+	}
+	host.expect(t, 1)
+	host.expectNone(t)
+}
+
+func TestWakeRateAfterBudget(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Rate: "1/h", WakeBudget: 1})
+	target := w.targets()[0]
+
+	// A wake the budget refuses leaves the token to the next
+	r := newTestRequest("GET", "http://example.com/", nil)
+	caddyhttp.SetVar(r.Context(), budgetVar, &wakeBudget{})
+	for i, want := range []wakeResult{resultBudgetExhausted, resultSent, resultRateLimited} {
+		if i > 0 {
+			r = newTestRequest("GET", "http://example.com/", nil)
+			w.requestBudget(r)
+		}
+		if got, _ := w.wake(r.Context(), target, w.logger); got != want {
+			t.Errorf("wake %d = %s, want %s", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawEthernetSupported reports whether sendRawEthernet can work here.
+const rawEthernetSupported = true
+
+// sendRawEthernet broadcasts packet as a Wake-on-LAN frame on the named
+// interface. It needs CAP_NET_RAW.
+func sendRawEthernet(ifname string, packet []byte) error {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(etherTypeWOL)))
+	if err != nil {
+		return fmt.Errorf("opening raw socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(etherTypeWOL),
+		Ifindex:  iface.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+	}
+	return unix.Sendto(fd, packet, 0, addr)
+}
+
+// checkRawEthernet opens and binds a raw socket on the named interface,
+// as sendRawEthernet would, without sending anything.
+func checkRawEthernet(ifname string) error {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(etherTypeWOL)))
+	if err != nil {
+		return fmt.Errorf("opening raw socket: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(etherTypeWOL), Ifindex: iface.Index}); err != nil {
+		return fmt.Errorf("binding raw socket to %s: %w", ifname, err)
+	}
+	return nil
+}
+
+// htons converts v to network byte order.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
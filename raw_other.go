@@ -0,0 +1,16 @@
+//go:build !linux
+
+package caddy_wakeonlan
+
+// rawEthernetSupported reports whether sendRawEthernet can work here.
+const rawEthernetSupported = false
+
+// sendRawEthernet is not implemented on this platform.
+func sendRawEthernet(ifname string, packet []byte) error {
+	return errRawEthernetUnsupported
+}
+
+// checkRawEthernet has nothing to check: the transport is dropped here.
+func checkRawEthernet(ifname string) error {
+	return nil
+}
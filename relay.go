@@ -0,0 +1,196 @@
+package caddy_wakeonlan
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Wire formats spoken with a WOL relay.
+const (
+	// One line with the MAC; the relay answers with a line starting "OK".
+	relayProtocolLine = "line"
+	// One JSON object per line, {"mac": ..., "ip": ..., "port": ...}; the
+	// relay answers with {"ok": true} or {"ok": false, "error": ...}.
+	relayProtocolJSON = "json"
+)
+
+// How a wake uses several relays.
+const (
+	// Each in order until one accepts the wake.
+	relayFailover = "failover"
+	// All at once; the wake succeeds if any accepts it.
+	relayParallel = "parallel"
+)
+
+// relayRequest is the JSON line sent to a relay.
+type relayRequest struct {
+	MAC  string `json:"mac"`
+	IP   string `json:"ip,omitempty"`
+	Port int    `json:"port,omitempty"`
+}
+
+// relayResponse is the JSON line a relay answers with.
+type relayResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// relays returns the relays wakes are handed to, nil if none.
+func (w *WakeOnLAN) relays() []string {
+	if w.Relay != "" {
+		return []string{w.Relay}
+	}
+	return w.Relays
+}
+
+// relayed reports whether wakes are handed to a relay, the handler's or
+// those of the sites.
+func (w *WakeOnLAN) relayed() bool {
+	return w.Relay != "" || len(w.Relays) > 0 || len(w.Sites) > 0
+}
+
+// validateRelay checks the relay settings.
+func (w *WakeOnLAN) validateRelay() error {
+	if !w.relayed() {
+		if w.RelayProtocol != "" || w.RelayStrategy != "" {
+			return errors.New("relay_protocol and relay_strategy require a relay or site")
+		}
+		return nil
+	}
+	if w.Relay != "" && len(w.Relays) > 0 {
+		return errors.New("relay and relays cannot both be set")
+	}
+	relays := w.relays()
+	for i, relay := range relays {
+		if _, _, err := splitEndpoint(relay); err != nil {
+			return fmt.Errorf("relay: %w", err)
+		}
+		if slices.Contains(relays[:i], relay) {
+			return fmt.Errorf("relay %s listed twice", relay)
+		}
+	}
+	switch w.RelayProtocol {
+	case "", relayProtocolLine, relayProtocolJSON:
+	default:
+		return fmt.Errorf("unknown relay_protocol %q", w.RelayProtocol)
+	}
+	switch w.RelayStrategy {
+	case "", relayFailover, relayParallel:
+	default:
+		return fmt.Errorf("unknown relay_strategy %q: want failover or parallel", w.RelayStrategy)
+	}
+	if w.Broadcast != "" || w.Protocol != "" || len(w.Transports) > 0 {
+		return errors.New("relay and site cannot be combined with broadcast, protocol or transports")
+	}
+	return nil
+}
+
+// sendRelays hands the wake of hw to the relays, as the strategy says, and
+// returns the errors of every relay tried if none accepted it. Relays that
+// failed while another accepted the wake are logged.
+func sendRelays(ctx context.Context, hw net.HardwareAddr, t Target, opts sendOptions) error {
+	errs := make([]error, len(opts.Relays))
+	if opts.RelayStrategy == relayParallel {
+		var wg sync.WaitGroup
+		for i, relay := range opts.Relays {
+			recordDelivery(ctx, delivery{dest: relay, transport: "relay"})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = sendRelay(ctx, relay, opts.RelayProtocol, hw, t, opts.SendTimeout)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for i, relay := range opts.Relays {
+			recordDelivery(ctx, delivery{dest: relay, transport: "relay"})
+			if errs[i] = sendRelay(ctx, relay, opts.RelayProtocol, hw, t, opts.SendTimeout); errs[i] == nil {
+				errs = errs[:i+1]
+				break
+			}
+			if ctx.Err() != nil {
+				errs = errs[:i+1]
+				break
+			}
+		}
+	}
+
+	var failed []error
+	accepted := 0
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("relay %s: %w", opts.Relays[i], err))
+		} else {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		if len(failed) == 1 {
+			// A single relay fails as it always has
+			return deliveryError(errs[0])
+		}
+		return deliveryError(errors.Join(failed...))
+	}
+	if len(failed) > 0 && opts.RelayLogger != nil {
+		opts.RelayLogger.Warn("relays failed; the wake was accepted by another",
+			zap.Int("accepted", accepted), zap.Errors("failed", failed))
+	}
+	return nil
+}
+
+// sendRelay asks the relay at addr to wake hw, and for the JSON protocol
+// passes on the target's IP and port. timeout bounds the whole exchange.
+func sendRelay(ctx context.Context, addr, protocol string, hw net.HardwareAddr, t Target, timeout time.Duration) error {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	var line []byte
+	if protocol == relayProtocolJSON {
+		line, err = json.Marshal(relayRequest{MAC: hw.String(), IP: t.IP, Port: t.Port})
+		if err != nil {
+			return err
+		}
+	} else {
+		line = []byte(hw.String())
+	}
+	if _, err := conn.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && reply == "" {
+		return fmt.Errorf("reading relay response: %w", err)
+	}
+	reply = strings.TrimSpace(reply)
+	if protocol == relayProtocolJSON {
+		var resp relayResponse
+		if err := json.Unmarshal([]byte(reply), &resp); err != nil {
+			return fmt.Errorf("invalid relay response %q: %w", reply, err)
+		}
+		if !resp.OK {
+			return fmt.Errorf("relay refused: %s", resp.Error)
+		}
+		return nil
+	}
+	if !strings.HasPrefix(strings.ToUpper(reply), "OK") {
+		return fmt.Errorf("relay refused: %q", reply)
+	}
+	return nil
+}
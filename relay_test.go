@@ -0,0 +1,250 @@
+package caddy_wakeonlan
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubRelay is a WOL relay listener answering each line it reads with
+// reply, recording the lines.
+type stubRelay struct {
+	ln    net.Listener
+	lines chan string
+}
+
+// newStubRelay starts a relay; a reply of "" closes the connection without
+// answering.
+func newStubRelay(t *testing.T, reply func(line string) string) *stubRelay {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &stubRelay{ln: ln, lines: make(chan string, 16)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(2 * time.Second))
+				line, err := bufio.NewReader(c).ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimSuffix(line, "\n")
+				r.lines <- line
+				if answer := reply(line); answer != "" {
+					c.Write([]byte(answer + "\n"))
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return r
+}
+
+func (r *stubRelay) addr() string {
+	return r.ln.Addr().String()
+}
+
+// expect returns the next line the relay read.
+func (r *stubRelay) expect(t *testing.T) string {
+	t.Helper()
+	select {
+	case line := <-r.lines:
+		return line
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay got nothing")
+		return ""
+	}
+}
+
+func TestRelayConfig(t *testing.T) {
+	tests := []struct {
+		input        string
+		wantRelays   []string
+		wantProtocol string
+		wantStrategy string
+		wantErr      bool
+	}{
+		{input: "relay 192.0.2.9:4000", wantRelays: []string{"192.0.2.9:4000"}},
+		{input: "relay 192.0.2.9:4000\n\trelay_protocol json", wantRelays: []string{"192.0.2.9:4000"}, wantProtocol: relayProtocolJSON},
+		{input: "relay 192.0.2.9:4000\n\trelay_protocol line", wantRelays: []string{"192.0.2.9:4000"}, wantProtocol: relayProtocolLine},
+		{input: "relay 192.0.2.9:4000 192.0.2.10:4000", wantRelays: []string{"192.0.2.9:4000", "192.0.2.10:4000"}},
+		{input: "relay 192.0.2.9:4000\n\trelay 192.0.2.10:4000 192.0.2.11:4000", wantRelays: []string{"192.0.2.9:4000", "192.0.2.10:4000", "192.0.2.11:4000"}},
+		{input: "relay 192.0.2.9:4000 192.0.2.10:4000\n\trelay_strategy parallel", wantRelays: []string{"192.0.2.9:4000", "192.0.2.10:4000"}, wantStrategy: relayParallel},
+		{input: "relay 192.0.2.9:4000\n\trelay_strategy failover", wantRelays: []string{"192.0.2.9:4000"}, wantStrategy: relayFailover},
+		{input: "relay", wantErr: true},
+		{input: "relay 192.0.2.9:4000 192.0.2.9:4000", wantErr: true},
+		{input: "relay 192.0.2.9:4000 192.0.2.10", wantErr: true},
+		{input: "relay 192.0.2.9:4000\n\trelay_strategy random", wantErr: true},
+		{input: "relay 192.0.2.9:4000\n\trelay_strategy", wantErr: true},
+		{input: "relay_strategy parallel", wantErr: true},
+		{input: "relay 192.0.2.9", wantErr: true},
+		{input: "relay 192.0.2.9:4000\n\trelay_protocol xml", wantErr: true},
+		{input: "relay_protocol json", wantErr: true},
+		{input: "relay 192.0.2.9:4000\n\tbroadcast 192.0.2.255", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (!slices.Equal(w.relays(), tt.wantRelays) || w.RelayProtocol != tt.wantProtocol || w.RelayStrategy != tt.wantStrategy) {
+				t.Errorf("relays %v over %q, %q; want %v over %q, %q", w.relays(), w.RelayProtocol, w.RelayStrategy, tt.wantRelays, tt.wantProtocol, tt.wantStrategy)
+			}
+		})
+	}
+}
+
+func TestSendRelay(t *testing.T) {
+	hw, _ := parseMAC(testMAC)
+	target := Target{MAC: testMAC, IP: "192.0.2.1", Port: 9}
+	tests := []struct {
+		name     string
+		protocol string
+		reply    string
+		wantLine string
+		wantErr  bool
+	}{
+		{name: "line OK", protocol: relayProtocolLine, reply: "OK", wantLine: testMAC},
+		{name: "line ok with detail", protocol: relayProtocolLine, reply: "ok sent 1 packet", wantLine: testMAC},
+		{name: "line refused", protocol: relayProtocolLine, reply: "ERR unknown MAC", wantLine: testMAC, wantErr: true},
+		{name: "line no answer", protocol: relayProtocolLine, wantLine: testMAC, wantErr: true},
+		{name: "json ok", protocol: relayProtocolJSON, reply: `{"ok":true}`, wantLine: `{"mac":"00:11:22:33:44:55","ip":"192.0.2.1","port":9}`},
+		{name: "json refused", protocol: relayProtocolJSON, reply: `{"ok":false,"error":"busy"}`, wantLine: `{"mac":"00:11:22:33:44:55","ip":"192.0.2.1","port":9}`, wantErr: true},
+		{name: "json garbled", protocol: relayProtocolJSON, reply: "OK", wantLine: `{"mac":"00:11:22:33:44:55","ip":"192.0.2.1","port":9}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newStubRelay(t, func(string) string { return tt.reply })
+			err := sendRelay(t.Context(), relay.addr(), tt.protocol, hw, target, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sendRelay = %v, want error %v", err, tt.wantErr)
+			}
+			if got := relay.expect(t); got != tt.wantLine {
+				t.Errorf("relay got %q, want %q", got, tt.wantLine)
+			}
+		})
+	}
+
+	t.Run("nothing listening", func(t *testing.T) {
+		if err := sendRelay(t.Context(), fmt.Sprintf("127.0.0.1:%d", closedPort(t)), relayProtocolLine, hw, target, time.Second); err == nil {
+			t.Error("sendRelay to a closed port succeeded")
+		}
+	})
+}
+
+func TestValidateRelays(t *testing.T) {
+	w := &WakeOnLAN{MAC: testMAC, Relay: "192.0.2.9:4000", Relays: []string{"192.0.2.10:4000"}}
+	if err := w.Validate(); err == nil {
+		t.Error("relay and relays both set validated")
+	}
+}
+
+func TestSendRelays(t *testing.T) {
+	hw, _ := parseMAC(testMAC)
+	target := Target{MAC: testMAC, IP: "192.0.2.1"}
+	accepting := func(string) string { return "OK" }
+	refusing := func(string) string { return "ERR busy" }
+	tests := []struct {
+		name     string
+		strategy string
+		// how each relay answers, nil for nothing listening
+		replies []func(string) string
+		// whether each relay is asked
+		wantAsked  []bool
+		wantErr    bool
+		wantWarned bool
+	}{
+		{name: "failover, first accepts", replies: []func(string) string{accepting, accepting}, wantAsked: []bool{true, false}},
+		{name: "failover, second accepts", replies: []func(string) string{refusing, accepting}, wantAsked: []bool{true, true}, wantWarned: true},
+		{name: "failover, one down", strategy: relayFailover, replies: []func(string) string{nil, accepting}, wantAsked: []bool{false, true}, wantWarned: true},
+		{name: "failover, none accepts", replies: []func(string) string{refusing, refusing}, wantAsked: []bool{true, true}, wantErr: true},
+		{name: "parallel, all accept", strategy: relayParallel, replies: []func(string) string{accepting, accepting}, wantAsked: []bool{true, true}},
+		{name: "parallel, one accepts", strategy: relayParallel, replies: []func(string) string{refusing, accepting}, wantAsked: []bool{true, true}, wantWarned: true},
+		{name: "parallel, none accepts", strategy: relayParallel, replies: []func(string) string{refusing, nil}, wantAsked: []bool{true, false}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubs := make([]*stubRelay, len(tt.replies))
+			addrs := make([]string, len(tt.replies))
+			for i, reply := range tt.replies {
+				if reply == nil {
+					addrs[i] = fmt.Sprintf("127.0.0.1:%d", closedPort(t))
+					continue
+				}
+				stubs[i] = newStubRelay(t, reply)
+				addrs[i] = stubs[i].addr()
+			}
+			w := &WakeOnLAN{}
+			logs := observeLogs(w)
+			err := sendRelays(t.Context(), hw, target, sendOptions{Relays: addrs, RelayStrategy: tt.strategy, SendTimeout: time.Second, RelayLogger: w.logger})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendRelays = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				for _, addr := range addrs {
+					if !strings.Contains(err.Error(), "relay "+addr) {
+						t.Errorf("error %q doesn't name relay %s", err, addr)
+					}
+				}
+			}
+			for i, stub := range stubs {
+				if stub == nil || !tt.wantAsked[i] {
+					continue
+				}
+				stub.expect(t)
+			}
+			time.Sleep(50 * time.Millisecond)
+			for i, stub := range stubs {
+				if stub != nil && !tt.wantAsked[i] && len(stub.lines) > 0 {
+					t.Errorf("relay %d asked, want it left alone", i)
+				}
+			}
+			if warned := logs.FilterMessageSnippet("relays failed").Len() > 0; warned != tt.wantWarned {
+				t.Errorf("warned %v, want %v", warned, tt.wantWarned)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRelay(t *testing.T) {
+	tests := []struct {
+		protocol   string
+		reply      string
+		wantLine   string
+		wantStatus int
+	}{
+		{protocol: relayProtocolLine, reply: "OK", wantLine: testMAC, wantStatus: http.StatusNoContent},
+		{protocol: relayProtocolLine, reply: "ERR", wantLine: testMAC, wantStatus: http.StatusBadGateway},
+		{protocol: relayProtocolJSON, reply: `{"ok":true}`, wantLine: `{"mac":"00:11:22:33:44:55","ip":"192.0.2.1"}`, wantStatus: http.StatusNoContent},
+		{protocol: relayProtocolJSON, reply: `{"ok":false,"error":"busy"}`, wantLine: `{"mac":"00:11:22:33:44:55","ip":"192.0.2.1"}`, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol+" "+tt.reply, func(t *testing.T) {
+			relay := newStubRelay(t, func(string) string { return tt.reply })
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Relay: relay.addr(), RelayProtocol: tt.protocol, Required: true})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if got := relay.expect(t); got != tt.wantLine {
+				t.Errorf("relay got %q, want %q", got, tt.wantLine)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Request variables describing the outcome of the handler's wakes, for
+// the handlers after it and placeholders like
+// {http.vars.wake_on_lan.result}.
+const (
+	// The result of the first target that failed, or else of the first
+	// target.
+	varResult = "wake_on_lan.result"
+	// The name of that target.
+	varTarget = "wake_on_lan.target"
+	// That target's error message, empty if it has none.
+	varError = "wake_on_lan.error"
+	// Every target's outcome as <name>=<result>, space-separated.
+	varResults = "wake_on_lan.results"
+)
+
+// Fields access_log_fields adds to the request's access log entry.
+const (
+	logFieldTarget = "wake_on_lan_target"
+	logFieldResult = "wake_on_lan_result"
+	logFieldError  = "wake_on_lan_error"
+)
+
+// setResultVars sets the result variables of r from the outcomes of
+// waking targets, replacing those of an earlier pass, and with
+// access_log_fields the access log fields.
+func (w *WakeOnLAN) setResultVars(r *http.Request, targets []Target, results []wakeResult, errs []error) {
+	if len(targets) == 0 {
+		return
+	}
+	first := 0
+	for i := range targets {
+		if errs[i] != nil && results[i].failed() {
+			first = i
+			break
+		}
+	}
+	all := make([]string, len(targets))
+	for i, t := range targets {
+		all[i] = t.label() + "=" + string(results[i])
+	}
+	msg := ""
+	if errs[first] != nil {
+		msg = errs[first].Error()
+	}
+	ctx := r.Context()
+	caddyhttp.SetVar(ctx, varResult, string(results[first]))
+	caddyhttp.SetVar(ctx, varTarget, targets[first].label())
+	caddyhttp.SetVar(ctx, varError, msg)
+	caddyhttp.SetVar(ctx, varResults, strings.Join(all, " "))
+	if w.RetriableStatus != 0 {
+		caddyhttp.SetVar(ctx, varRetriable, "")
+	}
+	if w.AccessLogFields {
+		setLogFields(r, targets[first].label(), results[first], msg)
+	}
+}
+
+// setLogFields adds the outcome of a target to r's access log entry,
+// replacing that of an earlier pass. Requests Caddy doesn't log have no
+// entry to add them to.
+func setLogFields(r *http.Request, target string, result wakeResult, msg string) {
+	extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields)
+	if !ok {
+		return
+	}
+	extra.Set(zap.String(logFieldTarget, target))
+	extra.Set(zap.String(logFieldResult, string(result)))
+	extra.Set(zap.String(logFieldError, msg))
+}
+
+// errorBody is the JSON body written for a required failure with
+// JSONErrors set.
+type errorBody struct {
+	Error  string `json:"error"`
+	Detail string `json:"detail"`
+	// Every member's outcome when a group failed
+	Members []groupMember `json:"members,omitempty"`
+	// Whether retriable_status reported the failure as worth retrying
+	Retriable bool `json:"retriable,omitempty"`
+}
+
+// fail ends the request for a required failure. By default it returns the
+// error for Caddy's error handling; with JSONErrors it writes the error as
+// a JSON body itself, identified by code.
+func (w *WakeOnLAN) fail(rw http.ResponseWriter, status int, code string, err error) error {
+	if !w.JSONErrors {
+		return caddyhttp.Error(status, err)
+	}
+	eb := errorBody{Error: code, Detail: err.Error(), Retriable: errors.Is(err, errRetriable)}
+	var groupErr *groupError
+	if errors.As(err, &groupErr) {
+		eb.Members = groupErr.members
+	}
+	body, _ := json.Marshal(eb)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, err = rw.Write(body)
+	return err
+}
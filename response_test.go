@@ -0,0 +1,316 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestJSONErrorsConfig(t *testing.T) {
+	w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\trequired\n\tjson_errors\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.JSONErrors {
+		t.Error("json_errors not set")
+	}
+	if _, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tjson_errors yes\n}"); err == nil {
+		t.Error("json_errors with an argument parsed")
+	}
+}
+
+func TestServeHTTPJSONErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		w          func(t *testing.T) *WakeOnLAN
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name: "send failed",
+			w: func(t *testing.T) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: closedPort(t), Protocol: protocolTCP}
+			},
+			wantStatus: http.StatusBadGateway,
+			wantError:  string(resultSendFailed),
+		},
+		{
+			name:       "MAC resolution",
+			w:          func(*testing.T) *WakeOnLAN { return &WakeOnLAN{MAC: autoMAC, IP: "192.0.2.77"} },
+			wantStatus: http.StatusInternalServerError,
+			wantError:  string(resultMACResolveFailed),
+		},
+		{
+			name: "client not allowed",
+			w: func(*testing.T) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", AllowFrom: []string{"10.0.0.0/8"}}
+			},
+			wantStatus: http.StatusForbidden,
+			wantError:  "client_not_allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tt.w(t)
+			w.Required = true
+			w.JSONErrors = true
+			w = provisionTest(t, w)
+			r := newTestRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			rec, called, err := serveTest(w, r)
+			if err != nil {
+				t.Fatalf("ServeHTTP returned %v, want the error written as JSON", err)
+			}
+			if called {
+				t.Error("next handler called")
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type %q, want application/json", ct)
+			}
+			var body map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q: %v", rec.Body, err)
+			}
+			if body["error"] != tt.wantError {
+				t.Errorf("error %v, want %q", body["error"], tt.wantError)
+			}
+			if detail, _ := body["detail"].(string); detail == "" {
+				t.Errorf("no detail in %s", rec.Body)
+			}
+			if len(body) != 2 {
+				t.Errorf("body %s has fields other than error and detail", rec.Body)
+			}
+		})
+	}
+}
+
+func TestServeHTTPPlainErrors(t *testing.T) {
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: closedPort(t), Protocol: protocolTCP, Required: true})
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusBadGateway {
+		t.Errorf("ServeHTTP = %v, want a 502 handler error", err)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("wrote body %q; Caddy's error handling writes it", rec.Body)
+	}
+}
+
+// varRecorder is a next handler recording the result variables it sees.
+type varRecorder struct {
+	vars map[string]any
+}
+
+func (v *varRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) error {
+	v.vars = make(map[string]any)
+	for _, name := range []string{varResult, varTarget, varError, varResults} {
+		v.vars[name] = caddyhttp.GetVar(r.Context(), name)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func TestServeHTTPResultVars(t *testing.T) {
+	host := newFakeHost(t)
+	up := newTCPHost(t)
+	closed := closedPort(t)
+	tests := []struct {
+		name     string
+		w        *WakeOnLAN
+		wantNext bool
+		want     map[string]any
+		// whether the error variable is set, its message varying
+		wantError bool
+	}{
+		{
+			name:     "sent",
+			w:        &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port()},
+			wantNext: true,
+			want:     map[string]any{varResult: "sent", varTarget: testMAC, varResults: testMAC + "=sent"},
+		},
+		{
+			name:     "already up",
+			w:        &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Check: up.addr()},
+			wantNext: true,
+			want:     map[string]any{varResult: "already_up", varTarget: testMAC, varResults: testMAC + "=already_up"},
+		},
+		{
+			name:      "failed",
+			w:         &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: closed, Protocol: protocolTCP},
+			wantNext:  true,
+			want:      map[string]any{varResult: "send_failed", varTarget: testMAC, varResults: testMAC + "=send_failed"},
+			wantError: true,
+		},
+		{
+			name: "first failure",
+			w: &WakeOnLAN{Protocol: protocolTCP, Targets: []Target{
+				{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: up.ln.Addr().(*net.TCPAddr).Port},
+				{Name: "desktop", MAC: "00:11:22:aa:bb:cc", IP: "127.0.0.1", Port: closed},
+			}},
+			wantNext:  true,
+			want:      map[string]any{varResult: "send_failed", varTarget: "desktop", varResults: "nas=sent desktop=send_failed"},
+			wantError: true,
+		},
+		{
+			// Set before the error reaches handle_errors
+			name:      "required failure",
+			w:         &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: closed, Protocol: protocolTCP, Required: true},
+			want:      map[string]any{varResult: "send_failed", varTarget: testMAC, varResults: testMAC + "=send_failed"},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, tt.w)
+			r := newTestRequest("GET", "http://example.com/", nil)
+			next := new(varRecorder)
+			err := w.ServeHTTP(httptest.NewRecorder(), r, next)
+			if (next.vars != nil) != tt.wantNext {
+				t.Fatalf("next handler called: %v, want %v (%v)", next.vars != nil, tt.wantNext, err)
+			}
+			got := next.vars
+			if got == nil {
+				got = make(map[string]any)
+				for _, name := range []string{varResult, varTarget, varError, varResults} {
+					got[name] = caddyhttp.GetVar(r.Context(), name)
+				}
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s = %v, want %v", name, got[name], want)
+				}
+			}
+			if msg, _ := got[varError].(string); (msg != "") != tt.wantError {
+				t.Errorf("%s = %q, want it set: %v", varError, msg, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestAccessLogFieldsConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "access_log_fields"},
+		{input: "access_log_fields yes", wantErr: true},
+		{input: "access_log_fields\n\tafter_response", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.AccessLogFields {
+				t.Error("access_log_fields not set")
+			}
+		})
+	}
+}
+
+// logFields returns the string fields added to extra, which caddyhttp
+// doesn't export.
+func logFields(extra *caddyhttp.ExtraLogFields) map[string]string {
+	fields := reflect.ValueOf(extra).Elem().FieldByName("fields")
+	got := make(map[string]string)
+	for i := range fields.Len() {
+		f := fields.Index(i)
+		got[f.FieldByName("Key").String()] = f.FieldByName("String").String()
+	}
+	return got
+}
+
+func TestServeHTTPAccessLogFields(t *testing.T) {
+	host := newFakeHost(t)
+	closed := closedPort(t)
+	tests := []struct {
+		name string
+		w    *WakeOnLAN
+		// the target and result logged
+		wantTarget, wantResult string
+		wantError              bool
+	}{
+		{
+			name:       "sent",
+			w:          &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), AccessLogFields: true},
+			wantTarget: testMAC, wantResult: "sent",
+		},
+		{
+			name: "first failure",
+			w: &WakeOnLAN{Protocol: protocolTCP, AccessLogFields: true, Targets: []Target{
+				{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: newTCPHost(t).port()},
+				{Name: "desktop", MAC: "00:11:22:aa:bb:cc", IP: "127.0.0.1", Port: closed},
+			}},
+			wantTarget: "desktop", wantResult: "send_failed", wantError: true,
+		},
+		{
+			name: "off",
+			w:    &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, tt.w)
+			extra := new(caddyhttp.ExtraLogFields)
+			r := newTestRequest("GET", "http://example.com/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.ExtraLogFieldsCtxKey, extra))
+			if _, _, err := serveTest(w, r); err != nil {
+				t.Fatal(err)
+			}
+			if w.Port == host.port() {
+				host.expect(t, 1)
+			}
+			got := logFields(extra)
+			if tt.wantResult == "" {
+				if len(got) > 0 {
+					t.Errorf("logged %v, want nothing", got)
+				}
+				return
+			}
+			if got[logFieldTarget] != tt.wantTarget || got[logFieldResult] != tt.wantResult || (got[logFieldError] != "") != tt.wantError {
+				t.Errorf("logged %v, want target %s, result %s, error set: %v", got, tt.wantTarget, tt.wantResult, tt.wantError)
+			}
+		})
+	}
+
+	t.Run("bulk", func(t *testing.T) {
+		w := provisionTest(t, &WakeOnLAN{FromBody: true, AllowOUI: []string{"00:11:22"}, AccessLogFields: true})
+		body := fmt.Sprintf(`[{"mac":%q,"ip":"127.0.0.1","port":%[3]d},{"mac":%[2]q,"ip":"127.0.0.1","port":%[3]d}]`, testMAC, "aa:bb:cc:dd:ee:ff", host.port())
+		extra := new(caddyhttp.ExtraLogFields)
+		r := newTestRequest("POST", "http://example.com/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.ExtraLogFieldsCtxKey, extra))
+		if _, _, err := serveTest(w, r); err != nil {
+			t.Fatal(err)
+		}
+		host.expect(t, 1)
+		if got := logFields(extra); got[logFieldResult] != string(resultForbidden) || got[logFieldTarget] != "aa:bb:cc:dd:ee:ff" {
+			t.Errorf("logged %v, want the refused entry", got)
+		}
+	})
+
+	t.Run("not logged", func(t *testing.T) {
+		// Without an access log entry there is nothing to add to
+		w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), AccessLogFields: true})
+		if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		host.expect(t, 1)
+	})
+}
@@ -0,0 +1,131 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultResponseDelayMax is the longest response_delay until_up holds the
+// response by default.
+const defaultResponseDelayMax = 30 * time.Second
+
+// ResponseDelay holds the response back once packets were sent, so a
+// respond or redir after the handler doesn't send the browser to a host
+// still booting. Unlike wait, it neither confirms the wake nor changes
+// its result: it only decides when the next handler runs.
+type ResponseDelay struct {
+	// How long to hold the response; with UntilUp, the most to hold it.
+	// Default with UntilUp: 30s.
+	Duration caddy.Duration `json:"duration,omitempty"`
+	// If set, the response is held until the check address of every
+	// target sent to accepts a connection, or Duration passes.
+	UntilUp bool `json:"until_up,omitempty"`
+}
+
+// maxDelay returns the longest the response is held.
+func (d *ResponseDelay) maxDelay() time.Duration {
+	if d.UntilUp && d.Duration == 0 {
+		return defaultResponseDelayMax
+	}
+	return time.Duration(d.Duration)
+}
+
+// validateResponseDelay checks response_delay and the settings it depends
+// on.
+func (w *WakeOnLAN) validateResponseDelay() error {
+	d := w.ResponseDelay
+	if d == nil {
+		return nil
+	}
+	switch {
+	case d.Duration < 0 || (!d.UntilUp && d.Duration == 0):
+		return fmt.Errorf("invalid response_delay %s", time.Duration(d.Duration))
+	case w.AfterResponse || w.WaitingPage != nil:
+		return errors.New("response_delay cannot be combined with after_response or waiting_page")
+	}
+	if !d.UntilUp {
+		return nil
+	}
+	for _, t := range w.allTargets() {
+		if t.Check == "" {
+			return fmt.Errorf("target %s: response_delay until_up requires a check address", t.label())
+		}
+	}
+	return nil
+}
+
+// delayResponse holds the request, once packets were sent to any of
+// targets, for the response delay or, with until_up, until those targets
+// are up. It returns early if the client goes away.
+func (w *WakeOnLAN) delayResponse(r *http.Request, targets []Target, results []wakeResult, logger *zap.Logger) {
+	d := w.ResponseDelay
+	if d == nil {
+		return
+	}
+	var booting []Target
+	for i, t := range targets {
+		switch results[i] {
+		case resultSent, resultAckReceived, resultTXConfirmed, resultWakeTimeout:
+			booting = append(booting, t)
+		case resultWoken:
+			// Already confirmed up; only a fixed delay still applies
+			if !d.UntilUp {
+				booting = append(booting, t)
+			}
+		}
+	}
+	if len(booting) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d.maxDelay())
+	defer cancel()
+	start := time.Now()
+	if !d.UntilUp {
+		_ = sleepCtx(ctx, d.maxDelay())
+	} else {
+		checkTimeout := time.Duration(w.CheckTimeout)
+		var wg sync.WaitGroup
+		for _, t := range booting {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				waitTCP(ctx, t.Check, checkTimeout, d.maxDelay())
+			}()
+		}
+		wg.Wait()
+	}
+	logger.Debug("response delayed", zap.Duration("delay", time.Since(start)),
+		zap.Bool("until_up", d.UntilUp), zap.Bool("client_gone", r.Context().Err() != nil))
+}
+
+// parseResponseDelay parses the arguments of response_delay: a duration,
+// or until_up and optionally the most to wait.
+func parseResponseDelay(d *caddyfile.Dispenser) (*ResponseDelay, error) {
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	delay := new(ResponseDelay)
+	if args[0] == "until_up" {
+		delay.UntilUp = true
+		args = args[1:]
+	} else if len(args) > 1 {
+		return nil, d.ArgErr()
+	}
+	if len(args) == 1 {
+		dur, err := caddy.ParseDuration(args[0])
+		if err != nil {
+			return nil, d.Errf("invalid response_delay duration %q: %v", args[0], err)
+		}
+		delay.Duration = caddy.Duration(dur)
+	}
+	return delay, nil
+}
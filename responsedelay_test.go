@@ -0,0 +1,128 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestResponseDelayConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ResponseDelay
+		wantMax time.Duration
+		wantErr bool
+	}{
+		{input: "response_delay 20s", want: ResponseDelay{Duration: caddy.Duration(20 * time.Second)}, wantMax: 20 * time.Second},
+		{input: "check 192.0.2.1:22\n\tresponse_delay until_up", want: ResponseDelay{UntilUp: true}, wantMax: defaultResponseDelayMax},
+		{
+			input:   "check 192.0.2.1:22\n\tresponse_delay until_up 1m",
+			want:    ResponseDelay{Duration: caddy.Duration(time.Minute), UntilUp: true},
+			wantMax: time.Minute,
+		},
+		{input: "response_delay", wantErr: true},
+		{input: "response_delay 0s", wantErr: true},
+		{input: "response_delay -1s", wantErr: true},
+		{input: "response_delay soon", wantErr: true},
+		{input: "response_delay 20s 30s", wantErr: true},
+		{input: "check 192.0.2.1:22\n\tresponse_delay until_up 1m 2m", wantErr: true},
+		{input: "response_delay until_up", wantErr: true},
+		{input: "response_delay 20s\n\tafter_response", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if *w.ResponseDelay != tt.want {
+				t.Errorf("response_delay = %+v, want %+v", *w.ResponseDelay, tt.want)
+			}
+			if got := w.ResponseDelay.maxDelay(); got != tt.wantMax {
+				t.Errorf("longest delay %s, want %s", got, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestServeHTTPResponseDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay ResponseDelay
+		// when the check address comes up, negative for never
+		upAfter time.Duration
+		// when the client goes away, 0 for never
+		leaveAfter time.Duration
+		// the TCP send fails, so there is nothing to wait for
+		sendFails        bool
+		wantMin, wantMax time.Duration
+	}{
+		{name: "fixed", delay: ResponseDelay{Duration: caddy.Duration(600 * time.Millisecond)}, upAfter: -1, wantMin: 600 * time.Millisecond, wantMax: 1200 * time.Millisecond},
+		{name: "until up", delay: ResponseDelay{Duration: caddy.Duration(3 * time.Second), UntilUp: true}, upAfter: 700 * time.Millisecond, wantMin: 700 * time.Millisecond, wantMax: 2 * time.Second},
+		{name: "until up capped", delay: ResponseDelay{Duration: caddy.Duration(800 * time.Millisecond), UntilUp: true}, upAfter: -1, wantMin: 800 * time.Millisecond, wantMax: 1500 * time.Millisecond},
+		{name: "already up", delay: ResponseDelay{Duration: caddy.Duration(3 * time.Second), UntilUp: true}, wantMax: 500 * time.Millisecond},
+		{
+			name:       "fixed client gone",
+			delay:      ResponseDelay{Duration: caddy.Duration(3 * time.Second)},
+			upAfter:    -1,
+			leaveAfter: 300 * time.Millisecond,
+			wantMin:    300 * time.Millisecond,
+			wantMax:    time.Second,
+		},
+		{
+			name:       "until up client gone",
+			delay:      ResponseDelay{Duration: caddy.Duration(3 * time.Second), UntilUp: true},
+			upAfter:    -1,
+			leaveAfter: 300 * time.Millisecond,
+			wantMin:    300 * time.Millisecond,
+			wantMax:    time.Second,
+		},
+		{name: "nothing sent", delay: ResponseDelay{Duration: caddy.Duration(3 * time.Second)}, upAfter: -1, sendFails: true, wantMax: 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			checkPort := closedPort(t)
+			delay := tt.delay
+			w := &WakeOnLAN{
+				MAC:           testMAC,
+				IP:            "127.0.0.1",
+				Port:          host.port(),
+				Check:         fmt.Sprintf("127.0.0.1:%d", checkPort),
+				CheckTimeout:  caddy.Duration(200 * time.Millisecond),
+				ResponseDelay: &delay,
+			}
+			if tt.sendFails {
+				w.Protocol, w.Port = protocolTCP, closedPort(t)
+			}
+			provisionTest(t, w)
+			listenAfter(t, checkPort, tt.upAfter)
+
+			r := newTestRequest("GET", "http://example.com/", nil)
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			if tt.leaveAfter > 0 {
+				time.AfterFunc(tt.leaveAfter, cancel)
+			}
+			start := time.Now()
+			rec, called, err := serveTest(w, r.WithContext(ctx))
+			took := time.Since(start)
+			if got := statusOf(rec, err); got != http.StatusNoContent || !called {
+				t.Errorf("status %d, next called %v; want %d and called (%v)", got, called, http.StatusNoContent, err)
+			}
+			if took < tt.wantMin || took > tt.wantMax {
+				t.Errorf("next handler ran after %s, want between %s and %s", took, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// errRetriable marks a failure retriable_status reports as worth running
+// the wake again for, the message handle_errors routes can match.
+var errRetriable = errors.New("wake_on_lan: retriable wake failure")
+
+// varRetriable is the request variable set to "true" when the handler
+// failed the request with retriable_status, and emptied when a later pass
+// of it wakes its targets.
+const varRetriable = "wake_on_lan.retriable"
+
+// retriable reports whether a wake that ended with r may succeed if run
+// again: the packet couldn't be sent or the host didn't come up, as
+// opposed to wakes refused by a limit, the authorize route or the
+// configuration.
+func (r wakeResult) retriable() bool {
+	switch r {
+	case resultSendFailed, resultMACResolveFailed, resultBusy, resultWakeTimeout, resultGroupFailed, resultDependencyDown:
+		return true
+	}
+	return false
+}
+
+// validateRetriable checks retriable_status and retriable_delay.
+func (w *WakeOnLAN) validateRetriable() error {
+	switch {
+	case w.RetriableStatus == 0 && w.RetriableDelay != 0:
+		return errors.New("retriable_delay requires retriable_status")
+	case w.RetriableStatus != 0 && (w.RetriableStatus < 400 || w.RetriableStatus > 599):
+		return fmt.Errorf("invalid retriable_status %d: must be a 4xx or 5xx status", w.RetriableStatus)
+	case w.RetriableDelay < 0:
+		return fmt.Errorf("invalid retriable_delay %s", time.Duration(w.RetriableDelay))
+	case w.RetriableStatus != 0 && w.AfterResponse:
+		return errors.New("retriable_status cannot be combined with after_response, which never fails the request")
+	}
+	return nil
+}
+
+// failWake ends the request for a wake that failed it with failure. With
+// retriable_status, a failure running the wake again may fix gets that
+// status instead of its own and an error wrapping errRetriable, marked in
+// the wake_on_lan.retriable variable, after waiting retriable_delay so a
+// handle_errors route running the wake again right away is paced.
+func (w *WakeOnLAN) failWake(rw http.ResponseWriter, r *http.Request, failure wakeResult, err error) error {
+	if w.RetriableStatus == 0 || !failure.retriable() {
+		return w.fail(rw, failure.status(), string(failure), err)
+	}
+	caddyhttp.SetVar(r.Context(), varRetriable, "true")
+	if w.RetriableDelay > 0 {
+		// A client gone meanwhile gets the error all the same
+		_ = sleepCtx(r.Context(), time.Duration(w.RetriableDelay))
+	}
+	return w.fail(rw, w.RetriableStatus, string(failure), fmt.Errorf("%w: %w", errRetriable, err))
+}
@@ -0,0 +1,135 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestRetriableConfig(t *testing.T) {
+	tests := []struct {
+		input     string
+		wantErr   bool
+		wantDelay time.Duration
+	}{
+		{input: "retriable_status 503"},
+		{input: "retriable_status 502\n\tretriable_delay 2s", wantDelay: 2 * time.Second},
+		{input: "retriable_status", wantErr: true},
+		{input: "retriable_status busy", wantErr: true},
+		{input: "retriable_status 302", wantErr: true},
+		{input: "retriable_status 600", wantErr: true},
+		{input: "retriable_delay 2s", wantErr: true},
+		{input: "retriable_status 503\n\tretriable_delay -1s", wantErr: true},
+		{input: "retriable_status 503\n\tafter_response", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && time.Duration(w.RetriableDelay) != tt.wantDelay {
+				t.Errorf("retriable_delay %s, want %s", time.Duration(w.RetriableDelay), tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestWakeResultRetriable(t *testing.T) {
+	for _, r := range []wakeResult{resultSendFailed, resultMACResolveFailed, resultBusy, resultWakeTimeout, resultGroupFailed, resultDependencyDown} {
+		if !r.retriable() {
+			t.Errorf("%s not retriable", r)
+		}
+	}
+	for _, r := range []wakeResult{resultSent, resultAlreadyUp, resultRateLimited, resultDenied, resultBudgetExhausted} {
+		if r.retriable() {
+			t.Errorf("%s retriable", r)
+		}
+	}
+}
+
+func TestServeHTTPRetriableStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		w          *WakeOnLAN
+		wantStatus int
+		// the wake_on_lan.retriable variable, unset or emptied if ""
+		wantVar string
+	}{
+		{
+			name:       "own status",
+			w:          &WakeOnLAN{MAC: autoMAC, IP: "192.0.2.77", Required: true},
+			wantStatus: resultMACResolveFailed.status(),
+		},
+		{
+			name:       "retriable",
+			w:          &WakeOnLAN{MAC: autoMAC, IP: "192.0.2.77", Required: true, RetriableStatus: http.StatusBadGateway},
+			wantStatus: http.StatusBadGateway,
+			wantVar:    "true",
+		},
+		{
+			// A refused wake isn't worth retrying
+			name:       "not retriable",
+			w:          &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: closedPort(t), Required: true, Rate: "1/h", RetriableStatus: http.StatusBadGateway},
+			wantStatus: http.StatusTooManyRequests,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, tt.w)
+			if w.Rate != "" {
+				// Spend the only token
+				serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			}
+			r := newTestRequest("GET", "http://example.com/", nil)
+			rec, called, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if called {
+				t.Error("next handler called")
+			}
+			if errors.Is(err, errRetriable) != (tt.wantVar != "") {
+				t.Errorf("error %v, want retriable %v", err, tt.wantVar != "")
+			}
+			if got, _ := caddyhttp.GetVar(r.Context(), varRetriable).(string); got != tt.wantVar {
+				t.Errorf("%s = %q, want %q", varRetriable, got, tt.wantVar)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRetriableDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:             autoMAC,
+		IP:              "192.0.2.77",
+		Required:        true,
+		JSONErrors:      true,
+		RetriableStatus: http.StatusServiceUnavailable,
+		RetriableDelay:  caddy.Duration(delay),
+	})
+	start := time.Now()
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if took := time.Since(start); took < delay {
+		t.Errorf("failed after %s, want at least %s", took, delay)
+	}
+	if got := statusOf(rec, err); got != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	var body errorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	if body.Error != string(resultMACResolveFailed) || !body.Retriable {
+		t.Errorf("body %+v, want a retriable mac_resolve_failed", body)
+	}
+}
@@ -0,0 +1,84 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Modes of socket_reuse.
+const (
+	// SO_REUSEADDR.
+	reuseAddr = "addr"
+	// SO_REUSEPORT.
+	reusePort = "port"
+	// Both options.
+	reuseBoth = "both"
+)
+
+// errSocketReuseUnsupported is returned where a socket_reuse option can't
+// be set.
+var errSocketReuseUnsupported = errors.New("the socket_reuse option is not supported on this platform")
+
+// validateSocketReuse checks socket_reuse's mode, that there are pinned
+// source ports for it to share and that the platform has its options.
+func (w *WakeOnLAN) validateSocketReuse() error {
+	switch w.SocketReuse {
+	case "":
+		return nil
+	case reuseAddr, reusePort, reuseBoth:
+	default:
+		return fmt.Errorf("invalid socket_reuse %q: want addr, port or both", w.SocketReuse)
+	}
+	switch {
+	case w.SourcePortRange == "":
+		return errors.New("socket_reuse shares the ports of source_port_range; without it every socket gets a free port of its own")
+	case !socketReuseSupported(w.SocketReuse):
+		return fmt.Errorf("socket_reuse %s: %w", w.SocketReuse, errSocketReuseUnsupported)
+	}
+	return nil
+}
+
+// reuseControl returns the function setting the options of mode on a
+// socket before it is bound.
+func reuseControl(mode string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = setSockReuse(fd, mode != reusePort, mode != reuseAddr)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// listenUDP is net.ListenUDP, with the socket_reuse options set on the
+// socket when ports has them.
+func (s *sourcePorts) listenUDP(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	if s == nil || s.reuse == "" {
+		return net.ListenUDP(network, laddr)
+	}
+	lc := net.ListenConfig{Control: reuseControl(s.reuse)}
+	conn, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// dialUDP is net.DialUDP, with the socket_reuse options set on the socket
+// when ports has them.
+func (s *sourcePorts) dialUDP(network string, laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	if s == nil || s.reuse == "" {
+		return net.DialUDP(network, laddr, raddr)
+	}
+	d := net.Dialer{LocalAddr: laddr, Control: reuseControl(s.reuse)}
+	conn, err := d.Dial(network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,14 @@
+//go:build (!unix && !windows) || solaris
+
+package caddy_wakeonlan
+
+// socketReuseSupported reports whether the options of mode can be set,
+// which they can't on this platform.
+func socketReuseSupported(mode string) bool {
+	return false
+}
+
+// setSockReuse is not implemented on this platform.
+func setSockReuse(fd uintptr, addr, port bool) error {
+	return errSocketReuseUnsupported
+}
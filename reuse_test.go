@@ -0,0 +1,50 @@
+package caddy_wakeonlan
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSocketReuseConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "source_port_range 40000-40009\n\tsocket_reuse addr", want: reuseAddr},
+		{input: "source_port_range 40000-40009\n\tsocket_reuse", wantErr: true},
+		{input: "source_port_range 40000-40009\n\tsocket_reuse all", wantErr: true},
+		{input: "source_port_range 40000-40009\n\tsocket_reuse addr port", wantErr: true},
+		{input: "socket_reuse addr", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.SocketReuse != tt.want {
+				t.Errorf("socket_reuse = %q, want %q", w.SocketReuse, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourcePortsWithoutReuse(t *testing.T) {
+	// Without socket_reuse a pinned port taken elsewhere is skipped
+	port := freeUDPPort(t)
+	host := newFakeHost(t)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: host.port()}
+	first, err := newSourcePorts(port, port).dial("nas", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if conn, err := newSourcePorts(port, port).dial("nas", addr); err == nil {
+		conn.Close()
+		t.Error("bound a port already taken without socket_reuse")
+	}
+}
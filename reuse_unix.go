@@ -0,0 +1,25 @@
+//go:build unix && !solaris
+
+package caddy_wakeonlan
+
+import "golang.org/x/sys/unix"
+
+// socketReuseSupported reports whether the options of mode can be set.
+func socketReuseSupported(mode string) bool {
+	return true
+}
+
+// setSockReuse sets SO_REUSEADDR and SO_REUSEPORT on the socket as asked.
+// On Linux, every socket sharing a port with SO_REUSEPORT must be owned by
+// the same user.
+func setSockReuse(fd uintptr, addr, port bool) error {
+	if addr {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return err
+		}
+	}
+	if port {
+		return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+//go:build unix && !solaris
+
+package caddy_wakeonlan
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSocketReuseUnixConfig(t *testing.T) {
+	for _, mode := range []string{reusePort, reuseBoth} {
+		w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsource_port_range 40000-40009\n\tsocket_reuse " + mode + "\n}")
+		if err == nil {
+			err = w.Validate()
+		}
+		if err != nil {
+			t.Errorf("socket_reuse %s: %v", mode, err)
+		}
+	}
+}
+
+func TestSourcePortsShared(t *testing.T) {
+	// Two handlers pinning the same port both bind it
+	port := freeUDPPort(t)
+	host := newFakeHost(t)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: host.port()}
+	var conns []*net.UDPConn
+	for i := range 2 {
+		ports := newSourcePorts(port, port)
+		ports.reuse = reuseBoth
+		conn, err := ports.dial("nas", addr)
+		if err != nil {
+			t.Fatalf("handler %d: %v", i+1, err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		if got := conn.LocalAddr().(*net.UDPAddr).Port; got != port {
+			t.Errorf("handler %d sends from port %d, want %d", i+1, got, port)
+		}
+		if _, err := conn.Write([]byte("wake")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host.expect(t, 2)
+
+	// The shared broadcast socket too
+	ports := newSourcePorts(port, port)
+	ports.reuse = reuseBoth
+	conn, err := openBroadcastConn(ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
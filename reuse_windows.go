@@ -0,0 +1,22 @@
+//go:build windows
+
+package caddy_wakeonlan
+
+import "golang.org/x/sys/windows"
+
+// socketReuseSupported reports whether the options of mode can be set:
+// Windows has no SO_REUSEPORT.
+func socketReuseSupported(mode string) bool {
+	return mode == reuseAddr
+}
+
+// setSockReuse sets SO_REUSEADDR on the socket if asked.
+func setSockReuse(fd uintptr, addr, port bool) error {
+	if port {
+		return errSocketReuseUnsupported
+	}
+	if addr {
+		return windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, 1)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// targetsAPIPath is the admin endpoint of the named targets; each one is
+// at targetsAPIPath/<name>.
+const targetsAPIPath = "/wake_on_lan/targets"
+
+// runtimeTargets are the named targets added, replaced or removed through
+// the admin API, layered over every app's inventory: a target set here
+// hides the inventory's of that name, and a removed one hides it
+// altogether, until set again. They survive config reloads, but not
+// restarts. Handlers look the targets up on every request and wakes copy
+// them when they start, so a change applies to the next request while
+// the wakes in flight finish with what they started with.
+var runtimeTargets = struct {
+	mu      sync.RWMutex
+	set     map[string]Target
+	removed map[string]struct{}
+}{
+	set:     make(map[string]Target),
+	removed: make(map[string]struct{}),
+}
+
+// runtimeTarget returns the target set as name through the admin API, and
+// whether there is one; overridden reports whether the API set or removed
+// name, the inventories then having no say.
+func runtimeTarget(name string) (t Target, ok, overridden bool) {
+	runtimeTargets.mu.RLock()
+	defer runtimeTargets.mu.RUnlock()
+	if t, ok := runtimeTargets.set[name]; ok {
+		return t, true, true
+	}
+	_, removed := runtimeTargets.removed[name]
+	return Target{}, false, removed
+}
+
+// namedTargets returns every named target handlers can refer to: the
+// inventories' with the admin API's changes applied.
+func namedTargets() map[string]Target {
+	targets := make(map[string]Target)
+	for _, a := range inventoryApps() {
+		a.mu.RLock()
+		maps.Copy(targets, a.targets)
+		a.mu.RUnlock()
+	}
+	runtimeTargets.mu.RLock()
+	defer runtimeTargets.mu.RUnlock()
+	for name := range runtimeTargets.removed {
+		delete(targets, name)
+	}
+	maps.Copy(targets, runtimeTargets.set)
+	return targets
+}
+
+// setRuntimeTarget sets name to t, failing with errTargetExists if create
+// is true and there is a target of that name already. It reports whether
+// the target is new.
+func setRuntimeTarget(name string, t Target, create bool) (bool, error) {
+	runtimeTargets.mu.Lock()
+	defer runtimeTargets.mu.Unlock()
+	_, exists := namedTargetLocked(name)
+	if create && exists {
+		return false, errTargetExists
+	}
+	delete(runtimeTargets.removed, name)
+	runtimeTargets.set[name] = t
+	return !exists, nil
+}
+
+// removeRuntimeTarget removes name, reporting false if there was no such
+// target.
+func removeRuntimeTarget(name string) bool {
+	runtimeTargets.mu.Lock()
+	defer runtimeTargets.mu.Unlock()
+	if _, exists := namedTargetLocked(name); !exists {
+		return false
+	}
+	delete(runtimeTargets.set, name)
+	runtimeTargets.removed[name] = struct{}{}
+	return true
+}
+
+// namedTargetLocked looks name up among the named targets. The caller
+// holds runtimeTargets.mu.
+func namedTargetLocked(name string) (Target, bool) {
+	if t, ok := runtimeTargets.set[name]; ok {
+		return t, true
+	}
+	if _, removed := runtimeTargets.removed[name]; removed {
+		return Target{}, false
+	}
+	for _, a := range inventoryApps() {
+		a.mu.RLock()
+		t, ok := a.targets[name]
+		a.mu.RUnlock()
+		if ok {
+			return t, true
+		}
+	}
+	return Target{}, false
+}
+
+// errTargetExists refuses to create a named target that exists already.
+var errTargetExists = errors.New("target exists; PUT replaces it")
+
+// decodeRuntimeTarget reads and validates the target named name in the
+// body of r.
+func decodeRuntimeTarget(rw http.ResponseWriter, r *http.Request, name string) (Target, error) {
+	dec := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxAdminBodyBytes))
+	dec.DisallowUnknownFields()
+	var t Target
+	if err := dec.Decode(&t); err != nil {
+		return Target{}, fmt.Errorf("decoding target: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return Target{}, errors.New("decoding target: more than one JSON value in the body")
+	}
+	if err := t.Validate(false); err != nil {
+		return Target{}, fmt.Errorf("target %s: %w", name, err)
+	}
+	if t.Name == "" {
+		t.Name = name
+	}
+	return t, nil
+}
+
+func (adminAPI) handleTargets(rw http.ResponseWriter, r *http.Request) error {
+	// A target may be named with the @ of the admin trigger, as in
+	// PUT /wake_on_lan/targets/@nas.
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, targetsAPIPath), "/")
+	name = strings.TrimPrefix(name, "@")
+	if name == "" {
+		if r.Method != http.MethodGet {
+			return caddy.APIError{
+				HTTPStatus: http.StatusMethodNotAllowed,
+				Err:        fmt.Errorf("method not allowed"),
+			}
+		}
+		targets := namedTargets()
+		for name, t := range targets {
+			targets[name] = redactTarget(t)
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(rw).Encode(targets)
+	}
+	if strings.Contains(name, "/") {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("invalid target name %q", name)}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		runtimeTargets.mu.RLock()
+		t, ok := namedTargetLocked(name)
+		runtimeTargets.mu.RUnlock()
+		if !ok {
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("no target %q", name)}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(rw).Encode(redactTarget(t))
+	case http.MethodPost, http.MethodPut:
+		t, err := decodeRuntimeTarget(rw, r, name)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		created, err := setRuntimeTarget(name, t, r.Method == http.MethodPost)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("target %s: %w", name, err)}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if created {
+			rw.WriteHeader(http.StatusCreated)
+		}
+		return json.NewEncoder(rw).Encode(redactTarget(t))
+	case http.MethodDelete:
+		if !removeRuntimeTarget(name) {
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("no target %q", name)}
+		}
+		rw.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method not allowed"),
+	}
+}
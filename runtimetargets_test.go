@@ -0,0 +1,211 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// resetRuntimeTargets starts the test without targets changed through the
+// admin API, and drops those it changes after.
+func resetRuntimeTargets(t *testing.T) {
+	t.Helper()
+	clear := func() {
+		runtimeTargets.mu.Lock()
+		runtimeTargets.set = make(map[string]Target)
+		runtimeTargets.removed = make(map[string]struct{})
+		runtimeTargets.mu.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+func TestHandleTargets(t *testing.T) {
+	resetRuntimeTargets(t)
+	loadInventoryApp(t, map[string]Target{
+		"nas":     {MAC: testMAC, IP: "192.0.2.1"},
+		"desktop": {MAC: "00:11:22:aa:bb:cc", IP: "192.0.2.2"},
+	})
+	// Run in order, each step seeing the changes of those before
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		// the targets listed afterwards
+		wantNames []string
+	}{
+		{name: "list", method: http.MethodGet, wantStatus: http.StatusOK, wantNames: []string{"desktop", "nas"}},
+		{name: "get", method: http.MethodGet, path: "/nas", wantStatus: http.StatusOK},
+		{name: "get unknown", method: http.MethodGet, path: "/printer", wantStatus: http.StatusNotFound},
+		{name: "create existing", method: http.MethodPost, path: "/nas", body: `{"mac":"00:11:22:33:44:66","ip":"192.0.2.9"}`, wantStatus: http.StatusConflict},
+		{name: "create", method: http.MethodPost, path: "/printer", body: `{"mac":"00:11:22:33:44:66","ip":"192.0.2.3"}`, wantStatus: http.StatusCreated, wantNames: []string{"desktop", "nas", "printer"}},
+		{name: "replace", method: http.MethodPut, path: "/nas", body: `{"mac":"` + testMAC + `","ip":"192.0.2.10"}`, wantStatus: http.StatusOK},
+		{name: "put new", method: http.MethodPut, path: "/tv/", body: `{"mac":"00:11:22:33:44:77","ip":"192.0.2.4"}`, wantStatus: http.StatusCreated, wantNames: []string{"desktop", "nas", "printer", "tv"}},
+		{name: "remove", method: http.MethodDelete, path: "/desktop", wantStatus: http.StatusNoContent, wantNames: []string{"nas", "printer", "tv"}},
+		{name: "get removed", method: http.MethodGet, path: "/desktop", wantStatus: http.StatusNotFound},
+		{name: "remove again", method: http.MethodDelete, path: "/desktop", wantStatus: http.StatusNotFound},
+		{name: "recreate removed", method: http.MethodPost, path: "/desktop", body: `{"mac":"00:11:22:aa:bb:cc","ip":"192.0.2.5"}`, wantStatus: http.StatusCreated, wantNames: []string{"desktop", "nas", "printer", "tv"}},
+		{name: "invalid target", method: http.MethodPost, path: "/scanner", body: `{"mac":"00:11:22","ip":"192.0.2.6"}`, wantStatus: http.StatusBadRequest},
+		{name: "unknown field", method: http.MethodPost, path: "/scanner", body: `{"mac":"00:11:22:33:44:88","address":"192.0.2.6"}`, wantStatus: http.StatusBadRequest},
+		{name: "two values", method: http.MethodPost, path: "/scanner", body: `{"mac":"00:11:22:33:44:88"} {}`, wantStatus: http.StatusBadRequest},
+		{name: "nested name", method: http.MethodGet, path: "/nas/ip", wantStatus: http.StatusNotFound},
+		{name: "post to the list", method: http.MethodPost, body: `{}`, wantStatus: http.StatusMethodNotAllowed},
+		{name: "patch", method: http.MethodPatch, path: "/nas", body: `{}`, wantStatus: http.StatusMethodNotAllowed},
+		{name: "list at the end", method: http.MethodGet, wantStatus: http.StatusOK, wantNames: []string{"desktop", "nas", "printer", "tv"}},
+	}
+	for _, step := range steps {
+		rec := httptest.NewRecorder()
+		err := adminAPI{}.handleTargets(rec, httptest.NewRequest(step.method, targetsAPIPath+step.path, strings.NewReader(step.body)))
+		if step.wantStatus >= 400 {
+			var apiErr caddy.APIError
+			if !errors.As(err, &apiErr) || apiErr.HTTPStatus != step.wantStatus {
+				t.Fatalf("%s: error = %v, want status %d", step.name, err, step.wantStatus)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if rec.Code != step.wantStatus {
+			t.Fatalf("%s: status %d, want %d", step.name, rec.Code, step.wantStatus)
+		}
+		if step.wantNames != nil {
+			names := slices.Sorted(maps.Keys(namedTargets()))
+			if !slices.Equal(names, step.wantNames) {
+				t.Fatalf("%s: targets %v, want %v", step.name, names, step.wantNames)
+			}
+		}
+	}
+
+	// The list and the inventory lookups see the changes
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleTargets(rec, httptest.NewRequest(http.MethodGet, targetsAPIPath, nil)); err != nil {
+		t.Fatal(err)
+	}
+	var listed map[string]Target
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	if got := listed["nas"]; got.IP != "192.0.2.10" || got.Name != "nas" {
+		t.Errorf("listed nas %+v, want it replaced and named", got)
+	}
+	app := inventoryApps()[0]
+	if nas, ok := app.target("nas"); !ok || nas.IP != "192.0.2.10" {
+		t.Errorf("inventory nas %+v, want it replaced", nas)
+	}
+	if _, ok := app.target("tv"); !ok {
+		t.Error("target added through the API not found by the inventory")
+	}
+}
+
+func TestHandleTargetsRedacts(t *testing.T) {
+	resetRuntimeTargets(t)
+	loadInventoryApp(t, map[string]Target{
+		"nas": {MAC: testMAC, IP: "192.0.2.1", SecureOn: "01:02:03:04:05:06"},
+	})
+	body := `{"mac":"00:11:22:33:44:66","bmc":{"endpoint":"https://192.0.2.9","username":"admin","password":"hunter2"}}`
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleTargets(rec, httptest.NewRequest(http.MethodPut, targetsAPIPath+"/server", strings.NewReader(body))); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"", "/nas", "/server"} {
+		rec := httptest.NewRecorder()
+		if err := (adminAPI{}).handleTargets(rec, httptest.NewRequest(http.MethodGet, targetsAPIPath+path, nil)); err != nil {
+			t.Fatalf("GET %q: %v", path, err)
+		}
+		for _, secret := range []string{"01:02:03:04:05:06", "admin", "hunter2"} {
+			if strings.Contains(rec.Body.String(), secret) {
+				t.Errorf("GET %q returned %q: %s", path, secret, rec.Body)
+			}
+		}
+		if !strings.Contains(rec.Body.String(), redacted) {
+			t.Errorf("GET %q returned no redacted field: %s", path, rec.Body)
+		}
+	}
+	// The secrets are kept, only hidden
+	if server, _, _ := runtimeTarget("server"); server.BMC == nil || server.BMC.Password != "hunter2" {
+		t.Errorf("stored server %+v, want its bmc password kept", server)
+	}
+}
+
+func TestHandleTargetsAtName(t *testing.T) {
+	resetRuntimeTargets(t)
+	loadInventoryApp(t, map[string]Target{"nas": {MAC: testMAC, IP: "192.0.2.1"}})
+	steps := []struct {
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{method: http.MethodGet, path: "/@nas", wantStatus: http.StatusOK},
+		{method: http.MethodPut, path: "/@nas", body: `{"mac":"` + testMAC + `","ip":"192.0.2.10"}`, wantStatus: http.StatusOK},
+		{method: http.MethodPost, path: "/@tv", body: `{"mac":"00:11:22:33:44:77","ip":"192.0.2.4"}`, wantStatus: http.StatusCreated},
+		{method: http.MethodDelete, path: "/@tv", wantStatus: http.StatusNoContent},
+	}
+	for _, step := range steps {
+		rec := httptest.NewRecorder()
+		if err := (adminAPI{}).handleTargets(rec, httptest.NewRequest(step.method, targetsAPIPath+step.path, strings.NewReader(step.body))); err != nil {
+			t.Fatalf("%s %s: %v", step.method, step.path, err)
+		}
+		if rec.Code != step.wantStatus {
+			t.Fatalf("%s %s: status %d, want %d", step.method, step.path, rec.Code, step.wantStatus)
+		}
+	}
+	names := slices.Sorted(maps.Keys(namedTargets()))
+	if !slices.Equal(names, []string{"nas"}) {
+		t.Errorf("targets %v, want [nas]", names)
+	}
+	if nas, _, _ := runtimeTarget("nas"); nas.IP != "192.0.2.10" {
+		t.Errorf("nas %+v, want it replaced", nas)
+	}
+}
+
+func TestServeHTTPRuntimeTarget(t *testing.T) {
+	resetRuntimeTargets(t)
+	before, after := newFakeHost(t), newFakeHost(t)
+	loadInventoryApp(t, map[string]Target{"nas": {MAC: testMAC, IP: "127.0.0.1", Port: before.port()}})
+	w := provisionIn(t, caddy.ActiveContext(), &WakeOnLAN{Inventory: []string{"nas"}})
+
+	wake := func() int {
+		t.Helper()
+		rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		return statusOf(rec, err)
+	}
+	if got := wake(); got != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", got, http.StatusNoContent)
+	}
+	before.expect(t, 1)
+
+	// Replaced: the next request wakes the new target, without a reload
+	body := fmt.Sprintf(`{"mac":%q,"ip":"127.0.0.1","port":%d}`, testMAC, after.port())
+	if err := (adminAPI{}).handleTargets(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, targetsAPIPath+"/nas", strings.NewReader(body))); err != nil {
+		t.Fatal(err)
+	}
+	if got := wake(); got != http.StatusNoContent {
+		t.Fatalf("after replacing: status = %d, want %d", got, http.StatusNoContent)
+	}
+	after.expect(t, 1)
+	before.expectNone(t)
+
+	// Removed: the handler has no target left to wake, as when one leaves
+	// the inventory file
+	if err := (adminAPI{}).handleTargets(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, targetsAPIPath+"/nas", nil)); err != nil {
+		t.Fatal(err)
+	}
+	logs := observeLogs(w)
+	wake()
+	after.expectNone(t)
+	if logs.FilterMessage("target not in inventory").Len() == 0 {
+		t.Error("removed target not reported missing")
+	}
+}
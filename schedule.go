@@ -0,0 +1,189 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// Schedule wakes targets at the times of a cron expression, independent
+// of requests.
+type Schedule struct {
+	// Standard five-field cron expression, or a descriptor such as @daily
+	// or @every 1h, in the server's local time unless prefixed with
+	// CRON_TZ=<zone>.
+	Cron string `json:"cron"`
+	// Targets to wake.
+	Targets []Target `json:"targets,omitempty"`
+	// Names of inventory targets to wake, looked up each time the
+	// schedule fires.
+	Inventory []string `json:"inventory,omitempty"`
+	// Broadcast address packets are also sent to.
+	Broadcast string `json:"broadcast,omitempty"`
+}
+
+// validate checks the cron expression and targets of the schedule.
+func (s *Schedule) validate() error {
+	if _, err := cron.ParseStandard(s.Cron); err != nil {
+		return fmt.Errorf("invalid cron expression %q: %w", s.Cron, err)
+	}
+	if len(s.Targets) == 0 && len(s.Inventory) == 0 {
+		return errors.New("no targets to wake")
+	}
+	if s.Broadcast != "" {
+		if err := validateBroadcast(s.Broadcast); err != nil {
+			return err
+		}
+	}
+	for i, t := range s.Targets {
+		if err := t.Validate(s.Broadcast == ""); err != nil {
+			return fmt.Errorf("target %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// startSchedules starts firing the app's schedules.
+func (a *App) startSchedules() {
+	if len(a.Schedules) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.scheduleCancel = cancel
+	a.cron = cron.New()
+	for i := range a.Schedules {
+		s := &a.Schedules[i]
+		// Validated in Provision
+		sched, _ := cron.ParseStandard(s.Cron)
+		// A run still sending when the next is due is not overlapped
+		job := cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(func() {
+			a.runSchedule(ctx, s)
+		}))
+		a.cron.Schedule(sched, job)
+	}
+	a.cron.Start()
+}
+
+// stopSchedules stops the schedules, interrupting and waiting for any run
+// in progress.
+func (a *App) stopSchedules() {
+	if a.cron == nil {
+		return
+	}
+	done := a.cron.Stop()
+	a.scheduleCancel()
+	<-done.Done()
+}
+
+// runSchedule wakes the targets of s one after another.
+func (a *App) runSchedule(ctx context.Context, s *Schedule) {
+	targets := append([]Target(nil), s.Targets...)
+	for _, name := range s.Inventory {
+		t, ok := a.target(name)
+		if !ok {
+			a.logger.Error("scheduled target not in inventory", zap.String("cron", s.Cron), zap.String("target", name))
+			continue
+		}
+		targets = append(targets, t)
+	}
+
+	opts := sendOptions{}
+	if s.Broadcast != "" {
+		opts.Broadcasts = []string{s.Broadcast}
+	}
+	opts = opts.withDefaults()
+	for _, t := range targets {
+		t = a.withDefaults(t)
+		err := sendRepeated(ctx, t, opts, a.logger)
+		if ctx.Err() != nil {
+			return
+		}
+		result := resultSent
+		if err != nil {
+			result = resultSendFailed
+		}
+		countResult(t, result)
+		fields := []zap.Field{
+			zap.String("cron", s.Cron),
+			zap.String("target", t.label()),
+			zap.String("mac", t.MAC),
+			zap.String("ip", t.IP),
+		}
+		if err != nil {
+			recordError(t.label(), result, err)
+			a.logger.Error("sending scheduled wake-on-lan packet", append(fields, zap.Error(err))...)
+			continue
+		}
+		a.logger.Info("scheduled wake-on-lan packet sent", fields...)
+	}
+}
+
+// withDefaults fills in t's unset port, repeat and interval from the app's
+// defaults, as handlers do for their targets.
+func (a *App) withDefaults(t Target) Target {
+	if d := a.Defaults; d != nil {
+		if t.Port == 0 && t.SRV == "" {
+			t.Port = d.Port
+		}
+		if t.Repeat == 0 {
+			t.Repeat = d.Repeat
+		}
+		if t.Interval == 0 {
+			t.Interval = d.Interval
+		}
+	}
+	if t.Repeat == 0 {
+		t.Repeat = 1
+	}
+	return t
+}
+
+// parseSchedule parses a schedule block. The cron expression may be given
+// as one quoted argument or as several.
+func parseSchedule(d *caddyfile.Dispenser) (Schedule, error) {
+	var s Schedule
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return s, d.ArgErr()
+	}
+	s.Cron = strings.Join(args, " ")
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return s, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "target":
+			t, err := parseTarget(d)
+			if err != nil {
+				return s, err
+			}
+			s.Targets = append(s.Targets, t)
+		case "inventory":
+			names := d.RemainingArgs()
+			if len(names) == 0 {
+				return s, d.ArgErr()
+			}
+			s.Inventory = append(s.Inventory, names...)
+		case "broadcast":
+			addr, err := parseStringArg(d)
+			if err != nil {
+				return s, err
+			}
+			s.Broadcast = addr
+		default:
+			return s, d.Errf("unrecognized schedule subdirective '%s'", d.Val())
+		}
+	}
+	// Targets are checked when the config loads
+	if _, err := cron.ParseStandard(s.Cron); err != nil {
+		return s, d.Errf("invalid cron expression %q: %v", s.Cron, err)
+	}
+	return s, nil
+}
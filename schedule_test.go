@@ -0,0 +1,146 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestScheduleValidate(t *testing.T) {
+	target := []Target{{MAC: testMAC, IP: "192.0.2.1"}}
+	tests := []struct {
+		name    string
+		s       Schedule
+		wantErr bool
+	}{
+		{name: "five fields", s: Schedule{Cron: "0 2 * * *", Targets: target}},
+		{name: "descriptor", s: Schedule{Cron: "@every 1h", Targets: target}},
+		{name: "time zone", s: Schedule{Cron: "CRON_TZ=Europe/Warsaw 0 2 * * 1-5", Targets: target}},
+		{name: "inventory only", s: Schedule{Cron: "@daily", Inventory: []string{"nas"}}},
+		{name: "broadcast only", s: Schedule{Cron: "@daily", Targets: []Target{{MAC: testMAC}}, Broadcast: "192.0.2.255"}},
+		{name: "six fields", s: Schedule{Cron: "0 0 2 * * *", Targets: target}, wantErr: true},
+		{name: "out of range", s: Schedule{Cron: "0 25 * * *", Targets: target}, wantErr: true},
+		{name: "unknown zone", s: Schedule{Cron: "CRON_TZ=Mars/Olympus 0 2 * * *", Targets: target}, wantErr: true},
+		{name: "no targets", s: Schedule{Cron: "@daily"}, wantErr: true},
+		{name: "no IP", s: Schedule{Cron: "@daily", Targets: []Target{{MAC: testMAC}}}, wantErr: true},
+		{name: "bad broadcast", s: Schedule{Cron: "@daily", Targets: target, Broadcast: "ff02::1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.s.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		wantCron      string
+		wantTargets   int
+		wantInventory []string
+		wantErr       bool
+	}{
+		{name: "quoted", input: "schedule \"0 2 * * *\" {\n\ttarget " + testMAC + " 192.0.2.1\n}", wantCron: "0 2 * * *", wantTargets: 1},
+		{name: "split", input: "schedule 0 2 * * * {\n\tinventory nas backup\n}", wantCron: "0 2 * * *", wantInventory: []string{"nas", "backup"}},
+		{name: "descriptor", input: "schedule @every 30m {\n\tinventory nas\n\tbroadcast 192.0.2.255\n}", wantCron: "@every 30m", wantInventory: []string{"nas"}},
+		{name: "no cron", input: "schedule {\n\tinventory nas\n}", wantErr: true},
+		{name: "invalid cron", input: "schedule \"61 * * * *\" {\n\tinventory nas\n}", wantErr: true},
+		{name: "unknown", input: "schedule @daily {\n\tcheck 192.0.2.1:22\n}", wantErr: true},
+		{name: "empty inventory", input: "schedule @daily {\n\tinventory\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+			d.Next()
+			s, err := parseSchedule(d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if s.Cron != tt.wantCron || len(s.Targets) != tt.wantTargets || fmt.Sprint(s.Inventory) != fmt.Sprint(tt.wantInventory) {
+				t.Errorf("schedule %+v, want cron %q, %d targets, inventory %v", s, tt.wantCron, tt.wantTargets, tt.wantInventory)
+			}
+		})
+	}
+}
+
+func TestScheduleLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule string
+		wantErr  bool
+	}{
+		{name: "valid", schedule: `{"cron": "@daily", "targets": [{"mac": "` + testMAC + `", "ip": "192.0.2.1"}]}`},
+		{name: "invalid cron", schedule: `{"cron": "every night", "targets": [{"mac": "` + testMAC + `", "ip": "192.0.2.1"}]}`, wantErr: true},
+		{name: "not in inventory", schedule: `{"cron": "@daily", "inventory": ["nas"]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := `{"admin": {"disabled": true}, "apps": {"wake_on_lan": {"schedules": [` + tt.schedule + `]}}}`
+			err := caddy.Load([]byte(config), true)
+			if err == nil {
+				caddy.Stop()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loading: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScheduleFires(t *testing.T) {
+	host := newFakeHost(t)
+	config := fmt.Sprintf(`{"admin": {"disabled": true}, "apps": {"wake_on_lan": {"schedules": [
+		{"cron": "@every 1s", "targets": [{"mac": %q, "ip": "127.0.0.1", "port": %d}]}
+	]}}}`, testMAC, host.port())
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatal(err)
+	}
+	host.expect(t, 1)
+	if err := caddy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	// Drain a run that fired while stopping
+	time.Sleep(50 * time.Millisecond)
+	for len(host.packets) > 0 {
+		<-host.packets
+	}
+	select {
+	case <-host.packets:
+		t.Error("schedule still fired after the app stopped")
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestRunSchedule(t *testing.T) {
+	host := newFakeHost(t)
+	core, logs := observer.New(zapcore.InfoLevel)
+	a := &App{
+		Defaults: &Defaults{Port: host.port(), Repeat: 2},
+		targets:  map[string]Target{"nas": {MAC: testMAC, IP: "127.0.0.1"}},
+		logger:   zap.New(core),
+	}
+	s := &Schedule{Cron: "@daily", Inventory: []string{"nas", "gone"}, Targets: []Target{{MAC: testMAC, IP: "127.0.0.1", Repeat: 1}}}
+	a.runSchedule(t.Context(), s)
+
+	// The inventory target inherits repeat 2, the inline one keeps its 1
+	host.expect(t, 3)
+	host.expectNone(t)
+	if n := logs.FilterMessage("scheduled target not in inventory").FilterField(zap.String("target", "gone")).Len(); n != 1 {
+		t.Errorf("logged the missing target %d times, want 1", n)
+	}
+	if n := logs.FilterMessage("scheduled wake-on-lan packet sent").Len(); n != 2 {
+		t.Errorf("logged %d sent wakes, want 2", n)
+	}
+}
@@ -0,0 +1,101 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Target selection policies.
+const (
+	// Wake every target (the default).
+	selectAll = "all"
+	// Wake one target chosen at random.
+	selectRandom = "random"
+	// Wake one target, taking turns.
+	selectRoundRobin = "round_robin"
+	// Wake one target chosen at random in proportion to its weight.
+	selectWeighted = "weighted"
+	// Wake the target picked longest ago, or never.
+	selectLeastRecent = "least_recent"
+)
+
+func validateSelect(policy string) error {
+	switch policy {
+	case "", selectAll, selectRandom, selectRoundRobin, selectWeighted, selectLeastRecent:
+		return nil
+	}
+	return fmt.Errorf("unknown select policy %q", policy)
+}
+
+// selectTargets narrows targets to the one to wake under the handler's
+// select policy.
+func (w *WakeOnLAN) selectTargets(targets []Target) []Target {
+	if len(targets) < 2 {
+		return targets
+	}
+	switch w.Select {
+	case selectRandom:
+		i := rand.IntN(len(targets))
+		return targets[i : i+1]
+	case selectRoundRobin:
+		i := int((w.roundRobin.Add(1) - 1) % uint64(len(targets)))
+		return targets[i : i+1]
+	case selectWeighted:
+		i := pickWeighted(targets)
+		return targets[i : i+1]
+	case selectLeastRecent:
+		i := w.lastPicked.pick(targets, time.Now())
+		return targets[i : i+1]
+	}
+	return targets
+}
+
+// pickWeighted returns the index of a target chosen at random, each with a
+// chance in proportion to its weight, 1 if unset.
+func pickWeighted(targets []Target) int {
+	total := 0
+	for _, t := range targets {
+		total += t.weight()
+	}
+	n := rand.IntN(total)
+	for i, t := range targets {
+		if n -= t.weight(); n < 0 {
+			return i
+		}
+	}
+	return len(targets) - 1
+}
+
+// pickTimes records when select least_recent last picked each target.
+type pickTimes struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newPickTimes() *pickTimes {
+	return &pickTimes{last: make(map[string]time.Time)}
+}
+
+// pick returns the index of the target picked longest ago, the first
+// never picked if any, and records it as picked at now. Recording it
+// when picked, not once woken, spreads requests arriving together over
+// the pool.
+func (p *pickTimes) pick(targets []Target, now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := 0
+	bestAt, ok := p.last[targets[0].key()]
+	for i, t := range targets[1:] {
+		if !ok {
+			break
+		}
+		at, seen := p.last[t.key()]
+		if !seen || at.Before(bestAt) {
+			best, bestAt, ok = i+1, at, seen
+		}
+	}
+	p.last[targets[best].key()] = now
+	return best
+}
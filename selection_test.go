@@ -0,0 +1,212 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testPool returns n targets on 127.0.0.1, each with its own MAC and fake
+// host.
+func testPool(t *testing.T, n int) ([]Target, []*fakeHost) {
+	t.Helper()
+	targets := make([]Target, n)
+	hosts := make([]*fakeHost, n)
+	for i := range targets {
+		hosts[i] = newFakeHost(t)
+		targets[i] = Target{MAC: fmt.Sprintf("00:11:22:33:44:%02x", i+1), IP: "127.0.0.1", Port: hosts[i].port()}
+	}
+	return targets, hosts
+}
+
+func TestSelectConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "select random", want: selectRandom},
+		{input: "select round_robin", want: selectRoundRobin},
+		{input: "select all", want: selectAll},
+		{input: "select weighted", want: selectWeighted},
+		{input: "select least_recent", want: selectLeastRecent},
+		{input: "select", wantErr: true},
+		{input: "select random round_robin", wantErr: true},
+		{input: "select first", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan {\n\ttarget 00:11:22:33:44:01 192.0.2.1\n\ttarget 00:11:22:33:44:02 192.0.2.2\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.Select != tt.want {
+				t.Errorf("select = %q, want %q", w.Select, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{input: "weight 3", want: 3},
+		{input: "weight 0"},
+		{input: "weight -1", wantErr: true},
+		{input: "weight", wantErr: true},
+		{input: "weight heavy", wantErr: true},
+		{input: "weight 1 2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan {\n\ttarget 00:11:22:33:44:01 192.0.2.1 {\n\t\t" + tt.input + "\n\t}\n\ttarget 00:11:22:33:44:02 192.0.2.2\n\tselect weighted\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.Targets[0].Weight != tt.want {
+				t.Errorf("weight = %d, want %d", w.Targets[0].Weight, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	const picks = 4000
+	// Unset weights count as 1
+	targets := []Target{{MAC: "00:11:22:33:44:01"}, {MAC: "00:11:22:33:44:02", Weight: 3}}
+	counts := make([]int, len(targets))
+	for range picks {
+		counts[pickWeighted(targets)]++
+	}
+	for i, want := range []int{picks / 4, picks * 3 / 4} {
+		if n := counts[i]; n < want-picks/20 || n > want+picks/20 {
+			t.Errorf("target %d picked %d times, want about %d", i, n, want)
+		}
+	}
+}
+
+func TestPickTimes(t *testing.T) {
+	targets, _ := testPool(t, 3)
+	p := newPickTimes()
+	now := time.Now()
+	// Those never picked first, in order, then the one picked longest ago
+	for i, want := range []int{0, 1, 2, 0, 1, 2, 0} {
+		if got := p.pick(targets, now.Add(time.Duration(i)*time.Second)); got != want {
+			t.Errorf("pick %d: target %d, want %d", i, got, want)
+		}
+	}
+
+	// A target joining the pool goes first
+	targets = append(targets, Target{MAC: "00:11:22:33:44:09", IP: "127.0.0.1"})
+	if got := p.pick(targets, now.Add(time.Minute)); got != 3 {
+		t.Errorf("picked target %d, want the new one, 3", got)
+	}
+	if got := p.pick(targets, now.Add(2*time.Minute)); got != 1 {
+		t.Errorf("picked target %d, want 1, picked longest ago", got)
+	}
+}
+
+func TestSelectTargets(t *testing.T) {
+	const picks = 3000
+	tests := []struct {
+		policy string
+		// picks each of the 3 targets gets, within tolerance
+		want, tolerance int
+		// targets each call returns
+		wantLen int
+	}{
+		{policy: selectAll, want: picks, wantLen: 3},
+		{policy: selectRoundRobin, want: picks / 3, wantLen: 1},
+		{policy: selectRandom, want: picks / 3, tolerance: picks / 10, wantLen: 1},
+		{policy: selectWeighted, want: picks / 3, tolerance: picks / 10, wantLen: 1},
+		{policy: selectLeastRecent, want: picks / 3, wantLen: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			targets, _ := testPool(t, 3)
+			w := provisionTest(t, &WakeOnLAN{Targets: targets, Select: tt.policy})
+			counts := make(map[string]int)
+			for range picks {
+				picked := w.selectTargets(w.Targets)
+				if len(picked) != tt.wantLen {
+					t.Fatalf("picked %d targets, want %d", len(picked), tt.wantLen)
+				}
+				for _, p := range picked {
+					counts[p.MAC]++
+				}
+			}
+			for _, target := range targets {
+				if n := counts[target.MAC]; n < tt.want-tt.tolerance || n > tt.want+tt.tolerance {
+					t.Errorf("%s picked %d times, want %d±%d", target.MAC, n, tt.want, tt.tolerance)
+				}
+			}
+		})
+	}
+
+	t.Run("round_robin takes turns", func(t *testing.T) {
+		targets, _ := testPool(t, 3)
+		w := provisionTest(t, &WakeOnLAN{Targets: targets, Select: selectRoundRobin})
+		for i := range 7 {
+			if got, want := w.selectTargets(w.Targets)[0].MAC, targets[i%3].MAC; got != want {
+				t.Errorf("pick %d: %s, want %s", i, got, want)
+			}
+		}
+	})
+
+	t.Run("single target", func(t *testing.T) {
+		targets, _ := testPool(t, 1)
+		w := provisionTest(t, &WakeOnLAN{Targets: targets, Select: selectRandom})
+		if got := w.selectTargets(w.Targets); len(got) != 1 || got[0].MAC != targets[0].MAC {
+			t.Errorf("picked %v, want the only target", got)
+		}
+	})
+}
+
+func TestServeHTTPSelect(t *testing.T) {
+	const requests = 30
+	tests := []struct {
+		policy string
+		// packets each of the 3 hosts gets, or -1 for any number
+		want int
+	}{
+		{policy: selectAll, want: requests},
+		{policy: selectRoundRobin, want: requests / 3},
+		{policy: selectRandom, want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			targets, hosts := testPool(t, 3)
+			w := provisionTest(t, &WakeOnLAN{Targets: targets, Select: tt.policy})
+			for range requests {
+				if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.want >= 0 {
+				for _, h := range hosts {
+					h.expect(t, tt.want)
+					h.expectNone(t)
+				}
+				return
+			}
+			// One packet per request in all
+			time.Sleep(100 * time.Millisecond)
+			total := 0
+			for _, h := range hosts {
+				total += len(h.packets)
+			}
+			if total != requests {
+				t.Errorf("got %d packets, want %d", total, requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// selfTest opens the sockets the send path needs, with the options it
+// sets on them, and sends one datagram to a listener on loopback, so a
+// host that can't broadcast, bind an interface or set a TTL fails the
+// config instead of every wake. Nothing is sent to a target. Targets,
+// the relay and the helper socket not resolving or listening only log a
+// warning: they may just be down for now.
+func (w *WakeOnLAN) selfTest() error {
+	var verified []string
+	capability := func(name string, err error) error {
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: self-test: %s: %w", name, err)
+		}
+		verified = append(verified, name)
+		return nil
+	}
+
+	if w.publisher != nil {
+		w.logger.Info("self-test: wake requests are published; no sockets to check")
+		return nil
+	}
+	if w.grpcConn != nil {
+		w.logger.Info("self-test: targets are woken over grpc; no sockets to check")
+		return nil
+	}
+	if w.HelperSocket != "" {
+		// The helper opens the sockets; all there is to check is that it
+		// listens
+		if _, err := os.Stat(w.HelperSocket); err != nil {
+			w.logger.Warn("self-test: helper socket", zap.Error(err))
+		}
+		w.logger.Info("self-test: packets are handed to the helper; no sockets to check")
+		return nil
+	}
+	if w.relayed() {
+		ctx, cancel := context.WithTimeout(w.ctx, defaultSendTimeout)
+		defer cancel()
+		opts := w.sendOptions()
+		relays := opts.Relays
+		for _, name := range siteNames(opts.Sites) {
+			relays = append(relays, opts.Sites[name]...)
+		}
+		for _, relay := range relays {
+			host, port, _ := splitEndpoint(relay)
+			if _, err := resolveUDPAddr(ctx, host, port, opts.ResolveRetries, opts.ResolveBackoff, opts.Prefer); err != nil {
+				w.logger.Warn("self-test: resolving relay", zap.String("relay", relay), zap.Error(err))
+			}
+		}
+		w.logger.Info("self-test: wakes are handed to the relay; no sockets to check")
+		return nil
+	}
+
+	ttl := w.TTL
+	targets := w.allTargets()
+	broadcast := w.Broadcast != "" || w.escalatesToBroadcast() || w.BroadcastFallback != nil || w.BroadcastSource != ""
+	var interfaces []string
+	for _, t := range targets {
+		ttl = max(ttl, t.TTL)
+		if ip := net.ParseIP(t.IP); ip != nil && classifyDest(ip) == destBroadcast {
+			broadcast = true
+		}
+		if w.VRF != "" {
+			t = inVRF(t, w.VRF)
+		}
+		if t.Interface != "" && !slices.Contains(interfaces, t.Interface) {
+			interfaces = append(interfaces, t.Interface)
+		}
+	}
+
+	if err := capability("udp", selfTestSend(ttl)); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		verified = append(verified, "ttl "+strconv.Itoa(ttl))
+	}
+	if broadcast && w.VRF == "" {
+		conn, err := listenBroadcast(nil, "")
+		switch {
+		case errors.Is(err, errBroadcastUnsupported):
+			// Sends dial a socket per packet instead
+			w.logger.Info("self-test: SO_BROADCAST can't be set on this platform; not checked")
+		case err != nil:
+			return capability("broadcast", err)
+		default:
+			conn.Close()
+			verified = append(verified, "broadcast")
+		}
+	}
+	for _, ifname := range interfaces {
+		if err := capability("interface "+ifname, selfTestInterface(ifname, broadcast)); err != nil {
+			return err
+		}
+	}
+	if w.SourcePortRange != "" {
+		lo, hi, err := parsePortRange(w.SourcePortRange)
+		if err != nil {
+			return capability("source_port_range", err)
+		}
+		// A range of its own, so no target's pinned port moves
+		ports := newSourcePorts(lo, hi)
+		ports.reuse = w.SocketReuse
+		conn, err := ports.bind("self-test", func(port int) (*net.UDPConn, error) {
+			return ports.listenUDP("udp", &net.UDPAddr{Port: port})
+		})
+		if err := capability("source_port_range", err); err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	if slices.Contains(w.transports, transportRawEthernet) {
+		var rawInterfaces []string
+		opts := w.sendOptions()
+		for _, t := range targets {
+			if ifname := rawInterface(t, opts); ifname != "" && !slices.Contains(rawInterfaces, ifname) {
+				rawInterfaces = append(rawInterfaces, ifname)
+			}
+		}
+		for _, ifname := range rawInterfaces {
+			if err := capability("raw_ethernet "+ifname, checkRawEthernet(ifname)); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.selfTestReachability(targets)
+	w.logger.Info("self-test passed", zap.Strings("verified", verified))
+	return nil
+}
+
+// selfTestSend sends a datagram to a listener on loopback from a socket
+// with the hop limit ttl, if set, as the packets to a target get.
+func selfTestSend(ttl int) error {
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+	conn, err := net.DialUDP("udp4", nil, sink.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := setTTL(conn, net.IPv4(127, 0, 0, 1), ttl); err != nil {
+		return err
+	}
+	payload := buildMagicPacket(make(net.HardwareAddr, 6))
+	if err := writeAll(conn, payload); err != nil {
+		return err
+	}
+	_ = sink.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := sink.Read(make([]byte, len(payload))); err != nil {
+		return fmt.Errorf("datagram sent to loopback not received: %w", err)
+	}
+	return nil
+}
+
+// selfTestInterface opens a socket bound to ifname, as sends through it
+// do, with SO_BROADCAST if broadcast is true.
+func selfTestInterface(ifname string, broadcast bool) error {
+	local, err := interfaceLocalAddr(ifname, false)
+	if err != nil {
+		return err
+	}
+	lc := net.ListenConfig{Control: interfaceControl(ifname, broadcast)}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort(local, "0"))
+	if err != nil {
+		return err
+	}
+	return pc.Close()
+}
+
+// selfTestReachability resolves every static target's host name, logging
+// those that fail.
+func (w *WakeOnLAN) selfTestReachability(targets []Target) {
+	ctx, cancel := context.WithTimeout(w.ctx, defaultSendTimeout)
+	defer cancel()
+	opts := w.sendOptions()
+	for _, t := range targets {
+		if t.IP == "" || t.SRV != "" {
+			continue
+		}
+		if _, err := resolveUDPAddr(ctx, t.IP, portOrDefault(t.Port), opts.ResolveRetries, opts.ResolveBackoff, opts.Prefer); err != nil {
+			w.logger.Warn("self-test: resolving target", zap.String("target", t.label()), zap.Error(err))
+		}
+	}
+}
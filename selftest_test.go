@@ -0,0 +1,127 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestSelfTestConfig(t *testing.T) {
+	w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tself_test\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.SelfTest {
+		t.Error("self_test not set")
+	}
+	if _, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tself_test yes\n}"); err == nil {
+		t.Error("self_test with an argument parsed")
+	}
+}
+
+func TestSelfTestSend(t *testing.T) {
+	for _, ttl := range []int{0, 1, 64} {
+		if err := selfTestSend(ttl); err != nil {
+			t.Errorf("ttl %d: %v", ttl, err)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	lo, _ := loopbackAndOther(t)
+	port := freeUDPPort(t)
+	tests := []struct {
+		name         string
+		w            *WakeOnLAN
+		wantVerified string
+		wantLog      string
+	}{
+		{name: "unicast", w: &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1"}, wantVerified: "udp"},
+		{name: "ttl", w: &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Targets: []Target{{MAC: "00:11:22:33:44:01", IP: "127.0.0.1", TTL: 4}}}, wantVerified: "udp,ttl 4"},
+		{name: "broadcast", w: &WakeOnLAN{MAC: testMAC, Broadcast: "127.255.255.255"}, wantVerified: "udp,broadcast"},
+		{name: "interface", w: &WakeOnLAN{Targets: []Target{{MAC: testMAC, IP: "127.0.0.1", Interface: lo}}}, wantVerified: "udp,interface " + lo},
+		{name: "source ports", w: &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", SourcePortRange: fmt.Sprintf("%d-%d", port, port)}, wantVerified: "udp,source_port_range"},
+		{name: "relay", w: &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Relay: "127.0.0.1:9"}, wantLog: "self-test: wakes are handed to the relay; no sockets to check"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, tt.w)
+			logs := observeLogs(w)
+			if err := w.selfTest(); err != nil {
+				t.Fatalf("selfTest: %v", err)
+			}
+			if tt.wantLog != "" {
+				if logs.FilterMessage(tt.wantLog).Len() != 1 {
+					t.Errorf("no %q log", tt.wantLog)
+				}
+				return
+			}
+			passed := logs.FilterMessage("self-test passed").All()
+			if len(passed) != 1 {
+				t.Fatal("no self-test passed log")
+			}
+			var verified []string
+			for _, v := range passed[0].ContextMap()["verified"].([]any) {
+				verified = append(verified, v.(string))
+			}
+			if got := strings.Join(verified, ","); got != tt.wantVerified {
+				t.Errorf("verified %q, want %q", got, tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestSelfTestFailures(t *testing.T) {
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.LocalAddr().(*net.UDPAddr).Port
+
+	// The config fails when it loads, not on the first wake
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	w := &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", SourcePortRange: fmt.Sprintf("%d-%d", port, port), SelfTest: true}
+	err = w.Provision(ctx)
+	if err == nil {
+		w.Cleanup()
+		t.Fatal("provisioned with the only source port taken")
+	}
+	if !strings.Contains(err.Error(), "self-test: source_port_range") {
+		t.Errorf("error %q doesn't name the capability", err)
+	}
+
+	if err := selfTestInterface("nosuchif0", false); err == nil {
+		t.Error("bound a socket to a missing interface")
+	}
+}
+
+func TestSelfTestUnresolvable(t *testing.T) {
+	// A target that stops resolving only logs a warning
+	var failing atomic.Bool
+	newFakeDNS(t, func(_ string, typ dnsmessage.Type, _ int) ([]net.IP, dnsmessage.RCode) {
+		if failing.Load() {
+			return nil, dnsmessage.RCodeNameError
+		}
+		if typ != dnsmessage.TypeA {
+			return nil, dnsmessage.RCodeSuccess
+		}
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, dnsmessage.RCodeSuccess
+	})
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "nas.test."})
+	logs := observeLogs(w)
+	failing.Store(true)
+	if err := w.selfTest(); err != nil {
+		t.Fatalf("selfTest: %v", err)
+	}
+	if logs.FilterMessage("self-test: resolving target").Len() != 1 {
+		t.Error("no warning about the unresolvable target")
+	}
+}
@@ -0,0 +1,709 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Transport protocols for the magic packet.
+const (
+	protocolUDP = "udp"
+	protocolTCP = "tcp"
+)
+
+// defaultSendTimeout bounds connecting and writing a packet over TCP.
+const defaultSendTimeout = 5 * time.Second
+
+// sendOptions tunes how sendWOL delivers a single packet.
+type sendOptions struct {
+	ResolveRetries int
+	ResolveBackoff time.Duration
+	// Which of a hostname's addresses to send to.
+	Prefer ipPreference
+
+	// Transports to send the packet to the target over, the timeout for a
+	// TCP send and the interface for raw ethernet frames.
+	Transports   []string
+	SendTimeout  time.Duration
+	RawInterface string
+
+	// Cache for "auto" MAC lookups (nil to look up every time) and the
+	// lifetimes of its hits and misses.
+	MACCache    *macCache
+	MACCacheTTL time.Duration
+	MACMissTTL  time.Duration
+
+	// DHCP leases to take MACs from before the configured ones (nil to
+	// use those as given).
+	DHCPLeases *dhcpLeases
+	// Switch to look up MACs from over SNMP, after the DHCP leases and
+	// before the configured MACs (nil to skip).
+	SNMP *snmpResolver
+	// Order to try the MAC sources in (empty for the default) and the
+	// ethers file the ethers source reads.
+	MACSources []string
+	Ethers     *ethersFile
+
+	// Cache for mDNS discovery, the time a query waits for answers and
+	// how long the answers are reused.
+	MDNSCache   *mdnsCache
+	MDNSTimeout time.Duration
+	MDNSTTL     time.Duration
+
+	// Local ports to send unicast packets from, pinned per target (nil
+	// for any port).
+	SourcePorts *sourcePorts
+
+	// Address probed before each repeated packet, and the probe's timeout;
+	// once it accepts a connection no more packets are sent.
+	RetryProbe        string
+	RetryProbeTimeout time.Duration
+	// Destination ports successive packets cycle through (nil to send
+	// each to the target's port).
+	RetryPorts []int
+
+	// WOL relays to hand the wake to instead of sending packets, how they
+	// are tried, the wire format they speak, and the logger of relays
+	// failing while another accepted the wake.
+	Relays        []string
+	RelayStrategy string
+	RelayProtocol string
+	RelayLogger   *zap.Logger
+	// Relays by site, instead of Relays, handed the wake of each target
+	// at the sites it names, or all of them.
+	Sites map[string][]string
+
+	// Counter of the packets sent to each target, refusing those over the
+	// handler's max_lifetime_packets (nil for no limit).
+	Fuse *packetFuse
+
+	// Unix datagram socket of a privileged helper to hand the packets to
+	// instead of sending them.
+	HelperSocket string
+
+	// Minimum packet length; shorter packets are padded with zeros.
+	PadTo int
+	// Bytes appended to each packet asking the agent for an ack (nil for
+	// none).
+	AckTrailer []byte
+	// Largest packet built (0 for maxPacketSize).
+	MaxPacketSize int
+	// VRF device packets are sent from, for targets without an interface.
+	VRF string
+	// Most MACs a pattern may expand to (0 for the default).
+	MaxMACExpansion int
+	// Packet templates parsed when the config loaded, by source.
+	PacketTemplates map[string]*packetTemplate
+	// Logger each packet is logged to before it is sent (nil to not log
+	// packets).
+	PacketLogger *zap.Logger
+	// Sends taking at least SlowSend are logged to SlowSendLogger with the
+	// time spent in each phase (0 to not log them).
+	SlowSend       time.Duration
+	SlowSendLogger *zap.Logger
+
+	// OUIs an "auto" MAC must start with (empty allows any).
+	AllowOUI [][3]byte
+
+	// Broadcast addresses to send to in addition to the target IP, and the
+	// shared socket to send on (nil to dial per packet). With SkipUnicast,
+	// only the broadcast addresses are sent to.
+	Broadcasts    []string
+	BroadcastConn *net.UDPConn
+	SkipUnicast   bool
+	// Sockets of shared_broadcast_socket, per interface (nil for none).
+	SharedBroadcast *broadcastSockets
+	// Policy picking the interfaces 255.255.255.255 goes out on (empty
+	// leaves it to the system).
+	BroadcastSource string
+}
+
+func (w *WakeOnLAN) sendOptions() sendOptions {
+	opts := sendOptions{
+		ResolveRetries:    w.ResolveRetries,
+		ResolveBackoff:    time.Duration(w.ResolveBackoff),
+		Prefer:            ipPreference{family: w.Prefer, only: w.PreferOnly},
+		Transports:        w.transports,
+		RawInterface:      w.RawInterface,
+		SendTimeout:       time.Duration(w.SendTimeout),
+		MACCache:          w.macCache,
+		DHCPLeases:        w.dhcpLeases,
+		SNMP:              w.snmp,
+		MACSources:        w.MACSources,
+		Ethers:            w.ethers,
+		AllowOUI:          w.allowOUI,
+		PadTo:             w.PadTo,
+		MaxPacketSize:     w.packetLimit(),
+		MaxMACExpansion:   w.MaxMACExpansion,
+		PacketTemplates:   w.packetTemplates,
+		RetryProbe:        w.RetryProbe,
+		RetryPorts:        w.RetryPorts,
+		Relays:            w.relays(),
+		RelayStrategy:     w.RelayStrategy,
+		RelayProtocol:     w.RelayProtocol,
+		RelayLogger:       w.logger,
+		Sites:             w.Sites,
+		HelperSocket:      w.HelperSocket,
+		RetryProbeTimeout: time.Duration(w.RetryProbeTimeout),
+		SourcePorts:       w.sourcePorts,
+		MACCacheTTL:       time.Duration(w.MACCacheTTL),
+		MACMissTTL:        time.Duration(w.MACMissTTL),
+		MDNSCache:         w.mdnsCache,
+		MDNSTimeout:       time.Duration(w.MDNSTimeout),
+		MDNSTTL:           time.Duration(w.MDNSTTL),
+		BroadcastConn:     w.broadcastConn,
+		SharedBroadcast:   w.sharedBroadcast,
+		BroadcastSource:   w.BroadcastSource,
+		VRF:               w.VRF,
+		Fuse:              w.fuse,
+	}
+	if w.Broadcast != "" {
+		opts.Broadcasts = []string{w.Broadcast}
+	}
+	if w.LogPacket {
+		opts.PacketLogger = w.logger
+	}
+	if w.SlowSend > 0 {
+		opts.SlowSend, opts.SlowSendLogger = time.Duration(w.SlowSend), w.logger
+	}
+	return opts.withDefaults()
+}
+
+// withDefaults fills in the defaults of unset options.
+func (opts sendOptions) withDefaults() sendOptions {
+	if opts.ResolveBackoff == 0 {
+		opts.ResolveBackoff = 250 * time.Millisecond
+	}
+	if opts.Transports == nil {
+		opts.Transports = []string{protocolUDP}
+	}
+	if opts.SendTimeout == 0 {
+		opts.SendTimeout = defaultSendTimeout
+	}
+	if opts.MDNSCache == nil {
+		opts.MDNSCache = newMDNSCache()
+	}
+	if opts.MDNSTimeout == 0 {
+		opts.MDNSTimeout = defaultMDNSTimeout
+	}
+	if opts.MDNSTTL == 0 {
+		opts.MDNSTTL = defaultMDNSTTL
+	}
+	if opts.MACCacheTTL == 0 {
+		opts.MACCacheTTL = defaultMACCacheTTL
+	}
+	if opts.MACMissTTL == 0 {
+		opts.MACMissTTL = defaultMACMissTTL
+	}
+	return opts
+}
+
+// sendRepeated sends t.Repeat packets to the target, pausing t.Interval
+// between them, or powers it on through its BMC. It stops early if ctx is
+// cancelled or, with a retry probe, once the probe shows the target is up.
+func sendRepeated(ctx context.Context, t Target, opts sendOptions, logger *zap.Logger) error {
+	if t.BMC != nil {
+		// Powered on once; there are no packets to repeat
+		return t.BMC.powerOn(ctx, logger)
+	}
+	if opts.PacketLogger != nil {
+		opts.PacketLogger = logger
+	}
+	opts.RelayLogger = logger
+	// The wake fails only if no packet at all went out; a transient
+	// failure of one repeat is covered by the others
+	var lastErr error
+	sent := 0
+	for i := 0; i < t.Repeat; i++ {
+		if i > 0 && t.Interval > 0 {
+			if err := sleepCtx(ctx, time.Duration(t.Interval)); err != nil {
+				if sent > 0 {
+					return nil
+				}
+				return err
+			}
+		}
+		// Probing is only worth it once a packet has gone out
+		if sent > 0 && opts.RetryProbe != "" && probeTCP(ctx, opts.RetryProbe, opts.RetryProbeTimeout) {
+			logger.Debug("target up; not resending", zap.Int("sent", sent), zap.String("retry_probe", opts.RetryProbe))
+			return nil
+		}
+		if err := sendWOL(ctx, attemptTarget(t, opts, i), opts); err != nil {
+			logger.Debug("sending packet failed", zap.Int("attempt", i+1), zap.Error(err))
+			if errors.Is(err, errFuseBlown) {
+				// No later packet would get through either
+				if sent > 0 {
+					return nil
+				}
+				return err
+			}
+			lastErr = err
+			continue
+		}
+		sent++
+		logger.Debug("packet sent", zap.Int("attempt", i+1), zap.Int("repeat", t.Repeat), zap.Int("size", packetSize(t, opts)))
+	}
+	if sent > 0 {
+		return nil
+	}
+	return lastErr
+}
+
+// attemptTarget returns t as the packet of the given attempt, counted from
+// 0, is sent to it: at the attempt's turn of the retry ports, if any.
+func attemptTarget(t Target, opts sendOptions, attempt int) Target {
+	if len(opts.RetryPorts) > 0 {
+		t.Port = opts.RetryPorts[attempt%len(opts.RetryPorts)]
+	}
+	return t
+}
+
+// validateRetryPorts checks that ports are valid and distinct.
+func validateRetryPorts(ports []int) error {
+	seen := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid retry_ports port %d", port)
+		}
+		if seen[port] {
+			return fmt.Errorf("retry_ports lists port %d twice", port)
+		}
+		seen[port] = true
+	}
+	return nil
+}
+
+// sleepCtx pauses for d, returning early with ctx's error if it is cancelled.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// sendWOL sends one magic packet for the target over each transport and,
+// if configured, to the broadcast address, or hands it to the relay.
+// Errors are WakeErrors of the failure's category, or context errors;
+// failures to determine the MAC wrap a macResolveError.
+//
+// When an "auto" MAC is missing from the neighbor table but was seen
+// before, and a broadcast address is configured, the packet goes only to
+// the broadcast address: a sleeping host often drops out of the table, and
+// unicast to it then wouldn't arrive anyway.
+//
+// With max_lifetime_packets, only a packet that went out is counted.
+func sendWOL(ctx context.Context, t Target, opts sendOptions) error {
+	if opts.Fuse == nil {
+		return sendPacket(ctx, t, opts)
+	}
+	if err := opts.Fuse.take(t); err != nil {
+		return err
+	}
+	err := sendPacket(ctx, t, opts)
+	opts.Fuse.settle(t, err == nil)
+	return err
+}
+
+// Send sends one magic packet for t over UDP, as a handler without
+// settings of its own would, for code embedding the module. A failure is
+// a *WakeError of its category, or ctx's error.
+func Send(ctx context.Context, t Target) error {
+	return sendWOL(ctx, t, sendOptions{}.withDefaults())
+}
+
+// sendPacket is sendWOL without max_lifetime_packets.
+func sendPacket(ctx context.Context, t Target, opts sendOptions) error {
+	if opts.VRF != "" {
+		t = inVRF(t, opts.VRF)
+	}
+	start := time.Now()
+	if opts.SlowSend > 0 {
+		var phases *sendPhases
+		ctx, phases = withSendPhases(ctx)
+		defer phases.logIfSlow(t, start, opts)
+	}
+	// Only lookups are observed; IP literals take no time to resolve
+	lookup := t.SRV != "" || t.MDNS != "" || (t.IP != "" && net.ParseIP(t.IP) == nil)
+	if t.SRV != "" {
+		var err error
+		if t, err = resolveSRVTarget(ctx, t); err != nil {
+			return wakeError(ErrResolve, err)
+		}
+	}
+	if t.MDNS != "" {
+		ip, err := opts.MDNSCache.resolve(ctx, t.MDNS, opts.MDNSTimeout, opts.MDNSTTL)
+		switch {
+		case err == nil:
+			t.IP = ip.String()
+		case len(opts.Broadcasts) == 0:
+			return wakeError(ErrResolve, hostResolveError{fmt.Errorf("mDNS: %w", err)})
+		default:
+			// The broadcast still reaches the host without its address
+		}
+	}
+	port := portOrDefault(t.Port)
+	var addr *net.UDPAddr
+	if t.IP != "" {
+		var err error
+		addr, err = resolveUDPAddr(ctx, t.IP, port, opts.ResolveRetries, opts.ResolveBackoff, opts.Prefer)
+		if err != nil {
+			return wakeError(ErrResolve, err)
+		}
+	}
+	if lookup {
+		observePhase(ctx, phaseResolve, start)
+	}
+
+	if isMACPattern(t.MAC) {
+		return sendMACPattern(ctx, t, port, opts)
+	}
+	hw, unicast, err := targetMAC(t, addr, opts)
+	if err != nil {
+		kind := ErrResolve
+		if _, parseErr := t.hardwareAddr(); t.MAC != autoMAC && parseErr != nil {
+			kind = ErrParseMAC
+		}
+		return wakeError(kind, macResolveError{err})
+	}
+	if len(opts.Sites) > 0 {
+		return sendSites(ctx, hw, t, opts)
+	}
+	if len(opts.Relays) > 0 {
+		return sendRelays(ctx, hw, t, opts)
+	}
+	packet, err := buildPacket(t, hw, opts)
+	if err != nil {
+		return err
+	}
+	logPacket(opts, t, addr, packet)
+
+	var errs []error
+	if opts.HelperSocket != "" {
+		for _, h := range helperDestinations(t, addr, port, unicast, opts) {
+			recordHelperDelivery(ctx, h, hw, len(packet))
+			errs = append(errs, deliveryError(sendHelper(ctx, opts.HelperSocket, h, packet, opts.SendTimeout)))
+		}
+		return errors.Join(errs...)
+	}
+	if unicast && !opts.SkipUnicast {
+		for _, transport := range opts.Transports {
+			dest := rawInterface(t, opts)
+			if transport != transportRawEthernet && addr != nil {
+				dest = addr.String()
+			}
+			if !claimSend(ctx, transport, hw.String(), dest) {
+				// Another handler of the request sent it there already
+				continue
+			}
+			if transport == transportRawEthernet {
+				recordDelivery(ctx, delivery{dest: hw.String(), transport: transport, iface: rawInterface(t, opts), bytes: len(packet)})
+			} else if addr != nil {
+				recordDelivery(ctx, delivery{dest: addr.String(), transport: transport, iface: t.Interface, bytes: len(packet)})
+			}
+			switch {
+			case transport == transportRawEthernet:
+				errs = append(errs, deliveryError(rawEthernetSend(rawInterface(t, opts), packet)))
+			case addr == nil:
+			case transport == protocolTCP:
+				errs = append(errs, deliveryError(writeTCP(ctx, addr, packet, opts.SendTimeout, t.Interface)))
+			case transport == protocolUDP && t.Interface != "":
+				errs = append(errs, deliveryError(writeOnInterface(ctx, t.Interface, addr, packet, t.TTL)))
+			case transport == protocolUDP && (opts.SourcePorts != nil || t.TTL != 0):
+				errs = append(errs, deliveryError(writeUDPFrom(ctx, opts.SourcePorts, t.key(), addr, packet, t.TTL)))
+			default:
+				errs = append(errs, deliveryError(sendCustom(ctx, transport, addr, packet, opts)))
+			}
+		}
+	}
+	for _, broadcast := range opts.Broadcasts {
+		if !claimSend(ctx, "broadcast", hw.String(), broadcast) {
+			continue
+		}
+		errs = append(errs, deliveryError(sendTargetBroadcast(ctx, t, broadcast, port, packet, opts)))
+	}
+	return errors.Join(errs...)
+}
+
+// targetMAC returns the MAC to wake for t from the first of its MAC
+// sources that has one, failing with the sources' errors if none does.
+// unicast is false when only the broadcast address should be sent to.
+func targetMAC(t Target, addr *net.UDPAddr, opts sendOptions) (hw net.HardwareAddr, unicast bool, err error) {
+	var errs []error
+	for _, name := range opts.sourceNames() {
+		hw, unicast, err := macSources[name].lookupMAC(t, addr, opts)
+		if hw != nil {
+			return hw, unicast, err
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil, false, errors.New("no MAC source has an entry for the target")
+	case 1:
+		return nil, false, errs[0]
+	}
+	return nil, false, errors.Join(errs...)
+}
+
+// defaultWarnSize is the packet size above which a warning about possible
+// fragmentation is logged. Well below any common MTU, so anything larger
+// than a magic packet's usual size stands out.
+const defaultWarnSize = 512
+
+// magicPacketSize returns the size in bytes of the magic packet.
+func magicPacketSize() int {
+	return 6 + 16*6
+}
+
+// buildMagicPacket builds the magic packet for hw: 6 x 0xFF followed by the
+// MAC repeated 16 times.
+func buildMagicPacket(hw net.HardwareAddr) []byte {
+	packet := make([]byte, magicPacketSize())
+	for i := 0; i < 6; i++ {
+		packet[i] = 0xFF
+	}
+	for i := 0; i < 16; i++ {
+		copy(packet[6+i*6:], hw)
+	}
+	return packet
+}
+
+// maxPacketSize is the largest packet built unless allow_large_packet is
+// set: the UDP payload that fits a 1500-byte Ethernet MTU over IPv4.
+const maxPacketSize = 1472
+
+// maxLargePacketSize is the largest packet built with allow_large_packet:
+// the largest UDP payload over IPv4.
+const maxLargePacketSize = 65507
+
+// padPacket appends zero bytes to packet up to n bytes, for NICs that
+// ignore short frames. Longer packets are returned unchanged.
+func padPacket(packet []byte, n int) []byte {
+	if len(packet) >= n {
+		return packet
+	}
+	return append(packet, make([]byte, n-len(packet))...)
+}
+
+// sendUDP delivers payload as a single datagram to host:port, from the
+// VRF if one is set.
+func sendUDP(ctx context.Context, host string, port int, payload []byte, opts sendOptions) error {
+	start := time.Now()
+	addr, err := resolveUDPAddr(ctx, host, port, opts.ResolveRetries, opts.ResolveBackoff, opts.Prefer)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		observePhase(ctx, phaseResolve, start)
+	}
+	if opts.VRF != "" {
+		return writeOnInterface(ctx, opts.VRF, addr, payload, 0)
+	}
+	return writeUDP(ctx, addr, payload)
+}
+
+// writeUDPFrom is writeUDP from the target's pinned source port, if a
+// source port range is configured, with the target's ttl if set.
+func writeUDPFrom(ctx context.Context, ports *sourcePorts, key string, addr *net.UDPAddr, payload []byte, ttl int) error {
+	switch classifyDest(addr.IP) {
+	case destBroadcast:
+		return writeBroadcast(ctx, ports, key, addr, payload, ttl)
+	case destMulticast:
+		return writeMulticast(ctx, ports, key, addr, payload, ttl)
+	}
+	return writeConnected(ctx, ports, key, addr, payload, ttl)
+}
+
+// writeConnected dials addr, from the pinned source port if ports is set,
+// and writes payload as a single datagram.
+func writeConnected(ctx context.Context, ports *sourcePorts, key string, addr *net.UDPAddr, payload []byte, ttl int) error {
+	start := time.Now()
+	var conn *net.UDPConn
+	var err error
+	if ports != nil {
+		conn, err = ports.dial(key, addr)
+	} else {
+		conn, err = net.DialUDP("udp", nil, addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := setTTL(conn, addr.IP, ttl); err != nil {
+		return err
+	}
+	observePhase(ctx, phaseDial, start)
+
+	start = time.Now()
+	defer observePhase(ctx, phaseWrite, start)
+	return writeAll(conn, payload)
+}
+
+// writeAll writes payload in one call and fails on a short write: a
+// truncated magic packet wakes nothing, so it must not count as sent.
+func writeAll(w io.Writer, payload []byte) error {
+	n, err := w.Write(payload)
+	if err != nil {
+		return err
+	}
+	return checkWritten(n, len(payload))
+}
+
+// checkWritten returns io.ErrShortWrite unless all want bytes were written.
+func checkWritten(n, want int) error {
+	if n != want {
+		return fmt.Errorf("%w: wrote %d of %d bytes", io.ErrShortWrite, n, want)
+	}
+	return nil
+}
+
+// writeUDP writes payload to addr as a single datagram: on a dialed socket,
+// or on an unconnected one when addr is a broadcast or multicast address.
+func writeUDP(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
+	return writeUDPFrom(ctx, nil, "", addr, payload, 0)
+}
+
+// writeTCP connects to addr and writes payload, for devices that only
+// accept the magic packet over TCP. timeout bounds both steps. With
+// ifname, the connection is made through that interface only.
+func writeTCP(ctx context.Context, addr *net.UDPAddr, payload []byte, timeout time.Duration, ifname string) error {
+	start := time.Now()
+	dialer, err := interfaceDialer(ifname, addr, timeout)
+	if err != nil {
+		return err
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr.AddrPort().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	observePhase(ctx, phaseDial, start)
+
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	start = time.Now()
+	defer observePhase(ctx, phaseWrite, start)
+	return writeAll(conn, payload)
+}
+
+// hostResolveError marks a failed lookup of a target's host name. Nothing
+// about it is cached: the next send looks the name up again, so a host
+// that stops resolving, or moves to another address, is picked up as soon
+// as DNS answers again.
+type hostResolveError struct {
+	err error
+}
+
+func (e hostResolveError) Error() string { return "resolving host: " + e.err.Error() }
+func (e hostResolveError) Unwrap() error { return e.err }
+
+// IP families a hostname's addresses can be preferred from.
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+	familyBoth = "both"
+)
+
+// ipPreference picks among the addresses a hostname resolves to: from
+// family first ("" for IPv4, like net.ResolveUDPAddr; "both" for the
+// resolver's order), and with only, from nothing else.
+type ipPreference struct {
+	family string
+	only   bool
+}
+
+// validateIPPreference checks a prefer family and whether it may be
+// exclusive.
+func validateIPPreference(family string, only bool) error {
+	switch family {
+	case "", familyIPv4, familyIPv6:
+	case familyBoth:
+		if only {
+			return errors.New("prefer both can't be only")
+		}
+	default:
+		return fmt.Errorf("invalid prefer %q (want ipv4, ipv6 or both)", family)
+	}
+	if only && family == "" {
+		return errors.New("prefer_only needs prefer ipv4 or ipv6")
+	}
+	return nil
+}
+
+// pick returns the address to send to among addrs, in the order the resolver
+// returned them, or false if none is acceptable.
+func (p ipPreference) pick(addrs []net.IPAddr) (net.IPAddr, bool) {
+	if p.family == familyBoth {
+		return addrs[0], true
+	}
+	wantV4 := p.family != familyIPv6
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == wantV4 {
+			return a, true
+		}
+	}
+	if p.only {
+		return net.IPAddr{}, false
+	}
+	return addrs[0], true
+}
+
+// resolveUDPAddr resolves host to a UDP address, retrying failed lookups up to
+// retries times with exponential backoff. When the host has several
+// addresses, prefer picks among them. IP literals skip the resolver,
+// so the zone of a link-local IPv6 address like fe80::1%eth0 is kept as
+// given and the packet leaves through that interface. Lookup failures are
+// returned as hostResolveError.
+func resolveUDPAddr(ctx context.Context, host string, port, retries int, backoff time.Duration, prefer ipPreference) (*net.UDPAddr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+	}
+	for attempt := 0; ; attempt++ {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err == nil && len(addrs) > 0 {
+			best, ok := prefer.pick(addrs)
+			if !ok {
+				// Another lookup won't change the families the name has
+				return nil, hostResolveError{fmt.Errorf("no %s addresses found for %q", prefer.family, host)}
+			}
+			return &net.UDPAddr{IP: best.IP, Port: port, Zone: best.Zone}, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no addresses found for %q", host)
+		}
+		if attempt >= retries {
+			return nil, hostResolveError{err}
+		}
+		if err := sleepCtx(ctx, resolveDelay(backoff, attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Bounds of the lookup retries: the most a handler may make, and the
+// longest wait between two of them.
+const (
+	maxResolveRetries = 100
+	maxResolveBackoff = 30 * time.Second
+)
+
+// resolveDelay returns the wait before retrying a lookup that failed for
+// the attempt'th time, counted from 0: backoff doubled per attempt, up to
+// maxResolveBackoff.
+func resolveDelay(backoff time.Duration, attempt int) time.Duration {
+	return min(backoff<<min(attempt, 16), maxResolveBackoff)
+}
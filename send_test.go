@@ -0,0 +1,1103 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// tcpHost is a TCP listener standing in for a host that is up, counting
+// the connections made to it.
+type tcpHost struct {
+	ln    net.Listener
+	conns atomic.Int32
+}
+
+// newTCPHost listens on a free loopback port until the test ends.
+func newTCPHost(t *testing.T) *tcpHost {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &tcpHost{ln: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			h.conns.Add(1)
+			c.Close()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return h
+}
+
+// addr returns the host:port the host listens on.
+func (h *tcpHost) addr() string {
+	return h.ln.Addr().String()
+}
+
+// port returns the port the host listens on.
+func (h *tcpHost) port() int {
+	return h.ln.Addr().(*net.TCPAddr).Port
+}
+
+// expectConns fails the test unless the host gets exactly n connections.
+func (h *tcpHost) expectConns(t *testing.T, n int32) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for h.conns.Load() < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Leave any connection beyond n the time to show up
+	time.Sleep(50 * time.Millisecond)
+	if got := h.conns.Load(); got != n {
+		t.Errorf("host got %d connections, want %d", got, n)
+	}
+}
+
+// closedPort returns a loopback TCP port nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+func TestSendRepeated(t *testing.T) {
+	tests := []struct {
+		name      string
+		repeat    int
+		ports     func(open int) []int
+		probe     bool
+		wantErr   bool
+		wantConns int32
+	}{
+		{
+			name:      "all delivered",
+			repeat:    2,
+			ports:     func(open int) []int { return []int{open} },
+			wantConns: 2,
+		},
+		{
+			name:      "one transient failure",
+			repeat:    2,
+			ports:     func(open int) []int { return []int{closedPort(t), open} },
+			wantConns: 1,
+		},
+		{
+			name:    "nothing delivered",
+			repeat:  2,
+			ports:   func(int) []int { return []int{closedPort(t)} },
+			wantErr: true,
+		},
+		{
+			// The failed first packet doesn't stop the probe after the
+			// second from ending the repeats early
+			name:      "probe after a failure",
+			repeat:    6,
+			ports:     func(open int) []int { return []int{closedPort(t), open} },
+			probe:     true,
+			wantConns: 2, // the packet and the probe
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newTCPHost(t)
+			w := &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Protocol: protocolTCP, Repeat: tt.repeat, RetryPorts: tt.ports(host.port())}
+			if tt.probe {
+				w.RetryProbe = host.addr()
+			}
+			w = provisionTest(t, w)
+			err := sendRepeated(t.Context(), w.targets()[0], w.sendOptions(), w.logger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendRepeated = %v, want error %v", err, tt.wantErr)
+			}
+			host.expectConns(t, tt.wantConns)
+		})
+	}
+}
+
+func TestValidateRetryPorts(t *testing.T) {
+	tests := []struct {
+		ports   []int
+		wantErr bool
+	}{
+		{ports: []int{7, 9}},
+		{ports: []int{0}, wantErr: true},
+		{ports: []int{65536}, wantErr: true},
+		{ports: []int{9, 9}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.ports), func(t *testing.T) {
+			if err := validateRetryPorts(tt.ports); (err != nil) != tt.wantErr {
+				t.Errorf("validateRetryPorts(%v) = %v, want error %v", tt.ports, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPortsConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []int
+		wantErr bool
+	}{
+		{input: "retry_ports 9", want: []int{9}},
+		{input: "retry_ports 9 7 40000", want: []int{9, 7, 40000}},
+		{input: "retry_ports", wantErr: true},
+		{input: "retry_ports nine", wantErr: true},
+		{input: "retry_ports 9 0", wantErr: true},
+		{input: "retry_ports 9 7 9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\trepeat 3\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && fmt.Sprint(w.RetryPorts) != fmt.Sprint(tt.want) {
+				t.Errorf("retry_ports = %v, want %v", w.RetryPorts, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttemptTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []int
+		want  []int
+	}{
+		{name: "none", want: []int{9, 9, 9, 9}},
+		{name: "one", ports: []int{7}, want: []int{7, 7, 7, 7}},
+		{name: "cycle", ports: []int{9, 7, 40000}, want: []int{9, 7, 40000, 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for attempt, want := range tt.want {
+				got := attemptTarget(Target{MAC: testMAC, Port: 9}, sendOptions{RetryPorts: tt.ports}, attempt)
+				if got.Port != want {
+					t.Errorf("attempt %d: port %d, want %d", attempt, got.Port, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTPRetryPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		repeat  int
+		untilUp bool
+		// index in the retry ports of each packet's port
+		want []int
+	}{
+		{name: "fewer than the ports", repeat: 2, want: []int{0, 1}},
+		{name: "cycle", repeat: 5, want: []int{0, 1, 2, 0, 1}},
+		{name: "send_until_up", untilUp: true, want: []int{0, 1, 2, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &recordingSender{}
+			ports := []int{closedPort(t), closedPort(t), closedPort(t)}
+			w := &WakeOnLAN{
+				MAC:        testMAC,
+				IP:         "127.0.0.1",
+				Repeat:     tt.repeat,
+				Interval:   caddy.Duration(10 * time.Millisecond),
+				RetryPorts: ports,
+				Transports: []string{registerTestSender(t, sender)},
+			}
+			if tt.untilUp {
+				w.SendUntilUp = &SendUntilUp{
+					Interval:    caddy.Duration(10 * time.Millisecond),
+					MaxPackets:  len(tt.want),
+					MaxDuration: caddy.Duration(500 * time.Millisecond),
+					Probe:       fmt.Sprintf("127.0.0.1:%d", closedPort(t)),
+				}
+				w.CheckTimeout = caddy.Duration(10 * time.Millisecond)
+			}
+			provisionTest(t, w)
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			sends := sender.recorded()
+			if len(sends) != len(tt.want) {
+				t.Fatalf("sent %d packets, want %d", len(sends), len(tt.want))
+			}
+			for i, s := range sends {
+				if want := fmt.Sprintf("127.0.0.1:%d", ports[tt.want[i]]); s.dest != want {
+					t.Errorf("packet %d sent to %s, want %s", i+1, s.dest, want)
+				}
+			}
+		})
+	}
+}
+
+// fakeDNS is a DNS server the default resolver asks for the rest of a
+// test, answering from a function of the question and how many times a
+// question of its name and type came before.
+type fakeDNS struct {
+	answer func(name string, typ dnsmessage.Type, n int) ([]net.IP, dnsmessage.RCode)
+
+	mu   sync.Mutex
+	seen map[string]int
+}
+
+// newFakeDNS starts a DNS server answering with answer and points
+// net.DefaultResolver at it until the test ends.
+func newFakeDNS(t *testing.T, answer func(name string, typ dnsmessage.Type, n int) ([]net.IP, dnsmessage.RCode)) *fakeDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDNS{answer: answer, seen: make(map[string]int)}
+	go d.serve(conn)
+	orig := net.DefaultResolver
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp4", conn.LocalAddr().String())
+		},
+	}
+	t.Cleanup(func() {
+		net.DefaultResolver = orig
+		conn.Close()
+	})
+	return d
+}
+
+// queries returns how many questions of name and type were asked.
+func (d *fakeDNS) queries(name string, typ dnsmessage.Type) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seen[name+" "+typ.String()]
+}
+
+func (d *fakeDNS) serve(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 {
+			continue
+		}
+		q := msg.Questions[0]
+		name := q.Name.String()
+		d.mu.Lock()
+		key := name + " " + q.Type.String()
+		seen := d.seen[key]
+		d.seen[key]++
+		d.mu.Unlock()
+		ips, rcode := d.answer(name, q.Type, seen)
+
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: msg.ID, Response: true, Authoritative: true, RCode: rcode},
+			Questions: msg.Questions,
+		}
+		for _, ip := range ips {
+			h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			switch ip4 := ip.To4(); {
+			case q.Type == dnsmessage.TypeA && ip4 != nil:
+				h.Type = dnsmessage.TypeA
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: [4]byte(ip4)}})
+			case q.Type == dnsmessage.TypeAAAA && ip4 == nil:
+				h.Type = dnsmessage.TypeAAAA
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}})
+			}
+		}
+		out, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		conn.WriteTo(out, addr)
+	}
+}
+
+func TestResolveUDPAddrRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing int
+		retries int
+		wantErr bool
+	}{
+		{name: "no failure", retries: 0},
+		{name: "failure without retries", failing: 1, retries: 0, wantErr: true},
+		{name: "failure then success", failing: 2, retries: 2},
+		{name: "more failures than retries", failing: 3, retries: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every lookup asks for A once, and fails while it is refused
+			dns := newFakeDNS(t, func(_ string, typ dnsmessage.Type, n int) ([]net.IP, dnsmessage.RCode) {
+				if typ == dnsmessage.TypeA && n < tt.failing {
+					return nil, dnsmessage.RCodeNameError
+				}
+				if typ == dnsmessage.TypeA {
+					return []net.IP{net.IPv4(192, 0, 2, 10)}, dnsmessage.RCodeSuccess
+				}
+				return nil, dnsmessage.RCodeSuccess
+			})
+			addr, err := resolveUDPAddr(t.Context(), "nas.test.", 9, tt.retries, time.Millisecond, ipPreference{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveUDPAddr error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && addr.String() != "192.0.2.10:9" {
+				t.Errorf("resolved %s, want 192.0.2.10:9", addr)
+			}
+			if got, want := dns.queries("nas.test.", dnsmessage.TypeA), min(tt.failing, tt.retries)+1; got != want {
+				t.Errorf("looked up %d times, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestResolveUDPAddrBackoff(t *testing.T) {
+	newFakeDNS(t, func(string, dnsmessage.Type, int) ([]net.IP, dnsmessage.RCode) {
+		return nil, dnsmessage.RCodeNameError
+	})
+	// Waits of 20ms and 40ms between the three lookups
+	start := time.Now()
+	if _, err := resolveUDPAddr(t.Context(), "nas.test.", 9, 2, 20*time.Millisecond, ipPreference{}); err == nil {
+		t.Fatal("resolved a name that doesn't exist")
+	}
+	if took := time.Since(start); took < 60*time.Millisecond {
+		t.Errorf("gave up after %s, want the backoff to take at least 60ms", took)
+	}
+
+	// A cancelled lookup doesn't wait the backoff out
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := resolveUDPAddr(ctx, "nas.test.", 9, 5, time.Second, ipPreference{}); err == nil {
+		t.Fatal("resolved a name that doesn't exist")
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("returned after %s, want about 30ms", took)
+	}
+}
+
+func TestResolveDelay(t *testing.T) {
+	// Many retries never wait less than the backoff, nor more than the
+	// cap, however far the doubling would go
+	for _, backoff := range []time.Duration{time.Millisecond, 250 * time.Millisecond, time.Minute} {
+		prev := time.Duration(0)
+		for attempt := range maxResolveRetries * 10 {
+			d := resolveDelay(backoff, attempt)
+			if d < min(backoff, maxResolveBackoff) || d > maxResolveBackoff || d < prev {
+				t.Fatalf("resolveDelay(%s, %d) = %s after %s, want it between %s and %s and not shrinking",
+					backoff, attempt, d, prev, backoff, maxResolveBackoff)
+			}
+			prev = d
+		}
+	}
+	if got, want := resolveDelay(20*time.Millisecond, 2), 80*time.Millisecond; got != want {
+		t.Errorf("resolveDelay(20ms, 2) = %s, want %s", got, want)
+	}
+}
+
+func TestResolveRetriesConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    WakeOnLAN
+		wantErr bool
+	}{
+		{
+			name:  "set",
+			input: "wake_on_lan 00:11:22:33:44:55 192.0.2.1 {\n\tresolve_retries 3\n\tresolve_backoff 200ms\n}",
+			want:  WakeOnLAN{ResolveRetries: 3, ResolveBackoff: caddy.Duration(200 * time.Millisecond)},
+		},
+		{name: "negative retries", input: "wake_on_lan 00:11:22:33:44:55 192.0.2.1 {\n\tresolve_retries -1\n}", wantErr: true},
+		{name: "too many retries", input: "wake_on_lan 00:11:22:33:44:55 192.0.2.1 {\n\tresolve_retries 1000\n}", wantErr: true},
+		{name: "invalid backoff", input: "wake_on_lan 00:11:22:33:44:55 192.0.2.1 {\n\tresolve_backoff soon\n}", wantErr: true},
+		{name: "missing count", input: "wake_on_lan 00:11:22:33:44:55 192.0.2.1 {\n\tresolve_retries\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (w.ResolveRetries != tt.want.ResolveRetries || w.ResolveBackoff != tt.want.ResolveBackoff) {
+				t.Errorf("resolve_retries %d, resolve_backoff %s; want %d, %s", w.ResolveRetries, time.Duration(w.ResolveBackoff), tt.want.ResolveRetries, time.Duration(tt.want.ResolveBackoff))
+			}
+		})
+	}
+}
+
+func TestServeHTTPResolveRetries(t *testing.T) {
+	host := newFakeHost(t)
+	var failing atomic.Bool
+	newFakeDNS(t, func(_ string, typ dnsmessage.Type, n int) ([]net.IP, dnsmessage.RCode) {
+		if typ != dnsmessage.TypeA {
+			return nil, dnsmessage.RCodeSuccess
+		}
+		if failing.Load() && n%2 == 1 {
+			// Every other lookup fails once the handler runs
+			return nil, dnsmessage.RCodeNameError
+		}
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, dnsmessage.RCodeSuccess
+	})
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "nas.test.", Port: host.port(), ResolveRetries: 1, Required: true})
+	failing.Store(true)
+	for i := 0; i < 3; i++ {
+		rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		if got := statusOf(rec, err); got != http.StatusNoContent {
+			t.Fatalf("request %d: status %d, want %d", i+1, got, http.StatusNoContent)
+		}
+		host.expect(t, 1)
+	}
+}
+
+// tcpReceiver listens on a free loopback port until the test ends,
+// returning its port and everything each connection to it sent.
+func tcpReceiver(t *testing.T) (int, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan []byte, 16)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetReadDeadline(time.Now().Add(2 * time.Second))
+				b, _ := io.ReadAll(c)
+				received <- b
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, received
+}
+
+func TestProtocolConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    WakeOnLAN
+		wantErr bool
+	}{
+		{name: "tcp", input: "protocol tcp\n\tsend_timeout 2s", want: WakeOnLAN{Protocol: protocolTCP, SendTimeout: caddy.Duration(2 * time.Second)}},
+		{name: "udp", input: "protocol udp", want: WakeOnLAN{Protocol: protocolUDP}},
+		{name: "unknown", input: "protocol sctp", wantErr: true},
+		{name: "missing", input: "protocol", wantErr: true},
+		{name: "tcp with broadcast", input: "protocol tcp\n\tbroadcast 192.168.1.255", wantErr: true},
+		{name: "invalid send_timeout", input: "send_timeout soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (w.Protocol != tt.want.Protocol || w.SendTimeout != tt.want.SendTimeout) {
+				t.Errorf("protocol %q, send_timeout %s; want %q, %s", w.Protocol, time.Duration(w.SendTimeout), tt.want.Protocol, time.Duration(tt.want.SendTimeout))
+			}
+		})
+	}
+}
+
+func TestServeHTTPProtocolTCP(t *testing.T) {
+	port, received := tcpReceiver(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port, Protocol: protocolTCP, SendTimeout: caddy.Duration(time.Second)})
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	hw, _ := parseMAC(testMAC)
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, buildMagicPacket(hw)) {
+			t.Errorf("received % x, want the magic packet", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing received over TCP")
+	}
+}
+
+// linkLocalAddr returns a link-local IPv6 address of a local interface,
+// zoned with its name, skipping the test if there is none.
+func linkLocalAddr(t *testing.T) netip.Addr {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			n, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(n.IP); ok && ip.Is6() && ip.IsLinkLocalUnicast() {
+				return ip.WithZone(iface.Name)
+			}
+		}
+	}
+	t.Skip("no interface has a link-local IPv6 address")
+	return netip.Addr{}
+}
+
+func TestResolveUDPAddrZone(t *testing.T) {
+	tests := []struct {
+		host     string
+		wantIP   string
+		wantZone string
+	}{
+		{host: "fe80::1%eth0", wantIP: "fe80::1", wantZone: "eth0"},
+		{host: "fe80::1%2", wantIP: "fe80::1", wantZone: "2"},
+		{host: "fe80::1", wantIP: "fe80::1"},
+		{host: "192.0.2.1", wantIP: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			addr, err := resolveUDPAddr(t.Context(), tt.host, 9, 0, 0, ipPreference{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.IP.String() != tt.wantIP || addr.Zone != tt.wantZone || addr.Port != 9 {
+				t.Errorf("resolved %s, want IP %s, zone %q, port 9", addr, tt.wantIP, tt.wantZone)
+			}
+		})
+	}
+}
+
+func TestServeHTTPLinkLocal(t *testing.T) {
+	// A link-local address only routes with its zone, so the packet only
+	// arrives if the zone is kept all the way to the socket
+	ip := linkLocalAddr(t)
+	conn, err := net.ListenUDP("udp6", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", ip, err)
+	}
+	defer conn.Close()
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: ip.String(), Port: conn.LocalAddr().(*net.UDPAddr).Port, Required: true})
+
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hw, _ := parseMAC(testMAC)
+	if !bytes.Equal(buf[:n], buildMagicPacket(hw)) {
+		t.Errorf("got % x, want the magic packet for %s", buf[:n], testMAC)
+	}
+}
+
+func TestPadPacket(t *testing.T) {
+	hw, _ := parseMAC(testMAC)
+	magic := buildMagicPacket(hw)
+	tests := []struct {
+		padTo int
+		want  int
+	}{
+		{padTo: 0, want: 102},
+		{padTo: 64, want: 102},
+		{padTo: 102, want: 102},
+		{padTo: 144, want: 144},
+		{padTo: 1472, want: 1472},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.padTo), func(t *testing.T) {
+			got := padPacket(bytes.Clone(magic), tt.padTo)
+			if len(got) != tt.want {
+				t.Errorf("padded to %d bytes, want %d", len(got), tt.want)
+			}
+			if !bytes.Equal(got[:len(magic)], magic) {
+				t.Error("padding changed the magic packet")
+			}
+			if tail := got[len(magic):]; !bytes.Equal(tail, make([]byte, len(tail))) {
+				t.Errorf("padded with % x, want zeros", tail)
+			}
+		})
+	}
+}
+
+func TestPadToConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{input: "pad_to 144", want: 144},
+		{input: "pad_to 1472", want: 1472},
+		{input: "pad_to 1473", wantErr: true},
+		{input: "pad_to 1473\n\tallow_large_packet", want: 1473},
+		{input: "pad_to -1", wantErr: true},
+		{input: "pad_to", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.PadTo != tt.want {
+				t.Errorf("pad_to = %d, want %d", w.PadTo, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPPadTo(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), PadTo: 256})
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	hw, _ := parseMAC(testMAC)
+	magic := buildMagicPacket(hw)
+	p := host.expect(t, 1)[0]
+	if len(p) != 256 {
+		t.Errorf("got a %d-byte packet, want 256", len(p))
+	}
+	if !bytes.HasPrefix(p, magic) {
+		t.Errorf("got % x, want it to start with the magic packet", p)
+	}
+}
+
+func TestServeHTTPResolveChanges(t *testing.T) {
+	// The name moves between two addresses on the same port and fails to
+	// resolve in between; each request uses the answer of the moment
+	first := newFakeHost(t)
+	second, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: first.port()})
+	if err != nil {
+		t.Skipf("can't listen on 127.0.0.2: %v", err)
+	}
+	defer second.Close()
+
+	var answer atomic.Value
+	answer.Store("127.0.0.1")
+	newFakeDNS(t, func(_ string, typ dnsmessage.Type, _ int) ([]net.IP, dnsmessage.RCode) {
+		ip := answer.Load().(string)
+		if ip == "" {
+			return nil, dnsmessage.RCodeNameError
+		}
+		if typ != dnsmessage.TypeA {
+			return nil, dnsmessage.RCodeSuccess
+		}
+		return []net.IP{net.ParseIP(ip)}, dnsmessage.RCodeSuccess
+	})
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "nas.test.", Port: first.port(), StatusHeader: "X-Wake-Result"})
+	logs := observeLogs(w)
+
+	tests := []struct {
+		answer     string
+		wantResult wakeResult
+	}{
+		{answer: "127.0.0.1", wantResult: resultSent},
+		{answer: "", wantResult: resultSendFailed},
+		{answer: "127.0.0.1", wantResult: resultSent},
+		{answer: "127.0.0.2", wantResult: resultSent},
+	}
+	for i, tt := range tests {
+		answer.Store(tt.answer)
+		rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		if got := rec.Header().Get("X-Wake-Result"); !strings.HasPrefix(got, string(tt.wantResult)+";") {
+			t.Errorf("request %d: result %q, want %s", i+1, got, tt.wantResult)
+		}
+		switch tt.answer {
+		case "127.0.0.1":
+			first.expect(t, 1)
+		case "127.0.0.2":
+			second.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := second.Read(make([]byte, 2048)); err != nil {
+				t.Errorf("request %d: nothing sent to the new address: %v", i+1, err)
+			}
+		}
+		first.expectNone(t)
+	}
+	if n := logs.FilterMessage("resolving wake-on-lan target; retrying on the next request").Len(); n != 1 {
+		t.Errorf("warned about %d failed lookups, want 1", n)
+	}
+}
+
+func TestResolveUDPAddrError(t *testing.T) {
+	newFakeDNS(t, func(string, dnsmessage.Type, int) ([]net.IP, dnsmessage.RCode) {
+		return nil, dnsmessage.RCodeNameError
+	})
+	_, err := resolveUDPAddr(t.Context(), "nas.test.", 9, 0, 0, ipPreference{})
+	var resolveErr hostResolveError
+	if !errors.As(err, &resolveErr) {
+		t.Errorf("error %v is not a hostResolveError", err)
+	}
+}
+
+func TestRetryProbeConfig(t *testing.T) {
+	tests := []struct {
+		input       string
+		wantProbe   string
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{input: "retry_probe 192.0.2.1:22", wantProbe: "192.0.2.1:22"},
+		{input: "retry_probe 192.0.2.1:22 250ms", wantProbe: "192.0.2.1:22", wantTimeout: 250 * time.Millisecond},
+		{input: "retry_probe", wantErr: true},
+		{input: "retry_probe 192.0.2.1:22 1s 2s", wantErr: true},
+		{input: "retry_probe 192.0.2.1:22 soon", wantErr: true},
+		{input: "retry_probe 192.0.2.1:22 -1s", wantErr: true},
+		{input: "retry_probe 192.0.2.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\trepeat 5\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (w.RetryProbe != tt.wantProbe || time.Duration(w.RetryProbeTimeout) != tt.wantTimeout) {
+				t.Errorf("retry_probe %q %s, want %q %s", w.RetryProbe, time.Duration(w.RetryProbeTimeout), tt.wantProbe, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRetryProbe(t *testing.T) {
+	tests := []struct {
+		name string
+		// packets after which the probe address comes up, 0 for never
+		upAfter     int
+		wantPackets int
+	}{
+		{name: "up after the first", upAfter: 1, wantPackets: 1},
+		{name: "up after the second", upAfter: 2, wantPackets: 2},
+		{name: "never up", wantPackets: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			probePort := closedPort(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:        testMAC,
+				IP:         "127.0.0.1",
+				Port:       host.port(),
+				Repeat:     5,
+				Interval:   caddy.Duration(100 * time.Millisecond),
+				RetryProbe: fmt.Sprintf("127.0.0.1:%d", probePort),
+			})
+
+			// Count the packets as they arrive, bringing the probe address
+			// up once the host has had upAfter of them
+			served, counted := make(chan struct{}), make(chan int)
+			go func(served <-chan struct{}) {
+				n := 0
+				var timeout <-chan time.Time
+				for {
+					select {
+					case <-host.packets:
+						n++
+						if n == tt.upAfter {
+							l, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", probePort))
+							if err != nil {
+								t.Error(err)
+							} else {
+								t.Cleanup(func() { l.Close() })
+							}
+						}
+					case <-served:
+						// Give the last packet time to arrive
+						served, timeout = nil, time.After(100*time.Millisecond)
+					case <-timeout:
+						counted <- n
+						return
+					}
+				}
+			}(served)
+
+			_, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			close(served)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-counted; got != tt.wantPackets {
+				t.Errorf("sent %d packets, want %d", got, tt.wantPackets)
+			}
+		})
+	}
+}
+
+// shortWriter accepts at most limit bytes per write, or fails with err.
+type shortWriter struct {
+	limit int
+	err   error
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return min(len(p), w.limit), nil
+}
+
+func TestWriteAll(t *testing.T) {
+	writeErr := errors.New("connection refused")
+	tests := []struct {
+		name      string
+		w         *shortWriter
+		wantErr   error
+		wantKind  error
+		wantWrote string
+	}{
+		{name: "full", w: &shortWriter{limit: 1 << 10}},
+		{name: "short", w: &shortWriter{limit: 40}, wantErr: io.ErrShortWrite, wantKind: ErrShortWrite, wantWrote: "wrote 40 of 102 bytes"},
+		{name: "nothing", w: &shortWriter{limit: 0}, wantErr: io.ErrShortWrite, wantKind: ErrShortWrite, wantWrote: "wrote 0 of 102 bytes"},
+		{name: "error", w: &shortWriter{err: writeErr}, wantErr: writeErr, wantKind: ErrWrite},
+	}
+	payload := make([]byte, 102)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := writeAll(tt.w, payload)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("writeAll: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("writeAll = %v, want %v", err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantWrote) {
+				t.Errorf("error %q does not mention %q", err, tt.wantWrote)
+			}
+			if kind := deliveryError(err); !errors.Is(kind, tt.wantKind) {
+				t.Errorf("deliveryError = %v, want kind %v", kind, tt.wantKind)
+			}
+		})
+	}
+}
+
+func TestCheckWritten(t *testing.T) {
+	tests := []struct {
+		n, want int
+		wantErr bool
+	}{
+		{n: 102, want: 102},
+		{n: 0, want: 0},
+		{n: 101, want: 102, wantErr: true},
+		{n: 103, want: 102, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := checkWritten(tt.n, tt.want)
+		if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, io.ErrShortWrite)) {
+			t.Errorf("checkWritten(%d, %d) = %v, want error %t", tt.n, tt.want, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIPPreferenceConfig(t *testing.T) {
+	tests := []struct {
+		input    string
+		want     string
+		wantOnly bool
+		wantErr  bool
+	}{
+		{input: "prefer ipv4", want: familyIPv4},
+		{input: "prefer ipv6", want: familyIPv6},
+		{input: "prefer both", want: familyBoth},
+		{input: "prefer ipv6 only", want: familyIPv6, wantOnly: true},
+		{input: "prefer both only", wantErr: true},
+		{input: "prefer ipv5", wantErr: true},
+		{input: "prefer ipv4 exclusively", wantErr: true},
+		{input: "prefer ipv4 only now", wantErr: true},
+		{input: "prefer", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (w.Prefer != tt.want || w.PreferOnly != tt.wantOnly) {
+				t.Errorf("prefer = %q, only %v, want %q, only %v", w.Prefer, w.PreferOnly, tt.want, tt.wantOnly)
+			}
+		})
+	}
+	if err := validateIPPreference("", true); err == nil {
+		t.Error("prefer_only without prefer accepted")
+	}
+}
+
+func TestIPPreferencePick(t *testing.T) {
+	v4, v6 := net.IPAddr{IP: net.ParseIP("192.0.2.10")}, net.IPAddr{IP: net.ParseIP("2001:db8::10")}
+	tests := []struct {
+		name   string
+		prefer ipPreference
+		addrs  []net.IPAddr
+		want   net.IP
+	}{
+		{name: "default", addrs: []net.IPAddr{v6, v4}, want: v4.IP},
+		{name: "ipv4", prefer: ipPreference{family: familyIPv4}, addrs: []net.IPAddr{v6, v4}, want: v4.IP},
+		{name: "ipv6", prefer: ipPreference{family: familyIPv6}, addrs: []net.IPAddr{v4, v6}, want: v6.IP},
+		{name: "both in resolver order", prefer: ipPreference{family: familyBoth}, addrs: []net.IPAddr{v6, v4}, want: v6.IP},
+		{name: "ipv6 falling back", prefer: ipPreference{family: familyIPv6}, addrs: []net.IPAddr{v4}, want: v4.IP},
+		{name: "ipv4 falling back", prefer: ipPreference{family: familyIPv4}, addrs: []net.IPAddr{v6}, want: v6.IP},
+		{name: "ipv6 only", prefer: ipPreference{family: familyIPv6, only: true}, addrs: []net.IPAddr{v4}},
+		{name: "ipv4 only", prefer: ipPreference{family: familyIPv4, only: true}, addrs: []net.IPAddr{v6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.prefer.pick(tt.addrs)
+			if ok != (tt.want != nil) {
+				t.Fatalf("picked %v, want %v", got.IP, tt.want)
+			}
+			if ok && !got.IP.Equal(tt.want) {
+				t.Errorf("picked %s, want %s", got.IP, tt.want)
+			}
+		})
+	}
+}
+
+// dualStackDNS answers for dual.test. with both families and for
+// v4.test. and v6.test. with one each.
+func dualStackDNS(t *testing.T, v4, v6 string) {
+	t.Helper()
+	newFakeDNS(t, func(name string, _ dnsmessage.Type, _ int) ([]net.IP, dnsmessage.RCode) {
+		switch name {
+		case "dual.test.":
+			return []net.IP{net.ParseIP(v4), net.ParseIP(v6)}, dnsmessage.RCodeSuccess
+		case "v4.test.":
+			return []net.IP{net.ParseIP(v4)}, dnsmessage.RCodeSuccess
+		case "v6.test.":
+			return []net.IP{net.ParseIP(v6)}, dnsmessage.RCodeSuccess
+		}
+		return nil, dnsmessage.RCodeNameError
+	})
+}
+
+func TestResolveUDPAddrPrefer(t *testing.T) {
+	dualStackDNS(t, "192.0.2.10", "2001:db8::10")
+	tests := []struct {
+		name    string
+		host    string
+		prefer  ipPreference
+		want    string
+		wantErr bool
+	}{
+		{name: "default", host: "dual.test.", want: "192.0.2.10"},
+		{name: "ipv4", host: "dual.test.", prefer: ipPreference{family: familyIPv4}, want: "192.0.2.10"},
+		{name: "ipv6", host: "dual.test.", prefer: ipPreference{family: familyIPv6}, want: "2001:db8::10"},
+		{name: "ipv6 falling back", host: "v4.test.", prefer: ipPreference{family: familyIPv6}, want: "192.0.2.10"},
+		{name: "ipv6 only", host: "v4.test.", prefer: ipPreference{family: familyIPv6, only: true}, wantErr: true},
+		{name: "ipv4 only", host: "v6.test.", prefer: ipPreference{family: familyIPv4, only: true}, wantErr: true},
+		{name: "literal against the preference", host: "192.0.2.1", prefer: ipPreference{family: familyIPv6, only: true}, want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := resolveUDPAddr(t.Context(), tt.host, 9, 0, 0, tt.prefer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveUDPAddr error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && addr.IP.String() != tt.want {
+				t.Errorf("resolved %s, want %s", addr.IP, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPPrefer(t *testing.T) {
+	// A fake host on each family's loopback address, on the same port
+	host := newFakeHost(t)
+	host6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback, Port: host.port()})
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer host6.Close()
+	dualStackDNS(t, "127.0.0.1", "::1")
+
+	tests := []struct {
+		name       string
+		host       string
+		prefer     string
+		only       bool
+		wantFamily string
+		wantResult wakeResult
+	}{
+		{name: "default", host: "dual.test.", wantFamily: familyIPv4, wantResult: resultSent},
+		{name: "ipv6", host: "dual.test.", prefer: familyIPv6, wantFamily: familyIPv6, wantResult: resultSent},
+		{name: "ipv6 falling back", host: "v4.test.", prefer: familyIPv6, wantFamily: familyIPv4, wantResult: resultSent},
+		{name: "ipv6 only", host: "v4.test.", prefer: familyIPv6, only: true, wantResult: resultSendFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:          testMAC,
+				IP:           tt.host,
+				Port:         host.port(),
+				Prefer:       tt.prefer,
+				PreferOnly:   tt.only,
+				StatusHeader: "X-Wake-Result",
+			})
+			rec, _, _ := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+
+			host6.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, _, err := host6.ReadFromUDP(make([]byte, 2048))
+			if got := err == nil; got != (tt.wantFamily == familyIPv6) {
+				t.Errorf("IPv6 host received a packet: %v, want %v", got, tt.wantFamily == familyIPv6)
+			}
+			if tt.wantFamily == familyIPv4 {
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+		})
+	}
+}
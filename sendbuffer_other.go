@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package caddy_wakeonlan
+
+// setSockSendBuffer is not implemented on this platform.
+func setSockSendBuffer(fd uintptr, n int) error {
+	return errSendBufferUnsupported
+}
+
+// sockSendBuffer is not implemented on this platform.
+func sockSendBuffer(fd uintptr) (int, error) {
+	return 0, errSendBufferUnsupported
+}
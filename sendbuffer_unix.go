@@ -0,0 +1,16 @@
+//go:build unix
+
+package caddy_wakeonlan
+
+import "golang.org/x/sys/unix"
+
+// setSockSendBuffer sets SO_SNDBUF on the socket.
+func setSockSendBuffer(fd uintptr, n int) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, n)
+}
+
+// sockSendBuffer reads SO_SNDBUF back. Linux reports twice the size set,
+// the rest being its bookkeeping.
+func sockSendBuffer(fd uintptr) (int, error) {
+	return unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package caddy_wakeonlan
+
+import "golang.org/x/sys/windows"
+
+// setSockSendBuffer sets SO_SNDBUF on the socket.
+func setSockSendBuffer(fd uintptr, n int) error {
+	return windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_SNDBUF, n)
+}
+
+// sockSendBuffer reads SO_SNDBUF back.
+func sockSendBuffer(fd uintptr) (int, error) {
+	return windows.GetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_SNDBUF)
+}
@@ -0,0 +1,78 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Sender delivers a magic packet over a custom transport. Plugins register
+// one under a name with RegisterSender, typically from an init function,
+// and configs select it by that name in transport or transports. dest is
+// the target's resolved address as host:port; Send must return once the
+// packet is handed off or ctx, bounded by send_timeout, is done.
+type Sender interface {
+	Send(ctx context.Context, packet []byte, dest string) error
+}
+
+var senders = struct {
+	sync.RWMutex
+	m map[string]Sender
+}{m: make(map[string]Sender)}
+
+func init() {
+	RegisterSender(protocolUDP, udpSender{})
+}
+
+// RegisterSender makes s available as the transport name. It panics if the
+// name is empty, reserved or already registered, like caddy.RegisterModule.
+func RegisterSender(name string, s Sender) {
+	if name == "" || s == nil {
+		panic("wake_on_lan: sender name and value required")
+	}
+	if name == protocolTCP || name == transportRawEthernet {
+		panic(fmt.Sprintf("wake_on_lan: transport %q is built in", name))
+	}
+	senders.Lock()
+	defer senders.Unlock()
+	if _, ok := senders.m[name]; ok {
+		panic(fmt.Sprintf("wake_on_lan: sender %q already registered", name))
+	}
+	senders.m[name] = s
+}
+
+// lookupSender returns the sender registered as name.
+func lookupSender(name string) (Sender, bool) {
+	senders.RLock()
+	defer senders.RUnlock()
+	s, ok := senders.m[name]
+	return s, ok
+}
+
+// udpSender is the built-in "udp" transport.
+type udpSender struct{}
+
+// Send writes packet to dest as a single datagram. dest is an IP literal,
+// so resolving it involves no lookup.
+func (udpSender) Send(ctx context.Context, packet []byte, dest string) error {
+	addr, err := net.ResolveUDPAddr("udp", dest)
+	if err != nil {
+		return err
+	}
+	return writeUDP(ctx, addr, packet)
+}
+
+// sendCustom sends packet to addr with the sender registered as name.
+func sendCustom(ctx context.Context, name string, addr *net.UDPAddr, packet []byte, opts sendOptions) error {
+	s, ok := lookupSender(name)
+	if !ok {
+		return fmt.Errorf("unknown transport %q", name)
+	}
+	if opts.SendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.SendTimeout)
+		defer cancel()
+	}
+	return s.Send(ctx, packet, addr.String())
+}
@@ -0,0 +1,165 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// recordingSender is an example of a custom transport: it records the
+// packets handed to it, failing with err, or blocking until the context is
+// done when block is set.
+type recordingSender struct {
+	mu    sync.Mutex
+	sends []recordedSend
+	err   error
+	block bool
+}
+
+type recordedSend struct {
+	packet      []byte
+	dest        string
+	hasDeadline bool
+}
+
+func (s *recordingSender) Send(ctx context.Context, packet []byte, dest string) error {
+	_, hasDeadline := ctx.Deadline()
+	s.mu.Lock()
+	s.sends = append(s.sends, recordedSend{packet: bytes.Clone(packet), dest: dest, hasDeadline: hasDeadline})
+	s.mu.Unlock()
+	if s.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.err
+}
+
+func (s *recordingSender) recorded() []recordedSend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]recordedSend(nil), s.sends...)
+}
+
+// registerTestSender registers a fresh recordingSender under a name unique
+// to the test, as senders can't be unregistered.
+func registerTestSender(t *testing.T, s *recordingSender) string {
+	t.Helper()
+	name := "test-" + strings.NewReplacer("/", "-", " ", "-").Replace(t.Name())
+	RegisterSender(name, s)
+	return name
+}
+
+func TestRegisterSender(t *testing.T) {
+	tests := []struct {
+		name   string
+		sender Sender
+	}{
+		{name: "", sender: &recordingSender{}},
+		{name: "nil-sender", sender: nil},
+		{name: protocolTCP, sender: &recordingSender{}},
+		{name: transportRawEthernet, sender: &recordingSender{}},
+		{name: protocolUDP, sender: &recordingSender{}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.name), func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterSender(%q) did not panic", tt.name)
+				}
+			}()
+			RegisterSender(tt.name, tt.sender)
+		})
+	}
+	if s, ok := lookupSender(protocolUDP); !ok || s != (udpSender{}) {
+		t.Errorf("udp sender = %v, %v; want the built-in one", s, ok)
+	}
+}
+
+func TestCustomTransportConfig(t *testing.T) {
+	name := registerTestSender(t, &recordingSender{})
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: "transport " + name, want: []string{name}},
+		{input: "transports udp " + name, want: []string{protocolUDP, name}},
+		{input: "transport unregistered", wantErr: true},
+		{input: "transports " + name + " " + name, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && strings.Join(w.Transports, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("transports = %v, want %v", w.Transports, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPCustomSender(t *testing.T) {
+	hw, _ := parseMAC(testMAC)
+	magic := buildMagicPacket(hw)
+	tests := []struct {
+		name        string
+		sender      *recordingSender
+		sendTimeout time.Duration
+		wantResult  wakeResult
+		wantTimeout bool
+	}{
+		{name: "sent", sender: &recordingSender{}, wantResult: resultSent},
+		{name: "failed", sender: &recordingSender{err: errors.New("bus offline")}, wantResult: resultSendFailed},
+		{name: "timed out", sender: &recordingSender{block: true}, sendTimeout: 50 * time.Millisecond, wantResult: resultSendFailed, wantTimeout: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := registerTestSender(t, tt.sender)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:          testMAC,
+				IP:           "127.0.0.1",
+				Port:         9,
+				Transports:   []string{name},
+				SendTimeout:  caddy.Duration(tt.sendTimeout),
+				StatusHeader: "X-Wake-Result",
+			})
+			start := time.Now()
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil && statusOf(rec, err) != http.StatusBadGateway {
+				t.Fatal(err)
+			}
+			if tt.wantTimeout && time.Since(start) > time.Second {
+				t.Errorf("send took %s despite send_timeout %s", time.Since(start), tt.sendTimeout)
+			}
+			if got := rec.Header().Get("X-Wake-Result"); !strings.HasPrefix(got, string(tt.wantResult)+";") {
+				t.Errorf("result %q, want %s", got, tt.wantResult)
+			}
+			sends := tt.sender.recorded()
+			if len(sends) == 0 {
+				t.Fatal("custom sender not called")
+			}
+			if sends[0].dest != "127.0.0.1:9" {
+				t.Errorf("dest = %q, want 127.0.0.1:9", sends[0].dest)
+			}
+			if !bytes.Equal(sends[0].packet, magic) {
+				t.Errorf("packet % x, want the magic packet", sends[0].packet)
+			}
+			if tt.sendTimeout > 0 && !sends[0].hasDeadline {
+				t.Error("send_timeout set no deadline on the sender's context")
+			}
+		})
+	}
+}
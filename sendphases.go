@@ -0,0 +1,75 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Phases of a send, as the send_phase_seconds histogram labels them: looking
+// the target's address up (its SRV record, mDNS name or host name), setting
+// up the socket, and writing the packet to it.
+const (
+	phaseResolve = "resolve"
+	phaseDial    = "dial"
+	phaseWrite   = "write"
+)
+
+// sendPhases adds up the time one send spent in each phase, for the
+// slow_send log line. A send writing to several destinations adds each.
+type sendPhases struct {
+	mu                   sync.Mutex
+	resolve, dial, write time.Duration
+}
+
+type sendPhasesKey struct{}
+
+// withSendPhases returns a context adding up the phases of the send made
+// with it.
+func withSendPhases(ctx context.Context) (context.Context, *sendPhases) {
+	p := new(sendPhases)
+	return context.WithValue(ctx, sendPhasesKey{}, p), p
+}
+
+// observePhase records the time since start as spent in phase, in the
+// send_phase_seconds histogram and the phases of ctx, if it has them.
+func observePhase(ctx context.Context, phase string, start time.Time) {
+	took := time.Since(start)
+	if wakeMetrics.sendPhase != nil {
+		wakeMetrics.sendPhase.WithLabelValues(phase).Observe(took.Seconds())
+	}
+	p, ok := ctx.Value(sendPhasesKey{}).(*sendPhases)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch phase {
+	case phaseResolve:
+		p.resolve += took
+	case phaseDial:
+		p.dial += took
+	case phaseWrite:
+		p.write += took
+	}
+}
+
+// logIfSlow logs the send of t started at start if it took at least the
+// slow_send threshold, with the time it spent in each phase.
+func (p *sendPhases) logIfSlow(t Target, start time.Time, opts sendOptions) {
+	took := time.Since(start)
+	if took < opts.SlowSend {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	opts.SlowSendLogger.Warn("slow send",
+		zap.String("target", t.label()),
+		zap.Duration("took", took),
+		zap.Duration("resolve", p.resolve),
+		zap.Duration("dial", p.dial),
+		zap.Duration("write", p.write),
+		zap.Duration("threshold", opts.SlowSend))
+}
@@ -0,0 +1,117 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sendPhaseCount returns the number of times phase was observed.
+func sendPhaseCount(t *testing.T, phase string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := wakeMetrics.sendPhase.WithLabelValues(phase).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestSlowSendConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    caddy.Duration
+		wantErr bool
+	}{
+		{input: "slow_send 250ms", want: caddy.Duration(250 * time.Millisecond)},
+		{input: "slow_send 0", want: 0},
+		{input: "slow_send", wantErr: true},
+		{input: "slow_send 1s 2s", wantErr: true},
+		{input: "slow_send soon", wantErr: true},
+		{input: "slow_send -1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.SlowSend != tt.want {
+				t.Errorf("slow_send %s, want %s", time.Duration(w.SlowSend), time.Duration(tt.want))
+			}
+		})
+	}
+}
+
+func TestObservePhase(t *testing.T) {
+	// Without phases in the context, only the histogram sees it
+	observePhase(context.Background(), phaseWrite, time.Now())
+
+	ctx, p := withSendPhases(context.Background())
+	observePhase(ctx, phaseResolve, time.Now().Add(-time.Second))
+	observePhase(ctx, phaseDial, time.Now().Add(-2*time.Second))
+	observePhase(ctx, phaseDial, time.Now().Add(-2*time.Second))
+	if p.resolve < time.Second || p.resolve > 2*time.Second {
+		t.Errorf("resolve %s, want about 1s", p.resolve)
+	}
+	if p.dial < 4*time.Second || p.dial > 5*time.Second {
+		t.Errorf("dial %s, want the two added up", p.dial)
+	}
+	if p.write != 0 {
+		t.Errorf("write %s, want none", p.write)
+	}
+}
+
+func TestServeHTTPSlowSend(t *testing.T) {
+	tests := []struct {
+		name     string
+		slowSend time.Duration
+		wantLog  bool
+	}{
+		{name: "off"},
+		{name: "fast", slowSend: time.Minute},
+		{name: "slow", slowSend: time.Nanosecond, wantLog: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), SlowSend: caddy.Duration(tt.slowSend)})
+			logs := observeLogs(w)
+			dials, writes := sendPhaseCount(t, phaseDial), sendPhaseCount(t, phaseWrite)
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			host.expect(t, 1)
+
+			// The histogram observes every send, logged or not
+			if got := sendPhaseCount(t, phaseDial) - dials; got != 1 {
+				t.Errorf("dial observed %d times, want 1", got)
+			}
+			if got := sendPhaseCount(t, phaseWrite) - writes; got != 1 {
+				t.Errorf("write observed %d times, want 1", got)
+			}
+			entries := logs.FilterMessage("slow send").All()
+			if (len(entries) > 0) != tt.wantLog {
+				t.Fatalf("logged %d slow sends, want logged %v", len(entries), tt.wantLog)
+			}
+			if !tt.wantLog {
+				return
+			}
+			fields := entries[0].ContextMap()
+			if fields["target"] != testMAC {
+				t.Errorf("target %v, want %s", fields["target"], testMAC)
+			}
+			for _, phase := range []string{"resolve", "dial", "write", "took"} {
+				if _, ok := fields[phase]; !ok {
+					t.Errorf("no %s field", phase)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// sharedBroadcastConns are the sockets of shared_broadcast_socket, shared
+// across handlers and config reloads: one per interface broadcasts are
+// sent through, and one, keyed "", for those the system routes.
+var sharedBroadcastConns = caddy.NewUsagePool()
+
+// sharedBroadcastConn is an unconnected socket with SO_BROADCAST set.
+// Concurrent sends write to it with WriteToUDP, which needs no locking.
+type sharedBroadcastConn struct {
+	conn *net.UDPConn
+}
+
+func (c *sharedBroadcastConn) Destruct() error {
+	return c.conn.Close()
+}
+
+// validateSharedBroadcastSocket checks shared_broadcast_socket against the
+// settings that need a socket of the handler's own.
+func (w *WakeOnLAN) validateSharedBroadcastSocket() error {
+	switch {
+	case !w.SharedBroadcastSocket:
+		return nil
+	case w.HelperSocket != "" || w.VRF != "" || w.relayed():
+		return errors.New("shared_broadcast_socket cannot be combined with helper_socket, vrf or relay, which send the broadcasts elsewhere")
+	case w.SourcePortRange != "" || w.SendBuffer != 0:
+		return errors.New("shared_broadcast_socket cannot be combined with source_port_range or send_buffer, which set up a socket of the handler's own")
+	}
+	return nil
+}
+
+// openInterfaceBroadcast opens an unconnected IPv4 UDP socket with
+// SO_BROADCAST set, sending through the named interface only.
+func openInterfaceBroadcast(ifname string) (*net.UDPConn, error) {
+	local, err := interfaceLocalAddr(ifname, false)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: interfaceControl(ifname, true)}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort(local, "0"))
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// broadcastSockets are the shared sockets a handler uses, each taken from
+// sharedBroadcastConns the first time it is needed.
+type broadcastSockets struct {
+	mu   sync.Mutex
+	held map[string]*net.UDPConn
+}
+
+func newBroadcastSockets() *broadcastSockets {
+	return &broadcastSockets{held: make(map[string]*net.UDPConn)}
+}
+
+// conn returns the shared socket sending through ifname, or routed by the
+// system for "", opening it if no handler has yet.
+func (s *broadcastSockets) conn(ifname string) (*net.UDPConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held == nil {
+		return nil, errors.New("shared broadcast sockets released")
+	}
+	if conn, ok := s.held[ifname]; ok {
+		return conn, nil
+	}
+	val, _, err := sharedBroadcastConns.LoadOrNew(ifname, func() (caddy.Destructor, error) {
+		var conn *net.UDPConn
+		var err error
+		if ifname == "" {
+			conn, err = openBroadcastConn(nil)
+		} else {
+			conn, err = openInterfaceBroadcast(ifname)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &sharedBroadcastConn{conn: conn}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn := val.(*sharedBroadcastConn).conn
+	s.held[ifname] = conn
+	return conn, nil
+}
+
+// release gives up the handler's uses of the shared sockets, closing those
+// no other handler uses anymore.
+func (s *broadcastSockets) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ifname := range s.held {
+		_, _ = sharedBroadcastConns.Delete(ifname)
+	}
+	s.held = nil
+}
+
+// provisionSharedBroadcast takes the shared sockets of the broadcasts the
+// handler is known to send when the config loads: the routed ones and
+// those of targets bound to an interface. broadcast_source interfaces,
+// looked up on every send, are taken when first sent through.
+func (w *WakeOnLAN) provisionSharedBroadcast() error {
+	if !w.SharedBroadcastSocket {
+		return nil
+	}
+	w.sharedBroadcast = newBroadcastSockets()
+	if w.Broadcast == "" && !w.escalatesToBroadcast() && w.BroadcastFallback == nil {
+		return nil
+	}
+	ifaces := []string{""}
+	for _, t := range w.allTargets() {
+		if t.Interface != "" {
+			ifaces = append(ifaces, t.Interface)
+		}
+	}
+	for _, ifname := range ifaces {
+		if _, err := w.sharedBroadcast.conn(ifname); err != nil {
+			if w.WarmUp {
+				w.sharedBroadcast.release()
+				return fmt.Errorf("wake_on_lan: warm-up: opening shared broadcast socket %q: %w", ifname, err)
+			}
+			// Not fatal; those packets get a socket each instead
+			w.logger.Warn("opening shared broadcast socket; falling back to per-packet sockets", zap.String("interface", ifname), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// sharedBroadcastOn sends payload to the broadcast address through ifname,
+// or where the system routes it for "", on the shared socket, reporting
+// false if there is none to send on: without shared_broadcast_socket, for
+// a ttl the shared socket mustn't keep, or if it can't be opened.
+func sharedBroadcastOn(ctx context.Context, opts sendOptions, ifname string, addr *net.UDPAddr, payload []byte, ttl int) (bool, error) {
+	if opts.SharedBroadcast == nil || ttl != 0 {
+		return false, nil
+	}
+	conn, err := opts.SharedBroadcast.conn(ifname)
+	if err != nil {
+		return false, nil
+	}
+	start := time.Now()
+	n, err := conn.WriteToUDP(payload, addr)
+	observePhase(ctx, phaseWrite, start)
+	if err != nil {
+		// The interface may have been replaced since the socket was
+		// bound to it; a socket of its own then reports the real error
+		return false, nil
+	}
+	return true, checkWritten(n, len(payload))
+}
@@ -0,0 +1,86 @@
+package caddy_wakeonlan
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSharedBroadcastSocketConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "broadcast 192.168.1.255\n\tshared_broadcast_socket"},
+		{input: "shared_broadcast_socket on", wantErr: true},
+		{input: "shared_broadcast_socket\n\trelay 192.0.2.10:9", wantErr: true},
+		{input: "shared_broadcast_socket\n\tsource_port_range 40000-40100", wantErr: true},
+		{input: "broadcast 192.168.1.255\n\tshared_broadcast_socket\n\tsend_buffer 1048576", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.SharedBroadcastSocket {
+				t.Error("shared_broadcast_socket not set")
+			}
+		})
+	}
+}
+
+func TestBroadcastSockets(t *testing.T) {
+	host := newFakeHost(t)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: host.port()}
+	a, b := newBroadcastSockets(), newBroadcastSockets()
+	connA, err := a.conn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connB, err := b.conn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connA != connB {
+		t.Fatal("handlers got a socket each, want one shared")
+	}
+
+	// Still open while another handler uses it
+	a.release()
+	if _, err := a.conn(""); err == nil {
+		t.Error("socket handed out after release")
+	}
+	if _, err := connB.WriteToUDP([]byte("wake"), addr); err != nil {
+		t.Errorf("writing after another handler released the socket: %v", err)
+	}
+	host.expect(t, 1)
+
+	// Closed once none does
+	b.release()
+	if _, err := connB.WriteToUDP([]byte("wake"), addr); err == nil {
+		t.Error("socket still open once released by every handler")
+	}
+}
+
+func TestServeHTTPSharedBroadcastSocket(t *testing.T) {
+	host := newFakeHost(t)
+	handlers := []*WakeOnLAN{
+		provisionTest(t, &WakeOnLAN{MAC: testMAC, Broadcast: "127.0.0.1", Port: host.port(), SharedBroadcastSocket: true}),
+		provisionTest(t, &WakeOnLAN{MAC: "00:11:22:aa:bb:cc", Broadcast: "127.0.0.1", Port: host.port(), SharedBroadcastSocket: true}),
+	}
+	for _, w := range handlers {
+		if w.broadcastConn != nil {
+			t.Error("handler opened a broadcast socket of its own")
+		}
+		if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		host.expect(t, 1)
+	}
+	if handlers[0].sharedBroadcast.held[""] != handlers[1].sharedBroadcast.held[""] {
+		t.Error("handlers sent on a socket each, want one shared")
+	}
+}
@@ -0,0 +1,197 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"path"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Defaults of shared_limit.
+const (
+	defaultSharedLimitPrefix      = "wake_on_lan/shared_limit"
+	defaultSharedLimitLockTimeout = 5 * time.Second
+)
+
+// The shared_limit on_error modes.
+const (
+	sharedLimitOpen   = "open"
+	sharedLimitClosed = "closed"
+)
+
+// errSharedLimited is returned for a wake skipped because the target was
+// woken within its shared_limit interval.
+var errSharedLimited = errors.New("target woken within the shared limit by this or another instance")
+
+// SharedLimit caps how often a target is woken across every Caddy instance
+// using the same storage, e.g. a cluster behind a load balancer, and
+// across restarts: the time of each target's last wake is kept in Caddy's
+// configured storage and checked under its lock before sending.
+type SharedLimit struct {
+	// Least time between two wakes of a target.
+	Every caddy.Duration `json:"every"`
+	// Prefix of the storage keys the wake times and locks are kept under.
+	// Default: wake_on_lan/shared_limit.
+	Prefix string `json:"prefix,omitempty"`
+	// Longest wait for another instance to release a target's lock.
+	// Default: 5s.
+	LockTimeout caddy.Duration `json:"lock_timeout,omitempty"`
+	// What a wake does when the storage can't be read or written, or the
+	// lock isn't acquired in time: "open" sends anyway, "closed" sends
+	// nothing. Default: open.
+	OnError string `json:"on_error,omitempty"`
+}
+
+// validateSharedLimit checks shared_limit.
+func (w *WakeOnLAN) validateSharedLimit() error {
+	l := w.SharedLimit
+	if l == nil {
+		if w.CooldownJitter != 0 {
+			return errors.New("cooldown_jitter requires shared_limit")
+		}
+		return nil
+	}
+	switch {
+	case w.CooldownJitter < 0:
+		return fmt.Errorf("invalid cooldown_jitter %s", time.Duration(w.CooldownJitter))
+	case l.Every <= 0:
+		return errors.New("shared_limit interval must be positive")
+	case l.LockTimeout < 0:
+		return fmt.Errorf("invalid shared_limit lock_timeout %s", time.Duration(l.LockTimeout))
+	case l.OnError != "" && l.OnError != sharedLimitOpen && l.OnError != sharedLimitClosed:
+		return fmt.Errorf("invalid shared_limit on_error %q: want open or closed", l.OnError)
+	}
+	return nil
+}
+
+// claimSharedLimit records in storage that t is being woken now, unless
+// this or another instance already woke it within the interval, in which
+// case errSharedLimited is returned. A storage that fails is logged and,
+// with on_error closed, skips the wake too.
+func (w *WakeOnLAN) claimSharedLimit(ctx context.Context, t Target, logger *zap.Logger) error {
+	l := w.SharedLimit
+	prefix := l.Prefix
+	if prefix == "" {
+		prefix = defaultSharedLimitPrefix
+	}
+	key := path.Join(prefix, certmagic.StorageKeys.Safe(t.key()))
+
+	err := w.claimSharedKey(ctx, key, time.Duration(l.Every)+w.cooldownJitter())
+	if err == nil || errors.Is(err, errSharedLimited) || ctx.Err() != nil {
+		return err
+	}
+	closed := l.OnError == sharedLimitClosed
+	if w.logThrottle.allow(t.label(), "shared_limit", zapcore.WarnLevel) {
+		if closed {
+			logger.Warn("shared_limit: storage failed; not sending", zap.String("key", key), zap.Error(err))
+		} else {
+			logger.Warn("shared_limit: storage failed; sending anyway", zap.String("key", key), zap.Error(err))
+		}
+	}
+	if closed {
+		return fmt.Errorf("shared_limit: %w", err)
+	}
+	return nil
+}
+
+// cooldownJitter returns a random duration of up to cooldown_jitter to
+// extend the shared_limit interval by for one check. The generator is
+// seeded afresh by each process, so instances draw apart.
+func (w *WakeOnLAN) cooldownJitter() time.Duration {
+	if w.CooldownJitter <= 0 {
+		return 0
+	}
+	return rand.N(time.Duration(w.CooldownJitter) + 1)
+}
+
+// claimSharedKey stores the current time at key if the time already there,
+// if any, is at least every ago, holding the key's lock meanwhile.
+func (w *WakeOnLAN) claimSharedKey(ctx context.Context, key string, every time.Duration) error {
+	lockTimeout := time.Duration(w.SharedLimit.LockTimeout)
+	if lockTimeout == 0 {
+		lockTimeout = defaultSharedLimitLockTimeout
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	if err := w.storage.Lock(lockCtx, key); err != nil {
+		if lockCtx.Err() != nil && ctx.Err() == nil {
+			return fmt.Errorf("lock held by another instance for over %s", lockTimeout)
+		}
+		return err
+	}
+	defer func() {
+		// Even when the request is gone, or other instances wait for the
+		// lock to expire
+		unlockCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), storageTimeout)
+		defer cancel()
+		if err := w.storage.Unlock(unlockCtx, key); err != nil {
+			w.logger.Warn("shared_limit: releasing lock", zap.String("key", key), zap.Error(err))
+		}
+	}()
+
+	ctx, cancel = context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	now := time.Now()
+	data, err := w.storage.Load(ctx, key)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		// A time that doesn't parse, from a storage someone edited, is as
+		// good as none
+		if last, err := time.Parse(time.RFC3339Nano, string(data)); err == nil && now.Sub(last) < every {
+			return errSharedLimited
+		}
+	}
+	return w.storage.Store(ctx, key, []byte(now.UTC().Format(time.RFC3339Nano)))
+}
+
+// parseSharedLimit parses the shared_limit subdirective: the interval, then
+// an optional block of prefix, lock_timeout and on_error.
+func parseSharedLimit(d *caddyfile.Dispenser) (*SharedLimit, error) {
+	every, err := parseDurationArg(d)
+	if err != nil {
+		return nil, err
+	}
+	l := &SharedLimit{Every: every}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "prefix":
+			prefix, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			l.Prefix = prefix
+		case "lock_timeout":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			l.LockTimeout = dur
+		case "on_error":
+			mode, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			l.OnError = mode
+		default:
+			return nil, d.Errf("unrecognized shared_limit subdirective '%s'", d.Val())
+		}
+	}
+	return l, nil
+}
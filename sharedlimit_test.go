@@ -0,0 +1,236 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+func TestSharedLimitConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    SharedLimit
+		wantErr bool
+	}{
+		{input: "shared_limit 5m", want: SharedLimit{Every: caddy.Duration(5 * time.Minute)}},
+		{
+			input: "shared_limit 1m {\n\t\tprefix wol/limits\n\t\tlock_timeout 2s\n\t\ton_error closed\n\t}",
+			want:  SharedLimit{Every: caddy.Duration(time.Minute), Prefix: "wol/limits", LockTimeout: caddy.Duration(2 * time.Second), OnError: sharedLimitClosed},
+		},
+		{input: "shared_limit", wantErr: true},
+		{input: "shared_limit 0s", wantErr: true},
+		{input: "shared_limit 1m {\n\t\tlock_timeout -1s\n\t}", wantErr: true},
+		{input: "shared_limit 1m {\n\t\ton_error maybe\n\t}", wantErr: true},
+		{input: "shared_limit 1m {\n\t\tbackend redis\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.SharedLimit != tt.want {
+				t.Errorf("shared_limit %+v, want %+v", *w.SharedLimit, tt.want)
+			}
+		})
+	}
+}
+
+// sharedLimitInstance returns a handler, provisioned in ctx, waking host
+// with the shared limit l kept in storage, standing in for one instance of
+// a cluster.
+func sharedLimitInstance(t *testing.T, ctx caddy.Context, host *fakeHost, storage certmagic.Storage, l SharedLimit) *WakeOnLAN {
+	t.Helper()
+	w := provisionIn(t, ctx, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), SharedLimit: &l, StatusHeader: "X-Wake-Result"})
+	w.storage = storage
+	return w
+}
+
+func TestServeHTTPSharedLimit(t *testing.T) {
+	// Caddy's storage is only set up for a running config
+	ctx := loadApp(t, `{}`)
+	host := newFakeHost(t)
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	limit := SharedLimit{Every: caddy.Duration(400 * time.Millisecond)}
+	instances := []*WakeOnLAN{sharedLimitInstance(t, ctx, host, storage, limit), sharedLimitInstance(t, ctx, host, storage, limit)}
+
+	wakeOn := func(w *WakeOnLAN) string {
+		t.Helper()
+		rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Header().Get("X-Wake-Result")
+	}
+	sent := string(resultSent) + "; target=" + testMAC
+	limited := string(resultRateLimited) + "; target=" + testMAC
+
+	if got := wakeOn(instances[0]); got != sent {
+		t.Errorf("first wake: %q, want %q", got, sent)
+	}
+	host.expect(t, 1)
+	// Another instance, or this one, within the interval
+	for i, w := range instances {
+		if got := wakeOn(w); got != limited {
+			t.Errorf("instance %d within the interval: %q, want %q", i, got, limited)
+		}
+	}
+	host.expectNone(t)
+
+	time.Sleep(time.Duration(limit.Every))
+	if got := wakeOn(instances[1]); got != sent {
+		t.Errorf("after the interval: %q, want %q", got, sent)
+	}
+	host.expect(t, 1)
+
+	// The time of the wake is what is stored
+	data, err := storage.Load(context.Background(), path.Join(defaultSharedLimitPrefix, certmagic.StorageKeys.Safe(instances[0].targets()[0].key())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at, err := time.Parse(time.RFC3339Nano, string(data)); err != nil || time.Since(at) > time.Second {
+		t.Errorf("stored %q (%v), want the time of the last wake", data, err)
+	}
+}
+
+func TestServeHTTPSharedLimitStorageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		onError string
+		// hold the target's lock from another instance, instead of the
+		// storage failing
+		lockHeld    bool
+		wantStatus  int
+		wantPackets int
+	}{
+		{name: "open", wantStatus: http.StatusNoContent, wantPackets: 1},
+		{name: "closed", onError: sharedLimitClosed, wantStatus: http.StatusTooManyRequests},
+		{name: "lock held, open", lockHeld: true, wantStatus: http.StatusNoContent, wantPackets: 1},
+		{name: "lock held, closed", onError: sharedLimitClosed, lockHeld: true, wantStatus: http.StatusTooManyRequests},
+	}
+	ctx := loadApp(t, `{}`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			storage := &flakyStorage{Storage: &certmagic.FileStorage{Path: t.TempDir()}}
+			w := sharedLimitInstance(t, ctx, host, storage, SharedLimit{
+				Every:       caddy.Duration(time.Minute),
+				LockTimeout: caddy.Duration(100 * time.Millisecond),
+				OnError:     tt.onError,
+			})
+			w.Required = true
+			logs := observeLogs(w)
+			if tt.lockHeld {
+				key := path.Join(defaultSharedLimitPrefix, certmagic.StorageKeys.Safe(w.targets()[0].key()))
+				if err := storage.Lock(context.Background(), key); err != nil {
+					t.Fatal(err)
+				}
+				defer storage.Unlock(context.Background(), key)
+			} else {
+				storage.down.Store(true)
+			}
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Errorf("status %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if tt.wantPackets > 0 {
+				host.expect(t, tt.wantPackets)
+			}
+			host.expectNone(t)
+			if logs.FilterMessageSnippet("shared_limit: storage failed").Len() != 1 {
+				t.Error("storage failure not logged")
+			}
+		})
+	}
+}
+
+func TestCooldownJitterConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "shared_limit 1h\n\tcooldown_jitter 2m", want: 2 * time.Minute},
+		{input: "shared_limit 1h\n\tcooldown_jitter 0s"},
+		{input: "shared_limit 1h\n\tcooldown_jitter -1s", wantErr: true},
+		{input: "shared_limit 1h\n\tcooldown_jitter", wantErr: true},
+		{input: "shared_limit 1h\n\tcooldown_jitter 1s 2s", wantErr: true},
+		{input: "cooldown_jitter 2m", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && time.Duration(w.CooldownJitter) != tt.want {
+				t.Errorf("cooldown_jitter %s, want %s", time.Duration(w.CooldownJitter), tt.want)
+			}
+		})
+	}
+}
+
+func TestCooldownJitter(t *testing.T) {
+	if got := (&WakeOnLAN{}).cooldownJitter(); got != 0 {
+		t.Errorf("jitter %s without cooldown_jitter, want none", got)
+	}
+	const most = 10 * time.Millisecond
+	w := &WakeOnLAN{CooldownJitter: caddy.Duration(most)}
+	seen := make(map[time.Duration]bool)
+	for range 100 {
+		d := w.cooldownJitter()
+		if d < 0 || d > most {
+			t.Fatalf("jitter %s, want 0 to %s", d, most)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("jitter drew %v, want it to vary", seen)
+	}
+}
+
+func TestServeHTTPCooldownJitter(t *testing.T) {
+	ctx := loadApp(t, `{}`)
+	host := newFakeHost(t)
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	const every, jitter = 200 * time.Millisecond, 300 * time.Millisecond
+	w := sharedLimitInstance(t, ctx, host, storage, SharedLimit{Every: caddy.Duration(every)})
+	w.CooldownJitter = caddy.Duration(jitter)
+
+	wake := func() string {
+		t.Helper()
+		rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Header().Get("X-Wake-Result")
+	}
+	sent := string(resultSent) + "; target=" + testMAC
+	limited := string(resultRateLimited) + "; target=" + testMAC
+
+	if got := wake(); got != sent {
+		t.Fatalf("first wake: %q, want %q", got, sent)
+	}
+	host.expect(t, 1)
+	// Within the interval, whatever the jitter
+	if got := wake(); got != limited {
+		t.Errorf("within the interval: %q, want %q", got, limited)
+	}
+	// Past the interval and the most jitter
+	time.Sleep(every + jitter)
+	if got := wake(); got != sent {
+		t.Errorf("past the interval and jitter: %q, want %q", got, sent)
+	}
+	host.expect(t, 1)
+}
@@ -0,0 +1,122 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// siteNames returns the names of sites, sorted.
+func siteNames(sites map[string][]string) []string {
+	names := make([]string, 0, len(sites))
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateSites checks the sites, their relays and the targets' references
+// to them.
+func (w *WakeOnLAN) validateSites() error {
+	if len(w.Sites) == 0 {
+		for _, t := range w.allTargets() {
+			if len(t.Sites) > 0 {
+				return fmt.Errorf("target %s: sites requires the handler to define them with site", t.label())
+			}
+		}
+		return nil
+	}
+	if w.Relay != "" || len(w.Relays) > 0 {
+		return errors.New("site cannot be combined with relay, which sites replace")
+	}
+	for _, name := range siteNames(w.Sites) {
+		relays := w.Sites[name]
+		if name == "" {
+			return errors.New("site with an empty name")
+		}
+		if len(relays) == 0 {
+			return fmt.Errorf("site %s has no relays", name)
+		}
+		for i, relay := range relays {
+			if _, _, err := splitEndpoint(relay); err != nil {
+				return fmt.Errorf("site %s: relay: %w", name, err)
+			}
+			if slices.Contains(relays[:i], relay) {
+				return fmt.Errorf("site %s: relay %s listed twice", name, relay)
+			}
+		}
+	}
+	for _, t := range w.allTargets() {
+		for i, name := range t.Sites {
+			if _, ok := w.Sites[name]; !ok {
+				return fmt.Errorf("target %s: sites %q: no such site", t.label(), name)
+			}
+			if slices.Contains(t.Sites[:i], name) {
+				return fmt.Errorf("target %s: site %s listed twice", t.label(), name)
+			}
+		}
+	}
+	return nil
+}
+
+// sendSites hands the wake of hw to every site t may be at, its own sites
+// or all of them, at once. Each site tries its relays as the strategy
+// says, and the wake succeeds if any site accepted it, which is logged
+// with the sites that didn't: those the target isn't at.
+func sendSites(ctx context.Context, hw net.HardwareAddr, t Target, opts sendOptions) error {
+	names := t.Sites
+	if len(names) == 0 {
+		names = siteNames(opts.Sites)
+	}
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		relays, ok := opts.Sites[name]
+		if !ok {
+			errs[i] = wakeError(ErrResolve, fmt.Errorf("no such site %q", name))
+			continue
+		}
+		siteOpts := opts
+		siteOpts.Relays = relays
+		if opts.RelayLogger != nil {
+			siteOpts.RelayLogger = opts.RelayLogger.With(zap.String("site", name))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = sendRelays(ctx, hw, t, siteOpts)
+		}()
+	}
+	wg.Wait()
+
+	var accepted []string
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("site %s: %w", names[i], err))
+		} else {
+			accepted = append(accepted, names[i])
+		}
+	}
+	if len(accepted) == 0 {
+		if len(failed) == 1 {
+			return errs[0]
+		}
+		return deliveryError(errors.Join(failed...))
+	}
+	if opts.RelayLogger != nil {
+		fields := []zap.Field{zap.Strings("sites", accepted)}
+		if len(failed) > 0 {
+			fields = append(fields, zap.Errors("failed", failed))
+		}
+		opts.RelayLogger.Debug("wake accepted at sites", fields...)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSitesConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "sites",
+			input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsite home 192.0.2.10:9\n\tsite office 198.51.100.10:9 198.51.100.11:9\n}",
+			want:  map[string]string{"home": "192.0.2.10:9", "office": "198.51.100.10:9 198.51.100.11:9"},
+		},
+		{
+			name:  "repeated",
+			input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsite home 192.0.2.10:9\n\tsite home 192.0.2.11:9\n}",
+			want:  map[string]string{"home": "192.0.2.10:9 192.0.2.11:9"},
+		},
+		{
+			name:  "target sites",
+			input: "wake_on_lan {\n\tsite home 192.0.2.10:9\n\tsite office 198.51.100.10:9\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tsites home\n\t}\n}",
+			want:  map[string]string{"home": "192.0.2.10:9", "office": "198.51.100.10:9"},
+		},
+		{name: "no relay", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsite home\n}", wantErr: true},
+		{name: "bad relay", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsite home 192.0.2.10\n}", wantErr: true},
+		{name: "relay listed twice", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsite home 192.0.2.10:9 192.0.2.10:9\n}", wantErr: true},
+		{name: "with relay", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsite home 192.0.2.10:9\n\trelay 192.0.2.11:9\n}", wantErr: true},
+		{name: "with broadcast", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsite home 192.0.2.10:9\n\tbroadcast 192.0.2.255\n}", wantErr: true},
+		{name: "unknown site", input: "wake_on_lan {\n\tsite home 192.0.2.10:9\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tsites office\n\t}\n}", wantErr: true},
+		{name: "site listed twice", input: "wake_on_lan {\n\tsite home 192.0.2.10:9\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tsites home home\n\t}\n}", wantErr: true},
+		{name: "target sites without sites", input: "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tsites home\n\t}\n}", wantErr: true},
+		{name: "target sites empty", input: "wake_on_lan {\n\tsite home 192.0.2.10:9\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tsites\n\t}\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(w.Sites) != len(tt.want) {
+				t.Errorf("sites %v, want %v", w.Sites, tt.want)
+			}
+			for name, relays := range tt.want {
+				if got := strings.Join(w.Sites[name], " "); got != relays {
+					t.Errorf("site %s: relays %q, want %q", name, got, relays)
+				}
+			}
+		})
+	}
+}
+
+func TestSendSites(t *testing.T) {
+	hw, _ := parseMAC(testMAC)
+	accepting := func(string) string { return "OK" }
+	refusing := func(string) string { return "ERR busy" }
+	tests := []struct {
+		name string
+		// how the relay of each site answers
+		replies map[string]func(string) string
+		// the target's sites, none for every site
+		sites     []string
+		wantAsked []string
+		wantErr   bool
+	}{
+		{name: "every site", replies: map[string]func(string) string{"home": accepting, "office": refusing}, wantAsked: []string{"home", "office"}},
+		{name: "target's sites", replies: map[string]func(string) string{"home": accepting, "office": accepting}, sites: []string{"office"}, wantAsked: []string{"office"}},
+		{name: "none accepts", replies: map[string]func(string) string{"home": refusing, "office": refusing}, wantAsked: []string{"home", "office"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubs := make(map[string]*stubRelay)
+			sites := make(map[string][]string)
+			for name, reply := range tt.replies {
+				stubs[name] = newStubRelay(t, reply)
+				sites[name] = []string{stubs[name].addr()}
+			}
+			w := &WakeOnLAN{}
+			logs := observeLogs(w)
+			target := Target{MAC: testMAC, IP: "192.0.2.1", Sites: tt.sites}
+			err := sendSites(t.Context(), hw, target, sendOptions{Sites: sites, SendTimeout: time.Second, RelayLogger: w.logger})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendSites = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				for _, name := range tt.wantAsked {
+					if !strings.Contains(err.Error(), "site "+name) {
+						t.Errorf("error %q doesn't name site %s", err, name)
+					}
+				}
+			}
+			for _, name := range tt.wantAsked {
+				if got := stubs[name].expect(t); got != testMAC {
+					t.Errorf("site %s asked for %q, want %s", name, got, testMAC)
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			for name, stub := range stubs {
+				if len(stub.lines) > 0 {
+					t.Errorf("site %s asked, want it left alone", name)
+				}
+			}
+			if !tt.wantErr && logs.FilterMessage("wake accepted at sites").Len() != 1 {
+				t.Error("accepting sites not logged")
+			}
+		})
+	}
+}
+
+func TestServeHTTPSites(t *testing.T) {
+	home := newStubRelay(t, func(string) string { return "OK" })
+	office := fmt.Sprintf("127.0.0.1:%d", closedPort(t))
+	w := provisionTest(t, &WakeOnLAN{
+		MAC:          testMAC,
+		IP:           "192.0.2.1",
+		Sites:        map[string][]string{"home": {home.addr()}, "office": {office}},
+		StatusHeader: "X-Wake-Result",
+	})
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.Header().Get("X-Wake-Result"), string(resultSent)+"; target="+testMAC; got != want {
+		t.Errorf("result = %q, want %q", got, want)
+	}
+	home.expect(t)
+}
@@ -0,0 +1,60 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// placeholderSkipTarget is replaced in skip_if_var's name by each target's
+// label.
+const placeholderSkipTarget = "{target}"
+
+// validateSkipIfVar checks skip_if_var names a variable.
+func (w *WakeOnLAN) validateSkipIfVar() error {
+	if w.SkipIfVar != "" && strings.TrimSpace(strings.ReplaceAll(w.SkipIfVar, placeholderSkipTarget, "")) == "" {
+		return errors.New("skip_if_var needs a name besides " + placeholderSkipTarget)
+	}
+	if w.SkipIfVar != "" && (w.Action == actionSleep || w.FromBody) {
+		return errors.New("skip_if_var cannot be combined with action sleep or from_body")
+	}
+	return nil
+}
+
+// flaggedUp reports whether the skip_if_var variable of t says it is up:
+// true as a bool, or as a string strconv.ParseBool accepts. Anything else,
+// the variable unset included, leaves t to be woken as usual.
+func (w *WakeOnLAN) flaggedUp(r *http.Request, t Target) bool {
+	name := strings.ReplaceAll(w.SkipIfVar, placeholderSkipTarget, t.label())
+	switch v := caddyhttp.GetVar(r.Context(), name).(type) {
+	case bool:
+		return v
+	case string:
+		up, err := strconv.ParseBool(v)
+		return err == nil && up
+	}
+	return false
+}
+
+// unflagged returns the targets whose skip_if_var variable doesn't say
+// they are up, which are sent nothing.
+func (w *WakeOnLAN) unflagged(r *http.Request, targets []Target, logger *zap.Logger) []Target {
+	if w.SkipIfVar == "" {
+		return targets
+	}
+	var down []Target
+	for _, t := range targets {
+		if !w.flaggedUp(r, t) {
+			down = append(down, t)
+			continue
+		}
+		logger.Debug("target flagged up by a request variable; not waking",
+			zap.String("target", t.label()),
+			zap.String("var", strings.ReplaceAll(w.SkipIfVar, placeholderSkipTarget, t.label())))
+	}
+	return down
+}
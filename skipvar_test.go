@@ -0,0 +1,123 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestSkipIfVarConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "skip_if_var host_up", want: "host_up"},
+		{input: "skip_if_var host_up:{target}", want: "host_up:{target}"},
+		{input: "skip_if_var", wantErr: true},
+		{input: "skip_if_var a b", wantErr: true},
+		{input: "skip_if_var {target}", wantErr: true},
+		{input: "skip_if_var host_up\n\taction sleep", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.SkipIfVar != tt.want {
+				t.Errorf("skip_if_var = %q, want %q", w.SkipIfVar, tt.want)
+			}
+		})
+	}
+
+	w, err := parseTest("wake_on_lan {\n\tfrom_body\n\tskip_if_var host_up\n}")
+	if err == nil {
+		err = w.Validate()
+	}
+	if err == nil {
+		t.Error("skip_if_var with from_body validated")
+	}
+}
+
+func TestFlaggedUp(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  bool
+	}{
+		{name: "unset"},
+		{name: "true", value: true, want: true},
+		{name: "false", value: false},
+		{name: "string", value: "true", want: true},
+		{name: "1", value: "1", want: true},
+		{name: "string false", value: "false"},
+		{name: "garbled", value: "yes"},
+		{name: "number", value: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &WakeOnLAN{SkipIfVar: "host_up:{target}"}
+			r := newTestRequest("GET", "http://example.com/", nil)
+			if tt.value != nil {
+				caddyhttp.SetVar(r.Context(), "host_up:nas", tt.value)
+			}
+			if got := w.flaggedUp(r, Target{Name: "nas"}); got != tt.want {
+				t.Errorf("flaggedUp = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPSkipIfVar(t *testing.T) {
+	host := newFakeHost(t)
+	target := func(name, mac string) Target {
+		return Target{Name: name, MAC: mac, IP: "127.0.0.1", Port: host.port()}
+	}
+	tests := []struct {
+		name     string
+		vars     map[string]any
+		wantSent int
+	}{
+		{name: "none flagged", wantSent: 2},
+		{name: "one flagged", vars: map[string]any{"host_up:nas": true}, wantSent: 1},
+		{name: "other flagged false", vars: map[string]any{"host_up:nas": true, "host_up:desktop": "false"}, wantSent: 1},
+		{name: "all flagged", vars: map[string]any{"host_up:nas": true, "host_up:desktop": "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, &WakeOnLAN{Targets: []Target{target("nas", testMAC), target("desktop", "00:11:22:aa:bb:cc")}, SkipIfVar: "host_up:{target}"})
+			r := newTestRequest("GET", "http://example.com/", nil)
+			for name, value := range tt.vars {
+				caddyhttp.SetVar(r.Context(), name, value)
+			}
+			rec, called, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != http.StatusNoContent || !called {
+				t.Fatalf("status %d, next called %v; want %d and called (%v)", got, called, http.StatusNoContent, err)
+			}
+			if tt.wantSent > 0 {
+				host.expect(t, tt.wantSent)
+			}
+			host.expectNone(t)
+		})
+	}
+}
+
+func TestServeHTTPSkipIfVarNotProbed(t *testing.T) {
+	host := newFakeHost(t)
+	up := newTCPHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Check: up.addr(), SkipIfVar: "host_up"})
+	r := newTestRequest("GET", "http://example.com/", nil)
+	caddyhttp.SetVar(r.Context(), "host_up", true)
+	if _, _, err := serveTest(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if n := up.conns.Load(); n != 0 {
+		t.Errorf("flagged target probed %d times, want none", n)
+	}
+	host.expectNone(t)
+}
@@ -0,0 +1,77 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// Handler actions.
+const (
+	actionWake  = "wake"
+	actionSleep = "sleep"
+)
+
+// resultSleepSent means the sleep command was sent to the sleep endpoint.
+const resultSleepSent wakeResult = "sleep_sent"
+
+// validateSleep checks the sleep command configuration.
+func (w *WakeOnLAN) validateSleep() error {
+	if w.SleepEndpoint == "" {
+		return errors.New("sleep action requires a sleep_endpoint")
+	}
+	if _, _, err := splitEndpoint(w.SleepEndpoint); err != nil {
+		return fmt.Errorf("sleep_endpoint: %w", err)
+	}
+	if len(w.SleepPayload) == 0 {
+		return errors.New("sleep action requires a sleep_payload")
+	}
+	return nil
+}
+
+// sendSleep sends the configured sleep command datagram.
+func (w *WakeOnLAN) sendSleep(ctx context.Context, logger *zap.Logger) (wakeResult, error) {
+	ctx, span := startSpan(ctx, "wake_on_lan.sleep", attribute.String("wake_on_lan.sleep_endpoint", w.SleepEndpoint))
+	result, err := w.sendSleepCommand(ctx, logger)
+	endSpan(span, result, err)
+	return result, err
+}
+
+// sendSleepCommand sends the datagram and records the outcome.
+func (w *WakeOnLAN) sendSleepCommand(ctx context.Context, logger *zap.Logger) (wakeResult, error) {
+	host, port, err := splitEndpoint(w.SleepEndpoint)
+	if err != nil {
+		return resultSendFailed, err
+	}
+	err = sendUDP(ctx, host, port, w.SleepPayload, w.sendOptions())
+
+	result := resultSleepSent
+	if err != nil {
+		result = resultSendFailed
+	}
+	wakeMetrics.results.WithLabelValues(w.sleepLabel(), string(result)).Inc()
+	w.notify(logger, newNotifyEvent(w.sleepLabel(), "", w.SleepEndpoint, nil, result, err))
+	fields := []zap.Field{
+		zap.String("target", w.sleepLabel()),
+		zap.String("sleep_endpoint", w.SleepEndpoint),
+		zap.String("result", string(result)),
+	}
+	if err != nil {
+		recordError(w.sleepLabel(), result, err)
+		logger.Error("sending sleep command", append(fields, zap.Error(err))...)
+	} else {
+		logger.Debug("sleep command", fields...)
+	}
+	return result, err
+}
+
+// sleepLabel names the machine being put to sleep in logs and metrics.
+func (w *WakeOnLAN) sleepLabel() string {
+	if w.Name != "" {
+		return sanitizeLabel(w.Name)
+	}
+	return sanitizeLabel(w.SleepEndpoint)
+}
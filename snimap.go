@@ -0,0 +1,39 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// validateSNIMap checks sni_map's entries.
+func (w *WakeOnLAN) validateSNIMap() error {
+	for name, t := range w.SNIMap {
+		if name == "" {
+			return errors.New("sni_map: empty server name")
+		}
+		if err := t.Validate(w.requiresIP()); err != nil {
+			return fmt.Errorf("sni_map %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// requestSNI returns the server name the client asked for in the TLS
+// handshake of r's connection, or "" over plain HTTP or without SNI.
+func requestSNI(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	return r.TLS.ServerName
+}
+
+// sniTarget returns the target sni_map maps r's server name to, with the
+// same matching as host_map.
+func (w *WakeOnLAN) sniTarget(r *http.Request) (Target, bool) {
+	sni := requestSNI(r)
+	if sni == "" {
+		return Target{}, false
+	}
+	return lookupHostMap(w.SNIMap, sni)
+}
@@ -0,0 +1,144 @@
+package caddy_wakeonlan
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestUnmarshalCaddyfileSNIMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "exact and wildcard",
+			input: `wake_on_lan {
+				sni_map {
+					NAS.example.com 10:ff:e0:cf:e6:0e 192.168.1.10
+					*.lab.example.com 10:ff:e0:cf:e6:0f 192.168.1.20 9
+				}
+			}`,
+			want: map[string]string{"nas.example.com": "192.168.1.10", "*.lab.example.com": "192.168.1.20"},
+		},
+		{
+			name:    "argument",
+			input:   "wake_on_lan {\n\tsni_map nas.example.com\n}",
+			wantErr: true,
+		},
+		{
+			name:    "target without a MAC",
+			input:   "wake_on_lan {\n\tsni_map {\n\t\tnas.example.com\n\t}\n}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(w.SNIMap) != len(tt.want) {
+				t.Fatalf("sni_map = %v, want %v", w.SNIMap, tt.want)
+			}
+			for name, ip := range tt.want {
+				if got := w.SNIMap[name].IP; got != ip {
+					t.Errorf("server name %s mapped to %q, want %q", name, got, ip)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateSNIMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		sniMap  map[string]Target
+		wantErr bool
+	}{
+		{name: "valid", sniMap: map[string]Target{"nas.example.com": {MAC: testMAC, IP: "192.0.2.1"}}},
+		{name: "empty server name", sniMap: map[string]Target{"": {MAC: testMAC, IP: "192.0.2.1"}}, wantErr: true},
+		{name: "invalid target", sniMap: map[string]Target{"nas.example.com": {MAC: "nope", IP: "192.0.2.1"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &WakeOnLAN{SNIMap: tt.sniMap}
+			if err := w.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeHTTPSNIMap(t *testing.T) {
+	tests := []struct {
+		name string
+		// the server name of the TLS handshake, none for plain HTTP
+		sni        string
+		host       string
+		withHost   bool
+		withTarget bool
+		// Which host gets the packet: "nas", "lab", "mapped", "default" or
+		// none
+		want       string
+		wantStatus int
+	}{
+		{name: "exact", sni: "nas.example.com", host: "other.example.com", want: "nas", wantStatus: http.StatusNoContent},
+		{name: "wildcard", sni: "pi.lab.example.com", want: "lab", wantStatus: http.StatusNoContent},
+		{name: "ahead of host_map", sni: "nas.example.com", host: "mapped.example.com", withHost: true, want: "nas", wantStatus: http.StatusNoContent},
+		{name: "unmapped", sni: "other.example.com", wantStatus: http.StatusNotFound},
+		{name: "unmapped with host_map", sni: "other.example.com", host: "mapped.example.com", withHost: true, want: "mapped", wantStatus: http.StatusNoContent},
+		{name: "unmapped with default", sni: "other.example.com", withTarget: true, want: "default", wantStatus: http.StatusNoContent},
+		{name: "plain HTTP", wantStatus: http.StatusNoContent},
+		{name: "plain HTTP with default", withTarget: true, want: "default", wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := map[string]*fakeHost{"nas": newFakeHost(t), "lab": newFakeHost(t), "mapped": newFakeHost(t), "default": newFakeHost(t)}
+			w := &WakeOnLAN{SNIMap: map[string]Target{
+				"nas.example.com":   {MAC: "00:11:22:33:44:01", IP: "127.0.0.1", Port: hosts["nas"].port()},
+				"*.lab.example.com": {MAC: "00:11:22:33:44:02", IP: "127.0.0.1", Port: hosts["lab"].port()},
+			}}
+			if tt.withHost {
+				w.HostMap = map[string]Target{"mapped.example.com": {MAC: "00:11:22:33:44:03", IP: "127.0.0.1", Port: hosts["mapped"].port()}}
+			}
+			if tt.withTarget {
+				w.Targets = []Target{{MAC: testMAC, IP: "127.0.0.1", Port: hosts["default"].port()}}
+			}
+			w = provisionTest(t, w)
+
+			host := tt.host
+			if host == "" {
+				host = "example.com"
+			}
+			r := newTestRequest("GET", "https://"+host+"/", nil)
+			if tt.sni != "" {
+				r.TLS = &tls.ConnectionState{ServerName: tt.sni}
+			} else {
+				r.TLS = nil
+			}
+			rec, called, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status %d, want %d", got, tt.wantStatus)
+			}
+			if called != (tt.wantStatus == http.StatusNoContent) {
+				t.Errorf("next handler called = %v", called)
+			}
+			for name, h := range hosts {
+				if name == tt.want {
+					h.expect(t, 1)
+				} else {
+					h.expectNone(t)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/gosnmp/gosnmp"
+	"go.uber.org/zap"
+)
+
+// Defaults for SNMP lookups.
+const (
+	// ipNetToMediaPhysAddress in IP-MIB: the switch's ARP table, indexed
+	// by interface and IPv4 address.
+	defaultSNMPOID       = "1.3.6.1.2.1.4.22.1.2"
+	defaultSNMPPort      = 161
+	defaultSNMPCommunity = "public"
+	defaultSNMPTimeout   = 2 * time.Second
+	defaultSNMPCacheTTL  = 5 * time.Minute
+)
+
+// SNMP versions.
+const (
+	snmpV2c = "2c"
+	snmpV3  = "3"
+)
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA224": gosnmp.SHA224,
+	"SHA256": gosnmp.SHA256,
+	"SHA384": gosnmp.SHA384,
+	"SHA512": gosnmp.SHA512,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"DES":     gosnmp.DES,
+	"AES":     gosnmp.AES,
+	"AES192":  gosnmp.AES192,
+	"AES256":  gosnmp.AES256,
+	"AES192C": gosnmp.AES192C,
+	"AES256C": gosnmp.AES256C,
+}
+
+// SNMP configures looking up target MACs in a switch or router's ARP
+// table over SNMP, for hosts where the neighbor table isn't available.
+// The table is walked once per cache TTL; targets it has no entry for,
+// or any failure to query it, fall back to their configured MAC.
+type SNMP struct {
+	// Address of the switch, as host or host:port. Default port: 161.
+	Switch string `json:"switch"`
+	// SNMP version: "2c" (the default) or "3".
+	Version string `json:"version,omitempty"`
+	// Community string for version 2c. Default: public.
+	Community string `json:"community,omitempty"`
+	// User name for version 3.
+	User string `json:"user,omitempty"`
+	// Authentication protocol for version 3: MD5, SHA, SHA224, SHA256,
+	// SHA384 or SHA512. Unset means no authentication.
+	AuthProtocol string `json:"auth_protocol,omitempty"`
+	// Authentication passphrase for version 3.
+	AuthPassphrase string `json:"auth_passphrase,omitempty"`
+	// Privacy protocol for version 3: DES, AES, AES192, AES256, AES192C or
+	// AES256C. Requires authentication. Unset means no privacy.
+	PrivProtocol string `json:"priv_protocol,omitempty"`
+	// Privacy passphrase for version 3.
+	PrivPassphrase string `json:"priv_passphrase,omitempty"`
+	// Base OID of a table whose values are MACs and whose indexes end in
+	// the IPv4 address. Default: 1.3.6.1.2.1.4.22.1.2
+	// (ipNetToMediaPhysAddress).
+	OID string `json:"oid,omitempty"`
+	// Timeout of each SNMP request. Default: 2s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// How long the walked table is reused. Default: 5m.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// Walk the table when the config loads, failing it if the switch
+	// can't be queried.
+	CheckOnLoad bool `json:"check_on_load,omitempty"`
+}
+
+// validate checks the switch address and credentials.
+func (s *SNMP) validate() error {
+	if s.Switch == "" {
+		return errors.New("snmp requires a switch address")
+	}
+	if _, _, err := s.hostPort(); err != nil {
+		return err
+	}
+	if s.Timeout < 0 || s.CacheTTL < 0 {
+		return errors.New("invalid snmp timeout or cache_ttl")
+	}
+	if s.OID != "" && !isNumericOID(s.OID) {
+		return fmt.Errorf("invalid snmp oid %q", s.OID)
+	}
+	switch s.Version {
+	case "", snmpV2c:
+		if s.User != "" || s.AuthProtocol != "" || s.PrivProtocol != "" {
+			return errors.New("snmp user, auth and priv require version 3")
+		}
+	case snmpV3:
+		if s.Community != "" {
+			return errors.New("snmp community requires version 2c")
+		}
+		if s.User == "" {
+			return errors.New("snmp version 3 requires a user")
+		}
+		if _, ok := snmpAuthProtocols[s.AuthProtocol]; s.AuthProtocol != "" && !ok {
+			return fmt.Errorf("unknown snmp auth protocol %q", s.AuthProtocol)
+		}
+		if _, ok := snmpPrivProtocols[s.PrivProtocol]; s.PrivProtocol != "" && !ok {
+			return fmt.Errorf("unknown snmp priv protocol %q", s.PrivProtocol)
+		}
+		if s.PrivProtocol != "" && s.AuthProtocol == "" {
+			return errors.New("snmp priv requires auth")
+		}
+		if (s.AuthProtocol != "") != (s.AuthPassphrase != "") || (s.PrivProtocol != "") != (s.PrivPassphrase != "") {
+			return errors.New("snmp auth and priv each need a protocol and a passphrase")
+		}
+	default:
+		return fmt.Errorf("unknown snmp version %q", s.Version)
+	}
+	return nil
+}
+
+// hostPort splits the switch address, defaulting the port.
+func (s *SNMP) hostPort() (string, uint16, error) {
+	host, port, err := net.SplitHostPort(s.Switch)
+	if err != nil {
+		return s.Switch, defaultSNMPPort, nil
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return "", 0, fmt.Errorf("invalid snmp switch port %q", port)
+	}
+	return host, uint16(n), nil
+}
+
+// client returns an SNMP client for the switch, not yet connected.
+func (s *SNMP) client(ctx context.Context) *gosnmp.GoSNMP {
+	host, port, _ := s.hostPort()
+	timeout := time.Duration(s.Timeout)
+	if timeout == 0 {
+		timeout = defaultSNMPTimeout
+	}
+	c := &gosnmp.GoSNMP{
+		Context: ctx,
+		Target:  host,
+		Port:    port,
+		Version: gosnmp.Version2c,
+		Timeout: timeout,
+		Retries: 1,
+	}
+	if s.Version != snmpV3 {
+		c.Community = s.Community
+		if c.Community == "" {
+			c.Community = defaultSNMPCommunity
+		}
+		return c
+	}
+	usm := &gosnmp.UsmSecurityParameters{UserName: s.User}
+	c.Version, c.SecurityModel, c.MsgFlags = gosnmp.Version3, gosnmp.UserSecurityModel, gosnmp.NoAuthNoPriv
+	if s.AuthProtocol != "" {
+		c.MsgFlags = gosnmp.AuthNoPriv
+		usm.AuthenticationProtocol, usm.AuthenticationPassphrase = snmpAuthProtocols[s.AuthProtocol], s.AuthPassphrase
+	}
+	if s.PrivProtocol != "" {
+		c.MsgFlags = gosnmp.AuthPriv
+		usm.PrivacyProtocol, usm.PrivacyPassphrase = snmpPrivProtocols[s.PrivProtocol], s.PrivPassphrase
+	}
+	c.SecurityParameters = usm
+	return c
+}
+
+// walk reads the switch's table of IPv4 addresses to MACs.
+func (s *SNMP) walk(ctx context.Context) (map[string]net.HardwareAddr, error) {
+	c := s.client(ctx)
+	if err := c.Connect(); err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+	oid := s.OID
+	if oid == "" {
+		oid = defaultSNMPOID
+	}
+	pdus, err := c.BulkWalkAll(oid)
+	if err != nil {
+		return nil, err
+	}
+	return parseSNMPTable(oid, pdus), nil
+}
+
+// parseSNMPTable maps the IPv4 address ending each variable's index to the
+// MAC it holds, skipping values that aren't MACs.
+func parseSNMPTable(base string, pdus []gosnmp.SnmpPDU) map[string]net.HardwareAddr {
+	table := make(map[string]net.HardwareAddr)
+	for _, pdu := range pdus {
+		hw, ok := pdu.Value.([]byte)
+		if pdu.Type != gosnmp.OctetString || !ok || len(hw) != 6 || isZeroMAC(hw) {
+			continue
+		}
+		index := strings.TrimPrefix(strings.TrimPrefix(pdu.Name, "."), strings.TrimPrefix(base, ".")+".")
+		parts := strings.Split(index, ".")
+		if len(parts) < 4 {
+			continue
+		}
+		ip := net.ParseIP(strings.Join(parts[len(parts)-4:], "."))
+		if ip == nil {
+			continue
+		}
+		table[ip.String()] = append(net.HardwareAddr(nil), hw...)
+	}
+	return table
+}
+
+// isNumericOID reports whether oid is a dotted string of numbers.
+func isNumericOID(oid string) bool {
+	for _, part := range strings.Split(strings.TrimPrefix(oid, "."), ".") {
+		if _, err := strconv.ParseUint(part, 10, 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// snmpResolver caches the switch's table for lookups at send time. A
+// failed walk is remembered for a short while, so a switch that is down
+// isn't queried on every request.
+type snmpResolver struct {
+	cfg    *SNMP
+	logger *zap.Logger
+	walk   func(context.Context) (map[string]net.HardwareAddr, error)
+	now    func() time.Time
+
+	mu        sync.Mutex
+	table     map[string]net.HardwareAddr
+	expires   time.Time
+	missUntil time.Time
+}
+
+// newSNMPResolver returns a resolver for cfg, walking the table up front
+// if cfg.CheckOnLoad is set.
+func newSNMPResolver(cfg *SNMP, logger *zap.Logger) (*snmpResolver, error) {
+	s := &snmpResolver{cfg: cfg, logger: logger, walk: cfg.walk, now: time.Now}
+	if cfg.CheckOnLoad {
+		table, err := s.walk(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		s.store(table)
+	}
+	return s, nil
+}
+
+func (s *snmpResolver) store(table map[string]net.HardwareAddr) {
+	ttl := time.Duration(s.cfg.CacheTTL)
+	if ttl == 0 {
+		ttl = defaultSNMPCacheTTL
+	}
+	s.table, s.expires, s.missUntil = table, s.now().Add(ttl), time.Time{}
+}
+
+// lookup returns the MAC the switch's table holds for ip. A failed walk is
+// logged; the caller then falls back to the configured MAC.
+func (s *snmpResolver) lookup(ip net.IP) (net.HardwareAddr, bool) {
+	if ip.To4() == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.After(s.expires) && now.After(s.missUntil) {
+		table, err := s.walk(context.Background())
+		if err != nil {
+			s.logger.Warn("querying switch for MACs over SNMP; using configured MACs",
+				zap.String("switch", s.cfg.Switch), zap.Error(err))
+			s.table, s.missUntil = nil, now.Add(defaultMACMissTTL)
+			return nil, false
+		}
+		s.store(table)
+	}
+	hw, ok := s.table[ip.String()]
+	return hw, ok
+}
+
+// parseSNMP parses the snmp subdirective.
+func parseSNMP(d *caddyfile.Dispenser) (*SNMP, error) {
+	s := new(SNMP)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	s.Switch = d.Val()
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "version":
+			v, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Version = v
+		case "community":
+			c, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Community = c
+		case "user":
+			u, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.User = u
+		case "auth", "priv":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			if last == "auth" {
+				s.AuthProtocol, s.AuthPassphrase = strings.ToUpper(args[0]), args[1]
+			} else {
+				s.PrivProtocol, s.PrivPassphrase = strings.ToUpper(args[0]), args[1]
+			}
+		case "oid":
+			oid, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.OID = oid
+		case "timeout":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Timeout = dur
+		case "cache_ttl":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.CacheTTL = dur
+		case "check_on_load":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			s.CheckOnLoad = true
+		default:
+			return nil, d.Errf("unrecognized snmp subdirective '%s'", d.Val())
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,352 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gosnmp/gosnmp"
+	"go.uber.org/zap"
+)
+
+// stubSwitch is an SNMP v2c responder standing in for a switch, answering
+// the GETBULK requests of a walk from a table of OIDs to MACs.
+type stubSwitch struct {
+	conn      *net.UDPConn
+	community string
+	walks     atomic.Int32
+
+	mu   sync.Mutex
+	oids []string // sorted
+	macs map[string][]byte
+}
+
+// newStubSwitch answers for community with the ARP table entries given as
+// "ip mac" pairs, under the default OID and interface index 1.
+func newStubSwitch(t *testing.T, community string, entries ...string) *stubSwitch {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubSwitch{conn: conn, community: community}
+	s.set(t, entries...)
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+// set replaces the switch's table.
+func (s *stubSwitch) set(t *testing.T, entries ...string) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.oids, s.macs = nil, make(map[string][]byte)
+	for _, e := range entries {
+		ip, mac, _ := strings.Cut(e, " ")
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oid := "." + defaultSNMPOID + ".1." + ip
+		s.oids = append(s.oids, oid)
+		s.macs[oid] = hw
+	}
+	slices.SortFunc(s.oids, compareOIDs)
+}
+
+func (s *stubSwitch) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stubSwitch) serve() {
+	decoder := &gosnmp.GoSNMP{Version: gosnmp.Version2c, Logger: gosnmp.NewLogger(nil)}
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := decoder.SnmpDecodePacket(buf[:n])
+		if err != nil || req.Community != s.community || len(req.Variables) == 0 {
+			// Switches ignore requests for other communities
+			continue
+		}
+		resp := *req
+		resp.PDUType = gosnmp.GetResponse
+		resp.Error, resp.ErrorIndex, resp.NonRepeaters, resp.MaxRepetitions = 0, 0, 0, 0
+		resp.Variables = s.next(req.Variables[0].Name)
+		if req.Variables[0].Name == "."+defaultSNMPOID {
+			s.walks.Add(1)
+		}
+		out, err := resp.MarshalMsg()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteToUDP(out, from)
+	}
+}
+
+// next returns the entries following oid, ending the MIB after the last.
+func (s *stubSwitch) next(oid string) []gosnmp.SnmpPDU {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pdus []gosnmp.SnmpPDU
+	for _, o := range s.oids {
+		if compareOIDs(o, oid) > 0 {
+			pdus = append(pdus, gosnmp.SnmpPDU{Name: o, Type: gosnmp.OctetString, Value: s.macs[o]})
+		}
+	}
+	if len(pdus) == 0 {
+		return []gosnmp.SnmpPDU{{Name: oid, Type: gosnmp.EndOfMibView}}
+	}
+	return pdus
+}
+
+// compareOIDs orders dotted OIDs numerically.
+func compareOIDs(a, b string) int {
+	parse := func(oid string) []int {
+		var out []int
+		for _, p := range strings.Split(strings.TrimPrefix(oid, "."), ".") {
+			n, _ := strconv.Atoi(p)
+			out = append(out, n)
+		}
+		return out
+	}
+	return slices.Compare(parse(a), parse(b))
+}
+
+func TestSNMPValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       SNMP
+		wantErr bool
+	}{
+		{name: "v2c", s: SNMP{Switch: "192.0.2.250"}},
+		{name: "v2c with port", s: SNMP{Switch: "192.0.2.250:1161", Community: "lan"}},
+		{name: "v3 noauth", s: SNMP{Switch: "192.0.2.250", Version: snmpV3, User: "wol"}},
+		{name: "v3 authpriv", s: SNMP{Switch: "192.0.2.250", Version: snmpV3, User: "wol", AuthProtocol: "SHA", AuthPassphrase: "a", PrivProtocol: "AES", PrivPassphrase: "p"}},
+		{name: "custom oid", s: SNMP{Switch: "192.0.2.250", OID: ".1.3.6.1.2.1.4.35.1.4"}},
+		{name: "no switch", s: SNMP{}, wantErr: true},
+		{name: "bad port", s: SNMP{Switch: "192.0.2.250:0"}, wantErr: true},
+		{name: "bad oid", s: SNMP{Switch: "192.0.2.250", OID: "ipNetToMediaPhysAddress"}, wantErr: true},
+		{name: "bad version", s: SNMP{Switch: "192.0.2.250", Version: "1"}, wantErr: true},
+		{name: "v2c user", s: SNMP{Switch: "192.0.2.250", User: "wol"}, wantErr: true},
+		{name: "v3 community", s: SNMP{Switch: "192.0.2.250", Version: snmpV3, User: "wol", Community: "lan"}, wantErr: true},
+		{name: "v3 no user", s: SNMP{Switch: "192.0.2.250", Version: snmpV3}, wantErr: true},
+		{name: "v3 unknown auth", s: SNMP{Switch: "192.0.2.250", Version: snmpV3, User: "wol", AuthProtocol: "SHA1", AuthPassphrase: "a"}, wantErr: true},
+		{name: "v3 priv without auth", s: SNMP{Switch: "192.0.2.250", Version: snmpV3, User: "wol", PrivProtocol: "AES", PrivPassphrase: "p"}, wantErr: true},
+		{name: "v3 auth without passphrase", s: SNMP{Switch: "192.0.2.250", Version: snmpV3, User: "wol", AuthProtocol: "SHA"}, wantErr: true},
+		{name: "negative ttl", s: SNMP{Switch: "192.0.2.250", CacheTTL: caddy.Duration(-time.Second)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.s.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSNMPConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    SNMP
+		wantErr bool
+	}{
+		{
+			name:  "v2c",
+			input: "snmp 192.0.2.250 {\n\t\tcommunity lan\n\t\tcache_ttl 1m\n\t\tcheck_on_load\n\t}",
+			want:  SNMP{Switch: "192.0.2.250", Community: "lan", CacheTTL: caddy.Duration(time.Minute), CheckOnLoad: true},
+		},
+		{
+			name:  "v3",
+			input: "snmp 192.0.2.250 {\n\t\tversion 3\n\t\tuser wol\n\t\tauth sha secret1\n\t\tpriv aes secret2\n\t}",
+			want:  SNMP{Switch: "192.0.2.250", Version: snmpV3, User: "wol", AuthProtocol: "SHA", AuthPassphrase: "secret1", PrivProtocol: "AES", PrivPassphrase: "secret2"},
+		},
+		{name: "no switch", input: "snmp", wantErr: true},
+		{name: "auth without passphrase", input: "snmp 192.0.2.250 {\n\t\tversion 3\n\t\tuser wol\n\t\tauth sha\n\t}", wantErr: true},
+		{name: "unknown", input: "snmp 192.0.2.250 {\n\t\tretries 3\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.SNMP != tt.want {
+				t.Errorf("snmp = %+v, want %+v", *w.SNMP, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSNMPTable(t *testing.T) {
+	base := defaultSNMPOID
+	pdus := []gosnmp.SnmpPDU{
+		{Name: "." + base + ".1.192.168.1.10", Type: gosnmp.OctetString, Value: []byte{0x10, 0xff, 0xe0, 0xcf, 0xe6, 0x0e}},
+		{Name: base + ".12.192.168.1.11", Type: gosnmp.OctetString, Value: []byte{0x10, 0xff, 0xe0, 0xcf, 0xe6, 0x0f}},
+		// Incomplete entries, short values and other types are skipped
+		{Name: "." + base + ".1.192.168.1.12", Type: gosnmp.OctetString, Value: make([]byte, 6)},
+		{Name: "." + base + ".1.192.168.1.13", Type: gosnmp.OctetString, Value: []byte{1, 2, 3}},
+		{Name: "." + base + ".1.192.168.1.14", Type: gosnmp.Integer, Value: 5},
+		{Name: "." + base + ".1.168", Type: gosnmp.OctetString, Value: []byte{0x10, 0xff, 0xe0, 0xcf, 0xe6, 0x10}},
+	}
+	got := make(map[string]string)
+	for ip, hw := range parseSNMPTable(base, pdus) {
+		got[ip] = hw.String()
+	}
+	want := map[string]string{"192.168.1.10": "10:ff:e0:cf:e6:0e", "192.168.1.11": "10:ff:e0:cf:e6:0f"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("table %v, want %v", got, want)
+	}
+}
+
+func TestSNMPWalk(t *testing.T) {
+	sw := newStubSwitch(t, "lan", "192.168.1.10 10:ff:e0:cf:e6:0e", "192.168.1.11 10:ff:e0:cf:e6:0f")
+	tests := []struct {
+		name      string
+		community string
+		want      map[string]string
+		wantErr   bool
+	}{
+		{name: "walked", community: "lan", want: map[string]string{"192.168.1.10": "10:ff:e0:cf:e6:0e", "192.168.1.11": "10:ff:e0:cf:e6:0f"}},
+		{name: "wrong community", community: "public", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &SNMP{Switch: sw.addr(), Community: tt.community, Timeout: caddy.Duration(200 * time.Millisecond)}
+			table, err := cfg.walk(t.Context())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("walk: %v, want error %v", err, tt.wantErr)
+			}
+			got := make(map[string]string)
+			for ip, hw := range table {
+				got[ip] = hw.String()
+			}
+			if !tt.wantErr && fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("table %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSNMPResolverCache(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	var walks int
+	var walkErr error
+	table := map[string]net.HardwareAddr{"192.168.1.10": {0x10, 0xff, 0xe0, 0xcf, 0xe6, 0x0e}}
+	s := &snmpResolver{
+		cfg:    &SNMP{Switch: "192.0.2.250", CacheTTL: caddy.Duration(time.Minute)},
+		logger: zap.NewNop(),
+		now:    func() time.Time { return now },
+		walk: func(context.Context) (map[string]net.HardwareAddr, error) {
+			walks++
+			return table, walkErr
+		},
+	}
+	steps := []struct {
+		name      string
+		advance   time.Duration
+		err       error
+		ip        string
+		wantOK    bool
+		wantWalks int
+	}{
+		{name: "first lookup walks", ip: "192.168.1.10", wantOK: true, wantWalks: 1},
+		{name: "cached", advance: 30 * time.Second, ip: "192.168.1.10", wantOK: true, wantWalks: 1},
+		{name: "unknown IP", ip: "192.168.1.99", wantWalks: 1},
+		{name: "IPv6 never walks", advance: time.Hour, ip: "fd00::10", wantWalks: 1},
+		{name: "expired fails", err: fmt.Errorf("timeout"), ip: "192.168.1.10", wantWalks: 2},
+		{name: "failure remembered", ip: "192.168.1.10", wantWalks: 2},
+		{name: "retried after the miss TTL", advance: defaultMACMissTTL + time.Second, ip: "192.168.1.10", wantOK: true, wantWalks: 3},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		walkErr = step.err
+		_, ok := s.lookup(net.ParseIP(step.ip))
+		if ok != step.wantOK || walks != step.wantWalks {
+			t.Errorf("%s: found %v after %d walks, want %v after %d", step.name, ok, walks, step.wantOK, step.wantWalks)
+		}
+	}
+}
+
+func TestProvisionSNMPCheckOnLoad(t *testing.T) {
+	sw := newStubSwitch(t, "lan", "127.0.0.1 10:ff:e0:cf:e6:0e")
+	tests := []struct {
+		name      string
+		community string
+		wantErr   bool
+	}{
+		{name: "reachable", community: "lan"},
+		{name: "unreachable", community: "wrong", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", SNMP: &SNMP{Switch: sw.addr(), Community: tt.community, Timeout: caddy.Duration(200 * time.Millisecond), CheckOnLoad: true}}
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+			defer cancel()
+			err := w.Provision(ctx)
+			if err == nil {
+				w.Cleanup()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Provision = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeHTTPSNMP(t *testing.T) {
+	const switchMAC = "10:ff:e0:cf:e6:0e"
+	tests := []struct {
+		name      string
+		mac       string
+		community string
+		entries   []string
+		wantMAC   string
+	}{
+		{name: "from switch", mac: testMAC, community: "lan", entries: []string{"127.0.0.1 " + switchMAC}, wantMAC: switchMAC},
+		{name: "auto", mac: autoMAC, community: "lan", entries: []string{"127.0.0.1 " + switchMAC}, wantMAC: switchMAC},
+		{name: "not in table", mac: testMAC, community: "lan", entries: []string{"192.168.1.10 " + switchMAC}, wantMAC: testMAC},
+		{name: "switch unreachable", mac: testMAC, community: "wrong", entries: []string{"127.0.0.1 " + switchMAC}, wantMAC: testMAC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sw := newStubSwitch(t, "lan", tt.entries...)
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:  tt.mac,
+				IP:   "127.0.0.1",
+				Port: host.port(),
+				SNMP: &SNMP{Switch: sw.addr(), Community: tt.community, Timeout: caddy.Duration(200 * time.Millisecond)},
+			})
+			for range 2 {
+				if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+					t.Fatal(err)
+				}
+				hw, _ := net.ParseMAC(tt.wantMAC)
+				if p := host.expect(t, 1)[0]; !bytes.Equal(p, buildMagicPacket(hw)) {
+					t.Errorf("packet % x, want the magic packet for %s", p, tt.wantMAC)
+				}
+			}
+			// The table is walked once per cache TTL
+			if n := sw.walks.Load(); tt.community == "lan" && n != 1 {
+				t.Errorf("switch walked %d times for two requests, want 1", n)
+			}
+		})
+	}
+}
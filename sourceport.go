@@ -0,0 +1,85 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// parsePortRange parses "<lo>-<hi>".
+func parsePortRange(s string) (lo, hi int, err error) {
+	l, h, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q: want <lo>-<hi>", s)
+	}
+	if lo, err = strconv.Atoi(l); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if hi, err = strconv.Atoi(h); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q: need 1 <= lo <= hi <= 65535", s)
+	}
+	return lo, hi, nil
+}
+
+// sourcePorts hands out local UDP ports from a range, pinning each target
+// to the port it last sent from so NAT and firewall rules keep matching.
+type sourcePorts struct {
+	lo, hi int
+	// socket_reuse mode set on every socket bound from the range, if any
+	reuse string
+
+	mu   sync.Mutex
+	pins map[string]int
+}
+
+func newSourcePorts(lo, hi int) *sourcePorts {
+	return &sourcePorts{lo: lo, hi: hi, pins: make(map[string]int)}
+}
+
+// dial connects to addr from the target's pinned port.
+func (s *sourcePorts) dial(key string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	return s.bind(key, func(port int) (*net.UDPConn, error) {
+		return s.dialUDP("udp", &net.UDPAddr{Port: port}, addr)
+	})
+}
+
+// bind opens a socket with open on the pinned port for key. If that port
+// is taken, the following ports in the range are tried in turn and the
+// first free one becomes the new pin. Keys without a pin start at a port
+// derived from the key, spreading them over the range.
+func (s *sourcePorts) bind(key string, open func(port int) (*net.UDPConn, error)) (*net.UDPConn, error) {
+	n := s.hi - s.lo + 1
+	s.mu.Lock()
+	start, ok := s.pins[key]
+	s.mu.Unlock()
+	if !ok {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		start = s.lo + int(h.Sum32()%uint32(n))
+	}
+
+	var lastErr error
+	for i := 0; i < n; i++ {
+		port := s.lo + (start-s.lo+i)%n
+		conn, err := open(port)
+		if err == nil {
+			s.mu.Lock()
+			s.pins[key] = port
+			s.mu.Unlock()
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no free source port in %d-%d: %w", s.lo, s.hi, lastErr)
+}
@@ -0,0 +1,42 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// lookupSRV resolves an SRV record name such as _wol._udp.example.com and
+// returns the host and port of its preferred record: the lowest priority,
+// and within it the highest weight.
+func lookupSRV(ctx context.Context, name string) (string, int, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(records) == 0 {
+		return "", 0, fmt.Errorf("no SRV records for %q", name)
+	}
+	best := records[0]
+	for _, r := range records[1:] {
+		if r.Priority < best.Priority || (r.Priority == best.Priority && r.Weight > best.Weight) {
+			best = r
+		}
+	}
+	return strings.TrimSuffix(best.Target, "."), int(best.Port), nil
+}
+
+// resolveSRVTarget returns t with its IP, and its port unless configured,
+// taken from its SRV record.
+func resolveSRVTarget(ctx context.Context, t Target) (Target, error) {
+	host, port, err := lookupSRV(ctx, t.SRV)
+	if err != nil {
+		return t, hostResolveError{fmt.Errorf("SRV %q: %w", t.SRV, err)}
+	}
+	t.IP = host
+	if t.Port == 0 {
+		t.Port = port
+	}
+	return t, nil
+}
@@ -0,0 +1,227 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Strictness levels of the safety checks.
+const (
+	// Skip the check.
+	strictOff = "off"
+	// Log a warning when the config loads (the default).
+	strictWarn = "warn"
+	// Fail the config.
+	strictError = "error"
+)
+
+// The safety checks, run on the targets when the config loads.
+const (
+	// A 8-byte EUI-64 or 20-byte InfiniBand MAC where a 6-byte one is
+	// carried.
+	checkMACFamily = "mac_family"
+	// A multicast, broadcast or all-zero MAC, which no NIC has.
+	checkMACGroup = "mac_group"
+	// An IP on loopback, which packets never leave this host for.
+	checkLoopback = "loopback"
+	// Targets sharing a MAC, kept apart only by their interfaces.
+	checkSharedMAC = "shared_mac"
+)
+
+// safetyChecks lists the checks in the order they run.
+var safetyChecks = []string{checkMACFamily, checkMACGroup, checkLoopback, checkSharedMAC}
+
+// safetyIssue is one problem a safety check found.
+type safetyIssue struct {
+	// What is wrong, as the error failing the config says it.
+	problem string
+	// The warning logged instead, and its fields.
+	warning string
+	fields  []zap.Field
+}
+
+// strictness returns the level of check: its own in strict_checks, then
+// strict for mac_family, then strictness, then warn.
+func (w *WakeOnLAN) strictness(check string) string {
+	if level, ok := w.StrictChecks[check]; ok {
+		return level
+	}
+	if check == checkMACFamily && w.Strict {
+		return strictError
+	}
+	if w.Strictness != "" {
+		return w.Strictness
+	}
+	return strictWarn
+}
+
+// validateStrictness checks the levels and fails for the first issue of a
+// check at level error.
+func (w *WakeOnLAN) validateStrictness() error {
+	if err := validateStrictLevel(w.Strictness); err != nil {
+		return fmt.Errorf("strictness: %w", err)
+	}
+	for check, level := range w.StrictChecks {
+		if !slices.Contains(safetyChecks, check) {
+			return fmt.Errorf("strictness: unknown check %q: want one of %s", check, strings.Join(safetyChecks, ", "))
+		}
+		if err := validateStrictLevel(level); err != nil {
+			return fmt.Errorf("strictness %s: %w", check, err)
+		}
+	}
+	for _, check := range safetyChecks {
+		if w.strictness(check) != strictError {
+			continue
+		}
+		if issues := w.safetyIssues(check); len(issues) > 0 {
+			return fmt.Errorf("%s (check %s)", issues[0].problem, check)
+		}
+	}
+	return nil
+}
+
+func validateStrictLevel(level string) error {
+	switch level {
+	case "", strictOff, strictWarn, strictError:
+		return nil
+	}
+	return fmt.Errorf("invalid level %q: want off, warn or error", level)
+}
+
+// warnSafety logs the issues of the checks at level warn.
+func (w *WakeOnLAN) warnSafety() {
+	for _, check := range safetyChecks {
+		if w.strictness(check) != strictWarn {
+			continue
+		}
+		for _, issue := range w.safetyIssues(check) {
+			w.logger.Warn(issue.warning, append(issue.fields, zap.String("check", check))...)
+		}
+	}
+}
+
+// safetyIssues runs check on the handler's targets.
+func (w *WakeOnLAN) safetyIssues(check string) []safetyIssue {
+	var issues []safetyIssue
+	if check == checkSharedMAC {
+		for mac, group := range duplicateMACs(w.allTargets()) {
+			labels := targetLabels(group)
+			issues = append(issues, safetyIssue{
+				problem: fmt.Sprintf("targets %s share MAC %s", strings.Join(labels, ", "), mac),
+				warning: "targets share a MAC; each is sent to only through its own interface",
+				fields:  []zap.Field{zap.String("mac", mac), zap.Strings("targets", labels)},
+			})
+		}
+		return issues
+	}
+	for _, t := range w.allTargets() {
+		if issue, ok := w.targetIssue(check, t); ok {
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// targetIssue runs check, one of those looking at a single target, on t.
+func (w *WakeOnLAN) targetIssue(check string, t Target) (safetyIssue, bool) {
+	var problem, warning string
+	switch check {
+	case checkMACFamily:
+		problem, warning = w.macFamilyMismatch(t), "MAC doesn't fit the destination; the target likely won't wake"
+	case checkMACGroup:
+		problem, warning = macGroupProblem(t), "MAC is no NIC's; the target won't wake"
+	case checkLoopback:
+		problem, warning = loopbackProblem(t), "IP is on loopback; packets won't leave this host"
+	}
+	if problem == "" {
+		return safetyIssue{}, false
+	}
+	return safetyIssue{
+		problem: fmt.Sprintf("target %s: %s", t.label(), problem),
+		warning: warning,
+		fields:  []zap.Field{zap.String("target", t.label()), zap.String("problem", problem)},
+	}, true
+}
+
+// macGroupProblem returns why t's MAC can't be a NIC's: it is all zeros,
+// the broadcast address or has the multicast bit set. Empty for "auto"
+// MACs and patterns, and for MACs that could be.
+func macGroupProblem(t Target) string {
+	hw, err := t.hardwareAddr()
+	if err != nil || isMACPattern(t.MAC) {
+		return ""
+	}
+	switch {
+	case allBytes(hw, 0x00):
+		return fmt.Sprintf("MAC %s is all zeros", hw)
+	case allBytes(hw, 0xFF):
+		return fmt.Sprintf("MAC %s is the broadcast address", hw)
+	case hw[0]&0x01 != 0:
+		return fmt.Sprintf("MAC %s is a multicast address", hw)
+	}
+	return ""
+}
+
+// allBytes reports whether every byte of hw is b.
+func allBytes(hw net.HardwareAddr, b byte) bool {
+	for _, c := range hw {
+		if c != b {
+			return false
+		}
+	}
+	return true
+}
+
+// loopbackProblem returns why t's packets can't leave this host, empty if
+// they can. Host names aren't resolved for it.
+func loopbackProblem(t Target) string {
+	if addr, err := netip.ParseAddr(t.IP); err == nil && addr.Unmap().IsLoopback() {
+		return fmt.Sprintf("IP %s is on loopback", t.IP)
+	}
+	if t.IP == "localhost" {
+		return "IP localhost is on loopback"
+	}
+	return ""
+}
+
+// parseStrictness parses strictness: an optional level for every check,
+// then a block of <check> <level> overrides.
+func parseStrictness(d *caddyfile.Dispenser) (string, map[string]string, error) {
+	var level string
+	var checks map[string]string
+	if d.NextArg() {
+		level = d.Val()
+		if d.NextArg() {
+			return "", nil, d.ArgErr()
+		}
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return "", nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		check := d.Val()
+		if !slices.Contains(safetyChecks, check) {
+			return "", nil, d.Errf("unrecognized strictness check '%s'", check)
+		}
+		checkLevel, err := parseStringArg(d)
+		if err != nil {
+			return "", nil, err
+		}
+		if checks == nil {
+			checks = make(map[string]string)
+		}
+		checks[check] = checkLevel
+	}
+	if level == "" && len(checks) == 0 {
+		return "", nil, d.Err("strictness requires a level or a block of checks")
+	}
+	return level, checks, nil
+}
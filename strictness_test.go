@@ -0,0 +1,184 @@
+package caddy_wakeonlan
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestStrictnessConfig(t *testing.T) {
+	tests := []struct {
+		input      string
+		want       string
+		wantChecks map[string]string
+		wantErr    bool
+	}{
+		{input: "strictness error", want: strictError},
+		{input: "strictness off", want: strictOff},
+		{input: "strictness {\n\t\tloopback off\n\t}", wantChecks: map[string]string{checkLoopback: strictOff}},
+		{
+			input:      "strictness error {\n\t\tshared_mac warn\n\t\tmac_group off\n\t}",
+			want:       strictError,
+			wantChecks: map[string]string{checkSharedMAC: strictWarn, checkMACGroup: strictOff},
+		},
+		{input: "strictness", wantErr: true},
+		{input: "strictness error warn", wantErr: true},
+		{input: "strictness loud", wantErr: true},
+		{input: "strictness {\n\t\tloopback loud\n\t}", wantErr: true},
+		{input: "strictness {\n\t\tmac_length error\n\t}", wantErr: true},
+		{input: "strictness {\n\t\tloopback\n\t}", wantErr: true},
+		{input: "strictness {\n\t\tloopback error {\n\t\t}\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if w.Strictness != tt.want || !maps.Equal(w.StrictChecks, tt.wantChecks) {
+				t.Errorf("strictness %q %v, want %q %v", w.Strictness, w.StrictChecks, tt.want, tt.wantChecks)
+			}
+		})
+	}
+}
+
+func TestStrictnessLevels(t *testing.T) {
+	tests := []struct {
+		name string
+		w    WakeOnLAN
+		// level of mac_family and of loopback
+		wantFamily, wantLoopback string
+	}{
+		{name: "default", wantFamily: strictWarn, wantLoopback: strictWarn},
+		{name: "strict", w: WakeOnLAN{Strict: true}, wantFamily: strictError, wantLoopback: strictWarn},
+		{name: "strictness", w: WakeOnLAN{Strictness: strictOff}, wantFamily: strictOff, wantLoopback: strictOff},
+		{name: "strict over strictness", w: WakeOnLAN{Strict: true, Strictness: strictOff}, wantFamily: strictError, wantLoopback: strictOff},
+		{
+			name:       "single checks first",
+			w:          WakeOnLAN{Strict: true, Strictness: strictError, StrictChecks: map[string]string{checkMACFamily: strictWarn, checkLoopback: strictOff}},
+			wantFamily: strictWarn, wantLoopback: strictOff,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.w.strictness(checkMACFamily); got != tt.wantFamily {
+				t.Errorf("mac_family %q, want %q", got, tt.wantFamily)
+			}
+			if got := tt.w.strictness(checkLoopback); got != tt.wantLoopback {
+				t.Errorf("loopback %q, want %q", got, tt.wantLoopback)
+			}
+		})
+	}
+}
+
+func TestSafetyIssues(t *testing.T) {
+	tests := []struct {
+		check string
+		t     Target
+		// part of the problem reported, empty for none
+		want string
+	}{
+		{check: checkMACGroup, t: Target{MAC: testMAC, IP: "192.0.2.1"}},
+		{check: checkMACGroup, t: Target{MAC: "00:00:00:00:00:00", IP: "192.0.2.1"}, want: "all zeros"},
+		{check: checkMACGroup, t: Target{MAC: "ff:ff:ff:ff:ff:ff", IP: "192.0.2.1"}, want: "the broadcast address"},
+		{check: checkMACGroup, t: Target{MAC: "01:00:5e:00:00:01", IP: "192.0.2.1"}, want: "a multicast address"},
+		{check: checkMACGroup, t: Target{MAC: autoMAC, IP: "192.0.2.1"}},
+		{check: checkLoopback, t: Target{MAC: testMAC, IP: "192.0.2.1"}},
+		{check: checkLoopback, t: Target{MAC: testMAC, IP: "127.0.0.1"}, want: "IP 127.0.0.1 is on loopback"},
+		{check: checkLoopback, t: Target{MAC: testMAC, IP: "::1"}, want: "on loopback"},
+		{check: checkLoopback, t: Target{MAC: testMAC, IP: "::ffff:127.0.0.2"}, want: "on loopback"},
+		{check: checkLoopback, t: Target{MAC: testMAC, IP: "localhost"}, want: "IP localhost is on loopback"},
+		{check: checkLoopback, t: Target{MAC: testMAC, IP: "nas.example.com"}},
+		{check: checkMACFamily, t: Target{MAC: testEUI64, IP: "192.0.2.1"}, want: "EUI-64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.check+" "+tt.t.MAC+" "+tt.t.IP, func(t *testing.T) {
+			w := WakeOnLAN{Targets: []Target{tt.t}}
+			issues := w.safetyIssues(tt.check)
+			if tt.want == "" {
+				if len(issues) > 0 {
+					t.Errorf("issues %+v, want none", issues)
+				}
+				return
+			}
+			if len(issues) != 1 || !strings.Contains(issues[0].problem, tt.want) {
+				t.Errorf("issues %+v, want one with %q", issues, tt.want)
+			}
+		})
+	}
+
+	t.Run(checkSharedMAC, func(t *testing.T) {
+		w := WakeOnLAN{Targets: []Target{
+			{MAC: testMAC, IP: "192.0.2.1", Interface: "eth0"},
+			{MAC: testMAC, IP: "192.0.2.1", Interface: "eth1"},
+			{MAC: "00:11:22:33:44:66", IP: "192.0.2.2"},
+		}}
+		issues := w.safetyIssues(checkSharedMAC)
+		if len(issues) != 1 || !strings.Contains(issues[0].problem, "share MAC "+testMAC) {
+			t.Errorf("issues %+v, want one for the shared MAC", issues)
+		}
+	})
+}
+
+func TestValidateStrictness(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "warn by default", input: "wake_on_lan 01:00:5e:00:00:01 127.0.0.1"},
+		{name: "error", input: "wake_on_lan 01:00:5e:00:00:01 192.0.2.1 {\n\tstrictness error\n}", wantErr: "(check mac_group)"},
+		{name: "check off", input: "wake_on_lan 01:00:5e:00:00:01 192.0.2.1 {\n\tstrictness error {\n\t\tmac_group off\n\t}\n}"},
+		{name: "single check", input: "wake_on_lan " + testMAC + " 127.0.0.1 {\n\tstrictness {\n\t\tloopback error\n\t}\n}", wantErr: "(check loopback)"},
+		{name: "strict", input: "wake_on_lan " + testEUI64 + " 192.0.2.1 {\n\tstrict\n}", wantErr: "(check mac_family)"},
+		{name: "strict overridden", input: "wake_on_lan " + testEUI64 + " 192.0.2.1 {\n\tstrict\n\tstrictness {\n\t\tmac_family warn\n\t}\n}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != (tt.wantErr != "") || err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Levels set in JSON are checked too
+	for _, w := range []*WakeOnLAN{
+		{MAC: testMAC, IP: "192.0.2.1", Strictness: "loud"},
+		{MAC: testMAC, IP: "192.0.2.1", StrictChecks: map[string]string{"mac_length": strictError}},
+		{MAC: testMAC, IP: "192.0.2.1", StrictChecks: map[string]string{checkLoopback: "loud"}},
+	} {
+		if err := w.Validate(); err == nil {
+			t.Errorf("strictness %q %v validated", w.Strictness, w.StrictChecks)
+		}
+	}
+}
+
+func TestWarnSafety(t *testing.T) {
+	w := provisionTest(t, &WakeOnLAN{
+		Targets: []Target{
+			{MAC: "01:00:5e:00:00:01", IP: "127.0.0.1"},
+			{MAC: testMAC, IP: "192.0.2.1"},
+		},
+		StrictChecks: map[string]string{checkMACGroup: strictOff},
+	})
+	logs := observeLogs(w)
+	w.warnSafety()
+	if got := logs.FilterMessage("IP is on loopback; packets won't leave this host").FilterField(zap.String("check", checkLoopback)).Len(); got != 1 {
+		t.Errorf("%d loopback warnings, want 1", got)
+	}
+	if got := logs.FilterMessage("MAC is no NIC's; the target won't wake").Len(); got != 0 {
+		t.Errorf("%d warnings from the check turned off, want none", got)
+	}
+}
@@ -0,0 +1,281 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Defaults of the wake summaries.
+const (
+	defaultSummaryWindow = 15 * time.Minute
+	defaultSummarySize   = 100
+	// maxSummarySize bounds the memory of each target's history.
+	maxSummarySize = 10000
+	// maxSummaryTargets bounds how many targets have a history; the least
+	// recently woken is dropped for a new one.
+	maxSummaryTargets = 1000
+)
+
+// summaries keeps the recent wakes of every target for GET
+// /wake_on_lan/summary: per target, a ring of the last attempts and one of
+// the last measured wake latencies, each holding at most size entries and
+// read only as far back as the window. Targets from requests share one
+// history, under dynamicLabel, as in the metrics, and at most
+// maxSummaryTargets are kept.
+var summaries = struct {
+	mu      sync.Mutex
+	window  time.Duration
+	size    int
+	targets map[string]*targetHistory
+	// Counts the uses of histories, ordering them by their last
+	clock uint64
+}{
+	window:  defaultSummaryWindow,
+	size:    defaultSummarySize,
+	targets: make(map[string]*targetHistory),
+}
+
+// targetHistory is the recent wakes of one target.
+type targetHistory struct {
+	attempts  ring[wakeAttempt]
+	latencies ring[wakeLatency]
+	// The metadata of the target's latest attempt
+	meta *TargetMeta
+	// summaries.clock when the history was last added to
+	used uint64
+}
+
+// wakeAttempt is one wake of a target and how it ended.
+type wakeAttempt struct {
+	at     time.Time
+	result wakeResult
+}
+
+// wakeLatency is how long a target took to come up after a wake that
+// ended at.
+type wakeLatency struct {
+	at time.Time
+	d  time.Duration
+}
+
+// ring is a fixed-size buffer overwriting its oldest entry when full.
+type ring[T any] struct {
+	entries []T
+	next    int
+	full    bool
+}
+
+func (r *ring[T]) add(e T) {
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// each calls f with the entries, oldest first.
+func (r *ring[T]) each(f func(T)) {
+	if r.full {
+		for _, e := range r.entries[r.next:] {
+			f(e)
+		}
+	}
+	for _, e := range r.entries[:r.next] {
+		f(e)
+	}
+}
+
+// configureSummaries sets how far back the summaries reach and how many
+// attempts they keep per target, 0 for the defaults. Histories kept at
+// another size are dropped.
+func configureSummaries(window time.Duration, size int) {
+	if window == 0 {
+		window = defaultSummaryWindow
+	}
+	if size == 0 {
+		size = defaultSummarySize
+	}
+	summaries.mu.Lock()
+	defer summaries.mu.Unlock()
+	summaries.window = window
+	if size != summaries.size {
+		summaries.size = size
+		summaries.targets = make(map[string]*targetHistory)
+	}
+}
+
+// history returns the history of the target labelled label, creating it if
+// there is none, after dropping the least recently used one if there are
+// maxSummaryTargets already. The caller holds summaries.mu.
+func history(label string) *targetHistory {
+	summaries.clock++
+	h := summaries.targets[label]
+	if h == nil {
+		if len(summaries.targets) >= maxSummaryTargets {
+			evictHistory()
+		}
+		h = &targetHistory{
+			attempts:  ring[wakeAttempt]{entries: make([]wakeAttempt, summaries.size)},
+			latencies: ring[wakeLatency]{entries: make([]wakeLatency, summaries.size)},
+		}
+		summaries.targets[label] = h
+	}
+	h.used = summaries.clock
+	return h
+}
+
+// evictHistory drops the least recently used history. The caller holds
+// summaries.mu.
+func evictHistory() {
+	var oldest string
+	var oldestUsed uint64
+	for label, h := range summaries.targets {
+		if oldest == "" || h.used < oldestUsed {
+			oldest, oldestUsed = label, h.used
+		}
+	}
+	delete(summaries.targets, oldest)
+}
+
+// summarizedResult reports whether a wake that ended with result is one of
+// the attempts a summary counts: anything but wakes that found the target
+// up, were never let run, or whose outcome the client didn't wait for.
+func summarizedResult(result wakeResult) bool {
+	switch result {
+	case resultAlreadyUp, resultRateLimited, resultBudgetExhausted, resultDenied, resultForbidden, resultSleepSent, resultClientDisconnected:
+		return false
+	}
+	return true
+}
+
+// recordAttempt adds a wake of t that ended with result to its summary.
+func recordAttempt(t Target, result wakeResult) {
+	if !summarizedResult(result) {
+		return
+	}
+	summaries.mu.Lock()
+	defer summaries.mu.Unlock()
+	h := history(t.metricLabel())
+	h.attempts.add(wakeAttempt{at: time.Now(), result: result})
+	h.meta = t.Meta
+}
+
+// recordLatency adds how long t took to come up after a wake to its
+// summary.
+func recordLatency(t Target, d time.Duration) {
+	summaries.mu.Lock()
+	defer summaries.mu.Unlock()
+	history(t.metricLabel()).latencies.add(wakeLatency{at: time.Now(), d: d})
+}
+
+// summary is the body of GET /wake_on_lan/summary.
+type summary struct {
+	WindowSeconds int64           `json:"window_seconds"`
+	Targets       []targetSummary `json:"targets"`
+}
+
+// targetSummary is the wakes of one target within the window.
+type targetSummary struct {
+	Target string      `json:"target"`
+	Meta   *TargetMeta `json:"meta,omitempty"`
+	// Wakes sent or tried
+	Attempted int `json:"attempted"`
+	// Those that sent their packets, or saw the target come up
+	Succeeded int `json:"succeeded"`
+	// Those that failed to send or found the target still down after
+	// the wait
+	Failed int `json:"failed"`
+	// Mean time from the first packet to the target up, of the wakes
+	// that waited for it; omitted if none did
+	AvgLatencySeconds *float64  `json:"avg_latency_seconds,omitempty"`
+	LastAttempt       time.Time `json:"last_attempt"`
+}
+
+// summarize computes the summaries of the targets with wakes since now
+// minus the window, by label, and drops the histories that have none.
+func summarize(now time.Time) summary {
+	summaries.mu.Lock()
+	defer summaries.mu.Unlock()
+	since := now.Add(-summaries.window)
+	s := summary{WindowSeconds: int64(summaries.window / time.Second), Targets: []targetSummary{}}
+	for label, h := range summaries.targets {
+		ts := targetSummary{Target: label, Meta: h.meta}
+		h.attempts.each(func(a wakeAttempt) {
+			if a.at.Before(since) {
+				return
+			}
+			ts.Attempted++
+			switch a.result {
+			case resultSent, resultAckReceived, resultTXConfirmed, resultWoken:
+				ts.Succeeded++
+			default:
+				ts.Failed++
+			}
+			ts.LastAttempt = a.at
+		})
+		var total time.Duration
+		var n int
+		h.latencies.each(func(l wakeLatency) {
+			if !l.at.Before(since) {
+				total += l.d
+				n++
+			}
+		})
+		if ts.Attempted == 0 && n == 0 {
+			delete(summaries.targets, label)
+			continue
+		}
+		if n > 0 {
+			avg := (total / time.Duration(n)).Seconds()
+			ts.AvgLatencySeconds = &avg
+		}
+		s.Targets = append(s.Targets, ts)
+	}
+	sort.Slice(s.Targets, func(i, j int) bool { return s.Targets[i].Target < s.Targets[j].Target })
+	return s
+}
+
+func (adminAPI) handleSummary(rw http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	s := summarize(time.Now())
+	if target := r.URL.Query().Get("target"); target != "" {
+		var found []targetSummary
+		for _, ts := range s.Targets {
+			if ts.Target == target {
+				found = append(found, ts)
+			}
+		}
+		if found == nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("no wakes of target %q within the window", target),
+			}
+		}
+		s.Targets = found
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(s)
+}
+
+// validateSummary checks the app's summary settings.
+func validateSummary(window time.Duration, size int) error {
+	switch {
+	case window < 0:
+		return fmt.Errorf("invalid summary_window %s", window)
+	case size < 0 || size > maxSummarySize:
+		return fmt.Errorf("invalid summary_size %d: want at most %d", size, maxSummarySize)
+	}
+	return nil
+}
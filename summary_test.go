@@ -0,0 +1,250 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+// testSummaries sets the summaries' window and size for the test, starting
+// from empty histories, and restores the defaults after.
+func testSummaries(t *testing.T, window time.Duration, size int) {
+	t.Helper()
+	configureSummaries(window, size)
+	summaries.mu.Lock()
+	summaries.targets = make(map[string]*targetHistory)
+	summaries.mu.Unlock()
+	t.Cleanup(func() { configureSummaries(0, 0) })
+}
+
+// summaryOf returns the summary of the target labelled label at now, or
+// nil if it has none.
+func summaryOf(label string, now time.Time) *targetSummary {
+	for _, ts := range summarize(now).Targets {
+		if ts.Target == label {
+			return &ts
+		}
+	}
+	return nil
+}
+
+func TestValidateSummary(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  time.Duration
+		size    int
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "set", window: time.Hour, size: 500},
+		{name: "largest", size: maxSummarySize},
+		{name: "negative window", window: -time.Second, wantErr: true},
+		{name: "negative size", size: -1, wantErr: true},
+		{name: "too large", size: maxSummarySize + 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSummary(tt.window, tt.size); (err != nil) != tt.wantErr {
+				t.Errorf("validateSummary = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSummaryOption(t *testing.T) {
+	v, err := parseAppOption(caddyfile.NewTestDispenser("wake_on_lan {\n\tsummary_window 1h\n\tsummary_size 500\n}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var app App
+	if err := json.Unmarshal(v.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(app.SummaryWindow) != time.Hour || app.SummarySize != 500 {
+		t.Errorf("summary_window %s, summary_size %d; want 1h and 500", time.Duration(app.SummaryWindow), app.SummarySize)
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := ring[int]{entries: make([]int, 3)}
+	for i, want := range [][]int{{1}, {1, 2}, {1, 2, 3}, {2, 3, 4}, {3, 4, 5}} {
+		r.add(i + 1)
+		var got []int
+		r.each(func(e int) { got = append(got, e) })
+		if !slices.Equal(got, want) {
+			t.Errorf("after adding %d: %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	testSummaries(t, time.Minute, 4)
+	nas := Target{Name: "nas", MAC: testMAC, Meta: &TargetMeta{Location: "basement"}}
+	for _, result := range []wakeResult{resultSent, resultWoken, resultSendFailed, resultAlreadyUp, resultRateLimited, resultDenied} {
+		recordAttempt(nas, result)
+	}
+	recordLatency(nas, 10*time.Second)
+	recordLatency(nas, 20*time.Second)
+	now := time.Now()
+
+	ts := summaryOf("nas", now)
+	if ts == nil {
+		t.Fatal("no summary of the target")
+	}
+	if ts.Attempted != 3 || ts.Succeeded != 2 || ts.Failed != 1 {
+		t.Errorf("attempted %d, succeeded %d, failed %d; want 3, 2 and 1", ts.Attempted, ts.Succeeded, ts.Failed)
+	}
+	if ts.AvgLatencySeconds == nil || *ts.AvgLatencySeconds != 15 {
+		t.Errorf("average latency %v, want 15s", ts.AvgLatencySeconds)
+	}
+	if ts.Meta == nil || ts.Meta.Location != "basement" {
+		t.Errorf("meta %+v, want the target's", ts.Meta)
+	}
+	if ts.LastAttempt.IsZero() || ts.LastAttempt.After(now) {
+		t.Errorf("last attempt %s, want before %s", ts.LastAttempt, now)
+	}
+
+	// Only the last size attempts are kept
+	for range 4 {
+		recordAttempt(nas, resultSent)
+	}
+	if ts := summaryOf("nas", time.Now()); ts.Attempted != 4 || ts.Failed != 0 {
+		t.Errorf("attempted %d, failed %d; want the last 4, none failed", ts.Attempted, ts.Failed)
+	}
+
+	// Past the window, the target is dropped
+	if ts := summaryOf("nas", time.Now().Add(2*time.Minute)); ts != nil {
+		t.Errorf("summary %+v past the window, want none", ts)
+	}
+	summaries.mu.Lock()
+	_, kept := summaries.targets["nas"]
+	summaries.mu.Unlock()
+	if kept {
+		t.Error("history kept past the window")
+	}
+
+	// Wakes not counted leave no summary
+	recordAttempt(Target{Name: "up"}, resultAlreadyUp)
+	if ts := summaryOf("up", time.Now()); ts != nil {
+		t.Errorf("summary %+v of a target only found up, want none", ts)
+	}
+}
+
+func TestSummaryTargetsBounded(t *testing.T) {
+	testSummaries(t, time.Minute, 1)
+	// Named targets past the cap, the first one woken again along the way
+	for i := range maxSummaryTargets + 50 {
+		recordAttempt(Target{Name: fmt.Sprintf("host-%d", i)}, resultSent)
+		if i == maxSummaryTargets/2 {
+			recordAttempt(Target{Name: "host-0"}, resultSent)
+		}
+	}
+	summaries.mu.Lock()
+	n := len(summaries.targets)
+	_, first := summaries.targets["host-0"]
+	_, second := summaries.targets["host-1"]
+	_, last := summaries.targets[fmt.Sprintf("host-%d", maxSummaryTargets+49)]
+	summaries.mu.Unlock()
+	if n != maxSummaryTargets {
+		t.Errorf("%d histories, want %d", n, maxSummaryTargets)
+	}
+	if !first || second || !last {
+		t.Errorf("kept host-0 %v, host-1 %v, the last %v; want the least recently used dropped", first, second, last)
+	}
+}
+
+func TestServeHTTPSummaryDynamicTargets(t *testing.T) {
+	testSummaries(t, time.Minute, 10)
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{FromQuery: &QueryParams{}})
+	const n = 50
+	for i := range n {
+		query := fmt.Sprintf("mac=00:11:22:33:66:%02x&ip=127.0.0.1&port=%d", i, host.port())
+		if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/wake?"+query, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host.expect(t, n)
+	s := summarize(time.Now())
+	if len(s.Targets) != 1 || s.Targets[0].Target != dynamicLabel {
+		t.Fatalf("summaries of %d targets, want only %s: %+v", len(s.Targets), dynamicLabel, s.Targets)
+	}
+	// Only the last size attempts are kept, like any target's
+	if got := s.Targets[0].Attempted; got != 10 {
+		t.Errorf("%s attempted %d, want 10", dynamicLabel, got)
+	}
+}
+
+func TestServeHTTPSummary(t *testing.T) {
+	testSummaries(t, time.Minute, 10)
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{Name: "summary-nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port()})
+	for range 2 {
+		if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host.expect(t, 2)
+	ts := summaryOf("summary-nas", time.Now())
+	if ts == nil || ts.Attempted != 2 || ts.Succeeded != 2 {
+		t.Errorf("summary %+v, want 2 attempts succeeded", ts)
+	}
+}
+
+func TestHandleSummary(t *testing.T) {
+	testSummaries(t, time.Minute, 10)
+	recordAttempt(Target{Name: "nas"}, resultSent)
+	recordAttempt(Target{Name: "desktop"}, resultSendFailed)
+
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		wantStatus  int
+		wantTargets []string
+	}{
+		{name: "all", method: http.MethodGet, wantStatus: http.StatusOK, wantTargets: []string{"desktop", "nas"}},
+		{name: "one", method: http.MethodGet, query: "?target=nas", wantStatus: http.StatusOK, wantTargets: []string{"nas"}},
+		{name: "unknown target", method: http.MethodGet, query: "?target=printer", wantStatus: http.StatusNotFound},
+		{name: "POST", method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			err := adminAPI{}.handleSummary(rec, httptest.NewRequest(tt.method, "/wake_on_lan/summary"+tt.query, nil))
+			if tt.wantStatus != http.StatusOK {
+				var apiErr caddy.APIError
+				if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.wantStatus {
+					t.Errorf("error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var s summary
+			if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+				t.Fatalf("decoding %q: %v", rec.Body, err)
+			}
+			if s.WindowSeconds != 60 {
+				t.Errorf("window_seconds %d, want 60", s.WindowSeconds)
+			}
+			var got []string
+			for _, ts := range s.Targets {
+				got = append(got, ts.Target)
+			}
+			if !slices.Equal(got, tt.wantTargets) {
+				t.Errorf("targets %v, want %v", got, tt.wantTargets)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Actions the summary_log line reports a request's target with.
+const (
+	summarySent            = "sent"
+	summarySkippedAwake    = "skipped_awake"
+	summarySkippedCooldown = "skipped_cooldown"
+	summaryRateLimited     = "rate_limited"
+	summarySkipped         = "skipped"
+	summaryError           = "error"
+)
+
+// summaryAction returns the action the summary_log line reports a target
+// whose wake ended with result as.
+func summaryAction(result wakeResult) string {
+	switch result {
+	case resultSent, resultAckReceived, resultTXConfirmed, resultWoken, resultWakeTimeout, resultSleepSent:
+		return summarySent
+	case resultAlreadyUp:
+		return summarySkippedAwake
+	case resultRateLimited:
+		return summarySkippedCooldown
+	case resultBudgetExhausted, resultBusy:
+		return summaryRateLimited
+	case resultDenied, resultForbidden, resultClientDisconnected:
+		return summarySkipped
+	}
+	return summaryError
+}
+
+// summaryOutcome is how one target's wake ended, for the summary_log line.
+type summaryOutcome struct {
+	target string
+	result wakeResult
+	err    string
+	dests  []string
+	// How long the target's wake took
+	took time.Duration
+}
+
+// requestSummary collects what the handler did with a request, logged as
+// one line when it's done with it. elapsed is the time from start until
+// the handler knew the outcome, not counting the handlers after it.
+type requestSummary struct {
+	start time.Time
+
+	mu       sync.Mutex
+	outcomes []summaryOutcome
+	reason   string
+	elapsed  time.Duration
+}
+
+type requestSummaryKey struct{}
+
+// withRequestSummary returns r collecting its summary into the returned
+// one.
+func withRequestSummary(r *http.Request) (*http.Request, *requestSummary) {
+	s := &requestSummary{start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), requestSummaryKey{}, s)), s
+}
+
+// noteOutcomes sets the outcomes of the wakes of ctx's request, replacing
+// those of an earlier pass, if it collects a summary.
+func noteOutcomes(ctx context.Context, outcomes []summaryOutcome) {
+	s, ok := ctx.Value(requestSummaryKey{}).(*requestSummary)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcomes, s.elapsed = outcomes, time.Since(s.start)
+}
+
+// noteSkipped records why the handler woke nothing for r, if it collects
+// a summary.
+func noteSkipped(r *http.Request, reason string) {
+	s, ok := r.Context().Value(requestSummaryKey{}).(*requestSummary)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reason, s.elapsed = reason, time.Since(s.start)
+}
+
+// wakeOutcomes returns the summary outcomes of waking targets, with the
+// destinations each one's deliveries went to and the time each took.
+func wakeOutcomes(targets []Target, results []wakeResult, errs []error, deliveries []*deliveryLog, took []time.Duration) []summaryOutcome {
+	outcomes := make([]summaryOutcome, len(targets))
+	for i, t := range targets {
+		outcomes[i] = summaryOutcome{target: t.label(), result: results[i], took: took[i]}
+		if errs[i] != nil {
+			outcomes[i].err = errs[i].Error()
+		}
+		if l := deliveries[i]; l != nil {
+			l.mu.Lock()
+			for _, d := range l.deliveries {
+				if !slices.Contains(outcomes[i].dests, d.dest) {
+					outcomes[i].dests = append(outcomes[i].dests, d.dest)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+	return outcomes
+}
+
+// sleepOutcome returns the summary outcome of the sleep request to label.
+func sleepOutcome(label string, result wakeResult, err error) summaryOutcome {
+	o := summaryOutcome{target: label, result: result}
+	if err != nil {
+		o.err = err.Error()
+	}
+	return o
+}
+
+// bulkOutcomes returns the summary outcomes of a bulk wake's entries.
+func bulkOutcomes(results []bulkResult) []summaryOutcome {
+	outcomes := make([]summaryOutcome, len(results))
+	for i, res := range results {
+		outcomes[i] = summaryOutcome{target: res.Target, result: wakeResult(res.Result), err: res.Error}
+	}
+	return outcomes
+}
+
+// log writes the summary line of the request: the target that failed
+// first, or else the first, its action and result, the destinations of
+// every target, and with several targets each one's result. A request
+// that woke nothing is logged as skipped, with the reason.
+func (s *requestSummary) log(logger *zap.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := s.elapsed
+	if elapsed == 0 {
+		elapsed = time.Since(s.start)
+	}
+	fields := []zap.Field{zap.Duration("elapsed", elapsed)}
+	if len(s.outcomes) == 0 {
+		reason := s.reason
+		if reason == "" {
+			reason = "nothing_woken"
+		}
+		logger.Info("wake-on-lan request", append(fields,
+			zap.String("action", summarySkipped),
+			zap.String("reason", reason))...)
+		return
+	}
+	first := s.outcomes[0]
+	for _, o := range s.outcomes {
+		if o.err != "" && o.result.failed() {
+			first = o
+			break
+		}
+	}
+	var dests, all []string
+	for _, o := range s.outcomes {
+		for _, d := range o.dests {
+			if !slices.Contains(dests, d) {
+				dests = append(dests, d)
+			}
+		}
+		all = append(all, o.target+"="+string(o.result))
+	}
+	fields = append(fields,
+		zap.String("target", first.target),
+		zap.String("action", summaryAction(first.result)),
+		zap.String("result", string(first.result)),
+		zap.Strings("destinations", dests))
+	if first.err != "" {
+		fields = append(fields, zap.String("error", first.err))
+	}
+	if len(s.outcomes) > 1 {
+		fields = append(fields, zap.String("results", strings.Join(all, " ")))
+	}
+	logger.Info("wake-on-lan request", fields...)
+}
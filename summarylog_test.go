@@ -0,0 +1,121 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSummaryLogConfig(t *testing.T) {
+	w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsummary_log\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.SummaryLog {
+		t.Error("summary_log not set")
+	}
+	if _, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tsummary_log info\n}"); err == nil {
+		t.Error("summary_log with an argument accepted")
+	}
+}
+
+func TestSummaryAction(t *testing.T) {
+	tests := []struct {
+		result wakeResult
+		want   string
+	}{
+		{result: resultSent, want: summarySent},
+		{result: resultWoken, want: summarySent},
+		{result: resultWakeTimeout, want: summarySent},
+		{result: resultAlreadyUp, want: summarySkippedAwake},
+		{result: resultRateLimited, want: summarySkippedCooldown},
+		{result: resultBudgetExhausted, want: summaryRateLimited},
+		{result: resultDenied, want: summarySkipped},
+		{result: resultSendFailed, want: summaryError},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.result), func(t *testing.T) {
+			if got := summaryAction(tt.result); got != tt.want {
+				t.Errorf("summaryAction = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPSummaryLog(t *testing.T) {
+	up := newTCPHost(t)
+	tests := []struct {
+		name string
+		w    func(port int) *WakeOnLAN
+		// the fields of the line, by key
+		want map[string]string
+		// whether the packet went to the host, listed as the destination
+		wantSent bool
+	}{
+		{
+			name:     "sent",
+			w:        func(port int) *WakeOnLAN { return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port} },
+			want:     map[string]string{"target": testMAC, "action": summarySent, "result": string(resultSent)},
+			wantSent: true,
+		},
+		{
+			name: "awake",
+			w: func(port int) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port, Check: up.addr(), Wait: caddy.Duration(time.Second)}
+			},
+			want: map[string]string{"target": testMAC, "action": summarySkippedAwake, "result": string(resultAlreadyUp)},
+		},
+		{
+			name: "not allowed",
+			w: func(port int) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port, AllowFrom: []string{"198.51.100.0/24"}}
+			},
+			want: map[string]string{"action": summarySkipped, "reason": "client_not_allowed"},
+		},
+		{
+			name: "first failure",
+			w: func(port int) *WakeOnLAN {
+				return &WakeOnLAN{Targets: []Target{
+					{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: port},
+					{Name: "desktop", MAC: autoMAC, IP: "192.0.2.77"},
+				}}
+			},
+			want:     map[string]string{"target": "desktop", "action": summaryError, "results": "nas=sent desktop=" + string(resultMACResolveFailed)},
+			wantSent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := tt.w(host.port())
+			w.SummaryLog = true
+			w = provisionTest(t, w)
+			logs := observeLogs(w)
+			serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			entries := logs.FilterMessage("wake-on-lan request").All()
+			if len(entries) != 1 {
+				t.Fatalf("logged %d summary lines, want 1", len(entries))
+			}
+			fields := entries[0].ContextMap()
+			for key, want := range tt.want {
+				if got := fmt.Sprint(fields[key]); got != want {
+					t.Errorf("%s = %s, want %s", key, got, want)
+				}
+			}
+			if _, ok := fields["elapsed"]; !ok {
+				t.Error("no elapsed field")
+			}
+			if !tt.wantSent {
+				host.expectNone(t)
+				return
+			}
+			host.expect(t, 1)
+			dest := fmt.Sprintf("127.0.0.1:%d", host.port())
+			if got := fmt.Sprint(fields["destinations"]); got != "["+dest+"]" {
+				t.Errorf("destinations %s, want [%s]", got, dest)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Target is a single machine to wake.
+type Target struct {
+	MAC  string `json:"mac,omitempty"`
+	IP   string `json:"ip,omitempty"`
+	Port int    `json:"port,omitempty"`
+	// SRV record to take the host, and the port unless set, from instead
+	// of IP.
+	SRV string `json:"srv,omitempty"`
+	// mDNS name (a nas.local host, an _smb._tcp.local service or an
+	// instance of one) to discover the IP from instead.
+	MDNS string `json:"mdns,omitempty"`
+
+	Repeat   int            `json:"repeat,omitempty"`
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	Check string `json:"check,omitempty"`
+
+	// Friendly name used in logs, metrics and the status header.
+	// Defaults to the MAC.
+	Name string `json:"name,omitempty"`
+
+	// SecureOn password, 6 bytes written like a MAC or as 12 hex digits,
+	// appended to the magic packet for NICs that require one.
+	SecureOn string `json:"secureon,omitempty"`
+	// Template the packet is built from instead of the standard magic
+	// packet; see packetTemplate.
+	PacketTemplate string `json:"packet_template,omitempty"`
+	// Encoding the packet is built with instead: standard (the default),
+	// short, or vendor:<name> for an encoder registered by a plugin.
+	Encoding string `json:"encoding,omitempty"`
+	// Checksum appended to the packet built from PacketTemplate or
+	// Encoding, before any padding: none (the default), sum8, xor or
+	// crc16.
+	Checksum string `json:"checksum,omitempty"`
+	// Network interface to send through, and only through, bypassing the
+	// routing table; needed to tell apart targets that share a MAC on
+	// different subnets.
+	Interface string `json:"interface,omitempty"`
+	// Hop limit of the UDP packets sent to the target, 1-255: IP_TTL, or
+	// the multicast TTL or IPv6 hop limit as fits the destination. Default:
+	// the system's.
+	TTL int `json:"ttl,omitempty"`
+	// Names of the handler's targets that must be confirmed up before
+	// this one is sent to. They are woken first, even when only this one
+	// was asked for.
+	DependsOn []string `json:"depends_on,omitempty"`
+	// Relative chance of the target being picked by select weighted, e.g.
+	// 1 for a large machine woken rarely and 3 for a small one. Default: 1.
+	Weight int `json:"weight,omitempty"`
+	// Names of the handler's sites the target may be at, whose relays its
+	// wakes are handed to. Default: every site.
+	Sites []string `json:"sites,omitempty"`
+	// If set, the target is powered on through its BMC instead of being
+	// sent magic packets.
+	BMC *BMC `json:"bmc,omitempty"`
+	// Description for people, carried to the admin API, notifications
+	// and the audit log.
+	Meta *TargetMeta `json:"meta,omitempty"`
+
+	// Whether the target was built from a request's MAC and address,
+	// through from_body, from_query or target_var, rather than configured.
+	fromRequest bool
+}
+
+// weight returns the target's weight under select weighted.
+func (t Target) weight() int {
+	if t.Weight == 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// Validate checks the target's address, retry settings and check address.
+// The IP may be left out when requireIP is false, i.e. when packets are
+// broadcast. Errors are unprefixed, for the caller to say which target
+// they are about.
+func (t Target) Validate(requireIP bool) error {
+	mac, ip, port := t.MAC, t.IP, t.Port
+	if mac == "" {
+		return errors.New("MAC must be specified")
+	}
+	if mac == autoMAC {
+		if ip == "" && t.SRV == "" && t.MDNS == "" {
+			return errors.New("auto MAC requires an IP to look up")
+		}
+	} else if isMACPattern(mac) {
+		if _, _, err := parseMACPattern(mac); err != nil {
+			return err
+		}
+		if ip != "" || t.SRV != "" || t.MDNS != "" {
+			return errors.New("MAC patterns are only broadcast; remove the IP, srv or mdns")
+		}
+	} else if _, err := t.hardwareAddr(); err != nil {
+		return fmt.Errorf("invalid MAC %q: %w", mac, err)
+	}
+	if t.MDNS != "" {
+		if ip != "" || t.SRV != "" {
+			return errors.New("mdns, srv and IP are mutually exclusive")
+		}
+		if err := validateMDNSName(t.MDNS); err != nil {
+			return err
+		}
+	} else if t.SRV != "" {
+		if ip != "" {
+			return errors.New("srv and IP are mutually exclusive")
+		}
+		// The record must exist now; its host is resolved on every send
+		if _, _, err := lookupSRV(context.Background(), t.SRV); err != nil {
+			return fmt.Errorf("invalid srv %q: %w", t.SRV, err)
+		}
+	} else if ip == "" && requireIP {
+		return errors.New("IP must be specified")
+	}
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Zone() != "" {
+		if err := validateZone(addr.Zone()); err != nil {
+			return fmt.Errorf("invalid IP %q: %w", ip, err)
+		}
+	} else if ip != "" && net.ParseIP(ip) == nil && t.fromRequest {
+		// A request's hostnames aren't looked up here, where nothing bounds
+		// the wait; the send resolves them under the wake's context
+		if err := validateHostname(ip); err != nil {
+			return fmt.Errorf("invalid IP/host %q: %w", ip, err)
+		}
+	} else if ip != "" && net.ParseIP(ip) == nil {
+		// Allow hostnames too, as ResolveUDPAddr will handle those at runtime
+		if _, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(portOrDefault(port)))); err != nil {
+			return fmt.Errorf("invalid IP/host %q: %w", ip, err)
+		}
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	if err := validateRetry(t.Repeat, t.Interval); err != nil {
+		return err
+	}
+	if err := validateProbeAddress(t.Check); err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	if t.SecureOn != "" {
+		if _, err := parseSecureOn(t.SecureOn); err != nil {
+			return fmt.Errorf("invalid secureon password: %w", err)
+		}
+	}
+	if err := validateTTL(t.TTL); err != nil {
+		return err
+	}
+	if t.Weight < 0 {
+		return fmt.Errorf("invalid weight %d", t.Weight)
+	}
+	if err := t.Meta.validate(); err != nil {
+		return err
+	}
+	if err := t.BMC.validate(); err != nil {
+		return err
+	}
+	if t.Interface != "" {
+		if _, err := net.InterfaceByName(t.Interface); err != nil {
+			return fmt.Errorf("invalid interface: no interface named %q", t.Interface)
+		}
+	}
+	if t.PacketTemplate != "" {
+		tmpl, err := parsePacketTemplate(t.PacketTemplate)
+		if err != nil {
+			return err
+		}
+		if tmpl.usesSecureOn() && t.SecureOn == "" {
+			return fmt.Errorf("packet template uses %s but no secureon password is set", placeholderSecureOn)
+		}
+	}
+	if err := t.validateEncoding(); err != nil {
+		return err
+	}
+	return validateChecksumName(t.Checksum)
+}
+
+// hardwareAddr parses the target's MAC. It fails for "auto", which is
+// only known once looked up.
+func (t Target) hardwareAddr() (net.HardwareAddr, error) {
+	return parseMAC(t.MAC)
+}
+
+// validateZone checks that an IPv6 zone names an existing interface, by
+// name or index, so link-local packets can't silently leave through the
+// wrong one.
+func validateZone(zone string) error {
+	if index, err := strconv.Atoi(zone); err == nil {
+		if _, err := net.InterfaceByIndex(index); err != nil {
+			return fmt.Errorf("no interface with index %d", index)
+		}
+		return nil
+	}
+	if _, err := net.InterfaceByName(zone); err != nil {
+		return fmt.Errorf("no interface named %q", zone)
+	}
+	return nil
+}
+
+func validateRetry(repeat int, interval caddy.Duration) error {
+	if repeat < 0 {
+		return fmt.Errorf("invalid repeat %d", repeat)
+	}
+	if interval < 0 {
+		return fmt.Errorf("invalid interval %s", time.Duration(interval))
+	}
+	return nil
+}
+
+func portOrDefault(port int) int {
+	if port == 0 {
+		return 9
+	}
+	return port
+}
+
+// key identifies the machine a target wakes. Targets sharing a MAC behind
+// different interfaces are told apart by the interface.
+func (t Target) key() string {
+	mac := t.MAC
+	if hw, err := t.hardwareAddr(); err == nil {
+		mac = hw.String()
+	}
+	if t.Interface != "" {
+		mac += "%" + t.Interface
+	}
+	if t.SRV != "" {
+		return mac + "@" + t.SRV
+	}
+	if t.MDNS != "" {
+		return mac + "@" + canonicalMDNSName(t.MDNS) + ":" + strconv.Itoa(portOrDefault(t.Port))
+	}
+	return mac + "@" + net.JoinHostPort(t.IP, strconv.Itoa(portOrDefault(t.Port)))
+}
+
+// label returns the target's name for logs, metrics and headers.
+func (t Target) label() string {
+	if t.Name != "" {
+		return sanitizeLabel(t.Name)
+	}
+	if t.MAC == autoMAC {
+		if t.SRV != "" {
+			return sanitizeLabel(t.SRV)
+		}
+		return sanitizeLabel(t.IP)
+	}
+	if hw, err := t.hardwareAddr(); err == nil {
+		return hw.String()
+	}
+	return sanitizeLabel(t.MAC)
+}
+
+// validateHostname checks that host is a DNS name, without looking it up:
+// dot-separated labels of letters, digits, hyphens and underscores, with
+// an optional trailing dot.
+func validateHostname(host string) error {
+	name := strings.TrimSuffix(host, ".")
+	if name == "" || len(name) > 253 {
+		return errors.New("not a hostname")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return errors.New("not a hostname")
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return errors.New("not a hostname")
+			}
+		}
+	}
+	return nil
+}
+
+// dynamicLabel stands in for the label of every target built from a
+// request in metrics: their MACs are the clients' to choose, and a series
+// per MAC would grow without bound.
+const dynamicLabel = "dynamic"
+
+// metricLabel returns the target's label in metrics: its label if it is
+// configured, or dynamicLabel if it came from a request.
+func (t Target) metricLabel() string {
+	if t.fromRequest {
+		return dynamicLabel
+	}
+	return t.label()
+}
+
+// sanitizeLabel makes s safe to use as a metric label and header value by
+// replacing anything outside [A-Za-z0-9_.:-] and capping its length.
+func sanitizeLabel(s string) string {
+	const maxLen = 64
+	s = strings.TrimSpace(s)
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '_', r == '.', r == ':', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
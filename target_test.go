@@ -0,0 +1,204 @@
+package caddy_wakeonlan
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestTargetLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		t    Target
+		want string
+	}{
+		{name: "name", t: Target{Name: "media-server", MAC: testMAC}, want: "media-server"},
+		{name: "name sanitized", t: Target{Name: " media server/1 ", MAC: testMAC}, want: "media_server_1"},
+		{name: "name capped", t: Target{Name: strings.Repeat("a", 100), MAC: testMAC}, want: strings.Repeat("a", 64)},
+		{name: "MAC", t: Target{MAC: "00-11-22-33-44-55"}, want: testMAC},
+		{name: "auto MAC", t: Target{MAC: autoMAC, IP: "nas.lan"}, want: "nas.lan"},
+		{name: "auto MAC with SRV", t: Target{MAC: autoMAC, SRV: "_wol._udp.lan"}, want: "_wol._udp.lan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.t.label(); got != tt.want {
+				t.Errorf("label() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetMetricLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		t    Target
+		want string
+	}{
+		{name: "named", t: Target{Name: "media-server", MAC: testMAC}, want: "media-server"},
+		{name: "configured MAC", t: Target{MAC: testMAC}, want: testMAC},
+		{name: "request MAC", t: Target{MAC: testMAC, fromRequest: true}, want: dynamicLabel},
+		{name: "request auto MAC", t: Target{MAC: autoMAC, IP: "nas.lan", fromRequest: true}, want: dynamicLabel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.t.metricLabel(); got != tt.want {
+				t.Errorf("metricLabel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Targets from requests are marked, and those named from the config
+	// aren't
+	w := provisionTest(t, &WakeOnLAN{
+		FromBody: true,
+		Targets:  []Target{{Name: "nas", MAC: "00:11:22:33:44:66", IP: "192.0.2.1"}},
+	})
+	for _, entry := range []bulkRequestTarget{{Name: "nas"}, {MAC: testMAC, IP: "192.0.2.2"}} {
+		got, err := w.bulkTarget(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := entry.Name == ""; got.fromRequest != want {
+			t.Errorf("entry %+v: fromRequest = %v, want %v", entry, got.fromRequest, want)
+		}
+	}
+}
+
+func TestNameConfig(t *testing.T) {
+	w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tname media-server\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Name != "media-server" {
+		t.Errorf("name = %q, want media-server", w.Name)
+	}
+	if _, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tname\n}"); err == nil {
+		t.Error("name without a value parsed")
+	}
+}
+
+func TestServeHTTPLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "media-server", want: "media-server"},
+		{name: "media server", want: "media_server"},
+		{want: testMAC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Name: tt.name, StatusHeader: "X-Wake-Result"})
+			logs := observeLogs(w)
+			before := testutil.ToFloat64(wakeMetrics.results.WithLabelValues(tt.want, string(resultSent)))
+
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), "sent; target="+tt.want; got != want {
+				t.Errorf("status header %q, want %q", got, want)
+			}
+			if got := testutil.ToFloat64(wakeMetrics.results.WithLabelValues(tt.want, string(resultSent))) - before; got != 1 {
+				t.Errorf("result_total of %s went up by %v, want 1", tt.want, got)
+			}
+			if n := logs.FilterField(zap.String("target", tt.want)).Len(); n == 0 {
+				t.Errorf("no log entry has target %q", tt.want)
+			}
+			host.expect(t, 1)
+		})
+	}
+}
+
+func TestValidateTargetZone(t *testing.T) {
+	lo, err := net.InterfaceByIndex(1)
+	if err != nil {
+		t.Skip("no interface with index 1")
+	}
+	tests := []struct {
+		ip      string
+		wantErr bool
+	}{
+		{ip: "fe80::1%" + lo.Name},
+		{ip: "fe80::1%1"},
+		{ip: "fe80::1%nosuch0", wantErr: true},
+		{ip: "fe80::1%65000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			err := Target{MAC: testMAC, IP: tt.ip}.Validate(true)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTargetValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		t         Target
+		requireIP bool
+		wantErr   string
+	}{
+		{name: "MAC and IP", t: Target{MAC: testMAC, IP: "192.0.2.1"}, requireIP: true},
+		{name: "hostname", t: Target{MAC: testMAC, IP: "localhost", Port: 7}, requireIP: true},
+		{name: "broadcast only", t: Target{MAC: testMAC}},
+		{name: "every option", t: Target{MAC: testMAC, IP: "192.0.2.1", Port: 9, Repeat: 3, Interval: caddy.Duration(time.Second), Check: "192.0.2.1:22", Name: "nas", SecureOn: "01:02:03:04:05:06", TTL: 4, Weight: 2}, requireIP: true},
+		{name: "no MAC", t: Target{IP: "192.0.2.1"}, wantErr: "MAC must be specified"},
+		{name: "bad MAC", t: Target{MAC: "00:11:22", IP: "192.0.2.1"}, wantErr: "invalid MAC"},
+		{name: "no IP", t: Target{MAC: testMAC}, requireIP: true, wantErr: "IP must be specified"},
+		{name: "auto MAC without IP", t: Target{MAC: autoMAC}, wantErr: "auto MAC requires an IP"},
+		{name: "bad host", t: Target{MAC: testMAC, IP: "no such host.invalid"}, wantErr: "invalid IP/host"},
+		{name: "bad port", t: Target{MAC: testMAC, IP: "192.0.2.1", Port: 65536}, wantErr: "invalid port"},
+		{name: "bad repeat", t: Target{MAC: testMAC, IP: "192.0.2.1", Repeat: -1}, wantErr: "invalid repeat"},
+		{name: "bad check", t: Target{MAC: testMAC, IP: "192.0.2.1", Check: "192.0.2.1"}, wantErr: "check:"},
+		{name: "bad secureon", t: Target{MAC: testMAC, IP: "192.0.2.1", SecureOn: "0102"}, wantErr: "invalid secureon password"},
+		{name: "bad weight", t: Target{MAC: testMAC, IP: "192.0.2.1", Weight: -1}, wantErr: "invalid weight"},
+		{name: "bad interface", t: Target{MAC: testMAC, IP: "192.0.2.1", Interface: "nosuch0"}, wantErr: "invalid interface"},
+		{name: "mdns and IP", t: Target{MAC: testMAC, IP: "192.0.2.1", MDNS: "nas.local"}, wantErr: "mutually exclusive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.t.Validate(tt.requireIP)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTargetShorthand(t *testing.T) {
+	// The directive's own MAC and IP make a one-element target list, as
+	// a target block would
+	shorthand, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 7 {\n\tname nas\n\trepeat 2\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := parseTest("wake_on_lan {\n\trepeat 2\n\ttarget " + testMAC + " 192.0.2.1 7 {\n\t\tname nas\n\t}\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []*WakeOnLAN{shorthand, block} {
+		provisionTest(t, w)
+	}
+	got, want := shorthand.targets(), block.targets()
+	if len(got) != 1 || len(want) != 1 {
+		t.Fatalf("got %d and %d targets, want 1 each", len(got), len(want))
+	}
+	if got[0].MAC != want[0].MAC || got[0].IP != want[0].IP || got[0].Port != want[0].Port || got[0].Name != want[0].Name || got[0].Repeat != want[0].Repeat {
+		t.Errorf("shorthand target %+v, want %+v", got[0], want[0])
+	}
+}
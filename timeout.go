@@ -0,0 +1,103 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// What to do when a target was sent to but didn't come up within the wait.
+const (
+	onTimeoutNext   = "next"
+	onTimeoutRetry  = "retry"
+	onTimeoutError  = "error"
+	onTimeoutNotify = "notify"
+)
+
+// defaultTimeoutRetries is how often on_timeout retry wakes again.
+const defaultTimeoutRetries = 2
+
+// errWakeTimeout fails a request with on_timeout error.
+var errWakeTimeout = errors.New("wake_on_lan: target did not come up in time")
+
+// validateOnTimeout checks on_timeout and the settings it depends on.
+func (w *WakeOnLAN) validateOnTimeout() error {
+	if w.OnTimeoutRetries < 0 {
+		return fmt.Errorf("invalid on_timeout_retries %d", w.OnTimeoutRetries)
+	}
+	if w.OnTimeoutRetries > 0 && w.OnTimeout != onTimeoutRetry {
+		return errors.New("on_timeout_retries requires on_timeout retry")
+	}
+	switch w.OnTimeout {
+	case "":
+		return nil
+	case onTimeoutNext, onTimeoutRetry, onTimeoutError:
+	case onTimeoutNotify:
+		if w.Notify == "" {
+			return errors.New("on_timeout notify requires notify")
+		}
+	default:
+		return fmt.Errorf("unknown on_timeout %q", w.OnTimeout)
+	}
+	if w.Wait <= 0 && len(w.Escalate) == 0 && w.SendUntilUp == nil && w.BroadcastFallback == nil {
+		return errors.New("on_timeout requires wait, escalate, send_until_up or broadcast_fallback")
+	}
+	if w.AfterResponse || w.FromBody || w.WakeOnFailure {
+		return errors.New("on_timeout cannot be combined with after_response, from_body or wake_on_failure")
+	}
+	return nil
+}
+
+// wakeUntilUp is wakeTargets followed by the on_timeout handling of the
+// targets that didn't come up: waking them again with retry, or failing
+// with error whatever required says. next and notify proceed, the
+// wake_timeout notification having gone out with the other outcomes. With
+// a group, the request fails unless every target came up in the end. It
+// returns every target's last result, and the failure.
+func (w *WakeOnLAN) wakeUntilUp(rw http.ResponseWriter, r *http.Request, targets []Target, logger *zap.Logger) ([]wakeResult, wakeResult, error) {
+	results, failure, err := w.wakeTargets(rw, r, targets, logger)
+	all, allResults := targets, slices.Clone(results)
+	if w.OnTimeout == onTimeoutRetry {
+		retries := w.OnTimeoutRetries
+		if retries == 0 {
+			retries = defaultTimeoutRetries
+		}
+		for retry := 1; retry <= retries; retry++ {
+			targets = timedOut(targets, results)
+			if len(targets) == 0 {
+				break
+			}
+			logger.Info("targets did not come up; waking again", zap.Int("retry", retry), zap.Int("targets", len(targets)))
+			var retryFailure wakeResult
+			var retryErr error
+			results, retryFailure, retryErr = w.wakeTargets(rw, r, targets, logger)
+			mergeResults(all, allResults, targets, results)
+			if err == nil {
+				failure, err = retryFailure, retryErr
+			}
+		}
+	}
+	if w.Group != "" {
+		if groupErr := w.checkGroup(all, allResults, logger); groupErr != nil {
+			return allResults, resultGroupFailed, groupErr
+		}
+	}
+	if w.OnTimeout == onTimeoutError && len(timedOut(targets, results)) > 0 {
+		return allResults, resultWakeTimeout, errWakeTimeout
+	}
+	return allResults, failure, err
+}
+
+// timedOut returns the targets whose result is wake_timeout.
+func timedOut(targets []Target, results []wakeResult) []Target {
+	var out []Target
+	for i, t := range targets {
+		if results[i] == resultWakeTimeout {
+			out = append(out, t)
+		}
+	}
+	return out
+}
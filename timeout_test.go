@@ -0,0 +1,149 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestOnTimeoutConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "wait 5s\n\ton_timeout next"},
+		{input: "wait 5s\n\ton_timeout error"},
+		{input: "wait 5s\n\ton_timeout retry\n\ton_timeout_retries 4"},
+		{input: "wait 5s\n\ton_timeout notify\n\tnotify https://hooks.example.com/wol"},
+		{input: "wait 5s\n\ton_timeout notify", wantErr: true},
+		{input: "wait 5s\n\ton_timeout ignore", wantErr: true},
+		{input: "on_timeout error", wantErr: true},
+		{input: "wait 5s\n\ton_timeout next\n\ton_timeout_retries 2", wantErr: true},
+		{input: "wait 5s\n\ton_timeout retry\n\ton_timeout_retries -1", wantErr: true},
+		{input: "wait 5s\n\ton_timeout error\n\tafter_response", wantErr: true},
+		{input: "wait 5s\n\ton_timeout", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tcheck 192.0.2.1:22\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// webhook records the results of the notifications posted to it.
+type webhook struct {
+	*httptest.Server
+	mu      sync.Mutex
+	results []string
+}
+
+func newWebhook(t *testing.T) *webhook {
+	t.Helper()
+	h := new(webhook)
+	h.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var event notifyEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decoding notification: %v", err)
+		}
+		h.mu.Lock()
+		h.results = append(h.results, event.Result)
+		h.mu.Unlock()
+	}))
+	t.Cleanup(h.Close)
+	return h
+}
+
+// waitFor waits for n notifications, returning their results.
+func (h *webhook) waitFor(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		h.mu.Lock()
+		results := append([]string(nil), h.results...)
+		h.mu.Unlock()
+		if len(results) >= n {
+			return results
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got notifications %v, want %d", results, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeHTTPOnTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		onTimeout string
+		retries   int
+		// when the host comes up, negative for never
+		upAfter    time.Duration
+		wantStatus int
+		wantNext   bool
+		wantSends  int
+		wantResult wakeResult
+	}{
+		{name: "default", upAfter: -1, wantStatus: http.StatusNoContent, wantNext: true, wantSends: 1, wantResult: resultWakeTimeout},
+		{name: "next", onTimeout: onTimeoutNext, upAfter: -1, wantStatus: http.StatusNoContent, wantNext: true, wantSends: 1, wantResult: resultWakeTimeout},
+		{name: "error", onTimeout: onTimeoutError, upAfter: -1, wantStatus: http.StatusGatewayTimeout, wantSends: 1},
+		{name: "retry exhausted", onTimeout: onTimeoutRetry, retries: 2, upAfter: -1, wantStatus: http.StatusNoContent, wantNext: true, wantSends: 3, wantResult: resultWakeTimeout},
+		{name: "retry default", onTimeout: onTimeoutRetry, upAfter: -1, wantStatus: http.StatusNoContent, wantNext: true, wantSends: 1 + defaultTimeoutRetries, wantResult: resultWakeTimeout},
+		{name: "retry woken", onTimeout: onTimeoutRetry, retries: 2, upAfter: 900 * time.Millisecond, wantStatus: http.StatusNoContent, wantNext: true, wantSends: 2, wantResult: resultWoken},
+		{name: "notify", onTimeout: onTimeoutNotify, upAfter: -1, wantStatus: http.StatusNoContent, wantNext: true, wantSends: 1, wantResult: resultWakeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			hook := newWebhook(t)
+			checkPort := closedPort(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:              testMAC,
+				IP:               "127.0.0.1",
+				Port:             host.port(),
+				Check:            fmt.Sprintf("127.0.0.1:%d", checkPort),
+				Wait:             caddy.Duration(600 * time.Millisecond),
+				OnTimeout:        tt.onTimeout,
+				OnTimeoutRetries: tt.retries,
+				Notify:           hook.URL,
+				StatusHeader:     "X-Wake-Result",
+			})
+			listenAfter(t, checkPort, tt.upAfter)
+
+			r := newTestRequest("GET", "http://example.com/", nil)
+			rec := httptest.NewRecorder()
+			next := new(nextHandler)
+			err := w.ServeHTTP(rec, r, next)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if next.called != tt.wantNext {
+				t.Errorf("next called = %v, want %v", next.called, tt.wantNext)
+			}
+			host.expect(t, tt.wantSends)
+			host.expectNone(t)
+			// Each pass adds its results; the last is the target's outcome
+			if results := rec.Header().Values("X-Wake-Result"); tt.wantResult != "" {
+				if len(results) != tt.wantSends || !strings.HasPrefix(results[len(results)-1], string(tt.wantResult)+";") {
+					t.Errorf("results %q, want %d ending in %s", results, tt.wantSends, tt.wantResult)
+				}
+			}
+			// Every wake, retries included, notifies its outcome
+			if results := hook.waitFor(t, tt.wantSends); results[0] != string(resultWakeTimeout) {
+				t.Errorf("first notification %q, want %s", results[0], resultWakeTimeout)
+			}
+		})
+	}
+}
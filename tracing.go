@@ -0,0 +1,42 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies this module's spans.
+const tracerName = "github.com/bartosz-kakol/caddy-wakeonlan"
+
+// startSpan starts a child of the span in ctx, using the tracer provider
+// it came from. Caddy's tracing handler puts one in the request context;
+// without it the span is a no-op.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// targetAttributes describes t on a span.
+func targetAttributes(t Target) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("wake_on_lan.target", t.label()),
+		attribute.String("wake_on_lan.mac", t.MAC),
+		attribute.String("wake_on_lan.ip", t.IP),
+	}
+}
+
+// endSpan records the outcome on span and ends it. Only failures are
+// recorded as errors; a wake timeout is an outcome, not an error.
+func endSpan(span trace.Span, result wakeResult, err error) {
+	if result != "" {
+		span.SetAttributes(attribute.String("wake_on_lan.result", string(result)))
+	}
+	if err != nil && (result == "" || result.failed()) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
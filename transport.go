@@ -0,0 +1,77 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// transportRawEthernet sends the packet as a raw layer 2 frame (EtherType
+// 0x0842) on RawInterface, without IP or UDP headers.
+const transportRawEthernet = "raw_ethernet"
+
+// etherTypeWOL is the EtherType for Wake-on-LAN frames.
+const etherTypeWOL = 0x0842
+
+// rawEthernetSend sends the frames of the raw_ethernet transport; tests
+// stub it, as sending needs CAP_NET_RAW.
+var rawEthernetSend = sendRawEthernet
+
+// errRawEthernetUnsupported is returned where raw frames can't be sent.
+var errRawEthernetUnsupported = errors.New("raw ethernet is not supported on this platform")
+
+// validateTransports checks the transports list and the options it needs.
+func (w *WakeOnLAN) validateTransports() error {
+	if len(w.Transports) == 0 {
+		return nil
+	}
+	if w.Protocol != "" {
+		return errors.New("protocol and transports are mutually exclusive")
+	}
+	for i, transport := range w.Transports {
+		switch transport {
+		case protocolTCP, transportRawEthernet:
+		default:
+			if _, ok := lookupSender(transport); !ok {
+				return fmt.Errorf("unknown transport %q", transport)
+			}
+		}
+		if slices.Contains(w.Transports[:i], transport) {
+			return fmt.Errorf("duplicate transport %q", transport)
+		}
+	}
+	if slices.Contains(w.Transports, transportRawEthernet) && w.RawInterface == "" {
+		return errors.New("transport raw_ethernet requires a raw_interface")
+	}
+	return nil
+}
+
+// provisionTransports sets the transports each packet is sent over,
+// dropping raw ethernet where the platform can't send it.
+func (w *WakeOnLAN) provisionTransports() {
+	switch {
+	case len(w.Transports) > 0:
+		w.transports = slices.Clone(w.Transports)
+	case w.Protocol != "":
+		w.transports = []string{w.Protocol}
+	default:
+		w.transports = []string{protocolUDP}
+	}
+	if i := slices.Index(w.transports, transportRawEthernet); i >= 0 && !rawEthernetSupported {
+		w.logger.Warn("skipping transport", zap.String("transport", transportRawEthernet), zap.Error(errRawEthernetUnsupported))
+		w.transports = slices.Delete(w.transports, i, i+1)
+	}
+}
+
+// requiresIP reports whether targets need an IP to be sent to: a
+// broadcast address, raw ethernet and a relay can reach them without one.
+// Until Provision applies the handler's profile, which may bring a
+// broadcast address, it can't tell, and doesn't require one.
+func (w *WakeOnLAN) requiresIP() bool {
+	if w.Profile != "" && !w.profileApplied {
+		return false
+	}
+	return w.Broadcast == "" && !w.relayed() && !slices.Contains(w.Transports, transportRawEthernet)
+}
@@ -0,0 +1,173 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rawFrame is a frame sent through the stubbed raw ethernet transport.
+type rawFrame struct {
+	iface  string
+	packet []byte
+}
+
+// stubRawEthernet replaces the raw ethernet transport for the test,
+// recording the frames sent and failing with err.
+func stubRawEthernet(t *testing.T, err error) func() []rawFrame {
+	t.Helper()
+	var mu sync.Mutex
+	var frames []rawFrame
+	orig := rawEthernetSend
+	rawEthernetSend = func(iface string, packet []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		frames = append(frames, rawFrame{iface: iface, packet: bytes.Clone(packet)})
+		return err
+	}
+	t.Cleanup(func() { rawEthernetSend = orig })
+	return func() []rawFrame {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(frames)
+	}
+}
+
+func TestTransportsConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: "transports udp tcp", want: []string{"udp", "tcp"}},
+		{input: "transports udp raw_ethernet\n\traw_interface eth0", want: []string{"udp", "raw_ethernet"}},
+		{input: "transports", wantErr: true},
+		{input: "transports udp carrier_pigeon", wantErr: true},
+		{input: "transports udp udp", wantErr: true},
+		{input: "transports udp raw_ethernet", wantErr: true},
+		{input: "transports udp tcp\n\tprotocol tcp", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(w.Transports, tt.want) {
+				t.Errorf("transports = %v, want %v", w.Transports, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvisionTransports(t *testing.T) {
+	// Raw ethernet is dropped where it can't be sent
+	withRaw := []string{protocolUDP}
+	if rawEthernetSupported {
+		withRaw = append(withRaw, transportRawEthernet)
+	}
+	tests := []struct {
+		name string
+		w    *WakeOnLAN
+		want []string
+	}{
+		{name: "default", w: &WakeOnLAN{}, want: []string{protocolUDP}},
+		{name: "protocol", w: &WakeOnLAN{Protocol: protocolTCP}, want: []string{protocolTCP}},
+		{name: "transports", w: &WakeOnLAN{Transports: []string{protocolUDP, protocolTCP}}, want: []string{protocolUDP, protocolTCP}},
+		{name: "raw ethernet", w: &WakeOnLAN{Transports: []string{protocolUDP, transportRawEthernet}, RawInterface: "eth0"}, want: withRaw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.w.MAC, tt.w.IP = testMAC, "192.0.2.1"
+			w := provisionTest(t, tt.w)
+			if !slices.Equal(w.transports, tt.want) {
+				t.Errorf("transports = %v, want %v", w.transports, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPTransports(t *testing.T) {
+	if !rawEthernetSupported {
+		t.Skip("raw ethernet is dropped on this platform")
+	}
+	hw, _ := parseMAC(testMAC)
+	magic := buildMagicPacket(hw)
+	tests := []struct {
+		name       string
+		rawErr     error
+		wantResult wakeResult
+	}{
+		{name: "both sent", wantResult: resultSent},
+		{name: "raw ethernet failing", rawErr: errors.New("operation not permitted"), wantResult: resultSendFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := stubRawEthernet(t, tt.rawErr)
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:          testMAC,
+				IP:           "127.0.0.1",
+				Port:         host.port(),
+				Transports:   []string{protocolUDP, transportRawEthernet},
+				RawInterface: "eth0",
+				StatusHeader: "X-Wake-Result",
+			})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rec.Header().Get("X-Wake-Result"); !strings.HasPrefix(got, string(tt.wantResult)+";") {
+				t.Errorf("result %q, want %s", got, tt.wantResult)
+			}
+			if p := host.expect(t, 1)[0]; !bytes.Equal(p, magic) {
+				t.Errorf("UDP packet % x, want the magic packet", p)
+			}
+			got := frames()
+			if len(got) != 1 || got[0].iface != "eth0" || !bytes.Equal(got[0].packet, magic) {
+				t.Errorf("raw frames %v, want the magic packet on eth0", got)
+			}
+		})
+	}
+}
+
+func TestServeHTTPTransportsUDPAndTCP(t *testing.T) {
+	port, received := tcpReceiver(t)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Skipf("UDP port %d taken: %v", port, err)
+	}
+	defer conn.Close()
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: port, Transports: []string{protocolUDP, protocolTCP}, Required: true})
+	if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	hw, _ := parseMAC(testMAC)
+	magic := buildMagicPacket(hw)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no UDP packet: %v", err)
+	}
+	if !bytes.Equal(buf[:n], magic) {
+		t.Errorf("UDP packet % x, want the magic packet", buf[:n])
+	}
+	select {
+	case p := <-received:
+		if !bytes.Equal(p, magic) {
+			t.Errorf("TCP payload % x, want the magic packet", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("no TCP payload")
+	}
+}
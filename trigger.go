@@ -0,0 +1,100 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// TriggerThreshold requires sustained interest before waking, the opposite
+// of a cooldown: a target is only woken once Count matching requests have
+// arrived within Window, so a single stray probe doesn't wake it.
+type TriggerThreshold struct {
+	// Requests needed within the window.
+	Count int `json:"count"`
+	// Sliding window the requests are counted over.
+	Window caddy.Duration `json:"window"`
+}
+
+// validate checks the count and window.
+func (t *TriggerThreshold) validate() error {
+	if t.Count < 1 {
+		return errors.New("trigger_threshold count must be at least 1")
+	}
+	if t.Window <= 0 {
+		return errors.New("trigger_threshold window must be positive")
+	}
+	return nil
+}
+
+// triggerCounter counts requests per target over a sliding window.
+type triggerCounter struct {
+	count  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	nextSweep time.Time
+}
+
+func newTriggerCounter(t *TriggerThreshold) *triggerCounter {
+	return &triggerCounter{
+		count:  t.Count,
+		window: time.Duration(t.Window),
+		now:    time.Now,
+		hits:   make(map[string][]time.Time),
+	}
+}
+
+// hit counts a request for the target with key and reports whether it
+// meets the threshold, in which case the count starts over.
+func (c *triggerCounter) hit(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	cutoff := now.Add(-c.window)
+	if now.After(c.nextSweep) {
+		// Targets asked for once, e.g. through from_query, don't linger
+		for k, hits := range c.hits {
+			if !hits[len(hits)-1].After(cutoff) {
+				delete(c.hits, k)
+			}
+		}
+		c.nextSweep = now.Add(c.window)
+	}
+	hits := c.hits[key]
+	for len(hits) > 0 && !hits[0].After(cutoff) {
+		hits = hits[1:]
+	}
+	hits = append(hits, now)
+	if len(hits) >= c.count {
+		delete(c.hits, key)
+		return true
+	}
+	c.hits[key] = hits
+	return false
+}
+
+// triggered returns the targets whose trigger threshold this request
+// meets, counting it for the others.
+func (w *WakeOnLAN) triggered(targets []Target, logger *zap.Logger) []Target {
+	if w.trigger == nil {
+		return targets
+	}
+	var met []Target
+	for _, t := range targets {
+		if w.trigger.hit(t.key()) {
+			met = append(met, t)
+			continue
+		}
+		logger.Debug("trigger threshold not met yet; not waking",
+			zap.String("target", t.label()),
+			zap.Int("count", w.TriggerThreshold.Count),
+			zap.Duration("window", time.Duration(w.TriggerThreshold.Window)))
+	}
+	return met
+}
@@ -0,0 +1,152 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestTriggerThresholdConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    TriggerThreshold
+		wantErr bool
+	}{
+		{input: "trigger_threshold 3 10s", want: TriggerThreshold{Count: 3, Window: caddy.Duration(10 * time.Second)}},
+		{input: "trigger_threshold 1 1m", want: TriggerThreshold{Count: 1, Window: caddy.Duration(time.Minute)}},
+		{input: "trigger_threshold 0 10s", wantErr: true},
+		{input: "trigger_threshold 3 0s", wantErr: true},
+		{input: "trigger_threshold three 10s", wantErr: true},
+		{input: "trigger_threshold 3 soon", wantErr: true},
+		{input: "trigger_threshold 3", wantErr: true},
+		{input: "trigger_threshold 3 10s 1m", wantErr: true},
+		{input: "trigger_threshold 3 10s\n\tfrom_body", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.TriggerThreshold != tt.want {
+				t.Errorf("trigger_threshold = %+v, want %+v", *w.TriggerThreshold, tt.want)
+			}
+		})
+	}
+}
+
+func TestTriggerCounter(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+		// when each request arrives, from the start
+		at   []time.Duration
+		want []bool
+	}{
+		{name: "one", count: 1, at: []time.Duration{0, time.Second}, want: []bool{true, true}},
+		{name: "sustained", count: 3, at: []time.Duration{0, 2 * time.Second, 4 * time.Second}, want: []bool{false, false, true}},
+		{
+			name:  "starts over",
+			count: 2,
+			at:    []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second},
+			want:  []bool{false, true, false, true},
+		},
+		{
+			name:  "too slow",
+			count: 3,
+			at:    []time.Duration{0, 6 * time.Second, 12 * time.Second, 18 * time.Second},
+			want:  []bool{false, false, false, false},
+		},
+		// The window slides: the first request drops out, the next two
+		// count with the one after
+		{
+			name:  "sliding",
+			count: 3,
+			at:    []time.Duration{0, 8 * time.Second, 11 * time.Second, 12 * time.Second},
+			want:  []bool{false, false, false, true},
+		},
+		{name: "at the window's edge", count: 2, at: []time.Duration{0, 10 * time.Second}, want: []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTriggerCounter(&TriggerThreshold{Count: tt.count, Window: caddy.Duration(10 * time.Second)})
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			for i, at := range tt.at {
+				c.now = func() time.Time { return start.Add(at) }
+				if got := c.hit(testMAC); got != tt.want[i] {
+					t.Errorf("request %d at %s: met = %v, want %v", i+1, at, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTriggerCounterPerTarget(t *testing.T) {
+	c := newTriggerCounter(&TriggerThreshold{Count: 2, Window: caddy.Duration(10 * time.Second)})
+	for i, tt := range []struct {
+		key  string
+		want bool
+	}{
+		{key: "nas"},
+		{key: "desktop"},
+		{key: "nas", want: true},
+		{key: "nas"},
+		{key: "desktop", want: true},
+	} {
+		if got := c.hit(tt.key); got != tt.want {
+			t.Errorf("request %d for %s: met = %v, want %v", i+1, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestTriggerCounterSweep(t *testing.T) {
+	// Targets asked for once are forgotten after a window
+	c := newTriggerCounter(&TriggerThreshold{Count: 2, Window: caddy.Duration(10 * time.Second)})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	c.hit("stray")
+	now = now.Add(11 * time.Second)
+	c.hit("nas")
+	if _, ok := c.hits["stray"]; ok {
+		t.Error("a target asked for once is still counted after the window")
+	}
+}
+
+func TestServeHTTPTriggerThreshold(t *testing.T) {
+	tests := []struct {
+		name string
+		// gap between requests
+		gaps        []time.Duration
+		wantPackets []int
+	}{
+		{name: "burst", gaps: []time.Duration{0, 0, 0, 0}, wantPackets: []int{0, 0, 1, 0}},
+		{name: "slow", gaps: []time.Duration{0, 400 * time.Millisecond, 400 * time.Millisecond}, wantPackets: []int{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:              testMAC,
+				IP:               "127.0.0.1",
+				Port:             host.port(),
+				TriggerThreshold: &TriggerThreshold{Count: 3, Window: caddy.Duration(500 * time.Millisecond)},
+			})
+			for i, gap := range tt.gaps {
+				time.Sleep(gap)
+				rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+				if got := statusOf(rec, err); got != http.StatusNoContent || !called {
+					t.Fatalf("request %d: status = %d, next called %v; want %d and called (%v)", i+1, got, called, http.StatusNoContent, err)
+				}
+				if tt.wantPackets[i] > 0 {
+					host.expect(t, tt.wantPackets[i])
+				}
+				host.expectNone(t)
+			}
+		})
+	}
+}
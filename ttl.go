@@ -0,0 +1,41 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// validateTTL checks a ttl setting: unset, or a hop count from 1 to 255.
+func validateTTL(ttl int) error {
+	if ttl < 0 || ttl > 255 {
+		return fmt.Errorf("invalid ttl %d (want 1-255)", ttl)
+	}
+	return nil
+}
+
+// setTTL sets the hop limit of packets sent on conn to dest: IP_TTL or
+// IP_MULTICAST_TTL for IPv4, IPV6_UNICAST_HOPS or IPV6_MULTICAST_HOPS for
+// IPv6. A ttl of 0 leaves the system's default.
+func setTTL(conn net.PacketConn, dest net.IP, ttl int) error {
+	if ttl == 0 {
+		return nil
+	}
+	var err error
+	switch multicast := dest.IsMulticast(); {
+	case dest.To4() != nil && multicast:
+		err = ipv4.NewPacketConn(conn).SetMulticastTTL(ttl)
+	case dest.To4() != nil:
+		err = ipv4.NewPacketConn(conn).SetTTL(ttl)
+	case multicast:
+		err = ipv6.NewPacketConn(conn).SetMulticastHopLimit(ttl)
+	default:
+		err = ipv6.NewPacketConn(conn).SetHopLimit(ttl)
+	}
+	if err != nil {
+		return fmt.Errorf("setting ttl %d: %w", ttl, err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package caddy_wakeonlan
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestTTLConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		want       int
+		wantTarget int
+		wantErr    bool
+	}{
+		{name: "handler", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tttl 3\n}", want: 3, wantTarget: 3},
+		{name: "bounds", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tttl 255\n}", want: 255, wantTarget: 255},
+		{
+			name:       "target",
+			input:      "wake_on_lan {\n\tttl 3\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tttl 7\n\t}\n}",
+			want:       3,
+			wantTarget: 7,
+		},
+		{name: "zero", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tttl 0\n}"},
+		{name: "too large", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tttl 256\n}", wantErr: true},
+		{name: "negative", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tttl -1\n}", wantErr: true},
+		{name: "not a number", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tttl many\n}", wantErr: true},
+		{name: "no argument", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tttl\n}", wantErr: true},
+		{
+			name:    "target too large",
+			input:   "wake_on_lan {\n\ttarget " + testMAC + " 192.0.2.1 {\n\t\tttl 300\n\t}\n}",
+			wantErr: true,
+		},
+		{name: "with relay", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tttl 3\n\trelay 192.0.2.10:9\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if w.TTL != tt.want {
+				t.Errorf("ttl = %d, want %d", w.TTL, tt.want)
+			}
+			if got := w.targets()[0].TTL; got != tt.wantTarget {
+				t.Errorf("target ttl = %d, want %d", got, tt.wantTarget)
+			}
+		})
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		dest    net.IP
+		ttl     int
+		// reads the option back
+		get func(conn net.PacketConn) (int, error)
+	}{
+		{name: "IPv4", network: "udp4", dest: net.IPv4(192, 0, 2, 1), ttl: 3, get: func(c net.PacketConn) (int, error) { return ipv4.NewPacketConn(c).TTL() }},
+		{name: "IPv4 broadcast", network: "udp4", dest: net.IPv4bcast, ttl: 200, get: func(c net.PacketConn) (int, error) { return ipv4.NewPacketConn(c).TTL() }},
+		{
+			name:    "IPv4 multicast",
+			network: "udp4",
+			dest:    net.IPv4(239, 255, 0, 1),
+			ttl:     5,
+			get:     func(c net.PacketConn) (int, error) { return ipv4.NewPacketConn(c).MulticastTTL() },
+		},
+		{name: "IPv6", network: "udp6", dest: net.ParseIP("2001:db8::1"), ttl: 7, get: func(c net.PacketConn) (int, error) { return ipv6.NewPacketConn(c).HopLimit() }},
+		{
+			name:    "IPv6 multicast",
+			network: "udp6",
+			dest:    net.ParseIP("ff02::1"),
+			ttl:     9,
+			get:     func(c net.PacketConn) (int, error) { return ipv6.NewPacketConn(c).MulticastHopLimit() },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenPacket(tt.network, "")
+			if err != nil {
+				t.Skipf("no %s socket: %v", tt.network, err)
+			}
+			defer conn.Close()
+			before, err := tt.get(conn)
+			if err != nil {
+				t.Skipf("can't read the option back here: %v", err)
+			}
+			// 0 keeps the system's default
+			if err := setTTL(conn, tt.dest, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := tt.get(conn); got != before {
+				t.Errorf("ttl 0 changed the option from %d to %d", before, got)
+			}
+			if err := setTTL(conn, tt.dest, tt.ttl); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := tt.get(conn); got != tt.ttl {
+				t.Errorf("option = %d, want %d", got, tt.ttl)
+			}
+		})
+	}
+}
+
+// ttlHost is a fakeHost reporting the TTL each packet arrived with.
+type ttlHost struct {
+	conn *ipv4.PacketConn
+	port int
+}
+
+// newTTLHost listens on a free loopback port until the test ends, skipping
+// the test where received TTLs can't be read.
+func newTTLHost(t *testing.T) *ttlHost {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	p := ipv4.NewPacketConn(conn)
+	if err := p.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+		t.Skipf("can't read received TTLs here: %v", err)
+	}
+	return &ttlHost{conn: p, port: conn.LocalAddr().(*net.UDPAddr).Port}
+}
+
+// expectTTLs waits for n packets and returns the TTL of each.
+func (h *ttlHost) expectTTLs(t *testing.T, n int) []int {
+	t.Helper()
+	buf := make([]byte, 2048)
+	var ttls []int
+	h.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(ttls) < n {
+		_, cm, _, err := h.conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %d packets, want %d: %v", len(ttls), n, err)
+		}
+		if cm == nil {
+			t.Skip("no TTL received with the packet")
+		}
+		ttls = append(ttls, cm.TTL)
+	}
+	return ttls
+}
+
+func TestServeHTTPTTL(t *testing.T) {
+	// The TTL of packets sent without one
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	systemTTL, err := ipv4.NewPacketConn(conn).TTL()
+	conn.Close()
+	if err != nil {
+		t.Skipf("can't read the default TTL: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		ttl       int
+		targetTTL int
+		// a loopback address standing in for the broadcast address, so
+		// each packet is caught twice
+		broadcast bool
+		want      int
+	}{
+		{name: "default", want: systemTTL},
+		{name: "handler", ttl: 3, want: 3},
+		{name: "target", ttl: 3, targetTTL: 7, want: 7},
+		{name: "broadcast", ttl: 5, broadcast: true, want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newTTLHost(t)
+			w := &WakeOnLAN{
+				Targets: []Target{{MAC: testMAC, IP: "127.0.0.1", Port: host.port, TTL: tt.targetTTL}},
+				TTL:     tt.ttl,
+			}
+			packets := 1
+			if tt.broadcast {
+				w.Broadcast = "127.0.0.1"
+				packets = 2
+			}
+			provisionTest(t, w)
+			if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			for i, got := range host.expectTTLs(t, packets) {
+				if got != tt.want {
+					t.Errorf("packet %d arrived with ttl %d, want %d", i+1, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// resultTXConfirmed reports a packet the interface it left through counted
+// as transmitted, with no wait configured or nothing to confirm the host
+// up by.
+const resultTXConfirmed wakeResult = "tx_confirmed"
+
+// sysClassNet is where Linux exposes the interfaces' counters.
+var sysClassNet = "/sys/class/net"
+
+// txSettle is how long confirm_tx waits after the send for the counter to
+// advance: drivers count a packet once it is handed to the hardware.
+const txSettle = 100 * time.Millisecond
+
+// txCountersAvailable reports whether the interfaces' counters can be read
+// here.
+func txCountersAvailable() error {
+	_, err := os.Stat(sysClassNet)
+	return err
+}
+
+// validateConfirmTX checks confirm_tx against the settings it can't see
+// the packets of.
+func (w *WakeOnLAN) validateConfirmTX() error {
+	switch {
+	case !w.ConfirmTX:
+		return nil
+	case w.relayed() || w.Publish != nil || w.GRPC != nil || w.HelperSocket != "":
+		return errors.New("confirm_tx cannot be combined with relay, publish, grpc or helper_socket, which send the packets from elsewhere")
+	case len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil:
+		return errors.New("confirm_tx cannot be combined with escalate, send_until_up or broadcast_fallback")
+	}
+	return nil
+}
+
+// txCount is an interface's TX counter before a send.
+type txCount struct {
+	iface  string
+	before uint64
+}
+
+// startTXCount reads the TX counter of the interface t's packets leave
+// through, returning nil if it can't be read, to send unconfirmed.
+func (w *WakeOnLAN) startTXCount(ctx context.Context, t Target, opts sendOptions, logger *zap.Logger) *txCount {
+	iface, err := txInterface(ctx, t, w.Broadcast, opts)
+	if err == nil {
+		var n uint64
+		if n, err = readTXPackets(iface); err == nil {
+			return &txCount{iface: iface, before: n}
+		}
+	}
+	logger.Debug("can't read the interface's TX counter; not confirming the send", zap.Error(err))
+	return nil
+}
+
+// advanced reports whether the counter moved past its value before the
+// send within txSettle. Other traffic on the interface advances it too, so
+// it confirms the packet left only as far as the counter can tell.
+func (c *txCount) advanced(ctx context.Context) bool {
+	deadline := time.Now().Add(txSettle)
+	for {
+		n, err := readTXPackets(c.iface)
+		if err != nil {
+			return false
+		}
+		if n > c.before {
+			return true
+		}
+		if !time.Now().Before(deadline) || sleepCtx(ctx, 10*time.Millisecond) != nil {
+			return false
+		}
+	}
+}
+
+// confirmTX reports whether c saw the packets leave, logging when it
+// didn't. A nil c confirms nothing.
+func (w *WakeOnLAN) confirmTX(ctx context.Context, c *txCount, t Target, logger *zap.Logger) bool {
+	if c == nil {
+		return false
+	}
+	if c.advanced(ctx) {
+		logger.Debug("packet counted by the interface", zap.String("interface", c.iface))
+		return true
+	}
+	if w.logThrottle.allow(t.label(), "confirm_tx", zapcore.WarnLevel) {
+		logger.Warn("TX counter didn't advance; the packet may have been dropped before leaving the interface", zap.String("interface", c.iface))
+	}
+	return false
+}
+
+// txInterface returns the interface t's packets leave through: its own, the
+// raw_interface for raw ethernet frames, or else the one the system routes
+// its address, or the broadcast address, through.
+func txInterface(ctx context.Context, t Target, broadcast string, opts sendOptions) (string, error) {
+	if t.Interface != "" {
+		return t.Interface, nil
+	}
+	if opts.RawInterface != "" && slices.Contains(opts.Transports, transportRawEthernet) {
+		return opts.RawInterface, nil
+	}
+	var ip net.IP
+	switch {
+	case t.IP != "":
+		addr, err := resolveUDPAddr(ctx, t.IP, portOrDefault(t.Port), opts.ResolveRetries, opts.ResolveBackoff, opts.Prefer)
+		if err != nil {
+			return "", err
+		}
+		ip = addr.IP
+	case broadcast != "":
+		ip = net.ParseIP(broadcast)
+	default:
+		return "", errors.New("no address to find the interface by")
+	}
+	return routeInterface(ip)
+}
+
+// routeInterface returns the interface packets to ip leave through: the
+// one on ip's network or, off every local network, the one holding the
+// address the system sends from to reach it.
+func routeInterface(ip net.IP) (string, error) {
+	nets, err := localNetworks()
+	if err != nil {
+		return "", err
+	}
+	for _, n := range nets {
+		if n.network.Contains(ip) {
+			return n.iface, nil
+		}
+	}
+	dest := net.JoinHostPort(ip.String(), "9")
+	if ip.Equal(net.IPv4bcast) {
+		dest = defaultRouteProbe
+	}
+	// Connecting a UDP socket only looks the route up; nothing is sent
+	conn, err := net.Dial("udp", dest)
+	if err != nil {
+		return "", fmt.Errorf("finding the route to %s: %w", ip, err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(local) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface holds %s, the source address to %s", local, ip)
+}
+
+// readTXPackets reads the packets ifname transmitted so far.
+func readTXPackets(ifname string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(sysClassNet, ifname, "statistics", "tx_packets"))
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("interface %s: invalid tx_packets: %w", ifname, err)
+	}
+	return n, nil
+}
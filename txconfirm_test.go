@@ -0,0 +1,150 @@
+package caddy_wakeonlan
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeTXCounters points the TX counters at a directory of the test's, with
+// ifname's counter at n, and returns the function setting it.
+func fakeTXCounters(t *testing.T, ifname string, n uint64) func(uint64) {
+	t.Helper()
+	dir := t.TempDir()
+	old := sysClassNet
+	sysClassNet = dir
+	t.Cleanup(func() { sysClassNet = old })
+	stats := filepath.Join(dir, ifname, "statistics")
+	if err := os.MkdirAll(stats, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	set := func(n uint64) {
+		if err := os.WriteFile(filepath.Join(stats, "tx_packets"), []byte(strconv.FormatUint(n, 10)+"\n"), 0o644); err != nil {
+			t.Error(err)
+		}
+	}
+	set(n)
+	return set
+}
+
+func TestConfirmTXConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "alone", input: "confirm_tx"},
+		{name: "with wait", input: "confirm_tx\n\tcheck 192.0.2.1:22\n\twait 1m"},
+		{name: "argument", input: "confirm_tx eth0", wantErr: true},
+		{name: "with relay", input: "confirm_tx\n\trelay 192.0.2.10:9", wantErr: true},
+		{name: "with escalate", input: "confirm_tx\n\tcheck 192.0.2.1:22\n\tescalate {\n\t\tunicast 5s\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.ConfirmTX {
+				t.Error("confirm_tx not set")
+			}
+		})
+	}
+}
+
+func TestReadTXPackets(t *testing.T) {
+	set := fakeTXCounters(t, "eth0", 42)
+	if n, err := readTXPackets("eth0"); err != nil || n != 42 {
+		t.Errorf("readTXPackets = %d, %v, want 42", n, err)
+	}
+	if _, err := readTXPackets("eth1"); err == nil {
+		t.Error("counter of a missing interface read")
+	}
+	set(0)
+	os.WriteFile(filepath.Join(sysClassNet, "eth0", "statistics", "tx_packets"), []byte("many"), 0o644)
+	if _, err := readTXPackets("eth0"); err == nil {
+		t.Error("invalid counter read")
+	}
+}
+
+func TestTXCountAdvanced(t *testing.T) {
+	set := fakeTXCounters(t, "eth0", 10)
+	c := &txCount{iface: "eth0", before: 10}
+	if c.advanced(t.Context()) {
+		t.Error("unchanged counter reported advanced")
+	}
+	// Counted shortly after the send, within txSettle
+	time.AfterFunc(txSettle/4, func() { set(11) })
+	if !c.advanced(t.Context()) {
+		t.Error("counter advancing after the send not seen")
+	}
+	if (&txCount{iface: "eth1"}).advanced(t.Context()) {
+		t.Error("missing counter reported advanced")
+	}
+}
+
+func TestTXInterface(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    Target
+		broadcast string
+		opts      sendOptions
+		want      string
+		wantErr   bool
+	}{
+		{name: "target interface", target: Target{MAC: testMAC, IP: "192.0.2.1", Interface: "eth1"}, want: "eth1"},
+		{name: "raw interface", target: Target{MAC: testMAC}, opts: sendOptions{RawInterface: "eth2", Transports: []string{transportRawEthernet}}, want: "eth2"},
+		{name: "routed", target: Target{MAC: testMAC, IP: "127.0.0.1"}, want: "lo"},
+		{name: "no address", target: Target{MAC: testMAC}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := txInterface(t.Context(), tt.target, tt.broadcast, tt.opts.withDefaults())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("interface %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPConfirmTX(t *testing.T) {
+	tests := []struct {
+		name string
+		// whether the counter advances after the send
+		counted    bool
+		wantResult wakeResult
+	}{
+		{name: "counted", counted: true, wantResult: resultTXConfirmed},
+		{name: "not counted", wantResult: resultSent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := fakeTXCounters(t, "lo", 100)
+			if tt.counted {
+				time.AfterFunc(txSettle/4, func() { set(101) })
+			}
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), ConfirmTX: true, StatusHeader: "X-Wake-Result"})
+			logs := observeLogs(w)
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			host.expect(t, 1)
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			if warned := logs.FilterMessageSnippet("TX counter didn't advance").Len() > 0; warned == tt.counted {
+				t.Errorf("warned %v, want %v", warned, !tt.counted)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Defaults for send_until_up.
+const (
+	defaultUntilUpInterval    = time.Second
+	defaultUntilUpMaxPackets  = 20
+	defaultUntilUpMaxDuration = 30 * time.Second
+)
+
+// writeTimeoutMargin is kept from the server's write timeout for the
+// response itself when deriving a default duration from it.
+const writeTimeoutMargin = time.Second
+
+// SendUntilUp keeps sending packets to a target, probing it in between,
+// until it is up or either cap is reached.
+type SendUntilUp struct {
+	// Time between packets, spent probing. Default: 1s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// Most packets sent. Default: 20.
+	MaxPackets int `json:"max_packets,omitempty"`
+	// Longest the loop runs, including the probing after the last packet.
+	// Default: 30s, or less to end a second before the server's
+	// write_timeout.
+	MaxDuration caddy.Duration `json:"max_duration,omitempty"`
+	// Address (host:port) probed over TCP. Default: each target's check
+	// address.
+	Probe string `json:"probe,omitempty"`
+}
+
+// validateSendUntilUp checks send_until_up and the settings it replaces.
+func (w *WakeOnLAN) validateSendUntilUp() error {
+	s := w.SendUntilUp
+	if s == nil {
+		return nil
+	}
+	if s.Interval < 0 || s.MaxDuration < 0 || s.MaxPackets < 0 {
+		return errors.New("send_until_up interval, max_packets and max_duration must not be negative")
+	}
+	if s.Interval > 0 && s.MaxDuration > 0 && s.Interval > s.MaxDuration {
+		return fmt.Errorf("send_until_up interval %s exceeds max_duration %s", time.Duration(s.Interval), time.Duration(s.MaxDuration))
+	}
+	if err := validateProbeAddress(s.Probe); err != nil {
+		return fmt.Errorf("send_until_up probe: %w", err)
+	}
+	switch {
+	case w.Wait > 0 || len(w.Escalate) > 0 || w.WaitingPage != nil:
+		return errors.New("send_until_up replaces wait, escalate and waiting_page")
+	case w.RetryProbe != "":
+		return errors.New("send_until_up replaces retry_probe")
+	}
+	if s.Probe == "" {
+		for _, t := range w.allTargets() {
+			if t.Check == "" {
+				return errors.New("send_until_up requires a probe or check address")
+			}
+		}
+	}
+	return nil
+}
+
+// sendUntilUp sends one packet to t per interval, probing in between, and
+// stops as soon as the probe succeeds. When send is false (a packet went
+// out recently), it only probes for as long as the loop would have run.
+func (w *WakeOnLAN) sendUntilUp(ctx context.Context, t Target, send bool, logger *zap.Logger) (wakeResult, error) {
+	s := w.SendUntilUp
+	interval, maxPackets, maxDuration := time.Duration(s.Interval), s.MaxPackets, time.Duration(s.MaxDuration)
+	if interval == 0 {
+		interval = defaultUntilUpInterval
+	}
+	if maxPackets == 0 {
+		maxPackets = defaultUntilUpMaxPackets
+	}
+	if maxDuration == 0 {
+		maxDuration = w.untilUpMaxDuration
+	}
+	if maxDuration == 0 {
+		maxDuration = defaultUntilUpMaxDuration
+	}
+	if send {
+		// The initial delay counts toward max_duration, leaving at least
+		// one interval
+		maxDuration = max(maxDuration-time.Duration(w.InitialDelay), interval)
+	}
+	probe := s.Probe
+	if probe == "" {
+		probe = t.Check
+	}
+	checkTimeout := time.Duration(w.CheckTimeout)
+	if !send {
+		logger.Debug("packet sent recently; only waiting", zap.String("probe", probe), zap.Duration("wait", maxDuration))
+		if waitTCP(ctx, probe, checkTimeout, maxDuration) {
+			return resultWoken, nil
+		}
+		return resultWakeTimeout, nil
+	}
+
+	loopCtx, cancel := context.WithTimeout(ctx, maxDuration)
+	defer cancel()
+	opts := w.sendOptions()
+	if opts.PacketLogger != nil {
+		opts.PacketLogger = logger
+	}
+	opts.RelayLogger = logger
+	var sent int
+	var sentAt time.Time
+	var lastErr error
+	for i := 1; i <= maxPackets && loopCtx.Err() == nil; i++ {
+		if err := sendWOL(loopCtx, attemptTarget(t, opts, i-1), opts); err != nil {
+			logger.Debug("sending packet failed", zap.Int("attempt", i), zap.Error(err))
+			lastErr = err
+		} else {
+			if sent == 0 {
+				sentAt = time.Now()
+			}
+			sent++
+			logger.Debug("packet sent", zap.Int("attempt", i), zap.Int("max_packets", maxPackets), zap.Int("size", packetSize(t, opts)))
+		}
+		// After the last packet, keep probing for the rest of the time
+		wait := interval
+		if i == maxPackets {
+			wait = maxDuration
+		}
+		if waitTCP(loopCtx, probe, checkTimeout, wait) {
+			logger.Debug("target up; not resending", zap.Int("sent", sent), zap.String("probe", probe))
+			if sent > 0 {
+				observeWakeDuration(t, sentAt)
+			}
+			return resultWoken, nil
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		return resultError, ctx.Err()
+	case sent == 0:
+		return failureResult(lastErr), lastErr
+	}
+	logger.Debug("target did not come up", zap.Int("sent", sent), zap.String("probe", probe))
+	return resultWakeTimeout, nil
+}
+
+// provisionDurations derives the default send_until_up max_duration from
+// the write timeout of the server the handler is in, so the loop doesn't
+// outlast the connection, and warns about waits set longer than it.
+func (w *WakeOnLAN) provisionDurations(writeTimeout time.Duration) {
+	w.untilUpMaxDuration = defaultUntilUpMaxDuration
+	if writeTimeout <= 0 {
+		return
+	}
+	limit := writeTimeout - writeTimeoutMargin
+	if limit <= 0 {
+		limit = writeTimeout / 2
+	}
+	if s := w.SendUntilUp; s != nil && s.MaxDuration == 0 && limit < w.untilUpMaxDuration {
+		w.untilUpMaxDuration = limit
+		w.logger.Debug("send_until_up max_duration derived from the server's write_timeout",
+			zap.Duration("max_duration", limit), zap.Duration("write_timeout", writeTimeout))
+	}
+
+	var longest time.Duration
+	switch {
+	case w.SendUntilUp != nil:
+		longest = w.untilUpMaxDuration
+		if w.SendUntilUp.MaxDuration > 0 {
+			longest = time.Duration(w.SendUntilUp.MaxDuration)
+		}
+	case len(w.Escalate) > 0:
+		for _, step := range w.Escalate {
+			longest += time.Duration(step.Wait)
+		}
+	case w.BroadcastFallback != nil:
+		longest = time.Duration(w.BroadcastFallback.fallbackAfter()+1) * w.BroadcastFallback.fallbackInterval()
+	default:
+		longest = time.Duration(w.Wait)
+	}
+	longest += time.Duration(w.InitialDelay)
+	if w.ResponseDelay != nil {
+		longest += w.ResponseDelay.maxDelay()
+	}
+	if longest > writeTimeout && !w.AfterResponse {
+		w.logger.Warn("waiting for targets can outlast the server's write_timeout, which cuts the response off",
+			zap.Duration("wait", longest), zap.Duration("write_timeout", writeTimeout))
+	}
+}
+
+// parseSendUntilUp parses the send_until_up subdirective.
+func parseSendUntilUp(d *caddyfile.Dispenser) (*SendUntilUp, error) {
+	s := new(SendUntilUp)
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "interval":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Interval = dur
+		case "max_packets":
+			n, err := parseIntArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.MaxPackets = n
+		case "max_duration":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.MaxDuration = dur
+		case "probe":
+			addr, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			s.Probe = addr
+		default:
+			return nil, d.Errf("unrecognized send_until_up subdirective '%s'", d.Val())
+		}
+	}
+	return s, nil
+}
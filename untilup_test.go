@@ -0,0 +1,230 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestSendUntilUpConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    SendUntilUp
+		wantErr bool
+	}{
+		{
+			name:  "full",
+			input: "send_until_up {\n\t\tinterval 2s\n\t\tmax_packets 5\n\t\tmax_duration 10s\n\t\tprobe 192.0.2.1:22\n\t}",
+			want: SendUntilUp{
+				Interval:    caddy.Duration(2 * time.Second),
+				MaxPackets:  5,
+				MaxDuration: caddy.Duration(10 * time.Second),
+				Probe:       "192.0.2.1:22",
+			},
+		},
+		{name: "check address", input: "check 192.0.2.1:22\n\tsend_until_up"},
+		{name: "without probe or check", input: "send_until_up", wantErr: true},
+		{name: "argument", input: "send_until_up 5 {\n\t\tprobe 192.0.2.1:22\n\t}", wantErr: true},
+		{name: "unknown subdirective", input: "send_until_up {\n\t\tprobe 192.0.2.1:22\n\t\tbackoff 2\n\t}", wantErr: true},
+		{name: "negative max_packets", input: "send_until_up {\n\t\tprobe 192.0.2.1:22\n\t\tmax_packets -1\n\t}", wantErr: true},
+		{name: "interval over max_duration", input: "send_until_up {\n\t\tprobe 192.0.2.1:22\n\t\tinterval 10s\n\t\tmax_duration 5s\n\t}", wantErr: true},
+		{name: "probe without port", input: "send_until_up {\n\t\tprobe 192.0.2.1\n\t}", wantErr: true},
+		{name: "with wait", input: "check 192.0.2.1:22\n\twait 5s\n\tsend_until_up", wantErr: true},
+		{name: "with escalate", input: "check 192.0.2.1:22\n\tescalate {\n\t\tunicast 5s\n\t}\n\tsend_until_up", wantErr: true},
+		{name: "with retry_probe", input: "retry_probe 192.0.2.1:22\n\tsend_until_up {\n\t\tprobe 192.0.2.1:22\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.SendUntilUp != tt.want {
+				t.Errorf("send_until_up = %+v, want %+v", *w.SendUntilUp, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvisionDurations(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxDuration  time.Duration
+		writeTimeout time.Duration
+		want         time.Duration
+	}{
+		{name: "no write timeout", want: defaultUntilUpMaxDuration},
+		{name: "long write timeout", writeTimeout: time.Minute, want: defaultUntilUpMaxDuration},
+		{name: "short write timeout", writeTimeout: 10 * time.Second, want: 9 * time.Second},
+		{name: "write timeout under the margin", writeTimeout: 800 * time.Millisecond, want: 400 * time.Millisecond},
+		{name: "explicit max_duration", maxDuration: 20 * time.Second, writeTimeout: 10 * time.Second, want: defaultUntilUpMaxDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &WakeOnLAN{SendUntilUp: &SendUntilUp{MaxDuration: caddy.Duration(tt.maxDuration)}, logger: zap.NewNop()}
+			w.provisionDurations(tt.writeTimeout)
+			if w.untilUpMaxDuration != tt.want {
+				t.Errorf("derived max_duration = %s, want %s", w.untilUpMaxDuration, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPSendUntilUp(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxPackets  int
+		maxDuration time.Duration
+		// packets after which the probe address comes up, 0 for never
+		upAfter     int
+		wantResult  wakeResult
+		wantPackets int
+	}{
+		{name: "up at once", maxPackets: 10, upAfter: 1, wantResult: resultWoken, wantPackets: 1},
+		{name: "up midway", maxPackets: 10, upAfter: 3, wantResult: resultWoken, wantPackets: 3},
+		{name: "packet cap", maxPackets: 3, maxDuration: 3500 * time.Millisecond, wantResult: resultWakeTimeout, wantPackets: 3},
+		// A packet a second, the loop ending while probing after the third
+		{name: "duration cap", maxPackets: 100, maxDuration: 2500 * time.Millisecond, wantResult: resultWakeTimeout, wantPackets: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			probePort := closedPort(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:  testMAC,
+				IP:   "127.0.0.1",
+				Port: host.port(),
+				SendUntilUp: &SendUntilUp{
+					Interval:    caddy.Duration(time.Second),
+					MaxPackets:  tt.maxPackets,
+					MaxDuration: caddy.Duration(tt.maxDuration),
+					Probe:       fmt.Sprintf("127.0.0.1:%d", probePort),
+				},
+				StatusHeader: "X-Wake-Result",
+			})
+
+			// Bring the probe address up as the packet arrives; the probe
+			// right after sending may miss it, the next one in the interval
+			// doesn't
+			packets := make(chan int, 64)
+			go func() {
+				n := 0
+				for range host.packets {
+					n++
+					if n == tt.upAfter {
+						l, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", probePort))
+						if err != nil {
+							t.Error(err)
+							continue
+						}
+						t.Cleanup(func() { l.Close() })
+					}
+					packets <- n
+				}
+			}()
+
+			rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !called {
+				t.Error("next handler not called")
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			// No packet follows once the loop has returned
+			time.Sleep(1200 * time.Millisecond)
+			var got int
+			for len(packets) > 0 {
+				got = <-packets
+			}
+			if got != tt.wantPackets {
+				t.Errorf("got %d packets, want %d", got, tt.wantPackets)
+			}
+		})
+	}
+}
+
+// serverContext returns a context the way the HTTP app provisions a
+// server's handlers, with the server in it.
+func serverContext(t *testing.T, srv *caddyhttp.Server) caddy.Context {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.WithValue(context.Background(), caddyhttp.ServerCtxKey, srv)})
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestProvisionWriteTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxDuration  time.Duration
+		writeTimeout time.Duration
+		inServer     bool
+		want         time.Duration
+	}{
+		{name: "outside a server", want: defaultUntilUpMaxDuration},
+		{name: "no write timeout", inServer: true, want: defaultUntilUpMaxDuration},
+		{name: "inherited", inServer: true, writeTimeout: 5 * time.Second, want: 4 * time.Second},
+		{name: "explicit max_duration", inServer: true, maxDuration: 20 * time.Second, writeTimeout: 5 * time.Second, want: defaultUntilUpMaxDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			t.Cleanup(cancel)
+			if tt.inServer {
+				ctx = serverContext(t, &caddyhttp.Server{WriteTimeout: caddy.Duration(tt.writeTimeout)})
+			}
+			w := provisionIn(t, ctx, &WakeOnLAN{
+				MAC:         testMAC,
+				IP:          "192.0.2.1",
+				SendUntilUp: &SendUntilUp{MaxDuration: caddy.Duration(tt.maxDuration), Probe: "192.0.2.1:22"},
+			})
+			if w.untilUpMaxDuration != tt.want {
+				t.Errorf("derived max_duration = %s, want %s", w.untilUpMaxDuration, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPWriteTimeout(t *testing.T) {
+	// Without max_duration, the loop ends a second before the server's
+	// write_timeout would cut the response off
+	host := newFakeHost(t)
+	ctx := serverContext(t, &caddyhttp.Server{WriteTimeout: caddy.Duration(2 * time.Second)})
+	w := provisionIn(t, ctx, &WakeOnLAN{
+		MAC:  testMAC,
+		IP:   "127.0.0.1",
+		Port: host.port(),
+		SendUntilUp: &SendUntilUp{
+			Interval: caddy.Duration(500 * time.Millisecond),
+			Probe:    fmt.Sprintf("127.0.0.1:%d", closedPort(t)),
+		},
+		StatusHeader: "X-Wake-Result",
+	})
+
+	start := time.Now()
+	rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.Header().Get("X-Wake-Result"), string(resultWakeTimeout)+"; target="+testMAC; got != want {
+		t.Errorf("result = %q, want %q", got, want)
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("loop ran %s, want about 1s", elapsed)
+	}
+	host.expect(t, 2)
+	host.expectNone(t)
+}
@@ -0,0 +1,100 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// defaultRetryDelay is how long wake_on_failure pauses after sending before
+// retrying, when it can't wait for a check address instead.
+const defaultRetryDelay = 5 * time.Second
+
+// defaultFailureStatus lists the handler error statuses that count as the
+// upstream being down: what reverse_proxy returns when it can't connect.
+var defaultFailureStatus = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// serveWakeOnFailure runs the next handler first and wakes the targets only
+// if it fails as if the upstream were down, then retries it.
+//
+// Only failures reported as handler errors are detected: reverse_proxy
+// returns one when dialing fails, before anything is written. A 502 the
+// upstream itself responds with has already been sent to the client and
+// can't be retried.
+func (w *WakeOnLAN) serveWakeOnFailure(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler, targets []Target, logger *zap.Logger) error {
+	retries := w.UpstreamRetries
+	if retries == 0 {
+		retries = 1
+	}
+	err := next.ServeHTTP(rw, r)
+	for attempt := 1; attempt <= retries && w.isUpstreamFailure(err); attempt++ {
+		logger.Debug("upstream failed; waking", zap.Int("attempt", attempt), zap.Error(err))
+		results, failure, wakeErr := w.wakeTargets(rw, r, targets, logger)
+		if w.failsRequest(wakeErr) {
+			return w.failWake(rw, r, failure, wakeErr)
+		}
+		if !allUp(results) {
+			// No check address told us the host is up; give it time to boot
+			delay := time.Duration(w.RetryDelay)
+			if delay == 0 {
+				delay = defaultRetryDelay
+			}
+			if err := sleepCtx(r.Context(), delay); err != nil {
+				return err
+			}
+		}
+		err = next.ServeHTTP(rw, r)
+	}
+	return err
+}
+
+// isUpstreamFailure reports whether err from the next handler carries one
+// of the failure statuses.
+func (w *WakeOnLAN) isUpstreamFailure(err error) bool {
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) {
+		return false
+	}
+	statuses := w.FailureStatus
+	if len(statuses) == 0 {
+		statuses = defaultFailureStatus
+	}
+	return slices.Contains(statuses, handlerErr.StatusCode)
+}
+
+// allUp reports whether every target was seen up by its check address.
+func allUp(results []wakeResult) bool {
+	for _, result := range results {
+		if result != resultWoken && result != resultAlreadyUp {
+			return false
+		}
+	}
+	return true
+}
+
+// validateWakeOnFailure checks the wake_on_failure settings.
+func (w *WakeOnLAN) validateWakeOnFailure() error {
+	if !w.WakeOnFailure {
+		return nil
+	}
+	if w.AfterResponse || w.FromBody {
+		return errors.New("wake_on_failure cannot be combined with after_response or from_body")
+	}
+	if w.UpstreamRetries < 0 {
+		return fmt.Errorf("invalid upstream_retries %d", w.UpstreamRetries)
+	}
+	if w.RetryDelay < 0 {
+		return fmt.Errorf("invalid retry_delay %s", time.Duration(w.RetryDelay))
+	}
+	for _, status := range w.FailureStatus {
+		if status < 400 || status > 599 {
+			return fmt.Errorf("invalid failure_status %d", status)
+		}
+	}
+	return nil
+}
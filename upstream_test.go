@@ -0,0 +1,117 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// failingNext is a next handler failing with its errors in turn, then
+// succeeding.
+type failingNext struct {
+	errs  []error
+	calls int
+}
+
+func (n *failingNext) ServeHTTP(rw http.ResponseWriter, _ *http.Request) error {
+	n.calls++
+	if n.calls <= len(n.errs) {
+		return n.errs[n.calls-1]
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func TestWakeOnFailureConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    WakeOnLAN
+		wantErr bool
+	}{
+		{
+			input: "wake_on_failure\n\tupstream_retries 3\n\tfailure_status 500 502\n\tretry_delay 2s",
+			want:  WakeOnLAN{WakeOnFailure: true, UpstreamRetries: 3, FailureStatus: []int{500, 502}, RetryDelay: caddy.Duration(2 * time.Second)},
+		},
+		{input: "wake_on_failure yes", wantErr: true},
+		{input: "wake_on_failure\n\tupstream_retries -1", wantErr: true},
+		{input: "wake_on_failure\n\tfailure_status", wantErr: true},
+		{input: "wake_on_failure\n\tfailure_status bad", wantErr: true},
+		{input: "wake_on_failure\n\tfailure_status 200", wantErr: true},
+		{input: "wake_on_failure\n\tretry_delay -1s", wantErr: true},
+		{input: "wake_on_failure\n\tafter_response", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if w.WakeOnFailure != tt.want.WakeOnFailure || w.UpstreamRetries != tt.want.UpstreamRetries ||
+				!slices.Equal(w.FailureStatus, tt.want.FailureStatus) || w.RetryDelay != tt.want.RetryDelay {
+				t.Errorf("parsed wake_on_failure %v, upstream_retries %d, failure_status %v, retry_delay %s",
+					w.WakeOnFailure, w.UpstreamRetries, w.FailureStatus, time.Duration(w.RetryDelay))
+			}
+		})
+	}
+}
+
+func TestServeHTTPWakeOnFailure(t *testing.T) {
+	badGateway := caddyhttp.Error(http.StatusBadGateway, errors.New("dial tcp: connection refused"))
+	tests := []struct {
+		name          string
+		retries       int
+		failureStatus []int
+		errs          []error
+		wantCalls     int
+		wantPackets   int
+		wantStatus    int
+	}{
+		{name: "upstream up", wantCalls: 1, wantStatus: http.StatusNoContent},
+		{name: "down then up", errs: []error{badGateway}, wantCalls: 2, wantPackets: 1, wantStatus: http.StatusNoContent},
+		{name: "still down", errs: []error{badGateway, badGateway}, wantCalls: 2, wantPackets: 1, wantStatus: http.StatusBadGateway},
+		{name: "up after retries", retries: 3, errs: []error{badGateway, badGateway}, wantCalls: 3, wantPackets: 2, wantStatus: http.StatusNoContent},
+		{name: "other status", errs: []error{caddyhttp.Error(http.StatusInternalServerError, errors.New("boom"))}, wantCalls: 1, wantStatus: http.StatusInternalServerError},
+		{name: "configured status", failureStatus: []int{http.StatusInternalServerError}, errs: []error{caddyhttp.Error(http.StatusInternalServerError, errors.New("boom"))}, wantCalls: 2, wantPackets: 1, wantStatus: http.StatusNoContent},
+		{name: "not a handler error", errs: []error{errors.New("boom")}, wantCalls: 1, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:             testMAC,
+				IP:              "127.0.0.1",
+				Port:            host.port(),
+				WakeOnFailure:   true,
+				UpstreamRetries: tt.retries,
+				FailureStatus:   tt.failureStatus,
+				RetryDelay:      caddy.Duration(10 * time.Millisecond),
+			})
+			r := newTestRequest("GET", "http://example.com/", nil)
+			next := &failingNext{errs: tt.errs}
+			rec := httptest.NewRecorder()
+			err := w.ServeHTTP(rec, r, next)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if next.calls != tt.wantCalls {
+				t.Errorf("next handler ran %d times, want %d", next.calls, tt.wantCalls)
+			}
+			if tt.wantPackets > 0 {
+				host.expect(t, tt.wantPackets)
+			}
+			host.expectNone(t)
+		})
+	}
+}
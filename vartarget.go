@@ -0,0 +1,59 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// varTarget builds the target given by the target_var request variable, a
+// string "<mac> [<ip-or-host> [<port>]]" like the handler's positional
+// target, checked like a from_body entry. ok is false when the variable is
+// unset or empty. An invalid value is a 400 and a MAC outside allow_oui a
+// 403, as the value is usually built from the request.
+func (w *WakeOnLAN) varTarget(r *http.Request) (t Target, ok bool, err error) {
+	if w.TargetVar == "" {
+		return Target{}, false, nil
+	}
+	v := caddyhttp.GetVar(r.Context(), w.TargetVar)
+	if v == nil {
+		return Target{}, false, nil
+	}
+	s, isString := v.(string)
+	if !isString {
+		return Target{}, false, fmt.Errorf("wake_on_lan: target_var %q holds a %T, not a string", w.TargetVar, v)
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Target{}, false, nil
+	}
+	if len(fields) > 3 {
+		return Target{}, false, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: target_var %q: want <mac> [<ip> [<port>]], got %q", w.TargetVar, s))
+	}
+	entry := bulkRequestTarget{MAC: fields[0]}
+	if len(fields) > 1 {
+		entry.IP = fields[1]
+	}
+	if len(fields) > 2 {
+		port, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return Target{}, false, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: target_var %q: invalid port %q", w.TargetVar, fields[2]))
+		}
+		entry.Port = port
+	}
+	t, err = w.bulkTarget(entry)
+	if err != nil {
+		if errors.Is(err, errOUINotAllowed) {
+			return Target{}, false, caddyhttp.Error(http.StatusForbidden, fmt.Errorf("wake_on_lan: %w", err))
+		}
+		if errors.Is(err, errMACIPMismatch) {
+			return Target{}, false, caddyhttp.Error(http.StatusConflict, fmt.Errorf("wake_on_lan: %w", err))
+		}
+		return Target{}, false, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("wake_on_lan: target_var %q: %w", w.TargetVar, err))
+	}
+	return t, true, nil
+}
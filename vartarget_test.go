@@ -0,0 +1,114 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestTargetVarConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "without targets", input: "wake_on_lan {\n\ttarget_var wol_target\n}", want: "wol_target"},
+		{name: "with a fallback target", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\ttarget_var wol_target\n}", want: "wol_target"},
+		{name: "missing name", input: "wake_on_lan {\n\ttarget_var\n}", wantErr: true},
+		{name: "two names", input: "wake_on_lan {\n\ttarget_var a b\n}", wantErr: true},
+		{name: "with from_body", input: "wake_on_lan {\n\ttarget_var wol_target\n\tfrom_body\n}", wantErr: true},
+		{name: "with from_query", input: "wake_on_lan {\n\ttarget_var wol_target\n\tfrom_query\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.TargetVar != tt.want {
+				t.Errorf("target_var = %q, want %q", w.TargetVar, tt.want)
+			}
+		})
+	}
+}
+
+// varSetter stands in for the route invoking the handler: it sets the
+// variable, or leaves it unset if value is nil, then calls the handler.
+type varSetter struct {
+	name  string
+	value any
+	next  caddyhttp.Handler
+}
+
+func (s varSetter) ServeHTTP(rw http.ResponseWriter, r *http.Request) error {
+	if s.value != nil {
+		caddyhttp.SetVar(r.Context(), s.name, s.value)
+	}
+	return s.next.ServeHTTP(rw, r)
+}
+
+func TestServeHTTPTargetVar(t *testing.T) {
+	const otherMAC = "00:11:22:aa:bb:cc"
+	tests := []struct {
+		name string
+		// configured target, if any
+		mac string
+		// variable value, with {port} replaced by the fake host's port
+		value      any
+		wantStatus int
+		wantMAC    string
+	}{
+		{name: "full", value: otherMAC + " 127.0.0.1 {port}", wantStatus: http.StatusNoContent, wantMAC: otherMAC},
+		{name: "over the configured target", mac: testMAC, value: otherMAC + " 127.0.0.1 {port}", wantStatus: http.StatusNoContent, wantMAC: otherMAC},
+		{name: "unset", mac: testMAC, wantStatus: http.StatusNoContent, wantMAC: testMAC},
+		{name: "empty", mac: testMAC, value: "  ", wantStatus: http.StatusNoContent, wantMAC: testMAC},
+		{name: "unset without targets", wantStatus: http.StatusInternalServerError},
+		{name: "not a string", value: 42, wantStatus: http.StatusInternalServerError},
+		{name: "too many fields", value: otherMAC + " 127.0.0.1 {port} extra", wantStatus: http.StatusBadRequest},
+		{name: "invalid port", value: otherMAC + " 127.0.0.1 nine", wantStatus: http.StatusBadRequest},
+		{name: "invalid MAC", value: "00:11:22:aa 127.0.0.1 {port}", wantStatus: http.StatusBadRequest},
+		{name: "MAC pattern", value: "00:11:22:aa:bb:** 127.0.0.1 {port}", wantStatus: http.StatusBadRequest},
+		{name: "oui refused", value: "aa:bb:cc:dd:ee:ff 127.0.0.1 {port}", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := &WakeOnLAN{TargetVar: "wol_target", AllowOUI: []string{"00:11:22"}}
+			if tt.mac != "" {
+				w.MAC, w.IP, w.Port = tt.mac, "127.0.0.1", host.port()
+			}
+			provisionTest(t, w)
+			value := tt.value
+			if s, ok := value.(string); ok {
+				value = strings.ReplaceAll(s, "{port}", strconv.Itoa(host.port()))
+			}
+
+			rec := httptest.NewRecorder()
+			next := new(nextHandler)
+			handler := varSetter{name: "wol_target", value: value, next: caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+				return w.ServeHTTP(rw, r, next)
+			})}
+			err := handler.ServeHTTP(rec, newTestRequest("GET", "http://example.com/", nil))
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if tt.wantMAC != "" {
+				want, _ := parseMAC(tt.wantMAC)
+				if got := net.HardwareAddr(host.expect(t, 1)[0][6:12]); !bytes.Equal(got, want) {
+					t.Errorf("woke %s, want %s", got, want)
+				}
+			}
+			host.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// What verify_mac_ip does with a MAC it can't check.
+const (
+	verifyAllow = "allow"
+	verifyDeny  = "deny"
+)
+
+// resultMACIPMismatch reports a request-supplied MAC refused by
+// verify_mac_ip.
+const resultMACIPMismatch wakeResult = "mac_ip_mismatch"
+
+// errMACIPMismatch refuses a request-supplied MAC that the neighbor table
+// doesn't pair with the request-supplied IP.
+var errMACIPMismatch = errors.New("MAC and IP not paired in the neighbor table")
+
+// VerifyMACIP cross-checks the MAC and IP of targets taken from requests
+// against the system's neighbor (ARP) table, so a caller can't pair an
+// arbitrary MAC with someone else's IP.
+type VerifyMACIP struct {
+	// What to do when the table has no entry for the IP, isn't readable,
+	// or the target has no IP literal: "allow" (the default) logs and
+	// sends anyway, "deny" refuses it like a mismatch.
+	OnUnknown string `json:"on_unknown,omitempty"`
+}
+
+// validate checks the on_unknown mode.
+func (v *VerifyMACIP) validate() error {
+	switch v.OnUnknown {
+	case "", verifyAllow, verifyDeny:
+		return nil
+	}
+	return fmt.Errorf("invalid verify_mac_ip mode %q (want allow or deny)", v.OnUnknown)
+}
+
+// verifyMACIP returns errMACIPMismatch unless the neighbor table holds hw
+// for ip. When the table can't tell, it allows or denies the pair as
+// configured.
+func (w *WakeOnLAN) verifyMACIP(hw net.HardwareAddr, ipOrHost string) error {
+	lookup := w.neighborLookup
+	if lookup == nil {
+		lookup = lookupNeighborMAC
+	}
+	ip := net.ParseIP(ipOrHost)
+	var err error
+	switch {
+	case ipOrHost == "":
+		err = errors.New("no IP given")
+	case ip == nil:
+		err = fmt.Errorf("%q is not an IP address", ipOrHost)
+	default:
+		var found net.HardwareAddr
+		if found, err = lookup(ip); err == nil {
+			if !bytes.Equal(found, hw) {
+				return fmt.Errorf("%w: %s is at %s, not %s", errMACIPMismatch, ip, found, hw)
+			}
+			return nil
+		}
+	}
+	if w.VerifyMACIP.OnUnknown == verifyDeny {
+		return fmt.Errorf("%w: can't verify %s: %v", errMACIPMismatch, hw, err)
+	}
+	w.logger.Info("can't verify MAC against the neighbor table; allowing it",
+		zap.String("mac", hw.String()), zap.String("ip", ipOrHost), zap.Error(err))
+	return nil
+}
@@ -0,0 +1,122 @@
+package caddy_wakeonlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestVerifyMACIPConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "from_query\n\tverify_mac_ip"},
+		{input: "from_query\n\tverify_mac_ip allow", want: verifyAllow},
+		{input: "from_body\n\tverify_mac_ip deny", want: verifyDeny},
+		{input: "target_var wol_target\n\tverify_mac_ip deny", want: verifyDeny},
+		{input: "from_query\n\tverify_mac_ip reject", wantErr: true},
+		{input: "from_query\n\tverify_mac_ip allow deny", wantErr: true},
+		{input: "verify_mac_ip", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			input := "wake_on_lan {\n\t" + tt.input + "\n}"
+			if !strings.Contains(tt.input, "\n") {
+				// Only for request targets; a configured one is refused
+				input = "wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}"
+			}
+			w, err := parseTest(input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.VerifyMACIP.OnUnknown != tt.want {
+				t.Errorf("on_unknown = %q, want %q", w.VerifyMACIP.OnUnknown, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPVerifyMACIP(t *testing.T) {
+	const otherMAC = "00:11:22:aa:bb:cc"
+	tests := []struct {
+		name      string
+		onUnknown string
+		// neighbor table entry for 127.0.0.1, "" for none
+		entry      string
+		ip         string
+		wantStatus int
+		wantLog    bool
+	}{
+		{name: "paired", entry: testMAC, ip: "127.0.0.1", wantStatus: http.StatusNoContent},
+		{name: "mismatch", entry: otherMAC, ip: "127.0.0.1", wantStatus: http.StatusConflict},
+		{name: "mismatch with allow", onUnknown: verifyAllow, entry: otherMAC, ip: "127.0.0.1", wantStatus: http.StatusConflict},
+		{name: "unknown allowed", ip: "127.0.0.1", wantStatus: http.StatusNoContent, wantLog: true},
+		{name: "unknown denied", onUnknown: verifyDeny, ip: "127.0.0.1", wantStatus: http.StatusConflict},
+		{name: "hostname allowed", entry: testMAC, ip: "localhost", wantStatus: http.StatusNoContent, wantLog: true},
+		{name: "hostname denied", onUnknown: verifyDeny, entry: testMAC, ip: "localhost", wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{FromQuery: &QueryParams{}, VerifyMACIP: &VerifyMACIP{OnUnknown: tt.onUnknown}})
+			neighbors := &fakeNeighbors{table: make(map[string]net.HardwareAddr)}
+			neighbors.set("127.0.0.1", tt.entry)
+			w.neighborLookup = neighbors.lookup
+			logs := observeLogs(w)
+
+			r := newTestRequest("GET", "http://example.com/wake?mac="+testMAC+"&ip="+tt.ip+"&port="+strconv.Itoa(host.port()), nil)
+			rec, _, err := serveTest(w, r)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if tt.wantStatus == http.StatusNoContent {
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+			if got := logs.FilterMessage("can't verify MAC against the neighbor table; allowing it").Len() > 0; got != tt.wantLog {
+				t.Errorf("logged allowing an unverified MAC: %v, want %v", got, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestServeHTTPVerifyMACIPBulk(t *testing.T) {
+	// A mismatched entry is refused on its own; the others are still sent
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{FromBody: true, VerifyMACIP: &VerifyMACIP{}})
+	neighbors := &fakeNeighbors{table: make(map[string]net.HardwareAddr)}
+	neighbors.set("127.0.0.1", testMAC)
+	w.neighborLookup = neighbors.lookup
+
+	var entries []string
+	for _, mac := range []string{testMAC, "00:11:22:aa:bb:cc"} {
+		entries = append(entries, fmt.Sprintf(`{"mac":%q,"ip":"127.0.0.1","port":%d}`, mac, host.port()))
+	}
+	r := newTestRequest("POST", "http://example.com/", strings.NewReader("["+strings.Join(entries, ",")+"]"))
+	r.Header.Set("Content-Type", "application/json")
+	rec, _, err := serveTest(w, r)
+	if got := statusOf(rec, err); got != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want %d (%v)", got, http.StatusMultiStatus, err)
+	}
+	var results []bulkResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	want := []string{string(resultSent), string(resultMACIPMismatch)}
+	for i, res := range results {
+		if i >= len(want) || res.Result != want[i] {
+			t.Errorf("entry %d: result %q, want %q", i, res.Result, want[i])
+		}
+	}
+	host.expect(t, 1)
+	host.expectNone(t)
+}
@@ -0,0 +1,41 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+)
+
+// errVRFUnsupported is returned for vrf outside Linux.
+var errVRFUnsupported = errors.New("vrf is only supported on Linux")
+
+// validateVRF checks that the VRF device exists and that nothing sends
+// around it.
+func (w *WakeOnLAN) validateVRF() error {
+	if w.VRF == "" {
+		return nil
+	}
+	if !vrfSupported {
+		return errVRFUnsupported
+	}
+	if _, err := net.InterfaceByName(w.VRF); err != nil {
+		return fmt.Errorf("invalid vrf: no device named %q", w.VRF)
+	}
+	switch {
+	case w.relayed() || w.SourcePortRange != "" || w.BroadcastSource != "":
+		return errors.New("vrf cannot be combined with relay, source_port_range or broadcast_source")
+	case slices.Contains(w.Transports, transportRawEthernet):
+		return errors.New("vrf cannot be combined with the raw_ethernet transport")
+	}
+	return nil
+}
+
+// inVRF returns t bound to the VRF device, unless it has an interface of
+// its own, which then decides where its packets go.
+func inVRF(t Target, vrf string) Target {
+	if t.Interface == "" {
+		t.Interface = vrf
+	}
+	return t
+}
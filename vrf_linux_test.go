@@ -0,0 +1,51 @@
+//go:build linux
+
+package caddy_wakeonlan
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPVRF(t *testing.T) {
+	// The host is at a loopback address, which only a socket bound to the
+	// loopback device reaches: a packet arriving through another device
+	// would mean the bind wasn't made. Any device stands in for a VRF.
+	lo, other := loopbackAndOther(t)
+	tests := []struct {
+		name     string
+		vrf      string
+		iface    string
+		wantSent bool
+	}{
+		{name: "loopback", vrf: lo, wantSent: true},
+		{name: "another device", vrf: other},
+		{name: "target interface over the vrf", vrf: other, iface: lo, wantSent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				Targets:      []Target{{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Interface: tt.iface}},
+				VRF:          tt.vrf,
+				StatusHeader: "X-Wake-Result",
+			})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := rec.Header().Values("X-Wake-Result")
+			if tt.wantSent {
+				if !slices.Contains(got, string(resultSent)+"; target=nas") {
+					if len(got) > 0 && strings.HasPrefix(got[0], string(resultSendFailed)) {
+						t.Skipf("can't bind sockets to a device here: %v", got)
+					}
+					t.Errorf("results %v, want nas sent", got)
+				}
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVRFConfig(t *testing.T) {
+	lo, _ := loopbackAndOther(t)
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "device", input: "vrf " + lo},
+		{name: "missing name", input: "vrf", wantErr: true},
+		{name: "two names", input: "vrf " + lo + " mgmt", wantErr: true},
+		{name: "unknown device", input: "vrf nosuchvrf0", wantErr: true},
+		{name: "with relay", input: "vrf " + lo + "\n\trelay 192.0.2.10:9", wantErr: true},
+		{name: "with source_port_range", input: "vrf " + lo + "\n\tsource_port_range 40000-40010", wantErr: true},
+		{name: "with raw_ethernet", input: "vrf " + lo + "\n\ttransport raw_ethernet\n\traw_interface " + lo, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if !vrfSupported && w != nil && w.VRF != "" {
+				if !errors.Is(err, errVRFUnsupported) {
+					t.Errorf("error = %v, want %v", err, errVRFUnsupported)
+				}
+				return
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.VRF != lo {
+				t.Errorf("vrf = %q, want %q", w.VRF, lo)
+			}
+		})
+	}
+}
+
+func TestInVRF(t *testing.T) {
+	tests := []struct {
+		name  string
+		iface string
+		want  string
+	}{
+		{name: "without an interface", want: "vrf-mgmt"},
+		{name: "with its own interface", iface: "eth1", want: "eth1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inVRF(Target{MAC: testMAC, Interface: tt.iface}, "vrf-mgmt"); got.Interface != tt.want {
+				t.Errorf("interface = %q, want %q", got.Interface, tt.want)
+			}
+		})
+	}
+}
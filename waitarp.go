@@ -0,0 +1,211 @@
+package caddy_wakeonlan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// arpNudgePort is the discard port the datagrams prompting the system to
+// re-resolve a target's MAC are sent to.
+const arpNudgePort = 9
+
+// arpRecheckInterval is how soon the neighbor table is read again after a
+// nudge when checking whether a target is already up.
+const arpRecheckInterval = 100 * time.Millisecond
+
+// errNeighborUnsupported is returned where the neighbor table can't be
+// read for its entries' state.
+var errNeighborUnsupported = errors.New("neighbor table state not supported on this platform")
+
+// neighborEntry is the neighbor table's view of one IP.
+type neighborEntry struct {
+	ip net.IP
+	hw net.HardwareAddr
+	// Whether the MAC answered recently: a REACHABLE entry, or a complete
+	// one where the table doesn't tell how recent it is.
+	reachable bool
+	// When the MAC last confirmed it answers, where the table tells; zero
+	// elsewhere.
+	confirmed time.Time
+}
+
+// arpDirective returns the name of the ARP confirmation configured, for
+// messages.
+func (w *WakeOnLAN) arpDirective() string {
+	if w.ConfirmARPLearned {
+		return "confirm_arp_learned"
+	}
+	return "wait_arp"
+}
+
+// waitsARP reports whether targets without a check address are confirmed
+// through the neighbor table, with wait_arp or confirm_arp_learned.
+func (w *WakeOnLAN) waitsARP() bool {
+	return w.WaitARP || w.ConfirmARPLearned
+}
+
+// validateWaitARP checks wait_arp or confirm_arp_learned and the settings
+// they depend on.
+func (w *WakeOnLAN) validateWaitARP() error {
+	if !w.waitsARP() {
+		return nil
+	}
+	name := w.arpDirective()
+	switch {
+	case w.WaitARP && w.ConfirmARPLearned:
+		return errors.New("wait_arp and confirm_arp_learned cannot be combined; confirm_arp_learned already waits for the neighbor table")
+	// backoff_response probes on each request instead of waiting
+	case w.Wait <= 0 && w.BackoffResponse == nil:
+		return fmt.Errorf("%s requires wait", name)
+	case len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil || w.WaitingPage != nil:
+		return fmt.Errorf("%s cannot be combined with escalate, send_until_up, broadcast_fallback or waiting_page", name)
+	}
+	for _, t := range w.allTargets() {
+		if t.Check == "" && w.Check == "" && t.IP == "" {
+			return fmt.Errorf("target %s: %s requires an IP on targets without a check address", t.label(), name)
+		}
+	}
+	return nil
+}
+
+// provisionWaitARP falls back to not confirming targets at all, as if they
+// had no check address, where the neighbor table can't be read.
+func (w *WakeOnLAN) provisionWaitARP() {
+	if !w.waitsARP() || w.neighborState != nil {
+		return
+	}
+	if err := neighborTableAvailable(); err != nil {
+		w.logger.Warn(w.arpDirective()+": neighbor table not available; targets without a check address are only sent to",
+			zap.Error(err))
+		return
+	}
+	w.neighborState = lookupNeighborEntry
+}
+
+// confirmsByARP reports whether t's presence is confirmed through the
+// neighbor table: with wait_arp or confirm_arp_learned, for targets
+// without a check address, where the table is available.
+func (w *WakeOnLAN) confirmsByARP(t Target) bool {
+	return w.waitsARP() && w.neighborState != nil && t.Check == ""
+}
+
+// arpPresent reports whether the neighbor table shows t's IP answering
+// from t's MAC, or from any MAC when t's isn't fixed.
+func (w *WakeOnLAN) arpPresent(ctx context.Context, t Target) bool {
+	_, ok := w.arpEntry(ctx, t)
+	return ok
+}
+
+// arpEntry returns the neighbor table's entry for t's IP if it is
+// reachable, from t's MAC when that is fixed. A datagram to the discard
+// port first prompts the system to resolve or re-verify the entry, since a
+// stale one outlives the host going to sleep.
+func (w *WakeOnLAN) arpEntry(ctx context.Context, t Target) (neighborEntry, bool) {
+	opts := w.sendOptions()
+	addr, err := resolveUDPAddr(ctx, t.IP, arpNudgePort, opts.ResolveRetries, opts.ResolveBackoff, opts.Prefer)
+	if err != nil {
+		return neighborEntry{}, false
+	}
+	nudgeNeighbor(addr)
+	e, err := w.neighborState(addr.IP)
+	if err != nil || !e.reachable {
+		return neighborEntry{}, false
+	}
+	if hw, err := t.hardwareAddr(); err == nil && !isMACPattern(t.MAC) && !bytes.Equal(hw, e.hw) {
+		return neighborEntry{}, false
+	}
+	return e, true
+}
+
+// probeARP checks whether t is already up for up to timeout, giving the
+// system a moment to hear the reply to its ARP request.
+func (w *WakeOnLAN) probeARP(ctx context.Context, t Target, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		if w.arpPresent(ctx, t) {
+			return true
+		}
+		if sleepCtx(ctx, arpRecheckInterval) != nil {
+			return false
+		}
+	}
+}
+
+// waitARP polls the neighbor table until t is present or ctx is done.
+func (w *WakeOnLAN) waitARP(ctx context.Context, t Target) bool {
+	for {
+		if w.arpPresent(ctx, t) {
+			return true
+		}
+		if sleepCtx(ctx, waitPollInterval) != nil {
+			return false
+		}
+	}
+}
+
+// waitARPLearned polls the neighbor table until it shows t's entry
+// (re)learned since the wait started, right after the send, or ctx is
+// done. An entry still reachable from before the wake doesn't count: the
+// entry is learned once it confirms its MAC after the start, where the
+// table tells when that was, and elsewhere once it turns reachable after
+// a poll found it missing, stale or from another MAC.
+func (w *WakeOnLAN) waitARPLearned(ctx context.Context, t Target) bool {
+	since := time.Now()
+	var sawDown bool
+	for {
+		e, ok := w.arpEntry(ctx, t)
+		switch {
+		case !ok:
+			sawDown = true
+		case !e.confirmed.IsZero():
+			if !e.confirmed.Before(since) {
+				return true
+			}
+		case sawDown:
+			return true
+		}
+		if sleepCtx(ctx, waitPollInterval) != nil {
+			return false
+		}
+	}
+}
+
+// nudgeNeighbor sends an empty datagram to addr, making the system resolve
+// its MAC if the entry is missing, or re-verify it if stale. Replies and
+// errors don't matter: only the neighbor table is read afterwards.
+func nudgeNeighbor(addr *net.UDPAddr) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = conn.Write(nil)
+}
+
+// bestNeighbor returns the entry of entries for ip, preferring a reachable
+// one when the IP is known on several interfaces.
+func bestNeighbor(entries []neighborEntry, ip net.IP) (neighborEntry, error) {
+	var found *neighborEntry
+	for i, e := range entries {
+		if !e.ip.Equal(ip) || len(e.hw) == 0 || isZeroMAC(e.hw) {
+			continue
+		}
+		if e.reachable {
+			return e, nil
+		}
+		if found == nil {
+			found = &entries[i]
+		}
+	}
+	if found == nil {
+		return neighborEntry{}, fmt.Errorf("no neighbor entry for %s", ip)
+	}
+	return *found, nil
+}
@@ -0,0 +1,97 @@
+//go:build linux
+
+package caddy_wakeonlan
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// neighborTableAvailable reports whether the neighbor table can be read,
+// over netlink or from /proc/net/arp.
+func neighborTableAvailable() error {
+	if _, err := netlinkNeighbors(); err == nil {
+		return nil
+	}
+	_, err := os.ReadFile(arpTablePath)
+	return err
+}
+
+// userHZ is the unit of the ages the kernel reports neighbor entries with,
+// in clock ticks per second: 100 on every architecture Go runs Linux on.
+const userHZ = 100
+
+// lookupNeighborEntry returns the neighbor table's entry for ip, read over
+// netlink, which tells REACHABLE entries apart from stale ones. Where
+// netlink can't be used, /proc/net/arp is read instead, and any complete
+// entry counts as reachable.
+func lookupNeighborEntry(ip net.IP) (neighborEntry, error) {
+	entries, err := netlinkNeighbors()
+	if err != nil {
+		hw, err := lookupNeighborMAC(ip)
+		if err != nil {
+			return neighborEntry{}, err
+		}
+		return neighborEntry{ip: ip, hw: hw, reachable: true}, nil
+	}
+	return bestNeighbor(entries, ip)
+}
+
+// netlinkNeighbors dumps the neighbor table with RTM_GETNEIGH.
+func netlinkNeighbors() ([]neighborEntry, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+	var entries []neighborEntry
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		if e, ok := parseNeighborMessage(m.Data); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// parseNeighborMessage decodes the body of an RTM_NEWNEIGH message: a
+// struct ndmsg, whose state is at offset 8, followed by attributes. The
+// cache info attribute starts with how long ago the entry was last
+// confirmed.
+func parseNeighborMessage(data []byte) (neighborEntry, bool) {
+	now := time.Now()
+	state := binary.NativeEndian.Uint16(data[8:10])
+	e := neighborEntry{reachable: state&unix.NUD_REACHABLE != 0}
+	attrs := data[unix.SizeofNdMsg:]
+	for len(attrs) >= unix.SizeofRtAttr {
+		n := int(binary.NativeEndian.Uint16(attrs[0:2]))
+		if n < unix.SizeofRtAttr || n > len(attrs) {
+			break
+		}
+		value := attrs[unix.SizeofRtAttr:n]
+		switch binary.NativeEndian.Uint16(attrs[2:4]) {
+		case unix.NDA_DST:
+			e.ip = net.IP(slices.Clone(value))
+		case unix.NDA_LLADDR:
+			e.hw = net.HardwareAddr(slices.Clone(value))
+		case unix.NDA_CACHEINFO:
+			if len(value) >= 4 {
+				age := time.Duration(binary.NativeEndian.Uint32(value[0:4])) * time.Second / userHZ
+				e.confirmed = now.Add(-age)
+			}
+		}
+		attrs = attrs[min((n+unix.NLA_ALIGNTO-1)&^(unix.NLA_ALIGNTO-1), len(attrs)):]
+	}
+	return e, e.ip != nil
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package caddy_wakeonlan
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// neighborMessage builds the body of an RTM_NEWNEIGH message with state
+// and the given attributes, each padded to the netlink alignment.
+func neighborMessage(state uint16, attrs map[uint16][]byte) []byte {
+	data := make([]byte, unix.SizeofNdMsg)
+	binary.NativeEndian.PutUint16(data[8:10], state)
+	for _, typ := range []uint16{unix.NDA_DST, unix.NDA_LLADDR, unix.NDA_CACHEINFO} {
+		value, ok := attrs[typ]
+		if !ok {
+			continue
+		}
+		attr := make([]byte, unix.SizeofRtAttr, unix.SizeofRtAttr+len(value)+unix.NLA_ALIGNTO)
+		binary.NativeEndian.PutUint16(attr[0:2], uint16(unix.SizeofRtAttr+len(value)))
+		binary.NativeEndian.PutUint16(attr[2:4], typ)
+		attr = append(attr, value...)
+		for len(attr)%unix.NLA_ALIGNTO != 0 {
+			attr = append(attr, 0)
+		}
+		data = append(data, attr...)
+	}
+	return data
+}
+
+func TestParseNeighborMessage(t *testing.T) {
+	hw, _ := net.ParseMAC(testMAC)
+	ip := net.IPv4(192, 0, 2, 10).To4()
+	cacheInfo := make([]byte, 16)
+	// Confirmed 3 seconds ago, in clock ticks
+	binary.NativeEndian.PutUint32(cacheInfo[0:4], 3*userHZ)
+	tests := []struct {
+		name          string
+		data          []byte
+		wantOK        bool
+		wantReachable bool
+		wantHW        net.HardwareAddr
+		wantAge       time.Duration
+	}{
+		{
+			name:          "reachable",
+			data:          neighborMessage(unix.NUD_REACHABLE, map[uint16][]byte{unix.NDA_DST: ip, unix.NDA_LLADDR: hw, unix.NDA_CACHEINFO: cacheInfo}),
+			wantOK:        true,
+			wantReachable: true,
+			wantHW:        hw,
+			wantAge:       3 * time.Second,
+		},
+		{
+			name:   "stale",
+			data:   neighborMessage(unix.NUD_STALE, map[uint16][]byte{unix.NDA_DST: ip, unix.NDA_LLADDR: hw}),
+			wantOK: true,
+			wantHW: hw,
+		},
+		{name: "incomplete", data: neighborMessage(unix.NUD_INCOMPLETE, map[uint16][]byte{unix.NDA_DST: ip}), wantOK: true},
+		{name: "without an IP", data: neighborMessage(unix.NUD_REACHABLE, map[uint16][]byte{unix.NDA_LLADDR: hw})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, ok := parseNeighborMessage(tt.data)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !e.ip.Equal(ip) || e.reachable != tt.wantReachable || e.hw.String() != tt.wantHW.String() {
+				t.Errorf("entry %+v, want %s at %s, reachable %v", e, tt.wantHW, ip, tt.wantReachable)
+			}
+			if tt.wantAge == 0 {
+				if !e.confirmed.IsZero() {
+					t.Errorf("confirmed %s, want unknown", e.confirmed)
+				}
+				return
+			}
+			if age := time.Since(e.confirmed); age < tt.wantAge || age > tt.wantAge+time.Second {
+				t.Errorf("confirmed %s ago, want %s", age, tt.wantAge)
+			}
+		})
+	}
+}
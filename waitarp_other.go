@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package caddy_wakeonlan
+
+import "net"
+
+// neighborTableAvailable reports that the neighbor table's state can't be
+// read here.
+func neighborTableAvailable() error {
+	return errNeighborUnsupported
+}
+
+// lookupNeighborEntry is not implemented on this platform.
+func lookupNeighborEntry(ip net.IP) (neighborEntry, error) {
+	return neighborEntry{}, errNeighborUnsupported
+}
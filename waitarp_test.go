@@ -0,0 +1,234 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestWaitARPConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "with wait", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\twait 30s\n\twait_arp\n}"},
+		{name: "with check", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tcheck 192.0.2.1:22\n\twait 30s\n\twait_arp\n}"},
+		{name: "argument", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\twait 30s\n\twait_arp yes\n}", wantErr: true},
+		{name: "without wait", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\twait_arp\n}", wantErr: true},
+		{name: "with send_until_up", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tcheck 192.0.2.1:22\n\twait 30s\n\tsend_until_up\n\twait_arp\n}", wantErr: true},
+		{name: "target without an IP", input: "wake_on_lan {\n\tbroadcast 192.0.2.255\n\ttarget " + testMAC + "\n\twait 30s\n\twait_arp\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.WaitARP {
+				t.Error("wait_arp not set")
+			}
+		})
+	}
+}
+
+func TestBestNeighbor(t *testing.T) {
+	mac := func(s string) net.HardwareAddr {
+		hw, _ := net.ParseMAC(s)
+		return hw
+	}
+	ip := net.IPv4(192, 0, 2, 10)
+	other := net.IPv4(192, 0, 2, 11)
+	tests := []struct {
+		name    string
+		entries []neighborEntry
+		want    net.HardwareAddr
+		wantErr bool
+	}{
+		{name: "only", entries: []neighborEntry{{ip: ip, hw: mac(testMAC)}}, want: mac(testMAC)},
+		{
+			name:    "reachable preferred",
+			entries: []neighborEntry{{ip: ip, hw: mac("00:11:22:aa:bb:cc")}, {ip: ip, hw: mac(testMAC), reachable: true}},
+			want:    mac(testMAC),
+		},
+		{name: "first when none reachable", entries: []neighborEntry{{ip: ip, hw: mac(testMAC)}, {ip: ip, hw: mac("00:11:22:aa:bb:cc")}}, want: mac(testMAC)},
+		{name: "other IP", entries: []neighborEntry{{ip: other, hw: mac(testMAC), reachable: true}}, wantErr: true},
+		{name: "incomplete", entries: []neighborEntry{{ip: ip, reachable: true}}, wantErr: true},
+		{name: "zero MAC", entries: []neighborEntry{{ip: ip, hw: make(net.HardwareAddr, 6), reachable: true}}, wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bestNeighbor(tt.entries, ip)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got.hw.String() != tt.want.String() {
+				t.Errorf("entry MAC %s, want %s", got.hw, tt.want)
+			}
+		})
+	}
+}
+
+// fakeNeighborState is a neighbor table holding one entry, which turns
+// reachable once up is due.
+type fakeNeighborState struct {
+	mu    sync.Mutex
+	entry neighborEntry
+	up    time.Time
+}
+
+func (n *fakeNeighborState) lookup(ip net.IP) (neighborEntry, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.entry.ip.Equal(ip) {
+		return neighborEntry{}, fmt.Errorf("no neighbor entry for %s", ip)
+	}
+	e := n.entry
+	e.reachable = !n.up.IsZero() && !time.Now().Before(n.up)
+	return e, nil
+}
+
+func TestServeHTTPWaitARP(t *testing.T) {
+	const otherMAC = "00:11:22:aa:bb:cc"
+	tests := []struct {
+		name string
+		// MAC of the table's entry for the target's IP, and when it turns
+		// reachable, negative for never
+		mac        string
+		upAfter    time.Duration
+		wantResult wakeResult
+		wantSent   bool
+	}{
+		{name: "already up", mac: testMAC, wantResult: resultAlreadyUp},
+		{name: "up after the send", mac: testMAC, upAfter: 700 * time.Millisecond, wantResult: resultWoken, wantSent: true},
+		{name: "never up", mac: testMAC, upAfter: -1, wantResult: resultWakeTimeout, wantSent: true},
+		{name: "another MAC", mac: otherMAC, wantResult: resultWakeTimeout, wantSent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			hw, _ := net.ParseMAC(tt.mac)
+			state := &fakeNeighborState{entry: neighborEntry{ip: net.IPv4(127, 0, 0, 1), hw: hw}}
+			if tt.upAfter >= 0 {
+				state.up = time.Now().Add(tt.upAfter)
+			}
+			w := &WakeOnLAN{
+				MAC:          testMAC,
+				IP:           "127.0.0.1",
+				Port:         host.port(),
+				Wait:         caddy.Duration(1500 * time.Millisecond),
+				CheckTimeout: caddy.Duration(200 * time.Millisecond),
+				WaitARP:      true,
+				StatusHeader: "X-Wake-Result",
+			}
+			w.neighborState = state.lookup
+			provisionTest(t, w)
+
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			if tt.wantSent {
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+		})
+	}
+}
+
+func TestConfirmARPLearnedConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "with wait", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\twait 30s\n\tconfirm_arp_learned\n}"},
+		{name: "with group", input: "wake_on_lan {\n\twait 30s\n\tconfirm_arp_learned\n\tgroup lab\n\ttarget " + testMAC + " 192.0.2.1\n}"},
+		{name: "argument", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\twait 30s\n\tconfirm_arp_learned yes\n}", wantErr: true},
+		{name: "without wait", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\tconfirm_arp_learned\n}", wantErr: true},
+		{name: "with wait_arp", input: "wake_on_lan " + testMAC + " 192.0.2.1 {\n\twait 30s\n\twait_arp\n\tconfirm_arp_learned\n}", wantErr: true},
+		{name: "target without an IP", input: "wake_on_lan {\n\tbroadcast 192.0.2.255\n\ttarget " + testMAC + "\n\twait 30s\n\tconfirm_arp_learned\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest(tt.input)
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.ConfirmARPLearned {
+				t.Error("confirm_arp_learned not set")
+			}
+		})
+	}
+}
+
+func TestWaitARPLearned(t *testing.T) {
+	hw, _ := net.ParseMAC(testMAC)
+	const learnAfter = 300 * time.Millisecond
+	tests := []struct {
+		name string
+		// entry returns the table's entry at now, the wait having started
+		// at start
+		entry func(start, now time.Time) neighborEntry
+		want  bool
+	}{
+		{
+			name:  "reachable throughout",
+			entry: func(start, now time.Time) neighborEntry { return neighborEntry{reachable: true} },
+		},
+		{
+			name: "reachable after missing",
+			entry: func(start, now time.Time) neighborEntry {
+				return neighborEntry{reachable: now.Sub(start) >= learnAfter}
+			},
+			want: true,
+		},
+		{
+			name: "confirmed before the wait",
+			entry: func(start, now time.Time) neighborEntry {
+				return neighborEntry{reachable: true, confirmed: start.Add(-time.Second)}
+			},
+		},
+		{
+			name: "confirmed during the wait",
+			entry: func(start, now time.Time) neighborEntry {
+				if now.Sub(start) < learnAfter {
+					return neighborEntry{reachable: true, confirmed: start.Add(-time.Second)}
+				}
+				return neighborEntry{reachable: true, confirmed: now}
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Wait: caddy.Duration(time.Second), ConfirmARPLearned: true})
+			start := time.Now()
+			w.neighborState = func(ip net.IP) (neighborEntry, error) {
+				e := tt.entry(start, time.Now())
+				e.ip, e.hw = ip, hw
+				return e, nil
+			}
+			ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+			defer cancel()
+			if got := w.waitARPLearned(ctx, w.targets()[0]); got != tt.want {
+				t.Errorf("waitARPLearned = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package caddy_wakeonlan
+
+import "net"
+
+// neighborTableAvailable reports whether the neighbor table can be read
+// with GetIpNetTable2.
+func neighborTableAvailable() error {
+	_, err := windowsNeighbors()
+	return err
+}
+
+// lookupNeighborEntry returns the neighbor table's entry for ip.
+func lookupNeighborEntry(ip net.IP) (neighborEntry, error) {
+	entries, err := windowsNeighbors()
+	if err != nil {
+		return neighborEntry{}, err
+	}
+	return bestNeighbor(entries, ip)
+}
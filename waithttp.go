@@ -0,0 +1,334 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultWaitHTTPTimeout bounds a single readiness request.
+const defaultWaitHTTPTimeout = 2 * time.Second
+
+// maxWaitHTTPBody is the most of a readiness response's body inspected.
+const maxWaitHTTPBody = 1 << 20
+
+// WaitHTTP polls an HTTP readiness endpoint, for services that accept
+// connections well before they can serve: a target counts as up only once
+// a GET of URL matches every expectation.
+type WaitHTTP struct {
+	// URL to GET, with the placeholders {wake.target} and {wake.ip} for
+	// the target woken, and Caddy's global ones such as {env.*}.
+	URL string `json:"url"`
+	// Request headers, with the same placeholders, e.g. an Authorization
+	// header taking its token from {env.READY_TOKEN}.
+	Header http.Header `json:"header,omitempty"`
+	// Status codes that count as ready. Default: any 2xx.
+	ExpectStatus []int `json:"expect_status,omitempty"`
+	// Status codes that count as up straight away, without the body
+	// expectations, e.g. 401 from an endpoint that is up but protected.
+	UpStatus []int `json:"up_status,omitempty"`
+	// Status codes that keep the wait going whatever else is expected,
+	// e.g. 503 from an app still starting.
+	RetryStatus []int `json:"retry_status,omitempty"`
+	// Text the body must contain.
+	ExpectBodyContains string `json:"expect_body_contains,omitempty"`
+	// Regular expression the body must match.
+	ExpectBodyRegex string `json:"expect_body_regex,omitempty"`
+	// Values the JSON body must hold, by dot-separated path (array
+	// elements by index), e.g. {"status.ready": true}.
+	ExpectJSON map[string]any `json:"expect_json,omitempty"`
+	// Timeout for a single request. Default: 2s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	bodyRegex *regexp.Regexp
+}
+
+// waitHTTPPlaceholder matches a placeholder in the readiness URL.
+var waitHTTPPlaceholder = regexp.MustCompile(`\{[^{}\s]+\}`)
+
+// validateWaitHTTP checks wait_http and the settings it depends on.
+func (w *WakeOnLAN) validateWaitHTTP() error {
+	h := w.WaitHTTP
+	if h == nil {
+		return nil
+	}
+	// Placeholders, such as {wake.ip} in the host, only have values once a
+	// target is woken, so stand-ins are parsed in their place.
+	u, err := url.Parse(waitHTTPPlaceholder.ReplaceAllString(h.URL, "placeholder"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("wait_http url %q must be an absolute http or https URL", h.URL)
+	}
+	for _, list := range []struct {
+		name  string
+		codes []int
+	}{{"expect_status", h.ExpectStatus}, {"up_status", h.UpStatus}, {"retry_status", h.RetryStatus}} {
+		for _, code := range list.codes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid wait_http %s %d", list.name, code)
+			}
+		}
+	}
+	for _, code := range h.UpStatus {
+		if slices.Contains(h.RetryStatus, code) {
+			return fmt.Errorf("wait_http status %d is in both up_status and retry_status", code)
+		}
+	}
+	if _, err := regexp.Compile(h.ExpectBodyRegex); err != nil {
+		return fmt.Errorf("invalid wait_http expect_body_regex: %w", err)
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("invalid wait_http timeout %s", time.Duration(h.Timeout))
+	}
+	switch {
+	// backoff_response probes on each request instead of waiting
+	case w.Wait <= 0 && w.BackoffResponse == nil:
+		return errors.New("wait_http requires wait")
+	case len(w.Escalate) > 0 || w.SendUntilUp != nil || w.BroadcastFallback != nil || w.WaitingPage != nil:
+		return errors.New("wait_http cannot be combined with escalate, send_until_up, broadcast_fallback or waiting_page")
+	}
+	return nil
+}
+
+// provisionWaitHTTP compiles the body expression.
+func (w *WakeOnLAN) provisionWaitHTTP() error {
+	if w.WaitHTTP == nil || w.WaitHTTP.ExpectBodyRegex == "" {
+		return nil
+	}
+	re, err := regexp.Compile(w.WaitHTTP.ExpectBodyRegex)
+	if err != nil {
+		return fmt.Errorf("wake_on_lan: wait_http expect_body_regex: %w", err)
+	}
+	w.WaitHTTP.bodyRegex = re
+	return nil
+}
+
+// ready reports whether one GET of the readiness URL for t matches every
+// expectation.
+func (h *WaitHTTP) ready(ctx context.Context, t Target) bool {
+	timeout := time.Duration(h.Timeout)
+	if timeout == 0 {
+		timeout = defaultWaitHTTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	repl := caddy.NewReplacer()
+	repl.Set("wake.target", t.label())
+	repl.Set("wake.ip", t.IP)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, repl.ReplaceKnown(h.URL, ""), nil)
+	if err != nil {
+		return false
+	}
+	for name, values := range h.Header {
+		for _, v := range values {
+			req.Header.Add(name, repl.ReplaceKnown(v, ""))
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxWaitHTTPBody))
+	if err != nil {
+		return false
+	}
+	return h.matches(resp.StatusCode, body)
+}
+
+// matches reports whether a response with status and body is ready. An
+// up_status is ready and a retry_status isn't, before anything else is
+// looked at.
+func (h *WaitHTTP) matches(status int, body []byte) bool {
+	switch {
+	case slices.Contains(h.UpStatus, status):
+		return true
+	case slices.Contains(h.RetryStatus, status):
+		return false
+	}
+	if len(h.ExpectStatus) > 0 {
+		if !slices.Contains(h.ExpectStatus, status) {
+			return false
+		}
+	} else if status < 200 || status > 299 {
+		return false
+	}
+	if h.ExpectBodyContains != "" && !strings.Contains(string(body), h.ExpectBodyContains) {
+		return false
+	}
+	if h.bodyRegex != nil && !h.bodyRegex.Match(body) {
+		return false
+	}
+	if len(h.ExpectJSON) > 0 {
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return false
+		}
+		for path, want := range h.ExpectJSON {
+			got, ok := jsonPath(doc, path)
+			if !ok || !reflect.DeepEqual(got, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// jsonPath returns the value at the dot-separated path in doc, a decoded
+// JSON document.
+func jsonPath(doc any, path string) (any, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]any:
+			var ok bool
+			if doc, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// waitReady polls the readiness URL for t until it matches or ctx is done.
+func (h *WaitHTTP) waitReady(ctx context.Context, t Target) bool {
+	for {
+		if h.ready(ctx, t) {
+			return true
+		}
+		if sleepCtx(ctx, waitPollInterval) != nil {
+			return false
+		}
+	}
+}
+
+// parseWaitHTTP parses the wait_http block.
+func parseWaitHTTP(d *caddyfile.Dispenser) (*WaitHTTP, error) {
+	h := new(WaitHTTP)
+	if d.NextArg() {
+		h.URL = d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "url":
+			u, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			h.URL = u
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			if h.Header == nil {
+				h.Header = make(http.Header)
+			}
+			h.Header.Add(args[0], args[1])
+		case "expect_status", "up_status", "retry_status":
+			codes, err := parseStatusCodes(d)
+			if err != nil {
+				return nil, err
+			}
+			switch last {
+			case "expect_status":
+				h.ExpectStatus = append(h.ExpectStatus, codes...)
+			case "up_status":
+				h.UpStatus = append(h.UpStatus, codes...)
+			default:
+				h.RetryStatus = append(h.RetryStatus, codes...)
+			}
+		case "expect_body_contains":
+			s, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			h.ExpectBodyContains = s
+		case "expect_body_regex":
+			s, err := parseStringArg(d)
+			if err != nil {
+				return nil, err
+			}
+			h.ExpectBodyRegex = s
+		case "expect_json":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			// A value that isn't JSON, like ok, is the string
+			var want any
+			if err := json.Unmarshal([]byte(args[1]), &want); err != nil {
+				want = args[1]
+			}
+			if h.ExpectJSON == nil {
+				h.ExpectJSON = make(map[string]any)
+			}
+			h.ExpectJSON[args[0]] = want
+		case "timeout":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			h.Timeout = dur
+		default:
+			return nil, d.Errf("unrecognized wait_http subdirective '%s'", d.Val())
+		}
+	}
+	if h.URL == "" {
+		return nil, d.Err("wait_http requires a url")
+	}
+	return h, nil
+}
+
+// parseStatusCodes parses the status codes a subdirective lists, each a
+// code such as 401 or a class such as 4xx, which stands for all 100 codes.
+func parseStatusCodes(d *caddyfile.Dispenser) ([]int, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	var codes []int
+	for _, arg := range args {
+		if len(arg) == 3 && arg[0] >= '1' && arg[0] <= '5' && strings.EqualFold(arg[1:], "xx") {
+			first := int(arg[0]-'0') * 100
+			for code := first; code < first+100; code++ {
+				codes = append(codes, code)
+			}
+			continue
+		}
+		code, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, d.Errf("invalid status code '%s'", arg)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
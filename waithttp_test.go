@@ -0,0 +1,333 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestWaitHTTPConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    WaitHTTP
+		wantErr bool
+	}{
+		{name: "url argument", input: "wait_http http://192.0.2.1/ready", want: WaitHTTP{URL: "http://192.0.2.1/ready"}},
+		{
+			name:  "full",
+			input: "wait_http {\n\t\turl https://192.0.2.1/ready\n\t\theader Authorization \"Bearer {env.READY_TOKEN}\"\n\t\texpect_status 200 204\n\t\tup_status 401\n\t\tretry_status 5xx\n\t\texpect_body_contains \"\\\"ready\\\":true\"\n\t\texpect_body_regex \"up since [0-9]+\"\n\t\texpect_json status.ready true\n\t\texpect_json status.phase running\n\t\ttimeout 1s\n\t}",
+			want: WaitHTTP{
+				URL:                "https://192.0.2.1/ready",
+				Header:             http.Header{"Authorization": {"Bearer {env.READY_TOKEN}"}},
+				ExpectStatus:       []int{200, 204},
+				UpStatus:           []int{401},
+				RetryStatus:        statusRange(500),
+				ExpectBodyContains: `"ready":true`,
+				ExpectBodyRegex:    "up since [0-9]+",
+				ExpectJSON:         map[string]any{"status.ready": true, "status.phase": "running"},
+				Timeout:            caddy.Duration(time.Second),
+			},
+		},
+		{name: "placeholder host", input: "wait_http http://{wake.ip}:8080/ready", want: WaitHTTP{URL: "http://{wake.ip}:8080/ready"}},
+		{name: "env host", input: "wait_http https://{env.READY_HOST}/ready/{wake.target}", want: WaitHTTP{URL: "https://{env.READY_HOST}/ready/{wake.target}"}},
+		{name: "missing url", input: "wait_http {\n\t\ttimeout 1s\n\t}", wantErr: true},
+		{name: "relative url", input: "wait_http /ready", wantErr: true},
+		{name: "ftp url", input: "wait_http ftp://192.0.2.1/ready", wantErr: true},
+		{name: "two urls", input: "wait_http http://192.0.2.1/a http://192.0.2.1/b", wantErr: true},
+		{name: "header without value", input: "wait_http http://192.0.2.1/ready {\n\t\theader Authorization\n\t}", wantErr: true},
+		{name: "invalid status", input: "wait_http http://192.0.2.1/ready {\n\t\texpect_status ok\n\t}", wantErr: true},
+		{name: "status out of range", input: "wait_http http://192.0.2.1/ready {\n\t\texpect_status 600\n\t}", wantErr: true},
+		{name: "up and retry", input: "wait_http http://192.0.2.1/ready {\n\t\tup_status 503\n\t\tretry_status 503\n\t}", wantErr: true},
+		{name: "invalid regex", input: "wait_http http://192.0.2.1/ready {\n\t\texpect_body_regex (\n\t}", wantErr: true},
+		{name: "json without value", input: "wait_http http://192.0.2.1/ready {\n\t\texpect_json ready\n\t}", wantErr: true},
+		{name: "unknown subdirective", input: "wait_http http://192.0.2.1/ready {\n\t\tmethod HEAD\n\t}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\twait 30s\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(*w.WaitHTTP, tt.want) {
+				t.Errorf("wait_http = %+v, want %+v", *w.WaitHTTP, tt.want)
+			}
+		})
+	}
+}
+
+// statusRange returns the 100 status codes of the class starting at first.
+func statusRange(first int) []int {
+	var codes []int
+	for code := first; code < first+100; code++ {
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func TestWaitHTTPPlaceholderHostTargets(t *testing.T) {
+	w, err := parseTest("wake_on_lan {\n\ttarget 00:11:22:33:44:01 192.0.2.1\n\ttarget 00:11:22:33:44:02 192.0.2.2\n\twait 30s\n\twait_http http://{wake.ip}:8080/ready\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if got, want := w.WaitHTTP.URL, "http://{wake.ip}:8080/ready"; got != want {
+		t.Errorf("url = %q, want %q", got, want)
+	}
+	if len(w.Targets) != 2 {
+		t.Errorf("%d targets, want 2", len(w.Targets))
+	}
+}
+
+func TestWaitHTTPRequiresWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "with wait", input: "wait 30s\n\twait_http http://192.0.2.1/ready"},
+		{name: "without wait", input: "wait_http http://192.0.2.1/ready", wantErr: true},
+		{name: "with send_until_up", input: "wait 30s\n\tcheck 192.0.2.1:22\n\tsend_until_up\n\twait_http http://192.0.2.1/ready", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWaitHTTPMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		h      WaitHTTP
+		status int
+		body   string
+		want   bool
+	}{
+		{name: "any 2xx", status: http.StatusNoContent, want: true},
+		{name: "not 2xx", status: http.StatusServiceUnavailable},
+		{name: "expected status", h: WaitHTTP{ExpectStatus: []int{http.StatusTeapot}}, status: http.StatusTeapot, want: true},
+		{name: "unexpected status", h: WaitHTTP{ExpectStatus: []int{http.StatusTeapot}}, status: http.StatusOK},
+		{name: "up status", h: WaitHTTP{UpStatus: []int{http.StatusUnauthorized}, ExpectBodyContains: "ready"}, status: http.StatusUnauthorized, want: true},
+		{name: "retry status", h: WaitHTTP{RetryStatus: []int{http.StatusOK}}, status: http.StatusOK, body: "ready"},
+		{name: "contains", h: WaitHTTP{ExpectBodyContains: `"ready":true`}, status: http.StatusOK, body: `{"ready":true}`, want: true},
+		{name: "doesn't contain", h: WaitHTTP{ExpectBodyContains: `"ready":true`}, status: http.StatusOK, body: `{"ready":false}`},
+		{name: "regex", h: WaitHTTP{bodyRegex: regexp.MustCompile(`up since \d+`)}, status: http.StatusOK, body: "up since 42", want: true},
+		{name: "regex mismatch", h: WaitHTTP{bodyRegex: regexp.MustCompile(`up since \d+`)}, status: http.StatusOK, body: "starting"},
+		{name: "json", h: WaitHTTP{ExpectJSON: map[string]any{"status.ready": true, "nodes.1.state": "up"}}, status: http.StatusOK, body: `{"status":{"ready":true},"nodes":[{"state":"down"},{"state":"up"}]}`, want: true},
+		{name: "json mismatch", h: WaitHTTP{ExpectJSON: map[string]any{"status.ready": true}}, status: http.StatusOK, body: `{"status":{"ready":"true"}}`},
+		{name: "json missing", h: WaitHTTP{ExpectJSON: map[string]any{"status.ready": true}}, status: http.StatusOK, body: `{"status":{}}`},
+		{name: "json number", h: WaitHTTP{ExpectJSON: map[string]any{"replicas": float64(3)}}, status: http.StatusOK, body: `{"replicas":3}`, want: true},
+		{name: "not json", h: WaitHTTP{ExpectJSON: map[string]any{"ready": true}}, status: http.StatusOK, body: "ready"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.h.matches(tt.status, []byte(tt.body)); got != tt.want {
+				t.Errorf("matches(%d, %q) = %v, want %v", tt.status, tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	doc := map[string]any{
+		"status": map[string]any{"ready": true},
+		"nodes":  []any{"a", map[string]any{"state": "up"}},
+	}
+	tests := []struct {
+		path   string
+		want   any
+		wantOK bool
+	}{
+		{path: "status.ready", want: true, wantOK: true},
+		{path: "nodes.0", want: "a", wantOK: true},
+		{path: "nodes.1.state", want: "up", wantOK: true},
+		{path: "nodes.2"},
+		{path: "nodes.-1"},
+		{path: "nodes.first"},
+		{path: "status.ready.value"},
+		{path: "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := jsonPath(doc, tt.path)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jsonPath(%q) = %v, %v; want %v, %v", tt.path, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestServeHTTPWaitHTTP(t *testing.T) {
+	// The app answers 401 without the token, then reports not ready for
+	// readyAfter-1 polls
+	const token = "Bearer s3cret"
+	tests := []struct {
+		name       string
+		readyAfter int64
+		header     string
+		wantResult wakeResult
+		wantSent   bool
+	}{
+		{name: "already ready", readyAfter: 1, header: token, wantResult: resultAlreadyUp},
+		{name: "ready while waiting", readyAfter: 3, header: token, wantResult: resultWoken, wantSent: true},
+		{name: "never ready", readyAfter: 100, header: token, wantResult: resultWakeTimeout, wantSent: true},
+		{name: "wrong token", readyAfter: 1, header: "Bearer guess", wantResult: resultWakeTimeout, wantSent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls atomic.Int64
+			app := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != token {
+					rw.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if r.URL.Path != "/ready/nas" {
+					rw.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if polls.Add(1) < tt.readyAfter {
+					rw.Write([]byte(`{"ready":false}`))
+					return
+				}
+				rw.Write([]byte(`{"ready":true}`))
+			}))
+			t.Cleanup(app.Close)
+
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				Name: "nas",
+				MAC:  testMAC,
+				IP:   "127.0.0.1",
+				Port: host.port(),
+				Wait: caddy.Duration(2 * time.Second),
+				WaitHTTP: &WaitHTTP{
+					URL:                app.URL + "/ready/{wake.target}",
+					Header:             http.Header{"Authorization": {tt.header}},
+					ExpectBodyContains: `"ready":true`,
+				},
+				StatusHeader: "X-Wake-Result",
+			})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target=nas"; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			if tt.wantSent {
+				host.expect(t, 1)
+			}
+			host.expectNone(t)
+		})
+	}
+}
+
+func TestParseStatusCodes(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []int
+		wantErr bool
+	}{
+		{input: "up_status 401", want: []int{401}},
+		{input: "up_status 401 403", want: []int{401, 403}},
+		{input: "up_status 4xx", want: statusRange(400)},
+		{input: "up_status 4XX", want: statusRange(400)},
+		{input: "up_status 401\n\t\tup_status 403", want: []int{401, 403}},
+		{input: "up_status 6xx", wantErr: true},
+		{input: "up_status 4x", wantErr: true},
+		{input: "up_status", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\twait 30s\n\twait_http http://192.0.2.1/ready {\n\t\t" + tt.input + "\n\t}\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(w.WaitHTTP.UpStatus, tt.want) {
+				t.Errorf("up_status = %v, want %v", w.WaitHTTP.UpStatus, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPWaitHTTPStatuses(t *testing.T) {
+	// The app answers each poll with the next of statuses, repeating the
+	// last; the first poll is the check for whether it is already up
+	tests := []struct {
+		name     string
+		statuses []int
+		up       []int
+		retry    []int
+		expect   []int
+		// poll a closed port instead
+		refused    bool
+		wantResult wakeResult
+	}{
+		{name: "401 up", statuses: []int{503, 401}, up: statusRange(400), retry: statusRange(500), wantResult: resultWoken},
+		{name: "401 without up_status", statuses: []int{503, 401}, wantResult: resultWakeTimeout},
+		{name: "503 retried", statuses: []int{503, 503, 200}, retry: statusRange(500), wantResult: resultWoken},
+		{name: "503 retried over expect_status", statuses: []int{503}, expect: []int{503}, retry: []int{503}, wantResult: resultWakeTimeout},
+		{name: "503 expected", statuses: []int{500, 503}, expect: []int{503}, wantResult: resultWoken},
+		{name: "connection refused", refused: true, up: statusRange(400), wantResult: resultWakeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls atomic.Int64
+			app := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				i := min(int(polls.Add(1)), len(tt.statuses)) - 1
+				rw.WriteHeader(tt.statuses[i])
+			}))
+			t.Cleanup(app.Close)
+			url := app.URL + "/ready"
+			if tt.refused {
+				url = fmt.Sprintf("http://127.0.0.1:%d/ready", closedPort(t))
+			}
+
+			host := newFakeHost(t)
+			w := provisionTest(t, &WakeOnLAN{
+				MAC:  testMAC,
+				IP:   "127.0.0.1",
+				Port: host.port(),
+				Wait: caddy.Duration(1500 * time.Millisecond),
+				WaitHTTP: &WaitHTTP{
+					URL:          url,
+					UpStatus:     tt.up,
+					RetryStatus:  tt.retry,
+					ExpectStatus: tt.expect,
+				},
+				StatusHeader: "X-Wake-Result",
+			})
+			rec, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			host.expect(t, 1)
+			host.expectNone(t)
+		})
+	}
+}
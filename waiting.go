@@ -0,0 +1,168 @@
+package caddy_wakeonlan
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// defaultWaitingRefresh is how often the waiting page reloads.
+const defaultWaitingRefresh = 5 * time.Second
+
+// defaultWaitingPage is served when no page is configured.
+const defaultWaitingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{wake.refresh}">
+<title>Waking up</title>
+</head>
+<body>
+<p>Waking up {wake.targets}. This page reloads every {wake.refresh} seconds until it is ready.</p>
+</body>
+</html>
+`
+
+// WaitingPage is an interim page served while the targets boot. It is
+// refresh-based: each request checks the targets, and until all of them
+// are up it sends the packets and answers with the page, which the
+// browser reloads. Once they are up, requests go to the next handler.
+type WaitingPage struct {
+	// HTML file to serve. Its contents are read when the config loads.
+	File string `json:"file,omitempty"`
+	// Inline HTML to serve instead of a file.
+	HTML string `json:"html,omitempty"`
+	// How often the page is reloaded, sent in the Refresh and Retry-After
+	// headers and available as {wake.refresh}. Default: 5s.
+	Refresh caddy.Duration `json:"refresh,omitempty"`
+}
+
+// validateWaitingPage checks the waiting page and what it relies on.
+func (w *WakeOnLAN) validateWaitingPage() error {
+	p := w.WaitingPage
+	if p == nil {
+		return nil
+	}
+	if p.File != "" && p.HTML != "" {
+		return errors.New("waiting_page takes a file or inline HTML, not both")
+	}
+	if p.Refresh < 0 || (p.Refresh > 0 && time.Duration(p.Refresh) < time.Second) {
+		return fmt.Errorf("invalid waiting_page refresh %s: must be at least 1s", time.Duration(p.Refresh))
+	}
+	switch {
+	case w.Wait > 0 || len(w.Escalate) > 0:
+		return errors.New("waiting_page replaces wait and escalate")
+	case w.AfterResponse || w.FromBody || w.FromQuery != nil || w.WakeOnFailure || w.OnTimeout != "":
+		return errors.New("waiting_page cannot be combined with after_response, from_body, from_query, wake_on_failure or on_timeout")
+	}
+	for _, t := range w.allTargets() {
+		if t.Check == "" {
+			return errors.New("waiting_page requires a check address")
+		}
+	}
+	return nil
+}
+
+// provisionWaitingPage loads the page to serve.
+func (w *WakeOnLAN) provisionWaitingPage() error {
+	p := w.WaitingPage
+	if p == nil {
+		return nil
+	}
+	switch {
+	case p.File != "":
+		body, err := os.ReadFile(p.File)
+		if err != nil {
+			return fmt.Errorf("wake_on_lan: waiting_page: %w", err)
+		}
+		w.waitingBody = string(body)
+	case p.HTML != "":
+		w.waitingBody = p.HTML
+	default:
+		w.waitingBody = defaultWaitingPage
+	}
+	return nil
+}
+
+// serveWaiting wakes the targets without waiting for them and calls the
+// next handler if all of them were already up; otherwise it answers with
+// the waiting page.
+func (w *WakeOnLAN) serveWaiting(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler, targets []Target, logger *zap.Logger) error {
+	results, failure, err := w.wakeTargets(rw, r, targets, logger)
+	if w.failsRequest(err) {
+		return w.failWake(rw, r, failure, err)
+	}
+	if allUp(results) {
+		return next.ServeHTTP(rw, r)
+	}
+
+	refresh := time.Duration(w.WaitingPage.Refresh)
+	if refresh == 0 {
+		refresh = defaultWaitingRefresh
+	}
+	seconds := strconv.Itoa(int(refresh / time.Second))
+	labels := make([]string, len(targets))
+	for i, t := range targets {
+		labels[i] = t.label()
+	}
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	repl.Set("wake.refresh", seconds)
+	repl.Set("wake.targets", strings.Join(labels, ", "))
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Refresh", seconds)
+	rw.Header().Set("Retry-After", seconds)
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = rw.Write([]byte(repl.ReplaceKnown(w.waitingBody, "")))
+	return err
+}
+
+// parseWaitingPage parses the waiting_page subdirective. Its argument is
+// inline HTML if it contains a '<', and a file otherwise.
+func parseWaitingPage(d *caddyfile.Dispenser) (*WaitingPage, error) {
+	p := new(WaitingPage)
+	if d.NextArg() {
+		if strings.Contains(d.Val(), "<") {
+			p.HTML = d.Val()
+		} else {
+			p.File = d.Val()
+		}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	var last string
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "{" {
+			return nil, blockNotAccepted(d, last)
+		}
+		last = d.Val()
+		switch d.Val() {
+		case "refresh":
+			dur, err := parseDurationArg(d)
+			if err != nil {
+				return nil, err
+			}
+			p.Refresh = dur
+		default:
+			return nil, d.Errf("unrecognized waiting_page subdirective '%s'", d.Val())
+		}
+	}
+	return p, nil
+}
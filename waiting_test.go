@@ -0,0 +1,128 @@
+package caddy_wakeonlan
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestWaitingPageConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    WaitingPage
+		wantErr bool
+	}{
+		{name: "default", input: "waiting_page", want: WaitingPage{}},
+		{name: "file", input: "waiting_page /srv/waking.html {\n\t\trefresh 10s\n\t}", want: WaitingPage{File: "/srv/waking.html", Refresh: caddy.Duration(10 * time.Second)}},
+		{name: "inline", input: "waiting_page \"<p>Waking {wake.targets}</p>\"", want: WaitingPage{HTML: "<p>Waking {wake.targets}</p>"}},
+		{name: "short refresh", input: "waiting_page {\n\t\trefresh 500ms\n\t}", wantErr: true},
+		{name: "two arguments", input: "waiting_page a.html b.html", wantErr: true},
+		{name: "unknown", input: "waiting_page {\n\t\tstatus 200\n\t}", wantErr: true},
+		{name: "with wait", input: "waiting_page\n\twait 30s", wantErr: true},
+		{name: "with on_timeout", input: "waiting_page\n\ton_timeout next", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\tcheck 192.0.2.1:80\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *w.WaitingPage != tt.want {
+				t.Errorf("waiting_page = %+v, want %+v", *w.WaitingPage, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitingPageRequiresCheck(t *testing.T) {
+	w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\twaiting_page\n}")
+	if err == nil {
+		err = w.Validate()
+	}
+	if err == nil {
+		t.Error("waiting_page accepted without a check address")
+	}
+}
+
+func TestServeHTTPWaitingPage(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "waking.html")
+	if err := os.WriteFile(file, []byte("<p>{wake.targets} boots, back in {wake.refresh}s</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		page        WaitingPage
+		method      string
+		up          bool
+		wantStatus  int
+		wantRefresh string
+		wantBody    string
+	}{
+		{name: "default page", method: "GET", wantStatus: http.StatusServiceUnavailable, wantRefresh: "5", wantBody: "Waking up nas. This page reloads every 5 seconds"},
+		{name: "file", page: WaitingPage{File: file, Refresh: caddy.Duration(2 * time.Second)}, method: "GET", wantStatus: http.StatusServiceUnavailable, wantRefresh: "2", wantBody: "<p>nas boots, back in 2s</p>"},
+		{name: "inline", page: WaitingPage{HTML: "<p>wait</p>"}, method: "GET", wantStatus: http.StatusServiceUnavailable, wantRefresh: "5", wantBody: "<p>wait</p>"},
+		{name: "head", method: "HEAD", wantStatus: http.StatusServiceUnavailable, wantRefresh: "5"},
+		{name: "up", method: "GET", up: true, wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			check := fmt.Sprintf("127.0.0.1:%d", closedPort(t))
+			if tt.up {
+				check = newTCPHost(t).addr()
+			}
+			page := tt.page
+			w := provisionTest(t, &WakeOnLAN{Name: "nas", MAC: testMAC, IP: "127.0.0.1", Port: host.port(), Check: check, WaitingPage: &page})
+
+			rec := httptest.NewRecorder()
+			next := new(nextHandler)
+			err := w.ServeHTTP(rec, newTestRequest(tt.method, "http://example.com/", nil), next)
+			if got := statusOf(rec, err); got != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+			if next.called != tt.up {
+				t.Errorf("next called = %v, want %v", next.called, tt.up)
+			}
+			if tt.up {
+				host.expectNone(t)
+				return
+			}
+			host.expect(t, 1)
+			for _, header := range []string{"Refresh", "Retry-After"} {
+				if got := rec.Header().Get(header); got != tt.wantRefresh {
+					t.Errorf("%s = %q, want %q", header, got, tt.wantRefresh)
+				}
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+			if tt.wantBody == "" && rec.Body.Len() > 0 {
+				t.Errorf("body %q, want none", rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body %q, want it to contain %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestProvisionWaitingPageMissingFile(t *testing.T) {
+	w := &WakeOnLAN{MAC: testMAC, IP: "192.0.2.1", Check: "192.0.2.1:80", WaitingPage: &WaitingPage{File: filepath.Join(t.TempDir(), "none.html")}}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+	if err := w.Provision(ctx); err == nil {
+		w.Cleanup()
+		t.Error("provisioned with a missing waiting_page file")
+	}
+}
@@ -0,0 +1,419 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// wakeResult describes the outcome of waking a single target.
+type wakeResult string
+
+const (
+	// The check address was already reachable, so nothing was sent.
+	resultAlreadyUp wakeResult = "already_up"
+	// The packet was sent and no wait was configured.
+	resultSent wakeResult = "sent"
+	// The packet was sent and the check address came up within the wait.
+	resultWoken wakeResult = "woken"
+	// The packet was sent but the check address stayed down for the whole wait.
+	resultWakeTimeout wakeResult = "wake_timeout"
+	// The MAC to wake could not be determined (e.g. no neighbor entry for
+	// an "auto" MAC).
+	resultMACResolveFailed wakeResult = "mac_resolve_failed"
+	// The packet could not be delivered (lookup, dial or write failed).
+	resultSendFailed wakeResult = "send_failed"
+	// Nothing was sent because the target's send rate was exhausted.
+	resultRateLimited wakeResult = "rate_limited"
+	// Nothing was sent because max_concurrent_wakes were already running.
+	resultBusy wakeResult = "busy"
+	// The wake was interrupted for another reason, e.g. the config was
+	// unloaded.
+	resultError wakeResult = "error"
+	// The client went away and cancel_on_client_disconnect ended the wake.
+	resultClientDisconnected wakeResult = "client_disconnected"
+)
+
+// errClientDisconnected ends the wakes of a client that went away, with
+// cancel_on_client_disconnect.
+var errClientDisconnected = errors.New("client disconnected")
+
+// wakeContext returns the context the request's wakes run in: the
+// request's own with cancel_on_client_disconnect, otherwise one that keeps
+// its values but outlives it, until the config is unloaded.
+func (w *WakeOnLAN) wakeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if w.CancelOnClientDisconnect {
+		return context.WithCancel(r.Context())
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	if w.ctx.Context == nil {
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(w.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// failed reports whether the result means no packet went out.
+func (r wakeResult) failed() bool {
+	return r == resultMACResolveFailed || r == resultSendFailed || r == resultRateLimited || r == resultBudgetExhausted || r == resultBusy || r == resultError || r == resultDependencyDown || r == resultFuseBlown
+}
+
+// status returns the HTTP status a required wake fails with: 500 when the
+// problem is the configuration or MAC resolution, 502 when the network
+// send failed, 429 when rate limited or out of wake budget, and 503 when
+// too many wakes are running or max_lifetime_packets was reached. A wake
+// denied by the authorize route gets 403, one whose dependency didn't come
+// up 424, and one whose host didn't 504.
+func (r wakeResult) status() int {
+	switch r {
+	case resultBusy, resultFuseBlown:
+		return http.StatusServiceUnavailable
+	case resultSendFailed:
+		return http.StatusBadGateway
+	case resultWakeTimeout, resultGroupFailed:
+		return http.StatusGatewayTimeout
+	case resultRateLimited, resultBudgetExhausted:
+		return http.StatusTooManyRequests
+	case resultDenied:
+		return http.StatusForbidden
+	case resultDependencyDown:
+		return http.StatusFailedDependency
+	}
+	return http.StatusInternalServerError
+}
+
+// failureResult classifies an error from sending packets.
+func failureResult(err error) wakeResult {
+	if errors.Is(err, errFuseBlown) {
+		return resultFuseBlown
+	}
+	var macErr macResolveError
+	if errors.Is(err, ErrParseMAC) || errors.As(err, &macErr) {
+		return resultMACResolveFailed
+	}
+	if errors.Is(err, context.Canceled) {
+		return resultError
+	}
+	return resultSendFailed
+}
+
+// wake wakes one target, sharing the operation with concurrent requests
+// for the same target when a grace period is configured, and with those
+// arriving close together when a batch window is.
+func (w *WakeOnLAN) wake(ctx context.Context, t Target, logger *zap.Logger) (result wakeResult, err error) {
+	ctx, span := startSpan(ctx, "wake_on_lan.target", targetAttributes(t)...)
+	defer func() { endSpan(span, result, err) }()
+	if w.boot != nil {
+		if w.boot.state(t.key()) == bootUp {
+			logger.Debug("target woken since it last went down; not sending", zap.String("target", t.label()))
+			return resultAlreadyUp, nil
+		}
+		defer func() { w.boot.record(t.key(), w.bootProbe(t), result) }()
+	}
+	if w.confirmed != nil {
+		if w.confirmed.fresh(t.key()) {
+			logger.Debug("target confirmed up recently; not probing", zap.String("target", t.label()))
+			return resultAlreadyUp, nil
+		}
+		defer func() { w.confirmed.record(t.key(), result) }()
+	}
+	run := func(ctx context.Context) (wakeResult, error) {
+		if w.GracePeriod <= 0 {
+			return w.wakeOnce(ctx, t, true, logger)
+		}
+		return w.coordinator.run(ctx, t.key(), time.Duration(w.GracePeriod), logger.With(zap.String("target", t.label())), func(ctx context.Context, send bool) (wakeResult, error) {
+			return w.wakeOnce(ctx, t, send, logger)
+		})
+	}
+	if w.BatchWindow > 0 {
+		return w.batcher.run(ctx, t.key(), time.Duration(w.BatchWindow), logger.With(zap.String("target", t.label())), run)
+	}
+	return run(ctx)
+}
+
+// wakeAfterResponse wakes targets once the response has been written. The
+// request context is done by then, so the wake is bounded by the module
+// context instead and stops when the config is unloaded.
+func (w *WakeOnLAN) wakeAfterResponse(targets []Target, src auditSource, logger *zap.Logger) {
+	w.eachTarget(w.ctx, len(targets), func(i int) {
+		result, err := w.wake(w.ctx, targets[i], logger)
+		w.record(logger, targets[i], result, err)
+		w.audit(src, targets[i], result, err)
+	})
+}
+
+// wakeOnce runs the full sequence for one target: skip it if it is already
+// up, send the packet(s) unless send is false, then optionally wait for it
+// to come up.
+func (w *WakeOnLAN) wakeOnce(ctx context.Context, t Target, send bool, logger *zap.Logger) (wakeResult, error) {
+	logger = logger.With(zap.String("target", t.label()))
+	checkTimeout := time.Duration(w.CheckTimeout)
+	switch {
+	case t.Check != "" && w.probe(ctx, t.Check, checkTimeout):
+		if w.ready(ctx, t) {
+			logger.Debug("target already up", zap.String("check", t.Check))
+			return resultAlreadyUp, nil
+		}
+		// Awake but still starting: another packet would change nothing
+		logger.Debug("target up but not ready yet; only waiting", zap.String("check", t.Check))
+		send = false
+	case w.confirmsByARP(t) && w.probeARP(ctx, t, checkTimeout):
+		if w.ready(ctx, t) {
+			logger.Debug("target already up", zap.String("neighbor", t.IP))
+			return resultAlreadyUp, nil
+		}
+		logger.Debug("target up but not ready yet; only waiting", zap.String("neighbor", t.IP))
+		send = false
+	case t.Check == "" && !w.confirmsByARP(t) && w.WaitHTTP != nil && w.ready(ctx, t):
+		logger.Debug("target already up", zap.String("wait_http", w.WaitHTTP.URL))
+		return resultAlreadyUp, nil
+	case t.Check == "" && !w.confirmsByARP(t) && w.WaitHTTP == nil && len(w.ConfirmExec) > 0 && w.ready(ctx, t):
+		logger.Debug("target already up", zap.String("confirm_exec", w.ConfirmExec[0]))
+		return resultAlreadyUp, nil
+	}
+	if send && w.InitialDelay > 0 {
+		// Before taking a wake slot, which would sit idle meanwhile
+		logger.Debug("delaying the first packet", zap.Duration("initial_delay", time.Duration(w.InitialDelay)))
+		if err := sleepCtx(ctx, time.Duration(w.InitialDelay)); err != nil {
+			return resultError, err
+		}
+	}
+	release, err := w.app.acquireWake(ctx)
+	if errors.Is(err, errTooManyWakes) {
+		return resultBusy, err
+	} else if err != nil {
+		return resultError, err
+	}
+	defer release()
+	if send && !takeBudget(ctx) {
+		return resultBudgetExhausted, errBudgetExhausted
+	}
+	if send && w.SharedLimit != nil {
+		// After the budget, so a wake the budget skips doesn't count as one
+		if err := w.claimSharedLimit(ctx, t, logger); err != nil {
+			if ctx.Err() != nil {
+				return resultError, err
+			}
+			return resultRateLimited, err
+		}
+	}
+	if send && w.limiters != nil && !w.limiters.allow(t.key()) {
+		// Last, so a wake another check skips doesn't take a token
+		return resultRateLimited, errRateLimited
+	}
+	if w.SendUntilUp != nil {
+		return w.sendUntilUp(ctx, t, send, logger)
+	}
+	if len(w.Escalate) > 0 && t.Check != "" {
+		return w.escalate(ctx, t, send, logger)
+	}
+	if w.BroadcastFallback != nil && t.Check != "" {
+		return w.broadcastFallback(ctx, t, send, logger)
+	}
+
+	// Listen before sending, so a host quick to announce itself isn't missed
+	var heard <-chan struct{}
+	if w.ConfirmListen != nil && w.Wait > 0 {
+		ch, release, err := w.ConfirmListen.listen(t)
+		if err != nil {
+			logger.Warn("can't listen for the wake confirmation; the target won't count as up", zap.Error(err))
+		} else {
+			defer release()
+			heard = ch
+		}
+	}
+
+	sentAt := time.Now()
+	var acked, txConfirmed bool
+	if send {
+		opts := w.sendOptions()
+		var tx *txCount
+		if w.ConfirmTX && t.BMC == nil {
+			tx = w.startTXCount(ctx, t, opts, logger)
+		}
+		var ackHeard <-chan struct{}
+		if w.Ack != nil {
+			trailer, ch, release, err := w.Ack.listen()
+			if err != nil {
+				logger.Warn("can't listen for the agent's ack; sending without one", zap.Error(err))
+			} else {
+				defer release()
+				opts.AckTrailer, ackHeard = trailer, ch
+			}
+		}
+		sendCtx, span := startSpan(ctx, "wake_on_lan.send", attribute.Int("wake_on_lan.repeat", t.Repeat))
+		var err error
+		if w.publisher != nil {
+			err = w.publish(sendCtx, t, logger)
+		} else if w.grpcConn != nil {
+			err = w.wakeGRPC(sendCtx, t, logger)
+		} else {
+			err = sendRepeated(sendCtx, t, opts, logger)
+		}
+		endSpan(span, "", err)
+		if err != nil {
+			return failureResult(err), err
+		}
+		txConfirmed = w.confirmTX(ctx, tx, t, logger)
+		if ackHeard != nil {
+			if acked = w.Ack.awaitAck(ctx, ackHeard); acked {
+				logger.Debug("packet acknowledged by the agent")
+			} else if w.logThrottle.allow(t.label(), "ack", zapcore.WarnLevel) {
+				logger.Warn("no ack from the agent; the packet may not have reached the target's segment")
+			}
+		}
+	} else {
+		logger.Debug("packet sent recently; only waiting")
+	}
+	// Without a wait, a packet sent by an earlier request within the grace
+	// period counts as sent for this one too.
+	if (t.Check == "" && w.WaitHTTP == nil && len(w.ConfirmExec) == 0 && !w.confirmsByARP(t) && w.ConfirmListen == nil) || w.Wait <= 0 {
+		if acked {
+			return resultAckReceived, nil
+		}
+		if txConfirmed {
+			return resultTXConfirmed, nil
+		}
+		return resultSent, nil
+	}
+
+	logger.Debug("waiting for target", zap.String("check", t.Check), zap.Duration("wait", time.Duration(w.Wait)))
+	waitCtx, span := startSpan(ctx, "wake_on_lan.wait", attribute.String("wake_on_lan.check", t.Check))
+	up := w.waitUp(waitCtx, t, checkTimeout, heard)
+	span.SetAttributes(attribute.Bool("wake_on_lan.up", up))
+	span.End()
+	if up {
+		if send {
+			// Only the request that sent knows when the packet went out
+			observeWakeDuration(t, sentAt)
+		}
+		return resultWoken, nil
+	}
+	return resultWakeTimeout, nil
+}
+
+// waitUp waits up to the wait for t to come up: for its check address to
+// accept connections or, with wait_arp and no check address, for its IP to
+// answer ARP, or to be learned anew with confirm_arp_learned. Then it waits
+// for heard to be closed by its datagram with confirm_listen, for the
+// readiness URL to match with wait_http and for confirm_exec to succeed.
+func (w *WakeOnLAN) waitUp(ctx context.Context, t Target, checkTimeout time.Duration, heard <-chan struct{}) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.Wait))
+	defer cancel()
+	if t.Check != "" && !waitTCP(ctx, t.Check, checkTimeout, time.Duration(w.Wait)) {
+		return false
+	}
+	if w.confirmsByARP(t) {
+		wait := w.waitARP
+		if w.ConfirmARPLearned {
+			wait = w.waitARPLearned
+		}
+		if !wait(ctx, t) {
+			return false
+		}
+	}
+	if w.ConfirmListen != nil {
+		if heard == nil {
+			return false
+		}
+		select {
+		case <-heard:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if w.WaitHTTP != nil && !w.WaitHTTP.waitReady(ctx, t) {
+		return false
+	}
+	return len(w.ConfirmExec) == 0 || w.waitConfirmExec(ctx, t)
+}
+
+// ready reports whether t, up at its check address or in the neighbor
+// table if confirmed by either, passes wait_http and confirm_exec once.
+func (w *WakeOnLAN) ready(ctx context.Context, t Target) bool {
+	if w.WaitHTTP != nil && !w.WaitHTTP.ready(ctx, t) {
+		return false
+	}
+	return len(w.ConfirmExec) == 0 || w.runConfirmExec(ctx, t)
+}
+
+// probe checks whether addr is up, in its own span.
+func (w *WakeOnLAN) probe(ctx context.Context, addr string, timeout time.Duration) bool {
+	ctx, span := startSpan(ctx, "wake_on_lan.check", attribute.String("wake_on_lan.check", addr))
+	defer span.End()
+	up := probeTCP(ctx, addr, timeout)
+	span.SetAttributes(attribute.Bool("wake_on_lan.up", up))
+	return up
+}
+
+// failsRequest reports whether a wake that ended with err fails the
+// request instead of passing it on: when required, when on_timeout error
+// or a group gave up, or when too many wakes were running to start this
+// one.
+func (w *WakeOnLAN) failsRequest(err error) bool {
+	return err != nil && (w.Required || errors.Is(err, errWakeTimeout) || errors.Is(err, errTooManyWakes) || errors.Is(err, errGroupFailed))
+}
+
+// record logs the outcome of a wake, counts it in the metrics and, unless
+// the target was already up, sends the webhook notification.
+func (w *WakeOnLAN) record(logger *zap.Logger, t Target, result wakeResult, err error) {
+	countResult(t, result)
+	recordAttempt(t, result)
+	if result != resultAlreadyUp && result != resultRateLimited && result != resultBudgetExhausted {
+		w.notify(logger, newNotifyEvent(t.label(), t.MAC, t.IP, t.Meta, result, err))
+	}
+	if result == resultSent || result == resultAckReceived || result == resultTXConfirmed || result == resultWoken {
+		w.runWakeExec(logger, t, result)
+	}
+
+	fields := []zap.Field{
+		zap.String("target", t.label()),
+		zap.String("mac", t.MAC),
+		zap.String("ip", t.IP),
+		zap.String("result", string(result)),
+	}
+	if result == resultRateLimited {
+		logger.Debug("wake-on-lan rate limited", fields...)
+		return
+	}
+	if result == resultBudgetExhausted {
+		logger.Debug("wake-on-lan budget for the request exhausted; not sending", fields...)
+		return
+	}
+	if result == resultBusy {
+		if w.logThrottle.allow(t.label(), string(result), zapcore.WarnLevel) {
+			logger.Warn("too many wake-on-lan wakes in progress; not sending", fields...)
+		}
+		return
+	}
+	var resolveErr hostResolveError
+	if errors.As(err, &resolveErr) {
+		// Usually a DNS hiccup; the name is looked up afresh next time
+		recordError(t.label(), result, err)
+		if w.logThrottle.allow(t.label(), "resolve", zapcore.WarnLevel) {
+			logger.Warn("resolving wake-on-lan target; retrying on the next request", append(fields, zap.Error(err))...)
+		}
+		return
+	}
+	if err != nil {
+		recordError(t.label(), result, err)
+		if !w.logThrottle.allow(t.label(), string(result), zapcore.ErrorLevel) {
+			return
+		}
+		msg := "sending wake-on-lan packet"
+		if result == resultMACResolveFailed {
+			msg = "resolving MAC for wake-on-lan"
+		}
+		logger.Error(msg, append(fields, zap.Error(err))...)
+		return
+	}
+	logger.Debug("wake-on-lan", fields...)
+}
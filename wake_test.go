@@ -0,0 +1,195 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestFailureResult(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want wakeResult
+	}{
+		{name: "MAC resolution", err: wakeError(ErrResolve, macResolveError{errors.New("no neighbor entry")}), want: resultMACResolveFailed},
+		{name: "invalid MAC", err: wakeError(ErrParseMAC, errors.New("invalid MAC")), want: resultMACResolveFailed},
+		{name: "host resolution", err: wakeError(ErrResolve, hostResolveError{errors.New("no such host")}), want: resultSendFailed},
+		{name: "send", err: fmt.Errorf("write: %w", errors.New("network is unreachable")), want: resultSendFailed},
+		{name: "cancelled", err: context.Canceled, want: resultError},
+		{name: "fuse", err: errFuseBlown, want: resultFuseBlown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureResult(tt.err); got != tt.want {
+				t.Errorf("failureResult(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWakeResultStatus(t *testing.T) {
+	tests := []struct {
+		result wakeResult
+		want   int
+	}{
+		{result: resultMACResolveFailed, want: http.StatusInternalServerError},
+		{result: resultError, want: http.StatusInternalServerError},
+		{result: resultSendFailed, want: http.StatusBadGateway},
+		{result: resultRateLimited, want: http.StatusTooManyRequests},
+		{result: resultBudgetExhausted, want: http.StatusTooManyRequests},
+		{result: resultBusy, want: http.StatusServiceUnavailable},
+		{result: resultFuseBlown, want: http.StatusServiceUnavailable},
+		{result: resultDenied, want: http.StatusForbidden},
+		{result: resultDependencyDown, want: http.StatusFailedDependency},
+		{result: resultWakeTimeout, want: http.StatusGatewayTimeout},
+		{result: resultGroupFailed, want: http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.result), func(t *testing.T) {
+			if got := tt.result.status(); got != tt.want {
+				t.Errorf("status() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		w          func(t *testing.T) *WakeOnLAN
+		wantResult wakeResult
+		wantStatus int
+	}{
+		{
+			// TEST-NET-1 isn't in the neighbor table
+			name:       "MAC resolution",
+			w:          func(*testing.T) *WakeOnLAN { return &WakeOnLAN{MAC: autoMAC, IP: "192.0.2.77"} },
+			wantResult: resultMACResolveFailed,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name: "send",
+			w: func(t *testing.T) *WakeOnLAN {
+				return &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: closedPort(t), Protocol: protocolTCP}
+			},
+			wantResult: resultSendFailed,
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		for _, required := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/required=%v", tt.name, required), func(t *testing.T) {
+				w := tt.w(t)
+				w.Required = required
+				w.StatusHeader = "X-Wake-Result"
+				w = provisionTest(t, w)
+				rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+				wantStatus := http.StatusNoContent
+				if required {
+					wantStatus = tt.wantStatus
+				}
+				if got := statusOf(rec, err); got != wantStatus {
+					t.Errorf("status %d, want %d", got, wantStatus)
+				}
+				if called == required {
+					t.Errorf("next handler called = %v", called)
+				}
+				if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+w.targets()[0].label(); got != want {
+					t.Errorf("status header %q, want %q", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestCancelOnClientDisconnectConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    bool
+		wantErr bool
+	}{
+		{input: "check 192.0.2.1:22\n\twait 30s", want: false},
+		{input: "check 192.0.2.1:22\n\twait 30s\n\tcancel_on_client_disconnect", want: true},
+		{input: "cancel_on_client_disconnect", want: true},
+		{input: "cancel_on_client_disconnect yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && w.CancelOnClientDisconnect != tt.want {
+				t.Errorf("cancel_on_client_disconnect = %v, want %v", w.CancelOnClientDisconnect, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPClientDisconnect(t *testing.T) {
+	const leaveAfter = 300 * time.Millisecond
+	tests := []struct {
+		name        string
+		cancel      bool
+		untilUp     bool
+		wantResult  wakeResult
+		wantPackets int
+		// bounds of how long ServeHTTP takes
+		wantMin, wantMax time.Duration
+	}{
+		{name: "wait", cancel: true, wantResult: resultClientDisconnected, wantPackets: 1, wantMax: time.Second},
+		{name: "wait carries on", wantResult: resultWakeTimeout, wantPackets: 1, wantMin: 2 * time.Second, wantMax: 3 * time.Second},
+		{name: "send_until_up", cancel: true, untilUp: true, wantResult: resultClientDisconnected, wantPackets: 1, wantMax: time.Second},
+		// A packet a second, until the duration cap
+		{name: "send_until_up carries on", untilUp: true, wantResult: resultWakeTimeout, wantPackets: 3, wantMin: 2 * time.Second, wantMax: 3500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			w := &WakeOnLAN{
+				MAC:                      testMAC,
+				IP:                       "127.0.0.1",
+				Port:                     host.port(),
+				CheckTimeout:             caddy.Duration(200 * time.Millisecond),
+				CancelOnClientDisconnect: tt.cancel,
+				StatusHeader:             "X-Wake-Result",
+			}
+			probe := fmt.Sprintf("127.0.0.1:%d", closedPort(t))
+			if tt.untilUp {
+				w.SendUntilUp = &SendUntilUp{Interval: caddy.Duration(time.Second), MaxDuration: caddy.Duration(2500 * time.Millisecond), Probe: probe}
+			} else {
+				w.Check = probe
+				w.Wait = caddy.Duration(2 * time.Second)
+			}
+			provisionTest(t, w)
+
+			r := newTestRequest("GET", "http://example.com/", nil)
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			time.AfterFunc(leaveAfter, cancel)
+			start := time.Now()
+			rec, _, err := serveTest(w, r.WithContext(ctx))
+			took := time.Since(start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if took < tt.wantMin || took > tt.wantMax {
+				t.Errorf("ServeHTTP took %s, want between %s and %s", took, tt.wantMin, tt.wantMax)
+			}
+			if got, want := rec.Header().Get("X-Wake-Result"), string(tt.wantResult)+"; target="+testMAC; got != want {
+				t.Errorf("result = %q, want %q", got, want)
+			}
+			host.expect(t, tt.wantPackets)
+			host.expectNone(t)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// Categories of failure to send a packet, for matching a WakeError with
+// errors.Is.
+var (
+	// The target's MAC could not be parsed.
+	ErrParseMAC = errors.New("wake_on_lan: parsing MAC")
+	// The target's host, SRV record or mDNS name, or its "auto" MAC,
+	// could not be looked up.
+	ErrResolve = errors.New("wake_on_lan: resolving")
+	// A socket could not be opened or connected.
+	ErrDial = errors.New("wake_on_lan: dialing")
+	// Writing the packet failed.
+	ErrWrite = errors.New("wake_on_lan: writing")
+	// Only part of the packet was written.
+	ErrShortWrite = errors.New("wake_on_lan: short write")
+)
+
+// WakeError is a failure to send a packet, in one of the categories above.
+// Its message is that of the underlying error.
+type WakeError struct {
+	// One of ErrParseMAC, ErrResolve, ErrDial, ErrWrite or ErrShortWrite.
+	Kind error
+	Err  error
+}
+
+func (e *WakeError) Error() string { return e.Err.Error() }
+func (e *WakeError) Unwrap() error { return e.Err }
+
+// Is reports whether target is the error's category.
+func (e *WakeError) Is(target error) bool { return target == e.Kind }
+
+// wakeError wraps err in kind, leaving nil, context errors and errors that
+// already have a category as they are.
+func wakeError(kind, err error) error {
+	var wakeErr *WakeError
+	if err == nil || errors.As(err, &wakeErr) || err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return &WakeError{Kind: kind, Err: err}
+}
+
+// deliveryError categorizes a failure to deliver a packet: a short write,
+// a failed dial, or any other failure while writing.
+func deliveryError(err error) error {
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, io.ErrShortWrite):
+		return wakeError(ErrShortWrite, err)
+	case errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "listen"):
+		return wakeError(ErrDial, err)
+	}
+	return wakeError(ErrWrite, err)
+}
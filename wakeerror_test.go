@@ -0,0 +1,150 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var wakeErrorKinds = []error{ErrParseMAC, ErrResolve, ErrDial, ErrWrite, ErrShortWrite}
+
+func TestWakeError(t *testing.T) {
+	cause := errors.New("no route to host")
+	for _, kind := range wakeErrorKinds {
+		t.Run(kind.Error(), func(t *testing.T) {
+			err := wakeError(kind, cause)
+			for _, other := range wakeErrorKinds {
+				if got := errors.Is(err, other); got != (other == kind) {
+					t.Errorf("errors.Is(err, %v) = %v, want %v", other, got, other == kind)
+				}
+			}
+			if !errors.Is(err, cause) {
+				t.Error("cause not unwrapped")
+			}
+			if err.Error() != cause.Error() {
+				t.Errorf("message = %q, want %q", err, cause)
+			}
+			var wakeErr *WakeError
+			if !errors.As(fmt.Errorf("sending: %w", err), &wakeErr) || wakeErr.Kind != kind {
+				t.Errorf("wrapped error isn't a %v WakeError", kind)
+			}
+			// An error keeps the category it was first given
+			if again := wakeError(ErrWrite, err); again != err {
+				t.Errorf("recategorized as %v", again)
+			}
+		})
+	}
+
+	for _, err := range []error{nil, context.Canceled, context.DeadlineExceeded} {
+		if got := wakeError(ErrWrite, err); got != err {
+			t.Errorf("wakeError(%v) = %v, want it unchanged", err, got)
+		}
+	}
+}
+
+func TestDeliveryError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "short write", err: fmt.Errorf("%w: wrote 40 of 102 bytes", io.ErrShortWrite), want: ErrShortWrite},
+		{name: "dial", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: ErrDial},
+		{name: "listen", err: &net.OpError{Op: "listen", Net: "udp", Err: errors.New("address already in use")}, want: ErrDial},
+		{name: "write", err: &net.OpError{Op: "write", Net: "udp", Err: errors.New("message too long")}, want: ErrWrite},
+		{name: "other", err: errors.New("sender failed"), want: ErrWrite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := deliveryError(tt.err); !errors.Is(err, tt.want) {
+				t.Errorf("deliveryError = %v, want it to match %v", err, tt.want)
+			}
+		})
+	}
+	if err := deliveryError(nil); err != nil {
+		t.Errorf("deliveryError(nil) = %v", err)
+	}
+}
+
+func TestSendWOLErrorKinds(t *testing.T) {
+	newFakeDNS(t, func(string, dnsmessage.Type, int) ([]net.IP, dnsmessage.RCode) {
+		return nil, dnsmessage.RCodeNameError
+	})
+	tests := []struct {
+		name   string
+		target Target
+		w      WakeOnLAN
+		// error the custom sender returns
+		sendErr error
+		want    error
+	}{
+		{name: "invalid MAC", target: Target{MAC: "00:11:22:33:44", IP: "127.0.0.1"}, want: ErrParseMAC},
+		{name: "unknown host", target: Target{MAC: testMAC, IP: "nas.example.com"}, want: ErrResolve},
+		{name: "auto MAC not found", target: Target{MAC: autoMAC, IP: "192.0.2.1"}, want: ErrResolve},
+		{name: "connection refused", target: Target{MAC: testMAC, IP: "127.0.0.1", Port: closedPort(t)}, w: WakeOnLAN{Protocol: protocolTCP}, want: ErrDial},
+		{name: "sender failed", target: Target{MAC: testMAC, IP: "127.0.0.1"}, sendErr: errors.New("queue full"), want: ErrWrite},
+		{name: "sender wrote part", target: Target{MAC: testMAC, IP: "127.0.0.1"}, sendErr: fmt.Errorf("%w: wrote 10 of 102 bytes", io.ErrShortWrite), want: ErrShortWrite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tt.w
+			w.MAC, w.IP = testMAC, "127.0.0.1"
+			if tt.sendErr != nil {
+				w.Transports = []string{registerTestSender(t, &recordingSender{err: tt.sendErr})}
+			}
+			provisionTest(t, &w)
+			// An empty neighbor table, so "auto" finds nothing
+			w.macCache, _, _ = newFakeNeighborCache()
+
+			err := sendWOL(t.Context(), tt.target, w.sendOptions())
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("sendWOL = %v, want it to match %v", err, tt.want)
+			}
+			for _, other := range wakeErrorKinds {
+				if other != tt.want && errors.Is(err, other) {
+					t.Errorf("error also matches %v", other)
+				}
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	newFakeDNS(t, func(string, dnsmessage.Type, int) ([]net.IP, dnsmessage.RCode) {
+		return nil, dnsmessage.RCodeNameError
+	})
+	host := newFakeHost(t)
+	if err := Send(t.Context(), Target{MAC: testMAC, IP: "127.0.0.1", Port: host.port()}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	host.expect(t, 1)
+
+	tests := []struct {
+		name   string
+		target Target
+		want   error
+	}{
+		{name: "invalid MAC", target: Target{MAC: "00:11:22:33:44", IP: "127.0.0.1"}, want: ErrParseMAC},
+		{name: "unknown host", target: Target{MAC: testMAC, IP: "nas.example.com"}, want: ErrResolve},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Send(t.Context(), tt.target)
+			var wakeErr *WakeError
+			if !errors.As(err, &wakeErr) || !errors.Is(err, tt.want) {
+				t.Errorf("Send = %v, want a WakeError matching %v", err, tt.want)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := Send(ctx, Target{MAC: testMAC, IP: "nas.example.com"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Send with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
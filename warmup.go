@@ -0,0 +1,70 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// warmUp looks up every static target's host name once, so the first wake
+// finds the answers in the system resolver's cache, and pins each target's
+// source port when a range is configured. Failures to reach a target are
+// only logged: it may be legitimately offline, and each send resolves
+// again anyway. Failures to bind a local socket, which no later send
+// would get past either, are returned to fail the config.
+func (w *WakeOnLAN) warmUp() error {
+	ctx, cancel := context.WithTimeout(w.ctx, defaultSendTimeout)
+	defer cancel()
+
+	if slices.Contains(w.transports, transportRawEthernet) && w.HelperSocket == "" {
+		if err := checkRawEthernet(w.RawInterface); err != nil {
+			return fmt.Errorf("wake_on_lan: warm-up: raw_interface: %w", err)
+		}
+	}
+	opts := w.sendOptions()
+	for _, t := range w.allTargets() {
+		logger := w.logger.With(zap.String("target", t.label()))
+		if t.SRV != "" {
+			var err error
+			if t, err = resolveSRVTarget(ctx, t); err != nil {
+				logger.Warn("warm-up: resolving target", zap.Error(err))
+				continue
+			}
+		}
+		if t.IP == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(t.IP); err == nil && w.sourcePorts == nil {
+			continue
+		}
+		addr, err := resolveUDPAddr(ctx, t.IP, portOrDefault(t.Port), opts.ResolveRetries, opts.ResolveBackoff, opts.Prefer)
+		if err != nil {
+			logger.Warn("warm-up: resolving target", zap.Error(err))
+			continue
+		}
+		if w.sourcePorts != nil {
+			conn, err := w.sourcePorts.dial(t.key(), addr)
+			if isLocalBindError(err) {
+				return fmt.Errorf("wake_on_lan: warm-up: target %s: binding source port: %w", t.label(), err)
+			} else if err != nil {
+				logger.Warn("warm-up: connecting to target", zap.Error(err))
+				continue
+			}
+			conn.Close()
+		}
+		logger.Debug("warmed up", zap.String("addr", addr.String()))
+	}
+	return nil
+}
+
+// isLocalBindError reports whether err is about the local end of a socket,
+// a port or address that can't be bound, rather than about the remote end.
+func isLocalBindError(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL) ||
+		errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM)
+}
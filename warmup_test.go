@@ -0,0 +1,232 @@
+package caddy_wakeonlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// freeUDPPort returns a UDP port nothing listens on.
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestWarmUpConfig(t *testing.T) {
+	w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\twarm_up\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.WarmUp {
+		t.Error("warm_up not set")
+	}
+	if _, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\twarm_up yes\n}"); err == nil {
+		t.Error("warm_up with an argument parsed")
+	}
+}
+
+func TestWarmUpResolves(t *testing.T) {
+	// Validate looks the name up once in any case
+	tests := []struct {
+		warmUp      bool
+		wantQueries int
+	}{
+		{warmUp: true, wantQueries: 2},
+		{warmUp: false, wantQueries: 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.warmUp), func(t *testing.T) {
+			dns := newFakeDNS(t, func(_ string, typ dnsmessage.Type, _ int) ([]net.IP, dnsmessage.RCode) {
+				if typ != dnsmessage.TypeA {
+					return nil, dnsmessage.RCodeSuccess
+				}
+				return []net.IP{net.IPv4(127, 0, 0, 1)}, dnsmessage.RCodeSuccess
+			})
+			before := dns.queries("nas.test.", dnsmessage.TypeA)
+			provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "nas.test.", WarmUp: tt.warmUp})
+			if got := dns.queries("nas.test.", dnsmessage.TypeA) - before; got != tt.wantQueries {
+				t.Errorf("looked up %d times, want %d", got, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestWarmUpUnresolvable(t *testing.T) {
+	// A name that stops resolving only logs a warning
+	var failing atomic.Bool
+	newFakeDNS(t, func(_ string, typ dnsmessage.Type, _ int) ([]net.IP, dnsmessage.RCode) {
+		if failing.Load() {
+			return nil, dnsmessage.RCodeNameError
+		}
+		if typ != dnsmessage.TypeA {
+			return nil, dnsmessage.RCodeSuccess
+		}
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, dnsmessage.RCodeSuccess
+	})
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "nas.test."})
+	logs := observeLogs(w)
+	failing.Store(true)
+	if err := w.warmUp(); err != nil {
+		t.Fatalf("warmUp: %v", err)
+	}
+	if logs.FilterMessage("warm-up: resolving target").Len() != 1 {
+		t.Error("no warning about the unresolvable target")
+	}
+}
+
+func TestWarmUpSockets(t *testing.T) {
+	t.Run("source port pinned", func(t *testing.T) {
+		port := freeUDPPort(t)
+		w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", SourcePortRange: fmt.Sprintf("%d-%d", port, port), WarmUp: true})
+		target := w.targets()[0]
+		w.sourcePorts.mu.Lock()
+		pinned, ok := w.sourcePorts.pins[target.key()]
+		w.sourcePorts.mu.Unlock()
+		if !ok || pinned != port {
+			t.Errorf("pinned port %d (%v), want %d", pinned, ok, port)
+		}
+	})
+
+	t.Run("broadcast socket open", func(t *testing.T) {
+		w := provisionTest(t, &WakeOnLAN{MAC: testMAC, Broadcast: "127.0.0.1", WarmUp: true})
+		if w.broadcastConn == nil {
+			t.Error("no broadcast socket after provision")
+		}
+	})
+
+	t.Run("source port taken", func(t *testing.T) {
+		// No later send could bind it either, so the config fails
+		taken, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer taken.Close()
+		port := taken.LocalAddr().(*net.UDPAddr).Port
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		w := &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", SourcePortRange: fmt.Sprintf("%d-%d", port, port), WarmUp: true}
+		err = w.Provision(ctx)
+		if err == nil {
+			w.Cleanup()
+			t.Fatal("provisioned with the only source port taken")
+		}
+	})
+
+	t.Run("first send uses the pinned port", func(t *testing.T) {
+		port := freeUDPPort(t)
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: conn.LocalAddr().(*net.UDPAddr).Port, SourcePortRange: fmt.Sprintf("%d-%d", port, port), WarmUp: true})
+		if _, _, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, from, err := conn.ReadFromUDP(make([]byte, 2048))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.Port != port {
+			t.Errorf("sent from port %d, want %d", from.Port, port)
+		}
+	})
+}
+
+func TestIsLocalBindError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "in use", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}, want: true},
+		{name: "not available", err: os.NewSyscallError("bind", syscall.EADDRNOTAVAIL), want: true},
+		{name: "permission", err: syscall.EACCES, want: true},
+		{name: "not permitted", err: syscall.EPERM, want: true},
+		{name: "unreachable", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, want: false},
+		{name: "refused", err: syscall.ECONNREFUSED, want: false},
+		{name: "nil", err: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLocalBindError(tt.err); got != tt.want {
+				t.Errorf("isLocalBindError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarmUpLocalFailures(t *testing.T) {
+	// Failures binding a local socket fail the config; failures reaching
+	// the target are only logged
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.LocalAddr().(*net.UDPAddr).Port
+	free := freeUDPPort(t)
+	tests := []struct {
+		name    string
+		w       *WakeOnLAN
+		rawOnly bool
+		wantErr string
+		wantLog string
+	}{
+		{
+			name:    "source port taken",
+			w:       &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", SourcePortRange: fmt.Sprintf("%d-%d", port, port)},
+			wantErr: "binding source port",
+		},
+		{
+			name:    "raw interface missing",
+			w:       &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Transports: []string{protocolUDP, transportRawEthernet}, RawInterface: "nosuchif0"},
+			rawOnly: true,
+			wantErr: "raw_interface",
+		},
+		{
+			// A link-local address without a zone can't be connected to
+			name:    "target unreachable",
+			w:       &WakeOnLAN{MAC: testMAC, IP: "fe80::1", SourcePortRange: fmt.Sprintf("%d-%d", free, free)},
+			wantLog: "warm-up: connecting to target",
+		},
+		{
+			name: "ready",
+			w:    &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", SourcePortRange: fmt.Sprintf("%d-%d", free, free)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rawOnly && !rawEthernetSupported {
+				t.Skip("raw ethernet is dropped on this platform")
+			}
+			w := provisionTest(t, tt.w)
+			logs := observeLogs(w)
+			err := w.warmUp()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("warmUp: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("warmUp = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if tt.wantLog != "" && logs.FilterMessage(tt.wantLog).Len() == 0 {
+				t.Errorf("no %q warning in %v", tt.wantLog, logs.All())
+			}
+		})
+	}
+}
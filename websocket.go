@@ -0,0 +1,29 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isWebSocketUpgrade reports whether r asks to open a WebSocket: an
+// HTTP/1.1 request whose Connection header lists "upgrade" and whose
+// Upgrade header lists "websocket" (RFC 6455), both compared without
+// regard to case, in any of their values.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken reports whether the comma-separated values of header name
+// include token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			// Upgrade tokens may carry a version, as in websocket/13
+			t, _, _ = strings.Cut(strings.TrimSpace(t), "/")
+			if strings.EqualFold(t, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
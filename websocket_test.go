@@ -0,0 +1,93 @@
+package caddy_wakeonlan
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOnWebSocketUpgradeConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "on_websocket_upgrade"},
+		{input: "on_websocket_upgrade yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			w, err := parseTest("wake_on_lan " + testMAC + " 192.0.2.1 {\n\t" + tt.input + "\n}")
+			if err == nil {
+				err = w.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !w.OnWebSocketUpgrade {
+				t.Error("on_websocket_upgrade not set")
+			}
+		})
+	}
+
+	w, err := parseTest("wake_on_lan {\n\tfrom_body\n\ton_websocket_upgrade\n}")
+	if err == nil {
+		err = w.Validate()
+	}
+	if err == nil {
+		t.Error("on_websocket_upgrade with from_body validated")
+	}
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection []string
+		upgrade    []string
+		want       bool
+	}{
+		{name: "handshake", connection: []string{"Upgrade"}, upgrade: []string{"websocket"}, want: true},
+		{name: "case", connection: []string{"UPGRADE"}, upgrade: []string{"WebSocket"}, want: true},
+		{name: "listed", connection: []string{"keep-alive, Upgrade"}, upgrade: []string{"h2c, websocket"}, want: true},
+		{name: "several values", connection: []string{"keep-alive", "upgrade"}, upgrade: []string{"websocket"}, want: true},
+		{name: "versioned", connection: []string{"upgrade"}, upgrade: []string{"websocket/13"}, want: true},
+		{name: "plain request"},
+		{name: "no Upgrade", connection: []string{"upgrade"}},
+		{name: "no Connection", upgrade: []string{"websocket"}},
+		{name: "keep-alive", connection: []string{"keep-alive"}, upgrade: []string{"websocket"}},
+		{name: "h2c", connection: []string{"upgrade"}, upgrade: []string{"h2c"}},
+		{name: "lookalike", connection: []string{"upgrade"}, upgrade: []string{"websockets"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest("GET", "http://example.com/", nil)
+			for _, v := range tt.connection {
+				r.Header.Add("Connection", v)
+			}
+			for _, v := range tt.upgrade {
+				r.Header.Add("Upgrade", v)
+			}
+			if got := isWebSocketUpgrade(r); got != tt.want {
+				t.Errorf("isWebSocketUpgrade = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPOnWebSocketUpgrade(t *testing.T) {
+	host := newFakeHost(t)
+	w := provisionTest(t, &WakeOnLAN{MAC: testMAC, IP: "127.0.0.1", Port: host.port(), OnWebSocketUpgrade: true})
+
+	rec, called, err := serveTest(w, newTestRequest("GET", "http://example.com/", nil))
+	if got := statusOf(rec, err); got != http.StatusNoContent || !called {
+		t.Errorf("plain request: status %d, next called %v; want %d and called", got, called, http.StatusNoContent)
+	}
+	host.expectNone(t)
+
+	r := newTestRequest("GET", "http://example.com/socket", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	rec, called, err = serveTest(w, r)
+	if got := statusOf(rec, err); got != http.StatusNoContent || !called {
+		t.Errorf("upgrade: status %d, next called %v; want %d and called", got, called, http.StatusNoContent)
+	}
+	host.expect(t, 1)
+}
@@ -0,0 +1,91 @@
+//go:build windows
+
+package caddy_wakeonlan
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestOpenBroadcastConnSetsOption(t *testing.T) {
+	conn, err := openBroadcastConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var on int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		on, sockErr = windows.GetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_BROADCAST)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	if on == 0 {
+		t.Error("SO_BROADCAST not set on the broadcast socket")
+	}
+}
+
+func TestBindInterfaceWindows(t *testing.T) {
+	lo, _ := loopbackAndOther(t)
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			conn, err := net.ListenPacket(network, "")
+			if err != nil {
+				t.Skip(err)
+			}
+			defer conn.Close()
+			raw, err := conn.(*net.UDPConn).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var bindErr error
+			if err := raw.Control(func(fd uintptr) {
+				bindErr = bindInterface(fd, network, lo)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if bindErr != nil {
+				t.Errorf("binding to %s: %v", lo, bindErr)
+			}
+		})
+	}
+
+	// An unknown interface is an error, not a silent fallback
+	conn, err := net.ListenPacket("udp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw, _ := conn.(*net.UDPConn).SyscallConn()
+	var bindErr error
+	raw.Control(func(fd uintptr) {
+		bindErr = bindInterface(fd, "udp4", "no-such-interface")
+	})
+	if bindErr == nil {
+		t.Error("bound to an unknown interface")
+	}
+}
+
+func TestWindowsNeighbors(t *testing.T) {
+	if err := neighborTableAvailable(); err != nil {
+		t.Fatalf("neighbor table not available: %v", err)
+	}
+	entries, err := windowsNeighbors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.ip.To16() == nil || len(e.hw) == 0 {
+			t.Errorf("malformed entry %+v", e)
+		}
+	}
+}